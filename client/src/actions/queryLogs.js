@@ -119,6 +119,7 @@ export const setLogsFilterRequest = createAction('SET_LOGS_FILTER_REQUEST');
  * @param filter
  * @param {string} filter.search
  * @param {string} filter.response_status 'QUERY' field of RESPONSE_FILTER object
+ * @param {string} filter.response_code one of RESPONSE_CODE_FILTER values
  * @returns function
  */
 export const setLogsFilter = (filter) => setLogsFilterRequest(filter);
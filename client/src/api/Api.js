@@ -37,7 +37,10 @@ class Api {
                     return false;
                 }
 
-                throw new Error(`${errorPath} | ${error.response.data} | ${error.response.status}`);
+                const { data } = error.response;
+                const message = data?.message ?? data;
+
+                throw new Error(`${errorPath} | ${message} | ${error.response.status}`);
             }
             throw new Error(`${errorPath} | ${error.message || error}`);
         }
@@ -524,6 +527,8 @@ class Api {
 
     QUERY_LOG_CLEAR = { path: 'querylog_clear', method: 'POST' };
 
+    GET_QUERY_LOG_ENTRY = { path: 'querylog', method: 'GET' };
+
     getQueryLog(params) {
         const { path, method } = this.GET_QUERY_LOG;
         // eslint-disable-next-line no-param-reassign
@@ -532,6 +537,11 @@ class Api {
         return this.makeRequest(url, method);
     }
 
+    getQueryLogEntry(id) {
+        const { path, method } = this.GET_QUERY_LOG_ENTRY;
+        return this.makeRequest(`${path}/${encodeURIComponent(id)}`, method);
+    }
+
     getQueryLogInfo() {
         const { path, method } = this.QUERY_LOG_INFO;
         return this.makeRequest(path, method);
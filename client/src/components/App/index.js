@@ -46,7 +46,7 @@ const ROUTES = [
         exact: true,
     },
     {
-        path: [`${MENU_URLS.logs}${getLogsUrlParams(':search?', ':response_status?')}`, MENU_URLS.logs],
+        path: [`${MENU_URLS.logs}${getLogsUrlParams(':search?', ':response_status?', ':response_code?')}`, MENU_URLS.logs],
         component: Logs,
     },
     {
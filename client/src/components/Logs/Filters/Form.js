@@ -9,6 +9,7 @@ import {
     DEBOUNCE_FILTER_TIMEOUT,
     DEFAULT_LOGS_FILTER,
     FORM_NAME,
+    RESPONSE_CODE_FILTER,
     RESPONSE_FILTER,
     RESPONSE_FILTER_QUERIES,
 } from '../../../helpers/constants';
@@ -91,6 +92,7 @@ renderFilterField.propTypes = {
 const FORM_NAMES = {
     search: 'search',
     response_status: 'response_status',
+    response_code: 'response_code',
 };
 
 const Form = (props) => {
@@ -106,7 +108,7 @@ const Form = (props) => {
     const history = useHistory();
 
     const {
-        response_status, search,
+        response_status, response_code, search,
     } = useSelector((state) => state?.form[FORM_NAME.LOGS_FILTER].values, shallowEqual);
 
     const [
@@ -117,16 +119,21 @@ const Form = (props) => {
     useEffect(() => {
         dispatch(setLogsFilter({
             response_status,
+            response_code,
             search: debouncedSearch,
         }));
 
-        history.replace(`${getLogsUrlParams(debouncedSearch, response_status)}`);
-    }, [response_status, debouncedSearch]);
+        history.replace(`${getLogsUrlParams(debouncedSearch, response_status, response_code)}`);
+    }, [response_status, response_code, debouncedSearch]);
 
     if (response_status && !(response_status in RESPONSE_FILTER_QUERIES)) {
         change(FORM_NAMES.response_status, DEFAULT_LOGS_FILTER[FORM_NAMES.response_status]);
     }
 
+    if (response_code && !RESPONSE_CODE_FILTER.includes(response_code)) {
+        change(FORM_NAMES.response_code, DEFAULT_LOGS_FILTER[FORM_NAMES.response_code]);
+    }
+
     const onInputClear = async () => {
         setIsLoading(true);
         setDebouncedSearch(DEFAULT_LOGS_FILTER[FORM_NAMES.search]);
@@ -184,6 +191,20 @@ const Form = (props) => {
                     }
                 </Field>
             </div>
+            <div className="field__select">
+                <Field
+                    name={FORM_NAMES.response_code}
+                    component="select"
+                    className={classNames('form-control custom-select custom-select--logs custom-select__arrow--left form-control--transparent', responseStatusClass)}
+                >
+                    <option value="">{t('all_response_codes')}</option>
+                    {RESPONSE_CODE_FILTER.map((code) => (
+                        <option key={code} value={code}>
+                            {code}
+                        </option>
+                    ))}
+                </Field>
+            </div>
         </form>
     );
 };
@@ -69,6 +69,7 @@ const Logs = () => {
 
     const {
         response_status: response_status_url_param,
+        response_code: response_code_url_param,
         search: search_url_param,
     } = queryString.parse(history.location.search);
 
@@ -84,6 +85,7 @@ const Logs = () => {
 
     const search = search_url_param || filter?.search || '';
     const response_status = response_status_url_param || filter?.response_status || '';
+    const response_code = response_code_url_param || filter?.response_code || '';
 
     const [isSmallScreen, setIsSmallScreen] = useState(window.innerWidth <= MEDIUM_SCREEN_SIZE);
     const [detailedDataCurrent, setDetailedDataCurrent] = useState({});
@@ -99,10 +101,11 @@ const Logs = () => {
             await dispatch(setFilteredLogs({
                 search,
                 response_status,
+                response_code,
             }));
             setIsLoading(false);
         })();
-    }, [response_status, search]);
+    }, [response_status, response_code, search]);
 
     const mediaQuery = window.matchMedia(`(max-width: ${MEDIUM_SCREEN_SIZE}px)`);
     const mediaQueryHandler = (e) => {
@@ -173,6 +176,7 @@ const Logs = () => {
         <Filters
                 filter={{
                     response_status,
+                    response_code,
                     search,
                 }}
                 setIsLoading={setIsLoading}
@@ -32,6 +32,11 @@ const checkboxes = [
         placeholder: 'disable_ipv6',
         subtitle: 'disable_ipv6_desc',
     },
+    {
+        name: 'block_doh_canary',
+        placeholder: 'block_doh_canary',
+        subtitle: 'block_doh_canary_desc',
+    },
 ];
 
 const customIps = [
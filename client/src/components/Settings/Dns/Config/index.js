@@ -16,6 +16,7 @@ const Config = () => {
         edns_cs_enabled,
         dnssec_enabled,
         disable_ipv6,
+        block_doh_canary,
         processingSetConfig,
     } = useSelector((state) => state.dnsConfig, shallowEqual);
 
@@ -38,6 +39,7 @@ const Config = () => {
                         blocking_ipv6,
                         edns_cs_enabled,
                         disable_ipv6,
+                        block_doh_canary,
                         dnssec_enabled,
                     }}
                     onSubmit={handleFormSubmit}
@@ -389,6 +389,7 @@ export const WHOIS_ICONS = {
 export const DEFAULT_LOGS_FILTER = {
     search: '',
     response_status: '',
+    response_code: '',
 };
 
 export const DEFAULT_LANGUAGE = 'en';
@@ -408,6 +409,7 @@ export const FILTERED_STATUS = {
     FILTERED_SAFE_SEARCH: 'FilteredSafeSearch',
     FILTERED_SAFE_BROWSING: 'FilteredSafeBrowsing',
     FILTERED_PARENTAL: 'FilteredParental',
+    FILTERED_DOH_CANARY: 'FilteredDoHCanary',
 };
 
 export const RESPONSE_FILTER = {
@@ -453,6 +455,12 @@ export const RESPONSE_FILTER = {
     },
 };
 
+/**
+ * The DNS response codes the query log can be filtered by.  The empty value
+ * means all of them.
+ */
+export const RESPONSE_CODE_FILTER = ['NOERROR', 'NXDOMAIN', 'SERVFAIL', 'REFUSED'];
+
 export const RESPONSE_FILTER_QUERIES = Object.values(RESPONSE_FILTER)
     .reduce((acc, { QUERY }) => {
         acc[QUERY] = QUERY;
@@ -508,6 +516,10 @@ export const FILTERED_STATUS_TO_META_MAP = {
         LABEL: RESPONSE_FILTER.BLOCKED_ADULT_WEBSITES.LABEL,
         COLOR: QUERY_STATUS_COLORS.YELLOW,
     },
+    [FILTERED_STATUS.FILTERED_DOH_CANARY]: {
+        LABEL: 'doh_canary',
+        COLOR: QUERY_STATUS_COLORS.RED,
+    },
 };
 
 export const DEFAULT_TIME_FORMAT = 'HH:mm:ss';
@@ -690,11 +690,13 @@ export const replaceZeroWithEmptyString = (value) => (parseInt(value, 10) === 0
 /**
  * @param {string} search
  * @param {string} [response_status]
+ * @param {string} [response_code]
  * @returns {string}
  */
-export const getLogsUrlParams = (search, response_status) => `?${queryString.stringify({
+export const getLogsUrlParams = (search, response_status, response_code) => `?${queryString.stringify({
     search: search || undefined,
     response_status: response_status || undefined,
+    response_code: response_code || undefined,
 })}`;
 
 export const processContent = (
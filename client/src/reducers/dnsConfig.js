@@ -49,6 +49,7 @@ const dnsConfig = handleActions(
         blocking_ipv6: DEFAULT_BLOCKING_IPV6,
         edns_cs_enabled: false,
         disable_ipv6: false,
+        block_doh_canary: true,
         dnssec_enabled: false,
         upstream_dns_file: '',
     },
@@ -0,0 +1,71 @@
+package aghalg
+
+// RingBuffer is a fixed-size buffer which overwrites the oldest element when a
+// new one is pushed into the full buffer.  It's not safe for concurrent use.
+type RingBuffer[T any] struct {
+	// buf is the underlying storage.
+	buf []T
+
+	// head is the index of the next element to write.
+	head int
+
+	// full is true if the buffer has been wrapped around.
+	full bool
+}
+
+// NewRingBuffer returns a new ring buffer of size.  size must be positive.
+func NewRingBuffer[T any](size int) (rb *RingBuffer[T]) {
+	if size <= 0 {
+		panic("aghalg: ring buffer size must be positive")
+	}
+
+	return &RingBuffer[T]{
+		buf: make([]T, size),
+	}
+}
+
+// Push adds v to rb, overwriting the oldest element if rb is full.
+func (rb *RingBuffer[T]) Push(v T) {
+	rb.buf[rb.head] = v
+	rb.head++
+	if rb.head == len(rb.buf) {
+		rb.head = 0
+		rb.full = true
+	}
+}
+
+// Len returns the number of elements in rb.
+func (rb *RingBuffer[T]) Len() (n int) {
+	if rb.full {
+		return len(rb.buf)
+	}
+
+	return rb.head
+}
+
+// Cap returns the maximum number of elements rb can hold.
+func (rb *RingBuffer[T]) Cap() (n int) {
+	return len(rb.buf)
+}
+
+// Clear removes all the elements from rb.  The references to the elements are
+// dropped, so that they can be collected.
+func (rb *RingBuffer[T]) Clear() {
+	var zero T
+	for i := range rb.buf {
+		rb.buf[i] = zero
+	}
+
+	rb.head, rb.full = 0, false
+}
+
+// Slice returns a copy of the elements of rb in the order from the oldest to
+// the newest.
+func (rb *RingBuffer[T]) Slice() (s []T) {
+	s = make([]T, 0, rb.Len())
+	if rb.full {
+		s = append(s, rb.buf[rb.head:]...)
+	}
+
+	return append(s, rb.buf[:rb.head]...)
+}
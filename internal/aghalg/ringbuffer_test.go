@@ -0,0 +1,46 @@
+package aghalg_test
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBuffer(t *testing.T) {
+	const size = 3
+
+	rb := aghalg.NewRingBuffer[int](size)
+
+	assert.Zero(t, rb.Len())
+	assert.Equal(t, size, rb.Cap())
+	assert.Empty(t, rb.Slice())
+
+	rb.Push(1)
+	rb.Push(2)
+
+	assert.Equal(t, 2, rb.Len())
+	assert.Equal(t, []int{1, 2}, rb.Slice())
+
+	rb.Push(3)
+
+	assert.Equal(t, size, rb.Len())
+	assert.Equal(t, []int{1, 2, 3}, rb.Slice())
+
+	rb.Push(4)
+	rb.Push(5)
+
+	assert.Equal(t, size, rb.Len())
+	assert.Equal(t, []int{3, 4, 5}, rb.Slice())
+
+	rb.Clear()
+
+	assert.Zero(t, rb.Len())
+	assert.Empty(t, rb.Slice())
+
+	rb.Push(6)
+
+	assert.Equal(t, []int{6}, rb.Slice())
+
+	assert.Panics(t, func() { aghalg.NewRingBuffer[int](0) })
+}
@@ -30,13 +30,6 @@ func OK(w http.ResponseWriter) {
 	}
 }
 
-// Error writes formatted message to w and also logs it.
-func Error(r *http.Request, w http.ResponseWriter, code int, format string, args ...any) {
-	text := fmt.Sprintf(format, args...)
-	log.Error("%s %s %s: %s", r.Method, r.Host, r.URL, text)
-	http.Error(w, text, code)
-}
-
 // UserAgent returns the ID of the service as a User-Agent string.  It can also
 // be used as the value of the Server HTTP header.
 func UserAgent() (ua string) {
@@ -0,0 +1,93 @@
+package aghhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// strictJSON is 1 if [DecodeJSON] rejects the unknown fields.  It must be
+// accessed atomically.
+var strictJSON uint32
+
+// SetStrictJSON sets if [DecodeJSON] rejects the requests with the fields
+// unknown to the HTTP API.
+func SetStrictJSON(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+
+	atomic.StoreUint32(&strictJSON, v)
+}
+
+// ErrBodyTooLarge is returned by [DecodeJSON] if the request body exceeds the
+// size limit.
+const ErrBodyTooLarge errors.Error = "request body is too large"
+
+// unknownFieldPrefix is the prefix of the error message returned by
+// [json.Decoder.Decode] for the unknown fields.
+const unknownFieldPrefix = "json: unknown field "
+
+// DecodeJSON decodes the JSON body of r into v.  The body must contain exactly
+// one JSON value.  The type mismatches and, if the strict decoding is enabled,
+// the unknown fields are returned as *FieldError, so that [Error] adds them to
+// the details of the response.  If v implements [Validator], it's validated
+// after decoding.
+func DecodeJSON(r *http.Request, v any) (err error) {
+	dec := json.NewDecoder(r.Body)
+	if atomic.LoadUint32(&strictJSON) == 1 {
+		dec.DisallowUnknownFields()
+	}
+
+	err = dec.Decode(v)
+	if err != nil {
+		return decodeError(err)
+	}
+
+	if dec.More() {
+		return errors.Error("unexpected data after the json value")
+	}
+
+	if val, ok := v.(Validator); ok {
+		return val.Validate()
+	}
+
+	return nil
+}
+
+// decodeError converts the error returned by [json.Decoder.Decode] into the
+// one suitable for the response.
+func decodeError(err error) (converted error) {
+	var typeErr *json.UnmarshalTypeError
+	var limitErr *aghio.LimitReachedError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value)
+		}
+
+		return &FieldError{
+			Err:   fmt.Errorf("%s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value),
+			Field: typeErr.Field,
+		}
+	case errors.As(err, &limitErr):
+		return fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, limitErr.Limit)
+	case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+		// The standard library doesn't provide a type for this error, see
+		// https://github.com/golang/go/issues/29035.
+		field := strings.Trim(strings.TrimPrefix(err.Error(), unknownFieldPrefix), `"`)
+
+		return &FieldError{
+			Err:   fmt.Errorf("unknown field %q", field),
+			Field: field,
+		}
+	default:
+		return err
+	}
+}
@@ -0,0 +1,101 @@
+package aghhttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type request struct {
+		Name     string `json:"name"`
+		Interval uint32 `json:"interval"`
+	}
+
+	testCases := []struct {
+		name       string
+		body       string
+		wantField  string
+		wantErrMsg string
+		strict     bool
+	}{{
+		name:       "valid",
+		body:       `{"name":"test","interval":1}`,
+		wantField:  "",
+		wantErrMsg: "",
+		strict:     true,
+	}, {
+		name:       "unknown_field",
+		body:       `{"name":"test","unknown":1}`,
+		wantField:  "",
+		wantErrMsg: "",
+		strict:     false,
+	}, {
+		name:       "unknown_field_strict",
+		body:       `{"name":"test","unknown":1}`,
+		wantField:  "unknown",
+		wantErrMsg: `unknown field "unknown"`,
+		strict:     true,
+	}, {
+		name:       "bad_type",
+		body:       `{"interval":"1"}`,
+		wantField:  "interval",
+		wantErrMsg: "interval: expected uint32, got string",
+		strict:     false,
+	}, {
+		name:       "out_of_range",
+		body:       `{"interval":-1}`,
+		wantField:  "interval",
+		wantErrMsg: "interval: expected uint32, got number -1",
+		strict:     false,
+	}, {
+		name:       "trailing_data",
+		body:       `{"name":"test"} {}`,
+		wantField:  "",
+		wantErrMsg: "unexpected data after the json value",
+		strict:     false,
+	}, {
+		name:       "trailing_space",
+		body:       "{\"name\":\"test\"}\n",
+		wantField:  "",
+		wantErrMsg: "",
+		strict:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aghhttp.SetStrictJSON(tc.strict)
+			t.Cleanup(func() { aghhttp.SetStrictJSON(false) })
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			err := aghhttp.DecodeJSON(r, &request{})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			if tc.wantField == "" {
+				return
+			}
+
+			fieldErr := &aghhttp.FieldError{}
+			require.ErrorAs(t, err, &fieldErr)
+
+			assert.Equal(t, tc.wantField, fieldErr.Field)
+		})
+	}
+
+	t.Run("too_large", func(t *testing.T) {
+		body, err := aghio.LimitReader(strings.NewReader(`{"name":"test"}`), 4)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/", body)
+		err = aghhttp.DecodeJSON(r, &request{})
+
+		assert.ErrorIs(t, err, aghhttp.ErrBodyTooLarge)
+	})
+}
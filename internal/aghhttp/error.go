@@ -0,0 +1,132 @@
+package aghhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ErrorResponse is the JSON error response of the HTTP API.
+type ErrorResponse struct {
+	// Code is the machine-readable code of the error derived from the HTTP
+	// status, for example "bad_request".
+	Code string `json:"code"`
+
+	// Message is the human-readable error message.
+	Message string `json:"message"`
+
+	// Details are the problems with the particular fields of the request, if
+	// any.
+	Details []*ErrorDetail `json:"details,omitempty"`
+}
+
+// ErrorDetail is the problem with a single field of the request.
+type ErrorDetail struct {
+	// Field is the name of the field as in the request.
+	Field string `json:"field"`
+
+	// Message is the human-readable description of the problem.
+	Message string `json:"message"`
+}
+
+// FieldError is the error caused by an invalid value of the field of the
+// request.  [Error] adds the details of the FieldErrors among its arguments to
+// the response.  Its message is the one of Err, so that wrapping an error into
+// a FieldError doesn't change the message.
+type FieldError struct {
+	// Err is the underlying error.
+	Err error
+
+	// Field is the name of the field as in the request.
+	Field string
+}
+
+// type check
+var _ error = (*FieldError)(nil)
+
+// Error implements the error interface for *FieldError.
+func (err *FieldError) Error() (msg string) {
+	return err.Err.Error()
+}
+
+// Unwrap implements the [errors.Wrapper] interface for *FieldError.
+func (err *FieldError) Unwrap() (unwrapped error) {
+	return err.Err
+}
+
+// legacyTextErrors is 1 if the errors are written as plain text.  It must be
+// accessed atomically.
+var legacyTextErrors uint32
+
+// SetLegacyTextErrors sets if [Error] writes the errors as plain text, as the
+// previous versions did, instead of [ErrorResponse].
+func SetLegacyTextErrors(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+
+	atomic.StoreUint32(&legacyTextErrors, v)
+}
+
+// errorCode returns the code of the error with the HTTP status code.
+func errorCode(code int) (errCode string) {
+	text := http.StatusText(code)
+	if text == "" {
+		return "error"
+	}
+
+	return strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(strings.ToLower(text))
+}
+
+// errorDetails returns the details of the FieldErrors among args.
+func errorDetails(args []any) (details []*ErrorDetail) {
+	for _, arg := range args {
+		err, ok := arg.(error)
+		if !ok {
+			continue
+		}
+
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			details = append(details, &ErrorDetail{
+				Field:   fieldErr.Field,
+				Message: fieldErr.Err.Error(),
+			})
+		}
+	}
+
+	return details
+}
+
+// Error writes formatted message to w and also logs it.  The message is
+// written as [ErrorResponse] unless the legacy plain text errors are enabled.
+func Error(r *http.Request, w http.ResponseWriter, code int, format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	log.Error("%s %s %s: %s", r.Method, r.Host, r.URL, text)
+
+	if atomic.LoadUint32(&legacyTextErrors) == 1 {
+		http.Error(w, text, code)
+
+		return
+	}
+
+	h := w.Header()
+	h.Set(HdrNameContentType, HdrValApplicationJSON)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(&ErrorResponse{
+		Code:    errorCode(code),
+		Message: text,
+		Details: errorDetails(args),
+	})
+	if err != nil {
+		log.Debug("writing error response: %s", err)
+	}
+}
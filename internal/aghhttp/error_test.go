@@ -0,0 +1,89 @@
+package aghhttp_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestError(t *testing.T) {
+	const errTest errors.Error = "test error"
+
+	fieldErr := &aghhttp.FieldError{Err: errTest, Field: "test_field"}
+
+	testCases := []struct {
+		want *aghhttp.ErrorResponse
+		name string
+		args []any
+		code int
+	}{{
+		want: &aghhttp.ErrorResponse{
+			Code:    "bad_request",
+			Message: "bad: 42",
+		},
+		name: "simple",
+		args: []any{42},
+		code: http.StatusBadRequest,
+	}, {
+		want: &aghhttp.ErrorResponse{
+			Code:    "unprocessable_entity",
+			Message: "bad: test error",
+			Details: []*aghhttp.ErrorDetail{{
+				Field:   "test_field",
+				Message: "test error",
+			}},
+		},
+		name: "field",
+		args: []any{fieldErr},
+		code: http.StatusUnprocessableEntity,
+	}, {
+		want: &aghhttp.ErrorResponse{
+			Code:    "internal_server_error",
+			Message: "bad: wrapped: test error",
+			Details: []*aghhttp.ErrorDetail{{
+				Field:   "test_field",
+				Message: "test error",
+			}},
+		},
+		name: "wrapped_field",
+		args: []any{errors.Annotate(fieldErr, "wrapped: %w")},
+		code: http.StatusInternalServerError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.org", nil)
+			w := httptest.NewRecorder()
+
+			aghhttp.Error(r, w, tc.code, "bad: %v", tc.args...)
+			require.Equal(t, tc.code, w.Code)
+
+			assert.Equal(t, aghhttp.HdrValApplicationJSON, w.Header().Get(aghhttp.HdrNameContentType))
+
+			resp := &aghhttp.ErrorResponse{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, resp)
+		})
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		aghhttp.SetLegacyTextErrors(true)
+		t.Cleanup(func() { aghhttp.SetLegacyTextErrors(false) })
+
+		r := httptest.NewRequest(http.MethodGet, "http://example.org", nil)
+		w := httptest.NewRecorder()
+
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad: %s", fieldErr)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		assert.Equal(t, "bad: test error\n", w.Body.String())
+	})
+}
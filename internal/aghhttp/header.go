@@ -9,6 +9,7 @@ const (
 	HdrNameAcceptEncoding           = "Accept-Encoding"
 	HdrNameAccessControlAllowOrigin = "Access-Control-Allow-Origin"
 	HdrNameAltSvc                   = "Alt-Svc"
+	HdrNameContentDisposition       = "Content-Disposition"
 	HdrNameContentEncoding          = "Content-Encoding"
 	HdrNameContentType              = "Content-Type"
 	HdrNameOrigin                   = "Origin"
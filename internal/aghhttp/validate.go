@@ -0,0 +1,46 @@
+package aghhttp
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/exp/constraints"
+)
+
+// Validator is a request, which checks the types and the ranges of its fields.
+// [DecodeJSON] validates the decoded values implementing it.
+type Validator interface {
+	// Validate returns an error if the request isn't valid.  The errors about
+	// the particular fields should be *FieldError, so that [Error] adds them to
+	// the details of the response.
+	Validate() (err error)
+}
+
+// ValidateRange returns a *FieldError if v isn't within [min, max].
+func ValidateRange[T constraints.Integer | constraints.Float](field string, v, min, max T) (err error) {
+	if v >= min && v <= max {
+		return nil
+	}
+
+	return &FieldError{
+		Err:   fmt.Errorf("%s: %v is out of range [%v, %v]", field, v, min, max),
+		Field: field,
+	}
+}
+
+// ValidatePort returns a *FieldError if port isn't a valid port number.  Zero
+// is considered valid, since it usually means a disabled or a default port.
+func ValidatePort(field string, port int) (err error) {
+	return ValidateRange(field, port, 0, math.MaxUint16)
+}
+
+// ValidateAll returns the first error returned by the validation functions.
+func ValidateAll(errs ...error) (err error) {
+	for _, err = range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
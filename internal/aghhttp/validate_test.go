@@ -0,0 +1,89 @@
+package aghhttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validatedRequest is a request implementing [aghhttp.Validator].
+type validatedRequest struct {
+	Port int `json:"port"`
+}
+
+// type check
+var _ aghhttp.Validator = (*validatedRequest)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for *validatedRequest.
+func (req *validatedRequest) Validate() (err error) {
+	return aghhttp.ValidatePort("port", req.Port)
+}
+
+func TestDecodeJSON_validator(t *testing.T) {
+	testCases := []struct {
+		name       string
+		body       string
+		wantErrMsg string
+	}{{
+		name:       "valid",
+		body:       `{"port":53}`,
+		wantErrMsg: "",
+	}, {
+		name:       "zero",
+		body:       `{"port":0}`,
+		wantErrMsg: "",
+	}, {
+		name:       "negative",
+		body:       `{"port":-1}`,
+		wantErrMsg: "port: -1 is out of range [0, 65535]",
+	}, {
+		name:       "too_large",
+		body:       `{"port":65536}`,
+		wantErrMsg: "port: 65536 is out of range [0, 65535]",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			err := aghhttp.DecodeJSON(r, &validatedRequest{})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			if tc.wantErrMsg == "" {
+				return
+			}
+
+			fieldErr := &aghhttp.FieldError{}
+			require.ErrorAs(t, err, &fieldErr)
+
+			assert.Equal(t, "port", fieldErr.Field)
+		})
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	assert.NoError(t, aghhttp.ValidateRange("ivl", 0.5, 0.0, 1.0))
+	assert.NoError(t, aghhttp.ValidateRange("ivl", uint32(1), 1, 1))
+
+	testutil.AssertErrorMsg(
+		t,
+		"ivl: 1.5 is out of range [0, 1]",
+		aghhttp.ValidateRange("ivl", 1.5, 0.0, 1.0),
+	)
+}
+
+func TestValidateAll(t *testing.T) {
+	assert.NoError(t, aghhttp.ValidateAll())
+	assert.NoError(t, aghhttp.ValidateAll(nil, nil))
+
+	testutil.AssertErrorMsg(
+		t,
+		"a: 2 is out of range [0, 1]",
+		aghhttp.ValidateAll(nil, aghhttp.ValidateRange("a", 2, 0, 1), aghhttp.ValidateRange("b", 2, 0, 1)),
+	)
+}
@@ -0,0 +1,152 @@
+// Package aghlog contains utilities for formatting the application log.
+package aghlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// Format is the format of the application log.
+type Format string
+
+// Valid Format values.
+const (
+	// FormatText is the default plain-text format of golibs/log.
+	FormatText Format = "text"
+
+	// FormatJSON is the format with a single JSON object per line.
+	FormatJSON Format = "json"
+)
+
+// entry is a single structured log entry.
+type entry struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Module   string `json:"module,omitempty"`
+	Func     string `json:"func,omitempty"`
+	Client   string `json:"client,omitempty"`
+	QName    string `json:"qname,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Msg      string `json:"msg"`
+}
+
+// JSONWriter is an io.Writer that converts the log lines written by golibs/log
+// into JSON objects, one per line.  The log flags must be set to 0 so that the
+// lines don't contain the timestamps, since JSONWriter adds its own.
+//
+// JSONWriter doesn't synchronize the writes, since the standard logger already
+// does that.
+type JSONWriter struct {
+	w   io.Writer
+	now func() (t time.Time)
+}
+
+// NewJSONWriter returns a new *JSONWriter that writes the converted lines into
+// w.
+func NewJSONWriter(w io.Writer) (jw *JSONWriter) {
+	return &JSONWriter{
+		w:   w,
+		now: time.Now,
+	}
+}
+
+// type check
+var _ io.Writer = (*JSONWriter)(nil)
+
+// Write implements the io.Writer interface for *JSONWriter.  p is expected to
+// be a single log line.
+func (jw *JSONWriter) Write(p []byte) (n int, err error) {
+	e := parseLine(string(bytes.TrimRight(p, "\n")))
+	e.Time = jw.now().Format(time.RFC3339Nano)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Don't wrap the error since there is no additional information.
+		return 0, err
+	}
+
+	_, err = jw.w.Write(append(b, '\n'))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// parseLine parses the log line in the golibs/log format:
+//
+//	[PID#GOID ][LEVEL] [FUNC(): ][MODULE: ]TEXT
+//
+// and returns the structured entry without the time set.
+func parseLine(line string) (e *entry) {
+	e = &entry{
+		Level: "info",
+	}
+
+	// Skip the process and goroutine identifiers which are added in the
+	// verbose mode.
+	if i := strings.IndexByte(line, ' '); i > 0 && strings.Contains(line[:i], "#") {
+		line = line[i+1:]
+	}
+
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			e.Level, line = line[1:i], line[i+2:]
+		}
+	}
+
+	if i := strings.Index(line, "(): "); i > 0 && !strings.Contains(line[:i], " ") {
+		e.Func, line = line[:i], line[i+4:]
+	}
+
+	if i := strings.Index(line, ": "); i > 0 && isModuleName(line[:i]) {
+		e.Module, line = line[:i], line[i+2:]
+	}
+
+	e.Msg = line
+	setFields(e, line)
+
+	return e
+}
+
+// isModuleName returns true if s looks like a name of the module used as the
+// prefix of log messages, e.g. "dnsforward" or "home".
+func isModuleName(s string) (ok bool) {
+	if s == "" || len(s) > 16 {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setFields fills the well-known fields of e from the "key=value" pairs of msg.
+func setFields(e *entry, msg string) {
+	for _, f := range strings.Fields(msg) {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			continue
+		}
+
+		v = strings.TrimRight(v, ",;")
+		switch k {
+		case "client":
+			e.Client = v
+		case "qname":
+			e.QName = v
+		case "duration":
+			e.Duration = v
+		default:
+			// Go on.
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package aghlog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	jw := NewJSONWriter(buf)
+	jw.now = func() (t time.Time) {
+		return time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		name string
+		line string
+		want string
+	}{{
+		name: "plain",
+		line: "[info] AdGuard Home is running\n",
+		want: `{"time":"2022-01-01T00:00:00Z","level":"info",` +
+			`"msg":"AdGuard Home is running"}` + "\n",
+	}, {
+		name: "module",
+		line: "[error] querylog: opening file: permission denied\n",
+		want: `{"time":"2022-01-01T00:00:00Z","level":"error",` +
+			`"module":"querylog","msg":"opening file: permission denied"}` + "\n",
+	}, {
+		name: "verbose_func",
+		line: "1234#56 [debug] github.com/pkg.Func(): some text\n",
+		want: `{"time":"2022-01-01T00:00:00Z","level":"debug",` +
+			`"func":"github.com/pkg.Func","msg":"some text"}` + "\n",
+	}, {
+		name: "fields",
+		line: "[debug] dnsforward: processed request client=1.2.3.4 " +
+			"qname=example.org. duration=1.5ms\n",
+		want: `{"time":"2022-01-01T00:00:00Z","level":"debug",` +
+			`"module":"dnsforward","client":"1.2.3.4","qname":"example.org.",` +
+			`"duration":"1.5ms","msg":"processed request client=1.2.3.4 ` +
+			`qname=example.org. duration=1.5ms"}` + "\n",
+	}, {
+		name: "not_module",
+		line: "[info] Go version: go1.18\n",
+		want: `{"time":"2022-01-01T00:00:00Z","level":"info",` +
+			`"msg":"Go version: go1.18"}` + "\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+
+			n, err := jw.Write([]byte(tc.line))
+			require.NoError(t, err)
+
+			assert.Equal(t, len(tc.line), n)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
@@ -47,6 +47,24 @@ func SetRlimit(val uint64) (err error) {
 	return setRlimit(val)
 }
 
+// OpenFilesNum returns the number of file descriptors opened by the current
+// process.
+func OpenFilesNum() (n uint64, err error) {
+	return openFilesNum()
+}
+
+// IsOwnedByCurrentUser returns true if the file described by fi is owned by the
+// effective user of the current process.
+func IsOwnedByCurrentUser(fi fs.FileInfo) (ok bool, err error) {
+	return isOwnedByCurrentUser(fi)
+}
+
+// MaxOpenFiles returns the soft limit of the number of file descriptors the
+// current process can open.
+func MaxOpenFiles() (n uint64, err error) {
+	return maxOpenFiles()
+}
+
 // HaveAdminRights checks if the current user has root (administrator) rights.
 func HaveAdminRights() (bool, error) {
 	return haveAdminRights()
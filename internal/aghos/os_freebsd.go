@@ -15,6 +15,16 @@ func setRlimit(val uint64) (err error) {
 	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
 }
 
+func maxOpenFiles() (n uint64, err error) {
+	var rlim syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(rlim.Cur), nil
+}
+
 func haveAdminRights() (bool, error) {
 	return os.Getuid() == 0, nil
 }
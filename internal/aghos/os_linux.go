@@ -18,6 +18,16 @@ func setRlimit(val uint64) (err error) {
 	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
 }
 
+func maxOpenFiles() (n uint64, err error) {
+	var rlim syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim)
+	if err != nil {
+		return 0, err
+	}
+
+	return rlim.Cur, nil
+}
+
 func haveAdminRights() (bool, error) {
 	// The error is nil because the platform-independent function signature
 	// requires returning an error.
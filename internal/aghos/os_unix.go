@@ -3,12 +3,40 @@
 package aghos
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
+func isOwnedByCurrentUser(fi fs.FileInfo) (ok bool, err error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("unexpected file info of type %T", fi.Sys())
+	}
+
+	return st.Uid == uint32(os.Geteuid()), nil
+}
+
+// openFilesNum counts the entries of /dev/fd, which on FreeBSD only shows all
+// the descriptors if fdescfs is mounted there.
+func openFilesNum() (n uint64, err error) {
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return 0, err
+	}
+
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	// Don't count the descriptor opened for reading the directory itself.
+	return uint64(len(entries) - 1), nil
+}
+
 func notifyReconfigureSignal(c chan<- os.Signal) {
 	signal.Notify(c, unix.SIGHUP)
 }
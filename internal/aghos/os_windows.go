@@ -3,6 +3,7 @@
 package aghos
 
 import (
+	"io/fs"
 	"os"
 	"os/signal"
 	"syscall"
@@ -14,6 +15,18 @@ func setRlimit(val uint64) (err error) {
 	return Unsupported("setrlimit")
 }
 
+func maxOpenFiles() (n uint64, err error) {
+	return 0, Unsupported("getrlimit")
+}
+
+func openFilesNum() (n uint64, err error) {
+	return 0, Unsupported("counting open files")
+}
+
+func isOwnedByCurrentUser(_ fs.FileInfo) (ok bool, err error) {
+	return false, Unsupported("checking file owner")
+}
+
 func haveAdminRights() (bool, error) {
 	var token windows.Token
 	h := windows.CurrentProcess()
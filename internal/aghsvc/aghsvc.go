@@ -0,0 +1,255 @@
+// Package aghsvc contains the utilities for managing the lifecycle of the
+// long-running parts of AdGuard Home, such as the DNS and DHCP servers.
+package aghsvc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Service is a long-running part of AdGuard Home, which can be started and
+// stopped.
+type Service interface {
+	// Start starts the service.  It does not block.
+	Start(ctx context.Context) (err error)
+
+	// Shutdown gracefully stops the service.  ctx is used to determine a
+	// timeout before returning without waiting for the service to stop.  If
+	// ctx is done before the service stops, calling Shutdown again waits for
+	// the same stop instead of starting another one.
+	Shutdown(ctx context.Context) (err error)
+}
+
+// type check
+var _ Service = (*FuncService)(nil)
+
+// FuncService is a [Service], which uses functions to start and stop.  It's
+// useful for adapting the modules, which don't support contexts.
+type FuncService struct {
+	// OnStart starts the service.  If nil, starting does nothing.
+	OnStart func() (err error)
+
+	// OnShutdown stops the service and blocks until it's stopped.  If nil,
+	// stopping does nothing.
+	OnShutdown func() (err error)
+
+	// Name is the name of the service used in the errors.
+	Name string
+
+	// mu protects stopping.
+	mu sync.Mutex
+
+	// stopping is the result of the latest OnShutdown called after the latest
+	// start, if any.
+	stopping *stopResult
+}
+
+// stopResult is the result of a call to OnShutdown.
+type stopResult struct {
+	// err is the error returned by OnShutdown.  It must only be read after
+	// done is closed.
+	err error
+
+	// done is closed when OnShutdown returns.
+	done chan struct{}
+}
+
+// Start implements the [Service] interface for *FuncService.  If ctx is done
+// before OnStart returns, Start returns the error of ctx and the service is
+// stopped with OnShutdown as soon as it starts.
+func (s *FuncService) Start(ctx context.Context) (err error) {
+	defer func() { err = errors.Annotate(err, "starting %s: %w", s.Name) }()
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.stopping = nil
+	s.mu.Unlock()
+
+	if s.OnStart == nil {
+		return nil
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer log.OnPanic("aghsvc: starting " + s.Name)
+
+		errCh <- s.OnStart()
+	}()
+
+	select {
+	case err = <-errCh:
+		return err
+	case <-ctx.Done():
+		go s.shutdownStarted(errCh)
+
+		return ctx.Err()
+	}
+}
+
+// shutdownStarted stops the service after OnStart sends its result to errCh,
+// unless it has failed to start.  It's used when the context of Start is done
+// before the service starts.
+func (s *FuncService) shutdownStarted(errCh <-chan error) {
+	defer log.OnPanic("aghsvc: stopping " + s.Name)
+
+	if <-errCh != nil || s.OnShutdown == nil {
+		return
+	}
+
+	err := s.OnShutdown()
+	if err != nil {
+		log.Error("aghsvc: stopping %s started after cancellation: %s", s.Name, err)
+	}
+}
+
+// Shutdown implements the [Service] interface for *FuncService.  If ctx is
+// done before OnShutdown returns, Shutdown returns the error of ctx and leaves
+// OnShutdown running.  Calling Shutdown again before the next Start waits for
+// the same call instead of calling OnShutdown once more.
+func (s *FuncService) Shutdown(ctx context.Context) (err error) {
+	defer func() { err = errors.Annotate(err, "stopping %s: %w", s.Name) }()
+
+	if s.OnShutdown == nil {
+		return nil
+	}
+
+	res := s.startStopping()
+
+	select {
+	case <-res.done:
+		return res.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startStopping calls OnShutdown in a separate goroutine, unless it's already
+// been called since the latest start, and returns the result of the call.
+func (s *FuncService) startStopping() (res *stopResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping != nil {
+		return s.stopping
+	}
+
+	res = &stopResult{
+		done: make(chan struct{}),
+	}
+	s.stopping = res
+
+	go func() {
+		defer log.OnPanic("aghsvc: stopping " + s.Name)
+		defer close(res.done)
+
+		res.err = s.OnShutdown()
+	}()
+
+	return res
+}
+
+// ErrShutDown is returned by [Manager.Start] after the manager has been shut
+// down.
+const ErrShutDown errors.Error = "manager is shut down"
+
+// Manager starts and stops several services in order.  It's safe for
+// concurrent use, and Shutdown waits for Start to return, so that the services
+// started concurrently with stopping are stopped as well.
+type Manager struct {
+	// mu protects started and isShutDown and serializes starting and stopping
+	// the services.
+	mu *sync.Mutex
+
+	// services are the managed services in the order of starting.
+	services []Service
+
+	// started is the number of the services started.  They are the first
+	// started elements of services.
+	started int
+
+	// isShutDown is true if Shutdown has been called.
+	isShutDown bool
+}
+
+// type check
+var _ Service = (*Manager)(nil)
+
+// NewManager returns a new manager of svcs.  The services are started in the
+// order given and stopped in the reverse one.
+func NewManager(svcs ...Service) (m *Manager) {
+	return &Manager{
+		mu:       &sync.Mutex{},
+		services: svcs,
+	}
+}
+
+// Start implements the [Service] interface for *Manager.  If any of the
+// services fails to start, Start stops the ones already started and returns
+// the errors.  It returns [ErrShutDown] if m has already been shut down.
+func (m *Manager) Start(ctx context.Context) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isShutDown {
+		return ErrShutDown
+	}
+
+	for _, svc := range m.services[m.started:] {
+		err = svc.Start(ctx)
+		if err != nil {
+			// Don't wrap the errors since they're informative enough as is.
+			return errors.WithDeferred(err, m.shutdown(ctx))
+		}
+
+		m.started++
+	}
+
+	return nil
+}
+
+// Shutdown implements the [Service] interface for *Manager.  It stops all the
+// started services in the reverse order, even if some of them fail to stop,
+// and returns all the errors.  If ctx is done before all the services stop,
+// Shutdown keeps stopping them in order without the deadline, so that the
+// services are never stopped concurrently.
+func (m *Manager) Shutdown(ctx context.Context) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.isShutDown = true
+
+	return m.shutdown(ctx)
+}
+
+// shutdown stops the started services in the reverse order.  m.mu is expected
+// to be locked.
+func (m *Manager) shutdown(ctx context.Context) (err error) {
+	var errs []error
+	for ; m.started > 0; m.started-- {
+		svc := m.services[m.started-1]
+		serr := svc.Shutdown(ctx)
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(serr, ctxErr) {
+			log.Info("aghsvc: warning: %s; waiting for the services to stop", serr)
+
+			// Wait for the service and stop the rest without the deadline.
+			ctx = context.Background()
+			serr = svc.Shutdown(ctx)
+		}
+
+		if serr != nil {
+			errs = append(errs, serr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("shutting down services", errs...)
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package aghsvc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghsvc"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRecordingService returns a service, which appends its name to log on
+// starting and stopping.  It fails to start with startErr.
+func newRecordingService(name string, log *[]string, startErr error) (s *aghsvc.FuncService) {
+	return &aghsvc.FuncService{
+		OnStart: func() (err error) {
+			*log = append(*log, "start "+name)
+
+			return startErr
+		},
+		OnShutdown: func() (err error) {
+			*log = append(*log, "stop "+name)
+
+			return nil
+		},
+		Name: name,
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success", func(t *testing.T) {
+		var log []string
+		m := aghsvc.NewManager(
+			newRecordingService("a", &log, nil),
+			newRecordingService("b", &log, nil),
+		)
+
+		require.NoError(t, m.Start(ctx))
+		require.NoError(t, m.Shutdown(ctx))
+
+		// Shutting down again must not stop the services twice.
+		require.NoError(t, m.Shutdown(ctx))
+
+		assert.Equal(t, []string{"start a", "start b", "stop b", "stop a"}, log)
+	})
+
+	t.Run("start_error", func(t *testing.T) {
+		const testError errors.Error = "test error"
+
+		var log []string
+		m := aghsvc.NewManager(
+			newRecordingService("a", &log, nil),
+			newRecordingService("b", &log, testError),
+			newRecordingService("c", &log, nil),
+		)
+
+		err := m.Start(ctx)
+		testutil.AssertErrorMsg(t, "starting b: test error", err)
+
+		require.NoError(t, m.Shutdown(ctx))
+
+		assert.Equal(t, []string{"start a", "start b", "stop a"}, log)
+	})
+
+	t.Run("start_after_shutdown", func(t *testing.T) {
+		var log []string
+		m := aghsvc.NewManager(newRecordingService("a", &log, nil))
+
+		require.NoError(t, m.Shutdown(ctx))
+
+		err := m.Start(ctx)
+		assert.ErrorIs(t, err, aghsvc.ErrShutDown)
+		assert.Empty(t, log)
+	})
+}
+
+func TestManager_Shutdown_deadline(t *testing.T) {
+	unblock := make(chan struct{})
+
+	var log []string
+	slow := &aghsvc.FuncService{
+		OnShutdown: func() (err error) {
+			<-unblock
+			log = append(log, "stop slow")
+
+			return nil
+		},
+		Name: "slow",
+	}
+
+	m := aghsvc.NewManager(newRecordingService("a", &log, nil), slow)
+	require.NoError(t, m.Start(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	t.Cleanup(cancel)
+
+	go func() {
+		<-ctx.Done()
+		close(unblock)
+	}()
+
+	// The services must be stopped in order even after the deadline.
+	require.NoError(t, m.Shutdown(ctx))
+
+	assert.Equal(t, []string{"start a", "stop slow", "stop a"}, log)
+}
+
+func TestFuncService_Shutdown(t *testing.T) {
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+
+	s := &aghsvc.FuncService{
+		OnShutdown: func() (err error) {
+			<-unblock
+
+			return nil
+		},
+		Name: "blocking",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	t.Cleanup(cancel)
+
+	err := s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFuncService_Shutdown_wait(t *testing.T) {
+	unblock := make(chan struct{})
+
+	calls := 0
+	s := &aghsvc.FuncService{
+		OnShutdown: func() (err error) {
+			calls++
+			<-unblock
+
+			return nil
+		},
+		Name: "blocking",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	t.Cleanup(cancel)
+
+	err := s.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(unblock)
+
+	// Shutting down again must wait for the running stop.
+	err = s.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, calls)
+}
+
+func TestFuncService_Start(t *testing.T) {
+	unblock := make(chan struct{})
+	stopped := make(chan struct{})
+
+	s := &aghsvc.FuncService{
+		OnStart: func() (err error) {
+			<-unblock
+
+			return nil
+		},
+		OnShutdown: func() (err error) {
+			close(stopped)
+
+			return nil
+		},
+		Name: "blocking",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	t.Cleanup(cancel)
+
+	err := s.Start(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The service started after the deadline must be stopped.
+	close(unblock)
+
+	select {
+	case <-stopped:
+		// Go on.
+	case <-time.After(time.Second):
+		t.Fatal("service started after the deadline wasn't stopped")
+	}
+}
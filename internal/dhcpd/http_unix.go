@@ -202,7 +202,7 @@ func (s *server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 	conf.Enabled = aghalg.BoolToNullBool(s.conf.Enabled)
 	conf.InterfaceName = s.conf.InterfaceName
 
-	err := json.NewDecoder(r.Body).Decode(conf)
+	err := aghhttp.DecodeJSON(r, conf)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "failed to parse new dhcp config json: %s", err)
 
@@ -424,7 +424,7 @@ func (s *server) handleDHCPFindActiveServer(w http.ResponseWriter, r *http.Reque
 	}
 
 	req := &findActiveServerReq{}
-	err := json.NewDecoder(r.Body).Decode(req)
+	err := aghhttp.DecodeJSON(r, req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
 
@@ -489,7 +489,7 @@ func setOtherDHCPResult(ifaceName string, result *dhcpSearchResult) {
 
 func (s *server) handleDHCPAddStaticLease(w http.ResponseWriter, r *http.Request) {
 	l := &Lease{}
-	err := json.NewDecoder(r.Body).Decode(l)
+	err := aghhttp.DecodeJSON(r, l)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 
@@ -521,7 +521,7 @@ func (s *server) handleDHCPAddStaticLease(w http.ResponseWriter, r *http.Request
 
 func (s *server) handleDHCPRemoveStaticLease(w http.ResponseWriter, r *http.Request) {
 	l := &Lease{}
-	err := json.NewDecoder(r.Body).Decode(l)
+	err := aghhttp.DecodeJSON(r, l)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 
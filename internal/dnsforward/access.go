@@ -1,7 +1,6 @@
 package dnsforward
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -227,7 +226,7 @@ func validateStrUniq(clients []string) (uc aghalg.UniqChecker[string], err error
 
 func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	list := &accessListJSON{}
-	err := json.NewDecoder(r.Body).Decode(&list)
+	err := aghhttp.DecodeJSON(r, &list)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
 
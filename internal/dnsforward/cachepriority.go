@@ -0,0 +1,137 @@
+package dnsforward
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// CachePriorityDomain is a domain with a high cache priority.  The domain is
+// periodically resolved through the cache, so that its responses resist the
+// eviction and are fetched again once expired.
+type CachePriorityDomain struct {
+	// Domain is the domain name.
+	Domain string `yaml:"domain" json:"domain"`
+
+	// Weight is the priority of the domain from 1 to maxCachePriorityWeight.
+	// The domains with greater weights are resolved more often: the domain is
+	// resolved once in maxCachePriorityWeight-Weight+1 ticks.
+	Weight uint8 `yaml:"weight" json:"weight"`
+}
+
+const (
+	// maxCachePriorityWeight is the maximum weight of a priority domain.
+	maxCachePriorityWeight = 10
+
+	// maxCachePriorityDomains is the maximum number of priority domains.
+	maxCachePriorityDomains = 100
+
+	// cachePriorityTick is the period of resolving the priority domains with
+	// the maximum weight.
+	cachePriorityTick = 1 * time.Minute
+)
+
+// validateCachePriorityDomains returns an error if any of domains is invalid.
+func validateCachePriorityDomains(domains []*CachePriorityDomain) (err error) {
+	if len(domains) > maxCachePriorityDomains {
+		return fmt.Errorf("too many domains: %d, max %d", len(domains), maxCachePriorityDomains)
+	}
+
+	for i, d := range domains {
+		if d == nil {
+			return fmt.Errorf("domain at index %d: %w", i, errors.Error("no value"))
+		}
+
+		err = netutil.ValidateDomainName(d.Domain)
+		if err != nil {
+			return fmt.Errorf("domain at index %d: %w", i, err)
+		}
+
+		if d.Weight == 0 || d.Weight > maxCachePriorityWeight {
+			return fmt.Errorf(
+				"domain %q: weight %d out of range [1, %d]",
+				d.Domain,
+				d.Weight,
+				maxCachePriorityWeight,
+			)
+		}
+	}
+
+	return nil
+}
+
+// cloneCachePriorityDomains returns a deep copy of domains.
+func cloneCachePriorityDomains(domains []*CachePriorityDomain) (cloned []*CachePriorityDomain) {
+	if domains == nil {
+		return nil
+	}
+
+	cloned = make([]*CachePriorityDomain, 0, len(domains))
+	for _, d := range domains {
+		cp := *d
+		cloned = append(cloned, &cp)
+	}
+
+	return cloned
+}
+
+// dueCachePriorityDomains returns the names of domains, which are to be
+// resolved at the tick number n.
+func dueCachePriorityDomains(domains []*CachePriorityDomain, n uint) (due []string) {
+	for _, d := range domains {
+		if n%uint(maxCachePriorityWeight-d.Weight+1) == 0 {
+			due = append(due, d.Domain)
+		}
+	}
+
+	return due
+}
+
+// refreshCachePriorityDomains periodically resolves the priority domains
+// through the cache until done is closed.
+func (s *Server) refreshCachePriorityDomains(done <-chan struct{}) {
+	defer log.OnPanic("dnsforward: refreshing priority domains")
+
+	t := time.NewTicker(cachePriorityTick)
+	defer t.Stop()
+
+	for n := uint(0); ; n++ {
+		select {
+		case <-t.C:
+			s.resolveCachePriorityDomains(n)
+		case <-done:
+			return
+		}
+	}
+}
+
+// resolveCachePriorityDomains resolves the priority domains, which are to be
+// resolved at the tick number n.  It does nothing if the cache is disabled.
+func (s *Server) resolveCachePriorityDomains(n uint) {
+	s.serverLock.RLock()
+	var due []string
+	if s.conf.CacheSize != 0 {
+		due = s.filterWarmUpDomains(dueCachePriorityDomains(s.conf.CachePriorityDomains, n))
+	}
+
+	qtypes := []uint16{dns.TypeA}
+	if !s.conf.AAAADisabled {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	s.serverLock.RUnlock()
+
+	for _, d := range due {
+		for _, qt := range qtypes {
+			err := s.warmUp(d, qt)
+			if errors.Is(err, errNotRunning) {
+				return
+			} else if err != nil {
+				log.Debug("dnsforward: resolving priority %s %s: %s", dns.Type(qt), d, err)
+			}
+		}
+	}
+}
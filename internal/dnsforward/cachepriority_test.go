@@ -0,0 +1,96 @@
+package dnsforward
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCachePriorityDomains(t *testing.T) {
+	tooMany := make([]*CachePriorityDomain, maxCachePriorityDomains+1)
+	for i := range tooMany {
+		tooMany[i] = &CachePriorityDomain{Domain: "example.org", Weight: 1}
+	}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		domains    []*CachePriorityDomain
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		domains:    nil,
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		domains: []*CachePriorityDomain{{
+			Domain: "example.org",
+			Weight: 1,
+		}, {
+			Domain: "intranet.example.com",
+			Weight: maxCachePriorityWeight,
+		}},
+	}, {
+		name:       "nil",
+		wantErrMsg: "domain at index 0: no value",
+		domains:    []*CachePriorityDomain{nil},
+	}, {
+		name:       "bad_domain",
+		wantErrMsg: `domain at index 0: bad domain name "": address is empty`,
+		domains:    []*CachePriorityDomain{{Domain: "", Weight: 1}},
+	}, {
+		name:       "zero_weight",
+		wantErrMsg: `domain "example.org": weight 0 out of range [1, 10]`,
+		domains:    []*CachePriorityDomain{{Domain: "example.org", Weight: 0}},
+	}, {
+		name:       "big_weight",
+		wantErrMsg: `domain "example.org": weight 11 out of range [1, 10]`,
+		domains:    []*CachePriorityDomain{{Domain: "example.org", Weight: 11}},
+	}, {
+		name:       "too_many",
+		wantErrMsg: "too many domains: 101, max 100",
+		domains:    tooMany,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateCachePriorityDomains(tc.domains)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestDueCachePriorityDomains(t *testing.T) {
+	domains := []*CachePriorityDomain{{
+		Domain: "max.example",
+		Weight: maxCachePriorityWeight,
+	}, {
+		Domain: "mid.example",
+		Weight: maxCachePriorityWeight - 1,
+	}, {
+		Domain: "min.example",
+		Weight: 1,
+	}}
+
+	var got []string
+	for n := uint(0); n < 2*maxCachePriorityWeight; n++ {
+		got = append(got, strings.Join(dueCachePriorityDomains(domains, n), ","))
+	}
+
+	want := make([]string, 2*maxCachePriorityWeight)
+	for n := range want {
+		due := []string{"max.example"}
+		if n%2 == 0 {
+			due = append(due, "mid.example")
+		}
+		if n%maxCachePriorityWeight == 0 {
+			due = append(due, "min.example")
+		}
+
+		want[n] = strings.Join(due, ",")
+	}
+
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,47 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
+)
+
+// dohCanaryDomains are the FQDNs of the canary domains, the NXDOMAIN response
+// to which makes the browsers keep using the resolver of the network instead
+// of their own DNS-over-HTTPS servers.  Chrome has no such domain, since it
+// only upgrades to the DNS-over-HTTPS server of the same provider.
+//
+// See https://support.mozilla.org/en-US/kb/canary-domain-use-application-dnsnet.
+var dohCanaryDomains = stringutil.NewSet(
+	"use-application-dns.net.",
+)
+
+// processDoHCanary responds with NXDOMAIN to the address requests for the
+// canary domains of the browsers' DNS-over-HTTPS, if enabled.  The request is
+// still written to the query log and counted in the statistics.
+func (s *Server) processDoHCanary(dctx *dnsContext) (rc resultCode) {
+	if !s.conf.BlockDoHCanary {
+		return resultCodeSuccess
+	}
+
+	pctx := dctx.proxyCtx
+	q := pctx.Req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return resultCodeSuccess
+	}
+
+	if !dohCanaryDomains.Has(dns.CanonicalName(q.Name)) {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: responding with nxdomain to doh canary %q", q.Name)
+
+	pctx.Res = s.genNXDomain(pctx.Req)
+	dctx.result = &filtering.Result{
+		Reason:     filtering.FilteredDoHCanary,
+		IsFiltered: true,
+	}
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,87 @@
+package dnsforward
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errCaseMismatch is returned when the response from a plain DNS upstream
+// doesn't preserve the randomized case of the question.
+const errCaseMismatch errors.Error = "upstream response does not match randomized question case"
+
+// randomizeCase returns a copy of name with the case of each ASCII letter
+// chosen randomly, also known as DNS 0x20 encoding.  It adds the entropy to the
+// plain DNS requests, which an off-path attacker must guess to spoof the
+// response.
+func randomizeCase(name string) (randomized string, err error) {
+	bits := make([]byte, len(name)/8+1)
+	if _, err = rand.Read(bits); err != nil {
+		return "", fmt.Errorf("generating random bits: %w", err)
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		if !isASCIILetter(c) {
+			continue
+		}
+
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			b[i] = c &^ 0x20
+		} else {
+			b[i] = c | 0x20
+		}
+	}
+
+	return string(b), nil
+}
+
+// isASCIILetter returns true if c is an ASCII letter.
+func isASCIILetter(c byte) (ok bool) {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isPlainUDP returns true if pctx has been resolved by a plain DNS-over-UDP
+// upstream.  The addresses of such upstreams have no scheme, see
+// [upstream.AddressToUpstream].
+func isPlainUDP(pctx *proxy.DNSContext) (ok bool) {
+	return pctx.Upstream != nil && !strings.Contains(pctx.Upstream.Address(), "://")
+}
+
+// checkRandomizedCase returns an error if the response in pctx has been
+// received from a plain DNS-over-UDP upstream and its question doesn't match
+// the randomized name exactly.  Otherwise, it replaces the randomized name in
+// the response with the original one so that the clients never see it.
+func checkRandomizedCase(pctx *proxy.DNSContext, orig, randomized string) (err error) {
+	resp := pctx.Res
+	if resp == nil {
+		return nil
+	}
+
+	if isPlainUDP(pctx) && (len(resp.Question) == 0 || resp.Question[0].Name != randomized) {
+		return errCaseMismatch
+	}
+
+	for i := range resp.Question {
+		restoreCase(&resp.Question[i].Name, orig)
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			restoreCase(&rr.Header().Name, orig)
+		}
+	}
+
+	return nil
+}
+
+// restoreCase sets name to orig if they only differ in case.
+func restoreCase(name *string, orig string) {
+	if strings.EqualFold(*name, orig) {
+		*name = orig
+	}
+}
@@ -0,0 +1,141 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	const name = "www.example-1.org."
+
+	randomized, err := randomizeCase(name)
+	require.NoError(t, err)
+
+	assert.True(t, strings.EqualFold(name, randomized))
+	assert.Len(t, randomized, len(name))
+}
+
+func TestCheckRandomizedCase(t *testing.T) {
+	const (
+		orig       = "example.org."
+		randomized = "ExaMPle.oRg."
+	)
+
+	newUps := func(addr string) (u *aghtest.UpstreamMock) {
+		return &aghtest.UpstreamMock{
+			OnAddress: func() (a string) { return addr },
+		}
+	}
+
+	newResp := func(name string) (resp *dns.Msg) {
+		return &dns.Msg{
+			Question: []dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			Answer: []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.IP{1, 2, 3, 4},
+			}},
+		}
+	}
+
+	testCases := []struct {
+		resp       *dns.Msg
+		ups        *aghtest.UpstreamMock
+		name       string
+		wantErrMsg string
+	}{{
+		resp:       newResp(randomized),
+		ups:        newUps("1.1.1.1:53"),
+		name:       "plain_match",
+		wantErrMsg: "",
+	}, {
+		resp:       newResp(orig),
+		ups:        newUps("1.1.1.1:53"),
+		name:       "plain_mismatch",
+		wantErrMsg: string(errCaseMismatch),
+	}, {
+		resp:       newResp(orig),
+		ups:        newUps("tls://1.1.1.1"),
+		name:       "encrypted_mismatch",
+		wantErrMsg: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pctx := &proxy.DNSContext{
+				Res:      tc.resp,
+				Upstream: tc.ups,
+			}
+
+			err := checkRandomizedCase(pctx, orig, randomized)
+			if tc.wantErrMsg != "" {
+				assert.EqualError(t, err, tc.wantErrMsg)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, orig, pctx.Res.Question[0].Name)
+			assert.Equal(t, orig, pctx.Res.Answer[0].Header().Name)
+		})
+	}
+}
+
+// TestPlainUpstream_sourcePorts makes sure that the plain DNS-over-UDP
+// upstreams use a new socket for each request, so that the operating system
+// chooses a new random source port for it.  The source-port randomization
+// relies on that.
+func TestPlainUpstream_sourcePorts(t *testing.T) {
+	const n = 8
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	ports := make(chan int, n)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			l, addr, rerr := conn.ReadFromUDP(buf)
+			if rerr != nil {
+				return
+			}
+
+			req := &dns.Msg{}
+			if req.Unpack(buf[:l]) != nil {
+				continue
+			}
+
+			ports <- addr.Port
+
+			resp, _ := (&dns.Msg{}).SetReply(req).Pack()
+			_, _ = conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	u, err := upstream.AddressToUpstream(conn.LocalAddr().String(), &upstream.Options{
+		Timeout: time.Second,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	seen := map[int]struct{}{}
+	for i := 0; i < n; i++ {
+		_, err = u.Exchange(createTestMessage("example.org."))
+		require.NoError(t, err)
+
+		seen[<-ports] = struct{}{}
+	}
+
+	assert.Greater(t, len(seen), 1)
+}
@@ -61,6 +61,21 @@ type FilteringConfig struct {
 	// nil if there are no custom upstreams for the client.
 	GetCustomUpstreamByClient func(id string) (conf *proxy.UpstreamConfig, err error) `yaml:"-"`
 
+	// ConsumeClientQuota is a callback that counts a query of the client
+	// identified by its IP address or ClientID.  It returns false if the
+	// client has exceeded its daily query quota.
+	ConsumeClientQuota func(id string) (ok bool) `yaml:"-"`
+
+	// BypassCacheForClient is a callback that returns true if the queries of
+	// the client identified by its IP address or ClientID should always be
+	// resolved by the upstreams, without using the DNS cache.
+	BypassCacheForClient func(id string) (ok bool) `yaml:"-"`
+
+	// DeviceSeen is a callback that records the device, which has sent a
+	// query, identified by its IP address and ClientID, if any.  The IP
+	// address is anonymized if needed.
+	DeviceSeen func(ip net.IP, clientID string) `yaml:"-"`
+
 	// Protection configuration
 	// --
 
@@ -92,6 +107,9 @@ type FilteringConfig struct {
 	// FastestTimeout replaces the default timeout for dialing IP addresses
 	// when FastestAddr is true.
 	FastestTimeout timeutil.Duration `yaml:"fastest_timeout"`
+	// FallbackDNS are the upstream servers used only when all the upstream
+	// servers from UpstreamDNS have failed to respond.
+	FallbackDNS []string `yaml:"fallback_dns"`
 
 	// Access settings
 	// --
@@ -113,6 +131,12 @@ type FilteringConfig struct {
 	CacheMaxTTL uint32 `yaml:"cache_ttl_max"` // override TTL value (maximum) received from upstream server
 	// CacheOptimistic defines if optimistic cache mechanism should be used.
 	CacheOptimistic bool `yaml:"cache_optimistic"`
+	// CacheWarmUp defines if the most requested domains from the statistics
+	// should be resolved into the cache on startup.
+	CacheWarmUp bool `yaml:"cache_warm_up"`
+	// CachePriorityDomains are the domains, which are periodically resolved
+	// through the cache to keep their responses in it.
+	CachePriorityDomains []*CachePriorityDomain `yaml:"cache_priority_domains"`
 
 	// Other settings
 	// --
@@ -124,6 +148,49 @@ type FilteringConfig struct {
 	MaxGoroutines          uint32   `yaml:"max_goroutines"`     // Max. number of parallel goroutines for processing incoming requests
 	HandleDDR              bool     `yaml:"handle_ddr"`         // Handle DDR requests
 
+	// BlockDoHCanary defines if the requests for the canary domains of the
+	// browsers' DNS-over-HTTPS should be responded with NXDOMAIN, so that the
+	// browsers don't bypass the filtering by using their own resolvers.
+	BlockDoHCanary bool `yaml:"block_doh_canary"`
+
+	// HandleServerName defines if the requests for the server's own hostnames
+	// should be answered locally instead of being forwarded to upstreams.
+	HandleServerName bool `yaml:"handle_server_name"`
+
+	// RandomizeUpstreamCase defines if the case of the letters in the
+	// questions sent to upstreams should be randomized.  The responses from
+	// plain DNS-over-UDP upstreams not preserving the case are rejected.
+	RandomizeUpstreamCase bool `yaml:"randomize_upstream_case"`
+
+	// AnswerValidation is the configuration of cross-checking the answers of
+	// upstreams for the security-sensitive domains.
+	AnswerValidation AnswerValidationConfig `yaml:"answer_validation"`
+
+	// ServfailDamping is the configuration of backing off the requests for the
+	// zones, for which the upstreams keep responding with SERVFAIL.
+	ServfailDamping ServfailDampingConfig `yaml:"servfail_damping"`
+
+	// ResolvedArchive is the configuration of the archive of the IP addresses
+	// resolved for the domain names.
+	ResolvedArchive ResolvedArchiveConfig `yaml:"resolved_archive"`
+
+	// FilteringFailureMode defines how the requests are answered if the
+	// filtering engine fails to check them.  If empty, FilteringFailOpen is
+	// used.
+	FilteringFailureMode FilteringFailureMode `yaml:"filtering_failure_mode"`
+
+	// ScheduledUpstreams are the rules routing the requests to different sets
+	// of upstreams depending on the time of the day.
+	ScheduledUpstreams []*ScheduledUpstream `yaml:"scheduled_upstreams"`
+
+	// ResourceGuard is the configuration of shedding the load before the
+	// process runs out of goroutines or file descriptors.
+	ResourceGuard ResourceGuardConfig `yaml:"resource_guard"`
+
+	// UpstreamsTLS are the policies of verifying the certificates of the
+	// encrypted upstreams.
+	UpstreamsTLS []*UpstreamTLSPolicy `yaml:"upstreams_tls"`
+
 	// IpsetList is the ipset configuration that allows AdGuard Home to add
 	// IP addresses of the specified domain names to an ipset list.  Syntax:
 	//
@@ -168,6 +235,10 @@ type TLSConfig struct {
 	// OverrideTLSCiphers, when set, contains the names of the cipher suites to
 	// use.  If the slice is empty, the default safe suites are used.
 	OverrideTLSCiphers []string `yaml:"override_tls_ciphers,omitempty" json:"-"`
+
+	// AdditionalCertificates are the certificates used along with the main
+	// one, selected by SNI.  They're only set in the configuration file.
+	AdditionalCertificates []*TLSCertificate `yaml:"additional_certificates,omitempty" json:"-"`
 }
 
 // DNSCryptConfig is the DNSCrypt server configuration struct.
@@ -187,6 +258,20 @@ type ServerConfig struct {
 	UpstreamConfig *proxy.UpstreamConfig // Upstream DNS servers config
 	OnDNSRequest   func(d *proxy.DNSContext)
 
+	// FallbackUpstreams are the upstreams parsed from FallbackDNS.
+	FallbackUpstreams []upstream.Upstream
+
+	// QtypeUpstreamConfigs are the upstream configurations for particular
+	// query types parsed from the upstream lines with qtypeUpstreamPrefix.
+	QtypeUpstreamConfigs map[uint16]*proxy.UpstreamConfig
+
+	// scheduledUpstreams are the rules parsed from ScheduledUpstreams.
+	scheduledUpstreams []*scheduledUpstream
+
+	// policyUpstreams are the upstreams created from UpstreamsTLS by their
+	// addresses.
+	policyUpstreams map[string]upstream.Upstream
+
 	FilteringConfig
 	TLSConfig
 	DNSCryptConfig
@@ -247,6 +332,7 @@ func (s *Server) createProxyConfig() (conf proxy.Config, err error) {
 		CacheMaxTTL:            srvConf.CacheMaxTTL,
 		CacheOptimistic:        srvConf.CacheOptimistic,
 		UpstreamConfig:         srvConf.UpstreamConfig,
+		Fallbacks:              srvConf.FallbackUpstreams,
 		BeforeRequestHandler:   s.beforeRequestHandler,
 		RequestHandler:         s.handleDNSRequest,
 		EnableEDNSClientSubnet: srvConf.EnableEDNSClientSubnet,
@@ -378,14 +464,15 @@ func (s *Server) prepareUpstreamSettings() error {
 
 	httpVersions := UpstreamHTTPVersions(s.conf.UseHTTP3Upstreams)
 	upstreams = stringutil.FilterOut(upstreams, IsCommentOrEmpty)
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(
-		upstreams,
-		&upstream.Options{
-			Bootstrap:    s.conf.BootstrapDNS,
-			Timeout:      s.conf.UpstreamTimeout,
-			HTTPVersions: httpVersions,
-		},
-	)
+
+	upstreams, qtypeUpstreams := splitQtypeUpstreams(upstreams)
+
+	opts := &upstream.Options{
+		Bootstrap:    s.conf.BootstrapDNS,
+		Timeout:      s.conf.UpstreamTimeout,
+		HTTPVersions: httpVersions,
+	}
+	upstreamConfig, err := proxy.ParseUpstreamsConfig(upstreams, opts)
 	if err != nil {
 		return fmt.Errorf("parsing upstream config: %w", err)
 	}
@@ -408,9 +495,35 @@ func (s *Server) prepareUpstreamSettings() error {
 		upstreamConfig.Upstreams = uc.Upstreams
 	}
 
+	s.conf.policyUpstreams, err = newPolicyUpstreams(s.conf.UpstreamsTLS, opts, &s.upsEvents)
+	if err != nil {
+		return fmt.Errorf("parsing upstreams tls policies: %w", err)
+	}
+
+	s.monitorUpstreamConfig(upstreamConfig)
 	s.conf.UpstreamConfig = upstreamConfig
 
-	return nil
+	s.conf.QtypeUpstreamConfigs, err = newQtypeUpstreamConfigs(qtypeUpstreams, opts, upstreamConfig)
+	if err != nil {
+		return fmt.Errorf("parsing upstreams for query types: %w", err)
+	}
+
+	// The domain-specific upstreams are shared with the main configuration
+	// and are already monitored.
+	for _, c := range s.conf.QtypeUpstreamConfigs {
+		c.Upstreams = s.monitorUpstreams(c.Upstreams)
+	}
+
+	s.conf.scheduledUpstreams, err = newScheduledUpstreams(s.conf.ScheduledUpstreams, opts, upstreamConfig)
+	if err != nil {
+		return fmt.Errorf("parsing scheduled upstreams: %w", err)
+	}
+
+	for _, su := range s.conf.scheduledUpstreams {
+		su.conf.Upstreams = s.monitorUpstreams(su.conf.Upstreams)
+	}
+
+	return s.prepareFallbackUpstreams(httpVersions)
 }
 
 // setProxyUpstreamMode sets the upstream mode and related settings in conf
@@ -493,6 +606,16 @@ func (s *Server) prepareTLS(proxyConfig *proxy.Config) error {
 		}
 	}
 
+	s.dotCerts, err = newTLSCerts(s.conf.cert, s.conf.AdditionalCertificates, TLSListenerDoT)
+	if err != nil {
+		return fmt.Errorf("preparing dot certificates: %w", err)
+	}
+
+	s.doqCerts, err = newTLSCerts(s.conf.cert, s.conf.AdditionalCertificates, TLSListenerDoQ)
+	if err != nil {
+		return fmt.Errorf("preparing doq certificates: %w", err)
+	}
+
 	proxyConfig.TLSConfig = &tls.Config{
 		GetCertificate: s.onGetCertificate,
 		CipherSuites:   s.conf.TLSCiphers,
@@ -542,13 +665,3 @@ func anyNameMatches(dnsNames []string, sni string) (ok bool) {
 
 	return false
 }
-
-// Called by 'tls' package when Client Hello is received
-// If the server name (from SNI) supplied by client is incorrect - we terminate the ongoing TLS handshake.
-func (s *Server) onGetCertificate(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if s.conf.StrictSNICheck && !anyNameMatches(s.conf.dnsNames, ch.ServerName) {
-		log.Info("dns: tls: unknown SNI in Client Hello: %s", ch.ServerName)
-		return nil, fmt.Errorf("invalid SNI")
-	}
-	return &s.conf.cert, nil
-}
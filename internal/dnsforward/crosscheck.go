@@ -0,0 +1,243 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// AnswerValidationConfig is the configuration of cross-checking the answers of
+// two upstreams for the security-sensitive domains, which makes the cache
+// poisoning of a single upstream detectable.
+type AnswerValidationConfig struct {
+	// Domains are the security-sensitive domain names.  Their subdomains are
+	// also checked.
+	Domains []string `yaml:"domains"`
+
+	// Enabled defines if the answers should be cross-checked.  It only has
+	// effect in the parallel upstream mode.
+	Enabled bool `yaml:"enabled"`
+
+	// Reject defines if the disagreeing answers should be replaced with
+	// SERVFAIL.  Otherwise, they're only recorded.
+	Reject bool `yaml:"reject"`
+}
+
+// matches returns true if host, which must be a lowercased FQDN, is one of the
+// security-sensitive domains or their subdomains.
+func (c *AnswerValidationConfig) matches(host string) (ok bool) {
+	host = strings.TrimSuffix(host, ".")
+	for _, d := range c.Domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxSecurityEvents is the maximum number of security events kept in memory.
+const maxSecurityEvents = 100
+
+// securityEvent is a detected disagreement between the answers of two
+// upstreams.
+type securityEvent struct {
+	Time      time.Time  `json:"time"`
+	Domain    string     `json:"domain"`
+	QType     string     `json:"question_type"`
+	Client    string     `json:"client"`
+	Upstreams []string   `json:"upstreams"`
+	Answers   [][]string `json:"answers"`
+	Rejected  bool       `json:"rejected"`
+}
+
+// securityEvents is the bounded list of the recent security events.  The zero
+// value is ready for use.
+type securityEvents struct {
+	mu     sync.Mutex
+	events []*securityEvent
+}
+
+// add records e, dropping the oldest event if the list is full.
+func (se *securityEvents) add(e *securityEvent) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	if len(se.events) == maxSecurityEvents {
+		copy(se.events, se.events[1:])
+		se.events = se.events[:maxSecurityEvents-1]
+	}
+
+	se.events = append(se.events, e)
+}
+
+// list returns the recorded events, the newest first.
+func (se *securityEvents) list() (events []*securityEvent) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	events = make([]*securityEvent, 0, len(se.events))
+	for i := len(se.events) - 1; i >= 0; i-- {
+		events = append(events, se.events[i])
+	}
+
+	return events
+}
+
+// crossCheck sends the request to one more upstream of prx and compares its
+// answer with the one received by the proxy if the requested domain is
+// security-sensitive and the parallel upstream mode is enabled.  If the answers
+// disagree, the security event is recorded and, if configured, the response is
+// replaced with SERVFAIL.
+func (s *Server) crossCheck(dctx *dnsContext, prx *proxy.Proxy) {
+	conf := &s.conf.AnswerValidation
+	pctx := dctx.proxyCtx
+	if !conf.Enabled || !s.conf.AllServers || pctx.Upstream == nil {
+		return
+	}
+
+	q := pctx.Req.Question[0]
+	if !conf.matches(strings.ToLower(q.Name)) {
+		return
+	}
+
+	ups := prx.UpstreamConfig.Upstreams
+	if pctx.CustomUpstreamConfig != nil {
+		ups = pctx.CustomUpstreamConfig.Upstreams
+	}
+
+	other := otherUpstream(ups, pctx.Upstream)
+	if other == nil {
+		log.Debug("dns: no upstream to cross-check %s", q.Name)
+
+		return
+	}
+
+	otherResp, err := other.Exchange(pctx.Req.Copy())
+	if err != nil {
+		log.Debug("dns: cross-checking %s with %s: %s", q.Name, other.Address(), err)
+
+		return
+	} else if answersAgree(pctx.Res, otherResp) {
+		return
+	}
+
+	e := &securityEvent{
+		Time:      time.Now(),
+		Domain:    strings.TrimSuffix(q.Name, "."),
+		QType:     dns.Type(q.Qtype).String(),
+		Client:    dctx.clientID,
+		Upstreams: []string{pctx.Upstream.Address(), other.Address()},
+		Answers:   [][]string{answerStrings(pctx.Res), answerStrings(otherResp)},
+		Rejected:  conf.Reject,
+	}
+	if e.Client == "" {
+		e.Client = ipStringFromAddr(pctx.Addr)
+	}
+
+	log.Info(
+		"dns: security: answers for %s from %s and %s disagree, rejected: %t",
+		e.Domain,
+		e.Upstreams[0],
+		e.Upstreams[1],
+		e.Rejected,
+	)
+
+	s.secEvents.add(e)
+
+	if conf.Reject {
+		pctx.Res = s.genServerFailure(pctx.Req)
+	}
+}
+
+// otherUpstream returns the first upstream from ups other than u or nil if
+// there is none.
+func otherUpstream(ups []upstream.Upstream, u upstream.Upstream) (other upstream.Upstream) {
+	for _, o := range ups {
+		if o != u {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// answersAgree returns true if a and b have the same response code and either
+// both have no address records or share at least one address.  The sets of
+// addresses may differ since the load-balanced domains are often resolved into
+// different addresses by different upstreams.
+func answersAgree(a, b *dns.Msg) (ok bool) {
+	if a == nil || b == nil {
+		return a == b
+	} else if a.Rcode != b.Rcode {
+		return false
+	}
+
+	aIPs, bIPs := answerIPs(a), answerIPs(b)
+	if len(aIPs) == 0 || len(bIPs) == 0 {
+		return len(aIPs) == len(bIPs)
+	}
+
+	for ip := range bIPs {
+		if _, ok = aIPs[ip]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// answerIPs returns the set of the addresses from the A and AAAA records of
+// the answer section of msg.
+func answerIPs(msg *dns.Msg) (ips map[string]struct{}) {
+	ips = map[string]struct{}{}
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		ips[ip.String()] = struct{}{}
+	}
+
+	return ips
+}
+
+// answerStrings returns the response code and the address records of msg as
+// strings.
+func answerStrings(msg *dns.Msg) (strs []string) {
+	if msg == nil {
+		return nil
+	}
+
+	ips := answerIPs(msg)
+	strs = make([]string, 0, len(ips)+1)
+	for ip := range ips {
+		strs = append(strs, ip)
+	}
+
+	slices.Sort(strs)
+
+	return append([]string{dns.RcodeToString[msg.Rcode]}, strs...)
+}
+
+// handleSecurityEvents handles requests to the GET /control/security_events
+// endpoint.
+func (s *Server) handleSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, s.secEvents.list())
+}
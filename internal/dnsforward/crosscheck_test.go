@@ -0,0 +1,163 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAnswerUpstream returns a mock upstream with the address addr, which
+// responds with an A record with ip or with NXDOMAIN if ip is nil.
+func newAnswerUpstream(addr string, ip net.IP) (u *aghtest.UpstreamMock) {
+	return &aghtest.UpstreamMock{
+		OnAddress: func() (a string) { return addr },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = new(dns.Msg).SetReply(req)
+			if ip == nil {
+				resp.Rcode = dns.RcodeNameError
+
+				return resp, nil
+			}
+
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: ip,
+			}}
+
+			return resp, nil
+		},
+	}
+}
+
+func TestServer_crossCheck(t *testing.T) {
+	first := newAnswerUpstream("first.example", net.IP{1, 2, 3, 4})
+
+	testCases := []struct {
+		other        upstream.Upstream
+		name         string
+		host         string
+		wantRcode    int
+		reject       bool
+		wantRecorded bool
+	}{{
+		other:        newAnswerUpstream("second.example", net.IP{1, 2, 3, 4}),
+		name:         "agree",
+		host:         "bank.example.",
+		wantRcode:    dns.RcodeSuccess,
+		reject:       true,
+		wantRecorded: false,
+	}, {
+		other:        newAnswerUpstream("second.example", net.IP{5, 6, 7, 8}),
+		name:         "not_sensitive",
+		host:         "other.example.",
+		wantRcode:    dns.RcodeSuccess,
+		reject:       true,
+		wantRecorded: false,
+	}, {
+		other:        newAnswerUpstream("second.example", net.IP{5, 6, 7, 8}),
+		name:         "flag",
+		host:         "www.bank.example.",
+		wantRcode:    dns.RcodeSuccess,
+		reject:       false,
+		wantRecorded: true,
+	}, {
+		other:        newAnswerUpstream("second.example", nil),
+		name:         "reject",
+		host:         "bank.example.",
+		wantRcode:    dns.RcodeServerFailure,
+		reject:       true,
+		wantRecorded: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			s.conf.AllServers = true
+			s.conf.AnswerValidation = AnswerValidationConfig{
+				Domains: []string{"Bank.Example"},
+				Enabled: true,
+				Reject:  tc.reject,
+			}
+
+			prx := &proxy.Proxy{
+				Config: proxy.Config{
+					UpstreamConfig: &proxy.UpstreamConfig{
+						Upstreams: []upstream.Upstream{first, tc.other},
+					},
+				},
+			}
+
+			req := createTestMessage(tc.host)
+			resp, err := first.Exchange(req)
+			require.NoError(t, err)
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:      req,
+					Res:      resp,
+					Addr:     &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+					Upstream: first,
+				},
+			}
+
+			s.crossCheck(dctx, prx)
+
+			assert.Equal(t, tc.wantRcode, dctx.proxyCtx.Res.Rcode)
+
+			events := s.secEvents.list()
+			if !tc.wantRecorded {
+				assert.Empty(t, events)
+
+				return
+			}
+
+			require.Len(t, events, 1)
+
+			e := events[0]
+			assert.Equal(t, "1.2.3.4", e.Client)
+			assert.Equal(t, []string{"first.example", "second.example"}, e.Upstreams)
+			assert.Equal(t, tc.reject, e.Rejected)
+			assert.Equal(t, []string{"NOERROR", "1.2.3.4"}, e.Answers[0])
+		})
+	}
+}
+
+func TestSecurityEvents(t *testing.T) {
+	se := &securityEvents{}
+	for i := 0; i < maxSecurityEvents+1; i++ {
+		se.add(&securityEvent{Domain: string(rune('a' + i%26))})
+	}
+
+	s := &Server{}
+	s.secEvents.add(&securityEvent{Domain: "example.org"})
+
+	w := httptest.NewRecorder()
+	s.handleSecurityEvents(w, httptest.NewRequest(http.MethodGet, "/control/security_events", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var events []*securityEvent
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&events))
+	require.Len(t, events, 1)
+
+	assert.Equal(t, "example.org", events[0].Domain)
+
+	list := se.list()
+	require.Len(t, list, maxSecurityEvents)
+
+	// The newest event is the first one.
+	assert.Equal(t, string(rune('a'+maxSecurityEvents%26)), list[0].Domain)
+}
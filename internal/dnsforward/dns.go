@@ -8,6 +8,7 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -56,9 +57,30 @@ type dnsContext struct {
 	// responseAD shows if the response had the AD bit set.
 	responseAD bool
 
+	// dnssecStatus is the status of the DNSSEC validation of the response by
+	// the upstream.
+	dnssecStatus querylog.DNSSECStatus
+
+	// cacheBypassed shows if the DNS cache has been bypassed for the client.
+	cacheBypassed bool
+
+	// fallback shows if the response has been received from the fallback
+	// upstreams.
+	fallback bool
+
+	// fallbackSwitched shows if the response has caused the transition
+	// between the primary and the fallback upstreams.
+	fallbackSwitched bool
+
 	// isLocalClient shows if client's IP address is from locally-served
 	// network.
 	isLocalClient bool
+
+	// isInternal shows if the request is made by AdGuard Home itself, for
+	// example by the resolve HTTP API.  Such requests aren't recorded into the
+	// query log, the statistics, and the device history, and don't consume
+	// the client's quota.
+	isInternal bool
 }
 
 // resultCode is the result of a request processing function.
@@ -82,10 +104,23 @@ const ddrHostFQDN = "_dns.resolver.arpa."
 
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error {
-	dctx := &dnsContext{
-		proxyCtx:  pctx,
-		result:    &filtering.Result{},
-		startTime: time.Now(),
+	_, err := s.processRequest(pctx, false)
+
+	return err
+}
+
+// processRequest runs the whole request processing pipeline for pctx and
+// returns the resulting context.  isInternal is true if the request is made by
+// AdGuard Home itself.
+func (s *Server) processRequest(
+	pctx *proxy.DNSContext,
+	isInternal bool,
+) (dctx *dnsContext, err error) {
+	dctx = &dnsContext{
+		proxyCtx:   pctx,
+		result:     &filtering.Result{},
+		startTime:  time.Now(),
+		isInternal: isInternal,
 	}
 
 	type modProcessFunc func(ctx *dnsContext) (rc resultCode)
@@ -98,7 +133,11 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 	mods := []modProcessFunc{
 		s.processRecursion,
 		s.processInitial,
+		s.processDeviceSeen,
+		s.processClientQuota,
+		s.processDoHCanary,
 		s.processDDRQuery,
+		s.processServerName,
 		s.processDetermineLocal,
 		s.processDHCPHosts,
 		s.processRestrictLocal,
@@ -108,6 +147,7 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 		s.processUpstream,
 		s.processFilteringAfterResponse,
 		s.ipset.process,
+		s.processResolvedArchive,
 		s.processQueryLogsAndStats,
 	}
 	for _, process := range mods {
@@ -117,10 +157,10 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 			// continue: call the next filter
 
 		case resultCodeFinish:
-			return nil
+			return dctx, nil
 
 		case resultCodeError:
-			return dctx.err
+			return dctx, dctx.err
 		}
 	}
 
@@ -129,7 +169,7 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 		pctx.Res.Compress = true
 	}
 
-	return nil
+	return dctx, nil
 }
 
 // processRecursion checks the incoming request and halts it's handling if s
@@ -165,15 +205,6 @@ func (s *Server) processInitial(dctx *dnsContext) (rc resultCode) {
 		s.conf.OnDNSRequest(pctx)
 	}
 
-	// Disable Mozilla DoH.
-	//
-	// See https://support.mozilla.org/en-US/kb/canary-domain-use-application-dnsnet.
-	if (qt == dns.TypeA || qt == dns.TypeAAAA) && q.Name == "use-application-dns.net." {
-		pctx.Res = s.genNXDomain(pctx.Req)
-
-		return resultCodeFinish
-	}
-
 	// Get the ClientID, if any, before getting client-specific filtering
 	// settings.
 	var key [8]byte
@@ -187,6 +218,46 @@ func (s *Server) processInitial(dctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
+// processDeviceSeen records the device, which has sent the request, into the
+// device history.
+func (s *Server) processDeviceSeen(dctx *dnsContext) (rc resultCode) {
+	deviceSeen := s.conf.DeviceSeen
+	if deviceSeen == nil || dctx.isInternal {
+		return resultCodeSuccess
+	}
+
+	ip, _ := netutil.IPAndPortFromAddr(dctx.proxyCtx.Addr)
+	if ip == nil {
+		return resultCodeSuccess
+	}
+
+	ip = netutil.CloneIP(ip)
+	s.anonymizer.Load()(ip)
+	deviceSeen(ip, dctx.clientID)
+
+	return resultCodeSuccess
+}
+
+// processClientQuota refuses the request if the client has exceeded its daily
+// query quota.
+func (s *Server) processClientQuota(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	consumeQuota := s.conf.ConsumeClientQuota
+	if pctx.Addr == nil || consumeQuota == nil || dctx.isInternal {
+		return resultCodeSuccess
+	}
+
+	id := stringutil.Coalesce(dctx.clientID, ipStringFromAddr(pctx.Addr))
+	if consumeQuota(id) {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: client %s exceeded its daily query quota", id)
+	pctx.Res = s.makeResponseREFUSED(pctx.Req)
+
+	return resultCodeFinish
+}
+
 func (s *Server) setTableHostToIP(t hostToIPTable) {
 	s.tableHostToIPLock.Lock()
 	defer s.tableHostToIPLock.Unlock()
@@ -644,7 +715,13 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		return resultCodeFinish
 	}
 
+	if s.dampServfail(dctx) {
+		return resultCodeSuccess
+	}
+
 	s.setCustomUpstream(pctx, dctx.clientID)
+	s.setScheduledUpstream(pctx, time.Now())
+	s.setQtypeUpstream(pctx)
 
 	origReqAD := false
 	if s.conf.EnableDNSSEC {
@@ -663,12 +740,20 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		return resultCodeError
 	}
 
-	if dctx.err = prx.Resolve(pctx); dctx.err != nil {
+	s.bypassCache(dctx, prx)
+
+	dctx.err = s.resolve(prx, pctx)
+	s.recordServfail(dctx)
+	if dctx.err != nil {
 		return resultCodeError
 	}
 
 	dctx.responseFromUpstream = true
 	dctx.responseAD = pctx.Res.AuthenticatedData
+	dctx.dnssecStatus = dnssecStatus(pctx.Req, pctx.Res)
+
+	s.checkFallback(dctx, prx)
+	s.crossCheck(dctx, prx)
 
 	if s.conf.EnableDNSSEC && !origReqAD {
 		pctx.Req.AuthenticatedData = false
@@ -678,6 +763,30 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
+// resolve resolves pctx using prx.  If the case randomization is enabled, the
+// question is sent to the upstream with the randomized case of the name.
+func (s *Server) resolve(prx *proxy.Proxy, pctx *proxy.DNSContext) (err error) {
+	if !s.conf.RandomizeUpstreamCase {
+		return prx.Resolve(pctx)
+	}
+
+	q := &pctx.Req.Question[0]
+	orig := q.Name
+	randomized, err := randomizeCase(orig)
+	if err != nil {
+		return err
+	}
+
+	q.Name = randomized
+	err = prx.Resolve(pctx)
+	q.Name = orig
+	if err != nil {
+		return err
+	}
+
+	return checkRandomizedCase(pctx, orig, randomized)
+}
+
 // isDHCPClientHostQ returns true if q is from a request for a DHCP client
 // hostname.  If ok is true, reqHost contains the requested hostname.
 func (s *Server) isDHCPClientHostQ(q dns.Question) (reqHost string, ok bool) {
@@ -723,6 +832,31 @@ func (s *Server) setCustomUpstream(pctx *proxy.DNSContext, clientID string) {
 	pctx.CustomUpstreamConfig = upsConf
 }
 
+// bypassCache makes prx resolve the request without using the DNS cache if the
+// client is configured to bypass it.
+func (s *Server) bypassCache(dctx *dnsContext, prx *proxy.Proxy) {
+	pctx := dctx.proxyCtx
+	bypass := s.conf.BypassCacheForClient
+	if pctx.Addr == nil || bypass == nil {
+		return
+	}
+
+	id := stringutil.Coalesce(dctx.clientID, ipStringFromAddr(pctx.Addr))
+	if !bypass(id) {
+		return
+	}
+
+	dctx.cacheBypassed = true
+
+	// The proxy never uses the cache for the requests with custom upstreams,
+	// so use the general ones if the client has none.
+	if pctx.CustomUpstreamConfig == nil {
+		pctx.CustomUpstreamConfig = prx.UpstreamConfig
+	}
+
+	log.Debug("dns: bypassing cache for client %s", id)
+}
+
 // Apply filtering logic after we have received response from upstream servers
 func (s *Server) processFilteringAfterResponse(dctx *dnsContext) (rc resultCode) {
 	pctx := dctx.proxyCtx
@@ -771,7 +905,9 @@ func (s *Server) filterAfterResponse(dctx *dnsContext, pctx *proxy.DNSContext) (
 
 	if result != nil {
 		dctx.result = result
-		dctx.origResp = pctx.Res
+		if result.IsFiltered {
+			dctx.origResp = pctx.Res
+		}
 	}
 
 	return resultCodeSuccess
@@ -229,6 +229,199 @@ func TestServer_ProcessDetermineLocal(t *testing.T) {
 	}
 }
 
+func TestServer_ProcessClientQuota(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				ConsumeClientQuota: func(id string) (ok bool) {
+					return id != "exceeded"
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		clientID string
+		wantRes  bool
+		wantRC   resultCode
+	}{{
+		name:     "allowed",
+		clientID: "allowed",
+		wantRes:  false,
+		wantRC:   resultCodeSuccess,
+	}, {
+		name:     "exceeded",
+		clientID: "exceeded",
+		wantRes:  true,
+		wantRC:   resultCodeFinish,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  createTestMessage("example.com."),
+					Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+				},
+				clientID: tc.clientID,
+			}
+
+			rc := s.processClientQuota(dctx)
+			assert.Equal(t, tc.wantRC, rc)
+
+			if !tc.wantRes {
+				assert.Nil(t, dctx.proxyCtx.Res)
+
+				return
+			}
+
+			require.NotNil(t, dctx.proxyCtx.Res)
+
+			assert.Equal(t, dns.RcodeRefused, dctx.proxyCtx.Res.Rcode)
+		})
+	}
+}
+
+func TestServer_ProcessDoHCanary(t *testing.T) {
+	testCases := []struct {
+		name    string
+		host    string
+		qtype   uint16
+		enabled bool
+		wantRes bool
+	}{{
+		name:    "canary",
+		host:    "use-application-dns.net.",
+		qtype:   dns.TypeA,
+		enabled: true,
+		wantRes: true,
+	}, {
+		name:    "canary_aaaa_case",
+		host:    "Use-Application-DNS.net.",
+		qtype:   dns.TypeAAAA,
+		enabled: true,
+		wantRes: true,
+	}, {
+		name:    "canary_txt",
+		host:    "use-application-dns.net.",
+		qtype:   dns.TypeTXT,
+		enabled: true,
+		wantRes: false,
+	}, {
+		name:    "subdomain",
+		host:    "sub.use-application-dns.net.",
+		qtype:   dns.TypeA,
+		enabled: true,
+		wantRes: false,
+	}, {
+		name:    "disabled",
+		host:    "use-application-dns.net.",
+		qtype:   dns.TypeA,
+		enabled: false,
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				conf: ServerConfig{
+					FilteringConfig: FilteringConfig{
+						BlockDoHCanary: tc.enabled,
+					},
+				},
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessageWithType(tc.host, tc.qtype),
+				},
+			}
+
+			rc := s.processDoHCanary(dctx)
+			assert.Equal(t, resultCodeSuccess, rc)
+
+			if !tc.wantRes {
+				assert.Nil(t, dctx.proxyCtx.Res)
+				assert.Nil(t, dctx.result)
+
+				return
+			}
+
+			require.NotNil(t, dctx.proxyCtx.Res)
+			require.NotNil(t, dctx.result)
+
+			assert.Equal(t, dns.RcodeNameError, dctx.proxyCtx.Res.Rcode)
+			assert.Equal(t, filtering.FilteredDoHCanary, dctx.result.Reason)
+			assert.True(t, dctx.result.IsFiltered)
+		})
+	}
+}
+
+func TestServer_BypassCache(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BypassCacheForClient: func(id string) (ok bool) {
+					return id == "bypass"
+				},
+			},
+		},
+	}
+
+	generalConf := &proxy.UpstreamConfig{}
+	customConf := &proxy.UpstreamConfig{}
+	prx := &proxy.Proxy{
+		Config: proxy.Config{
+			UpstreamConfig: generalConf,
+		},
+	}
+
+	testCases := []struct {
+		customConf   *proxy.UpstreamConfig
+		wantConf     *proxy.UpstreamConfig
+		name         string
+		clientID     string
+		wantBypassed bool
+	}{{
+		customConf:   nil,
+		wantConf:     nil,
+		name:         "cached",
+		clientID:     "cached",
+		wantBypassed: false,
+	}, {
+		customConf:   nil,
+		wantConf:     generalConf,
+		name:         "bypass",
+		clientID:     "bypass",
+		wantBypassed: true,
+	}, {
+		customConf:   customConf,
+		wantConf:     customConf,
+		name:         "bypass_custom_upstreams",
+		clientID:     "bypass",
+		wantBypassed: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:                  createTestMessage("example.com."),
+					Addr:                 &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+					CustomUpstreamConfig: tc.customConf,
+				},
+				clientID: tc.clientID,
+			}
+
+			s.bypassCache(dctx, prx)
+
+			assert.Equal(t, tc.wantBypassed, dctx.cacheBypassed)
+			assert.Same(t, tc.wantConf, dctx.proxyCtx.CustomUpstreamConfig)
+		})
+	}
+}
+
 func TestServer_ProcessDHCPHosts_localRestriction(t *testing.T) {
 	knownIP := net.IP{1, 2, 3, 4}
 
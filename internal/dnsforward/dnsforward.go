@@ -58,6 +58,17 @@ type hostToIPTable = map[string]net.IP
 //
 // The zero Server is empty and ready for use.
 type Server struct {
+	// filteringErrors is the number of the requests and the responses the
+	// filtering engine has failed to check.  It must be accessed atomically.
+	// It's arranged at the beginning of the structure to keep 64-bit
+	// alignment.
+	filteringErrors uint64
+
+	// resGuard tracks the usage of the goroutines and the file descriptors to
+	// shed the load before they're exhausted.  It's arranged right after
+	// filteringErrors to keep the 64-bit alignment of its counter.
+	resGuard resourceGuard
+
 	dnsProxy   *proxy.Proxy         // DNS proxy instance
 	dnsFilter  *filtering.DNSFilter // DNS filter instance
 	dhcpServer dhcpd.Interface      // DHCP server instance (optional)
@@ -78,6 +89,12 @@ type Server struct {
 	// anonymizer masks the client's IP addresses if needed.
 	anonymizer *aghnet.IPMut
 
+	// srvNames are the lowercased FQDNs of the server which are answered
+	// locally.  It's nil if the handling is disabled.
+	srvNames map[string]struct{}
+	// srvIPs are the addresses used in responses for srvNames.
+	srvIPs []net.IP
+
 	tableHostToIP     hostToIPTable
 	tableHostToIPLock sync.Mutex
 
@@ -95,6 +112,42 @@ type Server struct {
 
 	isRunning bool
 
+	// cachePriorityDone is closed once the server is stopped to stop
+	// refreshing the priority domains in the cache.
+	cachePriorityDone chan struct{}
+
+	// resGuardDone is closed once the server is stopped to stop guarding the
+	// resources.  It's nil if the resource guard is disabled.
+	resGuardDone chan struct{}
+
+	// fallbackActive is 1 if the last response from upstreams has been
+	// received from the fallback ones.  It must be accessed atomically.
+	fallbackActive uint32
+
+	// secEvents are the recent disagreements between the answers of
+	// upstreams.
+	secEvents securityEvents
+
+	// upsEvents tracks the states of the upstreams and keeps the recent
+	// transitions between them.
+	upsEvents upstreamEvents
+
+	// upsStats collects the statistics of the exchanges with each upstream.
+	upsStats upstreamStats
+
+	// servfailDamper tracks the failed responses of the upstreams to back off
+	// the requests for the failing zones.
+	servfailDamper servfailDamper
+
+	// resolvedArchive is the reverse index of the recently resolved
+	// addresses.
+	resolvedArchive resolvedArchive
+
+	// dotCerts and doqCerts are the certificates of the DNS-over-TLS and
+	// DNS-over-QUIC listeners, the first of which is the default one.
+	dotCerts []*tlsCert
+	doqCerts []*tlsCert
+
 	conf ServerConfig
 	// serverLock protects Server.
 	serverLock sync.RWMutex
@@ -212,6 +265,9 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.BlockedHosts = stringutil.CloneSlice(sc.BlockedHosts)
 	c.TrustedProxies = stringutil.CloneSlice(sc.TrustedProxies)
 	c.UpstreamDNS = stringutil.CloneSlice(sc.UpstreamDNS)
+	c.FallbackDNS = stringutil.CloneSlice(sc.FallbackDNS)
+	c.AnswerValidation.Domains = stringutil.CloneSlice(sc.AnswerValidation.Domains)
+	c.CachePriorityDomains = cloneCachePriorityDomains(sc.CachePriorityDomains)
 }
 
 // RDNSSettings returns the copy of actual RDNS configuration.
@@ -336,10 +392,21 @@ func (s *Server) Start() error {
 // startLocked starts the DNS server without locking. For internal use only.
 func (s *Server) startLocked() error {
 	err := s.dnsProxy.Start()
-	if err == nil {
-		s.isRunning = true
+	if err != nil {
+		return err
 	}
-	return err
+
+	s.isRunning = true
+
+	s.cachePriorityDone = make(chan struct{})
+	go s.refreshCachePriorityDomains(s.cachePriorityDone)
+
+	if s.conf.ResourceGuard.Enabled {
+		s.resGuardDone = make(chan struct{})
+		go s.guardResources(s.conf.ResourceGuard, s.resGuardDone)
+	}
+
+	return nil
 }
 
 // defaultLocalTimeout is the default timeout for resolving addresses from
@@ -445,6 +512,11 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 		return fmt.Errorf("checking blocking mode: %w", err)
 	}
 
+	err = s.conf.FilteringFailureMode.validate()
+	if err != nil {
+		return fmt.Errorf("checking filtering failure mode: %w", err)
+	}
+
 	s.initDefaultSettings()
 
 	err = s.prepareIpsetListSettings()
@@ -485,6 +557,8 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
 
+	s.prepareServerNames()
+
 	err = s.setupResolvers(s.conf.LocalPTRResolvers)
 	if err != nil {
 		return fmt.Errorf("setting up resolvers: %w", err)
@@ -562,6 +636,16 @@ func (s *Server) Stop() error {
 func (s *Server) stopLocked() (err error) {
 	var errs []error
 
+	if s.cachePriorityDone != nil {
+		close(s.cachePriorityDone)
+		s.cachePriorityDone = nil
+	}
+
+	if s.resGuardDone != nil {
+		close(s.resGuardDone)
+		s.resGuardDone = nil
+	}
+
 	if s.dnsProxy != nil {
 		err = s.dnsProxy.Stop()
 		if err != nil {
@@ -0,0 +1,53 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/miekg/dns"
+)
+
+// isDNSSECFailure returns true if the extended DNS error code reports the
+// failed DNSSEC validation.  The unsupported algorithms and digest types
+// aren't failures, since such zones are treated as insecure, see RFC 4035.
+func isDNSSECFailure(code uint16) (ok bool) {
+	switch code {
+	case
+		dns.ExtendedErrorCodeDNSSECIndeterminate,
+		dns.ExtendedErrorCodeDNSBogus,
+		dns.ExtendedErrorCodeSignatureExpired,
+		dns.ExtendedErrorCodeSignatureNotYetValid,
+		dns.ExtendedErrorCodeDNSKEYMissing,
+		dns.ExtendedErrorCodeRRSIGsMissing,
+		dns.ExtendedErrorCodeNoZoneKeyBitSet,
+		dns.ExtendedErrorCodeNSECMissing:
+		return true
+	default:
+		return false
+	}
+}
+
+// dnssecStatus returns the status of the DNSSEC validation of resp to req by
+// the upstream.  The validation is considered requested if req has either the
+// AD or the DO bit set.  The failures are only detected if the upstream reports
+// them with an extended DNS error, since a plain SERVFAIL may have other
+// causes.
+func dnssecStatus(req, resp *dns.Msg) (st querylog.DNSSECStatus) {
+	if resp.AuthenticatedData {
+		return querylog.DNSSECStatusSecure
+	}
+
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok && isDNSSECFailure(ede.InfoCode) {
+				return querylog.DNSSECStatusBogus
+			}
+		}
+	}
+
+	if req.AuthenticatedData {
+		return querylog.DNSSECStatusInsecure
+	} else if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		return querylog.DNSSECStatusInsecure
+	}
+
+	return querylog.DNSSECStatusNone
+}
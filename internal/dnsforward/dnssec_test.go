@@ -0,0 +1,85 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSSECStatus(t *testing.T) {
+	newReq := func(ad, do bool) (req *dns.Msg) {
+		req = (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		req.AuthenticatedData = ad
+		if do {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+
+		return req
+	}
+
+	newResp := func(req *dns.Msg, ad bool, ede uint16) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.AuthenticatedData = ad
+		if ede != dns.ExtendedErrorCodeOther {
+			resp.Rcode = dns.RcodeServerFailure
+			resp.SetEdns0(dns.DefaultMsgSize, true)
+			opt := resp.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: ede})
+		}
+
+		return resp
+	}
+
+	testCases := []struct {
+		req  *dns.Msg
+		name string
+		ad   bool
+		ede  uint16
+		want querylog.DNSSECStatus
+	}{{
+		req:  newReq(false, false),
+		name: "not_requested",
+		ad:   false,
+		ede:  dns.ExtendedErrorCodeOther,
+		want: querylog.DNSSECStatusNone,
+	}, {
+		req:  newReq(true, false),
+		name: "secure",
+		ad:   true,
+		ede:  dns.ExtendedErrorCodeOther,
+		want: querylog.DNSSECStatusSecure,
+	}, {
+		req:  newReq(true, false),
+		name: "insecure_ad",
+		ad:   false,
+		ede:  dns.ExtendedErrorCodeOther,
+		want: querylog.DNSSECStatusInsecure,
+	}, {
+		req:  newReq(false, true),
+		name: "insecure_do",
+		ad:   false,
+		ede:  dns.ExtendedErrorCodeOther,
+		want: querylog.DNSSECStatusInsecure,
+	}, {
+		req:  newReq(true, false),
+		name: "bogus",
+		ad:   false,
+		ede:  dns.ExtendedErrorCodeSignatureExpired,
+		want: querylog.DNSSECStatusBogus,
+	}, {
+		req:  newReq(true, false),
+		name: "other_error",
+		ad:   false,
+		ede:  dns.ExtendedErrorCodeNotReady,
+		want: querylog.DNSSECStatusInsecure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := newResp(tc.req, tc.ad, tc.ede)
+			assert.Equal(t, tc.want, dnssecStatus(tc.req, resp))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/miekg/dns"
+)
+
+// The extra texts of the extended DNS errors describing the categories of the
+// blocked requests.  The filter lists have no metadata about the categories of
+// their rules, so the requests blocked by them are reported with the neutral
+// edeTextBlocked.
+const (
+	edeTextAdminRule      = "admin rule"
+	edeTextBlocked        = "blocked"
+	edeTextBlockedService = "blocked service"
+	edeTextParental       = "parental"
+	edeTextSafeBrowsing   = "safebrowsing"
+	edeTextSafeSearch     = "safe search"
+)
+
+// blockedEDE returns the extended DNS error, see RFC 8914, describing why the
+// request has been filtered with res.  ede is nil if res isn't a block.
+//
+// The rules of the administrator and the security and the blocked services
+// settings are imposed by the operator of the server, so they're reported as
+// Blocked.  The filter lists and the parental control are usually what the
+// users have asked for, so they're reported as Filtered.
+func blockedEDE(res *filtering.Result) (ede *dns.EDNS0_EDE) {
+	ede = &dns.EDNS0_EDE{}
+	switch res.Reason {
+	case filtering.FilteredBlockList:
+		if len(res.Rules) > 0 && res.Rules[0].FilterListID == filtering.CustomListID {
+			ede.InfoCode, ede.ExtraText = dns.ExtendedErrorCodeBlocked, edeTextAdminRule
+		} else {
+			ede.InfoCode, ede.ExtraText = dns.ExtendedErrorCodeFiltered, edeTextBlocked
+		}
+	case filtering.FilteredBlockedService:
+		ede.InfoCode, ede.ExtraText = dns.ExtendedErrorCodeBlocked, edeTextBlockedService
+	case filtering.FilteredParental:
+		ede.InfoCode, ede.ExtraText = dns.ExtendedErrorCodeFiltered, edeTextParental
+	case filtering.FilteredSafeBrowsing:
+		ede.InfoCode, ede.ExtraText = dns.ExtendedErrorCodeBlocked, edeTextSafeBrowsing
+	case filtering.FilteredSafeSearch:
+		ede.InfoCode, ede.ExtraText = dns.ExtendedErrorCodeForgedAnswer, edeTextSafeSearch
+	default:
+		return nil
+	}
+
+	return ede
+}
+
+// addBlockedEDE adds the extended DNS error describing why the request req has
+// been filtered with res to resp.  The error is only added if req has the EDNS
+// OPT record, since otherwise resp mustn't have one, see RFC 6891.  The NODATA
+// responses to the questions suppressed by the $dnstype rules don't get one
+// either, since the host itself isn't blocked.
+func addBlockedEDE(req, resp *dns.Msg, res *filtering.Result) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil || res.SuppressedType == req.Question[0].Qtype {
+		return
+	}
+
+	ede := blockedEDE(res)
+	if ede == nil {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), false)
+		opt = resp.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, ede)
+}
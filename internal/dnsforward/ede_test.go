@@ -0,0 +1,125 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_genDNSFilterMessage_ede(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockingMode: BlockingModeNXDOMAIN,
+			},
+		},
+	}
+
+	testCases := []struct {
+		res       *filtering.Result
+		wantEDE   *dns.EDNS0_EDE
+		name      string
+		wantRCode int
+		withEDNS  bool
+	}{{
+		res: &filtering.Result{
+			Rules:      []*filtering.ResultRule{{FilterListID: 1}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		wantEDE: &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeFiltered,
+			ExtraText: edeTextBlocked,
+		},
+		name:      "filter_list",
+		wantRCode: dns.RcodeNameError,
+		withEDNS:  true,
+	}, {
+		res: &filtering.Result{
+			Rules:      []*filtering.ResultRule{{FilterListID: filtering.CustomListID}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		wantEDE: &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: edeTextAdminRule,
+		},
+		name:      "admin_rule",
+		wantRCode: dns.RcodeNameError,
+		withEDNS:  true,
+	}, {
+		res: &filtering.Result{
+			Reason:     filtering.FilteredBlockedService,
+			IsFiltered: true,
+		},
+		wantEDE: &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: edeTextBlockedService,
+		},
+		name:      "blocked_service",
+		wantRCode: dns.RcodeNameError,
+		withEDNS:  true,
+	}, {
+		res: &filtering.Result{
+			Reason:     filtering.FilteredParental,
+			IsFiltered: true,
+		},
+		wantEDE: &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeFiltered,
+			ExtraText: edeTextParental,
+		},
+		name:      "parental",
+		wantRCode: dns.RcodeNameError,
+		withEDNS:  true,
+	}, {
+		res: &filtering.Result{
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		wantEDE:   nil,
+		name:      "no_edns",
+		wantRCode: dns.RcodeNameError,
+		withEDNS:  false,
+	}, {
+		res: &filtering.Result{
+			Reason:         filtering.FilteredBlockList,
+			IsFiltered:     true,
+			SuppressedType: dns.TypeTXT,
+		},
+		wantEDE:   nil,
+		name:      "suppressed_type",
+		wantRCode: dns.RcodeSuccess,
+		withEDNS:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestMessageWithType("blocked.example.", dns.TypeTXT)
+			if tc.withEDNS {
+				req.SetEdns0(1232, false)
+			}
+
+			resp := s.genDNSFilterMessage(&proxy.DNSContext{Req: req}, tc.res)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRCode, resp.Rcode)
+
+			opt := resp.IsEdns0()
+			if tc.wantEDE == nil {
+				assert.Nil(t, opt)
+
+				return
+			}
+
+			require.NotNil(t, opt)
+			require.Len(t, opt.Option, 1)
+
+			assert.Equal(t, uint16(1232), opt.UDPSize())
+			assert.Equal(t, tc.wantEDE, opt.Option[0])
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package dnsforward
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// errFallbackDomainUpstreams is returned when the fallback upstreams contain
+// domain-specific ones, since those are always used as the primary ones.
+const errFallbackDomainUpstreams errors.Error = "domain-specific upstreams are not supported"
+
+// prepareFallbackUpstreams parses the fallback upstream servers.
+func (s *Server) prepareFallbackUpstreams(httpVersions []upstream.HTTPVersion) (err error) {
+	fallbacks := stringutil.FilterOut(s.conf.FallbackDNS, IsCommentOrEmpty)
+	if len(fallbacks) == 0 {
+		s.conf.FallbackUpstreams = nil
+
+		return nil
+	}
+
+	uc, err := proxy.ParseUpstreamsConfig(
+		fallbacks,
+		&upstream.Options{
+			Bootstrap:    s.conf.BootstrapDNS,
+			Timeout:      s.conf.UpstreamTimeout,
+			HTTPVersions: httpVersions,
+		},
+	)
+	if err == nil && hasDomainUpstreams(uc) {
+		err = errFallbackDomainUpstreams
+	}
+
+	if err != nil {
+		return fmt.Errorf("parsing fallback upstreams: %w", err)
+	}
+
+	s.conf.FallbackUpstreams = s.monitorUpstreams(uc.Upstreams)
+
+	return nil
+}
+
+// hasDomainUpstreams returns true if uc contains domain-specific upstreams.
+func hasDomainUpstreams(uc *proxy.UpstreamConfig) (ok bool) {
+	return len(uc.DomainReservedUpstreams) > 0 || len(uc.SpecifiedDomainUpstreams) > 0
+}
+
+// validateFallbacks returns an error if any of the fallback upstreams is
+// invalid.
+func validateFallbacks(fallbacks []string) (err error) {
+	uc, err := newUpstreamConfig(fallbacks)
+	if err != nil {
+		return err
+	} else if uc != nil && hasDomainUpstreams(uc) {
+		return errFallbackDomainUpstreams
+	}
+
+	return nil
+}
+
+// checkFallback marks dctx if the response has been received from the fallback
+// upstreams of prx and logs the transitions between the primary and the
+// fallback upstreams.
+func (s *Server) checkFallback(dctx *dnsContext, prx *proxy.Proxy) {
+	if len(prx.Fallbacks) == 0 {
+		return
+	}
+
+	u := dctx.proxyCtx.Upstream
+	if u == nil {
+		// The response has been served from the cache.
+		return
+	}
+
+	var active uint32
+	for _, f := range prx.Fallbacks {
+		if f == u {
+			dctx.fallback = true
+			active = 1
+
+			break
+		}
+	}
+
+	if atomic.SwapUint32(&s.fallbackActive, active) == active {
+		return
+	}
+
+	dctx.fallbackSwitched = true
+	if dctx.fallback {
+		log.Info("dns: primary upstreams failed, switched to fallback upstream %s", u.Address())
+	} else {
+		log.Info("dns: primary upstreams recovered, switched back from fallback upstreams")
+	}
+}
@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_checkFallback(t *testing.T) {
+	primaryFails := true
+	primary := &aghtest.UpstreamMock{
+		OnAddress: func() (addr string) { return "primary.example" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if primaryFails {
+				return nil, aghtest.ErrUpstream
+			}
+
+			return new(dns.Msg).SetReply(req), nil
+		},
+	}
+	fallback := &aghtest.UpstreamMock{
+		OnAddress: func() (addr string) { return "fallback.example" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return new(dns.Msg).SetReply(req), nil
+		},
+	}
+
+	s := &Server{}
+	prx := &proxy.Proxy{
+		Config: proxy.Config{
+			UpstreamConfig: &proxy.UpstreamConfig{
+				Upstreams: []upstream.Upstream{primary},
+			},
+			Fallbacks: []upstream.Upstream{fallback},
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		primaryFails bool
+		wantFallback bool
+		wantSwitched bool
+	}{{
+		name:         "primary",
+		primaryFails: false,
+		wantFallback: false,
+		wantSwitched: false,
+	}, {
+		name:         "switch_to_fallback",
+		primaryFails: true,
+		wantFallback: true,
+		wantSwitched: true,
+	}, {
+		name:         "fallback",
+		primaryFails: true,
+		wantFallback: true,
+		wantSwitched: false,
+	}, {
+		name:         "switch_to_primary",
+		primaryFails: false,
+		wantFallback: false,
+		wantSwitched: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			primaryFails = tc.primaryFails
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  createTestMessage("example.com."),
+					Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+				},
+			}
+
+			require.NoError(t, prx.Resolve(dctx.proxyCtx))
+
+			s.checkFallback(dctx, prx)
+
+			assert.Equal(t, tc.wantFallback, dctx.fallback)
+			assert.Equal(t, tc.wantSwitched, dctx.fallbackSwitched)
+		})
+	}
+}
+
+func TestValidateFallbacks(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		fallbacks  []string
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		fallbacks:  nil,
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		fallbacks:  []string{"# comment", "1.1.1.1", "tls://dns.example"},
+	}, {
+		name:       "domain_specific",
+		wantErrMsg: string(errFallbackDomainUpstreams),
+		fallbacks:  []string{"1.1.1.1", "[/example.org/]8.8.8.8"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateFallbacks(tc.fallbacks)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErrMsg)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package dnsforward
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
@@ -19,6 +20,12 @@ func (s *Server) beforeRequestHandler(
 	_ *proxy.Proxy,
 	pctx *proxy.DNSContext,
 ) (reply bool, err error) {
+	if s.shedLoad(pctx) {
+		log.Debug("dnsforward: shedding %s request from %s", pctx.Proto, pctx.Addr)
+
+		return false, nil
+	}
+
 	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
 	clientID, err := s.clientIDFromDNSContext(pctx)
 	if err != nil {
@@ -68,9 +75,11 @@ func (s *Server) filterDNSRequest(dctx *dnsContext) (res *filtering.Result, err
 	req := pctx.Req
 	q := req.Question[0]
 	host := strings.TrimSuffix(q.Name, ".")
-	resVal, err := s.dnsFilter.CheckHost(host, q.Qtype, dctx.setts)
+	resVal, err := s.checkHost(host, q.Qtype, dctx.setts)
 	if err != nil {
-		return nil, fmt.Errorf("checking host %q: %w", host, err)
+		s.filteringFailed(pctx, fmt.Errorf("checking host %q: %w", host, err))
+
+		return &filtering.Result{}, nil
 	}
 
 	// TODO(a.garipov): Make CheckHost return a pointer.
@@ -141,6 +150,8 @@ func (s *Server) checkHostRules(host string, rrtype uint16, setts *filtering.Set
 		return nil, nil
 	}
 
+	defer withRecoveredFiltering(&err)
+
 	var res filtering.Result
 	res, err = s.dnsFilter.CheckHostRules(host, rrtype, setts)
 	if err != nil {
@@ -150,9 +161,29 @@ func (s *Server) checkHostRules(host string, rrtype uint16, setts *filtering.Set
 	return &res, err
 }
 
+// checkIPLists checks ip against the IP reputation lists.  It is safe for
+// concurrent use.
+func (s *Server) checkIPLists(ip net.IP) (r *filtering.Result) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.dnsFilter == nil {
+		return nil
+	}
+
+	res, ok := s.dnsFilter.CheckIPLists(ip)
+	if !ok {
+		return nil
+	}
+
+	return &res
+}
+
 // filterDNSResponse checks each resource record of the response's answer
 // section from pctx and returns a non-nil res if at least one of canonical
-// names or IP addresses in it matches the filtering rules.
+// names or IP addresses in it matches the filtering rules or the IP reputation
+// lists.  res.IsFiltered is false if the response is only flagged by an IP
+// list.
 func (s *Server) filterDNSResponse(
 	pctx *proxy.DNSContext,
 	setts *filtering.Settings,
@@ -161,17 +192,21 @@ func (s *Server) filterDNSResponse(
 		return nil, nil
 	}
 
+	var flagged *filtering.Result
 	for _, a := range pctx.Res.Answer {
 		host := ""
+		var ip net.IP
 		var rrtype uint16
 		switch a := a.(type) {
 		case *dns.CNAME:
 			host = strings.TrimSuffix(a.Target, ".")
 			rrtype = dns.TypeCNAME
 		case *dns.A:
+			ip = a.A
 			host = a.A.String()
 			rrtype = dns.TypeA
 		case *dns.AAAA:
+			ip = a.AAAA
 			host = a.AAAA.String()
 			rrtype = dns.TypeAAAA
 		default:
@@ -182,16 +217,32 @@ func (s *Server) filterDNSResponse(
 
 		res, err = s.checkHostRules(host, rrtype, setts)
 		if err != nil {
-			return nil, err
-		} else if res == nil {
-			continue
-		} else if res.IsFiltered {
-			pctx.Res = s.genDNSFilterMessage(pctx, res)
-			log.Debug("DNSFwd: Matched %s by response: %s", pctx.Req.Question[0].Name, host)
-
-			return res, nil
+			s.filteringFailed(pctx, fmt.Errorf("checking %s %s: %w", dns.Type(rrtype), host, err))
+
+			return nil, nil
+		} else if res == nil || !res.IsFiltered {
+			if ip == nil {
+				continue
+			}
+
+			res = s.checkIPLists(ip)
+			if res == nil {
+				continue
+			} else if !res.IsFiltered {
+				log.Debug("dnsforward: %s flagged by ip list for %s", host, a.Header().Name)
+				if flagged == nil {
+					flagged = res
+				}
+
+				continue
+			}
 		}
+
+		pctx.Res = s.genDNSFilterMessage(pctx, res)
+		log.Debug("DNSFwd: Matched %s by response: %s", pctx.Req.Question[0].Name, host)
+
+		return res, nil
 	}
 
-	return nil, nil
+	return flagged, nil
 }
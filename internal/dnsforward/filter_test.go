@@ -152,3 +152,60 @@ func TestHandleDNSRequest_filterDNSResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_genDNSFilterMessage_suppressedType(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockingMode: BlockingModeNXDOMAIN,
+			},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		qtype     uint16
+		suppr     uint16
+		wantRCode int
+	}{{
+		name:      "suppressed",
+		qtype:     dns.TypeTXT,
+		suppr:     dns.TypeTXT,
+		wantRCode: dns.RcodeSuccess,
+	}, {
+		name:      "suppressed_a",
+		qtype:     dns.TypeA,
+		suppr:     dns.TypeA,
+		wantRCode: dns.RcodeSuccess,
+	}, {
+		name:      "blocked",
+		qtype:     dns.TypeTXT,
+		suppr:     0,
+		wantRCode: dns.RcodeNameError,
+	}, {
+		name:      "response_type",
+		qtype:     dns.TypeA,
+		suppr:     dns.TypeCNAME,
+		wantRCode: dns.RcodeNameError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &proxy.DNSContext{
+				Req: createTestMessageWithType("telemetry.example.", tc.qtype),
+			}
+			res := &filtering.Result{
+				Reason:         filtering.FilteredBlockList,
+				IsFiltered:     true,
+				SuppressedType: tc.suppr,
+			}
+
+			resp := s.genDNSFilterMessage(dctx, res)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRCode, resp.Rcode)
+			assert.Empty(t, resp.Answer)
+			assert.Len(t, resp.Ns, 1)
+		})
+	}
+}
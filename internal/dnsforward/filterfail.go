@@ -0,0 +1,84 @@
+package dnsforward
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// FilteringFailureMode defines how the requests are answered if the filtering
+// engine fails to check them.
+type FilteringFailureMode string
+
+// Allowed filtering failure modes.
+const (
+	// FilteringFailOpen means that the requests are processed as if they
+	// haven't matched any rules.  It's the default.
+	FilteringFailOpen FilteringFailureMode = "open"
+
+	// FilteringFailClosed means that the requests are answered with SERVFAIL.
+	FilteringFailClosed FilteringFailureMode = "closed"
+)
+
+// validate returns an error if m isn't a valid filtering failure mode.  The
+// empty mode is valid and means [FilteringFailOpen].
+func (m FilteringFailureMode) validate() (err error) {
+	switch m {
+	case "", FilteringFailOpen, FilteringFailClosed:
+		return nil
+	default:
+		return fmt.Errorf("bad filtering failure mode %q", m)
+	}
+}
+
+// withRecoveredFiltering turns the value recovered from the panic of the
+// filtering engine, if any, into the error pointed by err.  err must not be
+// nil.
+func withRecoveredFiltering(err *error) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	log.Error("dnsforward: filtering engine panic: %v", p)
+
+	*err = fmt.Errorf("filtering engine panic: %v", p)
+}
+
+// checkHost checks the host against the filters and the other filtering
+// sources.  The panic of the filtering engine is returned as an error.
+func (s *Server) checkHost(
+	host string,
+	qtype uint16,
+	setts *filtering.Settings,
+) (res filtering.Result, err error) {
+	defer withRecoveredFiltering(&err)
+
+	return s.dnsFilter.CheckHost(host, qtype, setts)
+}
+
+// filteringFailed handles the error of the filtering engine checking the
+// request or the response of pctx according to the filtering failure mode.  It
+// sets the response of pctx to SERVFAIL in [FilteringFailClosed] mode.
+func (s *Server) filteringFailed(pctx *proxy.DNSContext, err error) {
+	atomic.AddUint64(&s.filteringErrors, 1)
+
+	name := pctx.Req.Question[0].Name
+	if s.conf.FilteringFailureMode == FilteringFailClosed {
+		log.Error("dnsforward: filtering %s: %s; responding with servfail", name, err)
+		pctx.Res = s.genServerFailure(pctx.Req)
+
+		return
+	}
+
+	log.Error("dnsforward: filtering %s: %s; not filtering", name, err)
+}
+
+// FilteringErrors returns the number of the requests and the responses the
+// filtering engine has failed to check since the start.
+func (s *Server) FilteringErrors() (n uint64) {
+	return atomic.LoadUint64(&s.filteringErrors)
+}
@@ -0,0 +1,74 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_filterDNSRequest_failure(t *testing.T) {
+	testCases := []struct {
+		name         string
+		mode         FilteringFailureMode
+		wantServfail bool
+	}{{
+		name:         "open",
+		mode:         FilteringFailOpen,
+		wantServfail: false,
+	}, {
+		name:         "closed",
+		mode:         FilteringFailClosed,
+		wantServfail: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := createTestServer(t, &filtering.Config{}, ServerConfig{
+				UDPListenAddrs: []*net.UDPAddr{{}},
+				TCPListenAddrs: []*net.TCPAddr{{}},
+				FilteringConfig: FilteringConfig{
+					FilteringFailureMode: tc.mode,
+				},
+			}, nil)
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessage("nxdomain.example.org."),
+				},
+				// Make the filtering engine panic.
+				setts: nil,
+			}
+
+			var res *filtering.Result
+			var err error
+			require.NotPanics(t, func() { res, err = s.filterDNSRequest(dctx) })
+			require.NoError(t, err)
+			require.NotNil(t, res)
+
+			assert.False(t, res.IsFiltered)
+			assert.Equal(t, uint64(1), s.FilteringErrors())
+
+			if !tc.wantServfail {
+				assert.Nil(t, dctx.proxyCtx.Res)
+
+				return
+			}
+
+			require.NotNil(t, dctx.proxyCtx.Res)
+
+			assert.Equal(t, dns.RcodeServerFailure, dctx.proxyCtx.Res.Rcode)
+		})
+	}
+}
+
+func TestFilteringFailureMode_validate(t *testing.T) {
+	assert.NoError(t, FilteringFailureMode("").validate())
+	assert.NoError(t, FilteringFailOpen.validate())
+	assert.NoError(t, FilteringFailClosed.validate())
+	assert.EqualError(t, FilteringFailureMode("ajar").validate(), `bad filtering failure mode "ajar"`)
+}
@@ -1,8 +1,8 @@
 package dnsforward
 
 import (
-	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strings"
@@ -22,25 +22,28 @@ import (
 
 // jsonDNSConfig is the JSON representation of the DNS server configuration.
 type jsonDNSConfig struct {
-	Upstreams         *[]string     `json:"upstream_dns"`
-	UpstreamsFile     *string       `json:"upstream_dns_file"`
-	Bootstraps        *[]string     `json:"bootstrap_dns"`
-	ProtectionEnabled *bool         `json:"protection_enabled"`
-	RateLimit         *uint32       `json:"ratelimit"`
-	BlockingMode      *BlockingMode `json:"blocking_mode"`
-	EDNSCSEnabled     *bool         `json:"edns_cs_enabled"`
-	DNSSECEnabled     *bool         `json:"dnssec_enabled"`
-	DisableIPv6       *bool         `json:"disable_ipv6"`
-	UpstreamMode      *string       `json:"upstream_mode"`
-	CacheSize         *uint32       `json:"cache_size"`
-	CacheMinTTL       *uint32       `json:"cache_ttl_min"`
-	CacheMaxTTL       *uint32       `json:"cache_ttl_max"`
-	CacheOptimistic   *bool         `json:"cache_optimistic"`
-	ResolveClients    *bool         `json:"resolve_clients"`
-	UsePrivateRDNS    *bool         `json:"use_private_ptr_resolvers"`
-	LocalPTRUpstreams *[]string     `json:"local_ptr_upstreams"`
-	BlockingIPv4      net.IP        `json:"blocking_ipv4"`
-	BlockingIPv6      net.IP        `json:"blocking_ipv6"`
+	Upstreams            *[]string               `json:"upstream_dns"`
+	UpstreamsFile        *string                 `json:"upstream_dns_file"`
+	Bootstraps           *[]string               `json:"bootstrap_dns"`
+	Fallbacks            *[]string               `json:"fallback_dns"`
+	ProtectionEnabled    *bool                   `json:"protection_enabled"`
+	RateLimit            *uint32                 `json:"ratelimit"`
+	BlockingMode         *BlockingMode           `json:"blocking_mode"`
+	EDNSCSEnabled        *bool                   `json:"edns_cs_enabled"`
+	DNSSECEnabled        *bool                   `json:"dnssec_enabled"`
+	DisableIPv6          *bool                   `json:"disable_ipv6"`
+	BlockDoHCanary       *bool                   `json:"block_doh_canary"`
+	UpstreamMode         *string                 `json:"upstream_mode"`
+	CacheSize            *uint32                 `json:"cache_size"`
+	CacheMinTTL          *uint32                 `json:"cache_ttl_min"`
+	CacheMaxTTL          *uint32                 `json:"cache_ttl_max"`
+	CacheOptimistic      *bool                   `json:"cache_optimistic"`
+	CachePriorityDomains *[]*CachePriorityDomain `json:"cache_priority_domains"`
+	ResolveClients       *bool                   `json:"resolve_clients"`
+	UsePrivateRDNS       *bool                   `json:"use_private_ptr_resolvers"`
+	LocalPTRUpstreams    *[]string               `json:"local_ptr_upstreams"`
+	BlockingIPv4         net.IP                  `json:"blocking_ipv4"`
+	BlockingIPv6         net.IP                  `json:"blocking_ipv6"`
 }
 
 func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
@@ -50,6 +53,7 @@ func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
 	upstreams := stringutil.CloneSliceOrEmpty(s.conf.UpstreamDNS)
 	upstreamFile := s.conf.UpstreamDNSFileName
 	bootstraps := stringutil.CloneSliceOrEmpty(s.conf.BootstrapDNS)
+	fallbacks := stringutil.CloneSliceOrEmpty(s.conf.FallbackDNS)
 	protectionEnabled := s.conf.ProtectionEnabled
 	blockingMode := s.conf.BlockingMode
 	blockingIPv4 := s.conf.BlockingIPv4
@@ -58,10 +62,15 @@ func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
 	enableEDNSClientSubnet := s.conf.EnableEDNSClientSubnet
 	enableDNSSEC := s.conf.EnableDNSSEC
 	aaaaDisabled := s.conf.AAAADisabled
+	blockDoHCanary := s.conf.BlockDoHCanary
 	cacheSize := s.conf.CacheSize
 	cacheMinTTL := s.conf.CacheMinTTL
 	cacheMaxTTL := s.conf.CacheMaxTTL
 	cacheOptimistic := s.conf.CacheOptimistic
+	cachePriorityDomains := cloneCachePriorityDomains(s.conf.CachePriorityDomains)
+	if cachePriorityDomains == nil {
+		cachePriorityDomains = []*CachePriorityDomain{}
+	}
 	resolveClients := s.conf.ResolveClients
 	usePrivateRDNS := s.conf.UsePrivateRDNS
 	localPTRUpstreams := stringutil.CloneSliceOrEmpty(s.conf.LocalPTRResolvers)
@@ -73,25 +82,28 @@ func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
 	}
 
 	return &jsonDNSConfig{
-		Upstreams:         &upstreams,
-		UpstreamsFile:     &upstreamFile,
-		Bootstraps:        &bootstraps,
-		ProtectionEnabled: &protectionEnabled,
-		BlockingMode:      &blockingMode,
-		BlockingIPv4:      blockingIPv4,
-		BlockingIPv6:      blockingIPv6,
-		RateLimit:         &ratelimit,
-		EDNSCSEnabled:     &enableEDNSClientSubnet,
-		DNSSECEnabled:     &enableDNSSEC,
-		DisableIPv6:       &aaaaDisabled,
-		CacheSize:         &cacheSize,
-		CacheMinTTL:       &cacheMinTTL,
-		CacheMaxTTL:       &cacheMaxTTL,
-		CacheOptimistic:   &cacheOptimistic,
-		UpstreamMode:      &upstreamMode,
-		ResolveClients:    &resolveClients,
-		UsePrivateRDNS:    &usePrivateRDNS,
-		LocalPTRUpstreams: &localPTRUpstreams,
+		Upstreams:            &upstreams,
+		UpstreamsFile:        &upstreamFile,
+		Bootstraps:           &bootstraps,
+		Fallbacks:            &fallbacks,
+		ProtectionEnabled:    &protectionEnabled,
+		BlockingMode:         &blockingMode,
+		BlockingIPv4:         blockingIPv4,
+		BlockingIPv6:         blockingIPv6,
+		RateLimit:            &ratelimit,
+		EDNSCSEnabled:        &enableEDNSClientSubnet,
+		DNSSECEnabled:        &enableDNSSEC,
+		DisableIPv6:          &aaaaDisabled,
+		BlockDoHCanary:       &blockDoHCanary,
+		CacheSize:            &cacheSize,
+		CacheMinTTL:          &cacheMinTTL,
+		CacheMaxTTL:          &cacheMaxTTL,
+		CacheOptimistic:      &cacheOptimistic,
+		CachePriorityDomains: &cachePriorityDomains,
+		UpstreamMode:         &upstreamMode,
+		ResolveClients:       &resolveClients,
+		UsePrivateRDNS:       &usePrivateRDNS,
+		LocalPTRUpstreams:    &localPTRUpstreams,
 	}
 }
 
@@ -150,37 +162,117 @@ func (req *jsonDNSConfig) checkBootstrap() (err error) {
 	return nil
 }
 
+// maxJSONDNSConfigNum is the maximum value of the numeric fields of
+// jsonDNSConfig.  The values are converted into int, which may be 32 bits wide,
+// and it's also the maximum TTL value, see RFC 2181, section 8.
+const maxJSONDNSConfigNum = math.MaxInt32
+
+// type check
+var _ aghhttp.Validator = (*jsonDNSConfig)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for *jsonDNSConfig.  It
+// only checks the ranges of the numeric fields, see [jsonDNSConfig.validate]
+// for the rest.
+func (req *jsonDNSConfig) Validate() (err error) {
+	nums := []struct {
+		val   *uint32
+		field string
+	}{{
+		val:   req.RateLimit,
+		field: "ratelimit",
+	}, {
+		val:   req.CacheSize,
+		field: "cache_size",
+	}, {
+		val:   req.CacheMinTTL,
+		field: "cache_ttl_min",
+	}, {
+		val:   req.CacheMaxTTL,
+		field: "cache_ttl_max",
+	}}
+
+	for _, n := range nums {
+		if n.val == nil {
+			continue
+		}
+
+		err = aghhttp.ValidateRange(n.field, *n.val, 0, maxJSONDNSConfigNum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // validate returns an error if any field of req is invalid.
 func (req *jsonDNSConfig) validate(privateNets netutil.SubnetSet) (err error) {
 	if req.Upstreams != nil {
-		err = ValidateUpstreams(*req.Upstreams)
+		upstreams, qtypeUpstreams := splitQtypeUpstreams(*req.Upstreams)
+		err = ValidateUpstreams(upstreams)
+		if err == nil {
+			err = validateQtypeUpstreams(qtypeUpstreams)
+		}
+
+		if err != nil {
+			return &aghhttp.FieldError{
+				Err:   fmt.Errorf("validating upstream servers: %w", err),
+				Field: "upstream_dns",
+			}
+		}
+	}
+
+	if req.Fallbacks != nil {
+		err = validateFallbacks(*req.Fallbacks)
 		if err != nil {
-			return fmt.Errorf("validating upstream servers: %w", err)
+			return &aghhttp.FieldError{
+				Err:   fmt.Errorf("validating fallback upstream servers: %w", err),
+				Field: "fallback_dns",
+			}
 		}
 	}
 
 	if req.LocalPTRUpstreams != nil {
 		err = ValidateUpstreamsPrivate(*req.LocalPTRUpstreams, privateNets)
 		if err != nil {
-			return fmt.Errorf("validating private upstream servers: %w", err)
+			return &aghhttp.FieldError{
+				Err:   fmt.Errorf("validating private upstream servers: %w", err),
+				Field: "local_ptr_upstreams",
+			}
+		}
+	}
+
+	if req.CachePriorityDomains != nil {
+		err = validateCachePriorityDomains(*req.CachePriorityDomains)
+		if err != nil {
+			return &aghhttp.FieldError{
+				Err:   fmt.Errorf("validating cache priority domains: %w", err),
+				Field: "cache_priority_domains",
+			}
 		}
 	}
 
 	err = req.checkBootstrap()
 	if err != nil {
-		return err
+		return &aghhttp.FieldError{Err: err, Field: "bootstrap_dns"}
 	}
 
 	err = req.checkBlockingMode()
 	if err != nil {
-		return err
+		return &aghhttp.FieldError{Err: err, Field: "blocking_mode"}
 	}
 
 	switch {
 	case !req.checkUpstreamsMode():
-		return errors.Error("upstream_mode: incorrect value")
+		return &aghhttp.FieldError{
+			Err:   errors.Error("upstream_mode: incorrect value"),
+			Field: "upstream_mode",
+		}
 	case !req.checkCacheTTL():
-		return errors.Error("cache_ttl_min must be less or equal than cache_ttl_max")
+		return &aghhttp.FieldError{
+			Err:   errors.Error("cache_ttl_min must be less or equal than cache_ttl_max"),
+			Field: "cache_ttl_min",
+		}
 	default:
 		return nil
 	}
@@ -204,7 +296,7 @@ func (req *jsonDNSConfig) checkCacheTTL() bool {
 
 func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	req := &jsonDNSConfig{}
-	err := json.NewDecoder(r.Body).Decode(req)
+	err := aghhttp.DecodeJSON(r, req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
 
@@ -251,8 +343,10 @@ func (s *Server) setConfig(dc *jsonDNSConfig) (shouldRestart bool) {
 	setIfNotNil(&s.conf.ProtectionEnabled, dc.ProtectionEnabled)
 	setIfNotNil(&s.conf.EnableDNSSEC, dc.DNSSECEnabled)
 	setIfNotNil(&s.conf.AAAADisabled, dc.DisableIPv6)
+	setIfNotNil(&s.conf.BlockDoHCanary, dc.BlockDoHCanary)
 	setIfNotNil(&s.conf.ResolveClients, dc.ResolveClients)
 	setIfNotNil(&s.conf.UsePrivateRDNS, dc.UsePrivateRDNS)
+	setIfNotNil(&s.conf.CachePriorityDomains, dc.CachePriorityDomains)
 
 	return s.setConfigRestartable(dc)
 }
@@ -278,6 +372,7 @@ func (s *Server) setConfigRestartable(dc *jsonDNSConfig) (shouldRestart bool) {
 		setIfNotNil(&s.conf.LocalPTRResolvers, dc.LocalPTRUpstreams),
 		setIfNotNil(&s.conf.UpstreamDNSFileName, dc.UpstreamsFile),
 		setIfNotNil(&s.conf.BootstrapDNS, dc.Bootstraps),
+		setIfNotNil(&s.conf.FallbackDNS, dc.Fallbacks),
 		setIfNotNil(&s.conf.EnableEDNSClientSubnet, dc.EDNSCSEnabled),
 		setIfNotNil(&s.conf.CacheSize, dc.CacheSize),
 		setIfNotNil(&s.conf.CacheMinTTL, dc.CacheMinTTL),
@@ -575,6 +670,8 @@ func checkDNS(
 ) (err error) {
 	if IsCommentOrEmpty(upstreamConfigStr) {
 		return nil
+	} else if isQtypeUpstream(upstreamConfigStr) {
+		return checkQtypeDNS(upstreamConfigStr, bootstrap, timeout, healthCheck)
 	}
 
 	// Separate upstream from domains list.
@@ -619,9 +716,32 @@ func checkDNS(
 	return nil
 }
 
+// checkQtypeDNS checks each upstream of the line for particular query types
+// defined by upstreamConfigStr the same way checkDNS does.
+func checkQtypeDNS(
+	upstreamConfigStr string,
+	bootstrap []string,
+	timeout time.Duration,
+	healthCheck healthCheckFunc,
+) (err error) {
+	_, addrs, err := separateQtypeUpstream(upstreamConfigStr)
+	if err != nil {
+		return fmt.Errorf("wrong upstream format: %w", err)
+	}
+
+	for _, addr := range addrs {
+		err = checkDNS(addr, bootstrap, timeout, healthCheck)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	req := &upstreamJSON{}
-	err := json.NewDecoder(r.Body).Decode(req)
+	err := aghhttp.DecodeJSON(r, req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to read request body: %s", err)
 
@@ -698,6 +818,14 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream", s.handleTestUpstream)
+	s.conf.HTTPRegister(http.MethodGet, "/control/resolve", s.handleResolve)
+	s.conf.HTTPRegister(http.MethodGet, "/control/security_events", s.handleSecurityEvents)
+	s.conf.HTTPRegister(http.MethodGet, "/control/servfail_damping", s.handleServfailDamping)
+	s.conf.HTTPRegister(http.MethodGet, "/control/upstreams_events", s.handleUpstreamsEvents)
+	s.conf.HTTPRegister(http.MethodGet, "/control/stats_upstreams", s.handleStatsUpstreams)
+	s.conf.HTTPRegister(http.MethodGet, "/control/resolved_archive", s.handleResolvedArchive)
+	s.conf.HTTPRegister(http.MethodGet, "/control/resources", s.handleResources)
 
 	s.conf.HTTPRegister(http.MethodGet, "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister(http.MethodPost, "/control/access/set", s.handleAccessSet)
@@ -9,7 +9,6 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
-	"strings"
 	"testing"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -202,6 +201,13 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 	}, {
 		name:    "upstream_mode_bad",
 		wantSet: `upstream_mode: incorrect value`,
+	}, {
+		name:    "cache_priority_domains",
+		wantSet: "",
+	}, {
+		name: "cache_priority_domains_bad",
+		wantSet: `validating cache priority domains: ` +
+			`domain "intranet.example.com": weight 11 out of range [1, 10]`,
 	}, {
 		name:    "local_ptr_upstreams_good",
 		wantSet: "",
@@ -212,6 +218,13 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 	}, {
 		name:    "local_ptr_upstreams_null",
 		wantSet: "",
+	}, {
+		name:    "fallback_dns",
+		wantSet: "",
+	}, {
+		name: "fallback_dns_bad",
+		wantSet: `validating fallback upstream servers: ` +
+			`domain-specific upstreams are not supported`,
 	}}
 
 	var data map[string]struct {
@@ -233,7 +246,15 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 			require.NoError(t, err)
 
 			s.handleSetConfig(w, r)
-			assert.Equal(t, tc.wantSet, strings.TrimSuffix(w.Body.String(), "\n"))
+			if tc.wantSet == "" {
+				assert.Empty(t, w.Body.String())
+			} else {
+				errResp := &aghhttp.ErrorResponse{}
+				err = json.NewDecoder(w.Body).Decode(errResp)
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.wantSet, errResp.Message)
+			}
 			w.Body.Reset()
 
 			s.handleGetConfig(w, nil)
@@ -37,14 +37,32 @@ func ipsFromRules(resRules []*filtering.ResultRule) (ips []net.IP) {
 	return ips
 }
 
-// genDNSFilterMessage generates a filtered response to req for the filtering
-// result res.
+// genDNSFilterMessage generates a filtered response to the request in dctx for
+// the filtering result res.  The response contains the extended DNS error
+// describing the reason, if the client supports EDNS.
 func (s *Server) genDNSFilterMessage(
 	dctx *proxy.DNSContext,
 	res *filtering.Result,
 ) (resp *dns.Msg) {
+	resp = s.genFilteredResp(dctx, res)
+	addBlockedEDE(dctx.Req, resp, res)
+
+	return resp
+}
+
+// genFilteredResp generates a filtered response to the request in dctx for the
+// filtering result res.
+func (s *Server) genFilteredResp(dctx *proxy.DNSContext, res *filtering.Result) (resp *dns.Msg) {
 	req := dctx.Req
-	if qt := req.Question[0].Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
+	qt := req.Question[0].Qtype
+	if res.SuppressedType == qt {
+		// The rule only blocks the records of this type, so respond with
+		// NODATA, since NXDOMAIN would mean that there are no records of any
+		// type for the host.
+		return s.genNoData(req)
+	}
+
+	if qt != dns.TypeA && qt != dns.TypeAAAA {
 		if s.conf.BlockingMode == BlockingModeNullIP {
 			return s.makeResponse(req)
 		}
@@ -83,7 +101,7 @@ func (s *Server) genForBlockingMode(req *dns.Msg, ips []net.IP) (resp *dns.Msg)
 			return s.genAAAARecord(req, s.conf.BlockingIPv6)
 		default:
 			// Generally shouldn't happen, since the types are checked in
-			// genDNSFilterMessage.
+			// genFilteredResp.
 			log.Error("dns: invalid msg type %s for blocking mode %s", dns.Type(qt), m)
 
 			return s.makeResponse(req)
@@ -311,6 +329,15 @@ func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// genNoData returns a NODATA response to req, that is, a successful response
+// without any answers and with the SOA record for negative caching.
+func (s *Server) genNoData(req *dns.Msg) (resp *dns.Msg) {
+	resp = s.makeResponse(req)
+	resp.Ns = s.genSOA(req)
+
+	return resp
+}
+
 func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 	zone := ""
 	if len(request.Question) > 0 {
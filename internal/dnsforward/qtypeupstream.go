@@ -0,0 +1,182 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// qtypeUpstreamPrefix is the prefix of the upstream lines, which specify the
+// upstreams for the particular query types, for example:
+//
+//	[type:PTR]192.168.1.1
+//	[type:HTTPS,TYPE65]https://dns.example/dns-query
+//
+// Such upstreams are used for the queries of the specified types instead of the
+// default ones.  The domain-specific upstreams still take priority over them.
+const qtypeUpstreamPrefix = "[type:"
+
+// isQtypeUpstream returns true if s is an upstream line for particular query
+// types.
+func isQtypeUpstream(s string) (ok bool) {
+	return strings.HasPrefix(s, qtypeUpstreamPrefix)
+}
+
+// splitQtypeUpstreams splits the upstream lines into the common ones and the
+// ones for particular query types.
+func splitQtypeUpstreams(upstreams []string) (common, qtypeUpstreams []string) {
+	for _, u := range upstreams {
+		if isQtypeUpstream(u) {
+			qtypeUpstreams = append(qtypeUpstreams, u)
+		} else {
+			common = append(common, u)
+		}
+	}
+
+	return common, qtypeUpstreams
+}
+
+// separateQtypeUpstream splits the upstream line for particular query types
+// into the types and the addresses of the upstreams.
+func separateQtypeUpstream(s string) (qtypes []uint16, addrs []string, err error) {
+	defer func() { err = errors.Annotate(err, "bad upstream for query types %q: %w", s) }()
+
+	typesStr, addrsStr, ok := strings.Cut(s[len(qtypeUpstreamPrefix):], "]")
+	if !ok {
+		return nil, nil, errors.Error("missing separator")
+	}
+
+	for i, t := range strings.Split(typesStr, ",") {
+		var qt uint16
+		qt, err = parseQtype(strings.TrimSpace(t))
+		if err != nil {
+			return nil, nil, fmt.Errorf("type at index %d: %w", i, err)
+		}
+
+		qtypes = append(qtypes, qt)
+	}
+
+	addrs = strings.Fields(addrsStr)
+	if len(addrs) == 0 {
+		return nil, nil, errors.Error("no upstreams specified")
+	}
+
+	return qtypes, addrs, nil
+}
+
+// parseQtype parses the query type either by its mnemonic, like "PTR", or in
+// the generic "TYPE65" form.
+func parseQtype(s string) (qt uint16, err error) {
+	s = strings.ToUpper(s)
+	if qt, ok := dns.StringToType[s]; ok {
+		return qt, nil
+	}
+
+	if !strings.HasPrefix(s, "TYPE") {
+		return 0, fmt.Errorf("unknown query type %q", s)
+	}
+
+	n, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("parsing query type %q: %w", s, err)
+	} else if n == 0 {
+		return 0, fmt.Errorf("bad query type %q", s)
+	}
+
+	return uint16(n), nil
+}
+
+// validateQtypeUpstreams returns an error if any of the upstream lines for
+// particular query types is invalid.
+func validateQtypeUpstreams(upstreams []string) (err error) {
+	for _, u := range upstreams {
+		var addrs []string
+		_, addrs, err = separateQtypeUpstream(u)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
+		for _, addr := range addrs {
+			_, err = validateUpstream(addr, nil)
+			if err != nil {
+				return fmt.Errorf("validating upstream %q: %w", u, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newQtypeUpstreamConfigs parses the upstream lines for particular query types
+// and returns the upstream configurations for each of the types.  The
+// domain-specific upstreams of main are used by each configuration as well.
+func newQtypeUpstreamConfigs(
+	lines []string,
+	opts *upstream.Options,
+	main *proxy.UpstreamConfig,
+) (confs map[uint16]*proxy.UpstreamConfig, err error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	confs = map[uint16]*proxy.UpstreamConfig{}
+	for _, l := range lines {
+		var qtypes []uint16
+		var addrs []string
+		qtypes, addrs, err = separateQtypeUpstream(l)
+		if err != nil {
+			return nil, err
+		}
+
+		ups := make([]upstream.Upstream, 0, len(addrs))
+		for _, addr := range addrs {
+			var u upstream.Upstream
+			u, err = upstream.AddressToUpstream(addr, opts)
+			if err != nil {
+				return nil, fmt.Errorf("creating upstream %q: %w", addr, err)
+			}
+
+			ups = append(ups, u)
+		}
+
+		for _, qt := range qtypes {
+			c, ok := confs[qt]
+			if !ok {
+				c = &proxy.UpstreamConfig{
+					DomainReservedUpstreams:  main.DomainReservedUpstreams,
+					SpecifiedDomainUpstreams: main.SpecifiedDomainUpstreams,
+					SubdomainExclusions:      main.SubdomainExclusions,
+				}
+				confs[qt] = c
+			}
+
+			c.Upstreams = append(c.Upstreams, ups...)
+		}
+	}
+
+	return confs, nil
+}
+
+// setQtypeUpstream sets the upstreams for the query type of the request in
+// pctx, if there are any, unless the client has its own upstreams.  The
+// responses of such upstreams aren't cached, since the proxy doesn't cache the
+// responses of custom upstreams.
+func (s *Server) setQtypeUpstream(pctx *proxy.DNSContext) {
+	if pctx.CustomUpstreamConfig != nil || len(s.conf.QtypeUpstreamConfigs) == 0 {
+		return
+	}
+
+	qt := pctx.Req.Question[0].Qtype
+	if c, ok := s.conf.QtypeUpstreamConfigs[qt]; ok {
+		log.Debug("dns: using upstreams for query type %s", dns.Type(qt))
+
+		pctx.CustomUpstreamConfig = c
+	}
+}
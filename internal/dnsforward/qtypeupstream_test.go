@@ -0,0 +1,149 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeparateQtypeUpstream(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+		wantQtypes []uint16
+		wantAddrs  []string
+	}{{
+		name:       "single",
+		in:         "[type:PTR]192.168.1.1",
+		wantErrMsg: "",
+		wantQtypes: []uint16{dns.TypePTR},
+		wantAddrs:  []string{"192.168.1.1"},
+	}, {
+		name:       "several",
+		in:         "[type:https, TYPE64]tls://dns.example 1.1.1.1",
+		wantErrMsg: "",
+		wantQtypes: []uint16{dns.TypeHTTPS, dns.TypeSVCB},
+		wantAddrs:  []string{"tls://dns.example", "1.1.1.1"},
+	}, {
+		name: "no_separator",
+		in:   "[type:PTR192.168.1.1",
+		wantErrMsg: `bad upstream for query types "[type:PTR192.168.1.1": ` +
+			`missing separator`,
+		wantQtypes: nil,
+		wantAddrs:  nil,
+	}, {
+		name: "unknown_type",
+		in:   "[type:BAD]192.168.1.1",
+		wantErrMsg: `bad upstream for query types "[type:BAD]192.168.1.1": ` +
+			`type at index 0: unknown query type "BAD"`,
+		wantQtypes: nil,
+		wantAddrs:  nil,
+	}, {
+		name: "zero_type",
+		in:   "[type:TYPE0]192.168.1.1",
+		wantErrMsg: `bad upstream for query types "[type:TYPE0]192.168.1.1": ` +
+			`type at index 0: bad query type "TYPE0"`,
+		wantQtypes: nil,
+		wantAddrs:  nil,
+	}, {
+		name: "no_upstreams",
+		in:   "[type:PTR]",
+		wantErrMsg: `bad upstream for query types "[type:PTR]": ` +
+			`no upstreams specified`,
+		wantQtypes: nil,
+		wantAddrs:  nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			qtypes, addrs, err := separateQtypeUpstream(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantQtypes, qtypes)
+			assert.Equal(t, tc.wantAddrs, addrs)
+		})
+	}
+}
+
+func TestServer_setQtypeUpstream(t *testing.T) {
+	main, err := proxy.ParseUpstreamsConfig(
+		[]string{"1.1.1.1", "[/local.example/]192.168.1.2"},
+		&upstream.Options{},
+	)
+	require.NoError(t, err)
+
+	confs, err := newQtypeUpstreamConfigs(
+		[]string{"[type:PTR]192.168.1.1", "[type:PTR,HTTPS]9.9.9.9"},
+		&upstream.Options{},
+		main,
+	)
+	require.NoError(t, err)
+	require.Len(t, confs, 2)
+
+	ptrConf := confs[dns.TypePTR]
+	require.NotNil(t, ptrConf)
+	require.Len(t, ptrConf.Upstreams, 2)
+
+	assert.Equal(t, "192.168.1.1:53", ptrConf.Upstreams[0].Address())
+	assert.Equal(t, "9.9.9.9:53", ptrConf.Upstreams[1].Address())
+	assert.Equal(t, main.DomainReservedUpstreams, ptrConf.DomainReservedUpstreams)
+
+	s := &Server{
+		conf: ServerConfig{
+			QtypeUpstreamConfigs: confs,
+		},
+	}
+
+	clientConf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&aghtest.Upstream{}},
+	}
+
+	testCases := []struct {
+		custom *proxy.UpstreamConfig
+		want   *proxy.UpstreamConfig
+		name   string
+		qtype  uint16
+	}{{
+		custom: nil,
+		want:   ptrConf,
+		name:   "ptr",
+		qtype:  dns.TypePTR,
+	}, {
+		custom: nil,
+		want:   confs[dns.TypeHTTPS],
+		name:   "https",
+		qtype:  dns.TypeHTTPS,
+	}, {
+		custom: nil,
+		want:   nil,
+		name:   "other",
+		qtype:  dns.TypeA,
+	}, {
+		custom: clientConf,
+		want:   clientConf,
+		name:   "client",
+		qtype:  dns.TypePTR,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("1.1.168.192.in-addr.arpa.", tc.qtype)
+			pctx := &proxy.DNSContext{
+				Req:                  req,
+				Addr:                 &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+				CustomUpstreamConfig: tc.custom,
+			}
+
+			s.setQtypeUpstream(pctx)
+			assert.Same(t, tc.want, pctx.CustomUpstreamConfig)
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package dnsforward
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ResourceGuardConfig is the configuration of the guard, which sheds the load
+// before the process runs out of goroutines or file descriptors.
+type ResourceGuardConfig struct {
+	// GoroutinesLimit is the number of goroutines, above which the load is
+	// shed.  If zero, the number of goroutines isn't limited.
+	GoroutinesLimit uint32 `yaml:"goroutines_limit"`
+
+	// OpenFilesLimit is the number of open file descriptors, above which the
+	// load is shed.  If zero, defaultOpenFilesRatio of the limit set by the OS
+	// is used.
+	OpenFilesLimit uint64 `yaml:"open_files_limit"`
+
+	// Enabled defines if the guard is enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
+const (
+	// defaultOpenFilesRatio is the part of the limit of open file descriptors
+	// set by the OS, which is used if OpenFilesLimit isn't set.
+	defaultOpenFilesRatio = 0.9
+
+	// maxResourceEvents is the maximum number of the resource events kept in
+	// memory.
+	maxResourceEvents = 100
+
+	// resourceGuardTick is the period of checking the resources.
+	resourceGuardTick = 1 * time.Second
+)
+
+// resourceName is the name of a guarded resource.
+type resourceName string
+
+// resourceName values.
+const (
+	resourceGoroutines resourceName = "goroutines"
+	resourceOpenFiles  resourceName = "open_files"
+)
+
+// resourceEvent is a crossing of a resource's limit in either direction.
+type resourceEvent struct {
+	Time     time.Time    `json:"time"`
+	Resource resourceName `json:"resource"`
+	Value    uint64       `json:"value"`
+	Limit    uint64       `json:"limit"`
+
+	// Exceeded is true if the value has crossed the limit upwards.
+	Exceeded bool `json:"exceeded"`
+}
+
+// resourceUsage is the latest measured usage of the guarded resources.
+type resourceUsage struct {
+	// Time is the time of the latest measurement.
+	Time time.Time `json:"time"`
+
+	// OpenFilesError is the error of counting the open file descriptors, if
+	// any.
+	OpenFilesError string `json:"open_files_error,omitempty"`
+
+	Goroutines      uint64 `json:"goroutines"`
+	GoroutinesLimit uint64 `json:"goroutines_limit"`
+	OpenFiles       uint64 `json:"open_files"`
+	OpenFilesLimit  uint64 `json:"open_files_limit"`
+}
+
+// resourceGuard tracks the usage of the goroutines and the file descriptors
+// and keeps the bounded list of the recent crossings of their limits.  The zero
+// value is ready for use.
+type resourceGuard struct {
+	// shed is the number of the requests refused since the resources have
+	// been exhausted.  It must be accessed atomically.  It's arranged at the
+	// beginning of the structure to keep 64-bit alignment.
+	shed uint64
+
+	// overloaded is 1 if any of the resources has exceeded its limit.  It
+	// must be accessed atomically.
+	overloaded uint32
+
+	mu       sync.Mutex
+	usage    resourceUsage
+	exceeded map[resourceName]bool
+	events   []*resourceEvent
+}
+
+// check updates the state of the guard according to usage and records the
+// crossings of the limits, if any.  Zero limits aren't checked.
+func (rg *resourceGuard) check(usage resourceUsage) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+
+	if rg.exceeded == nil {
+		rg.exceeded = map[resourceName]bool{}
+	}
+
+	rg.usage = usage
+	goroutinesOver := rg.checkLocked(
+		resourceGoroutines,
+		usage.Time,
+		usage.Goroutines,
+		usage.GoroutinesLimit,
+	)
+	filesOver := rg.checkLocked(resourceOpenFiles, usage.Time, usage.OpenFiles, usage.OpenFilesLimit)
+
+	var overloaded uint32
+	if goroutinesOver || filesOver {
+		overloaded = 1
+	}
+
+	atomic.StoreUint32(&rg.overloaded, overloaded)
+}
+
+// checkLocked checks the value of the resource with name against limit at now,
+// records the crossing of the limit, if any, and returns true if the limit is
+// exceeded.  rg.mu is expected to be locked.
+func (rg *resourceGuard) checkLocked(
+	name resourceName,
+	now time.Time,
+	val uint64,
+	limit uint64,
+) (exceeded bool) {
+	exceeded = limit > 0 && val > limit
+	if exceeded == rg.exceeded[name] {
+		return exceeded
+	}
+
+	rg.exceeded[name] = exceeded
+	if exceeded {
+		log.Info("dns: warning: %s: %d exceeds limit %d, shedding load", name, val, limit)
+	} else {
+		log.Info("dns: %s: %d is within limit %d again", name, val, limit)
+	}
+
+	if len(rg.events) == maxResourceEvents {
+		copy(rg.events, rg.events[1:])
+		rg.events = rg.events[:maxResourceEvents-1]
+	}
+
+	rg.events = append(rg.events, &resourceEvent{
+		Time:     now,
+		Resource: name,
+		Value:    val,
+		Limit:    limit,
+		Exceeded: exceeded,
+	})
+
+	return exceeded
+}
+
+// isOverloaded returns true if any of the resources has exceeded its limit.
+func (rg *resourceGuard) isOverloaded() (ok bool) {
+	return atomic.LoadUint32(&rg.overloaded) == 1
+}
+
+// resourcesResp is the response to the GET /control/resources.
+type resourcesResp struct {
+	resourceUsage
+
+	// Events are the recent crossings of the limits, the newest first.
+	Events []*resourceEvent `json:"events"`
+
+	// ShedRequests is the number of the requests refused since the resources
+	// have been exhausted.
+	ShedRequests uint64 `json:"shed_requests"`
+
+	Enabled    bool `json:"enabled"`
+	Overloaded bool `json:"overloaded"`
+}
+
+// resp returns the current state of rg.
+func (rg *resourceGuard) resp() (resp *resourcesResp) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+
+	resp = &resourcesResp{
+		resourceUsage: rg.usage,
+		Events:        make([]*resourceEvent, 0, len(rg.events)),
+		ShedRequests:  atomic.LoadUint64(&rg.shed),
+		Overloaded:    rg.isOverloaded(),
+	}
+
+	for i := len(rg.events) - 1; i >= 0; i-- {
+		resp.Events = append(resp.Events, rg.events[i])
+	}
+
+	return resp
+}
+
+// measureResources returns the current usage of the resources limited
+// according to conf.  maxFiles is the limit of open file descriptors set by the
+// OS, or zero if unknown.
+func measureResources(conf *ResourceGuardConfig, maxFiles uint64) (usage resourceUsage) {
+	usage = resourceUsage{
+		Time:            time.Now(),
+		Goroutines:      uint64(runtime.NumGoroutine()),
+		GoroutinesLimit: uint64(conf.GoroutinesLimit),
+		OpenFilesLimit:  conf.OpenFilesLimit,
+	}
+
+	if usage.OpenFilesLimit == 0 {
+		usage.OpenFilesLimit = uint64(float64(maxFiles) * defaultOpenFilesRatio)
+	}
+
+	var err error
+	usage.OpenFiles, err = aghos.OpenFilesNum()
+	if err != nil {
+		// Don't shed the load because of the unknown number.
+		usage.OpenFilesError = err.Error()
+		usage.OpenFilesLimit = 0
+	}
+
+	return usage
+}
+
+// guardResources periodically checks the resources against the limits from
+// conf until done is closed.
+func (s *Server) guardResources(conf ResourceGuardConfig, done <-chan struct{}) {
+	defer log.OnPanic("dnsforward: guarding resources")
+
+	maxFiles, err := aghos.MaxOpenFiles()
+	if err != nil {
+		log.Debug("dnsforward: getting open files limit: %s", err)
+	}
+
+	t := time.NewTicker(resourceGuardTick)
+	defer t.Stop()
+
+	for {
+		s.resGuard.check(measureResources(&conf, maxFiles))
+
+		select {
+		case <-t.C:
+			// Go on.
+		case <-done:
+			// Don't keep shedding the load after the restart.
+			atomic.StoreUint32(&s.resGuard.overloaded, 0)
+
+			return
+		}
+	}
+}
+
+// shedLoad refuses the request in pctx received over a connection-oriented
+// protocol, if the resources are exhausted, and returns true if it has.  The
+// connection is closed to free its descriptor.  The other protocols don't
+// create a connection per client, so their requests are still processed.
+func (s *Server) shedLoad(pctx *proxy.DNSContext) (shed bool) {
+	if !s.resGuard.isOverloaded() {
+		return false
+	}
+
+	switch pctx.Proto {
+	case proxy.ProtoTCP, proxy.ProtoTLS:
+		if pctx.Conn != nil {
+			err := pctx.Conn.Close()
+			if err != nil {
+				log.Debug("dnsforward: closing shed connection: %s", err)
+			}
+		}
+	case proxy.ProtoHTTPS:
+		if w, r := pctx.HTTPResponseWriter, pctx.HTTPRequest; w != nil && r != nil {
+			w.Header().Set("Connection", "close")
+			aghhttp.Error(r, w, http.StatusServiceUnavailable, "server is overloaded")
+		}
+	default:
+		return false
+	}
+
+	atomic.AddUint64(&s.resGuard.shed, 1)
+
+	return true
+}
+
+// ShedRequests returns the number of the requests refused since the resources
+// have been exhausted.
+func (s *Server) ShedRequests() (n uint64) {
+	return atomic.LoadUint64(&s.resGuard.shed)
+}
+
+// handleResources handles requests to the GET /control/resources endpoint.  If
+// the guard is disabled, the usage of the resources is measured on request.
+func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
+	resp := s.resGuard.resp()
+
+	s.serverLock.RLock()
+	conf := s.conf.ResourceGuard
+	s.serverLock.RUnlock()
+
+	resp.Enabled = conf.Enabled
+	if !resp.Enabled {
+		maxFiles, err := aghos.MaxOpenFiles()
+		if err != nil {
+			log.Debug("dnsforward: getting open files limit: %s", err)
+		}
+
+		resp.resourceUsage = measureResources(&conf, maxFiles)
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
@@ -0,0 +1,106 @@
+package dnsforward
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceGuard_check(t *testing.T) {
+	rg := &resourceGuard{}
+	now := time.Now()
+
+	usage := func(goroutines, files uint64) (u resourceUsage) {
+		return resourceUsage{
+			Time:            now,
+			Goroutines:      goroutines,
+			GoroutinesLimit: 100,
+			OpenFiles:       files,
+			OpenFilesLimit:  1000,
+		}
+	}
+
+	rg.check(usage(50, 500))
+	assert.False(t, rg.isOverloaded())
+	assert.Empty(t, rg.resp().Events)
+
+	rg.check(usage(150, 500))
+	assert.True(t, rg.isOverloaded())
+
+	rg.check(usage(150, 1500))
+	assert.True(t, rg.isOverloaded())
+
+	rg.check(usage(50, 1500))
+	assert.True(t, rg.isOverloaded())
+
+	rg.check(usage(50, 500))
+	assert.False(t, rg.isOverloaded())
+
+	resp := rg.resp()
+	require.Len(t, resp.Events, 4)
+
+	assert.Equal(t, resourceOpenFiles, resp.Events[0].Resource)
+	assert.False(t, resp.Events[0].Exceeded)
+	assert.Equal(t, resourceGoroutines, resp.Events[1].Resource)
+	assert.False(t, resp.Events[1].Exceeded)
+	assert.Equal(t, resourceOpenFiles, resp.Events[2].Resource)
+	assert.True(t, resp.Events[2].Exceeded)
+	assert.Equal(t, uint64(1500), resp.Events[2].Value)
+	assert.Equal(t, resourceGoroutines, resp.Events[3].Resource)
+	assert.True(t, resp.Events[3].Exceeded)
+	assert.Equal(t, uint64(100), resp.Events[3].Limit)
+
+	t.Run("no_limits", func(t *testing.T) {
+		noLimits := &resourceGuard{}
+		noLimits.check(resourceUsage{Goroutines: 1e6, OpenFiles: 1e6})
+
+		assert.False(t, noLimits.isOverloaded())
+	})
+}
+
+func TestServer_shedLoad(t *testing.T) {
+	s := &Server{}
+
+	t.Run("not_overloaded", func(t *testing.T) {
+		assert.False(t, s.shedLoad(&proxy.DNSContext{Proto: proxy.ProtoTCP}))
+	})
+
+	s.resGuard.check(resourceUsage{Goroutines: 2, GoroutinesLimit: 1})
+	require.True(t, s.resGuard.isOverloaded())
+
+	t.Run("tcp", func(t *testing.T) {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { _ = peer.Close() })
+
+		assert.True(t, s.shedLoad(&proxy.DNSContext{Proto: proxy.ProtoTCP, Conn: conn}))
+
+		_, err := conn.Write([]byte{0})
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		pctx := &proxy.DNSContext{
+			Proto:              proxy.ProtoHTTPS,
+			HTTPRequest:        httptest.NewRequest(http.MethodPost, "/dns-query", nil),
+			HTTPResponseWriter: w,
+		}
+
+		assert.True(t, s.shedLoad(pctx))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "close", w.Header().Get("Connection"))
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		assert.False(t, s.shedLoad(&proxy.DNSContext{Proto: proxy.ProtoUDP}))
+	})
+
+	assert.Equal(t, uint64(2), s.ShedRequests())
+}
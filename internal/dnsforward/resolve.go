@@ -0,0 +1,137 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// resolveJSON is the response to the GET /control/resolve HTTP API.
+type resolveJSON struct {
+	// Status is the response code of the answer.
+	Status string `json:"status"`
+
+	// Answer, Authority, and Additional are the resource records of the
+	// corresponding sections of the answer in the presentation format.
+	Answer     []string `json:"answer"`
+	Authority  []string `json:"authority"`
+	Additional []string `json:"additional"`
+
+	// Reason is the reason of the filtering result.
+	Reason string `json:"reason"`
+
+	// Rule is the text of the first rule applied to the request, if any.
+	Rule string `json:"rule,omitempty"`
+
+	// Upstream is the address of the upstream server, which has resolved the
+	// request or whose answer has been cached.
+	Upstream string `json:"upstream,omitempty"`
+
+	// ElapsedMs is the time spent for processing the request, in
+	// milliseconds.
+	ElapsedMs float64 `json:"elapsed_ms"`
+
+	// Cached is true if the answer has been served from the cache.
+	Cached bool `json:"cached"`
+}
+
+// rrsToStrings returns the presentation format of rrs, excluding the OPT
+// pseudo-records.
+func rrsToStrings(rrs []dns.RR) (strs []string) {
+	strs = make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		strs = append(strs, rr.String())
+	}
+
+	return strs
+}
+
+// handleResolve is the handler for the GET /control/resolve HTTP API.  It
+// resolves the name through the whole request processing pipeline, as if the
+// request came from the loopback address, and responds with the decoded answer
+// and the details of the processing.  The request isn't recorded into the query
+// log, the statistics, and the device history.
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	name := q.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad name %q", name)
+
+		return
+	}
+
+	qtype := dns.TypeA
+	if typStr := q.Get("type"); typStr != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(typStr)]
+		if !ok {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad type %q", typStr)
+
+			return
+		}
+	}
+
+	if !s.IsRunning() {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "dns server is not running")
+
+		return
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.RecursionDesired = true
+
+	start := time.Now()
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		Addr:      &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		StartTime: start,
+	}
+
+	dctx, err := s.processRequest(pctx, true)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "resolving: %s", err)
+
+		return
+	}
+
+	res := pctx.Res
+	if res == nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "no response")
+
+		return
+	}
+
+	resp := &resolveJSON{
+		Status:     dns.RcodeToString[res.Rcode],
+		Answer:     rrsToStrings(res.Answer),
+		Authority:  rrsToStrings(res.Ns),
+		Additional: rrsToStrings(res.Extra),
+		Reason:     dctx.result.Reason.String(),
+		ElapsedMs:  time.Since(start).Seconds() * 1000,
+	}
+
+	if rules := dctx.result.Rules; len(rules) > 0 {
+		resp.Rule = rules[0].Text
+	}
+
+	if pctx.Upstream != nil {
+		resp.Upstream = pctx.Upstream.Address()
+	} else if cachedUps := pctx.CachedUpstreamAddr; cachedUps != "" {
+		resp.Upstream = cachedUps
+		resp.Cached = true
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
@@ -0,0 +1,125 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_handleResolve(t *testing.T) {
+	const upsAddr = "upstream.example"
+
+	ups := &aghtest.Upstream{
+		IPv4: map[string][]net.IP{
+			"host.example.": {{192, 168, 0, 1}},
+		},
+		Addr: upsAddr,
+	}
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+		},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{ups}
+
+	// The resolved requests must not be accounted anywhere.
+	ql := &testQueryLog{}
+	st := &testStats{}
+	s.queryLog, s.stats = ql, st
+	s.conf.DeviceSeen = func(ip net.IP, _ string) {
+		t.Errorf("unexpected device %s", ip)
+	}
+	s.conf.ConsumeClientQuota = func(id string) (ok bool) {
+		t.Errorf("unexpected quota consumption by %q", id)
+
+		return true
+	}
+
+	startDeferStop(t, s)
+
+	testCases := []struct {
+		want     *resolveJSON
+		name     string
+		host     string
+		qtype    string
+		wantCode int
+	}{{
+		want: &resolveJSON{
+			Status:     "NOERROR",
+			Answer:     []string{"host.example.\t0\tCLASS0\tA\t192.168.0.1"},
+			Authority:  []string{},
+			Additional: []string{},
+			Reason:     filtering.NotFilteredNotFound.String(),
+			Upstream:   upsAddr,
+		},
+		name:     "upstream",
+		host:     "host.example",
+		qtype:    "",
+		wantCode: http.StatusOK,
+	}, {
+		want: &resolveJSON{
+			Status:     "NOERROR",
+			Answer:     []string{"nxdomain.example.org.\t0\tIN\tA\t0.0.0.0"},
+			Authority:  []string{},
+			Additional: []string{},
+			Reason:     filtering.FilteredBlockList.String(),
+			Rule:       "||nxdomain.example.org",
+		},
+		name:     "blocked",
+		host:     "nxdomain.example.org",
+		qtype:    "A",
+		wantCode: http.StatusOK,
+	}, {
+		want:     nil,
+		name:     "bad_type",
+		host:     "host.example",
+		qtype:    "BAD",
+		wantCode: http.StatusBadRequest,
+	}, {
+		want:     nil,
+		name:     "bad_name",
+		host:     "",
+		qtype:    "A",
+		wantCode: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := url.Values{"name": []string{tc.host}}
+			if tc.qtype != "" {
+				q.Set("type", tc.qtype)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/control/resolve?"+q.Encode(), nil)
+			w := httptest.NewRecorder()
+			s.handleResolve(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.want == nil {
+				return
+			}
+
+			resp := &resolveJSON{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			resp.ElapsedMs = 0
+			assert.Equal(t, tc.want, resp)
+
+			assert.Nil(t, ql.lastParams)
+			assert.Zero(t, st.lastEntry)
+		})
+	}
+}
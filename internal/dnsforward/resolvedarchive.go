@@ -0,0 +1,224 @@
+package dnsforward
+
+import (
+	"container/list"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// ResolvedArchiveConfig is the configuration of the archive of the IP
+// addresses resolved for the domain names.  It allows mapping the IP addresses
+// from the logs of firewalls back to the domain names.
+type ResolvedArchiveConfig struct {
+	// Retention is the period of time, after which the mapping not seen again
+	// is removed from the archive.  If zero, defaultResolvedArchiveRetention
+	// is used.
+	Retention timeutil.Duration `yaml:"retention"`
+
+	// MaxEntries is the maximum number of the IP address to domain name
+	// mappings kept in the archive.  The least recently seen ones are removed
+	// first.  If zero, defaultResolvedArchiveMaxEntries is used.
+	MaxEntries int `yaml:"max_entries"`
+
+	// Enabled defines if the resolved addresses are archived.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Default values of the archive configuration.
+const (
+	defaultResolvedArchiveRetention  = 24 * time.Hour
+	defaultResolvedArchiveMaxEntries = 100_000
+)
+
+// params returns the parameters of the archive with the defaults applied.
+func (c *ResolvedArchiveConfig) params() (retention time.Duration, maxEntries int) {
+	retention, maxEntries = c.Retention.Duration, c.MaxEntries
+	if retention <= 0 {
+		retention = defaultResolvedArchiveRetention
+	}
+
+	if maxEntries <= 0 {
+		maxEntries = defaultResolvedArchiveMaxEntries
+	}
+
+	return retention, maxEntries
+}
+
+// resolvedMapping is a single IP address to domain name mapping.
+type resolvedMapping struct {
+	// FirstSeen is the time the domain name has first resolved to the address
+	// within the retention period.
+	FirstSeen time.Time `json:"first_seen"`
+
+	// LastSeen is the time the domain name has last resolved to the address.
+	LastSeen time.Time `json:"last_seen"`
+
+	// Domain is the resolved domain name.
+	Domain string `json:"domain"`
+
+	// ip is the resolved address.
+	ip netip.Addr
+}
+
+// resolvedArchive is the bounded reverse index of the resolved addresses.  The
+// zero value is ready for use.
+type resolvedArchive struct {
+	mu sync.Mutex
+
+	// byIP are the elements of order indexed by the address and the domain
+	// name.
+	byIP map[netip.Addr]map[string]*list.Element
+
+	// order is the list of *resolvedMapping ordered by the time they've been
+	// last seen, the least recent first.
+	order list.List
+}
+
+// record archives the mapping of ip to domain seen at now.
+func (ra *resolvedArchive) record(
+	conf *ResolvedArchiveConfig,
+	ip netip.Addr,
+	domain string,
+	now time.Time,
+) {
+	retention, maxEntries := conf.params()
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if ra.byIP == nil {
+		ra.byIP = map[netip.Addr]map[string]*list.Element{}
+	}
+
+	domains := ra.byIP[ip]
+	if e, ok := domains[domain]; ok {
+		e.Value.(*resolvedMapping).LastSeen = now
+		ra.order.MoveToBack(e)
+	} else {
+		if domains == nil {
+			domains = map[string]*list.Element{}
+			ra.byIP[ip] = domains
+		}
+
+		domains[domain] = ra.order.PushBack(&resolvedMapping{
+			FirstSeen: now,
+			LastSeen:  now,
+			Domain:    domain,
+			ip:        ip,
+		})
+	}
+
+	ra.removeOldLocked(now.Add(-retention), maxEntries)
+}
+
+// removeOldLocked removes the mappings last seen before the deadline as well
+// as the least recently seen ones exceeding maxEntries.  ra.mu is expected to
+// be locked.
+func (ra *resolvedArchive) removeOldLocked(deadline time.Time, maxEntries int) {
+	for e := ra.order.Front(); e != nil; e = ra.order.Front() {
+		m := e.Value.(*resolvedMapping)
+		if ra.order.Len() <= maxEntries && !m.LastSeen.Before(deadline) {
+			return
+		}
+
+		ra.order.Remove(e)
+
+		domains := ra.byIP[m.ip]
+		delete(domains, m.Domain)
+		if len(domains) == 0 {
+			delete(ra.byIP, m.ip)
+		}
+	}
+}
+
+// lookup returns the domain names resolved to ip since the deadline, the most
+// recently seen first.
+func (ra *resolvedArchive) lookup(ip netip.Addr, deadline time.Time) (mappings []*resolvedMapping) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	mappings = []*resolvedMapping{}
+	for _, e := range ra.byIP[ip] {
+		m := e.Value.(*resolvedMapping)
+		if m.LastSeen.Before(deadline) {
+			continue
+		}
+
+		c := *m
+		mappings = append(mappings, &c)
+	}
+
+	sort.Slice(mappings, func(i, j int) (less bool) {
+		return mappings[i].LastSeen.After(mappings[j].LastSeen)
+	})
+
+	return mappings
+}
+
+// processResolvedArchive archives the addresses from the answer of the
+// upstreams for the request of dctx, if enabled.
+func (s *Server) processResolvedArchive(dctx *dnsContext) (rc resultCode) {
+	conf := &s.conf.ResolvedArchive
+	if !conf.Enabled || !dctx.responseFromUpstream {
+		return resultCodeSuccess
+	}
+
+	pctx := dctx.proxyCtx
+	if pctx.Res == nil || pctx.Res.Rcode != dns.RcodeSuccess || len(pctx.Req.Question) == 0 {
+		return resultCodeSuccess
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(pctx.Req.Question[0].Name, "."))
+	now := time.Now()
+	for _, rr := range pctx.Res.Answer {
+		ip, ok := netip.AddrFromSlice(ipFromRR(rr))
+		if ok {
+			s.resolvedArchive.record(conf, ip.Unmap(), host, now)
+		}
+	}
+
+	return resultCodeSuccess
+}
+
+// resolvedArchiveResp is the response to the GET /control/resolved_archive.
+type resolvedArchiveResp struct {
+	IP      netip.Addr         `json:"ip"`
+	Domains []*resolvedMapping `json:"domains"`
+}
+
+// handleResolvedArchive handles requests to the GET /control/resolved_archive
+// endpoint.
+func (s *Server) handleResolvedArchive(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	conf := s.conf.ResolvedArchive
+	s.serverLock.RUnlock()
+
+	if !conf.Enabled {
+		aghhttp.Error(r, w, http.StatusNotFound, "resolved archive is disabled")
+
+		return
+	}
+
+	ip, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad ip: %s", err)
+
+		return
+	}
+
+	ip = ip.Unmap()
+	retention, _ := conf.params()
+
+	_ = aghhttp.WriteJSONResponse(w, r, &resolvedArchiveResp{
+		IP:      ip,
+		Domains: s.resolvedArchive.lookup(ip, time.Now().Add(-retention)),
+	})
+}
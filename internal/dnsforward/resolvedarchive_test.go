@@ -0,0 +1,64 @@
+package dnsforward
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvedArchive(t *testing.T) {
+	conf := &ResolvedArchiveConfig{
+		Retention:  timeutil.Duration{Duration: time.Hour},
+		MaxEntries: 3,
+		Enabled:    true,
+	}
+
+	var (
+		ip1 = netip.MustParseAddr("1.2.3.4")
+		ip2 = netip.MustParseAddr("1.2.3.5")
+	)
+
+	ra := &resolvedArchive{}
+	start := time.Now()
+
+	ra.record(conf, ip1, "first.example", start)
+	ra.record(conf, ip1, "second.example", start.Add(time.Minute))
+	ra.record(conf, ip1, "first.example", start.Add(2*time.Minute))
+
+	t.Run("lookup", func(t *testing.T) {
+		got := ra.lookup(ip1, start)
+		require.Len(t, got, 2)
+
+		assert.Equal(t, "first.example", got[0].Domain)
+		assert.Equal(t, start, got[0].FirstSeen)
+		assert.Equal(t, start.Add(2*time.Minute), got[0].LastSeen)
+		assert.Equal(t, "second.example", got[1].Domain)
+
+		assert.Empty(t, ra.lookup(ip2, start))
+	})
+
+	t.Run("max_entries", func(t *testing.T) {
+		now := start.Add(3 * time.Minute)
+		ra.record(conf, ip2, "third.example", now)
+		ra.record(conf, ip2, "fourth.example", now)
+
+		got := ra.lookup(ip1, start)
+		require.Len(t, got, 1)
+
+		assert.Equal(t, "first.example", got[0].Domain)
+		assert.Len(t, ra.lookup(ip2, start), 2)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		now := start.Add(time.Hour + 3*time.Minute)
+		ra.record(conf, ip2, "fifth.example", now)
+
+		assert.Empty(t, ra.lookup(ip1, start))
+		assert.Len(t, ra.lookup(ip2, start), 3)
+		assert.Equal(t, 3, ra.order.Len())
+	})
+}
@@ -0,0 +1,259 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ScheduledUpstream is a rule routing the requests to a different set of
+// upstreams within a period of the day, for example:
+//
+//	upstreams:
+//	- 'https://family.dns.example/dns-query'
+//	start: '07:00'
+//	end: '21:00'
+//	days: ['mon', 'tue', 'wed', 'thu', 'fri']
+//	clients: ['192.168.2.0/24']
+//
+// The first matching rule is used.  The client-specific upstreams take priority
+// over the scheduled ones, and the scheduled ones take priority over the ones
+// for particular query types.
+type ScheduledUpstream struct {
+	// Upstreams are the addresses of the upstreams used within the period.
+	Upstreams []string `yaml:"upstreams"`
+
+	// Start is the local time of the day, at which the period starts, in the
+	// "15:04" format.
+	Start string `yaml:"start"`
+
+	// End is the local time of the day, at which the period ends, in the
+	// "15:04" format.  If it's before Start, the period ends on the next day.
+	// If it's equal to Start, the period lasts the whole day.
+	End string `yaml:"end"`
+
+	// Days are the days of the week, at which the period starts, for example
+	// "mon".  If empty, the period starts every day.
+	Days []string `yaml:"days"`
+
+	// Clients are the IP addresses and CIDR subnets of the clients, to which
+	// the rule applies.  If empty, the rule applies to all the clients.
+	Clients []string `yaml:"clients"`
+}
+
+// scheduleDays are the days of the week by their names used in the scheduled
+// upstreams.
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduledUpstream is the parsed ScheduledUpstream.
+type scheduledUpstream struct {
+	// conf is the configuration of the upstreams used within the period.
+	conf *proxy.UpstreamConfig
+
+	// clients are the subnets of the clients, to which the rule applies.
+	clients []netip.Prefix
+
+	// start and end are the bounds of the period in minutes since midnight.
+	start int
+	end   int
+
+	// days are the days of the week, at which the period starts.  It's zero if
+	// the period starts every day.
+	days uint8
+}
+
+// parseTimeOfDay parses s in the "15:04" format into the number of minutes
+// since midnight.
+func parseTimeOfDay(s string) (mins int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parse returns the parsed su using opts for creating the upstreams.  The
+// domain-specific upstreams of main are used as well.
+func (su *ScheduledUpstream) parse(
+	opts *upstream.Options,
+	main *proxy.UpstreamConfig,
+) (parsed *scheduledUpstream, err error) {
+	parsed = &scheduledUpstream{}
+
+	parsed.start, err = parseTimeOfDay(su.Start)
+	if err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+
+	parsed.end, err = parseTimeOfDay(su.End)
+	if err != nil {
+		return nil, fmt.Errorf("end: %w", err)
+	}
+
+	for _, d := range su.Days {
+		wd, ok := scheduleDays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("bad day %q", d)
+		}
+
+		parsed.days |= 1 << wd
+	}
+
+	for _, c := range su.Clients {
+		var p netip.Prefix
+		p, err = parseClientPrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("bad client %q: %w", c, err)
+		}
+
+		parsed.clients = append(parsed.clients, p)
+	}
+
+	if len(su.Upstreams) == 0 {
+		return nil, errors.Error("no upstreams specified")
+	}
+
+	parsed.conf = &proxy.UpstreamConfig{
+		DomainReservedUpstreams:  main.DomainReservedUpstreams,
+		SpecifiedDomainUpstreams: main.SpecifiedDomainUpstreams,
+		SubdomainExclusions:      main.SubdomainExclusions,
+	}
+
+	for _, addr := range su.Upstreams {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(addr, opts)
+		if err != nil {
+			return nil, fmt.Errorf("creating upstream %q: %w", addr, err)
+		}
+
+		parsed.conf.Upstreams = append(parsed.conf.Upstreams, u)
+	}
+
+	return parsed, nil
+}
+
+// parseClientPrefix parses s either as a CIDR subnet or as a single IP
+// address.
+func parseClientPrefix(s string) (p netip.Prefix, err error) {
+	if strings.Contains(s, "/") {
+		p, err = netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return p.Masked(), nil
+	}
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// newScheduledUpstreams parses rules using opts for creating the upstreams.
+// The domain-specific upstreams of main are used by each rule as well.
+func newScheduledUpstreams(
+	rules []*ScheduledUpstream,
+	opts *upstream.Options,
+	main *proxy.UpstreamConfig,
+) (parsed []*scheduledUpstream, err error) {
+	for i, r := range rules {
+		if r == nil {
+			return nil, fmt.Errorf("rule at index %d: %w", i, errors.Error("no value"))
+		}
+
+		var su *scheduledUpstream
+		su, err = r.parse(opts, main)
+		if err != nil {
+			return nil, fmt.Errorf("rule at index %d: %w", i, err)
+		}
+
+		parsed = append(parsed, su)
+	}
+
+	return parsed, nil
+}
+
+// isOn returns true if the period of su starts on the day of the week wd.
+func (su *scheduledUpstream) isOn(wd time.Weekday) (ok bool) {
+	return su.days == 0 || su.days&(1<<wd) != 0
+}
+
+// matchesTime returns true if now is within the period of su.
+func (su *scheduledUpstream) matchesTime(now time.Time) (ok bool) {
+	mins := now.Hour()*60 + now.Minute()
+	wd := now.Weekday()
+
+	switch {
+	case su.start == su.end:
+		return su.isOn(wd)
+	case su.start < su.end:
+		return mins >= su.start && mins < su.end && su.isOn(wd)
+	case mins >= su.start:
+		return su.isOn(wd)
+	case mins < su.end:
+		// The period has started on the previous day.
+		return su.isOn((wd + 6) % 7)
+	default:
+		return false
+	}
+}
+
+// matchesClient returns true if the rule applies to the client with ip.
+func (su *scheduledUpstream) matchesClient(ip netip.Addr) (ok bool) {
+	if len(su.clients) == 0 {
+		return true
+	}
+
+	for _, p := range su.clients {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setScheduledUpstream sets the upstreams of the first scheduled rule matching
+// the request in pctx at now, if there is one, unless the client has its own
+// upstreams.  The responses of such upstreams aren't cached, since the proxy
+// doesn't cache the responses of custom upstreams.
+func (s *Server) setScheduledUpstream(pctx *proxy.DNSContext, now time.Time) {
+	if pctx.CustomUpstreamConfig != nil || len(s.conf.scheduledUpstreams) == 0 {
+		return
+	}
+
+	var ip netip.Addr
+	if addrIP, _ := netutil.IPAndPortFromAddr(pctx.Addr); addrIP != nil {
+		ip, _ = netip.AddrFromSlice(addrIP)
+		ip = ip.Unmap()
+	}
+
+	for i, su := range s.conf.scheduledUpstreams {
+		if su.matchesTime(now) && su.matchesClient(ip) {
+			log.Debug("dns: using scheduled upstreams at index %d", i)
+
+			pctx.CustomUpstreamConfig = su.conf
+
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewScheduledUpstreams(t *testing.T) {
+	main := &proxy.UpstreamConfig{}
+
+	testCases := []struct {
+		rule       *ScheduledUpstream
+		name       string
+		wantErrMsg string
+	}{{
+		rule: &ScheduledUpstream{
+			Upstreams: []string{"1.1.1.1"},
+			Start:     "07:00",
+			End:       "21:00",
+			Days:      []string{"Mon", "fri"},
+			Clients:   []string{"192.168.2.0/24", "::1"},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		rule:       nil,
+		name:       "nil",
+		wantErrMsg: "rule at index 0: no value",
+	}, {
+		rule: &ScheduledUpstream{
+			Upstreams: []string{"1.1.1.1"},
+			Start:     "7am",
+			End:       "21:00",
+		},
+		name: "bad_start",
+		wantErrMsg: `rule at index 0: start: parsing time "7am" as "15:04": ` +
+			`cannot parse "am" as ":"`,
+	}, {
+		rule: &ScheduledUpstream{
+			Upstreams: []string{"1.1.1.1"},
+			Start:     "07:00",
+			End:       "21:00",
+			Days:      []string{"monday"},
+		},
+		name:       "bad_day",
+		wantErrMsg: `rule at index 0: bad day "monday"`,
+	}, {
+		rule: &ScheduledUpstream{
+			Upstreams: []string{"1.1.1.1"},
+			Start:     "07:00",
+			End:       "21:00",
+			Clients:   []string{"client"},
+		},
+		name:       "bad_client",
+		wantErrMsg: `rule at index 0: bad client "client": ParseAddr("client"): unable to parse IP`,
+	}, {
+		rule: &ScheduledUpstream{
+			Start: "07:00",
+			End:   "21:00",
+		},
+		name:       "no_upstreams",
+		wantErrMsg: "rule at index 0: no upstreams specified",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newScheduledUpstreams(
+				[]*ScheduledUpstream{tc.rule},
+				&upstream.Options{},
+				main,
+			)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestScheduledUpstream_matchesTime(t *testing.T) {
+	// Monday.
+	day := time.Date(2022, time.October, 3, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Weekday, h, m int) (t time.Time) {
+		t = day.AddDate(0, 0, int(d-time.Monday))
+
+		return t.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	}
+
+	weekdays := &ScheduledUpstream{
+		Upstreams: []string{"1.1.1.1"},
+		Start:     "07:00",
+		End:       "21:00",
+		Days:      []string{"mon", "tue", "wed", "thu", "fri"},
+	}
+	nightly := &ScheduledUpstream{
+		Upstreams: []string{"1.1.1.1"},
+		Start:     "21:00",
+		End:       "07:00",
+		Days:      []string{"fri"},
+	}
+	allDay := &ScheduledUpstream{
+		Upstreams: []string{"1.1.1.1"},
+		Start:     "00:00",
+		End:       "00:00",
+	}
+
+	parsed, err := newScheduledUpstreams(
+		[]*ScheduledUpstream{weekdays, nightly, allDay},
+		&upstream.Options{},
+		&proxy.UpstreamConfig{},
+	)
+	require.NoError(t, err)
+	require.Len(t, parsed, 3)
+
+	testCases := []struct {
+		now  time.Time
+		su   *scheduledUpstream
+		name string
+		want bool
+	}{{
+		now:  at(time.Monday, 7, 0),
+		su:   parsed[0],
+		name: "start",
+		want: true,
+	}, {
+		now:  at(time.Monday, 20, 59),
+		su:   parsed[0],
+		name: "before_end",
+		want: true,
+	}, {
+		now:  at(time.Monday, 21, 0),
+		su:   parsed[0],
+		name: "end",
+		want: false,
+	}, {
+		now:  at(time.Saturday, 12, 0),
+		su:   parsed[0],
+		name: "other_day",
+		want: false,
+	}, {
+		now:  at(time.Friday, 23, 0),
+		su:   parsed[1],
+		name: "overnight_same_day",
+		want: true,
+	}, {
+		now:  at(time.Saturday, 6, 59),
+		su:   parsed[1],
+		name: "overnight_next_day",
+		want: true,
+	}, {
+		now:  at(time.Friday, 6, 59),
+		su:   parsed[1],
+		name: "overnight_previous_day",
+		want: false,
+	}, {
+		now:  at(time.Sunday, 13, 0),
+		su:   parsed[2],
+		name: "all_day",
+		want: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.su.matchesTime(tc.now))
+		})
+	}
+}
+
+func TestServer_setScheduledUpstream(t *testing.T) {
+	parsed, err := newScheduledUpstreams(
+		[]*ScheduledUpstream{{
+			Upstreams: []string{"9.9.9.9"},
+			Start:     "07:00",
+			End:       "21:00",
+			Clients:   []string{"192.168.2.0/24"},
+		}, {
+			Upstreams: []string{"1.1.1.1"},
+			Start:     "00:00",
+			End:       "00:00",
+		}},
+		&upstream.Options{},
+		&proxy.UpstreamConfig{},
+	)
+	require.NoError(t, err)
+	require.Len(t, parsed, 2)
+
+	s := &Server{
+		conf: ServerConfig{
+			scheduledUpstreams: parsed,
+		},
+	}
+
+	clientConf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&aghtest.Upstream{}},
+	}
+
+	day := time.Date(2022, time.October, 3, 12, 0, 0, 0, time.UTC)
+	night := day.Add(10 * time.Hour)
+
+	testCases := []struct {
+		now    time.Time
+		custom *proxy.UpstreamConfig
+		want   *proxy.UpstreamConfig
+		name   string
+		ip     net.IP
+	}{{
+		now:    day,
+		custom: nil,
+		want:   parsed[0].conf,
+		name:   "subnet_day",
+		ip:     net.IP{192, 168, 2, 3},
+	}, {
+		now:    night,
+		custom: nil,
+		want:   parsed[1].conf,
+		name:   "subnet_night",
+		ip:     net.IP{192, 168, 2, 3},
+	}, {
+		now:    day,
+		custom: nil,
+		want:   parsed[1].conf,
+		name:   "other_client",
+		ip:     net.IP{192, 168, 1, 3},
+	}, {
+		now:    day,
+		custom: clientConf,
+		want:   clientConf,
+		name:   "client_upstreams",
+		ip:     net.IP{192, 168, 2, 3},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pctx := &proxy.DNSContext{
+				Req:                  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+				Addr:                 &net.UDPAddr{IP: tc.ip, Port: 53},
+				CustomUpstreamConfig: tc.custom,
+			}
+
+			s.setScheduledUpstream(pctx, tc.now)
+			assert.Same(t, tc.want, pctx.CustomUpstreamConfig)
+		})
+	}
+}
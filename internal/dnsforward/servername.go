@@ -0,0 +1,174 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// serverNames returns the lowercased FQDNs of the server: the configured server
+// name and the non-wildcard DNS names from the certificate.
+func (s *Server) serverNames() (names map[string]struct{}) {
+	names = map[string]struct{}{}
+
+	add := func(n string) {
+		if n == "" || strings.Contains(n, "*") {
+			return
+		}
+
+		names[dns.Fqdn(strings.ToLower(n))] = struct{}{}
+	}
+
+	add(s.conf.ServerName)
+	for _, n := range s.conf.dnsNames {
+		add(n)
+	}
+
+	return names
+}
+
+// serverIPs returns the IP addresses the plain DNS server is reachable at.  If
+// the server listens on an unspecified address, the addresses of all network
+// interfaces except the loopback and the link-local ones are used.
+func (s *Server) serverIPs() (ips []net.IP) {
+	var unspecified bool
+	for _, addr := range s.conf.UDPListenAddrs {
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			unspecified = true
+
+			continue
+		}
+
+		ips = append(ips, addr.IP)
+	}
+
+	if !unspecified {
+		return ips
+	}
+
+	addrs, err := aghnet.CollectAllIfacesAddrs()
+	if err != nil {
+		log.Error("dnsforward: collecting server addresses: %s", err)
+
+		return ips
+	}
+
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips
+}
+
+// prepareServerNames sets up the data for answering the requests for the
+// server's own hostnames.  It must be called after the TLS configuration is
+// loaded.
+func (s *Server) prepareServerNames() {
+	if !s.conf.HandleServerName {
+		s.srvNames, s.srvIPs = nil, nil
+
+		return
+	}
+
+	s.srvNames = s.serverNames()
+	s.srvIPs = s.serverIPs()
+
+	log.Debug("dnsforward: answering for server names %v with %v", s.srvNames, s.srvIPs)
+}
+
+// processServerName responds to the requests for the server's own hostnames
+// with the server's addresses and, if DNS-over-HTTPS is enabled, with the
+// HTTPS resource record advertising it.  Other types get an empty response.
+func (s *Server) processServerName(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	req := pctx.Req
+	q := req.Question[0]
+
+	if _, ok := s.srvNames[strings.ToLower(q.Name)]; !ok {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dnsforward: answering %s request for server name %q", dns.Type(q.Qtype), q.Name)
+
+	resp := s.makeResponse(req)
+	switch q.Qtype {
+	case dns.TypeA:
+		for _, ip := range s.srvIPs {
+			if ip4 := ip.To4(); ip4 != nil {
+				resp.Answer = append(resp.Answer, s.genAnswerA(req, ip4))
+			}
+		}
+	case dns.TypeAAAA:
+		if s.conf.AAAADisabled {
+			break
+		}
+
+		for _, ip := range s.srvIPs {
+			if ip.To4() == nil {
+				resp.Answer = append(resp.Answer, s.genAnswerAAAA(req, ip))
+			}
+		}
+	case dns.TypeHTTPS:
+		resp.Answer = s.genAnswersHTTPS(req)
+	default:
+		// Go on and return an empty response.
+	}
+
+	// Go on so that the request is written to the query log and statistics.
+	pctx.Res = resp
+
+	return resultCodeSuccess
+}
+
+// genAnswersHTTPS returns the HTTPS resource records advertising the
+// DNS-over-HTTPS server, one per each listen address.
+func (s *Server) genAnswersHTTPS(req *dns.Msg) (ans []dns.RR) {
+	alpn := []string{"h2"}
+	if s.conf.ServeHTTP3 {
+		alpn = append(alpn, "h3")
+	}
+
+	var hintsV4, hintsV6 []net.IP
+	for _, ip := range s.srvIPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			hintsV4 = append(hintsV4, ip4)
+		} else if !s.conf.AAAADisabled {
+			hintsV6 = append(hintsV6, ip)
+		}
+	}
+
+	for _, addr := range s.conf.HTTPSListenAddrs {
+		values := []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: alpn},
+			&dns.SVCBPort{Port: uint16(addr.Port)},
+			&dns.SVCBDoHPath{Template: "/dns-query{?dns}"},
+		}
+
+		if len(hintsV4) > 0 {
+			values = append(values, &dns.SVCBIPv4Hint{Hint: hintsV4})
+		}
+
+		if len(hintsV6) > 0 {
+			values = append(values, &dns.SVCBIPv6Hint{Hint: hintsV6})
+		}
+
+		ans = append(ans, &dns.HTTPS{
+			SVCB: dns.SVCB{
+				Hdr:      s.hdr(req, dns.TypeHTTPS),
+				Priority: 1,
+				Target:   ".",
+				Value:    values,
+			},
+		})
+	}
+
+	return ans
+}
@@ -0,0 +1,137 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ProcessServerName(t *testing.T) {
+	const (
+		srvName = "dns.example"
+		srvFQDN = srvName + "."
+	)
+
+	ip4 := net.IP{1, 2, 3, 4}
+	ip6 := net.ParseIP("2001:db8::1")
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				HandleServerName: true,
+			},
+			TLSConfig: TLSConfig{
+				ServerName:       srvName,
+				HTTPSListenAddrs: []*net.TCPAddr{{Port: 8443}},
+				dnsNames:         []string{"*.dns.example", "Other.Example"},
+			},
+			UDPListenAddrs: []*net.UDPAddr{{IP: ip4, Port: 53}, {IP: ip6, Port: 53}},
+		},
+	}
+	s.prepareServerNames()
+
+	assert.Equal(t, map[string]struct{}{
+		srvFQDN:          {},
+		"other.example.": {},
+	}, s.srvNames)
+
+	testCases := []struct {
+		name    string
+		host    string
+		want    []dns.RR
+		qtype   uint16
+		wantRes bool
+	}{{
+		name:    "pass",
+		host:    "example.org.",
+		want:    nil,
+		qtype:   dns.TypeA,
+		wantRes: false,
+	}, {
+		name: "a",
+		host: "DNS.example.",
+		want: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "DNS.example.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   ip4,
+		}},
+		qtype:   dns.TypeA,
+		wantRes: true,
+	}, {
+		name: "aaaa",
+		host: "other.example.",
+		want: []dns.RR{&dns.AAAA{
+			Hdr:  dns.RR_Header{Name: "other.example.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+			AAAA: ip6,
+		}},
+		qtype:   dns.TypeAAAA,
+		wantRes: true,
+	}, {
+		name: "https",
+		host: srvFQDN,
+		want: []dns.RR{&dns.HTTPS{SVCB: dns.SVCB{
+			Hdr:      dns.RR_Header{Name: srvFQDN, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET},
+			Priority: 1,
+			Target:   ".",
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{"h2"}},
+				&dns.SVCBPort{Port: 8443},
+				&dns.SVCBDoHPath{Template: "/dns-query{?dns}"},
+				&dns.SVCBIPv4Hint{Hint: []net.IP{ip4}},
+				&dns.SVCBIPv6Hint{Hint: []net.IP{ip6}},
+			},
+		}}},
+		qtype:   dns.TypeHTTPS,
+		wantRes: true,
+	}, {
+		name:    "other_type",
+		host:    srvFQDN,
+		want:    nil,
+		qtype:   dns.TypeTXT,
+		wantRes: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessageWithType(tc.host, tc.qtype),
+				},
+			}
+
+			res := s.processServerName(dctx)
+			require.Equal(t, resultCodeSuccess, res)
+
+			if !tc.wantRes {
+				assert.Nil(t, dctx.proxyCtx.Res)
+
+				return
+			}
+
+			resp := dctx.proxyCtx.Res
+			require.NotNil(t, resp)
+
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			assert.Equal(t, tc.want, resp.Answer)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		s.conf.HandleServerName = false
+		s.prepareServerNames()
+
+		dctx := &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: createTestMessageWithType(srvFQDN, dns.TypeA),
+			},
+		}
+
+		res := s.processServerName(dctx)
+		require.Equal(t, resultCodeSuccess, res)
+
+		assert.Nil(t, dctx.proxyCtx.Res)
+	})
+}
@@ -0,0 +1,247 @@
+package dnsforward
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// ServfailDampingConfig is the configuration of backing off the requests for
+// the zones, for which the upstreams keep responding with SERVFAIL.  Such
+// requests are answered with SERVFAIL locally for some time, which protects
+// both the upstreams and the clients waiting for the responses.
+type ServfailDampingConfig struct {
+	// Window is the period of time, during which Threshold failures must
+	// happen to start the damping of the zone.  If zero,
+	// defaultServfailDampingWindow is used.
+	Window timeutil.Duration `yaml:"window"`
+
+	// Backoff is the duration of the damping of the zone.  If zero,
+	// defaultServfailDampingBackoff is used.
+	Backoff timeutil.Duration `yaml:"backoff"`
+
+	// Threshold is the number of the failed responses for the zone within
+	// Window, which starts the damping of the zone.  If zero,
+	// defaultServfailDampingThreshold is used.
+	Threshold uint32 `yaml:"threshold"`
+
+	// Enabled defines if the damping is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Default values of the damping configuration.
+const (
+	defaultServfailDampingWindow    = 10 * time.Second
+	defaultServfailDampingBackoff   = 30 * time.Second
+	defaultServfailDampingThreshold = 10
+)
+
+// maxServfailDampingZones is the number of tracked zones, after reaching which
+// the stale ones are removed.
+const maxServfailDampingZones = 10_000
+
+// params returns the parameters of the damping with the defaults applied.
+func (c *ServfailDampingConfig) params() (window, backoff time.Duration, threshold uint32) {
+	window, backoff, threshold = c.Window.Duration, c.Backoff.Duration, c.Threshold
+	if window <= 0 {
+		window = defaultServfailDampingWindow
+	}
+
+	if backoff <= 0 {
+		backoff = defaultServfailDampingBackoff
+	}
+
+	if threshold == 0 {
+		threshold = defaultServfailDampingThreshold
+	}
+
+	return window, backoff, threshold
+}
+
+// dampingZone is the damping state of a single zone.
+type dampingZone struct {
+	// windowStart is the time of the first failure within the current window.
+	windowStart time.Time
+
+	// dampedUntil is the time the damping of the zone ends at.  It's zero if
+	// the zone has never been damped.
+	dampedUntil time.Time
+
+	// failures is the number of the failures within the current window.
+	failures uint32
+
+	// answered is the number of the requests answered locally during the
+	// current damping.
+	answered uint64
+}
+
+// servfailDamper tracks the failed responses of the upstreams per zone.  The
+// zero value is ready for use.
+type servfailDamper struct {
+	mu    sync.Mutex
+	zones map[string]*dampingZone
+}
+
+// dampingZoneName returns the zone of host, which is the registrable domain,
+// or host itself if there is none.  host must be a lowercased FQDN.
+func dampingZoneName(host string) (zone string) {
+	host = strings.TrimSuffix(host, ".")
+	zone, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+
+	return zone
+}
+
+// isDamped returns true if the requests for zone should be answered locally at
+// now.  It counts such requests.
+func (sd *servfailDamper) isDamped(zone string, now time.Time) (ok bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	z := sd.zones[zone]
+	if z == nil || !now.Before(z.dampedUntil) {
+		return false
+	}
+
+	z.answered++
+
+	return true
+}
+
+// record accounts the response for zone received at now.  failed is true if
+// the upstreams responded with SERVFAIL or haven't responded at all.
+func (sd *servfailDamper) record(conf *ServfailDampingConfig, zone string, failed bool, now time.Time) {
+	if !failed {
+		return
+	}
+
+	window, backoff, threshold := conf.params()
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.zones == nil {
+		sd.zones = map[string]*dampingZone{}
+	}
+
+	z := sd.zones[zone]
+	if z == nil {
+		if len(sd.zones) >= maxServfailDampingZones {
+			sd.removeStale(now, window)
+		}
+
+		z = &dampingZone{}
+		sd.zones[zone] = z
+	}
+
+	if now.Sub(z.windowStart) > window {
+		z.windowStart = now
+		z.failures = 0
+	}
+
+	z.failures++
+	if z.failures < threshold {
+		return
+	}
+
+	z.dampedUntil = now.Add(backoff)
+	z.failures = 0
+	z.answered = 0
+
+	log.Info("dns: damping zone %s until %s after %d failures", zone, z.dampedUntil, threshold)
+}
+
+// removeStale removes the zones, which aren't damped at now and have no
+// failures within the window.  sd.mu is expected to be locked.
+func (sd *servfailDamper) removeStale(now time.Time, window time.Duration) {
+	for name, z := range sd.zones {
+		if !now.Before(z.dampedUntil) && now.Sub(z.windowStart) > window {
+			delete(sd.zones, name)
+		}
+	}
+}
+
+// dampedZoneJSON is the JSON representation of a damped zone.
+type dampedZoneJSON struct {
+	Until    time.Time `json:"until"`
+	Zone     string    `json:"zone"`
+	Answered uint64    `json:"answered"`
+}
+
+// damped returns the zones damped at now sorted by name.
+func (sd *servfailDamper) damped(now time.Time) (zones []*dampedZoneJSON) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	zones = []*dampedZoneJSON{}
+	for name, z := range sd.zones {
+		if now.Before(z.dampedUntil) {
+			zones = append(zones, &dampedZoneJSON{
+				Until:    z.dampedUntil,
+				Zone:     name,
+				Answered: z.answered,
+			})
+		}
+	}
+
+	sort.Slice(zones, func(i, j int) (less bool) { return zones[i].Zone < zones[j].Zone })
+
+	return zones
+}
+
+// dampServfail answers the request of dctx with SERVFAIL if its zone is
+// damped.  ok is true if the request has been answered.
+func (s *Server) dampServfail(dctx *dnsContext) (ok bool) {
+	if !s.conf.ServfailDamping.Enabled {
+		return false
+	}
+
+	pctx := dctx.proxyCtx
+	zone := dampingZoneName(strings.ToLower(pctx.Req.Question[0].Name))
+	if !s.servfailDamper.isDamped(zone, time.Now()) {
+		return false
+	}
+
+	log.Debug("dns: zone %s is damped, responding with servfail", zone)
+
+	pctx.Res = s.genServerFailure(pctx.Req)
+
+	return true
+}
+
+// recordServfail accounts the result of resolving the request of dctx by the
+// upstreams.  The responses from the cache aren't accounted.
+func (s *Server) recordServfail(dctx *dnsContext) {
+	if !s.conf.ServfailDamping.Enabled {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+	failed := dctx.err != nil
+	if !failed {
+		if pctx.Upstream == nil || pctx.Res == nil {
+			return
+		}
+
+		failed = pctx.Res.Rcode == dns.RcodeServerFailure
+	}
+
+	zone := dampingZoneName(strings.ToLower(pctx.Req.Question[0].Name))
+	s.servfailDamper.record(&s.conf.ServfailDamping, zone, failed, time.Now())
+}
+
+// handleServfailDamping handles requests to the GET /control/servfail_damping
+// endpoint.
+func (s *Server) handleServfailDamping(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, s.servfailDamper.damped(time.Now()))
+}
@@ -0,0 +1,102 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDampingZoneName(t *testing.T) {
+	testCases := []struct {
+		host string
+		want string
+	}{{
+		host: "www.example.org.",
+		want: "example.org",
+	}, {
+		host: "a.b.example.co.uk.",
+		want: "example.co.uk",
+	}, {
+		host: "example.org.",
+		want: "example.org",
+	}, {
+		host: "org.",
+		want: "org",
+	}, {
+		host: "host.lan.",
+		want: "host.lan",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			assert.Equal(t, tc.want, dampingZoneName(tc.host))
+		})
+	}
+}
+
+func TestServfailDamper(t *testing.T) {
+	const zone = "example.org"
+
+	conf := &ServfailDampingConfig{
+		Window:    timeutil.Duration{Duration: 10 * time.Second},
+		Backoff:   timeutil.Duration{Duration: time.Minute},
+		Threshold: 3,
+		Enabled:   true,
+	}
+
+	sd := &servfailDamper{}
+	start := time.Now()
+
+	t.Run("successes", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			sd.record(conf, zone, false, start)
+		}
+
+		assert.False(t, sd.isDamped(zone, start))
+	})
+
+	t.Run("outside_window", func(t *testing.T) {
+		now := start
+		for i := 0; i < 5; i++ {
+			sd.record(conf, zone, true, now)
+			now = now.Add(conf.Window.Duration/2 + time.Second)
+		}
+
+		assert.False(t, sd.isDamped(zone, now))
+	})
+
+	now := start.Add(time.Hour)
+	for i := uint32(0); i < conf.Threshold; i++ {
+		sd.record(conf, zone, true, now)
+	}
+
+	t.Run("damped", func(t *testing.T) {
+		assert.True(t, sd.isDamped(zone, now))
+		assert.True(t, sd.isDamped(zone, now.Add(time.Second)))
+		assert.False(t, sd.isDamped("example.com", now))
+
+		zones := sd.damped(now)
+		require.Len(t, zones, 1)
+
+		assert.Equal(t, zone, zones[0].Zone)
+		assert.Equal(t, now.Add(conf.Backoff.Duration), zones[0].Until)
+		assert.Equal(t, uint64(2), zones[0].Answered)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		end := now.Add(conf.Backoff.Duration)
+
+		assert.False(t, sd.isDamped(zone, end))
+		assert.Empty(t, sd.damped(end))
+	})
+}
+
+func TestServfailDampingConfig_params(t *testing.T) {
+	window, backoff, threshold := (&ServfailDampingConfig{}).params()
+	assert.Equal(t, defaultServfailDampingWindow, window)
+	assert.Equal(t, defaultServfailDampingBackoff, backoff)
+	assert.Equal(t, uint32(defaultServfailDampingThreshold), threshold)
+}
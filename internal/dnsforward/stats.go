@@ -2,6 +2,7 @@ package dnsforward
 
 import (
 	"net"
+	"net/http"
 	"strings"
 	"time"
 
@@ -16,6 +17,10 @@ import (
 
 // Write Stats data and logs
 func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
+	if dctx.isInternal {
+		return resultCodeSuccess
+	}
+
 	elapsed := time.Since(dctx.startTime)
 	pctx := dctx.proxyCtx
 
@@ -33,9 +38,22 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	s.serverLock.RLock()
 	defer s.serverLock.RUnlock()
 
+	var qname string
+	if len(msg.Question) > 0 {
+		qname = msg.Question[0].Name
+	}
+
+	// Check the ignored clients before the anonymization, since their real
+	// addresses are configured.
+	if s.queryLog != nil && !s.queryLog.ShouldLog(qname, ip, dctx.clientID) {
+		log.Debug("dnsforward: ignored request client=%s qname=%s", ip, qname)
+
+		return resultCodeSuccess
+	}
+
 	s.anonymizer.Load()(ip)
 
-	log.Debug("client ip: %s", ip)
+	log.Debug("dnsforward: processed request client=%s qname=%s duration=%s", ip, qname, elapsed)
 
 	// Synchronize access to s.queryLog and s.stats so they won't be suddenly
 	// uninitialized while in use.  This can happen after proxy server has been
@@ -68,6 +86,8 @@ func (s *Server) logQuery(
 		ClientIP:          ip,
 		Elapsed:           elapsed,
 		AuthenticatedData: dctx.responseAD,
+		DNSSEC:            dctx.dnssecStatus,
+		CacheBypassed:     dctx.cacheBypassed,
 	}
 
 	switch pctx.Proto {
@@ -111,6 +131,7 @@ func (s *Server) updateStats(
 		e.Client = clientIP.String()
 	}
 
+	e.At = ctx.startTime
 	e.Time = uint32(elapsed / 1000)
 	e.Result = stats.RNotFiltered
 
@@ -123,9 +144,112 @@ func (s *Server) updateStats(
 		e.Result = stats.RSafeSearch
 	case filtering.FilteredBlockList,
 		filtering.FilteredInvalid,
-		filtering.FilteredBlockedService:
+		filtering.FilteredBlockedService,
+		filtering.FilteredDoHCanary:
 		e.Result = stats.RFiltered
 	}
 
+	if res.Reason == filtering.FilteredBlockedService {
+		e.BlockedService = res.ServiceName
+	} else if e.Result != stats.RNotFiltered {
+		e.BlockedService = filtering.ServiceIDByHost(e.Domain)
+	}
+
+	e.Cache = s.cacheResult(ctx)
+	e.RespCode = respCode(pctx.Res)
+	e.Fallback = ctx.fallback
+	e.FallbackSwitched = ctx.fallbackSwitched
+	if pctx.Upstream != nil {
+		e.Upstream = pctx.Upstream.Address()
+	}
+
+	e.Listener = listenerAddr(pctx)
+
 	s.stats.Update(e)
 }
+
+// listenerAddr returns the protocol and the local address of the listener,
+// which has received the request in pctx, for example "udp://0.0.0.0:53".  It
+// returns an empty string if the address is unknown.
+func listenerAddr(pctx *proxy.DNSContext) (addr string) {
+	var laddr net.Addr
+	switch {
+	case pctx.Conn != nil:
+		laddr = pctx.Conn.LocalAddr()
+	case pctx.QUICConnection != nil:
+		laddr = pctx.QUICConnection.LocalAddr()
+	case pctx.DNSCryptResponseWriter != nil:
+		laddr = pctx.DNSCryptResponseWriter.LocalAddr()
+	case pctx.HTTPRequest != nil:
+		laddr, _ = pctx.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	}
+
+	if laddr == nil {
+		return ""
+	}
+
+	return string(pctx.Proto) + "://" + laddr.String()
+}
+
+// respCode returns the class of the response code of resp for the statistics.
+func respCode(resp *dns.Msg) (rc stats.ResponseCode) {
+	if resp == nil {
+		return stats.RespOther
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return stats.RespNoError
+	case dns.RcodeNameError:
+		return stats.RespNXDomain
+	case dns.RcodeServerFailure:
+		return stats.RespServFail
+	case dns.RcodeRefused:
+		return stats.RespRefused
+	default:
+		return stats.RespOther
+	}
+}
+
+// optimisticTTL is the TTL of the expired responses served from the
+// optimistic cache.  It must be kept in sync with dnsproxy.
+const optimisticTTL = 10
+
+// cacheResult returns the result of looking up the DNS cache for the request.
+// The optimistic cache doesn't mark the expired responses, so those are
+// recognized by their TTLs, which may rarely count a fresh response with the
+// same TTL as a stale one.
+func (s *Server) cacheResult(dctx *dnsContext) (cr stats.CacheResult) {
+	pctx := dctx.proxyCtx
+	if !dctx.responseFromUpstream ||
+		s.conf.CacheSize == 0 ||
+		pctx.CustomUpstreamConfig != nil ||
+		pctx.Req.CheckingDisabled {
+		return stats.CacheNone
+	} else if pctx.CachedUpstreamAddr == "" {
+		return stats.CacheMiss
+	}
+
+	resp := pctx.Res
+	if resp == nil {
+		return stats.CacheHit
+	} else if resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0 {
+		return stats.CacheNegativeHit
+	} else if s.conf.CacheOptimistic && isOptimisticResp(resp) {
+		return stats.CacheStaleHit
+	}
+
+	return stats.CacheHit
+}
+
+// isOptimisticResp returns true if all answers of resp have the TTL set by the
+// optimistic cache to the expired responses.
+func isOptimisticResp(resp *dns.Msg) (ok bool) {
+	for _, rr := range resp.Answer {
+		if rr.Header().Ttl != optimisticTTL {
+			return false
+		}
+	}
+
+	return true
+}
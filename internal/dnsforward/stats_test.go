@@ -1,7 +1,10 @@
 package dnsforward
 
 import (
+	"context"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -11,6 +14,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,12 +34,20 @@ func (l *testQueryLog) Add(p *querylog.AddParams) {
 	l.lastParams = p
 }
 
+// ShouldLog implements the querylog.QueryLog interface for *testQueryLog.
+func (l *testQueryLog) ShouldLog(_ string, _ net.IP, _ string) (ok bool) {
+	return true
+}
+
 // testStats is a simple stats.Stats implementation for tests.
 type testStats struct {
 	// Stats is embedded here simply to make testStats a stats.Stats without
 	// actually implementing all methods.
 	stats.Interface
 
+	// latency is returned by Latency.
+	latency *stats.LatencyResp
+
 	lastEntry stats.Entry
 }
 
@@ -44,6 +56,11 @@ func (l *testStats) Update(e stats.Entry) {
 	l.lastEntry = e
 }
 
+// Latency implements the stats.Stats interface for *testStats.
+func (l *testStats) Latency() (resp *stats.LatencyResp) {
+	return l.latency
+}
+
 func TestProcessQueryLogsAndStats(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -198,3 +215,157 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_CacheResult(t *testing.T) {
+	newResp := func(rcode int, ttls ...uint32) (resp *dns.Msg) {
+		resp = &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}}
+		for _, ttl := range ttls {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Ttl: ttl},
+				A:   net.IP{1, 2, 3, 4},
+			})
+		}
+
+		return resp
+	}
+
+	srv := &Server{}
+	srv.conf.CacheSize = 1024
+	srv.conf.CacheOptimistic = true
+
+	testCases := []struct {
+		resp         *dns.Msg
+		name         string
+		cachedAddr   string
+		fromUpstream bool
+		want         stats.CacheResult
+	}{{
+		resp:         newResp(dns.RcodeSuccess, 100),
+		name:         "not_resolved",
+		cachedAddr:   "",
+		fromUpstream: false,
+		want:         stats.CacheNone,
+	}, {
+		resp:         newResp(dns.RcodeSuccess, 100),
+		name:         "miss",
+		cachedAddr:   "",
+		fromUpstream: true,
+		want:         stats.CacheMiss,
+	}, {
+		resp:         newResp(dns.RcodeSuccess, 100),
+		name:         "hit",
+		cachedAddr:   "1.1.1.1:53",
+		fromUpstream: true,
+		want:         stats.CacheHit,
+	}, {
+		resp:         newResp(dns.RcodeNameError),
+		name:         "negative_hit",
+		cachedAddr:   "1.1.1.1:53",
+		fromUpstream: true,
+		want:         stats.CacheNegativeHit,
+	}, {
+		resp:         newResp(dns.RcodeSuccess, optimisticTTL, optimisticTTL),
+		name:         "stale_hit",
+		cachedAddr:   "1.1.1.1:53",
+		fromUpstream: true,
+		want:         stats.CacheStaleHit,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:                &dns.Msg{},
+					Res:                tc.resp,
+					CachedUpstreamAddr: tc.cachedAddr,
+				},
+				responseFromUpstream: tc.fromUpstream,
+			}
+
+			assert.Equal(t, tc.want, srv.cacheResult(dctx))
+		})
+	}
+}
+
+func TestRespCode(t *testing.T) {
+	testCases := []struct {
+		resp *dns.Msg
+		name string
+		want stats.ResponseCode
+	}{{
+		resp: nil,
+		name: "no_response",
+		want: stats.RespOther,
+	}, {
+		resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess}},
+		name: "noerror",
+		want: stats.RespNoError,
+	}, {
+		resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}},
+		name: "nxdomain",
+		want: stats.RespNXDomain,
+	}, {
+		resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}},
+		name: "servfail",
+		want: stats.RespServFail,
+	}, {
+		resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeRefused}},
+		name: "refused",
+		want: stats.RespRefused,
+	}, {
+		resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNotImplemented}},
+		name: "other",
+		want: stats.RespOther,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, respCode(tc.resp))
+		})
+	}
+}
+
+func TestListenerAddr(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, udpConn.Close)
+
+	httpAddr := &net.TCPAddr{IP: net.IP{192, 168, 1, 1}, Port: 443}
+	httpReq := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+	httpReq = httpReq.WithContext(context.WithValue(
+		httpReq.Context(),
+		http.LocalAddrContextKey,
+		httpAddr,
+	))
+
+	testCases := []struct {
+		pctx *proxy.DNSContext
+		name string
+		want string
+	}{{
+		pctx: &proxy.DNSContext{Proto: proxy.ProtoUDP, Conn: udpConn},
+		name: "udp",
+		want: "udp://" + udpConn.LocalAddr().String(),
+	}, {
+		pctx: &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: httpReq},
+		name: "https",
+		want: "https://192.168.1.1:443",
+	}, {
+		pctx: &proxy.DNSContext{
+			Proto:       proxy.ProtoHTTPS,
+			HTTPRequest: httptest.NewRequest(http.MethodGet, "/dns-query", nil),
+		},
+		name: "https_no_addr",
+		want: "",
+	}, {
+		pctx: &proxy.DNSContext{Proto: proxy.ProtoUDP},
+		name: "unknown",
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, listenerAddr(tc.pctx))
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// TLSListener is the kind of the listener, which uses a TLS certificate.
+type TLSListener string
+
+// Kinds of TLS listeners.
+const (
+	// TLSListenerHTTPS is the HTTPS listener, which serves both the web
+	// interface and DNS-over-HTTPS.
+	TLSListenerHTTPS TLSListener = "https"
+
+	// TLSListenerDoT is the DNS-over-TLS listener.
+	TLSListenerDoT TLSListener = "dot"
+
+	// TLSListenerDoQ is the DNS-over-QUIC listener.
+	TLSListenerDoQ TLSListener = "doq"
+)
+
+// validate returns an error if l isn't a known kind of listener.
+func (l TLSListener) validate() (err error) {
+	switch l {
+	case TLSListenerHTTPS, TLSListenerDoT, TLSListenerDoQ:
+		return nil
+	default:
+		return fmt.Errorf("bad listener %q", l)
+	}
+}
+
+// TLSCertificate is a certificate used along with the main one.  The
+// certificate for a connection is selected by the server name the client
+// indicates (SNI) among the certificates of the listener, with the main one
+// being the default.
+type TLSCertificate struct {
+	// Pair is the parsed certificate chain and private key.  It's set by
+	// Load.
+	Pair *tls.Certificate `yaml:"-" json:"-"`
+
+	// CertificatePath is the path to the PEM-encoded certificate chain.
+	CertificatePath string `yaml:"certificate_path" json:"certificate_path"`
+
+	// PrivateKeyPath is the path to the PEM-encoded private key.
+	PrivateKeyPath string `yaml:"private_key_path" json:"private_key_path"`
+
+	// Listeners are the listeners the certificate is used by.  If empty, the
+	// certificate is used by all of them.
+	Listeners []TLSListener `yaml:"listeners" json:"listeners"`
+}
+
+// Load validates c, reads the certificate chain and the private key from the
+// files, and sets c.Pair.
+func (c *TLSCertificate) Load() (err error) {
+	for _, l := range c.Listeners {
+		if err = l.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.CertificatePath == "" || c.PrivateKeyPath == "" {
+		return errors.Error("certificate and private key paths must be set")
+	}
+
+	chain, err := os.ReadFile(c.CertificatePath)
+	if err != nil {
+		return fmt.Errorf("reading cert file: %w", err)
+	}
+
+	key, err := os.ReadFile(c.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("reading key file: %w", err)
+	}
+
+	pair, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return fmt.Errorf("parsing key pair: %w", err)
+	}
+
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	c.Pair = &pair
+
+	return nil
+}
+
+// usedBy returns true if c is loaded and used by the listener l.
+func (c *TLSCertificate) usedBy(l TLSListener) (ok bool) {
+	if c.Pair == nil {
+		return false
+	}
+
+	if len(c.Listeners) == 0 {
+		return true
+	}
+
+	for _, cl := range c.Listeners {
+		if cl == l {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListenerCertificates returns the certificates of the listener l: main
+// followed by the loaded ones from additional used by l.
+func ListenerCertificates(
+	main tls.Certificate,
+	additional []*TLSCertificate,
+	l TLSListener,
+) (certs []tls.Certificate) {
+	certs = []tls.Certificate{main}
+	for _, c := range additional {
+		if c.usedBy(l) {
+			certs = append(certs, *c.Pair)
+		}
+	}
+
+	return certs
+}
+
+// tlsCert is a certificate of a DNS listener along with the names it's valid
+// for.
+type tlsCert struct {
+	// pair is the certificate chain and private key.
+	pair *tls.Certificate
+
+	// dnsNames are the sorted DNS names from the certificate's SAN or its CN,
+	// if there are none.
+	dnsNames []string
+}
+
+// newTLSCerts returns the certificates of the DNS listener l: main followed by
+// the ones from additional used by l.
+func newTLSCerts(main tls.Certificate, additional []*TLSCertificate, l TLSListener) (certs []*tlsCert, err error) {
+	for _, pair := range ListenerCertificates(main, additional, l) {
+		pair := pair
+		x := pair.Leaf
+		if x == nil {
+			x, err = x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("parsing certificate: %w", err)
+			}
+		}
+
+		names := append([]string{}, x.DNSNames...)
+		if len(names) == 0 {
+			names = append(names, x.Subject.CommonName)
+		}
+
+		sort.Strings(names)
+
+		certs = append(certs, &tlsCert{
+			pair:     &pair,
+			dnsNames: names,
+		})
+	}
+
+	return certs, nil
+}
+
+// matchingTLSCert returns the first of certs valid for sni, the client's SNI
+// value, or nil if there is none.
+func matchingTLSCert(certs []*tlsCert, sni string) (c *tls.Certificate) {
+	for _, tc := range certs {
+		if anyNameMatches(tc.dnsNames, sni) {
+			return tc.pair
+		}
+	}
+
+	return nil
+}
+
+// isQUICHello returns true if ch has been received by the DNS-over-QUIC
+// listener.
+func isQUICHello(ch *tls.ClientHelloInfo) (ok bool) {
+	if ch.Conn == nil {
+		return false
+	}
+
+	_, ok = ch.Conn.LocalAddr().(*net.UDPAddr)
+
+	return ok
+}
+
+// onGetCertificate selects the certificate for the TLS handshake by the
+// server name supplied by the client in the Client Hello.  If the name doesn't
+// match any of the listener's certificates, the main one is used, unless the
+// strict SNI check is enabled, in which case the handshake is terminated.
+func (s *Server) onGetCertificate(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := s.dotCerts
+	if isQUICHello(ch) {
+		certs = s.doqCerts
+	}
+
+	if c := matchingTLSCert(certs, ch.ServerName); c != nil {
+		return c, nil
+	}
+
+	if s.conf.StrictSNICheck {
+		log.Info("dns: tls: unknown SNI in Client Hello: %s", ch.ServerName)
+
+		return nil, fmt.Errorf("invalid SNI")
+	}
+
+	return certs[0].pair, nil
+}
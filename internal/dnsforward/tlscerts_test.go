@@ -0,0 +1,207 @@
+package dnsforward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertPEM returns the PEM-encoded self-signed certificate for names and
+// its private key.
+func newTestCertPEM(t *testing.T, names ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM
+}
+
+// newTestTLSCertificate returns the loaded additional certificate for names
+// used by listeners.
+func newTestTLSCertificate(
+	t *testing.T,
+	listeners []TLSListener,
+	names ...string,
+) (c *TLSCertificate) {
+	t.Helper()
+
+	certPEM, keyPEM := newTestCertPEM(t, names...)
+
+	dir := t.TempDir()
+	c = &TLSCertificate{
+		CertificatePath: filepath.Join(dir, "cert.pem"),
+		PrivateKeyPath:  filepath.Join(dir, "key.pem"),
+		Listeners:       listeners,
+	}
+
+	require.NoError(t, os.WriteFile(c.CertificatePath, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(c.PrivateKeyPath, keyPEM, 0o600))
+	require.NoError(t, c.Load())
+
+	return c
+}
+
+func TestTLSCertificate_Load(t *testing.T) {
+	c := newTestTLSCertificate(t, nil, "dns.example")
+	require.NotNil(t, c.Pair)
+	require.NotNil(t, c.Pair.Leaf)
+
+	assert.Equal(t, []string{"dns.example"}, c.Pair.Leaf.DNSNames)
+
+	t.Run("bad_listener", func(t *testing.T) {
+		bad := &TLSCertificate{
+			CertificatePath: c.CertificatePath,
+			PrivateKeyPath:  c.PrivateKeyPath,
+			Listeners:       []TLSListener{"smtp"},
+		}
+
+		assert.EqualError(t, bad.Load(), `bad listener "smtp"`)
+	})
+
+	t.Run("no_key", func(t *testing.T) {
+		bad := &TLSCertificate{
+			CertificatePath: c.CertificatePath,
+		}
+
+		assert.EqualError(t, bad.Load(), "certificate and private key paths must be set")
+	})
+}
+
+// fakeConn is a [net.Conn] with the local address only.
+type fakeConn struct {
+	net.Conn
+
+	laddr net.Addr
+}
+
+// LocalAddr implements the [net.Conn] interface for *fakeConn.
+func (c *fakeConn) LocalAddr() (addr net.Addr) { return c.laddr }
+
+func TestServer_onGetCertificate(t *testing.T) {
+	mainPEM, mainKey := newTestCertPEM(t, "dns.example")
+	main, err := tls.X509KeyPair(mainPEM, mainKey)
+	require.NoError(t, err)
+
+	wildcard := newTestTLSCertificate(t, nil, "*.other.example")
+	dotOnly := newTestTLSCertificate(t, []TLSListener{TLSListenerDoT}, "dot.example")
+	httpsOnly := newTestTLSCertificate(t, []TLSListener{TLSListenerHTTPS}, "web.example")
+	additional := []*TLSCertificate{wildcard, dotOnly, httpsOnly}
+
+	s := &Server{}
+	s.dotCerts, err = newTLSCerts(main, additional, TLSListenerDoT)
+	require.NoError(t, err)
+
+	s.doqCerts, err = newTLSCerts(main, additional, TLSListenerDoQ)
+	require.NoError(t, err)
+
+	quicConn := &fakeConn{laddr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 853}}
+
+	testCases := []struct {
+		conn net.Conn
+		want *tls.Certificate
+		name string
+		sni  string
+	}{{
+		conn: nil,
+		want: s.dotCerts[0].pair,
+		name: "main",
+		sni:  "dns.example",
+	}, {
+		conn: nil,
+		want: wildcard.Pair,
+		name: "wildcard",
+		sni:  "dns.other.example",
+	}, {
+		conn: nil,
+		want: dotOnly.Pair,
+		name: "dot_only",
+		sni:  "dot.example",
+	}, {
+		conn: quicConn,
+		want: s.doqCerts[0].pair,
+		name: "dot_only_on_doq",
+		sni:  "dot.example",
+	}, {
+		conn: nil,
+		want: s.dotCerts[0].pair,
+		name: "https_only_on_dot",
+		sni:  "web.example",
+	}, {
+		conn: quicConn,
+		want: wildcard.Pair,
+		name: "wildcard_on_doq",
+		sni:  "dns.other.example",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cerr := s.onGetCertificate(&tls.ClientHelloInfo{ServerName: tc.sni, Conn: tc.conn})
+			require.NoError(t, cerr)
+
+			assert.Equal(t, tc.want.Certificate, c.Certificate)
+		})
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		s.conf.StrictSNICheck = true
+		t.Cleanup(func() { s.conf.StrictSNICheck = false })
+
+		_, cerr := s.onGetCertificate(&tls.ClientHelloInfo{ServerName: "web.example"})
+		assert.Error(t, cerr)
+
+		c, cerr := s.onGetCertificate(&tls.ClientHelloInfo{ServerName: "dot.example"})
+		require.NoError(t, cerr)
+
+		assert.Equal(t, dotOnly.Pair.Certificate, c.Certificate)
+	})
+}
+
+func TestListenerCertificates(t *testing.T) {
+	main := tls.Certificate{Certificate: [][]byte{{1}}}
+	all := newTestTLSCertificate(t, nil, "all.example")
+	https := newTestTLSCertificate(t, []TLSListener{TLSListenerHTTPS}, "web.example")
+	notLoaded := &TLSCertificate{}
+
+	certs := ListenerCertificates(main, []*TLSCertificate{all, https, notLoaded}, TLSListenerHTTPS)
+	require.Len(t, certs, 3)
+
+	assert.Equal(t, main, certs[0])
+	assert.Equal(t, *all.Pair, certs[1])
+	assert.Equal(t, *https.Pair, certs[2])
+
+	certs = ListenerCertificates(main, []*TLSCertificate{all, https, notLoaded}, TLSListenerDoQ)
+	require.Len(t, certs, 2)
+}
@@ -0,0 +1,336 @@
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// upstreamDiagReq is the request body for the POST /control/test_upstream HTTP
+// API.
+type upstreamDiagReq struct {
+	// Upstream is the candidate upstream string in the same format as used in
+	// the upstream_dns setting.
+	Upstream string `json:"upstream"`
+
+	// BootstrapDNS are the bootstrap servers to resolve the upstream's
+	// hostname with.  If empty, the default ones are used.
+	BootstrapDNS []string `json:"bootstrap_dns"`
+}
+
+// upstreamDiagResp is the response body for the POST /control/test_upstream
+// HTTP API.
+type upstreamDiagResp struct {
+	// Upstream is the upstream string as it was passed in the request.
+	Upstream string `json:"upstream"`
+
+	// Address is the address of the upstream server without the
+	// domain-specific part.
+	Address string `json:"address,omitempty"`
+
+	// Protocol is the DNS protocol of the upstream, e.g. "tls" or "https".
+	Protocol string `json:"protocol,omitempty"`
+
+	// NegotiatedProtocol is the application protocol negotiated during the
+	// TLS handshake, if any, e.g. "h2" or "doq".
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+
+	// TLSVersion is the version of TLS used for the connection, if any.
+	TLSVersion string `json:"tls_version,omitempty"`
+
+	// BootstrapError is the description of the problem with bootstrapping
+	// the upstream, if any.
+	BootstrapError string `json:"bootstrap_error,omitempty"`
+
+	// Error is the description of the failure, if any.
+	Error string `json:"error,omitempty"`
+
+	// Domains are the domains for which the upstream is used, if it is
+	// domain-specific.
+	Domains []string `json:"domains,omitempty"`
+
+	// BootstrapAddrs are the addresses the upstream's hostname has been
+	// resolved into using the bootstrap servers.
+	BootstrapAddrs []string `json:"bootstrap_addresses,omitempty"`
+
+	// RTT is the round-trip time of the test request in milliseconds.
+	RTT float64 `json:"rtt_ms"`
+
+	// DNSSEC is true if the upstream returns DNSSEC signatures for signed
+	// zones.
+	DNSSEC bool `json:"dnssec"`
+
+	// OK is true if the upstream has successfully resolved the test request.
+	OK bool `json:"ok"`
+}
+
+// tlsStateRecorder stores the state of the latest TLS connection established by
+// an upstream.
+type tlsStateRecorder struct {
+	// mu protects state.
+	mu *sync.Mutex
+
+	// state is the latest connection state, if any.
+	state *tls.ConnectionState
+}
+
+// verifyConnection implements the [tls.Config.VerifyConnection] function
+// signature for *tlsStateRecorder.  It never returns an error, since the
+// certificates are verified by the upstream itself.
+func (r *tlsStateRecorder) verifyConnection(state tls.ConnectionState) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = &state
+
+	return nil
+}
+
+// connState returns the latest recorded connection state, if any.
+func (r *tlsStateRecorder) connState() (state *tls.ConnectionState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state
+}
+
+// upstreamProtocol returns the name of DNS protocol used by the upstream with
+// the address addr.
+func upstreamProtocol(addr string) (proto string) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "udp"
+	}
+
+	switch proto = addr[:i]; proto {
+	case "sdns":
+		return "dnscrypt"
+	case "h3":
+		return "https"
+	default:
+		return proto
+	}
+}
+
+// diagBootstrap resolves the hostname of the upstream with the address addr
+// using bootstrap and fills the appropriate fields of resp.  It does nothing if
+// the upstream doesn't need bootstrapping.
+func diagBootstrap(resp *upstreamDiagResp, addr string, bootstrap []string, timeout time.Duration) {
+	if !strings.Contains(addr, "://") || strings.HasPrefix(addr, "sdns://") {
+		// Plain DNS upstreams are only specified with IP addresses and the
+		// DNSCrypt stamps contain them.
+		return
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		// Don't report the error here, since the upstream creation will
+		// report it anyway.
+		return
+	}
+
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return
+	}
+
+	var errs []error
+	for _, b := range bootstrap {
+		var r *upstream.Resolver
+		r, err = upstream.NewResolver(b, &upstream.Options{Timeout: timeout})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bootstrap %q: %w", b, err))
+
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var addrs []net.IPAddr
+		addrs, err = r.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bootstrap %q: resolving %q: %w", b, host, err))
+
+			continue
+		}
+
+		for _, a := range addrs {
+			resp.BootstrapAddrs = append(resp.BootstrapAddrs, a.IP.String())
+		}
+
+		// The first working bootstrap is enough, since the upstream uses them
+		// in parallel.
+		return
+	}
+
+	if len(errs) > 0 {
+		resp.BootstrapError = errors.List("resolving upstream hostname", errs...).Error()
+	}
+}
+
+// diagDNSSEC returns true if u responds with the signatures to a request for a
+// signed zone.
+func diagDNSSEC(u upstream.Upstream) (ok bool) {
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   ".",
+			Qtype:  dns.TypeDNSKEY,
+			Qclass: dns.ClassINET,
+		}},
+	}
+	req.SetEdns0(dns.DefaultMsgSize, true)
+
+	resp, err := u.Exchange(req)
+	if err != nil {
+		log.Debug("dnsforward: checking dnssec support of %q: %s", u.Address(), err)
+
+		return false
+	}
+
+	if resp.AuthenticatedData {
+		return true
+	}
+
+	for _, rr := range resp.Answer {
+		if _, ok = rr.(*dns.RRSIG); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diagUpstream checks the upstream defined by upstreamConfigStr and returns the
+// detailed diagnostics.  It uses bootstrap to resolve the upstream's hostname.
+func diagUpstream(
+	upstreamConfigStr string,
+	bootstrap []string,
+	timeout time.Duration,
+) (resp *upstreamDiagResp) {
+	resp = &upstreamDiagResp{
+		Upstream: upstreamConfigStr,
+	}
+
+	addr, domains, err := separateUpstream(upstreamConfigStr)
+	if err != nil {
+		resp.Error = fmt.Sprintf("wrong upstream format: %s", err)
+
+		return resp
+	}
+
+	resp.Address, resp.Domains = addr, domains
+
+	useDefault, err := validateUpstream(addr, domains)
+	if err != nil {
+		resp.Error = fmt.Sprintf("wrong upstream format: %s", err)
+
+		return resp
+	} else if useDefault {
+		resp.OK = true
+
+		return resp
+	}
+
+	resp.Protocol = upstreamProtocol(addr)
+
+	if len(bootstrap) == 0 {
+		bootstrap = defaultBootstrap
+	}
+
+	diagBootstrap(resp, addr, bootstrap, timeout)
+
+	rec := &tlsStateRecorder{mu: &sync.Mutex{}}
+	u, err := upstream.AddressToUpstream(addr, &upstream.Options{
+		Bootstrap:        bootstrap,
+		Timeout:          timeout,
+		VerifyConnection: rec.verifyConnection,
+	})
+	if err != nil {
+		resp.Error = fmt.Sprintf("failed to choose upstream for %q: %s", addr, err)
+
+		return resp
+	}
+	defer func() {
+		cerr := u.Close()
+		if cerr != nil {
+			log.Debug("dnsforward: closing upstream %q: %s", addr, cerr)
+		}
+	}()
+
+	start := time.Now()
+	err = checkDNSUpstreamExc(u)
+	resp.RTT = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		resp.Error = fmt.Sprintf("upstream %q fails to exchange: %s", addr, err)
+
+		return resp
+	}
+
+	resp.OK = true
+	if state := rec.connState(); state != nil {
+		resp.NegotiatedProtocol = state.NegotiatedProtocol
+		resp.TLSVersion = tlsVersionString(state.Version)
+	}
+
+	resp.DNSSEC = diagDNSSEC(u)
+
+	return resp
+}
+
+// tlsVersionString returns the human-readable name of the TLS version v.
+func tlsVersionString(v uint16) (s string) {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// handleTestUpstream handles requests to the POST /control/test_upstream
+// endpoint.
+func (s *Server) handleTestUpstream(w http.ResponseWriter, r *http.Request) {
+	req := &upstreamDiagReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	if IsCommentOrEmpty(req.Upstream) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "upstream: empty value")
+
+		return
+	}
+
+	s.serverLock.RLock()
+	timeout := s.conf.UpstreamTimeout
+	s.serverLock.RUnlock()
+
+	resp := diagUpstream(req.Upstream, req.BootstrapDNS, timeout)
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
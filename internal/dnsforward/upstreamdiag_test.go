@@ -0,0 +1,83 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamProtocol(t *testing.T) {
+	testCases := []struct {
+		addr string
+		want string
+	}{{
+		addr: "1.1.1.1",
+		want: "udp",
+	}, {
+		addr: "1.1.1.1:53",
+		want: "udp",
+	}, {
+		addr: "tcp://1.1.1.1",
+		want: "tcp",
+	}, {
+		addr: "tls://dns.adguard.com",
+		want: "tls",
+	}, {
+		addr: "https://dns.adguard.com/dns-query",
+		want: "https",
+	}, {
+		addr: "h3://dns.google/dns-query",
+		want: "https",
+	}, {
+		addr: "quic://dns.adguard.com",
+		want: "quic",
+	}, {
+		addr: "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
+		want: "dnscrypt",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			assert.Equal(t, tc.want, upstreamProtocol(tc.addr))
+		})
+	}
+}
+
+func TestDiagUpstream_invalid(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	testCases := []struct {
+		name    string
+		ups     string
+		wantErr string
+		wantOK  bool
+	}{{
+		name:    "bad_proto",
+		ups:     "asdf://1.1.1.1",
+		wantErr: "wrong upstream format: wrong protocol",
+		wantOK:  false,
+	}, {
+		name: "no_separator",
+		ups:  "[/host.com]tls://dns.adguard.com",
+		wantErr: `wrong upstream format: bad upstream for domain ` +
+			`"[/host.com]tls://dns.adguard.com": missing separator`,
+		wantOK: false,
+	}, {
+		name:    "default",
+		ups:     "[/example.org/]#",
+		wantErr: "",
+		wantOK:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := diagUpstream(tc.ups, nil, timeout)
+
+			assert.Equal(t, tc.ups, resp.Upstream)
+			assert.Equal(t, tc.wantErr, resp.Error)
+			assert.Equal(t, tc.wantOK, resp.OK)
+			assert.Zero(t, resp.RTT)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package dnsforward
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// maxUpstreamEvents is the maximum number of upstream state transitions kept
+// in memory.
+const maxUpstreamEvents = 1000
+
+// upstreamDownThreshold is the number of consecutive failed exchanges, after
+// which the upstream is considered down.  A single successful exchange makes it
+// up again.
+const upstreamDownThreshold = 3
+
+// upstreamState is the state of an upstream.
+type upstreamState string
+
+// upstreamState values.
+const (
+	upstreamStateUp   upstreamState = "up"
+	upstreamStateDown upstreamState = "down"
+
+	// upstreamStateTLSFailed means that the certificate of the upstream
+	// doesn't comply with its TLS policy.  The upstream is considered to
+	// comply again after the next successful verification.
+	upstreamStateTLSFailed upstreamState = "tls_failed"
+)
+
+// upstreamEvent is a transition of an upstream between the states.
+type upstreamEvent struct {
+	Time     time.Time     `json:"time"`
+	Upstream string        `json:"upstream"`
+	State    upstreamState `json:"state"`
+
+	// Error is the error of the latest failed exchange, which has made the
+	// upstream down, or the error of the failed verification of its
+	// certificate.  It's empty for the transitions to upstreamStateUp.
+	Error string `json:"error,omitempty"`
+
+	// Failures is the number of the consecutive failed exchanges before the
+	// transition.
+	Failures int `json:"failures"`
+}
+
+// upstreamHealth is the tracked health of a single upstream.
+type upstreamHealth struct {
+	// failures is the number of the consecutive failed exchanges.
+	failures int
+
+	// down is true if the upstream is considered down.
+	down bool
+
+	// tlsFailed is true if the latest verification of the certificate of the
+	// upstream has failed.
+	tlsFailed bool
+}
+
+// upstreamEvents tracks the states of the upstreams and keeps the bounded list
+// of the recent transitions between them.  The zero value is ready for use.
+type upstreamEvents struct {
+	mu     sync.Mutex
+	health map[string]*upstreamHealth
+	events []*upstreamEvent
+}
+
+// report updates the state of the upstream with addr according to the result of
+// its exchange and records the transition, if any.
+func (ue *upstreamEvents) report(addr string, err error) {
+	ue.mu.Lock()
+	defer ue.mu.Unlock()
+
+	h := ue.healthLocked(addr)
+	if err != nil {
+		h.failures++
+		if h.down || h.failures < upstreamDownThreshold {
+			return
+		}
+
+		h.down = true
+		log.Info("dns: upstream %s is down after %d failures: %s", addr, h.failures, err)
+		ue.addLocked(&upstreamEvent{
+			Time:     time.Now(),
+			Upstream: addr,
+			State:    upstreamStateDown,
+			Error:    err.Error(),
+			Failures: h.failures,
+		})
+
+		return
+	}
+
+	failures := h.failures
+	h.failures = 0
+	if !h.down {
+		return
+	}
+
+	h.down = false
+	log.Info("dns: upstream %s is up again", addr)
+	ue.addLocked(&upstreamEvent{
+		Time:     time.Now(),
+		Upstream: addr,
+		State:    upstreamStateUp,
+		Failures: failures,
+	})
+}
+
+// reportTLS updates the state of the upstream with addr according to the result
+// of the verification of its certificate and records the first failure, if
+// any.
+func (ue *upstreamEvents) reportTLS(addr string, err error) {
+	ue.mu.Lock()
+	defer ue.mu.Unlock()
+
+	h := ue.healthLocked(addr)
+	if err == nil {
+		h.tlsFailed = false
+
+		return
+	} else if h.tlsFailed {
+		return
+	}
+
+	h.tlsFailed = true
+	log.Info("dns: warning: upstream %s failed tls verification: %s", addr, err)
+	ue.addLocked(&upstreamEvent{
+		Time:     time.Now(),
+		Upstream: addr,
+		State:    upstreamStateTLSFailed,
+		Error:    err.Error(),
+		Failures: h.failures,
+	})
+}
+
+// healthLocked returns the tracked health of the upstream with addr, creating
+// it if necessary.  ue.mu is expected to be locked.
+func (ue *upstreamEvents) healthLocked(addr string) (h *upstreamHealth) {
+	if ue.health == nil {
+		ue.health = map[string]*upstreamHealth{}
+	}
+
+	h, ok := ue.health[addr]
+	if !ok {
+		h = &upstreamHealth{}
+		ue.health[addr] = h
+	}
+
+	return h
+}
+
+// addLocked records e, dropping the oldest event if the list is full.  ue.mu
+// is expected to be locked.
+func (ue *upstreamEvents) addLocked(e *upstreamEvent) {
+	if len(ue.events) == maxUpstreamEvents {
+		copy(ue.events, ue.events[1:])
+		ue.events = ue.events[:maxUpstreamEvents-1]
+	}
+
+	ue.events = append(ue.events, e)
+}
+
+// list returns the recorded events, the newest first.
+func (ue *upstreamEvents) list() (events []*upstreamEvent) {
+	ue.mu.Lock()
+	defer ue.mu.Unlock()
+
+	events = make([]*upstreamEvent, 0, len(ue.events))
+	for i := len(ue.events) - 1; i >= 0; i-- {
+		events = append(events, ue.events[i])
+	}
+
+	return events
+}
+
+// monitoredUpstream is an upstream reporting the results of its exchanges to
+// track its state and to collect its statistics.
+type monitoredUpstream struct {
+	upstream.Upstream
+
+	// events tracks the state of the upstream.
+	events *upstreamEvents
+
+	// stats collects the statistics of the upstream.
+	stats *upstreamStats
+}
+
+// type check
+var _ upstream.Upstream = (*monitoredUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for
+// *monitoredUpstream.
+func (u *monitoredUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.Upstream.Exchange(m)
+	u.events.report(u.Address(), err)
+	u.stats.report(u.Address(), err)
+
+	return resp, err
+}
+
+// monitorUpstreams returns ups wrapped to track their states.  The upstreams
+// with TLS policies are replaced with the ones verifying their certificates
+// according to the policies.
+func (s *Server) monitorUpstreams(ups []upstream.Upstream) (monitored []upstream.Upstream) {
+	if len(ups) == 0 {
+		return ups
+	}
+
+	monitored = make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		if pu, ok := s.conf.policyUpstreams[u.Address()]; ok {
+			// Close the replaced upstream, since it's not used anymore.
+			if err := u.Close(); err != nil {
+				log.Debug("dns: closing upstream %s replaced by tls policy: %s", u.Address(), err)
+			}
+
+			u = pu
+		}
+
+		monitored = append(monitored, &monitoredUpstream{
+			Upstream: u,
+			events:   &s.upsEvents,
+			stats:    &s.upsStats,
+		})
+	}
+
+	return monitored
+}
+
+// monitorUpstreamConfig wraps the general and the domain-specific upstreams of
+// uc to track their states.
+func (s *Server) monitorUpstreamConfig(uc *proxy.UpstreamConfig) {
+	uc.Upstreams = s.monitorUpstreams(uc.Upstreams)
+	for d, ups := range uc.DomainReservedUpstreams {
+		uc.DomainReservedUpstreams[d] = s.monitorUpstreams(ups)
+	}
+
+	for d, ups := range uc.SpecifiedDomainUpstreams {
+		uc.SpecifiedDomainUpstreams[d] = s.monitorUpstreams(ups)
+	}
+}
+
+// handleUpstreamsEvents handles requests to the GET /control/upstreams_events
+// endpoint.
+func (s *Server) handleUpstreamsEvents(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, s.upsEvents.list())
+}
@@ -0,0 +1,93 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_monitorUpstreams(t *testing.T) {
+	const (
+		addr   = "upstream.example:53"
+		errMsg = "test error"
+	)
+
+	var fail bool
+	ups := &aghtest.UpstreamMock{
+		OnAddress: func() (a string) { return addr },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if fail {
+				return nil, errors.Error(errMsg)
+			}
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+	}
+
+	s := &Server{}
+	u := s.monitorUpstreams([]upstream.Upstream{ups})[0]
+	req := createTestMessage("example.org.")
+
+	exchange := func(t *testing.T, n int, f bool) {
+		t.Helper()
+
+		fail = f
+		for i := 0; i < n; i++ {
+			_, _ = u.Exchange(req)
+		}
+	}
+
+	exchange(t, upstreamDownThreshold-1, true)
+	exchange(t, 1, false)
+	assert.Empty(t, s.upsEvents.list(), "failures below the threshold")
+
+	exchange(t, upstreamDownThreshold+1, true)
+	events := s.upsEvents.list()
+	require.Len(t, events, 1)
+
+	assert.Equal(t, addr, events[0].Upstream)
+	assert.Equal(t, upstreamStateDown, events[0].State)
+	assert.Equal(t, errMsg, events[0].Error)
+	assert.Equal(t, upstreamDownThreshold, events[0].Failures)
+
+	exchange(t, 2, false)
+	events = s.upsEvents.list()
+	require.Len(t, events, 2)
+
+	// The newest event is the first one.
+	assert.Equal(t, upstreamStateUp, events[0].State)
+	assert.Empty(t, events[0].Error)
+	assert.Equal(t, upstreamDownThreshold+1, events[0].Failures)
+
+	w := httptest.NewRecorder()
+	s.handleUpstreamsEvents(w, httptest.NewRequest(http.MethodGet, "/control/upstreams_events", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var got []*upstreamEvent
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Len(t, got, 2)
+
+	assert.Equal(t, upstreamStateUp, got[0].State)
+	assert.Equal(t, upstreamStateDown, got[1].State)
+}
+
+func TestUpstreamEvents_bounded(t *testing.T) {
+	ue := &upstreamEvents{}
+	for i := 0; i < maxUpstreamEvents+1; i++ {
+		ue.addLocked(&upstreamEvent{Failures: i})
+	}
+
+	events := ue.list()
+	require.Len(t, events, maxUpstreamEvents)
+
+	assert.Equal(t, maxUpstreamEvents, events[0].Failures)
+	assert.Equal(t, 1, events[len(events)-1].Failures)
+}
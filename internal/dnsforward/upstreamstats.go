@@ -0,0 +1,167 @@
+package dnsforward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// upstreamCounters are the statistics of the exchanges with a single upstream.
+type upstreamCounters struct {
+	// queries is the number of the exchanges.
+	queries uint64
+
+	// failures is the number of the failed exchanges, including timeouts.
+	failures uint64
+
+	// timeouts is the number of the exchanges failed due to a timeout.
+	timeouts uint64
+}
+
+// upstreamStats collects the statistics of the exchanges with each upstream
+// since the start.  The zero value is ready for use.
+type upstreamStats struct {
+	mu  sync.Mutex
+	ups map[string]*upstreamCounters
+}
+
+// isTimeout returns true if err is caused by a timeout.
+func isTimeout(err error) (ok bool) {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// report records the exchange with the upstream with addr, which finished with
+// err.
+func (us *upstreamStats) report(addr string, err error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.ups == nil {
+		us.ups = map[string]*upstreamCounters{}
+	}
+
+	c, ok := us.ups[addr]
+	if !ok {
+		c = &upstreamCounters{}
+		us.ups[addr] = c
+	}
+
+	c.queries++
+	if err == nil {
+		return
+	}
+
+	c.failures++
+	if isTimeout(err) {
+		c.timeouts++
+	}
+}
+
+// upstreamStatsEntry is the statistics of a single upstream.
+type upstreamStatsEntry struct {
+	// Upstream is the address of the upstream.
+	Upstream string `json:"upstream"`
+
+	// LatencyBuckets are the numbers of the requests resolved by the upstream,
+	// which took no longer than the corresponding element of
+	// upstreamsStatsResp.LatencyBounds to process.  The last element is the
+	// number of the requests, which took longer than all of the bounds.
+	LatencyBuckets []uint64 `json:"latency_buckets"`
+
+	// NumQueries is the number of the exchanges with the upstream.
+	NumQueries uint64 `json:"num_queries"`
+
+	// NumFailures is the number of the failed exchanges, including timeouts.
+	NumFailures uint64 `json:"num_failures"`
+
+	// NumTimeouts is the number of the exchanges failed due to a timeout.
+	NumTimeouts uint64 `json:"num_timeouts"`
+
+	// ErrorRate is the ratio of the failed exchanges to all of them.
+	ErrorRate float64 `json:"error_rate"`
+
+	// AvgLatency is the average processing time of the requests resolved by
+	// the upstream in seconds.
+	AvgLatency float64 `json:"avg_latency"`
+}
+
+// upstreamsStatsResp is the response to the GET /control/stats_upstreams.
+type upstreamsStatsResp struct {
+	// LatencyBounds are the upper bounds of the latency buckets in seconds.
+	LatencyBounds []float64 `json:"latency_bounds"`
+
+	// Upstreams are the statistics of each upstream sorted by its address.
+	Upstreams []*upstreamStatsEntry `json:"upstreams"`
+}
+
+// resp returns the statistics of the upstreams.  The latency distributions
+// are taken from lat, which is the processing time statistics collected by
+// the statistics module, if any.
+func (us *upstreamStats) resp(lat *stats.LatencyResp) (resp *upstreamsStatsResp) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	resp = &upstreamsStatsResp{
+		LatencyBounds: []float64{},
+		Upstreams:     make([]*upstreamStatsEntry, 0, len(us.ups)),
+	}
+
+	upsLat := map[string]*stats.LatencyStats{}
+	if lat != nil {
+		resp.LatencyBounds = lat.BucketBounds
+		for _, ls := range lat.Upstreams {
+			upsLat[ls.Upstream] = ls
+		}
+	}
+
+	addrs := maps.Keys(us.ups)
+	slices.Sort(addrs)
+	for _, addr := range addrs {
+		c := us.ups[addr]
+		e := &upstreamStatsEntry{
+			Upstream:       addr,
+			LatencyBuckets: []uint64{},
+			NumQueries:     c.queries,
+			NumFailures:    c.failures,
+			NumTimeouts:    c.timeouts,
+		}
+
+		if c.queries > 0 {
+			e.ErrorRate = float64(c.failures) / float64(c.queries)
+		}
+
+		if ls, ok := upsLat[addr]; ok {
+			e.LatencyBuckets = ls.Buckets
+			e.AvgLatency = ls.AvgTime
+		}
+
+		resp.Upstreams = append(resp.Upstreams, e)
+	}
+
+	return resp
+}
+
+// handleStatsUpstreams handles requests to the GET /control/stats_upstreams
+// endpoint.
+func (s *Server) handleStatsUpstreams(w http.ResponseWriter, r *http.Request) {
+	var lat *stats.LatencyResp
+	if s.stats != nil {
+		lat = s.stats.Latency()
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, s.upsStats.resp(lat))
+}
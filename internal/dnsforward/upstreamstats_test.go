@@ -0,0 +1,135 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTimeout(t *testing.T) {
+	testCases := []struct {
+		err  error
+		name string
+		want bool
+	}{{
+		err:  os.ErrDeadlineExceeded,
+		name: "deadline",
+		want: true,
+	}, {
+		err:  fmt.Errorf("exchanging: %w", os.ErrDeadlineExceeded),
+		name: "wrapped",
+		want: true,
+	}, {
+		err:  errors.Error("test error"),
+		name: "other",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isTimeout(tc.err))
+		})
+	}
+}
+
+func TestUpstreamStats(t *testing.T) {
+	const (
+		addrFast = "fast.example:53"
+		addrSlow = "slow.example:53"
+	)
+
+	us := &upstreamStats{}
+	us.report(addrSlow, os.ErrDeadlineExceeded)
+	us.report(addrSlow, errors.Error("test error"))
+	us.report(addrFast, nil)
+	us.report(addrFast, nil)
+
+	lat := &stats.LatencyResp{
+		BucketBounds: []float64{0.001, 0.01},
+		Upstreams: []*stats.LatencyStats{{
+			Upstream: addrFast,
+			Buckets:  []uint64{1, 1, 0},
+			Count:    2,
+			AvgTime:  0.002,
+		}},
+	}
+
+	resp := us.resp(lat)
+	assert.Equal(t, lat.BucketBounds, resp.LatencyBounds)
+	require.Len(t, resp.Upstreams, 2)
+
+	fast := resp.Upstreams[0]
+	assert.Equal(t, addrFast, fast.Upstream)
+	assert.Equal(t, uint64(2), fast.NumQueries)
+	assert.Zero(t, fast.NumFailures)
+	assert.Zero(t, fast.ErrorRate)
+	assert.InDelta(t, 0.002, fast.AvgLatency, 1e-9)
+	assert.Equal(t, []uint64{1, 1, 0}, fast.LatencyBuckets)
+
+	// The failed exchanges don't resolve any requests, so there is no
+	// latency distribution.
+	slow := resp.Upstreams[1]
+	assert.Equal(t, addrSlow, slow.Upstream)
+	assert.Equal(t, uint64(2), slow.NumQueries)
+	assert.Equal(t, uint64(2), slow.NumFailures)
+	assert.Equal(t, uint64(1), slow.NumTimeouts)
+	assert.Equal(t, 1.0, slow.ErrorRate)
+	assert.Zero(t, slow.AvgLatency)
+	assert.Empty(t, slow.LatencyBuckets)
+}
+
+func TestServer_handleStatsUpstreams(t *testing.T) {
+	const addr = "upstream.example:53"
+
+	ups := &aghtest.UpstreamMock{
+		OnAddress: func() (a string) { return addr },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+	}
+
+	s := &Server{
+		stats: &testStats{
+			latency: &stats.LatencyResp{
+				BucketBounds: []float64{0.001},
+				Upstreams: []*stats.LatencyStats{{
+					Upstream: addr,
+					Buckets:  []uint64{0, 1},
+					Count:    1,
+					AvgTime:  0.002,
+				}},
+			},
+		},
+	}
+	u := s.monitorUpstreams([]upstream.Upstream{ups})[0]
+
+	_, err := u.Exchange(createTestMessage("example.org."))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.handleStatsUpstreams(w, httptest.NewRequest(http.MethodGet, "/control/stats_upstreams", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &upstreamsStatsResp{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	require.Len(t, resp.Upstreams, 1)
+
+	assert.Equal(t, []float64{0.001}, resp.LatencyBounds)
+	assert.Equal(t, addr, resp.Upstreams[0].Upstream)
+	assert.Equal(t, uint64(1), resp.Upstreams[0].NumQueries)
+	assert.Zero(t, resp.Upstreams[0].NumFailures)
+	assert.Equal(t, []uint64{0, 1}, resp.Upstreams[0].LatencyBuckets)
+}
@@ -0,0 +1,266 @@
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// UpstreamTLSPolicy is the policy of verifying the certificate of an encrypted
+// upstream, for example:
+//
+//	upstream: 'tls://192.168.1.2'
+//	server_name: 'dns.lab.example'
+//	spki_pins: ['47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=']
+//
+// The policy replaces the default verification of the upstream's certificate
+// against its hostname.
+type UpstreamTLSPolicy struct {
+	// Upstream is the address of the upstream as written in the upstreams
+	// configuration.  It must be a DNS-over-TLS, DNS-over-HTTPS, or
+	// DNS-over-QUIC one.
+	Upstream string `yaml:"upstream"`
+
+	// ServerName is the hostname, for which the certificate must be valid.  If
+	// empty, the hostname of the upstream is used.
+	ServerName string `yaml:"server_name"`
+
+	// SPKIPins are the base64-encoded SHA-256 hashes of the subject public key
+	// info, one of which must match a certificate in the chain.  If empty, the
+	// keys aren't pinned.
+	SPKIPins []string `yaml:"spki_pins"`
+
+	// AllowSelfSigned disables verifying the chain of the certificate, so that
+	// self-signed certificates are accepted.  The hostname is still verified,
+	// as well as the pins, if set.  It should only be used for the resolvers
+	// in a lab.
+	AllowSelfSigned bool `yaml:"allow_self_signed"`
+}
+
+// tlsSchemes are the schemes of the upstreams, which support TLS policies.
+var tlsSchemes = []string{"tls://", "https://", "quic://", "h3://"}
+
+// tlsVerifier verifies the certificates of an upstream according to its
+// policy.
+type tlsVerifier struct {
+	// roots are the root certificates used to verify the chain.  If nil, the
+	// system ones are used.
+	roots *x509.CertPool
+
+	// serverName is the required hostname.  It's the hostname of the upstream,
+	// unless the policy sets another one.
+	serverName string
+
+	// pins are the decoded SPKI pins.
+	pins [][]byte
+
+	// allowSelfSigned is true if the chain isn't verified.
+	allowSelfSigned bool
+}
+
+// newTLSVerifier validates p and returns the verifier for it.
+func newTLSVerifier(p *UpstreamTLSPolicy, roots *x509.CertPool) (v *tlsVerifier, err error) {
+	if !hasTLSScheme(p.Upstream) {
+		return nil, fmt.Errorf("upstream %q: not an encrypted upstream", p.Upstream)
+	}
+
+	v = &tlsVerifier{
+		roots:           roots,
+		serverName:      p.ServerName,
+		pins:            make([][]byte, 0, len(p.SPKIPins)),
+		allowSelfSigned: p.AllowSelfSigned,
+	}
+
+	if v.serverName == "" {
+		// Never skip verifying the hostname, since otherwise any certificate
+		// would be accepted with allow_self_signed and no pins.
+		v.serverName, err = upstreamHostname(p.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", p.Upstream, err)
+		}
+	}
+
+	for i, pin := range p.SPKIPins {
+		var hash []byte
+		hash, err = base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: pin at index %d: %w", p.Upstream, i, err)
+		} else if len(hash) != sha256.Size {
+			return nil, fmt.Errorf(
+				"upstream %q: pin at index %d: bad length %d, want %d",
+				p.Upstream,
+				i,
+				len(hash),
+				sha256.Size,
+			)
+		}
+
+		v.pins = append(v.pins, hash)
+	}
+
+	return v, nil
+}
+
+// hasTLSScheme returns true if addr is an address of an encrypted upstream.
+func hasTLSScheme(addr string) (ok bool) {
+	for _, s := range tlsSchemes {
+		if strings.HasPrefix(addr, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamHostname returns the hostname or the IP address of the encrypted
+// upstream with addr.
+func upstreamHostname(addr string) (host string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("parsing address: %w", err)
+	}
+
+	host = u.Hostname()
+	if host == "" {
+		return "", errors.Error("no hostname")
+	}
+
+	return host, nil
+}
+
+// verify verifies the certificates from state.  It's used as the
+// VerifyConnection callback of the TLS configuration.
+func (v *tlsVerifier) verify(state tls.ConnectionState) (err error) {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return errors.Error("no certificates")
+	}
+
+	if v.allowSelfSigned {
+		err = certs[0].VerifyHostname(v.serverName)
+	} else {
+		err = v.verifyChain(certs)
+	}
+
+	if err != nil {
+		return fmt.Errorf("verifying certificate: %w", err)
+	}
+
+	if len(v.pins) == 0 {
+		return nil
+	}
+
+	for _, c := range certs {
+		hash := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		for _, pin := range v.pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	return errors.Error("no certificate matches the spki pins")
+}
+
+// verifyChain verifies the chain of certs against v.roots and v.serverName.
+func (v *tlsVerifier) verifyChain(certs []*x509.Certificate) (err error) {
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		DNSName:       v.serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	_, err = certs[0].Verify(opts)
+
+	return err
+}
+
+// newPolicyUpstreams returns the upstreams created from policies with opts by
+// their addresses.  The failures of the verification are reported to ue.
+func newPolicyUpstreams(
+	policies []*UpstreamTLSPolicy,
+	opts *upstream.Options,
+	ue *upstreamEvents,
+) (ups map[string]upstream.Upstream, err error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	ups = make(map[string]upstream.Upstream, len(policies))
+	for i, p := range policies {
+		if p == nil {
+			return nil, fmt.Errorf("policy at index %d: no value", i)
+		}
+
+		var u upstream.Upstream
+		u, err = newPolicyUpstream(p, opts, ue)
+		if err != nil {
+			return nil, fmt.Errorf("policy at index %d: %w", i, err)
+		}
+
+		addr := u.Address()
+		if _, ok := ups[addr]; ok {
+			return nil, fmt.Errorf("policy at index %d: duplicate upstream %q", i, addr)
+		}
+
+		ups[addr] = u
+	}
+
+	return ups, nil
+}
+
+// newPolicyUpstream creates an upstream verifying its certificates according
+// to p.
+func newPolicyUpstream(
+	p *UpstreamTLSPolicy,
+	opts *upstream.Options,
+	ue *upstreamEvents,
+) (u upstream.Upstream, err error) {
+	v, err := newTLSVerifier(p, upstream.RootCAs)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.allowSelfSigned {
+		log.Info(
+			"dns: warning: upstream %s: certificate chain isn't verified, "+
+				"allow_self_signed must only be used for testing",
+			p.Upstream,
+		)
+	}
+
+	// addr is set right after the upstream is created, before any exchange.
+	var addr string
+	policyOpts := *opts
+
+	// The certificate is fully verified by v, including the hostname.
+	policyOpts.InsecureSkipVerify = true
+	policyOpts.VerifyConnection = func(state tls.ConnectionState) (verr error) {
+		verr = v.verify(state)
+		ue.reportTLS(addr, verr)
+
+		return verr
+	}
+
+	u, err = upstream.AddressToUpstream(p.Upstream, &policyOpts)
+	if err != nil {
+		return nil, fmt.Errorf("creating upstream %q: %w", p.Upstream, err)
+	}
+
+	addr = u.Address()
+
+	return u, nil
+}
@@ -0,0 +1,250 @@
+package dnsforward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSVerifier(t *testing.T) {
+	testCases := []struct {
+		policy     *UpstreamTLSPolicy
+		name       string
+		wantErrMsg string
+	}{{
+		policy: &UpstreamTLSPolicy{
+			Upstream: "tls://dns.example",
+			SPKIPins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		policy: &UpstreamTLSPolicy{
+			Upstream: "8.8.8.8",
+		},
+		name:       "plain",
+		wantErrMsg: `upstream "8.8.8.8": not an encrypted upstream`,
+	}, {
+		policy: &UpstreamTLSPolicy{
+			Upstream: "https://dns.example/dns-query",
+			SPKIPins: []string{"AAAA"},
+		},
+		name: "short_pin",
+		wantErrMsg: `upstream "https://dns.example/dns-query": pin at index 0: ` +
+			`bad length 3, want 32`,
+	}, {
+		policy: &UpstreamTLSPolicy{
+			Upstream: "quic://dns.example",
+			SPKIPins: []string{"!"},
+		},
+		name: "bad_pin",
+		wantErrMsg: `upstream "quic://dns.example": pin at index 0: ` +
+			`illegal base64 data at input byte 0`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newTLSVerifier(tc.policy, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestTLSVerifier_verify(t *testing.T) {
+	const name = "dns.lab.example"
+
+	certPEM, _ := newTestCertPEM(t, name)
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	state := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	testCases := []struct {
+		roots    *x509.CertPool
+		policy   *UpstreamTLSPolicy
+		name     string
+		upstream string
+		wantErr  bool
+	}{{
+		roots: roots,
+		policy: &UpstreamTLSPolicy{
+			ServerName: name,
+		},
+		name:     "server_name",
+		upstream: "tls://192.168.1.2",
+		wantErr:  false,
+	}, {
+		roots: roots,
+		policy: &UpstreamTLSPolicy{
+			ServerName: "other.example",
+		},
+		name:     "server_name_mismatch",
+		upstream: "tls://192.168.1.2",
+		wantErr:  true,
+	}, {
+		roots:    roots,
+		policy:   &UpstreamTLSPolicy{},
+		name:     "upstream_hostname",
+		upstream: "tls://" + name,
+		wantErr:  false,
+	}, {
+		roots: nil,
+		policy: &UpstreamTLSPolicy{
+			ServerName: name,
+		},
+		name:     "unknown_authority",
+		upstream: "tls://192.168.1.2",
+		wantErr:  true,
+	}, {
+		roots: nil,
+		policy: &UpstreamTLSPolicy{
+			ServerName:      name,
+			AllowSelfSigned: true,
+		},
+		name:     "self_signed",
+		upstream: "tls://192.168.1.2",
+		wantErr:  false,
+	}, {
+		roots: nil,
+		policy: &UpstreamTLSPolicy{
+			AllowSelfSigned: true,
+		},
+		name:     "self_signed_upstream_hostname",
+		upstream: "https://" + name + "/dns-query",
+		wantErr:  false,
+	}, {
+		roots: nil,
+		policy: &UpstreamTLSPolicy{
+			AllowSelfSigned: true,
+		},
+		name:     "self_signed_hostname_mismatch",
+		upstream: "tls://192.168.1.2",
+		wantErr:  true,
+	}, {
+		roots: roots,
+		policy: &UpstreamTLSPolicy{
+			SPKIPins: []string{otherPin, pin},
+		},
+		name:     "pin",
+		upstream: "tls://" + name,
+		wantErr:  false,
+	}, {
+		roots: nil,
+		policy: &UpstreamTLSPolicy{
+			SPKIPins:        []string{otherPin},
+			AllowSelfSigned: true,
+		},
+		name:     "pin_mismatch",
+		upstream: "tls://" + name,
+		wantErr:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.policy.Upstream = tc.upstream
+
+			v, vErr := newTLSVerifier(tc.policy, tc.roots)
+			require.NoError(t, vErr)
+
+			vErr = v.verify(state)
+			if tc.wantErr {
+				assert.Error(t, vErr)
+			} else {
+				assert.NoError(t, vErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamEvents_reportTLS(t *testing.T) {
+	const addr = "tls://192.168.1.2:853"
+
+	ue := &upstreamEvents{}
+	verifyErr := errors.Error("no certificate matches the spki pins")
+
+	ue.reportTLS(addr, verifyErr)
+	ue.reportTLS(addr, verifyErr)
+
+	events := ue.list()
+	require.Len(t, events, 1)
+
+	assert.Equal(t, addr, events[0].Upstream)
+	assert.Equal(t, upstreamStateTLSFailed, events[0].State)
+	assert.Equal(t, verifyErr.Error(), events[0].Error)
+
+	ue.reportTLS(addr, nil)
+	ue.reportTLS(addr, verifyErr)
+
+	assert.Len(t, ue.list(), 2)
+}
+
+func TestServer_monitorUpstreams_policy(t *testing.T) {
+	const addr = "tls://192.168.1.2"
+
+	opts := &upstream.Options{}
+	s := &Server{}
+
+	var err error
+	s.conf.policyUpstreams, err = newPolicyUpstreams([]*UpstreamTLSPolicy{{
+		Upstream:        addr,
+		AllowSelfSigned: true,
+	}}, opts, &s.upsEvents)
+	require.NoError(t, err)
+
+	pu, err := upstream.AddressToUpstream(addr, opts)
+	require.NoError(t, err)
+
+	closed := false
+	u := &aghtest.UpstreamMock{
+		OnAddress: pu.Address,
+		OnClose: func() (err error) {
+			closed = true
+
+			return nil
+		},
+	}
+
+	monitored := s.monitorUpstreams([]upstream.Upstream{u})
+	require.Len(t, monitored, 1)
+
+	mu, ok := monitored[0].(*monitoredUpstream)
+	require.True(t, ok)
+
+	assert.Same(t, s.conf.policyUpstreams[u.Address()], mu.Upstream)
+	assert.True(t, closed)
+
+	t.Run("duplicate", func(t *testing.T) {
+		_, err = newPolicyUpstreams([]*UpstreamTLSPolicy{{
+			Upstream: addr,
+		}, {
+			Upstream: addr + ":853",
+		}}, opts, &s.upsEvents)
+		testutil.AssertErrorMsg(
+			t,
+			`policy at index 1: duplicate upstream "tls://192.168.1.2:853"`,
+			err,
+		)
+	})
+}
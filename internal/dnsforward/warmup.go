@@ -0,0 +1,118 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// warmUpRPS is the maximum number of requests per second sent to upstreams
+// during the cache warm-up.
+const warmUpRPS = 10
+
+// errNotRunning is returned when the server has been stopped.
+const errNotRunning errors.Error = "server is not running"
+
+// WarmUpCache starts resolving domains in the background to put the responses
+// into the cache, so that the first requests after the start are answered
+// quickly.  It does nothing if the cache or the warm-up is disabled.
+func (s *Server) WarmUpCache(domains []string) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if !s.conf.CacheWarmUp || s.conf.CacheSize == 0 || len(domains) == 0 {
+		return
+	}
+
+	qtypes := []uint16{dns.TypeA}
+	if !s.conf.AAAADisabled {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+
+	go s.warmUpCache(s.filterWarmUpDomains(domains), qtypes)
+}
+
+// filterWarmUpDomains returns the domains which should be resolved using the
+// upstreams, skipping the locally-served ones.
+func (s *Server) filterWarmUpDomains(domains []string) (filtered []string) {
+	filtered = make([]string, 0, len(domains))
+	for _, d := range domains {
+		if d == "" ||
+			strings.HasSuffix(d, ".in-addr.arpa") ||
+			strings.HasSuffix(d, ".ip6.arpa") ||
+			strings.HasSuffix(d, "."+s.localDomainSuffix) {
+			continue
+		}
+
+		filtered = append(filtered, d)
+	}
+
+	return filtered
+}
+
+// warmUpCache resolves each of domains with each of qtypes with a rate limit.
+// It stops once the server is stopped.
+func (s *Server) warmUpCache(domains []string, qtypes []uint16) {
+	defer log.OnPanic("dnsforward: warming up cache")
+
+	log.Info("dnsforward: warming up cache with %d domains", len(domains))
+
+	t := time.NewTicker(time.Second / warmUpRPS)
+	defer t.Stop()
+
+	start := time.Now()
+	var failed int
+	for _, d := range domains {
+		for _, qt := range qtypes {
+			<-t.C
+
+			err := s.warmUp(d, qt)
+			if errors.Is(err, errNotRunning) {
+				log.Info("dnsforward: cache warm-up interrupted: %s", err)
+
+				return
+			} else if err != nil {
+				log.Debug("dnsforward: warming up %s %s: %s", dns.Type(qt), d, err)
+				failed++
+			}
+		}
+	}
+
+	log.Info(
+		"dnsforward: cache warm-up finished in %s, %d requests failed",
+		time.Since(start),
+		failed,
+	)
+}
+
+// warmUp resolves the host with qtype through the proxy's cache.  The request
+// isn't filtered and doesn't appear in the query log and statistics.
+func (s *Server) warmUp(host string, qtype uint16) (err error) {
+	// Don't hold the lock while resolving, since that may take up to the
+	// upstream timeout and would block the reconfiguration meanwhile.  If the
+	// proxy is replaced, the next request uses the new one.
+	s.serverLock.RLock()
+	p := s.dnsProxy
+	isRunning := s.isRunning
+	s.serverLock.RUnlock()
+
+	if !isRunning || p == nil {
+		return errNotRunning
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(host), qtype)
+
+	dctx := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Req:   req,
+		Addr:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	}
+
+	return p.Resolve(dctx)
+}
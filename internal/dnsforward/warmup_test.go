@@ -0,0 +1,27 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_filterWarmUpDomains(t *testing.T) {
+	s := &Server{
+		localDomainSuffix: defaultLocalDomainSuffix,
+	}
+
+	domains := []string{
+		"example.org",
+		"",
+		"host.lan",
+		"1.0.168.192.in-addr.arpa",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa",
+		"www.example.com",
+	}
+
+	assert.Equal(t, []string{
+		"example.org",
+		"www.example.com",
+	}, s.filterWarmUpDomains(domains))
+}
@@ -1,7 +1,6 @@
 package filtering
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -427,6 +426,23 @@ func BlockedSvcKnown(s string) (ok bool) {
 	return ok
 }
 
+// ServiceIDByHost returns the ID of the first known blocked service in the
+// alphabetical order, the rules of which match host, or an empty string if
+// there is none.  It's used to aggregate the blocked domains by services
+// regardless of what has blocked them.
+func ServiceIDByHost(host string) (id string) {
+	req := rules.NewRequestForHostname(host)
+	for _, id = range serviceIDs {
+		for _, rule := range serviceRules[id] {
+			if rule.Match(req) {
+				return id
+			}
+		}
+	}
+
+	return ""
+}
+
 // ApplyBlockedServices - set blocked services settings for this DNS request
 func (d *DNSFilter) ApplyBlockedServices(setts *Settings, list []string) {
 	setts.ServicesRules = []ServiceEntry{}
@@ -466,7 +482,7 @@ func (d *DNSFilter) handleBlockedServicesList(w http.ResponseWriter, r *http.Req
 
 func (d *DNSFilter) handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
 	list := []string{}
-	err := json.NewDecoder(r.Body).Decode(&list)
+	err := aghhttp.DecodeJSON(r, &list)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 
@@ -0,0 +1,367 @@
+package filtering
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+	"golang.org/x/exp/slices"
+)
+
+// maxChangelogLen is the maximum number of updates kept in the changelog of a
+// single filter list.
+const maxChangelogLen = 10
+
+// maxDiffSamples is the maximum number of added and removed rules kept as
+// samples of a single update.
+const maxDiffSamples = 10
+
+// rulesDiff is the difference between two versions of a filter list.
+type rulesDiff struct {
+	// updated is the time of the update.
+	updated time.Time
+
+	// addedSample are some of the added rules.
+	addedSample []string
+
+	// removedSample are some of the removed rules.
+	removedSample []string
+
+	// added is the number of added rules.
+	added int
+
+	// removed is the number of removed rules.
+	removed int
+}
+
+// changelogTracker keeps the changes of the filter lists made by the updates.
+type changelogTracker struct {
+	// mu protects lists and the file.
+	mu *sync.Mutex
+
+	// lists are the most recent changes of the filter lists by their IDs, the
+	// latest first.
+	lists map[int64][]*rulesDiff
+
+	// path is the path to the file keeping the changelog between restarts.  If
+	// it's empty, the changelog is only kept in memory.
+	path string
+}
+
+// newChangelogTracker returns a properly initialized *changelogTracker, which
+// persists the changelog in the file with the given path, if it's not empty.
+func newChangelogTracker(path string) (t *changelogTracker) {
+	return &changelogTracker{
+		mu:    &sync.Mutex{},
+		lists: map[int64][]*rulesDiff{},
+		path:  path,
+	}
+}
+
+// load reads the changelog from the file.  The changes of the filter lists,
+// for which exists returns false, are dropped.  The changelog is truncated to
+// the limits in case the file has been modified manually.
+func (t *changelogTracker) load(exists func(id int64) (ok bool)) (err error) {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading changelog: %w", err)
+	}
+
+	lists := map[int64][]*rulesDiffJSON{}
+	err = json.Unmarshal(data, &lists)
+	if err != nil {
+		return fmt.Errorf("decoding changelog: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, diffsJSON := range lists {
+		if !exists(id) {
+			continue
+		}
+
+		if len(diffsJSON) > maxChangelogLen {
+			diffsJSON = diffsJSON[:maxChangelogLen]
+		}
+
+		diffs := make([]*rulesDiff, 0, len(diffsJSON))
+		for i, dj := range diffsJSON {
+			var diff *rulesDiff
+			diff, err = dj.toInternal()
+			if err != nil {
+				return fmt.Errorf("decoding changelog of filter %d: update at index %d: %w", id, i, err)
+			}
+
+			diffs = append(diffs, diff)
+		}
+
+		t.lists[id] = diffs
+	}
+
+	return nil
+}
+
+// saveLocked writes the changelog into the file, if it's set.  t.mu is
+// expected to be locked.
+func (t *changelogTracker) saveLocked() {
+	if t.path == "" {
+		return
+	}
+
+	lists := make(map[int64][]*rulesDiffJSON, len(t.lists))
+	for id, diffs := range t.lists {
+		lists[id] = diffsToJSON(diffs)
+	}
+
+	data, err := json.Marshal(lists)
+	if err != nil {
+		log.Error("filtering: encoding changelog: %s", err)
+
+		return
+	}
+
+	err = maybe.WriteFile(t.path, data, 0o644)
+	if err != nil {
+		log.Error("filtering: writing changelog: %s", err)
+	}
+}
+
+// record stores the diff of the filter list with the given id.
+func (t *changelogTracker) record(id int64, diff *rulesDiff) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	diffs := append([]*rulesDiff{diff}, t.lists[id]...)
+	if len(diffs) > maxChangelogLen {
+		diffs = diffs[:maxChangelogLen]
+	}
+
+	t.lists[id] = diffs
+	t.saveLocked()
+}
+
+// remove deletes the changelog of the filter list with the given id.
+func (t *changelogTracker) remove(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.lists[id]; !ok {
+		return
+	}
+
+	delete(t.lists, id)
+	t.saveLocked()
+}
+
+// get returns the changelog of the filter list with the given id.
+func (t *changelogTracker) get(id int64) (diffs []*rulesDiff) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Clone(t.lists[id])
+}
+
+// readRules calls f for each rule in the filter list from r.  Empty lines and
+// comments are skipped the same way as in [DNSFilter.parseFilterContents].
+func readRules(r io.Reader, f func(rule string)) (err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := trimRuleLine(s.Text())
+		if line != "" {
+			f(line)
+		}
+	}
+
+	return s.Err()
+}
+
+// trimRuleLine returns the trimmed rule from line or an empty string if line
+// isn't a rule.
+func trimRuleLine(line string) (rule string) {
+	rule = strings.TrimSpace(line)
+	if rule == "" || rule[0] == '!' || rule[0] == '#' {
+		return ""
+	}
+
+	return rule
+}
+
+// diffRulesFiles returns the difference between the filter lists in the files
+// with the given paths.  If the old file doesn't exist, diff is nil.
+func diffRulesFiles(oldPath, newPath string) (diff *rulesDiff, err error) {
+	oldRules := map[string]struct{}{}
+	err = readRulesFile(oldPath, func(rule string) { oldRules[rule] = struct{}{} })
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading previous version: %w", err)
+	}
+
+	diff = &rulesDiff{
+		updated:       time.Now(),
+		addedSample:   []string{},
+		removedSample: []string{},
+	}
+
+	err = readRulesFile(newPath, func(rule string) {
+		if _, ok := oldRules[rule]; ok {
+			delete(oldRules, rule)
+
+			return
+		}
+
+		diff.added++
+		if len(diff.addedSample) < maxDiffSamples {
+			diff.addedSample = append(diff.addedSample, rule)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading new version: %w", err)
+	}
+
+	diff.removed = len(oldRules)
+	for rule := range oldRules {
+		diff.removedSample = append(diff.removedSample, rule)
+	}
+
+	slices.Sort(diff.removedSample)
+	if len(diff.removedSample) > maxDiffSamples {
+		diff.removedSample = diff.removedSample[:maxDiffSamples]
+	}
+
+	return diff, nil
+}
+
+// readRulesFile calls f for each rule in the filter list file with the given
+// path.
+func readRulesFile(path string, f func(rule string)) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, file.Close()) }()
+
+	return readRules(file, f)
+}
+
+// rulesDiffJSON is the JSON representation of a single update of a filter
+// list.  It's also used to keep the changelog in the file.
+type rulesDiffJSON struct {
+	Updated string   `json:"updated"`
+	Added   []string `json:"added_sample"`
+	Removed []string `json:"removed_sample"`
+	NumAdd  int      `json:"num_added"`
+	NumRem  int      `json:"num_removed"`
+}
+
+// diffsToJSON returns the JSON representations of diffs.
+func diffsToJSON(diffs []*rulesDiff) (diffsJSON []*rulesDiffJSON) {
+	diffsJSON = make([]*rulesDiffJSON, 0, len(diffs))
+	for _, diff := range diffs {
+		diffsJSON = append(diffsJSON, &rulesDiffJSON{
+			Updated: diff.updated.Format(time.RFC3339),
+			Added:   diff.addedSample,
+			Removed: diff.removedSample,
+			NumAdd:  diff.added,
+			NumRem:  diff.removed,
+		})
+	}
+
+	return diffsJSON
+}
+
+// toInternal returns the diff represented by dj.  The samples are truncated
+// to maxDiffSamples.
+func (dj *rulesDiffJSON) toInternal() (diff *rulesDiff, err error) {
+	updated, err := time.Parse(time.RFC3339, dj.Updated)
+	if err != nil {
+		return nil, fmt.Errorf("updated: %w", err)
+	}
+
+	return &rulesDiff{
+		updated:       updated,
+		addedSample:   truncateSample(dj.Added),
+		removedSample: truncateSample(dj.Removed),
+		added:         dj.NumAdd,
+		removed:       dj.NumRem,
+	}, nil
+}
+
+// truncateSample returns the first maxDiffSamples rules of sample.  It never
+// returns nil.
+func truncateSample(sample []string) (truncated []string) {
+	if len(sample) > maxDiffSamples {
+		return sample[:maxDiffSamples]
+	} else if sample == nil {
+		return []string{}
+	}
+
+	return sample
+}
+
+// changelogJSON is the response to the GET /control/filtering/changelog HTTP
+// API.
+type changelogJSON struct {
+	Updates []*rulesDiffJSON `json:"updates"`
+	ID      int64            `json:"id"`
+}
+
+// handleFilteringChangelog is the handler for the GET
+// /control/filtering/changelog HTTP API.
+func (d *DNSFilter) handleFilteringChangelog(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad id: %s", err)
+
+		return
+	}
+
+	if !d.filterIDExists(id) {
+		aghhttp.Error(r, w, http.StatusNotFound, "filter list %d not found", id)
+
+		return
+	}
+
+	resp := &changelogJSON{
+		ID:      id,
+		Updates: diffsToJSON(d.changelog.get(id)),
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// filterIDExists returns true if there is a blocklist or an allowlist with the
+// given id.
+func (d *DNSFilter) filterIDExists(id int64) (ok bool) {
+	d.filtersMu.RLock()
+	defer d.filtersMu.RUnlock()
+
+	for _, filters := range [][]FilterYAML{d.Filters, d.WhitelistFilters} {
+		for _, flt := range filters {
+			if flt.ID == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
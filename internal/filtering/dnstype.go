@@ -0,0 +1,25 @@
+package filtering
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// hasDNSTypeModifier returns true if the network rule r has the $dnstype
+// modifier, that is, if it only applies to some types of the DNS questions.
+func hasDNSTypeModifier(r *rules.NetworkRule) (ok bool) {
+	text := r.Text()
+	i := strings.LastIndexByte(text, '$')
+	if i < 0 {
+		return false
+	}
+
+	for _, opt := range strings.Split(text[i+1:], ",") {
+		if strings.HasPrefix(strings.TrimSpace(opt), "dnstype=") {
+			return true
+		}
+	}
+
+	return false
+}
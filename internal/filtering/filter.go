@@ -296,21 +296,22 @@ func (d *DNSFilter) listsToUpdate(filters *[]FilterYAML, force bool) (toUpd []Fi
 			Filter: Filter{
 				ID: flt.ID,
 			},
-			URL:      flt.URL,
-			Name:     flt.Name,
-			checksum: flt.checksum,
+			URL:        flt.URL,
+			Name:       flt.Name,
+			RulesCount: flt.RulesCount,
+			checksum:   flt.checksum,
 		})
 	}
 
 	return toUpd
 }
 
-func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int, []FilterYAML, []bool, bool) {
+func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int, bool) {
 	var updateFlags []bool // 'true' if filter data has changed
 
 	updateFilters := d.listsToUpdate(filters, force)
 	if len(updateFilters) == 0 {
-		return 0, nil, nil, false
+		return 0, false
 	}
 
 	nfail := 0
@@ -318,6 +319,7 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 		uf := &updateFilters[i]
 		updated, err := d.update(uf)
 		updateFlags = append(updateFlags, updated)
+		d.health.record(uf.ID, err)
 		if err != nil {
 			nfail++
 			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
@@ -326,7 +328,7 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 	}
 
 	if nfail == len(updateFilters) {
-		return 0, nil, nil, true
+		return 0, true
 	}
 
 	updateCount := 0
@@ -355,7 +357,7 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 		d.filtersMu.Unlock()
 	}
 
-	return updateCount, updateFilters, updateFlags, false
+	return updateCount, false
 }
 
 // refreshFiltersIntl checks filters and updates them if necessary.  If force is
@@ -372,6 +374,10 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 //     that this method works only on Unix systems.  On Windows, don't pass
 //     files to filtering, pass the whole data.
 //
+//  3. If any of the filters has been updated, start compiling the new
+//     filtering engines in the background.  The old ones are used until the
+//     new ones are ready.
+//
 // refreshFiltersIntl returns the number of updated filters.  It also returns
 // true if there was a network error and nothing could be updated.
 //
@@ -380,19 +386,15 @@ func (d *DNSFilter) refreshFiltersIntl(block, allow, force bool) (int, bool) {
 	log.Debug("filtering: updating...")
 
 	updNum := 0
-	var lists []FilterYAML
-	var toUpd []bool
 	isNetErr := false
 
 	if block {
-		updNum, lists, toUpd, isNetErr = d.refreshFiltersArray(&d.Filters, force)
+		updNum, isNetErr = d.refreshFiltersArray(&d.Filters, force)
 	}
 	if allow {
-		updNumAl, listsAl, toUpdAl, isNetErrAl := d.refreshFiltersArray(&d.WhitelistFilters, force)
+		updNumAl, isNetErrAl := d.refreshFiltersArray(&d.WhitelistFilters, force)
 
 		updNum += updNumAl
-		lists = append(lists, listsAl...)
-		toUpd = append(toUpd, toUpdAl...)
 		isNetErr = isNetErr || isNetErrAl
 	}
 	if isNetErr {
@@ -400,16 +402,10 @@ func (d *DNSFilter) refreshFiltersIntl(block, allow, force bool) (int, bool) {
 	}
 
 	if updNum != 0 {
-		d.EnableFilters(false)
-
-		for i := range lists {
-			uf := &lists[i]
-			updated := toUpd[i]
-			if !updated {
-				continue
-			}
-			_ = os.Remove(uf.Path(d.DataDir) + ".old")
-		}
+		// Compile the updated lists in the background.  The updated files
+		// replace the old ones by renaming, so the old engines keep reading
+		// the old contents until the new engines are swapped in.
+		d.EnableFilters(true)
 	}
 
 	log.Debug("filtering: update finished")
@@ -429,6 +425,21 @@ func isPrintableText(data []byte, len int) bool {
 	return true
 }
 
+// validateFirstChunk returns an error if the first chunk of the filter list
+// data doesn't look like a plain-text filter list.
+func validateFirstChunk(chunk []byte) (err error) {
+	if !isPrintableText(chunk, len(chunk)) {
+		return errors.Error("data contains non-printable characters")
+	}
+
+	s := strings.ToLower(string(chunk))
+	if strings.Contains(s, "<html") || strings.Contains(s, "<!doctype") {
+		return errors.Error("data is HTML, not plain text")
+	}
+
+	return nil
+}
+
 // A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
 func (d *DNSFilter) parseFilterContents(file io.Reader) (int, uint32, string) {
 	rulesCount := 0
@@ -497,13 +508,8 @@ func (d *DNSFilter) read(reader io.Reader, tmpFile *os.File, filter *FilterYAML)
 			firstChunkLen += copied
 
 			if firstChunkLen == len(firstChunk) || err == io.EOF {
-				if !isPrintableText(firstChunk, firstChunkLen) {
-					return total, fmt.Errorf("data contains non-printable characters")
-				}
-
-				s := strings.ToLower(string(firstChunk))
-				if strings.Contains(s, "<html") || strings.Contains(s, "<!doctype") {
-					return total, fmt.Errorf("data is HTML, not plain text")
+				if err = validateFirstChunk(firstChunk[:firstChunkLen]); err != nil {
+					return total, err
 				}
 
 				htmlTest = false
@@ -552,6 +558,8 @@ func (d *DNSFilter) finalizeUpdate(
 		return os.Remove(tmpFileName)
 	}
 
+	d.recordChanges(flt, tmpFileName)
+
 	log.Printf("saving filter %d contents to: %s", flt.ID, flt.Path(d.DataDir))
 
 	if err = os.Rename(tmpFileName, flt.Path(d.DataDir)); err != nil {
@@ -565,6 +573,24 @@ func (d *DNSFilter) finalizeUpdate(
 	return nil
 }
 
+// recordChanges stores the difference between the cached copy of flt and its
+// new version in the file with the given path into the changelog.
+func (d *DNSFilter) recordChanges(flt *FilterYAML, newPath string) {
+	diff, err := diffRulesFiles(flt.Path(d.DataDir), newPath)
+	if err != nil {
+		log.Error("filtering: computing changes of filter %d: %s", flt.ID, err)
+
+		return
+	} else if diff == nil {
+		// The list has been downloaded for the first time.
+		return
+	}
+
+	log.Debug("filtering: filter %d: %d rules added, %d removed", flt.ID, diff.added, diff.removed)
+
+	d.changelog.record(flt.ID, diff)
+}
+
 // processUpdate copies filter's content from src to dst and returns the name,
 // rules number, and checksum for it.  It also returns the number of bytes read
 // from src.
@@ -645,7 +671,15 @@ func (d *DNSFilter) updateIntl(flt *FilterYAML) (ok bool, err error) {
 		r = resp.Body
 	}
 
+	// Store the internationalized domain names in the rules in the ASCII form.
+	r = newASCIIRulesReader(r)
+
 	name, rnum, cs, n, err = d.processUpdate(r, tmpFile, flt)
+	if err == nil && rnum == 0 && flt.RulesCount > 0 {
+		// Don't replace the last cached copy of the list with an empty one,
+		// since that's most probably an error on the server's side.
+		return false, errNoRules
+	}
 
 	return cs != flt.checksum, err
 }
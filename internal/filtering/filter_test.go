@@ -105,6 +105,18 @@ func TestFilters(t *testing.T) {
 		t.Cleanup(func() { fltContent = []byte(content) })
 
 		updateAndAssert(t, require.True, 1)
+
+		diffs := filters.changelog.get(f.ID)
+		require.Len(t, diffs, 1)
+
+		assert.Equal(t, 1, diffs[0].added)
+		assert.Equal(t, []string{"||example.com^"}, diffs[0].addedSample)
+		assert.Equal(t, 3, diffs[0].removed)
+		assert.Equal(t, []string{
+			"0.0.0.0 example.com",
+			"||example.com^$third-party",
+			"||example.org^$third-party",
+		}, diffs[0].removedSample)
 	})
 
 	t.Run("load_unload", func(t *testing.T) {
@@ -114,3 +126,35 @@ func TestFilters(t *testing.T) {
 		f.unload()
 	})
 }
+
+func TestChangelogTracker_persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changelog.json")
+	updated := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tr := newChangelogTracker(path)
+	for i := 0; i < maxChangelogLen+1; i++ {
+		tr.record(1, &rulesDiff{
+			updated:       updated.Add(time.Duration(i) * time.Hour),
+			addedSample:   []string{"||added.example^"},
+			removedSample: []string{},
+			added:         i,
+		})
+	}
+	tr.record(2, &rulesDiff{updated: updated, addedSample: []string{}, removedSample: []string{}})
+	tr.record(3, &rulesDiff{updated: updated, addedSample: []string{}, removedSample: []string{}})
+	tr.remove(3)
+
+	loaded := newChangelogTracker(path)
+	err := loaded.load(func(id int64) (ok bool) { return id != 2 })
+	require.NoError(t, err)
+
+	diffs := loaded.get(1)
+	require.Len(t, diffs, maxChangelogLen)
+
+	assert.True(t, diffs[0].updated.Equal(updated.Add(maxChangelogLen*time.Hour)))
+	assert.Equal(t, maxChangelogLen, diffs[0].added)
+	assert.Equal(t, []string{"||added.example^"}, diffs[0].addedSample)
+
+	assert.Empty(t, loaded.get(2))
+	assert.Empty(t, loaded.get(3))
+}
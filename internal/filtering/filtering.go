@@ -15,6 +15,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
@@ -114,6 +115,11 @@ type Config struct {
 	// DataDir is used to store filters' contents.
 	DataDir string `yaml:"-"`
 
+	// ChangelogFilePath is the path to the file keeping the changes of the
+	// filter lists made by the updates.  If it's empty, the changelog is only
+	// kept in memory.
+	ChangelogFilePath string `yaml:"-"`
+
 	// filtersMu protects filter lists.
 	filtersMu *sync.RWMutex
 
@@ -125,6 +131,10 @@ type Config struct {
 
 	// UserRules is the global list of custom rules.
 	UserRules []string `yaml:"-"`
+
+	// IPLists are the IP reputation lists used to check the addresses in
+	// responses.
+	IPLists []IPListYAML `yaml:"ip_lists"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
@@ -187,6 +197,20 @@ type DNSFilter struct {
 
 	refreshLock *sync.Mutex
 
+	// health tracks the health of the filter lists.
+	health *healthTracker
+
+	// done is closed by Close to stop the background checks and refreshes of
+	// the IP lists started by Start.  It's nil until Start is called.  It's
+	// protected by engineLock.
+	done chan struct{}
+
+	// changelog keeps the changes of the filter lists made by the updates.
+	changelog *changelogTracker
+
+	// ipLists are the loaded IP reputation lists.
+	ipLists *ipLists
+
 	// filterTitleRegexp is the regular expression to retrieve a name of a
 	// filter list.
 	filterTitleRegexp *regexp.Regexp
@@ -250,6 +274,11 @@ const (
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2499.
 	RewrittenRule
+
+	// FilteredDoHCanary is returned when the request for a canary domain of
+	// the browsers' DNS-over-HTTPS has been responded with NXDOMAIN to keep
+	// the browsers using AdGuard Home.
+	FilteredDoHCanary
 )
 
 // TODO(a.garipov): Resync with actual code names or replace completely
@@ -269,6 +298,8 @@ var reasonNames = []string{
 	Rewritten:          "Rewrite",
 	RewrittenAutoHosts: "RewriteEtcHosts",
 	RewrittenRule:      "RewriteRule",
+
+	FilteredDoHCanary: "FilteredDoHCanary",
 }
 
 func (r Reason) String() string {
@@ -313,6 +344,7 @@ func (d *DNSFilter) WriteDiskConfig(c *Config) {
 
 		*c = d.Config
 		c.Rewrites = cloneRewrites(c.Rewrites)
+		c.IPLists = slices.Clone(c.IPLists)
 	}()
 
 	d.filtersMu.RLock()
@@ -335,7 +367,8 @@ func cloneRewrites(entries []*LegacyRewrite) (clone []*LegacyRewrite) {
 
 // SetFilters sets new filters, synchronously or asynchronously.  When filters
 // are set asynchronously, the old filters continue working until the new
-// filters are ready.
+// filters are ready.  The pending asynchronous task is replaced, so that only
+// the latest filters are compiled.
 //
 // In this case the caller must ensure that the old filter files are intact.
 func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool) error {
@@ -389,19 +422,29 @@ func (d *DNSFilter) Close() {
 	d.engineLock.Lock()
 	defer d.engineLock.Unlock()
 
+	if d.done != nil {
+		close(d.done)
+		d.done = nil
+	}
+
 	d.reset()
 }
 
+// reset closes the rule storages.  It's safe to call it several times.
 func (d *DNSFilter) reset() {
-	if d.rulesStorage != nil {
-		if err := d.rulesStorage.Close(); err != nil {
-			log.Error("filtering: rulesStorage.Close: %s", err)
+	closeRuleStorages(d.rulesStorage, d.rulesStorageAllow)
+	d.rulesStorage, d.rulesStorageAllow = nil, nil
+}
+
+// closeRuleStorages closes each of the non-nil storages and logs the errors.
+func closeRuleStorages(storages ...*filterlist.RuleStorage) {
+	for _, rs := range storages {
+		if rs == nil {
+			continue
 		}
-	}
 
-	if d.rulesStorageAllow != nil {
-		if err := d.rulesStorageAllow.Close(); err != nil {
-			log.Error("filtering: rulesStorageAllow.Close: %s", err)
+		if err := rs.Close(); err != nil {
+			log.Error("filtering: closing rule storage: %s", err)
 		}
 	}
 }
@@ -446,6 +489,12 @@ type Result struct {
 	// Reason is the reason for blocking or unblocking the request.
 	Reason Reason `json:",omitempty"`
 
+	// SuppressedType is the type of the question blocked by a rule with the
+	// $dnstype modifier.  Such rules only suppress the records of some types,
+	// so the host itself must still exist in the response.  It is zero unless
+	// Reason is set to FilteredBlockList.
+	SuppressedType uint16 `json:",omitempty"`
+
 	// IsFiltered is true if the request is filtered.
 	IsFiltered bool `json:",omitempty"`
 }
@@ -458,7 +507,7 @@ func (r Reason) Matched() bool {
 
 // CheckHostRules tries to match the host against filtering rules only.
 func (d *DNSFilter) CheckHostRules(host string, rrtype uint16, setts *Settings) (Result, error) {
-	return d.matchHost(strings.ToLower(host), rrtype, setts)
+	return d.matchHost(toASCII(strings.ToLower(host)), rrtype, setts)
 }
 
 // CheckHost tries to match the host against filtering rules, then safebrowsing
@@ -474,7 +523,8 @@ func (d *DNSFilter) CheckHost(
 		return Result{}, nil
 	}
 
-	host = strings.ToLower(host)
+	// Internationalized domain names are stored and matched in the ASCII form.
+	host = toASCII(strings.ToLower(host))
 
 	if setts.FilteringEnabled {
 		res = d.processRewrites(host, qtype)
@@ -667,7 +717,7 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 		case len(f.Data) != 0:
 			lists = append(lists, &filterlist.StringRuleList{
 				ID:             id,
-				RulesText:      string(f.Data),
+				RulesText:      rulesToASCII(string(f.Data)),
 				IgnoreCosmetic: true,
 			})
 		case f.FilePath == "":
@@ -709,8 +759,13 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 	return rs, nil
 }
 
-// Initialize urlfilter objects.
+// initFiltering compiles the new urlfilter engines from the filters and swaps
+// them in.  The compilation may take a while for the large lists, so it's done
+// without holding engineLock, and the requests are matched against the old
+// engines until the new ones are ready.
 func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
+	start := time.Now()
+
 	rulesStorage, err := newRuleStorage(blockFilters)
 	if err != nil {
 		return err
@@ -724,20 +779,26 @@ func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
 	filteringEngine := urlfilter.NewDNSEngine(rulesStorage)
 	filteringEngineAllow := urlfilter.NewDNSEngine(rulesStorageAllow)
 
+	var oldStorage, oldStorageAllow *filterlist.RuleStorage
 	func() {
 		d.engineLock.Lock()
 		defer d.engineLock.Unlock()
 
-		d.reset()
+		oldStorage, oldStorageAllow = d.rulesStorage, d.rulesStorageAllow
 		d.rulesStorage = rulesStorage
 		d.filteringEngine = filteringEngine
 		d.rulesStorageAllow = rulesStorageAllow
 		d.filteringEngineAllow = filteringEngineAllow
 	}()
 
+	// The matching holds engineLock while using the rules, so the old engines
+	// aren't used by anyone after the swap and their storages may be closed
+	// without the lock.
+	closeRuleStorages(oldStorage, oldStorageAllow)
+
 	// Make sure that the OS reclaims memory as soon as possible.
 	debug.FreeOSMemory()
-	log.Debug("initialized filtering engine")
+	log.Debug("filtering: initialized engines in %s", time.Since(start))
 
 	return nil
 }
@@ -791,7 +852,12 @@ func (d *DNSFilter) matchHostProcessDNSResult(
 			reason = NotFilteredAllowList
 		}
 
-		return makeResult([]rules.Rule{dnsres.NetworkRule}, reason)
+		res = makeResult([]rules.Rule{dnsres.NetworkRule}, reason)
+		if res.IsFiltered && hasDNSTypeModifier(dnsres.NetworkRule) {
+			res.SuppressedType = qtype
+		}
+
+		return res
 	}
 
 	if qtype == dns.TypeA && dnsres.HostRulesV4 != nil {
@@ -926,6 +992,8 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 	d = &DNSFilter{
 		resolver:          net.DefaultResolver,
 		refreshLock:       &sync.Mutex{},
+		health:            newHealthTracker(),
+		changelog:         newChangelogTracker(c.ChangelogFilePath),
 		filterTitleRegexp: regexp.MustCompile(`^! Title: +(.*)$`),
 	}
 
@@ -1012,6 +1080,14 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 	updateUniqueFilterID(d.Filters)
 	updateUniqueFilterID(d.WhitelistFilters)
 
+	err = d.changelog.load(d.filterIDExists)
+	if err != nil {
+		// Don't fail, since the changelog is only informational.
+		log.Error("filtering: %s", err)
+	}
+
+	d.initIPLists()
+
 	return d, nil
 }
 
@@ -1024,8 +1100,15 @@ func (d *DNSFilter) Start() {
 
 	d.RegisterFilteringHandlers()
 
+	d.engineLock.Lock()
+	d.done = make(chan struct{})
+	done := d.done
+	d.engineLock.Unlock()
+
 	// Here we should start updating filters,
 	//  but currently we can't wake up the periodic task to do so.
 	// So for now we just start this periodic task from here.
 	go d.periodicallyRefreshFilters()
+	go d.periodicallyCheckFiltersHealth(done)
+	go d.periodicallyRefreshIPLists(done)
 }
@@ -409,6 +409,8 @@ func TestMatching(t *testing.T) {
 		regexRules     = `/example\.org/` + nl + `@@||test.example.org^` + nl
 		maskRules      = `test*.example.org^` + nl + `exam*.com` + nl
 		dnstypeRules   = `||example.org^$dnstype=AAAA` + nl + `@@||test.example.org^` + nl
+		unicodeRules   = `||пример.рф^` + nl
+		punycodeRules  = `||xn--e1afmkfd.xn--p1ai^` + nl
 	)
 	testCases := []struct {
 		name           string
@@ -676,6 +678,34 @@ func TestMatching(t *testing.T) {
 		wantIsFiltered: false,
 		wantReason:     NotFilteredAllowList,
 		wantDNSType:    dns.TypeAAAA,
+	}, {
+		name:           "idn_unicode_rule",
+		rules:          unicodeRules,
+		host:           "xn--e1afmkfd.xn--p1ai",
+		wantIsFiltered: true,
+		wantReason:     FilteredBlockList,
+		wantDNSType:    dns.TypeA,
+	}, {
+		name:           "idn_unicode_rule",
+		rules:          unicodeRules,
+		host:           "sub.xn--e1afmkfd.xn--p1ai",
+		wantIsFiltered: true,
+		wantReason:     FilteredBlockList,
+		wantDNSType:    dns.TypeA,
+	}, {
+		name:           "idn_punycode_rule",
+		rules:          punycodeRules,
+		host:           "ПРИМЕР.рф",
+		wantIsFiltered: true,
+		wantReason:     FilteredBlockList,
+		wantDNSType:    dns.TypeA,
+	}, {
+		name:           "idn_punycode_rule",
+		rules:          punycodeRules,
+		host:           "xn--e1afmkfd.xn--p1ai",
+		wantIsFiltered: true,
+		wantReason:     FilteredBlockList,
+		wantDNSType:    dns.TypeA,
 	}}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("%s-%s", tc.name, tc.host), func(t *testing.T) {
@@ -692,6 +722,66 @@ func TestMatching(t *testing.T) {
 	}
 }
 
+func TestDNSFilter_CheckHost_suppressedType(t *testing.T) {
+	const nl = "\n"
+	const rules = `||telemetry.example^$dnstype=TXT` + nl +
+		`||tracker.example^$dnstype=~A` + nl +
+		`||ads.example^` + nl +
+		`@@||allowed.example^$dnstype=TXT` + nl
+
+	filters := []Filter{{ID: 0, Data: []byte(rules)}}
+	d, setts := newForTest(t, nil, filters)
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name           string
+		host           string
+		qtype          uint16
+		wantSuppressed uint16
+		wantIsFiltered bool
+	}{{
+		name:           "suppressed",
+		host:           "telemetry.example",
+		qtype:          dns.TypeTXT,
+		wantSuppressed: dns.TypeTXT,
+		wantIsFiltered: true,
+	}, {
+		name:           "other_type",
+		host:           "telemetry.example",
+		qtype:          dns.TypeA,
+		wantSuppressed: 0,
+		wantIsFiltered: false,
+	}, {
+		name:           "negated",
+		host:           "tracker.example",
+		qtype:          dns.TypeAAAA,
+		wantSuppressed: dns.TypeAAAA,
+		wantIsFiltered: true,
+	}, {
+		name:           "no_modifier",
+		host:           "ads.example",
+		qtype:          dns.TypeTXT,
+		wantSuppressed: 0,
+		wantIsFiltered: true,
+	}, {
+		name:           "allowlist",
+		host:           "allowed.example",
+		qtype:          dns.TypeTXT,
+		wantSuppressed: 0,
+		wantIsFiltered: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, tc.qtype, setts)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantIsFiltered, res.IsFiltered)
+			assert.Equal(t, tc.wantSuppressed, res.SuppressedType)
+		})
+	}
+}
+
 func TestWhitelist(t *testing.T) {
 	rules := `||host1^
 ||host2^
@@ -736,6 +826,35 @@ func TestWhitelist(t *testing.T) {
 	assert.Equal(t, "||host2^", res.Rules[0].Text)
 }
 
+func TestDNSFilter_SetFilters_async(t *testing.T) {
+	d, setts := newForTest(t, nil, []Filter{{ID: 0, Data: []byte("||old.example^\n")}})
+	t.Cleanup(d.Close)
+
+	// The filters initializer isn't started, so run its tasks manually.
+	d.filtersInitializerChan = make(chan filtersInitializerParams, 1)
+
+	newFilters := []Filter{{ID: 0, Data: []byte("||new.example^\n")}}
+	err := d.SetFilters([]Filter{{ID: 0, Data: []byte("||pending.example^\n")}}, nil, true)
+	require.NoError(t, err)
+
+	// The pending task is replaced by the newer one.
+	err = d.SetFilters(newFilters, nil, true)
+	require.NoError(t, err)
+
+	// The old engine is used until the new one is ready.
+	d.checkMatch(t, "old.example", setts)
+	d.checkMatchEmpty(t, "new.example", setts)
+
+	params := <-d.filtersInitializerChan
+	assert.Equal(t, newFilters, params.blockFilters)
+
+	err = d.initFiltering(params.allowFilters, params.blockFilters)
+	require.NoError(t, err)
+
+	d.checkMatchEmpty(t, "old.example", setts)
+	d.checkMatch(t, "new.example", setts)
+}
+
 // Client Settings.
 
 func applyClientSettings(setts *Settings) {
@@ -822,6 +941,34 @@ func TestClientSettings(t *testing.T) {
 	}
 }
 
+func TestServiceIDByHost(t *testing.T) {
+	InitModule()
+
+	testCases := []struct {
+		name   string
+		host   string
+		wantID string
+	}{{
+		name:   "domain",
+		host:   "facebook.com",
+		wantID: "facebook",
+	}, {
+		name:   "subdomain",
+		host:   "www.youtube.com",
+		wantID: "youtube",
+	}, {
+		name:   "unknown",
+		host:   "example.org",
+		wantID: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantID, ServiceIDByHost(tc.host))
+		})
+	}
+}
+
 // Benchmarks.
 
 func BenchmarkSafeBrowsing(b *testing.B) {
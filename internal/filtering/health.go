@@ -0,0 +1,384 @@
+package filtering
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// errNoRules is returned when the downloaded filter list contains no rules.
+const errNoRules errors.Error = "filter list contains no rules"
+
+// healthCheckIvl is the interval between the health checks of the enabled
+// filter lists.
+const healthCheckIvl = 1 * time.Hour
+
+// maxHealthCheckSize is the maximum number of bytes read from the filter list
+// source during a single health check.
+const maxHealthCheckSize = 64 * 1024 * 1024
+
+// filterHealth is the health state of a single filter list.
+type filterHealth struct {
+	// lastCheck is the time of the last check, either by updating or by the
+	// health check.
+	lastCheck time.Time
+
+	// lastSuccess is the time of the last successful check.
+	lastSuccess time.Time
+
+	// lastErr is the error of the last check, if any.
+	lastErr error
+
+	// validators are used to make the next health check conditional.
+	validators healthValidators
+
+	// failures is the number of consecutive failed checks.
+	failures uint32
+}
+
+// healthValidators are the values used to check if the source of a filter list
+// has changed since the last successful check, so that the unchanged lists
+// aren't downloaded each time.
+type healthValidators struct {
+	// etag is the ETag header of the last successful response, if any.
+	etag string
+
+	// modTime is the time the source has last been modified at, according to
+	// the Last-Modified header or the modification time of a file.  If zero,
+	// the time the cached copy has been updated at is used.
+	modTime time.Time
+}
+
+// healthCheck is a health check of a single filter list.
+type healthCheck struct {
+	// validators are the ones from the last successful check.
+	validators healthValidators
+
+	// lastUpdated is the time the cached copy of the list has been updated at.
+	lastUpdated time.Time
+
+	// url is the URL or the absolute path of the list's source.
+	url string
+
+	// id is the identifier of the list.
+	id int64
+}
+
+// healthTracker tracks the health state of the filter lists by their IDs.
+type healthTracker struct {
+	// mu protects lists.
+	mu *sync.Mutex
+
+	// lists are the health states of filter lists by their IDs.
+	lists map[int64]*filterHealth
+}
+
+// newHealthTracker returns a properly initialized *healthTracker.
+func newHealthTracker() (t *healthTracker) {
+	return &healthTracker{
+		mu:    &sync.Mutex{},
+		lists: map[int64]*filterHealth{},
+	}
+}
+
+// record stores the result of checking the filter list with the given id.  err
+// is nil if the check was successful.
+func (t *healthTracker) record(id int64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.lists[id]
+	if !ok {
+		h = &filterHealth{}
+		t.lists[id] = h
+	}
+
+	h.lastCheck = time.Now()
+	h.lastErr = err
+	if err != nil {
+		h.failures++
+
+		return
+	}
+
+	h.lastSuccess = h.lastCheck
+	h.failures = 0
+}
+
+// recordCheck stores the result of the health check of the filter list with
+// the given id along with the validators for the next check.  err is nil if the
+// check was successful.
+func (t *healthTracker) recordCheck(id int64, v healthValidators, err error) {
+	t.record(id, err)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if h, ok := t.lists[id]; ok {
+		h.validators = v
+	}
+}
+
+// remove deletes the health state of the filter list with the given id.
+func (t *healthTracker) remove(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.lists, id)
+}
+
+// filterHealthStatus is the status of a filter list health.
+type filterHealthStatus string
+
+// Valid filterHealthStatus values.
+const (
+	filterHealthOK      filterHealthStatus = "ok"
+	filterHealthFailing filterHealthStatus = "failing"
+	filterHealthUnknown filterHealthStatus = "unknown"
+)
+
+// filterHealthJSON is the JSON representation of a filter list health.
+type filterHealthJSON struct {
+	Status              filterHealthStatus `json:"status"`
+	LastCheck           string             `json:"last_check,omitempty"`
+	LastSuccess         string             `json:"last_success,omitempty"`
+	LastError           string             `json:"last_error,omitempty"`
+	ConsecutiveFailures uint32             `json:"consecutive_failures"`
+	UsingCachedCopy     bool               `json:"using_cached_copy"`
+}
+
+// toJSON returns the JSON representation of the health state of the filter
+// list with the given id.  hasRules should be true if the cached copy of the
+// list contains any rules.
+func (t *healthTracker) toJSON(id int64, hasRules bool) (hj *filterHealthJSON) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.lists[id]
+	if !ok {
+		return &filterHealthJSON{
+			Status: filterHealthUnknown,
+		}
+	}
+
+	hj = &filterHealthJSON{
+		Status:              filterHealthOK,
+		ConsecutiveFailures: h.failures,
+		LastCheck:           h.lastCheck.Format(time.RFC3339),
+	}
+
+	if !h.lastSuccess.IsZero() {
+		hj.LastSuccess = h.lastSuccess.Format(time.RFC3339)
+	}
+
+	if h.lastErr != nil {
+		hj.Status = filterHealthFailing
+		hj.LastError = h.lastErr.Error()
+		hj.UsingCachedCopy = hasRules
+	}
+
+	return hj
+}
+
+// checkFilterData reads the filter list data from r and returns an error if
+// it's not a valid filter list.
+func (d *DNSFilter) checkFilterData(r io.Reader) (err error) {
+	r, err = aghio.LimitReader(r, maxHealthCheckSize)
+	if err != nil {
+		// Don't wrap the error since it's an internal error.
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, 4*1024)
+	chunk, err := br.Peek(4 * 1024)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading data: %w", err)
+	}
+
+	if err = validateFirstChunk(chunk); err != nil {
+		return err
+	}
+
+	rulesNum, _, _ := d.parseFilterContents(br)
+	if rulesNum == 0 {
+		return errNoRules
+	}
+
+	return nil
+}
+
+// checkFilterHealth checks if the source of the filter list is reachable and
+// contains a valid filter list.  The list isn't read if its source hasn't
+// changed since the last successful check or the last update of the cached
+// copy.  It doesn't modify the cached copy.
+func (d *DNSFilter) checkFilterHealth(hc *healthCheck) (v healthValidators, err error) {
+	v = hc.validators
+	if filepath.IsAbs(hc.url) {
+		return d.checkFileHealth(hc)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, hc.url, nil)
+	if err != nil {
+		return v, fmt.Errorf("creating request: %w", err)
+	}
+
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+
+	if since := lastModified(hc); !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return v, fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return v, nil
+	case http.StatusOK:
+		// Go on.
+	default:
+		return v, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+	}
+
+	v = healthValidators{
+		etag: resp.Header.Get("ETag"),
+	}
+
+	if t, perr := http.ParseTime(resp.Header.Get("Last-Modified")); perr == nil {
+		v.modTime = t
+	}
+
+	return v, d.checkFilterData(resp.Body)
+}
+
+// checkFileHealth is the implementation of checkFilterHealth for the filter
+// lists stored in the local files.
+func (d *DNSFilter) checkFileHealth(hc *healthCheck) (v healthValidators, err error) {
+	f, err := os.Open(hc.url)
+	if err != nil {
+		return hc.validators, fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return hc.validators, fmt.Errorf("getting file info: %w", err)
+	}
+
+	v = healthValidators{
+		modTime: fi.ModTime(),
+	}
+
+	if since := lastModified(hc); !since.IsZero() && !v.modTime.After(since) {
+		return v, nil
+	}
+
+	return v, d.checkFilterData(f)
+}
+
+// lastModified returns the time the source of the filter list has last been
+// known to be valid at.  It's zero if unknown.
+func lastModified(hc *healthCheck) (t time.Time) {
+	if t = hc.validators.modTime; t.IsZero() {
+		t = hc.lastUpdated
+	}
+
+	return t
+}
+
+// listsToCheck returns the enabled filter lists which haven't been checked for
+// at least the health check interval.
+func (d *DNSFilter) listsToCheck() (toCheck []*healthCheck) {
+	d.filtersMu.RLock()
+	defer d.filtersMu.RUnlock()
+
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+
+	now := time.Now()
+	for _, filters := range [][]FilterYAML{d.Filters, d.WhitelistFilters} {
+		for _, flt := range filters {
+			if !flt.Enabled {
+				continue
+			}
+
+			hc := &healthCheck{
+				lastUpdated: flt.LastUpdated,
+				url:         flt.URL,
+				id:          flt.ID,
+			}
+
+			if h, ok := d.health.lists[flt.ID]; ok {
+				if now.Sub(h.lastCheck) < healthCheckIvl {
+					continue
+				}
+
+				hc.validators = h.validators
+			}
+
+			toCheck = append(toCheck, hc)
+		}
+	}
+
+	return toCheck
+}
+
+// checkFiltersHealth checks the health of all the enabled filter lists.
+func (d *DNSFilter) checkFiltersHealth() {
+	for _, hc := range d.listsToCheck() {
+		v, err := d.checkFilterHealth(hc)
+		if err != nil {
+			log.Info("filtering: health check of filter %d at %q: %s", hc.id, hc.url, err)
+		}
+
+		d.health.recordCheck(hc.id, v, err)
+	}
+}
+
+// periodicallyCheckFiltersHealth checks the health of the enabled filter lists
+// once in a while until done is closed.  The checks are not performed if the
+// updates are disabled.
+func (d *DNSFilter) periodicallyCheckFiltersHealth(done <-chan struct{}) {
+	defer log.OnPanic("filtering: checking health")
+
+	t := time.NewTicker(healthCheckIvl)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			// Go on.
+		case <-done:
+			log.Debug("filtering: stopped checking health")
+
+			return
+		}
+
+		d.confLock.RLock()
+		ivl := d.FiltersUpdateIntervalHours
+		d.confLock.RUnlock()
+
+		if ivl == 0 {
+			continue
+		}
+
+		d.checkFiltersHealth()
+	}
+}
@@ -0,0 +1,181 @@
+package filtering
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTracker(t *testing.T) {
+	const id int64 = 1
+
+	ht := newHealthTracker()
+
+	hj := ht.toJSON(id, true)
+	require.NotNil(t, hj)
+
+	assert.Equal(t, filterHealthUnknown, hj.Status)
+
+	const testErr errors.Error = "test error"
+
+	ht.record(id, testErr)
+	ht.record(id, testErr)
+
+	hj = ht.toJSON(id, true)
+	require.NotNil(t, hj)
+
+	assert.Equal(t, filterHealthFailing, hj.Status)
+	assert.Equal(t, string(testErr), hj.LastError)
+	assert.Equal(t, uint32(2), hj.ConsecutiveFailures)
+	assert.True(t, hj.UsingCachedCopy)
+	assert.Empty(t, hj.LastSuccess)
+
+	ht.record(id, nil)
+
+	hj = ht.toJSON(id, true)
+	require.NotNil(t, hj)
+
+	assert.Equal(t, filterHealthOK, hj.Status)
+	assert.Empty(t, hj.LastError)
+	assert.Zero(t, hj.ConsecutiveFailures)
+	assert.False(t, hj.UsingCachedCopy)
+	assert.NotEmpty(t, hj.LastSuccess)
+
+	ht.remove(id)
+
+	hj = ht.toJSON(id, true)
+	require.NotNil(t, hj)
+
+	assert.Equal(t, filterHealthUnknown, hj.Status)
+}
+
+func TestValidateFirstChunk(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		chunk      []byte
+	}{{
+		name:       "rules",
+		wantErrMsg: "",
+		chunk:      []byte("||example.org^\n! comment\n"),
+	}, {
+		name:       "html",
+		wantErrMsg: "data is HTML, not plain text",
+		chunk:      []byte("<!DOCTYPE html><html></html>"),
+	}, {
+		name:       "binary",
+		wantErrMsg: "data contains non-printable characters",
+		chunk:      []byte{0x1f, 0x8b, 0x08, 0x00},
+	}, {
+		name:       "empty",
+		wantErrMsg: "",
+		chunk:      []byte{},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateFirstChunk(tc.chunk)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErrMsg)
+			}
+		})
+	}
+}
+
+func TestDNSFilter_periodicallyCheckFiltersHealth_close(t *testing.T) {
+	done := make(chan struct{})
+	d := &DNSFilter{
+		done: done,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		d.periodicallyCheckFiltersHealth(done)
+	}()
+
+	d.Close()
+	assert.Nil(t, d.done)
+
+	select {
+	case <-stopped:
+		// Go on.
+	case <-time.After(time.Second):
+		t.Fatal("health checks weren't stopped")
+	}
+
+	// Closing again must not panic.
+	assert.NotPanics(t, d.Close)
+}
+
+func TestDNSFilter_checkFilterHealth(t *testing.T) {
+	const (
+		etag  = `"1"`
+		rules = "||example.org^\n"
+	)
+
+	var full, notModified uint32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddUint32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		atomic.AddUint32(&full, 1)
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(rules))
+	}))
+	t.Cleanup(srv.Close)
+
+	d := &DNSFilter{
+		Config: Config{
+			HTTPClient: srv.Client(),
+		},
+		filterTitleRegexp: regexp.MustCompile(`^! Title: +(.*)$`),
+	}
+
+	t.Run("url", func(t *testing.T) {
+		hc := &healthCheck{url: srv.URL}
+		v, err := d.checkFilterHealth(hc)
+		require.NoError(t, err)
+
+		assert.Equal(t, etag, v.etag)
+
+		hc.validators = v
+		v, err = d.checkFilterHealth(hc)
+		require.NoError(t, err)
+
+		assert.Equal(t, etag, v.etag)
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&full))
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&notModified))
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "filter.txt")
+		err := os.WriteFile(path, []byte("! comment\n"), 0o644)
+		require.NoError(t, err)
+
+		hc := &healthCheck{url: path}
+		_, err = d.checkFilterHealth(hc)
+		assert.ErrorIs(t, err, errNoRules)
+
+		// The file modified before the last update isn't read again.
+		hc.lastUpdated = time.Now().Add(time.Hour)
+		_, err = d.checkFilterHealth(hc)
+		assert.NoError(t, err)
+	})
+}
@@ -1,7 +1,6 @@
 package filtering
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -47,7 +46,7 @@ type filterAddJSON struct {
 
 func (d *DNSFilter) handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	fj := filterAddJSON{}
-	err := json.NewDecoder(r.Body).Decode(&fj)
+	err := aghhttp.DecodeJSON(r, &fj)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
 
@@ -129,7 +128,7 @@ func (d *DNSFilter) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 	}
 
 	req := request{}
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := aghhttp.DecodeJSON(r, &req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "failed to parse request body json: %s", err)
 
@@ -152,6 +151,8 @@ func (d *DNSFilter) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 		}
 
 		deleted = flt
+		d.health.remove(flt.ID)
+		d.changelog.remove(flt.ID)
 		path := flt.Path(d.DataDir)
 		err = os.Rename(path, path+".old")
 		if err != nil {
@@ -191,7 +192,7 @@ type filterURLReq struct {
 
 func (d *DNSFilter) handleFilteringSetURL(w http.ResponseWriter, r *http.Request) {
 	fj := filterURLReq{}
-	err := json.NewDecoder(r.Body).Decode(&fj)
+	err := aghhttp.DecodeJSON(r, &fj)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
 
@@ -258,14 +259,17 @@ func (d *DNSFilter) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 	}
 
 	req := &filteringRulesReq{}
-	err := json.NewDecoder(r.Body).Decode(req)
+	err := aghhttp.DecodeJSON(r, req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
 
 		return
 	}
 
+	d.filtersMu.Lock()
 	d.UserRules = req.Rules
+	d.filtersMu.Unlock()
+
 	d.ConfigModified()
 	d.EnableFilters(true)
 }
@@ -281,7 +285,7 @@ func (d *DNSFilter) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 	var err error
 
 	req := Req{}
-	err = json.NewDecoder(r.Body).Decode(&req)
+	err = aghhttp.DecodeJSON(r, &req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
 
@@ -305,12 +309,13 @@ func (d *DNSFilter) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 }
 
 type filterJSON struct {
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	LastUpdated string `json:"last_updated,omitempty"`
-	ID          int64  `json:"id"`
-	RulesCount  uint32 `json:"rules_count"`
-	Enabled     bool   `json:"enabled"`
+	Health      *filterHealthJSON `json:"health,omitempty"`
+	URL         string            `json:"url"`
+	Name        string            `json:"name"`
+	LastUpdated string            `json:"last_updated,omitempty"`
+	ID          int64             `json:"id"`
+	RulesCount  uint32            `json:"rules_count"`
+	Enabled     bool              `json:"enabled"`
 }
 
 type filteringConfig struct {
@@ -321,6 +326,21 @@ type filteringConfig struct {
 	Enabled          bool         `json:"enabled"`
 }
 
+// type check
+var _ aghhttp.Validator = (*filteringConfig)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for *filteringConfig.
+func (c *filteringConfig) Validate() (err error) {
+	if ValidateUpdateIvl(c.Interval) {
+		return nil
+	}
+
+	return &aghhttp.FieldError{
+		Err:   fmt.Errorf("interval: unsupported value %d", c.Interval),
+		Field: "interval",
+	}
+}
+
 func filterToJSON(f FilterYAML) filterJSON {
 	fj := filterJSON{
 		ID:         f.ID,
@@ -345,10 +365,16 @@ func (d *DNSFilter) handleFilteringStatus(w http.ResponseWriter, r *http.Request
 	resp.Interval = d.FiltersUpdateIntervalHours
 	for _, f := range d.Filters {
 		fj := filterToJSON(f)
+		if f.Enabled {
+			fj.Health = d.health.toJSON(f.ID, f.RulesCount > 0)
+		}
 		resp.Filters = append(resp.Filters, fj)
 	}
 	for _, f := range d.WhitelistFilters {
 		fj := filterToJSON(f)
+		if f.Enabled {
+			fj.Health = d.health.toJSON(f.ID, f.RulesCount > 0)
+		}
 		resp.WhitelistFilters = append(resp.WhitelistFilters, fj)
 	}
 	resp.UserRules = d.UserRules
@@ -360,19 +386,13 @@ func (d *DNSFilter) handleFilteringStatus(w http.ResponseWriter, r *http.Request
 // Set filtering configuration
 func (d *DNSFilter) handleFilteringConfig(w http.ResponseWriter, r *http.Request) {
 	req := filteringConfig{}
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := aghhttp.DecodeJSON(r, &req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
 
 		return
 	}
 
-	if !ValidateUpdateIvl(req.Interval) {
-		aghhttp.Error(r, w, http.StatusBadRequest, "Unsupported interval")
-
-		return
-	}
-
 	func() {
 		d.filtersMu.Lock()
 		defer d.filtersMu.Unlock()
@@ -486,6 +506,9 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodGet, "/control/blocked_services/list", d.handleBlockedServicesList)
 	registerHTTP(http.MethodPost, "/control/blocked_services/set", d.handleBlockedServicesSet)
 
+	registerHTTP(http.MethodGet, "/control/ip_lists/status", d.handleIPListsStatus)
+	registerHTTP(http.MethodPost, "/control/ip_lists/refresh", d.handleIPListsRefresh)
+
 	registerHTTP(http.MethodGet, "/control/filtering/status", d.handleFilteringStatus)
 	registerHTTP(http.MethodPost, "/control/filtering/config", d.handleFilteringConfig)
 	registerHTTP(http.MethodPost, "/control/filtering/add_url", d.handleFilteringAddURL)
@@ -494,6 +517,10 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodPost, "/control/filtering/refresh", d.handleFilteringRefresh)
 	registerHTTP(http.MethodPost, "/control/filtering/set_rules", d.handleFilteringSetRules)
 	registerHTTP(http.MethodGet, "/control/filtering/check_host", d.handleCheckHost)
+	registerHTTP(http.MethodGet, "/control/filtering/changelog", d.handleFilteringChangelog)
+	registerHTTP(http.MethodGet, "/control/filtering/rules", d.handleUserRulesGet)
+	registerHTTP(http.MethodPost, "/control/filtering/rules/add", d.handleUserRulesAdd)
+	registerHTTP(http.MethodPost, "/control/filtering/rules/delete", d.handleUserRulesDelete)
 }
 
 // ValidateUpdateIvl returns false if i is not a valid filters update interval.
@@ -0,0 +1,175 @@
+package filtering
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/idna"
+)
+
+// punycodePrefix is the ACE prefix of the internationalized domain name labels
+// encoded with punycode.  See RFC 5890.
+const punycodePrefix = "xn--"
+
+// toASCII returns the ASCII form of the internationalized domain name host,
+// also known as punycode.  host is returned as is if it's already ASCII or if
+// it can't be converted.
+func toASCII(host string) (ascii string) {
+	if isASCII(host) {
+		return host
+	}
+
+	ascii, err := idna.ToASCII(host)
+	if err != nil {
+		log.Debug("filtering: converting %q to ascii: %s", host, err)
+
+		return host
+	}
+
+	return ascii
+}
+
+// toUnicode returns the Unicode form of the internationalized domain name
+// host.  host is returned as is if it has no punycode labels or if it can't be
+// converted.
+func toUnicode(host string) (uni string) {
+	if !hasPunycode(host) {
+		return host
+	}
+
+	uni, err := idna.ToUnicode(host)
+	if err != nil {
+		log.Debug("filtering: converting %q to unicode: %s", host, err)
+
+		return host
+	}
+
+	return uni
+}
+
+// isASCII returns true if s only contains ASCII characters.
+func isASCII(s string) (ok bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasPunycode returns true if host has labels encoded with punycode.
+func hasPunycode(host string) (ok bool) {
+	return strings.HasPrefix(host, punycodePrefix) || strings.Contains(host, "."+punycodePrefix)
+}
+
+// isRuleDomainRune returns true if c may be a part of a domain name in a rule.
+func isRuleDomainRune(c rune) (ok bool) {
+	return c == '-' || c == '.' || c == '_' || c == '*' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// ruleToASCII converts the internationalized domain names in the pattern of the
+// filtering rule into the ASCII form, since urlfilter only matches the ASCII
+// ones.  Comments, regular expressions, and modifiers are left as is.
+func ruleToASCII(rule string) (ascii string) {
+	if isASCII(rule) {
+		return rule
+	}
+
+	pattern := strings.TrimLeft(rule, " \t")
+	if pattern == "" || pattern[0] == '!' || pattern[0] == '#' {
+		return rule
+	}
+
+	pattern = strings.TrimPrefix(pattern, "@@")
+	if strings.HasPrefix(pattern, "/") {
+		return rule
+	}
+
+	end := len(rule)
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		end = i
+	}
+
+	b := &strings.Builder{}
+	for start := 0; start < end; {
+		i := strings.IndexFunc(rule[start:end], func(c rune) (ok bool) { return !isRuleDomainRune(c) })
+		if i < 0 {
+			i = end - start
+		}
+
+		tok := rule[start : start+i]
+		if !isASCII(tok) {
+			tok = toASCII(strings.ToLower(tok))
+		}
+
+		b.WriteString(tok)
+		if start += i; start == end {
+			break
+		}
+
+		// Write the separator as is.
+		_, sepLen := utf8.DecodeRuneInString(rule[start:end])
+		b.WriteString(rule[start : start+sepLen])
+		start += sepLen
+	}
+
+	b.WriteString(rule[end:])
+
+	return b.String()
+}
+
+// rulesToASCII is like [ruleToASCII] but for a text consisting of rules
+// separated with newlines.
+func rulesToASCII(text string) (ascii string) {
+	if isASCII(text) {
+		return text
+	}
+
+	b := &strings.Builder{}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		b.WriteString(ruleToASCII(line))
+	}
+
+	return b.String()
+}
+
+// asciiRulesReader is an [io.Reader] converting the internationalized domain
+// names in the rules read from the underlying reader into the ASCII form.
+type asciiRulesReader struct {
+	r   *bufio.Reader
+	err error
+	buf string
+}
+
+// newASCIIRulesReader returns a new properly initialized *asciiRulesReader.
+func newASCIIRulesReader(r io.Reader) (ar *asciiRulesReader) {
+	return &asciiRulesReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// type check
+var _ io.Reader = (*asciiRulesReader)(nil)
+
+// Read implements the [io.Reader] interface for *asciiRulesReader.
+func (ar *asciiRulesReader) Read(p []byte) (n int, err error) {
+	for ar.buf == "" {
+		if ar.err != nil {
+			return 0, ar.err
+		}
+
+		var line string
+		line, ar.err = ar.r.ReadString('\n')
+		ar.buf = ruleToASCII(line)
+	}
+
+	n = copy(p, ar.buf)
+	ar.buf = ar.buf[n:]
+
+	return n, nil
+}
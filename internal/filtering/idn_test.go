@@ -0,0 +1,69 @@
+package filtering
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleToASCII(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule string
+		want string
+	}{{
+		name: "ascii",
+		rule: "||Example.ORG^",
+		want: "||Example.ORG^",
+	}, {
+		name: "adblock",
+		rule: "||ПРИМЕР.рф^",
+		want: "||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "allowlist",
+		rule: "@@||пример.рф^$important",
+		want: "@@||xn--e1afmkfd.xn--p1ai^$important",
+	}, {
+		name: "hosts",
+		rule: "0.0.0.0 пример.рф",
+		want: "0.0.0.0 xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "wildcard",
+		rule: "*.пример.рф",
+		want: "*.xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "modifier",
+		rule: "||пример.рф^$client=Клиент",
+		want: "||xn--e1afmkfd.xn--p1ai^$client=Клиент",
+	}, {
+		name: "comment",
+		rule: "! пример.рф",
+		want: "! пример.рф",
+	}, {
+		name: "regexp",
+		rule: "/пример/",
+		want: "/пример/",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ruleToASCII(tc.rule))
+		})
+	}
+}
+
+func TestASCIIRulesReader(t *testing.T) {
+	const (
+		text = "! Title\n||пример.рф^\n||example.org^\n0.0.0.0 испытание.рф"
+		want = "! Title\n||xn--e1afmkfd.xn--p1ai^\n||example.org^\n0.0.0.0 xn--80akhbyknj4f.xn--p1ai"
+	)
+
+	b, err := io.ReadAll(newASCIIRulesReader(strings.NewReader(text)))
+	require.NoError(t, err)
+
+	assert.Equal(t, want, string(b))
+	assert.Equal(t, want, rulesToASCII(text))
+}
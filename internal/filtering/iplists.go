@@ -0,0 +1,504 @@
+package filtering
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+// IPListAction is the action performed on the responses containing the
+// addresses from an IP list.
+type IPListAction string
+
+// IPListAction values.
+const (
+	// IPListActionBlock means that the response is blocked.
+	IPListActionBlock IPListAction = "block"
+
+	// IPListActionFlag means that the response is passed to the client as
+	// is, but the match is recorded in the query log.
+	IPListActionFlag IPListAction = "flag"
+)
+
+// IPListYAML is an IP reputation list in the configuration file.  The list
+// contains networks in CIDR notation or IP addresses, one per line.  For the
+// MaxMind-style CSV files only the first column is used.
+type IPListYAML struct {
+	// URL is the URL or the absolute file path of the list.
+	URL string `yaml:"url"`
+
+	// Name is the human-readable name of the list.
+	Name string `yaml:"name"`
+
+	// Action is the action performed on the matched responses.  The empty
+	// value is treated as [IPListActionBlock].
+	Action IPListAction `yaml:"action"`
+
+	// ID is the unique identifier of the list.  It's assigned automatically
+	// if not set.
+	ID int64 `yaml:"id"`
+
+	// Enabled defines if the list is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// ipList is a loaded IP reputation list.
+type ipList struct {
+	// lastUpdated is the time of the last successful update of the list.
+	lastUpdated time.Time
+
+	// nets are the networks of the list grouped by the prefix length.
+	nets map[int]map[netip.Prefix]struct{}
+
+	// conf is the configuration of the list.
+	conf IPListYAML
+
+	// count is the number of networks in the list.
+	count int
+
+	// hits is the number of responses matched by the list since the start.
+	// It must be accessed atomically.
+	hits uint64
+}
+
+// path returns the path to the cached copy of the list in dataDir.
+func (conf *IPListYAML) path(dataDir string) (p string) {
+	return filepath.Join(dataDir, filterDir, "iplist_"+strconv.FormatInt(conf.ID, 10)+".txt")
+}
+
+// parseIPListLine returns the network from the line of an IP list.  ok is
+// false if the line doesn't contain a valid network, for example, if it's a
+// comment or a CSV header.
+func parseIPListLine(line string) (p netip.Prefix, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' {
+		return netip.Prefix{}, false
+	}
+
+	// Only use the first column of the CSV lists.
+	field, _, _ := strings.Cut(line, ",")
+	field = strings.Trim(strings.TrimSpace(field), `"`)
+
+	p, err := netip.ParsePrefix(field)
+	if err == nil {
+		return p.Masked(), true
+	}
+
+	addr, err := netip.ParseAddr(field)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// parseIPList reads the networks from r.
+func parseIPList(r io.Reader) (nets map[int]map[netip.Prefix]struct{}, count int, err error) {
+	nets = map[int]map[netip.Prefix]struct{}{}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		p, ok := parseIPListLine(s.Text())
+		if !ok {
+			continue
+		}
+
+		// Store the IPv4 networks as IPv4-mapped IPv6 ones to look up both
+		// kinds of addresses the same way.
+		if p.Addr().Is4() {
+			p = netip.PrefixFrom(netip.AddrFrom16(p.Addr().As16()), p.Bits()+96)
+		}
+
+		byLen, ok := nets[p.Bits()]
+		if !ok {
+			byLen = map[netip.Prefix]struct{}{}
+			nets[p.Bits()] = byLen
+		}
+
+		if _, ok = byLen[p]; !ok {
+			byLen[p] = struct{}{}
+			count++
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, 0, fmt.Errorf("reading list: %w", err)
+	}
+
+	return nets, count, nil
+}
+
+// match returns the network from l which contains addr, which must be an
+// IPv6 or an IPv4-mapped IPv6 address.
+func (l *ipList) match(addr netip.Addr) (p netip.Prefix, ok bool) {
+	for bits, byLen := range l.nets {
+		p, _ = addr.Prefix(bits)
+		if _, ok = byLen[p]; ok {
+			return p, true
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+// ipLists is the set of the loaded IP reputation lists.
+type ipLists struct {
+	// mu protects lists.
+	mu *sync.RWMutex
+
+	// lists are the loaded enabled lists.
+	lists []*ipList
+}
+
+// ipListHitRule returns the text of the rule describing a match of the network
+// p from the IP list.
+func ipListHitRule(p netip.Prefix) (text string) {
+	if p.Addr().Is4In6() {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+
+	return p.String()
+}
+
+// CheckIPLists checks if ip is in one of the enabled IP reputation lists.  If
+// it is, res contains the matched list and network.  res.IsFiltered is true if
+// the action of the list is [IPListActionBlock].
+func (d *DNSFilter) CheckIPLists(ip net.IP) (res Result, ok bool) {
+	if d.ipLists == nil {
+		return Result{}, false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Result{}, false
+	}
+
+	addr = netip.AddrFrom16(addr.As16())
+
+	d.ipLists.mu.RLock()
+	defer d.ipLists.mu.RUnlock()
+
+	for _, l := range d.ipLists.lists {
+		p, matched := l.match(addr)
+		if !matched {
+			continue
+		}
+
+		atomic.AddUint64(&l.hits, 1)
+
+		res = Result{
+			Rules: []*ResultRule{{
+				Text:         ipListHitRule(p),
+				IP:           ip,
+				FilterListID: l.conf.ID,
+			}},
+			Reason:     FilteredBlockList,
+			IsFiltered: true,
+		}
+
+		if l.conf.Action == IPListActionFlag {
+			// Keep the matched rule for the query log, but don't count the
+			// request as blocked.
+			res.Reason, res.IsFiltered = NotFilteredNotFound, false
+		}
+
+		return res, true
+	}
+
+	return Result{}, false
+}
+
+// initIPLists assigns the IDs to the configured IP lists and loads their cached
+// copies.
+func (d *DNSFilter) initIPLists() {
+	for i := range d.IPLists {
+		if d.IPLists[i].ID > nextFilterID {
+			nextFilterID = d.IPLists[i].ID + 1
+		}
+	}
+
+	for i := range d.IPLists {
+		if d.IPLists[i].ID == 0 {
+			d.IPLists[i].ID = assignUniqueFilterID()
+		}
+	}
+
+	d.ipLists = &ipLists{
+		mu: &sync.RWMutex{},
+	}
+
+	for _, conf := range d.IPLists {
+		if !conf.Enabled {
+			continue
+		}
+
+		switch conf.Action {
+		case "", IPListActionBlock, IPListActionFlag:
+			// Go on.
+		default:
+			log.Error("filtering: ip list %d: unknown action %q", conf.ID, conf.Action)
+
+			continue
+		}
+
+		l, err := d.loadIPList(conf)
+		if err != nil {
+			log.Error("filtering: loading ip list %d: %s", conf.ID, err)
+
+			continue
+		}
+
+		d.ipLists.lists = append(d.ipLists.lists, l)
+	}
+}
+
+// loadIPList loads the cached copy of the IP list.  It returns an empty list if
+// there is no cached copy.
+func (d *DNSFilter) loadIPList(conf IPListYAML) (l *ipList, err error) {
+	l = &ipList{
+		nets: map[int]map[netip.Prefix]struct{}{},
+		conf: conf,
+	}
+
+	f, err := os.Open(conf.path(d.DataDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("getting file stat: %w", err)
+	}
+
+	l.nets, l.count, err = parseIPList(f)
+	if err != nil {
+		return nil, err
+	}
+
+	l.lastUpdated = st.ModTime()
+
+	return l, nil
+}
+
+// maxIPListSize is the maximum size of the contents of an IP list.  The larger
+// lists are considered invalid.
+const maxIPListSize = 64 * 1024 * 1024
+
+// fetchIPList returns the contents of the IP list from its source.  The
+// contents larger than maxIPListSize are rejected.
+func (d *DNSFilter) fetchIPList(conf IPListYAML) (data []byte, err error) {
+	var r io.ReadCloser
+	if filepath.IsAbs(conf.URL) {
+		r, err = os.Open(conf.URL)
+		if err != nil {
+			return nil, fmt.Errorf("opening file: %w", err)
+		}
+	} else {
+		var resp *http.Response
+		resp, err = d.HTTPClient.Get(conf.URL)
+		if err != nil {
+			return nil, fmt.Errorf("requesting: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+
+			return nil, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+		}
+
+		r = resp.Body
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	lr, err := aghio.LimitReader(r, maxIPListSize)
+	if err != nil {
+		// Don't wrap the error since it's an internal error.
+		return nil, err
+	}
+
+	// This use of ReadAll is safe, because the reader is limited.
+	data, err = io.ReadAll(lr)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	return data, nil
+}
+
+// updateIPList downloads the IP list, saves it to the cached copy, and returns
+// the loaded list.
+func (d *DNSFilter) updateIPList(conf IPListYAML) (l *ipList, err error) {
+	data, err := d.fetchIPList(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	l = &ipList{
+		lastUpdated: time.Now(),
+		conf:        conf,
+	}
+
+	l.nets, l.count, err = parseIPList(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	} else if l.count == 0 {
+		return nil, errNoRules
+	}
+
+	err = os.WriteFile(conf.path(d.DataDir), data, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("saving list: %w", err)
+	}
+
+	return l, nil
+}
+
+// refreshIPLists updates the enabled IP lists which are older than the update
+// interval or all of them if force is true.  The lists which have never been
+// downloaded are updated even if the updates are disabled.  It returns the
+// number of the updated lists.
+func (d *DNSFilter) refreshIPLists(force bool) (updated int) {
+	d.confLock.RLock()
+	ivl := time.Duration(d.FiltersUpdateIntervalHours) * time.Hour
+	d.confLock.RUnlock()
+
+	d.ipLists.mu.RLock()
+	toUpd := make([]*ipList, 0, len(d.ipLists.lists))
+	for _, l := range d.ipLists.lists {
+		if force || l.lastUpdated.IsZero() || (ivl > 0 && time.Since(l.lastUpdated) >= ivl) {
+			toUpd = append(toUpd, l)
+		}
+	}
+	d.ipLists.mu.RUnlock()
+
+	for _, old := range toUpd {
+		l, err := d.updateIPList(old.conf)
+		if err != nil {
+			log.Info("filtering: updating ip list %d from %q: %s", old.conf.ID, old.conf.URL, err)
+
+			continue
+		}
+
+		log.Info("filtering: updated ip list %d: %d networks", l.conf.ID, l.count)
+
+		d.ipLists.mu.Lock()
+		i := slices.Index(d.ipLists.lists, old)
+		if i >= 0 {
+			l.hits = atomic.LoadUint64(&old.hits)
+			d.ipLists.lists[i] = l
+			updated++
+		}
+		d.ipLists.mu.Unlock()
+	}
+
+	return updated
+}
+
+// periodicallyRefreshIPLists updates the IP lists once in a while until done is
+// closed.
+func (d *DNSFilter) periodicallyRefreshIPLists(done <-chan struct{}) {
+	defer log.OnPanic("filtering: refreshing ip lists")
+
+	d.refreshIPLists(false)
+
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			d.refreshIPLists(false)
+		case <-done:
+			log.Debug("filtering: stopped refreshing ip lists")
+
+			return
+		}
+	}
+}
+
+// ipListJSON is the JSON representation of an IP list.
+type ipListJSON struct {
+	LastUpdated string       `json:"last_updated,omitempty"`
+	URL         string       `json:"url"`
+	Name        string       `json:"name"`
+	Action      IPListAction `json:"action"`
+	ID          int64        `json:"id"`
+	NetsCount   int          `json:"nets_count"`
+	Hits        uint64       `json:"hits"`
+}
+
+// ipListsStatusResp is the response to the GET /control/ip_lists/status HTTP
+// API.
+type ipListsStatusResp struct {
+	Lists []*ipListJSON `json:"lists"`
+}
+
+// handleIPListsStatus is the handler for the GET /control/ip_lists/status HTTP
+// API.
+func (d *DNSFilter) handleIPListsStatus(w http.ResponseWriter, r *http.Request) {
+	d.ipLists.mu.RLock()
+	defer d.ipLists.mu.RUnlock()
+
+	resp := &ipListsStatusResp{
+		Lists: make([]*ipListJSON, 0, len(d.ipLists.lists)),
+	}
+
+	for _, l := range d.ipLists.lists {
+		lj := &ipListJSON{
+			URL:       l.conf.URL,
+			Name:      l.conf.Name,
+			Action:    l.conf.Action,
+			ID:        l.conf.ID,
+			NetsCount: l.count,
+			Hits:      atomic.LoadUint64(&l.hits),
+		}
+
+		if lj.Action == "" {
+			lj.Action = IPListActionBlock
+		}
+
+		if !l.lastUpdated.IsZero() {
+			lj.LastUpdated = l.lastUpdated.Format(time.RFC3339)
+		}
+
+		resp.Lists = append(resp.Lists, lj)
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// ipListsRefreshResp is the response to the POST /control/ip_lists/refresh
+// HTTP API.
+type ipListsRefreshResp struct {
+	Updated int `json:"updated"`
+}
+
+// handleIPListsRefresh is the handler for the POST /control/ip_lists/refresh
+// HTTP API.
+func (d *DNSFilter) handleIPListsRefresh(w http.ResponseWriter, r *http.Request) {
+	resp := &ipListsRefreshResp{
+		Updated: d.refreshIPLists(true),
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
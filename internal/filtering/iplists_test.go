@@ -0,0 +1,197 @@
+package filtering
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPListLine(t *testing.T) {
+	testCases := []struct {
+		name   string
+		line   string
+		want   netip.Prefix
+		wantOK bool
+	}{{
+		name:   "cidr",
+		line:   "1.2.3.0/24",
+		want:   netip.MustParsePrefix("1.2.3.0/24"),
+		wantOK: true,
+	}, {
+		name:   "cidr_unmasked",
+		line:   "1.2.3.4/24",
+		want:   netip.MustParsePrefix("1.2.3.0/24"),
+		wantOK: true,
+	}, {
+		name:   "ip",
+		line:   "  2001:db8::1  ",
+		want:   netip.MustParsePrefix("2001:db8::1/128"),
+		wantOK: true,
+	}, {
+		name:   "csv",
+		line:   `"5.6.0.0/16",2017370,2017370,,0,0`,
+		want:   netip.MustParsePrefix("5.6.0.0/16"),
+		wantOK: true,
+	}, {
+		name:   "csv_header",
+		line:   "network,geoname_id,registered_country_geoname_id",
+		wantOK: false,
+	}, {
+		name:   "comment",
+		line:   "# 1.2.3.4",
+		wantOK: false,
+	}, {
+		name:   "empty",
+		line:   "",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, ok := parseIPListLine(tc.line)
+			require.Equal(t, tc.wantOK, ok)
+
+			assert.Equal(t, tc.want, p)
+		})
+	}
+}
+
+func TestDNSFilter_CheckIPLists(t *testing.T) {
+	dir := t.TempDir()
+
+	blockPath := filepath.Join(dir, "block.csv")
+	err := os.WriteFile(blockPath, []byte("network,geoname_id\n1.2.3.0/24,1\n2001:db8::/32,2\n"), 0o644)
+	require.NoError(t, err)
+
+	flagPath := filepath.Join(dir, "flag.txt")
+	err = os.WriteFile(flagPath, []byte("# Flagged.\n5.6.7.8\n"), 0o644)
+	require.NoError(t, err)
+
+	d, _ := newForTest(t, &Config{
+		DataDir: dir,
+		IPLists: []IPListYAML{{
+			URL:     blockPath,
+			Name:    "Block",
+			Enabled: true,
+		}, {
+			URL:     flagPath,
+			Name:    "Flag",
+			Action:  IPListActionFlag,
+			Enabled: true,
+		}, {
+			URL:     flagPath,
+			Name:    "Disabled",
+			Enabled: false,
+		}},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	require.Len(t, d.ipLists.lists, 2)
+
+	blockID, flagID := d.IPLists[0].ID, d.IPLists[1].ID
+	require.NotZero(t, blockID)
+	require.NotZero(t, flagID)
+	require.NotEqual(t, blockID, flagID)
+
+	// The lists haven't been downloaded yet.
+	_, ok := d.CheckIPLists(net.IP{1, 2, 3, 4})
+	require.False(t, ok)
+
+	require.Equal(t, 2, d.refreshIPLists(false))
+
+	testCases := []struct {
+		name       string
+		ip         net.IP
+		wantRule   string
+		wantListID int64
+		wantOK     bool
+		wantBlock  bool
+	}{{
+		name:       "block_v4",
+		ip:         net.IP{1, 2, 3, 4},
+		wantRule:   "1.2.3.0/24",
+		wantListID: blockID,
+		wantOK:     true,
+		wantBlock:  true,
+	}, {
+		name:       "block_v6",
+		ip:         net.ParseIP("2001:db8::1"),
+		wantRule:   "2001:db8::/32",
+		wantListID: blockID,
+		wantOK:     true,
+		wantBlock:  true,
+	}, {
+		name:       "flag",
+		ip:         net.IP{5, 6, 7, 8},
+		wantRule:   "5.6.7.8/32",
+		wantListID: flagID,
+		wantOK:     true,
+		wantBlock:  false,
+	}, {
+		name:   "none",
+		ip:     net.IP{5, 6, 7, 9},
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, matched := d.CheckIPLists(tc.ip)
+			require.Equal(t, tc.wantOK, matched)
+
+			if !tc.wantOK {
+				return
+			}
+
+			assert.Equal(t, tc.wantBlock, res.IsFiltered)
+
+			require.Len(t, res.Rules, 1)
+
+			assert.Equal(t, tc.wantRule, res.Rules[0].Text)
+			assert.Equal(t, tc.wantListID, res.Rules[0].FilterListID)
+		})
+	}
+
+	assert.Equal(t, uint64(2), d.ipLists.lists[0].hits)
+	assert.Equal(t, uint64(1), d.ipLists.lists[1].hits)
+
+	// The cached copies are loaded on start.
+	d2, _ := newForTest(t, &Config{
+		DataDir: dir,
+		IPLists: d.IPLists,
+	}, nil)
+	t.Cleanup(d2.Close)
+
+	_, ok = d2.CheckIPLists(net.IP{1, 2, 3, 4})
+	assert.True(t, ok)
+}
+
+func TestDNSFilter_periodicallyRefreshIPLists_close(t *testing.T) {
+	d, _ := newForTest(t, &Config{
+		DataDir: t.TempDir(),
+	}, nil)
+
+	done := make(chan struct{})
+	d.done = done
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		d.periodicallyRefreshIPLists(done)
+	}()
+
+	d.Close()
+
+	select {
+	case <-stopped:
+		// Go on.
+	case <-time.After(time.Second):
+		t.Fatal("refreshing ip lists wasn't stopped")
+	}
+}
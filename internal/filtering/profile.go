@@ -0,0 +1,57 @@
+package filtering
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// ProfileSettings are the global filtering settings, which are switched
+// together by a configuration profile.
+type ProfileSettings struct {
+	// BlockedServices are the names of the globally blocked services.
+	BlockedServices []string `yaml:"blocked_services" json:"blocked_services"`
+
+	// FilteringEnabled defines if the filter lists are used.
+	FilteringEnabled bool `yaml:"filtering_enabled" json:"filtering_enabled"`
+
+	// ParentalEnabled defines if the parental control is enabled.
+	ParentalEnabled bool `yaml:"parental_enabled" json:"parental_enabled"`
+
+	// SafeSearchEnabled defines if the safe search is enforced.
+	SafeSearchEnabled bool `yaml:"safesearch_enabled" json:"safesearch_enabled"`
+
+	// SafeBrowsingEnabled defines if the safe browsing is enabled.
+	SafeBrowsingEnabled bool `yaml:"safebrowsing_enabled" json:"safebrowsing_enabled"`
+}
+
+// ProfileSettings returns the current global filtering settings.
+func (d *DNSFilter) ProfileSettings() (s *ProfileSettings) {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+
+	return &ProfileSettings{
+		BlockedServices:     slices.Clone(d.Config.BlockedServices),
+		FilteringEnabled:    d.Config.FilteringEnabled,
+		ParentalEnabled:     d.Config.ParentalEnabled,
+		SafeSearchEnabled:   d.Config.SafeSearchEnabled,
+		SafeBrowsingEnabled: d.Config.SafeBrowsingEnabled,
+	}
+}
+
+// SetProfileSettings sets the global filtering settings to s.
+func (d *DNSFilter) SetProfileSettings(s *ProfileSettings) {
+	func() {
+		d.confLock.Lock()
+		defer d.confLock.Unlock()
+
+		d.Config.BlockedServices = slices.Clone(s.BlockedServices)
+		d.Config.ParentalEnabled = s.ParentalEnabled
+		d.Config.SafeSearchEnabled = s.SafeSearchEnabled
+		d.Config.SafeBrowsingEnabled = s.SafeBrowsingEnabled
+	}()
+
+	d.filtersMu.Lock()
+	defer d.filtersMu.Unlock()
+
+	d.Config.FilteringEnabled = s.FilteringEnabled
+	d.SetEnabled(s.FilteringEnabled)
+}
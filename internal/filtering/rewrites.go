@@ -3,7 +3,6 @@
 package filtering
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -80,7 +79,7 @@ func (rw *LegacyRewrite) normalize() (err error) {
 	// TODO(a.garipov): Write a case-agnostic version of strings.HasSuffix and
 	// use it in matchDomainWildcard instead of using strings.ToLower
 	// everywhere.
-	rw.Domain = strings.ToLower(rw.Domain)
+	rw.Domain = toASCII(strings.ToLower(rw.Domain))
 
 	switch rw.Answer {
 	case "AAAA":
@@ -99,6 +98,7 @@ func (rw *LegacyRewrite) normalize() (err error) {
 
 	ip := net.ParseIP(rw.Answer)
 	if ip == nil {
+		rw.Answer = toASCII(strings.ToLower(rw.Answer))
 		rw.Type = dns.TypeCNAME
 
 		return nil
@@ -232,10 +232,14 @@ func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 
 	d.confLock.Lock()
 	for _, ent := range d.Config.Rewrites {
+		// Show the internationalized domain names in the Unicode form.
 		jsent := rewriteEntryJSON{
-			Domain: ent.Domain,
+			Domain: toUnicode(ent.Domain),
 			Answer: ent.Answer,
 		}
+		if ent.Type == dns.TypeCNAME {
+			jsent.Answer = toUnicode(ent.Answer)
+		}
 		arr = append(arr, &jsent)
 	}
 	d.confLock.Unlock()
@@ -245,7 +249,7 @@ func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 
 func (d *DNSFilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 	rwJSON := rewriteEntryJSON{}
-	err := json.NewDecoder(r.Body).Decode(&rwJSON)
+	err := aghhttp.DecodeJSON(r, &rwJSON)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 
@@ -276,7 +280,7 @@ func (d *DNSFilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 
 func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request) {
 	jsent := rewriteEntryJSON{}
-	err := json.NewDecoder(r.Body).Decode(&jsent)
+	err := aghhttp.DecodeJSON(r, &jsent)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 
@@ -287,6 +291,15 @@ func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 		Domain: jsent.Domain,
 		Answer: jsent.Answer,
 	}
+
+	err = entDel.normalize()
+	if err != nil {
+		// Shouldn't happen currently, since normalize only returns a non-nil
+		// error when a rewrite is nil, but be change-proof.
+		aghhttp.Error(r, w, http.StatusBadRequest, "normalizing: %s", err)
+
+		return
+	}
 	arr := []*LegacyRewrite{}
 
 	d.confLock.Lock()
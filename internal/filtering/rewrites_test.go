@@ -69,6 +69,13 @@ func TestRewrites(t *testing.T) {
 	}, {
 		Domain: "*.issue4016.com",
 		Answer: "sub.issue4016.com",
+	}, {
+		// This one and below are about internationalized domain names.
+		Domain: "*.ПРИМЕР.рф",
+		Answer: "испытание.рф",
+	}, {
+		Domain: "xn--80akhbyknj4f.xn--p1ai",
+		Answer: "1.2.3.8",
 	}}
 
 	require.NoError(t, d.prepareRewrites())
@@ -171,6 +178,13 @@ func TestRewrites(t *testing.T) {
 		wantIPs:    nil,
 		wantReason: NotFilteredNotFound,
 		dtyp:       dns.TypeA,
+	}, {
+		name:       "idn",
+		host:       "www.xn--e1afmkfd.xn--p1ai",
+		wantCName:  "xn--80akhbyknj4f.xn--p1ai",
+		wantIPs:    []net.IP{{1, 2, 3, 8}},
+		wantReason: Rewritten,
+		dtyp:       dns.TypeA,
 	}}
 
 	for _, tc := range testCases {
@@ -0,0 +1,226 @@
+package filtering
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"golang.org/x/exp/slices"
+)
+
+// Pagination limits of the user rules HTTP API.
+const (
+	defaultRulesPageLimit = 100
+	maxRulesPageLimit     = 1000
+)
+
+// userRulesETag returns the entity tag of the user rules, which changes each
+// time the rules are changed.
+func userRulesETag(rules []string) (etag string) {
+	h := sha256.New()
+	for _, r := range rules {
+		_, _ = h.Write([]byte(r))
+		_, _ = h.Write([]byte{'\n'})
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// userRuleJSON is a single user rule along with its index.
+type userRuleJSON struct {
+	Text  string `json:"text"`
+	Index int    `json:"index"`
+}
+
+// userRulesPageJSON is the page of the user rules.
+type userRulesPageJSON struct {
+	Rules []*userRuleJSON `json:"rules"`
+	Total int             `json:"total"`
+}
+
+// parsePageParam parses the non-negative integer query parameter name.  It
+// returns def if the parameter is absent.
+func parsePageParam(r *http.Request, name string, def int) (n int, err error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+
+	n, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %w", name, err)
+	} else if n < 0 {
+		return 0, fmt.Errorf("bad %s: %d is negative", name, n)
+	}
+
+	return n, nil
+}
+
+// handleUserRulesGet is the handler for the GET /control/filtering/rules HTTP
+// API.  It responds with a page of the user rules and their entity tag.
+func (d *DNSFilter) handleUserRulesGet(w http.ResponseWriter, r *http.Request) {
+	offset, err := parsePageParam(r, "offset", 0)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	limit, err := parsePageParam(r, "limit", defaultRulesPageLimit)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	} else if limit > maxRulesPageLimit {
+		aghhttp.Error(r, w, http.StatusBadRequest, "limit must not exceed %d", maxRulesPageLimit)
+
+		return
+	}
+
+	d.filtersMu.RLock()
+	rules := d.UserRules
+	resp := &userRulesPageJSON{
+		Rules: []*userRuleJSON{},
+		Total: len(rules),
+	}
+
+	for i := offset; i < len(rules) && i < offset+limit; i++ {
+		resp.Rules = append(resp.Rules, &userRuleJSON{
+			Text:  rules[i],
+			Index: i,
+		})
+	}
+
+	etag := userRulesETag(rules)
+	d.filtersMu.RUnlock()
+
+	w.Header().Set("ETag", etag)
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// userRulesAddReq is the request for the POST /control/filtering/rules/add
+// HTTP API.
+type userRulesAddReq struct {
+	Rules []string `json:"rules"`
+}
+
+// handleUserRulesAdd is the handler for the POST /control/filtering/rules/add
+// HTTP API.  It appends the rules to the user rules.
+func (d *DNSFilter) handleUserRulesAdd(w http.ResponseWriter, r *http.Request) {
+	req := &userRulesAddReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	d.modifyUserRules(w, r, false, func(rules []string) (upd []string, err error) {
+		return append(slices.Clip(rules), req.Rules...), nil
+	})
+}
+
+// userRulesDeleteReq is the request for the POST
+// /control/filtering/rules/delete HTTP API.
+type userRulesDeleteReq struct {
+	Indexes []int `json:"indexes"`
+}
+
+// handleUserRulesDelete is the handler for the POST
+// /control/filtering/rules/delete HTTP API.  It removes the user rules with the
+// given indexes.  Since the indexes of the rules change after each
+// modification, the entity tag of the rules is required.
+func (d *DNSFilter) handleUserRulesDelete(w http.ResponseWriter, r *http.Request) {
+	req := &userRulesDeleteReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	d.modifyUserRules(w, r, true, func(rules []string) (upd []string, err error) {
+		del := make([]bool, len(rules))
+		for _, i := range req.Indexes {
+			if i < 0 || i >= len(rules) {
+				return nil, fmt.Errorf("index %d out of range [0, %d)", i, len(rules))
+			}
+
+			del[i] = true
+		}
+
+		upd = make([]string, 0, len(rules))
+		for i, rule := range rules {
+			if !del[i] {
+				upd = append(upd, rule)
+			}
+		}
+
+		return upd, nil
+	})
+}
+
+// modifyUserRules replaces the user rules with the result of modify, if the
+// request's If-Match header matches their current entity tag.  If etagRequired
+// is true, the header must be present.  It responds with the new entity tag.
+func (d *DNSFilter) modifyUserRules(
+	w http.ResponseWriter,
+	r *http.Request,
+	etagRequired bool,
+	modify func(rules []string) (upd []string, err error),
+) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" && etagRequired {
+		aghhttp.Error(r, w, http.StatusPreconditionRequired, "If-Match header is required")
+
+		return
+	}
+
+	d.filtersMu.Lock()
+	rules := d.UserRules
+	if ifMatch != "" && ifMatch != userRulesETag(rules) {
+		d.filtersMu.Unlock()
+		aghhttp.Error(r, w, http.StatusPreconditionFailed, "user rules have been modified")
+
+		return
+	}
+
+	upd, err := modify(rules)
+	if err != nil {
+		d.filtersMu.Unlock()
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	d.UserRules = upd
+	etag := userRulesETag(upd)
+	d.filtersMu.Unlock()
+
+	d.ConfigModified()
+	d.EnableFilters(true)
+
+	w.Header().Set("ETag", etag)
+}
+
+// AddUserRules appends rules to the user rules, skipping the ones already
+// present, and applies them.
+func (d *DNSFilter) AddUserRules(rules ...string) {
+	d.filtersMu.Lock()
+	upd := slices.Clip(d.UserRules)
+	for _, rule := range rules {
+		if !slices.Contains(upd, rule) {
+			upd = append(upd, rule)
+		}
+	}
+
+	d.UserRules = upd
+	d.filtersMu.Unlock()
+
+	d.ConfigModified()
+	d.EnableFilters(true)
+}
@@ -0,0 +1,98 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_userRulesHTTP(t *testing.T) {
+	d, _ := newForTest(t, &Config{ConfigModified: func() {}}, nil)
+	t.Cleanup(d.Close)
+
+	d.UserRules = []string{"||first.example^", "||second.example^", "||third.example^"}
+
+	// The filters initializer isn't started, so drain its tasks manually.
+	d.filtersInitializerChan = make(chan filtersInitializerParams, 1)
+
+	getPage := func(t *testing.T, query string) (page *userRulesPageJSON, etag string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/control/filtering/rules?"+query, nil)
+		d.handleUserRulesGet(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		page = &userRulesPageJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(page))
+
+		return page, w.Header().Get("ETag")
+	}
+
+	post := func(h http.HandlerFunc, body any, etag string) (w *httptest.ResponseRecorder) {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		if etag != "" {
+			r.Header.Set("If-Match", etag)
+		}
+
+		h(w, r)
+
+		select {
+		case <-d.filtersInitializerChan:
+		default:
+		}
+
+		return w
+	}
+
+	page, etag := getPage(t, "offset=1&limit=1")
+	require.Len(t, page.Rules, 1)
+	require.NotEmpty(t, etag)
+
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, &userRuleJSON{Text: "||second.example^", Index: 1}, page.Rules[0])
+
+	t.Run("delete_no_etag", func(t *testing.T) {
+		w := post(d.handleUserRulesDelete, &userRulesDeleteReq{Indexes: []int{1}}, "")
+		assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := post(d.handleUserRulesDelete, &userRulesDeleteReq{Indexes: []int{1}}, etag)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		newETag := w.Header().Get("ETag")
+		assert.NotEqual(t, etag, newETag)
+		assert.Equal(t, []string{"||first.example^", "||third.example^"}, d.UserRules)
+	})
+
+	t.Run("stale_etag", func(t *testing.T) {
+		w := post(d.handleUserRulesAdd, &userRulesAddReq{Rules: []string{"||fourth.example^"}}, etag)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("add", func(t *testing.T) {
+		w := post(d.handleUserRulesAdd, &userRulesAddReq{Rules: []string{"||fourth.example^"}}, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		page, etag = getPage(t, "")
+		require.Len(t, page.Rules, 3)
+
+		assert.Equal(t, w.Header().Get("ETag"), etag)
+		assert.Equal(t, "||fourth.example^", page.Rules[2].Text)
+	})
+
+	t.Run("bad_index", func(t *testing.T) {
+		w := post(d.handleUserRulesDelete, &userRulesDeleteReq{Indexes: []int{3}}, etag)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
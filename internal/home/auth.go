@@ -4,7 +4,6 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -79,6 +78,12 @@ type Auth struct {
 type webUser struct {
 	Name         string `yaml:"name"`
 	PasswordHash string `yaml:"password"`
+
+	// Clients are the names of the persistent clients the user administers.
+	// If it's empty, the user administers everything.  Otherwise, the user
+	// may only view and modify the settings and the query log of these
+	// clients.
+	Clients []string `yaml:"clients,omitempty"`
 }
 
 // InitAuth - create a global object
@@ -413,7 +418,7 @@ func realIP(r *http.Request) (ip net.IP, err error) {
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	req := loginJSON{}
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := aghhttp.DecodeJSON(r, &req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
 
@@ -583,6 +588,12 @@ func optionalAuth(
 			if optionalAuthThird(w, r) {
 				return
 			}
+
+			var ok bool
+			r, ok = restrictDelegated(w, r)
+			if !ok {
+				return
+			}
 		}
 
 		h(w, r)
@@ -0,0 +1,300 @@
+package home
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// captiveDNSPort is the port the captive DNS server listens on.
+	captiveDNSPort = 53
+
+	// captiveHTTPPort is the port of the HTTP server redirecting to the setup
+	// page.
+	captiveHTTPPort = 80
+
+	// captiveTTL is the TTL of the captive DNS answers.  It's kept short so
+	// that the clients forget them soon after the setup is finished.
+	captiveTTL = 10
+)
+
+// captiveSetup answers all DNS queries with the address of this host and
+// redirects the plain HTTP requests to the setup page, so that the first-run
+// setup is reachable from a device, which only has its DNS server pointed at
+// this host.  It only listens on the addresses within the private and the
+// link-local networks, so that it isn't an open resolver on the hosts with
+// public addresses.
+type captiveSetup struct {
+	// mu protects the servers.
+	mu *sync.Mutex
+
+	// httpSrv redirects to the setup page.  It's nil if the web interface
+	// already listens on captiveHTTPPort.
+	httpSrv *http.Server
+
+	// dnsSrvs are the DNS servers listening on each interface address.
+	dnsSrvs []*dns.Server
+
+	// webPort is the port of the web interface.
+	webPort int
+}
+
+// newCaptiveSetup returns a new captive setup redirecting to the web interface
+// on webPort.
+func newCaptiveSetup(webPort int) (c *captiveSetup) {
+	return &captiveSetup{
+		mu:      &sync.Mutex{},
+		webPort: webPort,
+	}
+}
+
+// start starts the captive DNS and HTTP servers.  Failures to listen on some
+// of the addresses are logged, since any of them is enough for the setup.
+func (c *captiveSetup) start() (err error) {
+	addrs, err := aghnet.CollectAllIfacesAddrs()
+	if err != nil {
+		return fmt.Errorf("captive setup: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var httpLs []net.Listener
+	for _, a := range addrs {
+		if !isCaptiveAddr(net.ParseIP(a)) {
+			log.Debug("captive setup: skipping non-local address %s", a)
+
+			continue
+		}
+
+		c.listenDNS(net.JoinHostPort(a, strconv.Itoa(captiveDNSPort)))
+		if c.webPort == captiveHTTPPort {
+			continue
+		}
+
+		hostPort := net.JoinHostPort(a, strconv.Itoa(captiveHTTPPort))
+		l, lerr := net.Listen("tcp", hostPort)
+		if lerr != nil {
+			log.Debug("captive setup: listening http on %s: %s", hostPort, lerr)
+		} else {
+			httpLs = append(httpLs, l)
+		}
+	}
+
+	if len(c.dnsSrvs) == 0 {
+		return errors.Error("captive setup: no addresses to listen on")
+	}
+
+	if len(httpLs) > 0 {
+		c.httpSrv = &http.Server{
+			Handler:           http.HandlerFunc(c.redirect),
+			ReadHeaderTimeout: readHdrTimeout,
+		}
+
+		for _, l := range httpLs {
+			go c.serveHTTP(c.httpSrv, l)
+		}
+	}
+
+	log.Info("captive setup: answering dns queries on %d listeners", len(c.dnsSrvs))
+
+	return nil
+}
+
+// isCaptiveAddr returns true if the captive servers may listen on ip, which is
+// the case for the addresses within the private, the link-local, and the
+// loopback networks.
+func isCaptiveAddr(ip net.IP) (ok bool) {
+	return ip != nil && (ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLoopback())
+}
+
+// listenDNS starts the UDP and TCP DNS servers on hostPort.  c.mu is expected
+// to be locked.
+func (c *captiveSetup) listenDNS(hostPort string) {
+	pc, err := net.ListenPacket("udp", hostPort)
+	if err != nil {
+		log.Debug("captive setup: listening udp on %s: %s", hostPort, err)
+	} else {
+		c.serveDNS(&dns.Server{PacketConn: pc, Handler: c})
+	}
+
+	l, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		log.Debug("captive setup: listening tcp on %s: %s", hostPort, err)
+	} else {
+		c.serveDNS(&dns.Server{Listener: l, Handler: c})
+	}
+}
+
+// serveDNS adds srv to the servers and starts it.  c.mu is expected to be
+// locked.
+func (c *captiveSetup) serveDNS(srv *dns.Server) {
+	c.dnsSrvs = append(c.dnsSrvs, srv)
+
+	go func() {
+		defer log.OnPanic("captive setup: serving dns")
+
+		serr := srv.ActivateAndServe()
+		if serr != nil {
+			log.Debug("captive setup: serving dns: %s", serr)
+		}
+	}()
+}
+
+// serveHTTP serves the redirecting HTTP requests accepted by l with srv.
+func (c *captiveSetup) serveHTTP(srv *http.Server, l net.Listener) {
+	defer log.OnPanic("captive setup: serving http")
+
+	err := srv.Serve(l)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Info("captive setup: serving http: %s", err)
+	}
+}
+
+// type check
+var _ dns.Handler = (*captiveSetup)(nil)
+
+// ServeDNS implements the [dns.Handler] interface for *captiveSetup.
+func (c *captiveSetup) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	var localIP net.IP
+	switch a := w.LocalAddr().(type) {
+	case *net.UDPAddr:
+		localIP = a.IP
+	case *net.TCPAddr:
+		localIP = a.IP
+	}
+
+	err := w.WriteMsg(captiveResponse(req, localIP))
+	if err != nil {
+		log.Debug("captive setup: writing response: %s", err)
+	}
+}
+
+// captiveResponse returns the response to req pointing the requested name at
+// ip.  The queries of other types and families are answered with no data.
+func captiveResponse(req *dns.Msg, ip net.IP) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.RecursionAvailable = true
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+
+		return resp
+	}
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    captiveTTL,
+	}
+
+	ip4 := ip.To4()
+	switch {
+	case q.Qtype == dns.TypeA && ip4 != nil:
+		resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+	case q.Qtype == dns.TypeAAAA && ip4 == nil && ip != nil:
+		resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+
+	return resp
+}
+
+// redirect redirects the request to the setup page on the address, on which
+// the request has been received.
+func (c *captiveSetup) redirect(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if laddr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		host = laddr.IP.String()
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	u := "http://" + net.JoinHostPort(host, strconv.Itoa(c.webPort)) + "/install.html"
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// stop stops all the captive servers.  It's safe for concurrent use and does
+// nothing if the servers are already stopped.
+func (c *captiveSetup) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.dnsSrvs) == 0 && c.httpSrv == nil {
+		return
+	}
+
+	for _, srv := range c.dnsSrvs {
+		err := srv.Shutdown()
+		if err != nil {
+			// The server may have not been activated yet, so close its
+			// listener directly.
+			err = closeDNSListener(srv)
+		}
+
+		if err != nil {
+			log.Debug("captive setup: stopping dns server: %s", err)
+		}
+	}
+
+	c.dnsSrvs = nil
+
+	if c.httpSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := c.httpSrv.Shutdown(ctx)
+		if err != nil {
+			log.Debug("captive setup: stopping http server: %s", err)
+		}
+
+		c.httpSrv = nil
+	}
+
+	log.Info("captive setup: stopped")
+}
+
+// closeDNSListener closes the listener of srv.
+func closeDNSListener(srv *dns.Server) (err error) {
+	if srv.PacketConn != nil {
+		return srv.PacketConn.Close()
+	}
+
+	return srv.Listener.Close()
+}
+
+// stopCaptiveSetup stops the captive setup, if it's running.
+func stopCaptiveSetup() {
+	if Context.captive != nil {
+		Context.captive.stop()
+	}
+}
+
+// pauseCaptiveSetup stops the captive setup, if it's running, so that the
+// ports it listens on could be checked or taken.  resume starts it again and
+// must be called unless the setup has been finished successfully.
+func pauseCaptiveSetup() (resume func()) {
+	c := Context.captive
+	if c == nil {
+		return func() {}
+	}
+
+	c.stop()
+
+	return func() {
+		err := c.start()
+		if err != nil {
+			log.Error("restarting captive setup: %s", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptiveResponse(t *testing.T) {
+	ip4 := net.IP{192, 168, 0, 1}
+	ip6 := net.ParseIP("fd00::1")
+
+	testCases := []struct {
+		ip      net.IP
+		want    dns.RR
+		name    string
+		qtype   uint16
+		wantErr bool
+	}{{
+		ip:    ip4,
+		want:  &dns.A{A: ip4.To4()},
+		name:  "a",
+		qtype: dns.TypeA,
+	}, {
+		ip:    ip6,
+		want:  &dns.AAAA{AAAA: ip6},
+		name:  "aaaa",
+		qtype: dns.TypeAAAA,
+	}, {
+		ip:    ip4,
+		want:  nil,
+		name:  "aaaa_on_ipv4",
+		qtype: dns.TypeAAAA,
+	}, {
+		ip:    ip6,
+		want:  nil,
+		name:  "a_on_ipv6",
+		qtype: dns.TypeA,
+	}, {
+		ip:    ip4,
+		want:  nil,
+		name:  "mx",
+		qtype: dns.TypeMX,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("example.org.", tc.qtype)
+			resp := captiveResponse(req, tc.ip)
+
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			if tc.want == nil {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			require.Len(t, resp.Answer, 1)
+
+			ans := resp.Answer[0]
+			assert.Equal(t, uint32(captiveTTL), ans.Header().Ttl)
+			assert.Equal(t, "example.org.", ans.Header().Name)
+
+			switch want := tc.want.(type) {
+			case *dns.A:
+				a, ok := ans.(*dns.A)
+				require.True(t, ok)
+
+				assert.Equal(t, want.A, a.A)
+			case *dns.AAAA:
+				aaaa, ok := ans.(*dns.AAAA)
+				require.True(t, ok)
+
+				assert.Equal(t, want.AAAA, aaaa.AAAA)
+			}
+		})
+	}
+
+	t.Run("no_question", func(t *testing.T) {
+		resp := captiveResponse(&dns.Msg{}, ip4)
+		assert.Equal(t, dns.RcodeFormatError, resp.Rcode)
+	})
+}
+
+func TestCaptiveSetup_redirect(t *testing.T) {
+	c := newCaptiveSetup(3000)
+
+	r := httptest.NewRequest(http.MethodGet, "http://connectivitycheck.example/generate_204", nil)
+	w := httptest.NewRecorder()
+	c.redirect(w, r)
+
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://connectivitycheck.example:3000/install.html", w.Header().Get("Location"))
+}
+
+func TestIsCaptiveAddr(t *testing.T) {
+	testCases := []struct {
+		ip   net.IP
+		name string
+		want bool
+	}{{
+		ip:   net.IP{192, 168, 0, 1},
+		name: "private_ipv4",
+		want: true,
+	}, {
+		ip:   net.ParseIP("fd00::1"),
+		name: "private_ipv6",
+		want: true,
+	}, {
+		ip:   net.IP{169, 254, 0, 1},
+		name: "link_local",
+		want: true,
+	}, {
+		ip:   net.IP{127, 0, 0, 1},
+		name: "loopback",
+		want: true,
+	}, {
+		ip:   net.IP{93, 184, 216, 34},
+		name: "public_ipv4",
+		want: false,
+	}, {
+		ip:   net.ParseIP("2001:db8::1"),
+		name: "public_ipv6",
+		want: false,
+	}, {
+		ip:   nil,
+		name: "nil",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isCaptiveAddr(tc.ip))
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"golang.org/x/exp/slices"
+)
+
+// ClientProvider is a pluggable source of the names of the runtime clients,
+// such as an external inventory system.  The built-in sources, DHCP, ARP, rDNS,
+// and the hosts files, keep filling the index of the runtime clients, and the
+// providers are asked about the clients according to their priorities.
+type ClientProvider interface {
+	// Name returns the name of the provider used in the logs.
+	Name() (name string)
+
+	// Priority returns the priority of the provider.  The built-in sources
+	// have the priorities from 0, WHOIS, to 4, the hosts files, in the order of
+	// the clientSource constants.  The name from the provider is used instead
+	// of the one from the built-in source only if the priority of the provider
+	// is greater.  Among the providers, the one with the greatest priority is
+	// asked first.
+	Priority() (prio int)
+
+	// ClientName returns the name of the client with ip.  ok is false if the
+	// client is unknown to the provider.
+	ClientName(ctx context.Context, ip netip.Addr) (name string, ok bool, err error)
+}
+
+// ClientSourceProvider is the source of the names returned by the
+// [ClientProvider]s.  Those names aren't kept in the index of the runtime
+// clients, so it doesn't take part in the priority of the built-in sources.
+const ClientSourceProvider clientSource = ClientSourceHostsFile + 1
+
+// maxProviderCacheSize is the maximum number of the answers of a single
+// provider kept in its cache.
+const maxProviderCacheSize = 10_000
+
+// providerLookupTimeout is the timeout of a single request to a provider.
+const providerLookupTimeout = 2 * time.Second
+
+// providerAnswer is a cached answer of a provider.
+type providerAnswer struct {
+	// expire is the time, after which the answer is requested again.
+	expire time.Time
+
+	// name is the name of the client, if ok is true.
+	name string
+
+	// ok is true if the client is known to the provider.
+	ok bool
+}
+
+// cachedProvider is a provider with its answers cached for some time.  The
+// unknown clients are cached as well, but the errors aren't.
+type cachedProvider struct {
+	ClientProvider
+
+	// mu protects answers.
+	mu *sync.Mutex
+
+	// answers are the cached answers of the provider.
+	answers map[netip.Addr]*providerAnswer
+
+	// ttl is the time the answers are cached for.  If zero, the answers aren't
+	// cached.
+	ttl time.Duration
+}
+
+// clientName returns the name of the client with ip from the cache or from the
+// provider.
+func (p *cachedProvider) clientName(ip netip.Addr) (name string, ok bool) {
+	now := time.Now()
+
+	p.mu.Lock()
+	a, cached := p.answers[ip]
+	p.mu.Unlock()
+
+	if cached && now.Before(a.expire) {
+		return a.name, a.ok
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), providerLookupTimeout)
+	defer cancel()
+
+	name, ok, err := p.ClientName(ctx, ip)
+	if err != nil {
+		log.Debug("clients: provider %q: looking up %s: %s", p.Name(), ip, err)
+
+		return "", false
+	} else if p.ttl == 0 {
+		return name, ok
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.answers) >= maxProviderCacheSize {
+		// Don't bother with evicting the least recently used answers, since the
+		// number of clients is usually far less than the limit.
+		p.answers = map[netip.Addr]*providerAnswer{}
+	}
+
+	p.answers[ip] = &providerAnswer{
+		expire: now.Add(p.ttl),
+		name:   name,
+		ok:     ok,
+	}
+
+	return name, ok
+}
+
+// AddProvider registers the pluggable source of the names of the runtime
+// clients.  The answers of p are cached for ttl, if it's not zero.
+func (clients *clientsContainer) AddProvider(p ClientProvider, ttl time.Duration) {
+	clients.providersLock.Lock()
+	defer clients.providersLock.Unlock()
+
+	clients.providers = append(clients.providers, &cachedProvider{
+		ClientProvider: p,
+		mu:             &sync.Mutex{},
+		answers:        map[netip.Addr]*providerAnswer{},
+		ttl:            ttl,
+	})
+
+	slices.SortStableFunc(clients.providers, func(a, b *cachedProvider) (less bool) {
+		return a.Priority() > b.Priority()
+	})
+
+	log.Debug("clients: added provider %q with priority %d", p.Name(), p.Priority())
+}
+
+// fromProviders returns the runtime client with ip named by the providers with
+// the priorities greater than the one of rc, which may be nil.  ok is false if
+// none of them knows the client.
+func (clients *clientsContainer) fromProviders(
+	ip net.IP,
+	rc *RuntimeClient,
+) (prc *RuntimeClient, ok bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, false
+	}
+
+	clients.providersLock.Lock()
+	providers := slices.Clone(clients.providers)
+	clients.providersLock.Unlock()
+
+	for _, p := range providers {
+		if rc != nil && rc.Host != "" && p.Priority() <= int(rc.Source) {
+			break
+		}
+
+		name, known := p.clientName(addr.Unmap())
+		if !known || name == "" {
+			continue
+		}
+
+		prc = &RuntimeClient{
+			Host:      name,
+			Source:    ClientSourceProvider,
+			WHOISInfo: &RuntimeClientWHOISInfo{},
+		}
+
+		if rc != nil && rc.WHOISInfo != nil {
+			prc.WHOISInfo = rc.WHOISInfo
+		}
+
+		return prc, true
+	}
+
+	return nil, false
+}
+
+// clientProviderConf is the configuration of a webhook client provider.
+type clientProviderConf struct {
+	// Name is the name of the provider used in the logs.
+	Name string `yaml:"name"`
+
+	// URL is the URL of the webhook.  The IP address of the client is sent
+	// within the "ip" query parameter.
+	URL string `yaml:"url"`
+
+	// CacheTTL is the time the answers of the webhook are cached for.
+	CacheTTL timeutil.Duration `yaml:"cache_ttl"`
+
+	// Priority is the priority of the provider.  See
+	// [ClientProvider.Priority].
+	Priority int `yaml:"priority"`
+}
+
+// webhookProvider is a [ClientProvider] requesting the names of the clients
+// from an HTTP endpoint, for example a CMDB.  The endpoint is expected to
+// respond with a JSON object with the "name" property or with 404 Not Found if
+// the client is unknown.
+type webhookProvider struct {
+	// client is the HTTP client used to request the webhook.
+	client *http.Client
+
+	// url is the URL of the webhook.
+	url *url.URL
+
+	// name is the name of the provider.
+	name string
+
+	// priority is the priority of the provider.
+	priority int
+}
+
+// newWebhookProvider returns a new webhook provider with the configuration.
+func newWebhookProvider(c *clientProviderConf, client *http.Client) (p *webhookProvider, err error) {
+	if c.Name == "" {
+		return nil, errors.Error("provider name is empty")
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("provider %q: parsing url: %w", c.Name, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("provider %q: unsupported url scheme %q", c.Name, u.Scheme)
+	}
+
+	return &webhookProvider{
+		client:   client,
+		url:      u,
+		name:     c.Name,
+		priority: c.Priority,
+	}, nil
+}
+
+// type check
+var _ ClientProvider = (*webhookProvider)(nil)
+
+// Name implements the [ClientProvider] interface for *webhookProvider.
+func (p *webhookProvider) Name() (name string) {
+	return p.name
+}
+
+// Priority implements the [ClientProvider] interface for *webhookProvider.
+func (p *webhookProvider) Priority() (prio int) {
+	return p.priority
+}
+
+// maxWebhookRespSize is the maximum size of the response of a webhook provider.
+const maxWebhookRespSize = 64 * 1024
+
+// ClientName implements the [ClientProvider] interface for *webhookProvider.
+func (p *webhookProvider) ClientName(
+	ctx context.Context,
+	ip netip.Addr,
+) (name string, ok bool, err error) {
+	u := *p.url
+	q := u.Query()
+	q.Set("ip", ip.String())
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", false, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Go on.
+	case http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data := &struct {
+		Name string `json:"name"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxWebhookRespSize)).Decode(data)
+	if err != nil {
+		return "", false, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return data.Name, data.Name != "", nil
+}
+
+// initProviders registers the webhook providers with the configurations.
+func (clients *clientsContainer) initProviders(confs []*clientProviderConf, client *http.Client) (err error) {
+	for i, c := range confs {
+		var p *webhookProvider
+		p, err = newWebhookProvider(c, client)
+		if err != nil {
+			return fmt.Errorf("client provider at index %d: %w", i, err)
+		}
+
+		clients.AddProvider(p, c.CacheTTL.Duration)
+	}
+
+	return nil
+}
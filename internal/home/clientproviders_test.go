@@ -0,0 +1,209 @@
+package home
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testProvider is a [ClientProvider] for tests.
+type testProvider struct {
+	// names are the names of the known clients.
+	names map[netip.Addr]string
+
+	// name is the name of the provider.
+	name string
+
+	// priority is the priority of the provider.
+	priority int
+
+	// lookups is the number of the lookups made.
+	lookups int
+}
+
+// type check
+var _ ClientProvider = (*testProvider)(nil)
+
+// Name implements the [ClientProvider] interface for *testProvider.
+func (p *testProvider) Name() (name string) { return p.name }
+
+// Priority implements the [ClientProvider] interface for *testProvider.
+func (p *testProvider) Priority() (prio int) { return p.priority }
+
+// ClientName implements the [ClientProvider] interface for *testProvider.
+func (p *testProvider) ClientName(
+	_ context.Context,
+	ip netip.Addr,
+) (name string, ok bool, err error) {
+	p.lookups++
+	name, ok = p.names[ip]
+
+	return name, ok, nil
+}
+
+func TestClientsContainer_AddProvider(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	var (
+		dhcpIP    = net.IP{1, 1, 1, 1}
+		hostsIP   = net.IP{1, 1, 1, 2}
+		unknownIP = net.IP{1, 1, 1, 3}
+	)
+
+	ok, err := clients.AddHost(dhcpIP, "dhcp.host", ClientSourceDHCP)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = clients.AddHost(hostsIP, "hosts.host", ClientSourceHostsFile)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	cmdb := &testProvider{
+		names: map[netip.Addr]string{
+			netip.MustParseAddr("1.1.1.1"): "cmdb-dhcp",
+			netip.MustParseAddr("1.1.1.2"): "cmdb-hosts",
+		},
+		name:     "cmdb",
+		priority: int(ClientSourceDHCP),
+	}
+	clients.AddProvider(cmdb, time.Hour)
+
+	override := &testProvider{
+		names: map[netip.Addr]string{
+			netip.MustParseAddr("1.1.1.1"): "override",
+		},
+		name:     "override",
+		priority: int(ClientSourceHostsFile) + 1,
+	}
+	clients.AddProvider(override, 0)
+
+	testCases := []struct {
+		name     string
+		wantHost string
+		ip       net.IP
+		wantSrc  clientSource
+		wantOK   bool
+	}{{
+		name:     "higher_priority",
+		wantHost: "override",
+		ip:       dhcpIP,
+		wantSrc:  ClientSourceProvider,
+		wantOK:   true,
+	}, {
+		name:     "builtin_priority",
+		wantHost: "hosts.host",
+		ip:       hostsIP,
+		wantSrc:  ClientSourceHostsFile,
+		wantOK:   true,
+	}, {
+		name:     "unknown",
+		wantHost: "",
+		ip:       unknownIP,
+		wantSrc:  0,
+		wantOK:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, found := clients.FindRuntimeClient(tc.ip)
+			require.Equal(t, tc.wantOK, found)
+
+			if !tc.wantOK {
+				return
+			}
+
+			assert.Equal(t, tc.wantHost, rc.Host)
+			assert.Equal(t, tc.wantSrc, rc.Source)
+		})
+	}
+
+	t.Run("cache", func(t *testing.T) {
+		lookups := cmdb.lookups
+
+		_, _ = clients.FindRuntimeClient(unknownIP)
+		assert.Equal(t, lookups, cmdb.lookups)
+
+		overrideLookups := override.lookups
+
+		_, _ = clients.FindRuntimeClient(unknownIP)
+		assert.Equal(t, overrideLookups+1, override.lookups)
+	})
+}
+
+func TestWebhookProvider_ClientName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("ip") {
+		case "1.1.1.1":
+			_, _ = w.Write([]byte(`{"name":"laptop"}`))
+		case "1.1.1.2":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	p, err := newWebhookProvider(&clientProviderConf{
+		Name: "cmdb",
+		URL:  srv.URL + "/lookup?token=secret",
+	}, srv.Client())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		ip         netip.Addr
+		wantName   string
+		wantErrMsg string
+		wantOK     bool
+	}{{
+		name:       "known",
+		ip:         netip.MustParseAddr("1.1.1.1"),
+		wantName:   "laptop",
+		wantErrMsg: "",
+		wantOK:     true,
+	}, {
+		name:       "unknown",
+		ip:         netip.MustParseAddr("1.1.1.2"),
+		wantName:   "",
+		wantErrMsg: "",
+		wantOK:     false,
+	}, {
+		name:       "error",
+		ip:         netip.MustParseAddr("1.1.1.3"),
+		wantName:   "",
+		wantErrMsg: "unexpected status 500 Internal Server Error",
+		wantOK:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, ok, cerr := p.ClientName(context.Background(), tc.ip)
+			if tc.wantErrMsg != "" {
+				assert.EqualError(t, cerr, tc.wantErrMsg)
+			} else {
+				assert.NoError(t, cerr)
+			}
+
+			assert.Equal(t, tc.wantName, name)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+
+	t.Run("bad_url", func(t *testing.T) {
+		_, err = newWebhookProvider(&clientProviderConf{
+			Name: "cmdb",
+			URL:  "ftp://cmdb.lan",
+		}, srv.Client())
+		assert.EqualError(t, err, `provider "cmdb": unsupported url scheme "ftp"`)
+	})
+}
@@ -0,0 +1,432 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+)
+
+// quotasFileName is the name of the file within the data directory, which
+// keeps the numbers of queries made today by the clients and the groups with
+// daily query limits.
+const quotasFileName = "quotas.json"
+
+// quotasSavePeriod is the period of saving the numbers of queries into the
+// file.  They're also saved when the clients container is closed.
+const quotasSavePeriod = 5 * time.Minute
+
+// groupQuotaConf is the configuration of the daily query quota of a group of
+// persistent clients, that is, the clients with the same tag.
+type groupQuotaConf struct {
+	// Tag is the tag of the clients in the group, for example "device_other".
+	Tag string `yaml:"tag"`
+
+	// DailyQueryLimit is the maximum number of queries all the clients of the
+	// group may make during a day together.  Once it's exceeded, the queries
+	// of all of them are refused until the local midnight.
+	DailyQueryLimit uint32 `yaml:"daily_query_limit"`
+}
+
+// queryQuota is the state of a daily query quota.
+type queryQuota struct {
+	// day is the local midnight starting the day, during which num queries
+	// have been made.
+	day time.Time
+
+	// num is the number of queries made during day.
+	num uint32
+}
+
+// startOfDay returns the local midnight starting the day containing t.
+func startOfDay(t time.Time) (midnight time.Time) {
+	y, m, d := t.Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// count returns the number of queries made during the day containing now.
+func (q *queryQuota) count(now time.Time) (num uint32) {
+	if !q.day.Equal(startOfDay(now)) {
+		return 0
+	}
+
+	return q.num
+}
+
+// inc counts a query made at now.
+func (q *queryQuota) inc(now time.Time) {
+	if day := startOfDay(now); !q.day.Equal(day) {
+		q.day, q.num = day, 0
+	}
+
+	q.num++
+}
+
+// quotasFile is the structure of the file keeping the numbers of queries.
+type quotasFile struct {
+	// Day is the local midnight starting the day, during which the queries
+	// have been made.
+	Day time.Time `json:"day"`
+
+	// Clients are the numbers of queries of the persistent clients by their
+	// names.
+	Clients map[string]uint32 `json:"clients"`
+
+	// Groups are the numbers of queries of the groups by their tags.
+	Groups map[string]uint32 `json:"groups"`
+}
+
+// clientQuotas are the daily query quotas of the persistent clients and their
+// groups.  It has its own lock, so that counting the queries doesn't hold the
+// lock of the clients container.
+type clientQuotas struct {
+	// mu protects clients and groups.
+	mu *sync.Mutex
+
+	// clients are the quotas of the persistent clients by their names.
+	clients map[string]*queryQuota
+
+	// groups are the quotas of the groups by their tags.
+	groups map[string]*queryQuota
+
+	// groupLimits are the daily query limits of the groups by their tags.  It
+	// isn't modified after initialization.
+	groupLimits map[string]uint32
+
+	// path is the path to the file keeping the numbers of queries.  If it's
+	// empty, they aren't persisted.
+	path string
+
+	// limited is 1 if any persistent client or group has a daily query limit.
+	// It must be accessed atomically.
+	limited uint32
+}
+
+// newClientQuotas returns new empty quotas, which aren't persisted.
+func newClientQuotas() (q *clientQuotas) {
+	return &clientQuotas{
+		mu:          &sync.Mutex{},
+		clients:     map[string]*queryQuota{},
+		groups:      map[string]*queryQuota{},
+		groupLimits: map[string]uint32{},
+	}
+}
+
+// initQuotas sets the limits of the groups from the configuration and loads
+// the numbers of queries made today from the file at path.  It must only be
+// called once, before the clients container is started.
+func (clients *clientsContainer) initQuotas(confs []*groupQuotaConf, path string) (err error) {
+	q := clients.quotas
+	for _, c := range confs {
+		if !clients.allTags.Has(c.Tag) {
+			log.Info("clients: skipping quota of unknown tag %q", c.Tag)
+
+			continue
+		}
+
+		if c.DailyQueryLimit > 0 {
+			q.groupLimits[c.Tag] = c.DailyQueryLimit
+		}
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	clients.updateQuotasLimitedLocked()
+
+	q.path = path
+
+	return q.load(time.Now())
+}
+
+// load loads the numbers of queries made during the day containing now from
+// the file.
+func (q *clientQuotas) load(now time.Time) (err error) {
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading quotas: %w", err)
+	}
+
+	f := &quotasFile{}
+	err = json.Unmarshal(data, f)
+	if err != nil {
+		return fmt.Errorf("decoding quotas: %w", err)
+	}
+
+	day := startOfDay(now)
+	if !f.Day.Equal(day) {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for name, num := range f.Clients {
+		q.clients[name] = &queryQuota{day: day, num: num}
+	}
+
+	for tag, num := range f.Groups {
+		q.groups[tag] = &queryQuota{day: day, num: num}
+	}
+
+	return nil
+}
+
+// save writes the numbers of queries made during the day containing now into
+// the file, if it's set.
+func (q *clientQuotas) save(now time.Time) (err error) {
+	if q.path == "" {
+		return nil
+	}
+
+	f := &quotasFile{
+		Day:     startOfDay(now),
+		Clients: map[string]uint32{},
+		Groups:  map[string]uint32{},
+	}
+
+	func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		for name, qq := range q.clients {
+			if num := qq.count(now); num > 0 {
+				f.Clients[name] = num
+			}
+		}
+
+		for tag, qq := range q.groups {
+			if num := qq.count(now); num > 0 {
+				f.Groups[tag] = num
+			}
+		}
+	}()
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encoding quotas: %w", err)
+	}
+
+	err = maybe.WriteFile(q.path, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing quotas: %w", err)
+	}
+
+	return nil
+}
+
+// periodicSaveQuotas saves the numbers of queries every quotasSavePeriod.
+func (clients *clientsContainer) periodicSaveQuotas() {
+	defer log.OnPanic("clients quotas")
+
+	for {
+		time.Sleep(quotasSavePeriod)
+
+		err := clients.quotas.save(time.Now())
+		if err != nil {
+			log.Error("clients: %s", err)
+		}
+	}
+}
+
+// quotaLocked returns the quota of the client or the group with key in m,
+// creating it if necessary.  q.mu is expected to be locked.
+func quotaLocked(m map[string]*queryQuota, key string) (qq *queryQuota) {
+	qq, ok := m[key]
+	if !ok {
+		qq = &queryQuota{}
+		m[key] = qq
+	}
+
+	return qq
+}
+
+// consume counts a query of the persistent client with name, limit, and tags
+// made at now and returns true if it still fits into the quotas of the client
+// and all its groups.  The exceeding queries aren't counted.
+func (q *clientQuotas) consume(name string, limit uint32, tags []string, now time.Time) (ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var quotas []*queryQuota
+	if limit > 0 {
+		qq := quotaLocked(q.clients, name)
+		if qq.count(now) >= limit {
+			return false
+		}
+
+		quotas = append(quotas, qq)
+	}
+
+	for _, t := range tags {
+		groupLimit := q.groupLimits[t]
+		if groupLimit == 0 {
+			continue
+		}
+
+		qq := quotaLocked(q.groups, t)
+		if qq.count(now) >= groupLimit {
+			return false
+		}
+
+		quotas = append(quotas, qq)
+	}
+
+	for _, qq := range quotas {
+		qq.inc(now)
+	}
+
+	return true
+}
+
+// rename moves the numbers of queries of the persistent client from prev to
+// name.
+func (q *clientQuotas) rename(prev, name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if qq, ok := q.clients[prev]; ok {
+		delete(q.clients, prev)
+		q.clients[name] = qq
+	}
+}
+
+// remove removes the numbers of queries of the persistent client with name.
+func (q *clientQuotas) remove(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.clients, name)
+}
+
+// updateQuotasLimitedLocked updates the flag telling if any persistent client
+// or group has a daily query limit.  clients.lock is expected to be locked.
+func (clients *clientsContainer) updateQuotasLimitedLocked() {
+	var limited uint32
+	if len(clients.quotas.groupLimits) > 0 {
+		limited = 1
+	} else {
+		for _, c := range clients.list {
+			if c.DailyQueryLimit > 0 {
+				limited = 1
+
+				break
+			}
+		}
+	}
+
+	atomic.StoreUint32(&clients.quotas.limited, limited)
+}
+
+// consumeQuota counts a query of the persistent client identified by its IP
+// address or ClientID and returns false if the client or any of its groups has
+// exceeded its daily query limit.  Queries of the clients without limits are
+// always allowed.
+func (clients *clientsContainer) consumeQuota(id string) (ok bool) {
+	q := clients.quotas
+	if atomic.LoadUint32(&q.limited) == 0 {
+		return true
+	}
+
+	var name string
+	var limit uint32
+	var tags []string
+	func() {
+		clients.lock.Lock()
+		defer clients.lock.Unlock()
+
+		var c *Client
+		c, ok = clients.findLocked(id)
+		if ok {
+			name, limit, tags = c.Name, c.DailyQueryLimit, c.Tags
+		}
+	}()
+
+	if !ok {
+		return true
+	}
+
+	return q.consume(name, limit, tags, time.Now())
+}
+
+// setQuotaState sets the daily query quota state of c at now in cj.  The
+// client's queries are considered refused if the quota of the client or of
+// any of its groups is exceeded.  clients.lock is expected to be locked.
+func (clients *clientsContainer) setQuotaState(cj *clientJSON, c *Client, now time.Time) {
+	q := clients.quotas
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if qq, ok := q.clients[c.Name]; ok {
+		cj.DailyQueries = qq.count(now)
+	}
+
+	cj.DailyQueryLimitExceeded = c.DailyQueryLimit != 0 && cj.DailyQueries >= c.DailyQueryLimit
+	for _, t := range c.Tags {
+		groupLimit := q.groupLimits[t]
+		if groupLimit == 0 {
+			continue
+		}
+
+		if qq, ok := q.groups[t]; ok && qq.count(now) >= groupLimit {
+			cj.DailyQueryLimitExceeded = true
+		}
+	}
+}
+
+// groupQuotaJSON is the state of the daily query quota of a group of clients.
+type groupQuotaJSON struct {
+	// Tag is the tag of the clients in the group.
+	Tag string `json:"tag"`
+
+	// DailyQueries is the number of queries the clients of the group have
+	// made today.
+	DailyQueries uint32 `json:"daily_queries"`
+
+	// DailyQueryLimit is the maximum number of queries the clients of the
+	// group may make during a day together.
+	DailyQueryLimit uint32 `json:"daily_query_limit"`
+
+	// DailyQueryLimitExceeded is true if the queries of the clients of the
+	// group are refused until the local midnight.
+	DailyQueryLimitExceeded bool `json:"daily_query_limit_exceeded"`
+}
+
+// groupQuotasJSON returns the states of the daily query quotas of the groups
+// at now in the order of clientTags.
+func (q *clientQuotas) groupQuotasJSON(now time.Time) (quotas []*groupQuotaJSON) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	quotas = []*groupQuotaJSON{}
+	for _, t := range clientTags {
+		limit := q.groupLimits[t]
+		if limit == 0 {
+			continue
+		}
+
+		var num uint32
+		if qq, ok := q.groups[t]; ok {
+			num = qq.count(now)
+		}
+
+		quotas = append(quotas, &groupQuotaJSON{
+			Tag:                     t,
+			DailyQueries:            num,
+			DailyQueryLimit:         limit,
+			DailyQueryLimitExceeded: num >= limit,
+		})
+	}
+
+	return quotas
+}
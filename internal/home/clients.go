@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
@@ -44,6 +45,20 @@ type Client struct {
 	BlockedServices []string
 	Upstreams       []string
 
+	// PortalToken is the secret token, which the device of the client
+	// authenticates with in the self-service portal API.  Empty string means
+	// that the portal is unavailable for the client.
+	PortalToken string
+
+	// DailyQueryLimit is the maximum number of queries the client may make
+	// during a day.  Once it's exceeded, the queries are refused until the
+	// local midnight.  Zero means no limit.
+	DailyQueryLimit uint32
+
+	// BypassCache, if true, makes the queries of the client always resolved
+	// by the upstreams, without using the DNS cache.
+	BypassCache bool
+
 	UseOwnSettings        bool
 	FilteringEnabled      bool
 	SafeSearchEnabled     bool
@@ -90,6 +105,8 @@ func (cs clientSource) String() (s string) {
 		return "DHCP"
 	case ClientSourceHostsFile:
 		return "etc/hosts"
+	case ClientSourceProvider:
+		return "provider"
 	default:
 		return ""
 	}
@@ -139,6 +156,10 @@ type clientsContainer struct {
 
 	lock sync.Mutex
 
+	// quotas are the daily query quotas of the persistent clients and their
+	// groups.  They have their own lock.
+	quotas *clientQuotas
+
 	allTags *stringutil.Set
 
 	// dhcpServer is used for looking up clients IP addresses by MAC addresses
@@ -154,6 +175,13 @@ type clientsContainer struct {
 	// arpdb stores the neighbors retrieved from ARP.
 	arpdb aghnet.ARPDB
 
+	// providersLock protects providers.
+	providersLock sync.Mutex
+
+	// providers are the pluggable sources of the names of the runtime
+	// clients sorted by their priorities, the greatest first.
+	providers []*cachedProvider
+
 	testing bool // if TRUE, this object is used for internal tests
 }
 
@@ -172,6 +200,7 @@ func (clients *clientsContainer) Init(
 	clients.list = make(map[string]*Client)
 	clients.idIndex = make(map[string]*Client)
 	clients.ipToRC = netutil.NewIPMap(0)
+	clients.quotas = newClientQuotas()
 
 	clients.allTags = stringutil.NewSet(clientTags...)
 
@@ -208,6 +237,7 @@ func (clients *clientsContainer) Start() {
 			clients.registerWebHandlers()
 		}
 		go clients.periodicUpdate()
+		go clients.periodicSaveQuotas()
 	}
 }
 
@@ -226,6 +256,12 @@ type clientObject struct {
 	BlockedServices []string `yaml:"blocked_services"`
 	Upstreams       []string `yaml:"upstreams"`
 
+	PortalToken string `yaml:"portal_token"`
+
+	DailyQueryLimit uint32 `yaml:"daily_query_limit"`
+
+	BypassCache bool `yaml:"bypass_cache"`
+
 	UseGlobalSettings        bool `yaml:"use_global_settings"`
 	FilteringEnabled         bool `yaml:"filtering_enabled"`
 	ParentalEnabled          bool `yaml:"parental_enabled"`
@@ -244,6 +280,12 @@ func (clients *clientsContainer) addFromConfig(objects []*clientObject) {
 			IDs:       o.IDs,
 			Upstreams: o.Upstreams,
 
+			PortalToken: o.PortalToken,
+
+			DailyQueryLimit: o.DailyQueryLimit,
+
+			BypassCache: o.BypassCache,
+
 			UseOwnSettings:        !o.UseGlobalSettings,
 			FilteringEnabled:      o.FilteringEnabled,
 			ParentalEnabled:       o.ParentalEnabled,
@@ -293,6 +335,12 @@ func (clients *clientsContainer) forConfig() (objs []*clientObject) {
 			BlockedServices: stringutil.CloneSlice(cli.BlockedServices),
 			Upstreams:       stringutil.CloneSlice(cli.Upstreams),
 
+			PortalToken: cli.PortalToken,
+
+			DailyQueryLimit: cli.DailyQueryLimit,
+
+			BypassCache: cli.BypassCache,
+
 			UseGlobalSettings:        !cli.UseOwnSettings,
 			FilteringEnabled:         cli.FilteringEnabled,
 			ParentalEnabled:          cli.ParentalEnabled,
@@ -486,6 +534,17 @@ func (clients *clientsContainer) findUpstreams(
 	return conf, nil
 }
 
+// bypassesCache returns true if the persistent client identified by its IP
+// address or ClientID should bypass the DNS cache.
+func (clients *clientsContainer) bypassesCache(id string) (ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findLocked(id)
+
+	return ok && c.BypassCache
+}
+
 // findLocked searches for a client by its ID.  For internal use only.
 func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
 	c, ok = clients.idIndex[id]
@@ -555,16 +614,23 @@ func (clients *clientsContainer) findRuntimeClientLocked(ip net.IP) (rc *Runtime
 	return rc, true
 }
 
-// FindRuntimeClient finds a runtime client by their IP.
+// FindRuntimeClient finds a runtime client by their IP.  The providers with
+// the priorities greater than the one of the source of the client are asked
+// first.
 func (clients *clientsContainer) FindRuntimeClient(ip net.IP) (rc *RuntimeClient, ok bool) {
 	if ip == nil {
 		return nil, false
 	}
 
 	clients.lock.Lock()
-	defer clients.lock.Unlock()
+	rc, ok = clients.findRuntimeClientLocked(ip)
+	clients.lock.Unlock()
+
+	if prc, pok := clients.fromProviders(ip, rc); pok {
+		return prc, true
+	}
 
-	return clients.findRuntimeClientLocked(ip)
+	return rc, ok
 }
 
 // check validates the client.
@@ -612,6 +678,10 @@ func (clients *clientsContainer) check(c *Client) (err error) {
 		return fmt.Errorf("invalid upstream servers: %w", err)
 	}
 
+	if l := len(c.PortalToken); l > 0 && l < minPortalTokenLen {
+		return fmt.Errorf("portal token must be at least %d characters long", minPortalTokenLen)
+	}
+
 	return nil
 }
 
@@ -649,6 +719,10 @@ func (clients *clientsContainer) Add(c *Client) (ok bool, err error) {
 		clients.idIndex[id] = c
 	}
 
+	if c.DailyQueryLimit > 0 {
+		atomic.StoreUint32(&clients.quotas.limited, 1)
+	}
+
 	log.Debug("clients: added %q: ID:%q [%d]", c.Name, c.IDs, len(clients.list))
 
 	return true, nil
@@ -677,6 +751,9 @@ func (clients *clientsContainer) Del(name string) (ok bool) {
 		delete(clients.idIndex, id)
 	}
 
+	clients.quotas.remove(name)
+	clients.updateQuotasLimitedLocked()
+
 	return true
 }
 
@@ -748,7 +825,13 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 		return err
 	}
 
+	// Keep the queries already made today.
+	if prev.Name != c.Name {
+		clients.quotas.rename(prev.Name, c.Name)
+	}
+
 	*prev = *c
+	clients.updateQuotasLimitedLocked()
 
 	return nil
 }
@@ -933,12 +1016,15 @@ func (clients *clientsContainer) updateFromDHCP(add bool) {
 }
 
 // Close gracefully closes all the client-specific upstream configurations of
-// the persistent clients.
+// the persistent clients and saves the numbers of queries made today.
 func (clients *clientsContainer) Close() (err error) {
 	persistent := maps.Values(clients.list)
 	slices.SortFunc(persistent, func(a, b *Client) (less bool) { return a.Name < b.Name })
 
 	var errs []error
+	if err = clients.quotas.save(time.Now()); err != nil {
+		errs = append(errs, err)
+	}
 
 	for _, cli := range persistent {
 		if err = cli.closeUpstreams(); err != nil {
@@ -947,7 +1033,7 @@ func (clients *clientsContainer) Close() (err error) {
 	}
 
 	if len(errs) > 0 {
-		return errors.List("closing client specific upstreams", errs...)
+		return errors.List("closing clients", errs...)
 	}
 
 	return nil
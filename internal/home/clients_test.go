@@ -4,7 +4,9 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -357,3 +359,186 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Len(t, config.Upstreams, 1)
 	assert.Len(t, config.DomainReservedUpstreams, 1)
 }
+
+func TestClientsBypassCache(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:         []string{"1.1.1.1", "probe"},
+		Name:        "client1",
+		BypassCache: true,
+	})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.True(t, clients.bypassesCache("1.1.1.1"))
+	assert.True(t, clients.bypassesCache("probe"))
+	assert.False(t, clients.bypassesCache("1.2.3.4"))
+}
+
+func TestClientsDailyQueryLimit(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:             []string{"1.1.1.1"},
+		Name:            "client1",
+		DailyQueryLimit: 2,
+	})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.True(t, clients.consumeQuota("1.2.3.4"))
+
+	assert.True(t, clients.consumeQuota("1.1.1.1"))
+	assert.True(t, clients.consumeQuota("1.1.1.1"))
+	assert.False(t, clients.consumeQuota("1.1.1.1"))
+
+	c, ok := clients.Find("1.1.1.1")
+	require.True(t, ok)
+
+	cj := clientToJSON(c)
+	clients.lock.Lock()
+	clients.setQuotaState(cj, c, time.Now())
+	clients.lock.Unlock()
+
+	assert.Equal(t, uint32(2), cj.DailyQueries)
+	assert.True(t, cj.DailyQueryLimitExceeded)
+
+	// The queries made today must be kept after updating the client.
+	err = clients.Update("client1", &Client{
+		IDs:             []string{"1.1.1.1"},
+		Name:            "client1_renamed",
+		DailyQueryLimit: 3,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, clients.consumeQuota("1.1.1.1"))
+	assert.False(t, clients.consumeQuota("1.1.1.1"))
+
+	// The queries of the clients without limits aren't counted.
+	assert.True(t, clients.Del("client1_renamed"))
+	assert.Zero(t, atomic.LoadUint32(&clients.quotas.limited))
+	assert.True(t, clients.consumeQuota("1.1.1.1"))
+}
+
+func TestClientsGroupQueryLimit(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	quotasPath := filepath.Join(t.TempDir(), quotasFileName)
+	err := clients.initQuotas([]*groupQuotaConf{{
+		Tag:             "device_other",
+		DailyQueryLimit: 3,
+	}, {
+		Tag:             "unknown_tag",
+		DailyQueryLimit: 1,
+	}}, quotasPath)
+	require.NoError(t, err)
+
+	for _, c := range []*Client{{
+		IDs:  []string{"1.1.1.1"},
+		Name: "iot1",
+		Tags: []string{"device_other"},
+	}, {
+		IDs:             []string{"2.2.2.2"},
+		Name:            "iot2",
+		Tags:            []string{"device_other"},
+		DailyQueryLimit: 1,
+	}, {
+		IDs:  []string{"3.3.3.3"},
+		Name: "pc",
+		Tags: []string{"device_pc"},
+	}} {
+		var ok bool
+		ok, err = clients.Add(c)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	assert.True(t, clients.consumeQuota("2.2.2.2"))
+	// The client's own quota is exceeded, so the group's one isn't consumed.
+	assert.False(t, clients.consumeQuota("2.2.2.2"))
+
+	assert.True(t, clients.consumeQuota("1.1.1.1"))
+	assert.True(t, clients.consumeQuota("1.1.1.1"))
+	assert.False(t, clients.consumeQuota("1.1.1.1"))
+
+	assert.True(t, clients.consumeQuota("3.3.3.3"))
+
+	now := time.Now()
+	assert.Equal(t, []*groupQuotaJSON{{
+		Tag:                     "device_other",
+		DailyQueries:            3,
+		DailyQueryLimit:         3,
+		DailyQueryLimitExceeded: true,
+	}}, clients.quotas.groupQuotasJSON(now))
+
+	require.NoError(t, clients.Close())
+
+	// The numbers of queries must survive the restart.
+	restarted := clientsContainer{
+		testing: true,
+	}
+	restarted.Init(nil, nil, nil, nil)
+
+	err = restarted.initQuotas([]*groupQuotaConf{{
+		Tag:             "device_other",
+		DailyQueryLimit: 4,
+	}}, quotasPath)
+	require.NoError(t, err)
+
+	ok, err := restarted.Add(&Client{
+		IDs:  []string{"1.1.1.1"},
+		Name: "iot1",
+		Tags: []string{"device_other"},
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.True(t, restarted.consumeQuota("1.1.1.1"))
+	assert.False(t, restarted.consumeQuota("1.1.1.1"))
+}
+
+func TestClientQuotas_load(t *testing.T) {
+	now := time.Date(2022, 1, 1, 23, 59, 0, 0, time.UTC)
+
+	q := newClientQuotas()
+	q.path = filepath.Join(t.TempDir(), quotasFileName)
+
+	assert.True(t, q.consume("client", 1, nil, now))
+	require.NoError(t, q.save(now))
+
+	// The numbers of the previous day mustn't be loaded.
+	next := newClientQuotas()
+	next.path = q.path
+	require.NoError(t, next.load(now.Add(time.Minute)))
+
+	assert.Empty(t, next.clients)
+
+	require.NoError(t, next.load(now))
+
+	assert.False(t, next.consume("client", 1, nil, now))
+}
+
+func TestClientQuotas_consume(t *testing.T) {
+	const limit = 1
+
+	q := newClientQuotas()
+	now := time.Date(2022, 1, 1, 23, 59, 0, 0, time.UTC)
+
+	assert.True(t, q.consume("client", limit, nil, now))
+	assert.False(t, q.consume("client", limit, nil, now))
+	assert.Equal(t, uint32(limit), q.clients["client"].count(now))
+
+	now = now.Add(time.Minute)
+	assert.Zero(t, q.clients["client"].count(now))
+	assert.True(t, q.consume("client", limit, nil, now))
+}
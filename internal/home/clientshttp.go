@@ -1,10 +1,10 @@
 package home
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/golibs/log"
@@ -36,6 +36,33 @@ type clientJSON struct {
 	Tags            []string `json:"tags"`
 	Upstreams       []string `json:"upstreams"`
 
+	// PortalToken is the token the client's device authenticates with in the
+	// self-service portal API.  It's write-only, so it's never sent in the
+	// responses.  If nil, the current token is kept when updating the client.
+	// Empty string disables the portal for the client.
+	PortalToken *string `json:"portal_token,omitempty"`
+
+	// PortalTokenSet is true if the client has a portal token.  It's ignored
+	// when adding or updating the client.
+	PortalTokenSet bool `json:"portal_token_set"`
+
+	// DailyQueries is the number of queries the client has made today.  It's
+	// ignored when adding or updating the client.
+	DailyQueries uint32 `json:"daily_queries"`
+
+	// DailyQueryLimit is the maximum number of queries the client may make
+	// during a day.  Zero means no limit.
+	DailyQueryLimit uint32 `json:"daily_query_limit"`
+
+	// DailyQueryLimitExceeded is true if the client's queries are refused
+	// until the local midnight.  It's ignored when adding or updating the
+	// client.
+	DailyQueryLimitExceeded bool `json:"daily_query_limit_exceeded"`
+
+	// BypassCache is true if the client's queries are always resolved by the
+	// upstreams, without using the DNS cache.
+	BypassCache bool `json:"bypass_cache"`
+
 	FilteringEnabled         bool `json:"filtering_enabled"`
 	ParentalEnabled          bool `json:"parental_enabled"`
 	SafeBrowsingEnabled      bool `json:"safebrowsing_enabled"`
@@ -55,6 +82,7 @@ type runtimeClientJSON struct {
 type clientListJSON struct {
 	Clients        []*clientJSON       `json:"clients"`
 	RuntimeClients []runtimeClientJSON `json:"auto_clients"`
+	GroupQuotas    []*groupQuotaJSON   `json:"group_quotas"`
 	Tags           []string            `json:"supported_tags"`
 }
 
@@ -62,14 +90,35 @@ type clientListJSON struct {
 func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http.Request) {
 	data := clientListJSON{}
 
+	var u webUser
+	if Context.auth != nil {
+		u = Context.auth.getCurrentUser(r)
+	}
+
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
+	now := time.Now()
 	for _, c := range clients.list {
+		if !u.managesClient(c.Name) {
+			continue
+		}
+
 		cj := clientToJSON(c)
+		clients.setQuotaState(cj, c, now)
 		data.Clients = append(data.Clients, cj)
 	}
 
+	data.Tags = clientTags
+	data.GroupQuotas = clients.quotas.groupQuotasJSON(now)
+
+	if u.isDelegated() {
+		// Don't show the runtime clients to the delegated administrators.
+		_ = aghhttp.WriteJSONResponse(w, r, data)
+
+		return
+	}
+
 	clients.ipToRC.Range(func(ip net.IP, v any) (cont bool) {
 		rc, ok := v.(*RuntimeClient)
 		if !ok {
@@ -91,14 +140,12 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 		return true
 	})
 
-	data.Tags = clientTags
-
 	_ = aghhttp.WriteJSONResponse(w, r, data)
 }
 
 // Convert JSON object to Client object
 func jsonToClient(cj clientJSON) (c *Client) {
-	return &Client{
+	c = &Client{
 		Name:                cj.Name,
 		IDs:                 cj.IDs,
 		Tags:                cj.Tags,
@@ -112,7 +159,17 @@ func jsonToClient(cj clientJSON) (c *Client) {
 		BlockedServices:       cj.BlockedServices,
 
 		Upstreams: cj.Upstreams,
+
+		DailyQueryLimit: cj.DailyQueryLimit,
+
+		BypassCache: cj.BypassCache,
 	}
+
+	if cj.PortalToken != nil {
+		c.PortalToken = *cj.PortalToken
+	}
+
+	return c
 }
 
 // Convert Client object to JSON
@@ -131,13 +188,19 @@ func clientToJSON(c *Client) (cj *clientJSON) {
 		BlockedServices:          c.BlockedServices,
 
 		Upstreams: c.Upstreams,
+
+		PortalTokenSet: c.PortalToken != "",
+
+		DailyQueryLimit: c.DailyQueryLimit,
+
+		BypassCache: c.BypassCache,
 	}
 }
 
 // Add a new client
 func (clients *clientsContainer) handleAddClient(w http.ResponseWriter, r *http.Request) {
 	cj := clientJSON{}
-	err := json.NewDecoder(r.Body).Decode(&cj)
+	err := aghhttp.DecodeJSON(r, &cj)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
 
@@ -164,7 +227,7 @@ func (clients *clientsContainer) handleAddClient(w http.ResponseWriter, r *http.
 // Remove client
 func (clients *clientsContainer) handleDelClient(w http.ResponseWriter, r *http.Request) {
 	cj := clientJSON{}
-	err := json.NewDecoder(r.Body).Decode(&cj)
+	err := aghhttp.DecodeJSON(r, &cj)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
 
@@ -191,10 +254,21 @@ type updateJSON struct {
 	Data clientJSON `json:"data"`
 }
 
+// updatedClient returns the client from the update request.  The portal token
+// is write-only, so the current one is kept unless dj sets it.
+func (clients *clientsContainer) updatedClient(dj *updateJSON) (c *Client) {
+	c = jsonToClient(dj.Data)
+	if dj.Data.PortalToken == nil {
+		c.PortalToken = clients.portalToken(dj.Name)
+	}
+
+	return c
+}
+
 // Update client's properties
 func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *http.Request) {
 	dj := updateJSON{}
-	err := json.NewDecoder(r.Body).Decode(&dj)
+	err := aghhttp.DecodeJSON(r, &dj)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
 
@@ -207,7 +281,16 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 		return
 	}
 
-	c := jsonToClient(dj.Data)
+	c := clients.updatedClient(&dj)
+	if Context.auth != nil {
+		err = clients.checkDelegatedUpdate(Context.auth.getCurrentUser(r), dj.Name, c)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusForbidden, "%s", err)
+
+			return
+		}
+	}
+
 	err = clients.Update(dj.Name, c)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
@@ -235,6 +318,11 @@ func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http
 			cj = clients.findRuntime(ip, idStr)
 		} else {
 			cj = clientToJSON(c)
+
+			clients.lock.Lock()
+			clients.setQuotaState(cj, c, time.Now())
+			clients.lock.Unlock()
+
 			disallowed, rule := clients.dnsServer.IsBlockedClient(ip, idStr)
 			cj.Disallowed, cj.DisallowedRule = &disallowed, &rule
 		}
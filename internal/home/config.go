@@ -7,8 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghlog"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -55,6 +57,10 @@ type logSettings struct {
 	// is the computer's local time.
 	LocalTime bool `yaml:"log_localtime"`
 
+	// Format is the format of the log messages.  It is either "text", which is
+	// the default, or "json".
+	Format aghlog.Format `yaml:"log_format"`
+
 	// Verbose determines, if verbose (aka debug) logging is enabled.
 	Verbose bool `yaml:"verbose"`
 }
@@ -75,8 +81,13 @@ type osConfig struct {
 type clientsConfig struct {
 	// Sources defines the set of sources to fetch the runtime clients from.
 	Sources *clientSourcesConf `yaml:"runtime_sources"`
+	// Providers are the webhooks providing the names of the runtime clients.
+	Providers []*clientProviderConf `yaml:"providers"`
 	// Persistent are the configured clients.
 	Persistent []*clientObject `yaml:"persistent"`
+	// GroupQuotas are the daily query quotas of the groups of the persistent
+	// clients with the same tags.
+	GroupQuotas []*groupQuotaConf `yaml:"group_quotas"`
 }
 
 // configuration is loaded from YAML
@@ -108,6 +119,12 @@ type configuration struct {
 	Language string `yaml:"language"`
 	// DebugPProf defines if the profiling HTTP handler will listen on :6060.
 	DebugPProf bool `yaml:"debug_pprof"`
+	// LegacyTextErrors defines if the HTTP API responds with the plain text
+	// errors, as the previous versions did, instead of the JSON ones.
+	LegacyTextErrors bool `yaml:"legacy_text_errors"`
+	// StrictJSON defines if the HTTP API rejects the requests with the unknown
+	// fields.
+	StrictJSON bool `yaml:"strict_json"`
 
 	// TTL for a web session (in hours)
 	// An active session is automatically refreshed once a day.
@@ -134,6 +151,17 @@ type configuration struct {
 	// Keep this field sorted to ensure consistent ordering.
 	Clients *clientsConfig `yaml:"clients"`
 
+	// Reports is the configuration of the scheduled reports by email.
+	Reports reportsConfig `yaml:"reports"`
+
+	// SettingsProfiles is the configuration of the named profiles of the
+	// global filtering settings.
+	SettingsProfiles profilesConfig `yaml:"settings_profiles"`
+
+	// ReadOnly is the configuration of the read-only mode for the devices
+	// with write-cycle-limited flash storage.
+	ReadOnly readOnlyConfig `yaml:"read_only"`
+
 	logSettings `yaml:",inline"`
 
 	OSConfig *osConfig `yaml:"os"`
@@ -143,6 +171,9 @@ type configuration struct {
 	SchemaVersion int `yaml:"schema_version"` // keeping last so that users will be less tempted to change it -- used when upgrading between versions
 }
 
+// megabyte is the number of bytes in a megabyte.
+const megabyte = 1024 * 1024
+
 // field ordering is important -- yaml fields will mirror ordering from here
 type dnsConfig struct {
 	BindHosts []netip.Addr `yaml:"bind_hosts"`
@@ -152,20 +183,86 @@ type dnsConfig struct {
 	// days.
 	StatsInterval uint32 `yaml:"statistics_interval"`
 
+	// StatsPerClientTops defines if the top domains of each client are
+	// collected.  It's not supported with QueryLogHashed.
+	StatsPerClientTops bool `yaml:"statistics_per_client_tops"`
+
+	// StatsLatencyBuckets are the ascending upper bounds of the processing
+	// time histogram buckets of the per-upstream latency statistics.  If
+	// empty, the default ones are used.
+	StatsLatencyBuckets []timeutil.Duration `yaml:"statistics_latency_buckets"`
+
 	// QueryLogEnabled defines if the query log is enabled.
 	QueryLogEnabled bool `yaml:"querylog_enabled"`
 	// QueryLogFileEnabled defines, if the query log is written to the file.
 	QueryLogFileEnabled bool `yaml:"querylog_file_enabled"`
 	// QueryLogInterval is the interval for query log's files rotation.
 	QueryLogInterval timeutil.Duration `yaml:"querylog_interval"`
+	// QueryLogClientRetention is the period, after which the client IP
+	// addresses, ClientIDs, and EDNS Client Subnets are removed from the
+	// stored query log entries.  Zero means they are kept.
+	QueryLogClientRetention timeutil.Duration `yaml:"querylog_client_retention"`
+	// QueryLogCoalesceInterval is the window, within which the identical
+	// queries of a client are recorded once with the number of repeats.  Zero
+	// means every query is recorded.
+	QueryLogCoalesceInterval timeutil.Duration `yaml:"querylog_coalesce_interval"`
+	// QueryLogHashed defines if the domain names and the client addresses are
+	// only stored in the query log as their salted hashes.  It's not supported
+	// with StatsPerClientTops.
+	QueryLogHashed bool `yaml:"querylog_hashed"`
 	// QueryLogMemSize is the number of entries kept in memory before they are
 	// flushed to disk.
 	QueryLogMemSize uint32 `yaml:"querylog_size_memory"`
+	// QueryLogFlushInterval is the interval, after which the query log
+	// entries kept in memory are written to the file even if there are less
+	// than QueryLogMemSize of them.  If zero, they're only written once there
+	// are QueryLogMemSize of them.
+	QueryLogFlushInterval timeutil.Duration `yaml:"querylog_flush_interval"`
+	// QueryLogMaxSize is the maximum total size of the query log's files in
+	// megabytes.  Zero means no limit.
+	QueryLogMaxSize uint32 `yaml:"querylog_max_size"`
+	// QueryLogBackend is the storage of the query log: "file", "daily", or
+	// "sqlite".
+	QueryLogBackend querylog.Backend `yaml:"querylog_backend"`
+	// QueryLogCompress defines if the rotated query log files are compressed
+	// with gzip.
+	QueryLogCompress bool `yaml:"querylog_compress"`
+	// QueryLogCompressionLevel is the gzip compression level of the rotated
+	// query log files.  Zero means the default level.
+	QueryLogCompressionLevel int `yaml:"querylog_compression_level"`
+	// QueryLogEncryptionPassphrase is the passphrase, from which the key
+	// encrypting the stored query log records is derived.  Empty means no
+	// encryption, unless QueryLogEncryptionKeyFile is set.
+	QueryLogEncryptionPassphrase string `yaml:"querylog_encryption_passphrase"`
+	// QueryLogEncryptionKeyFile is the path to the file with the hex-encoded
+	// 256-bit key encrypting the stored query log records.  It takes
+	// precedence over QueryLogEncryptionPassphrase.
+	QueryLogEncryptionKeyFile string `yaml:"querylog_encryption_key_file"`
+	// QueryLogSyslog is the configuration of forwarding the query log entries
+	// to a remote syslog server.
+	QueryLogSyslog querylog.SyslogConfig `yaml:"querylog_syslog"`
+	// QueryLogExporter is the configuration of exporting the query log entries
+	// into ClickHouse or Elasticsearch.
+	QueryLogExporter querylog.ExporterConfig `yaml:"querylog_exporter"`
+	// QueryLogArchive is the configuration of uploading the rotated query log
+	// files into an S3-compatible object storage.
+	QueryLogArchive querylog.ArchiveConfig `yaml:"querylog_archive"`
+	// QueryLogIgnoredDomains are the domains, which queries are neither
+	// logged nor counted in the statistics.  Wildcards are supported.
+	QueryLogIgnoredDomains []string `yaml:"querylog_ignored_domains"`
+	// QueryLogIgnoredClients are the IP addresses, CIDRs, and ClientIDs of the
+	// clients, which queries are neither logged nor counted in the
+	// statistics.  Wildcards are supported.
+	QueryLogIgnoredClients []string `yaml:"querylog_ignored_clients"`
 
 	// AnonymizeClientIP defines if clients' IP addresses should be anonymized
 	// in query log and statistics.
 	AnonymizeClientIP bool `yaml:"anonymize_client_ip"`
 
+	// AnonymizationMode is the way the clients' IP addresses are anonymized:
+	// either "mask" or "hash".
+	AnonymizationMode querylog.AnonymizationMode `yaml:"anonymization_mode"`
+
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	DnsfilterConf *filtering.Config `yaml:",inline"`
@@ -241,6 +338,16 @@ var config = &configuration{
 		QueryLogFileEnabled: true,
 		QueryLogInterval:    timeutil.Duration{Duration: 90 * timeutil.Day},
 		QueryLogMemSize:     1000,
+		QueryLogBackend:     querylog.BackendFile,
+		AnonymizationMode:   querylog.AnonymizationModeMask,
+		QueryLogSyslog: querylog.SyslogConfig{
+			Protocol: querylog.SyslogProtoUDP,
+			Format:   querylog.SyslogFormatRFC5424,
+		},
+		QueryLogExporter: querylog.ExporterConfig{
+			Kind:  querylog.ExporterKindClickHouse,
+			Table: "querylog",
+		},
 		FilteringConfig: dnsforward.FilteringConfig{
 			ProtectionEnabled:  true, // whether or not use any of filtering features
 			BlockingMode:       dnsforward.BlockingModeDefault,
@@ -249,12 +356,25 @@ var config = &configuration{
 			RefuseAny:          true,
 			AllServers:         false,
 			HandleDDR:          true,
+			BlockDoHCanary:     true,
 			FastestTimeout: timeutil.Duration{
 				Duration: fastip.DefaultPingWaitTimeout,
 			},
 
 			TrustedProxies: []string{"127.0.0.0/8", "::1/128"},
 			CacheSize:      4 * 1024 * 1024,
+			CacheWarmUp:    true,
+
+			ServfailDamping: dnsforward.ServfailDampingConfig{
+				Window:    timeutil.Duration{Duration: 10 * time.Second},
+				Backoff:   timeutil.Duration{Duration: 30 * time.Second},
+				Threshold: 10,
+			},
+			ResolvedArchive: dnsforward.ResolvedArchiveConfig{
+				Retention:  timeutil.Duration{Duration: timeutil.Day},
+				MaxEntries: 100_000,
+			},
+			FilteringFailureMode: dnsforward.FilteringFailOpen,
 
 			// set default maximum concurrent queries to 300
 			// we introduced a default limit due to this:
@@ -273,6 +393,13 @@ var config = &configuration{
 		UpstreamTimeout: timeutil.Duration{Duration: dnsforward.DefaultTimeout},
 		UsePrivateRDNS:  true,
 	},
+	Reports: reportsConfig{
+		SMTP: smtpConfig{
+			Port: 587,
+		},
+		Schedule: reportScheduleWeekly,
+		Hour:     8,
+	},
 	TLS: tlsConfigSettings{
 		PortHTTPS:       defaultPortHTTPS,
 		PortDNSOverTLS:  defaultPortTLS, // needs to be passed through to dnsproxy
@@ -309,6 +436,7 @@ var config = &configuration{
 		},
 	},
 	logSettings: logSettings{
+		Format:     aghlog.FormatText,
 		Compress:   false,
 		LocalTime:  false,
 		MaxBackups: 0,
@@ -388,6 +516,12 @@ func parseConfig() (err error) {
 		return fmt.Errorf("validating udp ports: %w", err)
 	}
 
+	// The per-client tops are the browsing history of each client, which the
+	// hashed mode mustn't store.
+	if config.DNS.QueryLogHashed && config.DNS.StatsPerClientTops {
+		return errors.Error("statistics_per_client_tops isn't supported with querylog_hashed")
+	}
+
 	if !filtering.ValidateUpdateIvl(config.DNS.DnsfilterConf.FiltersUpdateIntervalHours) {
 		config.DNS.DnsfilterConf.FiltersUpdateIntervalHours = 24
 	}
@@ -459,8 +593,21 @@ func (c *configuration) write() (err error) {
 		config.DNS.QueryLogEnabled = dc.Enabled
 		config.DNS.QueryLogFileEnabled = dc.FileEnabled
 		config.DNS.QueryLogInterval = timeutil.Duration{Duration: dc.RotationIvl}
+		config.DNS.QueryLogClientRetention = timeutil.Duration{Duration: dc.ClientRetention}
+		config.DNS.QueryLogCoalesceInterval = timeutil.Duration{Duration: dc.CoalesceIvl}
 		config.DNS.QueryLogMemSize = dc.MemSize
+		config.DNS.QueryLogFlushInterval = timeutil.Duration{Duration: dc.FlushInterval}
+		config.DNS.QueryLogMaxSize = uint32(dc.MaxSize / megabyte)
+		config.DNS.QueryLogBackend = dc.Backend
+		config.DNS.QueryLogCompress = dc.Compress
+		config.DNS.QueryLogCompressionLevel = dc.CompressionLevel
+		config.DNS.QueryLogSyslog = dc.Syslog
+		config.DNS.QueryLogExporter = dc.Exporter
+		config.DNS.QueryLogArchive = dc.Archive
+		config.DNS.QueryLogIgnoredDomains = dc.IgnoredDomains
+		config.DNS.QueryLogIgnoredClients = dc.IgnoredClients
 		config.DNS.AnonymizeClientIP = dc.AnonymizeClientIP
+		config.DNS.AnonymizationMode = dc.AnonymizationMode
 	}
 
 	if Context.filters != nil {
@@ -482,6 +629,14 @@ func (c *configuration) write() (err error) {
 		Context.dhcpServer.WriteDiskConfig(config.DHCP)
 	}
 
+	if Context.reports != nil {
+		Context.reports.writeDiskConfig(&config.Reports)
+	}
+
+	if Context.profiles != nil {
+		Context.profiles.writeDiskConfig(&config.SettingsProfiles)
+	}
+
 	config.Clients.Persistent = Context.clients.forConfig()
 
 	configFile := config.getConfigFilename()
@@ -109,6 +109,10 @@ type statusResponse struct {
 	// openapi.yaml declares.
 	IsDHCPAvailable bool `json:"dhcp_available"`
 	IsRunning       bool `json:"running"`
+
+	// ActiveProfile is the name of the last activated settings profile, if
+	// any.
+	ActiveProfile string `json:"active_profile,omitempty"`
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -143,6 +147,10 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		resp.IsProtectionEnabled = c.ProtectionEnabled
 	}
 
+	if Context.profiles != nil {
+		resp.ActiveProfile = Context.profiles.active()
+	}
+
 	// IsDHCPAvailable field is now false by default for Windows.
 	if runtime.GOOS != "windows" {
 		resp.IsDHCPAvailable = Context.dhcpServer != nil
@@ -153,12 +161,17 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 
 type profileJSON struct {
 	Name string `json:"name"`
+
+	// Clients are the names of the clients administered by a delegated
+	// administrator.
+	Clients []string `json:"clients,omitempty"`
 }
 
 func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	u := Context.auth.getCurrentUser(r)
 	resp := &profileJSON{
-		Name: u.Name,
+		Name:    u.Name,
+		Clients: u.Clients,
 	}
 
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
@@ -174,6 +187,7 @@ func registerControlHandlers() {
 	Context.mux.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	httpRegister(http.MethodPost, "/control/update", handleUpdate)
 	httpRegister(http.MethodGet, "/control/profile", handleGetProfile)
+	httpRegister(http.MethodGet, "/control/roaming/bundle", handleRoamingBundle)
 
 	// No auth is necessary for DoH/DoT configurations
 	Context.mux.HandleFunc("/apple/doh.mobileconfig", postInstall(handleMobileConfigDoH))
@@ -185,6 +199,12 @@ func httpRegister(method, url string, handler http.HandlerFunc) {
 	if method == "" {
 		// "/dns-query" handler doesn't need auth, gzip and isn't restricted by 1 HTTP method
 		Context.mux.HandleFunc(url, postInstall(handler))
+		return
+	} else if strings.HasPrefix(url, portalPathPrefix) {
+		// The portal handlers are authenticated by the portal tokens of the
+		// clients instead of the administrator's credentials.
+		Context.mux.Handle(url, postInstallHandler(portalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
+
 		return
 	}
 
@@ -286,7 +306,8 @@ func preInstall(handler func(http.ResponseWriter, *http.Request)) func(http.Resp
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !Context.firstRun {
 			// if it's not first run, don't let users access it (for example /install.html when configuration is done)
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			aghhttp.Error(r, w, http.StatusForbidden, "%s", http.StatusText(http.StatusForbidden))
+
 			return
 		}
 		handler(w, r)
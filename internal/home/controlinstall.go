@@ -75,6 +75,17 @@ type checkConfReq struct {
 	SetStaticIP bool            `json:"set_static_ip"`
 }
 
+// type check
+var _ aghhttp.Validator = (*checkConfReq)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for *checkConfReq.
+func (req *checkConfReq) Validate() (err error) {
+	return aghhttp.ValidateAll(
+		aghhttp.ValidatePort("web.port", req.Web.Port),
+		aghhttp.ValidatePort("dns.port", req.DNS.Port),
+	)
+}
+
 type checkConfRespEnt struct {
 	Status     string `json:"status"`
 	CanAutofix bool   `json:"can_autofix"`
@@ -171,13 +182,18 @@ func (req *checkConfReq) validateDNS(
 func (web *Web) handleInstallCheckConfig(w http.ResponseWriter, r *http.Request) {
 	req := &checkConfReq{}
 
-	err := json.NewDecoder(r.Body).Decode(req)
+	err := aghhttp.DecodeJSON(r, req)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "decoding the request: %s", err)
 
 		return
 	}
 
+	// Release the ports taken by the captive setup before checking them.  The
+	// setup isn't finished yet, so start it again afterwards.
+	resumeCaptive := pauseCaptiveSetup()
+	defer resumeCaptive()
+
 	resp := &checkConfResp{}
 	tcpPorts := aghalg.UniqChecker[tcpPort]{}
 	if err = req.validateWeb(tcpPorts); err != nil {
@@ -316,6 +332,17 @@ type applyConfigReq struct {
 	DNS applyConfigReqEnt `json:"dns"`
 }
 
+// type check
+var _ aghhttp.Validator = (*applyConfigReq)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for *applyConfigReq.
+func (req *applyConfigReq) Validate() (err error) {
+	return aghhttp.ValidateAll(
+		aghhttp.ValidatePort("web.port", req.Web.Port),
+		aghhttp.ValidatePort("dns.port", req.DNS.Port),
+	)
+}
+
 // copyInstallSettings copies the installation parameters between two
 // configuration structures.
 func copyInstallSettings(dst, src *configuration) {
@@ -397,6 +424,16 @@ func (web *Web) handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Release the ports taken by the captive setup, but only stop it for good
+	// if the configuration is applied.
+	resumeCaptive := pauseCaptiveSetup()
+	applied := false
+	defer func() {
+		if !applied {
+			resumeCaptive()
+		}
+	}()
+
 	err = aghnet.CheckPort("udp", netip.AddrPortFrom(req.DNS.IP, uint16(req.DNS.Port)))
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
@@ -447,6 +484,8 @@ func (web *Web) handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	applied = true
+
 	web.conf.firstRun = false
 	web.conf.BindHost = req.Web.IP
 	web.conf.BindPort = req.Web.Port
@@ -486,6 +525,11 @@ func decodeApplyConfigReq(r io.Reader) (req *applyConfigReq, restartHTTP bool, e
 		return nil, false, fmt.Errorf("parsing request: %w", err)
 	}
 
+	err = req.Validate()
+	if err != nil {
+		return nil, false, err
+	}
+
 	if req.Web.Port == 0 || req.DNS.Port == 0 {
 		return nil, false, errors.Error("ports cannot be 0")
 	}
@@ -541,7 +585,7 @@ type checkConfigReqBeta struct {
 // functionality will appear in default handleInstallCheckConfig.
 func (web *Web) handleInstallCheckConfigBeta(w http.ResponseWriter, r *http.Request) {
 	reqData := checkConfigReqBeta{}
-	err := json.NewDecoder(r.Body).Decode(&reqData)
+	err := aghhttp.DecodeJSON(r, &reqData)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to parse 'check_config' JSON data: %s", err)
 
@@ -614,7 +658,7 @@ type applyConfigReqBeta struct {
 // functionality will appear in default handleInstallConfigure.
 func (web *Web) handleInstallConfigureBeta(w http.ResponseWriter, r *http.Request) {
 	reqData := applyConfigReqBeta{}
-	err := json.NewDecoder(r.Body).Decode(&reqData)
+	err := aghhttp.DecodeJSON(r, &reqData)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to parse 'check_config' JSON data: %s", err)
 
@@ -45,7 +45,7 @@ func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
 
 	var err error
 	if r.ContentLength != 0 {
-		err = json.NewDecoder(r.Body).Decode(req)
+		err = aghhttp.DecodeJSON(r, req)
 		if err != nil {
 			aghhttp.Error(r, w, http.StatusBadRequest, "parsing request: %s", err)
 
@@ -0,0 +1,254 @@
+package home
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/exp/slices"
+)
+
+// delegatedRoutes are the control API routes available to the delegated
+// administrators, that is the users administering only some of the clients.
+// The keys have the "METHOD /path" format.
+var delegatedRoutes = stringutil.NewSet(
+	http.MethodGet+" /control/status",
+	http.MethodGet+" /control/profile",
+	http.MethodGet+" /control/logout",
+	http.MethodGet+" /control/clients",
+	http.MethodPost+" /control/clients/update",
+	http.MethodGet+" /control/querylog",
+	http.MethodGet+" /control/querylog_info",
+	http.MethodGet+" /control/querylog_export",
+	http.MethodPost+" /control/querylog_jobs",
+	http.MethodGet+" /control/querylog_jobs/status",
+	http.MethodGet+" /control/querylog_jobs/result",
+	http.MethodPost+" /control/querylog_jobs/cancel",
+	http.MethodGet+" /control/blocked_services/services",
+)
+
+// delegatedSubtrees are the prefixes of the paths of the control API routes
+// with the parameters in the path available to the delegated administrators.
+// The keys have the same format as the ones of delegatedRoutes.
+var delegatedSubtrees = []string{
+	http.MethodGet + " /control/querylog/",
+}
+
+// isDelegatedRoute returns true if the delegated administrators may use the
+// control API route with the method and the path.
+func isDelegatedRoute(method, path string) (ok bool) {
+	route := method + " " + path
+	if delegatedRoutes.Has(route) {
+		return true
+	}
+
+	for _, prefix := range delegatedSubtrees {
+		if strings.HasPrefix(route, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDelegated returns true if u may only administer some of the clients.
+func (u *webUser) isDelegated() (ok bool) {
+	return len(u.Clients) > 0
+}
+
+// managesClient returns true if u may administer the persistent client with
+// the name.
+func (u *webUser) managesClient(name string) (ok bool) {
+	if !u.isDelegated() {
+		return true
+	}
+
+	for _, n := range u.Clients {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// delegatedIDs returns the identifiers of the persistent clients with the
+// names.  The MAC addresses are replaced with the IP addresses leased to them
+// by the DHCP server, since the MAC addresses aren't written to the query log.
+func (clients *clientsContainer) delegatedIDs(names []string) (ids []string) {
+	var leases []*dhcpd.Lease
+	if clients.dhcpServer != nil {
+		leases = clients.dhcpServer.Leases(dhcpd.LeasesAll)
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, name := range names {
+		c, ok := clients.list[name]
+		if !ok {
+			continue
+		}
+
+		for _, id := range c.IDs {
+			mac, err := net.ParseMAC(id)
+			if err != nil {
+				ids = append(ids, id)
+
+				continue
+			}
+
+			for _, l := range leases {
+				if l.HWAddr.String() == mac.String() {
+					ids = append(ids, l.IP.String())
+				}
+			}
+		}
+	}
+
+	return ids
+}
+
+// queryLogIDs returns the identifiers of the client with id to show its query
+// log.  The MAC address is replaced with the IP addresses leased to it by the
+// DHCP server.  It's a [querylog.ResolveClientFunc].
+func (clients *clientsContainer) queryLogIDs(id string) (ids []string) {
+	mac, err := net.ParseMAC(id)
+	if err != nil {
+		return []string{id}
+	}
+
+	if clients.dhcpServer == nil {
+		return nil
+	}
+
+	for _, l := range clients.dhcpServer.Leases(dhcpd.LeasesAll) {
+		if l.HWAddr.String() == mac.String() {
+			ids = append(ids, l.IP.String())
+		}
+	}
+
+	return ids
+}
+
+// managesIDs returns true if u may see the query log of the client with the
+// identifiers ids, that is if all of them belong to the clients administered by
+// u.
+func (clients *clientsContainer) managesIDs(u webUser, ids []string) (ok bool) {
+	if !u.isDelegated() {
+		return true
+	}
+
+	allowed := clients.delegatedIDs(u.Clients)
+	var nets []netip.Prefix
+	for _, id := range allowed {
+		if p, err := netip.ParsePrefix(id); err == nil {
+			nets = append(nets, p)
+		}
+	}
+
+	for _, id := range ids {
+		if !slices.Contains(allowed, id) && !prefixesContain(nets, id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// prefixesContain returns true if id is an IP address within one of nets.
+func prefixesContain(nets []netip.Prefix, id string) (ok bool) {
+	ip, err := netip.ParseAddr(id)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range nets {
+		if p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkQueryLogAccess returns true if the current user may see the query log
+// of the client with the identifiers ids.  It's a [querylog.ClientAccessFunc].
+func checkQueryLogAccess(r *http.Request, ids []string) (ok bool) {
+	if Context.auth == nil {
+		return true
+	}
+
+	return Context.clients.managesIDs(Context.auth.getCurrentUser(r), ids)
+}
+
+// checkDelegatedUpdate returns an error if u isn't allowed to update the
+// persistent client with the name to c.  The delegated administrators may
+// neither rename their clients nor change their identifiers, since that would
+// allow them to take over other clients.
+func (clients *clientsContainer) checkDelegatedUpdate(u webUser, name string, c *Client) (err error) {
+	if !u.isDelegated() {
+		return nil
+	}
+
+	if !u.managesClient(name) {
+		return fmt.Errorf("client %q is not administered by %q", name, u.Name)
+	} else if c.Name != name {
+		return errors.Error("delegated administrators may not rename clients")
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	prev, ok := clients.list[name]
+	if !ok {
+		// Let [clientsContainer.Update] report the error.
+		return nil
+	}
+
+	if !slices.Equal(prev.IDs, c.IDs) {
+		return errors.Error("delegated administrators may not change client ids")
+	}
+
+	return nil
+}
+
+// restrictDelegated checks if the current user is allowed to make the request
+// and, if the user is a delegated administrator, limits the query log to the
+// requests of their clients.  If ok is false, the response has already been
+// written.
+func restrictDelegated(w http.ResponseWriter, r *http.Request) (rr *http.Request, ok bool) {
+	if Context.auth == nil || !strings.HasPrefix(r.URL.Path, "/control/") {
+		return r, true
+	}
+
+	u := Context.auth.getCurrentUser(r)
+	if !u.isDelegated() {
+		return r, true
+	}
+
+	if !isDelegatedRoute(r.Method, r.URL.Path) {
+		aghhttp.Error(
+			r,
+			w,
+			http.StatusForbidden,
+			"delegated user %q is not allowed to %s %s",
+			u.Name,
+			r.Method,
+			r.URL.Path,
+		)
+
+		return nil, false
+	}
+
+	f := querylog.NewClientsFilter(Context.clients.delegatedIDs(u.Clients))
+
+	return r.WithContext(querylog.WithClientsFilter(r.Context(), f)), true
+}
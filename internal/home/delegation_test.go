@@ -0,0 +1,168 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientsContainer_delegation(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	const mac = "aa:aa:aa:aa:aa:aa"
+
+	clients.dhcpServer = &dhcpd.MockInterface{
+		OnLeases: func(_ dhcpd.GetLeasesFlags) (leases []*dhcpd.Lease) {
+			hwAddr, err := net.ParseMAC(mac)
+			require.NoError(t, err)
+
+			return []*dhcpd.Lease{{
+				HWAddr: hwAddr,
+				IP:     net.IP{1, 1, 1, 2},
+			}}
+		},
+	}
+
+	for _, c := range []*Client{{
+		Name: "kid_phone",
+		IDs:  []string{"1.1.1.1", mac},
+	}, {
+		Name: "kid_laptop",
+		IDs:  []string{"kid-laptop", "1.1.2.0/24"},
+	}, {
+		Name: "parent_phone",
+		IDs:  []string{"2.2.2.2"},
+	}} {
+		ok, err := clients.Add(c)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	admin := webUser{Name: "admin"}
+	parent := webUser{
+		Name:    "parent",
+		Clients: []string{"kid_phone", "kid_laptop"},
+	}
+
+	t.Run("manages", func(t *testing.T) {
+		assert.True(t, admin.managesClient("parent_phone"))
+		assert.True(t, parent.managesClient("kid_phone"))
+		assert.False(t, parent.managesClient("parent_phone"))
+	})
+
+	t.Run("ids", func(t *testing.T) {
+		ids := clients.delegatedIDs(parent.Clients)
+		assert.ElementsMatch(t, []string{"1.1.1.1", "1.1.1.2", "kid-laptop", "1.1.2.0/24"}, ids)
+	})
+
+	t.Run("query_log_ids", func(t *testing.T) {
+		assert.Equal(t, []string{"1.1.1.2"}, clients.queryLogIDs(mac))
+		assert.Equal(t, []string{"kid-laptop"}, clients.queryLogIDs("kid-laptop"))
+		assert.Empty(t, clients.queryLogIDs("bb:bb:bb:bb:bb:bb"))
+	})
+
+	t.Run("manages_ids", func(t *testing.T) {
+		assert.True(t, clients.managesIDs(admin, []string{"2.2.2.2"}))
+		assert.True(t, clients.managesIDs(parent, []string{"1.1.1.2"}))
+		assert.True(t, clients.managesIDs(parent, []string{"1.1.2.3", "kid-laptop"}))
+		assert.False(t, clients.managesIDs(parent, []string{"1.1.1.1", "2.2.2.2"}))
+		assert.False(t, clients.managesIDs(parent, []string{"1.1.3.1"}))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		testCases := []struct {
+			user       webUser
+			client     *Client
+			name       string
+			clientName string
+			wantErrMsg string
+		}{{
+			user:       admin,
+			client:     &Client{Name: "new_name", IDs: []string{"3.3.3.3"}},
+			name:       "admin",
+			clientName: "parent_phone",
+			wantErrMsg: "",
+		}, {
+			user:       parent,
+			client:     &Client{Name: "kid_phone", IDs: []string{"1.1.1.1", mac}},
+			name:       "allowed",
+			clientName: "kid_phone",
+			wantErrMsg: "",
+		}, {
+			user:       parent,
+			client:     &Client{Name: "parent_phone", IDs: []string{"2.2.2.2"}},
+			name:       "not_managed",
+			clientName: "parent_phone",
+			wantErrMsg: `client "parent_phone" is not administered by "parent"`,
+		}, {
+			user:       parent,
+			client:     &Client{Name: "kid_tablet", IDs: []string{"1.1.1.1", mac}},
+			name:       "rename",
+			clientName: "kid_phone",
+			wantErrMsg: "delegated administrators may not rename clients",
+		}, {
+			user:       parent,
+			client:     &Client{Name: "kid_phone", IDs: []string{"2.2.2.2"}},
+			name:       "change_ids",
+			clientName: "kid_phone",
+			wantErrMsg: "delegated administrators may not change client ids",
+		}}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				err := clients.checkDelegatedUpdate(tc.user, tc.clientName, tc.client)
+				if tc.wantErrMsg == "" {
+					assert.NoError(t, err)
+
+					return
+				}
+
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+			})
+		}
+	})
+}
+
+func TestIsDelegatedRoute(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		want   bool
+	}{{
+		name:   "route",
+		method: http.MethodGet,
+		path:   "/control/querylog",
+		want:   true,
+	}, {
+		name:   "subtree",
+		method: http.MethodGet,
+		path:   "/control/querylog/1667300000000000000",
+		want:   true,
+	}, {
+		name:   "subtree_bad_method",
+		method: http.MethodPost,
+		path:   "/control/querylog/1667300000000000000",
+		want:   false,
+	}, {
+		name:   "not_delegated",
+		method: http.MethodPost,
+		path:   "/control/querylog_clear",
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isDelegatedRoute(tc.method, tc.path))
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/google/renameio/maybe"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// deviceHistoryFileName is the name of the file within the data directory,
+// which the device history is stored in.
+const deviceHistoryFileName = "devices.json"
+
+// deviceHistorySaveIvl is the interval between the savings of the changed
+// device history.
+const deviceHistorySaveIvl = 5 * time.Minute
+
+// seenDevice is a device, which has ever sent a DNS query.
+type seenDevice struct {
+	// FirstSeen is the time of the first query from the device.
+	FirstSeen time.Time `json:"first_seen"`
+
+	// LastSeen is the time of the latest query from the device.
+	LastSeen time.Time `json:"last_seen"`
+
+	// ID identifies the device within the history.  It's the MAC address of
+	// the device, if it's known, and its IP address otherwise.
+	ID string `json:"id"`
+
+	// MAC is the MAC address of the device, if it's known.
+	MAC string `json:"mac,omitempty"`
+
+	// IPs are the IP addresses the device has sent the queries from.
+	IPs []string `json:"ips"`
+
+	// ClientIDs are the ClientIDs the device has sent the queries with.
+	ClientIDs []string `json:"client_ids"`
+
+	// Names are the names of the persistent and runtime clients the device
+	// has been known as.
+	Names []string `json:"names"`
+}
+
+// deviceHistory is the persistent record of every device ever seen.  Unlike the
+// statistics, it isn't limited by any time window.
+type deviceHistory struct {
+	// mu protects devices and changed.
+	mu *sync.Mutex
+
+	// devices maps the IDs of the devices to the devices.
+	devices map[string]*seenDevice
+
+	// findMAC returns the MAC address of the device with the IP address, if
+	// it's known.
+	findMAC func(ip net.IP) (mac net.HardwareAddr)
+
+	// findNames returns the names of the clients with the IP address and the
+	// ClientID.
+	findNames func(ip net.IP, clientID string) (names []string)
+
+	// done is closed when the history is closed.
+	done chan struct{}
+
+	// path is the path to the file, which the history is stored in.
+	path string
+
+	// changed is true if the history has been changed since the last saving.
+	changed bool
+}
+
+// newDeviceHistory returns a new device history stored in the file at path,
+// loading the previously seen devices from it.
+func newDeviceHistory(
+	path string,
+	findMAC func(ip net.IP) (mac net.HardwareAddr),
+	findNames func(ip net.IP, clientID string) (names []string),
+) (h *deviceHistory, err error) {
+	h = &deviceHistory{
+		mu:        &sync.Mutex{},
+		devices:   map[string]*seenDevice{},
+		findMAC:   findMAC,
+		findNames: findNames,
+		done:      make(chan struct{}),
+		path:      path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	var devices []*seenDevice
+	err = json.Unmarshal(data, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+
+	for _, d := range devices {
+		h.devices[d.ID] = d
+	}
+
+	return h, nil
+}
+
+// seen records the query from the device with the IP address and the ClientID
+// made at now.
+func (h *deviceHistory) seen(ip net.IP, clientID string, now time.Time) {
+	var mac string
+	if hwa := h.findMAC(ip); hwa != nil {
+		mac = hwa.String()
+	}
+
+	ipStr := ip.String()
+	id := stringutil.Coalesce(mac, ipStr)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.changed = true
+
+	d, ok := h.devices[id]
+	if !ok {
+		log.Info("devices: new device %s", id)
+
+		d = &seenDevice{
+			FirstSeen: now,
+			ID:        id,
+			MAC:       mac,
+			IPs:       []string{},
+			ClientIDs: []string{},
+			Names:     []string{},
+		}
+		h.devices[id] = d
+	}
+
+	d.LastSeen = now
+
+	isNew := !ok
+	if !slices.Contains(d.IPs, ipStr) {
+		d.IPs = append(d.IPs, ipStr)
+		isNew = true
+	}
+
+	if clientID != "" && !slices.Contains(d.ClientIDs, clientID) {
+		d.ClientIDs = append(d.ClientIDs, clientID)
+		isNew = true
+	}
+
+	// The names of the runtime clients are usually resolved after the first
+	// queries, so look them up until there are some.
+	if !isNew && len(d.Names) > 0 {
+		return
+	}
+
+	for _, name := range h.findNames(ip, clientID) {
+		if name != "" && !slices.Contains(d.Names, name) {
+			d.Names = append(d.Names, name)
+		}
+	}
+}
+
+// list returns the seen devices, the most recently seen first.
+func (h *deviceHistory) list() (devices []*seenDevice) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	devices = make([]*seenDevice, 0, len(h.devices))
+	for _, d := range h.devices {
+		cloned := *d
+		cloned.IPs = slices.Clone(d.IPs)
+		cloned.ClientIDs = slices.Clone(d.ClientIDs)
+		cloned.Names = slices.Clone(d.Names)
+
+		devices = append(devices, &cloned)
+	}
+
+	slices.SortFunc(devices, func(a, b *seenDevice) (less bool) {
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+
+		return a.ID < b.ID
+	})
+
+	return devices
+}
+
+// remove removes the devices with the given IDs from the history.  If ids is
+// empty, all devices are removed.
+func (h *deviceHistory) remove(ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(ids) == 0 {
+		maps.Clear(h.devices)
+	}
+
+	for _, id := range ids {
+		delete(h.devices, id)
+	}
+
+	h.changed = true
+}
+
+// save writes the history into the file, if it has been changed.
+func (h *deviceHistory) save() (err error) {
+	h.mu.Lock()
+	if !h.changed {
+		h.mu.Unlock()
+
+		return nil
+	}
+
+	devices := maps.Values(h.devices)
+	data, err := json.Marshal(devices)
+	h.changed = false
+	h.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	err = maybe.WriteFile(h.path, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	log.Debug("devices: saved %d devices", len(devices))
+
+	return nil
+}
+
+// start starts saving the history periodically.
+func (h *deviceHistory) start() {
+	go h.periodicSave()
+}
+
+// periodicSave saves the changed history once in a while until the history is
+// closed.
+func (h *deviceHistory) periodicSave() {
+	defer log.OnPanic("devices: saving")
+
+	t := time.NewTicker(deviceHistorySaveIvl)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := h.save(); err != nil {
+				log.Error("devices: saving: %s", err)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// close stops saving the history periodically and saves it for the last time.
+func (h *deviceHistory) close() (err error) {
+	close(h.done)
+
+	return h.save()
+}
+
+// devicesListJSON is the response to the GET /control/devices HTTP API.
+type devicesListJSON struct {
+	Devices []*seenDevice `json:"devices"`
+}
+
+// handleDevicesList is the handler for the GET /control/devices HTTP API.
+func (h *deviceHistory) handleDevicesList(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, &devicesListJSON{
+		Devices: h.list(),
+	})
+}
+
+// devicesDeleteReq is the request for the POST /control/devices/delete HTTP
+// API.
+type devicesDeleteReq struct {
+	IDs []string `json:"ids"`
+}
+
+// handleDevicesDelete is the handler for the POST /control/devices/delete HTTP
+// API.
+func (h *deviceHistory) handleDevicesDelete(w http.ResponseWriter, r *http.Request) {
+	req := &devicesDeleteReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	} else if len(req.IDs) == 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no ids")
+
+		return
+	}
+
+	h.remove(req.IDs)
+}
+
+// handleDevicesClear is the handler for the POST /control/devices/clear HTTP
+// API.
+func (h *deviceHistory) handleDevicesClear(_ http.ResponseWriter, _ *http.Request) {
+	h.remove(nil)
+}
+
+// registerWebHandlers registers the HTTP handlers of the device history.
+func (h *deviceHistory) registerWebHandlers() {
+	httpRegister(http.MethodGet, "/control/devices", h.handleDevicesList)
+	httpRegister(http.MethodPost, "/control/devices/delete", h.handleDevicesDelete)
+	httpRegister(http.MethodPost, "/control/devices/clear", h.handleDevicesClear)
+}
+
+// findMAC returns the MAC address of the DHCP client with the IP address, if
+// any.
+func (clients *clientsContainer) findMAC(ip net.IP) (mac net.HardwareAddr) {
+	if clients.dhcpServer == nil {
+		return nil
+	}
+
+	return clients.dhcpServer.FindMACbyIP(ip)
+}
+
+// deviceNames returns the names of the persistent client with the ClientID or
+// the IP address and of the runtime client with the IP address, if any.
+func (clients *clientsContainer) deviceNames(ip net.IP, clientID string) (names []string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findLocked(stringutil.Coalesce(clientID, ip.String()))
+	if ok {
+		names = append(names, c.Name)
+	}
+
+	rc, ok := clients.findRuntimeClientLocked(ip)
+	if ok {
+		names = append(names, rc.Host)
+	}
+
+	return names
+}
@@ -0,0 +1,89 @@
+package home
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceHistory(t *testing.T) {
+	knownIP := net.IP{192, 168, 0, 2}
+	knownMAC := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	findMAC := func(ip net.IP) (mac net.HardwareAddr) {
+		if ip.Equal(knownIP) {
+			return knownMAC
+		}
+
+		return nil
+	}
+
+	names := map[string]string{}
+	findNames := func(ip net.IP, _ string) (res []string) {
+		if name, ok := names[ip.String()]; ok {
+			res = append(res, name)
+		}
+
+		return res
+	}
+
+	path := filepath.Join(t.TempDir(), deviceHistoryFileName)
+	h, err := newDeviceHistory(path, findMAC, findNames)
+	require.NoError(t, err)
+
+	first := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := first.Add(time.Hour)
+
+	h.seen(knownIP, "", first)
+	h.seen(net.IP{192, 168, 0, 3}, "cli", first)
+
+	// The name of the runtime client is resolved after the first query.
+	names["192.168.0.2"] = "host.lan"
+	h.seen(knownIP, "", last)
+
+	devices := h.list()
+	require.Len(t, devices, 2)
+
+	assert.Equal(t, &seenDevice{
+		FirstSeen: first,
+		LastSeen:  last,
+		ID:        knownMAC.String(),
+		MAC:       knownMAC.String(),
+		IPs:       []string{"192.168.0.2"},
+		ClientIDs: []string{},
+		Names:     []string{"host.lan"},
+	}, devices[0])
+	assert.Equal(t, &seenDevice{
+		FirstSeen: first,
+		LastSeen:  first,
+		ID:        "192.168.0.3",
+		IPs:       []string{"192.168.0.3"},
+		ClientIDs: []string{"cli"},
+		Names:     []string{},
+	}, devices[1])
+
+	t.Run("persistence", func(t *testing.T) {
+		require.NoError(t, h.save())
+
+		var loaded *deviceHistory
+		loaded, err = newDeviceHistory(path, findMAC, findNames)
+		require.NoError(t, err)
+
+		assert.Equal(t, devices, loaded.list())
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		h.remove([]string{"192.168.0.3"})
+		devices = h.list()
+		require.Len(t, devices, 1)
+
+		assert.Equal(t, knownMAC.String(), devices[0].ID)
+
+		h.remove(nil)
+		assert.Empty(t, h.list())
+	})
+}
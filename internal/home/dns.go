@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -30,6 +31,15 @@ const (
 	defaultPortTLS   = 853
 )
 
+// anonymizationKeyFileName is the name of the file within the data directory
+// containing the key for hashing the clients' IP addresses.
+const anonymizationKeyFileName = "anonymization.key"
+
+// filtersChangelogFileName is the name of the file within the volatile data
+// directory, which the changes of the filter lists made by the updates are
+// stored in.
+const filtersChangelogFileName = "filters_changelog.json"
+
 // Called by other modules when configuration is changed
 func onConfigModified() {
 	err := config.write()
@@ -38,42 +48,124 @@ func onConfigModified() {
 	}
 }
 
-// initDNSServer creates an instance of the dnsforward.Server
-// Please note that we must do it even if we don't start it
-// so that we had access to the query log and the stats
-func initDNSServer() (err error) {
-	baseDir := Context.getDataDir()
-
-	var anonFunc aghnet.IPMutFunc
-	if config.DNS.AnonymizeClientIP {
-		anonFunc = querylog.AnonymizeIP
+// newStatsConfig returns the configuration of the statistics stored within
+// volatileDir.
+func newStatsConfig(volatileDir string) (conf stats.Config) {
+	buckets := make([]time.Duration, 0, len(config.DNS.StatsLatencyBuckets))
+	for _, b := range config.DNS.StatsLatencyBuckets {
+		buckets = append(buckets, b.Duration)
 	}
-	anonymizer := aghnet.NewIPMut(anonFunc)
 
-	statsConf := stats.Config{
-		Filename:       filepath.Join(baseDir, "stats.db"),
+	return stats.Config{
+		Filename:       filepath.Join(volatileDir, "stats.db"),
 		LimitDays:      config.DNS.StatsInterval,
+		LatencyBuckets: buckets,
+		PerClientTops:  config.DNS.StatsPerClientTops,
 		ConfigModified: onConfigModified,
 		HTTPRegister:   httpRegister,
+		ExtraCounters:  extraCounters,
+		ClientsHidden:  metricsClientsHidden,
 	}
-	Context.stats, err = stats.New(statsConf)
-	if err != nil {
-		return fmt.Errorf("init stats: %w", err)
-	}
+}
+
+// metricsClientsHidden returns true if the query log anonymizes or hashes the
+// clients, so the metrics mustn't expose them either.
+func metricsClientsHidden() (ok bool) {
+	config.RLock()
+	defer config.RUnlock()
+
+	return config.DNS.QueryLogHashed || config.DNS.AnonymizeClientIP
+}
 
-	conf := querylog.Config{
+// newQueryLogConfig returns the configuration of the query log stored within
+// volatileDir.
+func newQueryLogConfig(
+	volatileDir string,
+	anonymizer *aghnet.IPMut,
+	anonKey []byte,
+) (conf querylog.Config) {
+	return querylog.Config{
 		Anonymizer:        anonymizer,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 		FindClient:        Context.clients.findMultiple,
-		BaseDir:           baseDir,
+		CheckHost:         replayCheckHost,
+		ResolveClient:     Context.clients.queryLogIDs,
+		CheckClientAccess: checkQueryLogAccess,
+		ImportStats:       importStats,
+		BaseDir:           volatileDir,
 		RotationIvl:       config.DNS.QueryLogInterval.Duration,
+		MaxSize:           uint64(config.DNS.QueryLogMaxSize) * megabyte,
+		ClientRetention:   config.DNS.QueryLogClientRetention.Duration,
+		CoalesceIvl:       config.DNS.QueryLogCoalesceInterval.Duration,
 		MemSize:           config.DNS.QueryLogMemSize,
+		FlushInterval:     config.DNS.QueryLogFlushInterval.Duration,
+		Backend:           config.DNS.QueryLogBackend,
+		CompressionLevel:  config.DNS.QueryLogCompressionLevel,
+		Syslog:            config.DNS.QueryLogSyslog,
+		Exporter:          config.DNS.QueryLogExporter,
+		Archive:           config.DNS.QueryLogArchive,
+		IgnoredDomains:    config.DNS.QueryLogIgnoredDomains,
+		IgnoredClients:    config.DNS.QueryLogIgnoredClients,
 		Enabled:           config.DNS.QueryLogEnabled,
 		FileEnabled:       config.DNS.QueryLogFileEnabled,
+		Compress:          config.DNS.QueryLogCompress,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
+		AnonymizationMode: config.DNS.AnonymizationMode,
+		AnonymizationKey:  anonKey,
+		Hashed:            config.DNS.QueryLogHashed,
+
+		EncryptionPassphrase: config.DNS.QueryLogEncryptionPassphrase,
+		EncryptionKeyFile:    config.DNS.QueryLogEncryptionKeyFile,
+	}
+}
+
+// importStats passes the statistics data of the queries imported into the
+// query log to the statistics, if they're initialized.
+func importStats(entries []stats.Entry) {
+	if Context.stats != nil {
+		Context.stats.Import(entries)
 	}
-	Context.queryLog = querylog.New(conf)
+}
+
+// initDNSServer creates an instance of the dnsforward.Server
+// Please note that we must do it even if we don't start it
+// so that we had access to the query log and the stats
+func initDNSServer() (err error) {
+	baseDir := Context.getDataDir()
+	volatileDir := Context.getVolatileDataDir()
+
+	anonKey, err := querylog.ReadAnonymizationKey(filepath.Join(baseDir, anonymizationKeyFileName))
+	if err != nil {
+		return fmt.Errorf("reading anonymization key: %w", err)
+	}
+
+	var anonFunc aghnet.IPMutFunc
+	if config.DNS.AnonymizeClientIP {
+		anonFunc = querylog.NewAnonymizer(config.DNS.AnonymizationMode, anonKey)
+	}
+	anonymizer := aghnet.NewIPMut(anonFunc)
+
+	Context.stats, err = stats.New(newStatsConfig(volatileDir))
+	if err != nil {
+		return fmt.Errorf("init stats: %w", err)
+	}
+
+	Context.queryLog = querylog.New(newQueryLogConfig(volatileDir, anonymizer, anonKey))
+
+	Context.devices, err = newDeviceHistory(
+		filepath.Join(volatileDir, deviceHistoryFileName),
+		Context.clients.findMAC,
+		Context.clients.deviceNames,
+	)
+	if err != nil {
+		return fmt.Errorf("init device history: %w", err)
+	}
+
+	Context.devices.registerWebHandlers()
+
+	Context.reports = newReporter(&config.Reports, Context.stats, Context.devices)
+	Context.reports.registerWebHandlers()
 
 	Context.filters, err = filtering.New(config.DNS.DnsfilterConf, nil)
 	if err != nil {
@@ -81,6 +173,24 @@ func initDNSServer() (err error) {
 		return err
 	}
 
+	Context.profiles, err = newProfileSwitcher(&config.SettingsProfiles, Context.filters.SetProfileSettings)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	Context.profiles.registerWebHandlers()
+
+	Context.unblockRequests, err = newUnblockRequests(
+		filepath.Join(Context.getDataDir(), unblockRequestsFileName),
+		func(rule string) { Context.filters.AddUserRules(rule) },
+	)
+	if err != nil {
+		return fmt.Errorf("init unblock requests: %w", err)
+	}
+
+	Context.unblockRequests.registerWebHandlers()
+
 	var privateNets netutil.SubnetSet
 	switch len(config.DNS.PrivateNets) {
 	case 0:
@@ -240,6 +350,13 @@ func generateServerConfig() (newConf dnsforward.ServerConfig, err error) {
 
 	newConf.FilterHandler = applyAdditionalFiltering
 	newConf.GetCustomUpstreamByClient = Context.clients.findUpstreams
+	newConf.ConsumeClientQuota = Context.clients.consumeQuota
+	newConf.BypassCacheForClient = Context.clients.bypassesCache
+
+	devices := Context.devices
+	newConf.DeviceSeen = func(ip net.IP, clientID string) {
+		devices.seen(ip, clientID, time.Now())
+	}
 
 	newConf.LocalPTRResolvers = dnsConf.LocalPTRResolvers
 	newConf.UpstreamTimeout = dnsConf.UpstreamTimeout.Duration
@@ -377,6 +494,74 @@ func applyAdditionalFiltering(clientIP net.IP, clientID string, setts *filtering
 	setts.ParentalEnabled = c.ParentalEnabled
 }
 
+// extraCounters returns the counters of the modules other than the statistics
+// for the metrics.
+func extraCounters() (cs []*stats.Counter) {
+	cs = queryLogCounters()
+	if Context.dnsServer != nil {
+		cs = append(cs, &stats.Counter{
+			Name:  "adguard_home_dns_filtering_errors_total",
+			Help:  "The number of DNS requests and responses the filtering engine has failed to check.",
+			Value: Context.dnsServer.FilteringErrors(),
+		}, &stats.Counter{
+			Name:  "adguard_home_dns_shed_requests_total",
+			Help:  "The number of DNS requests refused, since the goroutines or the file descriptors have been exhausted.",
+			Value: Context.dnsServer.ShedRequests(),
+		})
+	}
+
+	return cs
+}
+
+// queryLogCounters returns the counters of writing the query log entries for
+// the metrics.
+func queryLogCounters() (cs []*stats.Counter) {
+	if Context.queryLog == nil {
+		return nil
+	}
+
+	ws := Context.queryLog.WriteStats()
+
+	return []*stats.Counter{{
+		Name:  "adguard_home_querylog_entries_written_total",
+		Help:  "The number of query log entries written to the storage.",
+		Value: ws.Written,
+	}, {
+		Name:  "adguard_home_querylog_entries_dropped_total",
+		Help:  "The number of query log entries dropped, since the write queue has been full.",
+		Value: ws.Dropped,
+	}, {
+		Name:  "adguard_home_querylog_entries_buffered",
+		Help:  "The number of query log entries in memory waiting to be written to the storage.",
+		Value: ws.Buffered,
+		Gauge: true,
+	}}
+}
+
+// replayCheckHost checks host against the current filtering rules using the
+// current settings of the client.  The safe browsing and parental control
+// checks are skipped, since those require a request to the external service
+// for each host.
+func replayCheckHost(
+	host string,
+	qtype uint16,
+	ip net.IP,
+	clientID string,
+) (res *filtering.Result, err error) {
+	setts := Context.filters.GetConfig()
+	setts.ProtectionEnabled = true
+	applyAdditionalFiltering(ip, clientID, &setts)
+	setts.SafeBrowsingEnabled = false
+	setts.ParentalEnabled = false
+
+	r, err := Context.filters.CheckHost(host, qtype, &setts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
 func startDNSServer() error {
 	config.RLock()
 	defer config.RUnlock()
@@ -394,9 +579,12 @@ func startDNSServer() error {
 		return fmt.Errorf("couldn't start forwarding DNS server: %w", err)
 	}
 
-	Context.filters.Start()
-	Context.stats.Start()
-	Context.queryLog.Start()
+	Context.devices.start()
+	Context.reports.start()
+	Context.profiles.start()
+
+	const topDomainsNumber = 100 // the number of domains to warm up
+	Context.dnsServer.WarmUpCache(Context.stats.TopDomains(topDomainsNumber))
 
 	const topClientsNumber = 100 // the number of clients to get
 	for _, ip := range Context.stats.TopClientsIP(topClientsNumber) {
@@ -446,34 +634,73 @@ func stopDNSServer() (err error) {
 		return fmt.Errorf("closing clients container: %w", err)
 	}
 
-	closeDNSServer()
+	closeDNSModules()
 
 	return nil
 }
 
+// closeDNSServer closes the DNS server along with the modules it depends on,
+// which are otherwise stopped as separate services.  See newServices.
 func closeDNSServer() {
 	// DNS forward module must be closed BEFORE stats or queryLog because it depends on them
+	closeDNSModules()
+
+	Context.filters.Close()
+	closeQueryLog()
+	closeStats()
+
+	log.Debug("all dns modules are closed")
+}
+
+// closeDNSModules closes the DNS server and the modules, which are started
+// along with it.
+func closeDNSModules() {
 	if Context.dnsServer != nil {
 		Context.dnsServer.Close()
 		Context.dnsServer = nil
 	}
 
-	Context.filters.Close()
+	if Context.reports != nil {
+		Context.reports.close()
+		Context.reports = nil
+	}
 
-	if Context.stats != nil {
-		err := Context.stats.Close()
+	if Context.profiles != nil {
+		Context.profiles.close()
+		Context.profiles = nil
+	}
+
+	if Context.devices != nil {
+		err := Context.devices.close()
 		if err != nil {
-			log.Debug("closing stats: %s", err)
+			log.Error("closing device history: %s", err)
 		}
 
-		// TODO(e.burkov):  Find out if it's safe.
-		Context.stats = nil
+		Context.devices = nil
 	}
+}
 
-	if Context.queryLog != nil {
-		Context.queryLog.Close()
-		Context.queryLog = nil
+// closeStats closes the statistics module, if it's not closed yet.
+func closeStats() {
+	if Context.stats == nil {
+		return
 	}
 
-	log.Debug("all dns modules are closed")
+	err := Context.stats.Close()
+	if err != nil {
+		log.Debug("closing stats: %s", err)
+	}
+
+	// TODO(e.burkov):  Find out if it's safe.
+	Context.stats = nil
+}
+
+// closeQueryLog closes the query log module, if it's not closed yet.
+func closeQueryLog() {
+	if Context.queryLog == nil {
+		return
+	}
+
+	Context.queryLog.Close()
+	Context.queryLog = nil
 }
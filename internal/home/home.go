@@ -22,8 +22,10 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghlog"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghsvc"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -52,6 +54,7 @@ type homeContext struct {
 	clients    clientsContainer     // per-client-settings module
 	stats      stats.Interface      // statistics module
 	queryLog   querylog.QueryLog    // query log module
+	devices    *deviceHistory       // device history module
 	dnsServer  *dnsforward.Server   // DNS module
 	rdns       *RDNS                // rDNS module
 	whois      *WHOIS               // WHOIS module
@@ -66,6 +69,23 @@ type homeContext struct {
 	// hostsWatcher is the watcher to detect changes in the hosts files.
 	hostsWatcher aghos.FSWatcher
 
+	// unblockRequests is the queue of the unblock requests made in the
+	// self-service portal of the clients.
+	unblockRequests *unblockRequests
+
+	// reports sends the scheduled reports by email.
+	reports *reporter
+
+	// profiles switches the profiles of the global filtering settings.
+	profiles *profileSwitcher
+
+	// services starts and stops the DNS and DHCP servers.
+	services *aghsvc.Manager
+
+	// captive answers the DNS queries and redirects to the setup page during
+	// the first run.  It's nil unless the captive setup is enabled.
+	captive *captiveSetup
+
 	updater *updater.Updater
 
 	// mux is our custom http.ServeMux.
@@ -97,9 +117,20 @@ func (c *homeContext) getDataDir() string {
 	return filepath.Join(c.workDir, dataDir)
 }
 
+// getVolatileDataDir returns path to the directory where we store the
+// frequently written databases.  It's the data directory unless the read-only
+// mode is enabled.
+func (c *homeContext) getVolatileDataDir() (dir string) {
+	return config.ReadOnly.dataDir(c.workDir, c.getDataDir())
+}
+
 // Context - a global context object
 var Context homeContext
 
+// signalShutdownTimeout is the maximum duration of stopping the modules on a
+// termination signal.
+const signalShutdownTimeout = 10 * time.Second
+
 // Main is the entry point
 func Main(clientBuildFS fs.FS) {
 	initCmdLineOpts()
@@ -123,7 +154,9 @@ func Main(clientBuildFS fs.FS) {
 				Context.clients.Reload()
 				Context.tls.reload()
 			default:
-				cleanup(context.Background())
+				ctx, cancel := context.WithTimeout(context.Background(), signalShutdownTimeout)
+				cleanup(ctx)
+				cancel()
 				cleanupAlways()
 				os.Exit(0)
 			}
@@ -295,12 +328,19 @@ func setupConfig(opts options) (err error) {
 	config.DNS.DnsfilterConf.ConfigModified = onConfigModified
 	config.DNS.DnsfilterConf.HTTPRegister = httpRegister
 	config.DNS.DnsfilterConf.DataDir = Context.getDataDir()
+	config.DNS.DnsfilterConf.ChangelogFilePath = filepath.Join(
+		Context.getVolatileDataDir(),
+		filtersChangelogFileName,
+	)
 	config.DNS.DnsfilterConf.Filters = slices.Clone(config.Filters)
 	config.DNS.DnsfilterConf.WhitelistFilters = slices.Clone(config.WhitelistFilters)
 	config.DNS.DnsfilterConf.UserRules = slices.Clone(config.UserRules)
 	config.DNS.DnsfilterConf.HTTPClient = Context.client
 
 	config.DHCP.WorkDir = Context.workDir
+	if config.ReadOnly.Enabled {
+		config.DHCP.WorkDir = Context.getVolatileDataDir()
+	}
 	config.DHCP.HTTPRegister = httpRegister
 	config.DHCP.ConfigModified = onConfigModified
 
@@ -331,6 +371,18 @@ func setupConfig(opts options) (err error) {
 	}
 
 	Context.clients.Init(config.Clients.Persistent, Context.dhcpServer, Context.etcHosts, arpdb)
+	err = Context.clients.initQuotas(
+		config.Clients.GroupQuotas,
+		filepath.Join(Context.getDataDir(), quotasFileName),
+	)
+	if err != nil {
+		return fmt.Errorf("initing client quotas: %w", err)
+	}
+
+	err = Context.clients.initProviders(config.Clients.Providers, Context.client)
+	if err != nil {
+		return fmt.Errorf("initing client providers: %w", err)
+	}
 
 	if opts.bindPort != 0 {
 		tcpPorts := aghalg.UniqChecker[tcpPort]{}
@@ -450,6 +502,9 @@ func run(opts options, clientBuildFS fs.FS) {
 	err = setupConfig(opts)
 	fatalOnError(err)
 
+	aghhttp.SetLegacyTextErrors(config.LegacyTextErrors)
+	aghhttp.SetStrictJSON(config.StrictJSON)
+
 	if !Context.firstRun {
 		// Save the updated config
 		err = config.write()
@@ -475,7 +530,17 @@ func run(opts options, clientBuildFS fs.FS) {
 		log.Fatalf("Cannot create DNS data dir at %s: %s", Context.getDataDir(), err)
 	}
 
-	sessFilename := filepath.Join(Context.getDataDir(), "sessions.db")
+	if config.ReadOnly.Enabled {
+		volatileDir := Context.getVolatileDataDir()
+		log.Info("read-only mode: storing data files in %s", volatileDir)
+
+		err = prepareVolatileDir(volatileDir)
+		if err != nil {
+			log.Fatalf("Cannot prepare volatile data dir at %s: %s", volatileDir, err)
+		}
+	}
+
+	sessFilename := filepath.Join(Context.getVolatileDataDir(), "sessions.db")
 	GLMode = opts.glinetMode
 	var rateLimiter *authRateLimiter
 	if config.AuthAttempts > 0 && config.AuthBlockMin > 0 {
@@ -512,24 +577,30 @@ func run(opts options, clientBuildFS fs.FS) {
 
 		Context.tls.start()
 
+		Context.services = newServices(Context.dhcpServer)
 		go func() {
-			serr := startDNSServer()
-			if serr != nil {
+			// The manager serializes starting with stopping on a signal, so
+			// the services are never left running on exit.
+			serr := Context.services.Start(context.Background())
+			if errors.Is(serr, aghsvc.ErrShutDown) {
+				return
+			} else if serr != nil {
 				closeDNSServer()
 				fatalOnError(serr)
 			}
 		}()
-
-		if Context.dhcpServer != nil {
-			err = Context.dhcpServer.Start()
-			if err != nil {
-				log.Error("starting dhcp server: %s", err)
-			}
-		}
 	}
 
 	Context.web.Start()
 
+	if Context.firstRun && opts.captiveSetup {
+		Context.captive = newCaptiveSetup(config.BindPort)
+		err = Context.captive.start()
+		if err != nil {
+			log.Error("starting captive setup: %s", err)
+		}
+	}
+
 	// wait indefinitely for other go-routines to complete their job
 	select {}
 }
@@ -543,7 +614,8 @@ func startMods() error {
 
 	Context.tls.start()
 
-	err = startDNSServer()
+	Context.services = newServices(nil)
+	err = Context.services.Start(context.Background())
 	if err != nil {
 		closeDNSServer()
 
@@ -650,6 +722,9 @@ func configureLogger(opts options) {
 	ls.MaxBackups = config.MaxBackups
 	ls.MaxSize = config.MaxSize
 	ls.MaxAge = config.MaxAge
+	if config.Format != "" {
+		ls.Format = config.Format
+	}
 
 	// log.SetLevel(log.INFO) - default
 	if ls.Verbose {
@@ -666,6 +741,10 @@ func configureLogger(opts options) {
 		ls.File = configSyslog
 	}
 
+	// Wrap the output after it has been configured, since the syslog one is
+	// set by aghos.ConfigureSyslog.
+	defer setLogFormat(ls.Format)
+
 	// logs are written to stdout (default)
 	if ls.File == "" {
 		return
@@ -694,10 +773,27 @@ func configureLogger(opts options) {
 	}
 }
 
+// setLogFormat sets the format of the log output.  It must be called after the
+// log output is configured.
+func setLogFormat(f aghlog.Format) {
+	switch f {
+	case "", aghlog.FormatText:
+		// Go on.
+	case aghlog.FormatJSON:
+		// JSON entries contain their own timestamps.
+		log.SetFlags(0)
+		log.SetOutput(aghlog.NewJSONWriter(log.Writer()))
+	default:
+		log.Fatalf("unsupported log_format %q", f)
+	}
+}
+
 // cleanup stops and resets all the modules.
 func cleanup(ctx context.Context) {
 	log.Info("stopping AdGuard Home")
 
+	stopCaptiveSetup()
+
 	if Context.web != nil {
 		Context.web.Close(ctx)
 		Context.web = nil
@@ -707,15 +803,11 @@ func cleanup(ctx context.Context) {
 		Context.auth = nil
 	}
 
-	err := stopDNSServer()
-	if err != nil {
-		log.Error("stopping dns server: %s", err)
-	}
-
-	if Context.dhcpServer != nil {
-		err = Context.dhcpServer.Stop()
+	var err error
+	if Context.services != nil {
+		err = Context.services.Shutdown(ctx)
 		if err != nil {
-			log.Error("stopping dhcp server: %s", err)
+			log.Error("stopping services: %s", err)
 		}
 	}
 
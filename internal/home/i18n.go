@@ -1,7 +1,6 @@
 package home
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -68,7 +67,7 @@ func handleI18nChangeLanguage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	langReq := &languageJSON{}
-	err := json.NewDecoder(r.Body).Decode(langReq)
+	err := aghhttp.DecodeJSON(r, langReq)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusInternalServerError, "reading req: %s", err)
 
@@ -4,9 +4,10 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
-
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
 )
 
 // middlerware is a wrapper function signature.
@@ -30,26 +31,29 @@ const defaultReqBodySzLim = 64 * 1024
 // requests.
 const largerReqBodySzLim = 4 * 1024 * 1024
 
-// expectsLargerRequests shows if this request should use a larger body size
-// limit.  These are exceptions for poorly designed current APIs as well as APIs
-// that are designed to expect large files and requests.  Remove once the new,
-// better APIs are up.
+// largerReqBodyRoutes are the routes using a larger body size limit.  The keys
+// have the "METHOD /path" format.  These are exceptions for poorly designed
+// current APIs as well as APIs that are designed to expect large files and
+// requests.  Remove once the new, better APIs are up.
 //
 // See https://github.com/AdguardTeam/AdGuardHome/issues/2666 and
 // https://github.com/AdguardTeam/AdGuardHome/issues/2675.
-func expectsLargerRequests(r *http.Request) (ok bool) {
-	m := r.Method
-	if m != http.MethodPost {
-		return false
-	}
+var largerReqBodyRoutes = stringutil.NewSet(
+	http.MethodPost+" /control/access/set",
+	http.MethodPost+" /control/filtering/set_rules",
+	http.MethodPost+" /control/tls/configure",
+	http.MethodPost+" /control/tls/validate",
+)
 
-	p := r.URL.Path
-	return p == "/control/access/set" ||
-		p == "/control/filtering/set_rules"
+// expectsLargerRequests shows if this request should use a larger body size
+// limit.
+func expectsLargerRequests(r *http.Request) (ok bool) {
+	return largerReqBodyRoutes.Has(r.Method + " " + r.URL.Path)
 }
 
 // limitRequestBody wraps underlying handler h, making it's request's body Read
-// method limited.
+// method limited.  The requests declaring the larger bodies are rejected right
+// away.
 func limitRequestBody(h http.Handler) (limited http.Handler) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var err error
@@ -59,6 +63,19 @@ func limitRequestBody(h http.Handler) (limited http.Handler) {
 			szLim = largerReqBodySzLim
 		}
 
+		if r.ContentLength > szLim {
+			aghhttp.Error(
+				r,
+				w,
+				http.StatusRequestEntityTooLarge,
+				"%s: limit is %d bytes",
+				aghhttp.ErrBodyTooLarge,
+				szLim,
+			)
+
+			return
+		}
+
 		var reader io.Reader
 		reader, err = aghio.LimitReader(r.Body, szLim)
 		if err != nil {
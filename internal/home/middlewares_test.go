@@ -57,6 +57,9 @@ func TestLimitRequestBody(t *testing.T) {
 			lim := limitRequestBody(handler)
 
 			req := httptest.NewRequest(http.MethodPost, "https://www.example.com", strings.NewReader(tc.body))
+			// Check the limit of the streamed bodies, which sizes aren't known
+			// in advance.
+			req.ContentLength = -1
 			res := httptest.NewRecorder()
 
 			lim.ServeHTTP(res, req)
@@ -66,3 +69,49 @@ func TestLimitRequestBody(t *testing.T) {
 		})
 	}
 }
+
+func TestLimitRequestBody_contentLength(t *testing.T) {
+	var called bool
+	lim := limitRequestBody(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		called = true
+	}))
+
+	testCases := []struct {
+		name       string
+		path       string
+		size       int
+		wantCalled bool
+	}{{
+		name:       "default",
+		path:       "/control/dns_config",
+		size:       defaultReqBodySzLim,
+		wantCalled: true,
+	}, {
+		name:       "too_large",
+		path:       "/control/dns_config",
+		size:       defaultReqBodySzLim + 1,
+		wantCalled: false,
+	}, {
+		name:       "larger_route",
+		path:       "/control/filtering/set_rules",
+		size:       defaultReqBodySzLim + 1,
+		wantCalled: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			called = false
+
+			body := strings.NewReader(string(make([]byte, tc.size)))
+			req := httptest.NewRequest(http.MethodPost, tc.path, body)
+			res := httptest.NewRecorder()
+
+			lim.ServeHTTP(res, req)
+			assert.Equal(t, tc.wantCalled, called)
+
+			if !tc.wantCalled {
+				assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+			}
+		})
+	}
+}
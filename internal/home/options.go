@@ -67,6 +67,11 @@ type options struct {
 	// localFrontend forces AdGuard Home to use the frontend files from disk
 	// rather than the ones that have been compiled into the binary.
 	localFrontend bool
+
+	// captiveSetup makes AdGuard Home answer all DNS queries with its own
+	// address and redirect the HTTP requests to the setup page during the
+	// first run.
+	captiveSetup bool
 }
 
 // initCmdLineOpts completes initialization of the global command-line option
@@ -255,6 +260,14 @@ var cmdLineOpts = []cmdLineOpt{{
 	description:     "Use local frontend directories.",
 	longName:        "local-frontend",
 	shortName:       "",
+}, {
+	updateWithValue: nil,
+	updateNoValue:   func(o options) (options, error) { o.captiveSetup = true; return o, nil },
+	effect:          nil,
+	serialize:       func(o options) (val string, ok bool) { return "", o.captiveSetup },
+	description:     "Answer all DNS queries with own address until the setup is finished.",
+	longName:        "captive-setup",
+	shortName:       "",
 }, {
 	updateWithValue: nil,
 	updateNoValue:   func(o options) (options, error) { o.verbose = true; return o, nil },
@@ -103,6 +103,11 @@ func TestParseDisableUpdate(t *testing.T) {
 	assert.True(t, testParseOK(t, "--no-check-update").disableUpdate, "--no-check-update is disable update")
 }
 
+func TestParseCaptiveSetup(t *testing.T) {
+	assert.False(t, testParseOK(t).captiveSetup, "empty is not captive setup")
+	assert.True(t, testParseOK(t, "--captive-setup").captiveSetup, "--captive-setup is captive setup")
+}
+
 // TODO(e.burkov):  Remove after v0.108.0.
 func TestParseDisableMemoryOptimization(t *testing.T) {
 	o, eff, err := parseCmdOpts("", []string{"--no-mem-optimization"})
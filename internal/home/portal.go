@@ -0,0 +1,418 @@
+package home
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/google/renameio/maybe"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+)
+
+// Client self-service portal
+//
+// The portal is a limited HTTP API under the /portal/ prefix, which a client
+// device authenticates with using the portal token of its persistent client
+// instead of the administrator's credentials.  It only allows viewing the
+// client's own queries and requesting the unblocking of a domain, which an
+// administrator then approves or rejects.
+
+// minPortalTokenLen is the minimum length of a portal token.
+const minPortalTokenLen = 16
+
+// portalPathPrefix is the prefix of the paths of the portal HTTP API.
+const portalPathPrefix = "/portal/"
+
+// unblockRequestsFileName is the name of the file within the data directory,
+// which the unblock requests are stored in.
+const unblockRequestsFileName = "unblock_requests.json"
+
+// maxPendingUnblockRequests is the maximum number of pending unblock requests
+// a single client may have.
+const maxPendingUnblockRequests = 10
+
+// maxUnblockRequests is the maximum number of stored unblock requests.  The
+// oldest decided requests are removed once it's exceeded.
+const maxUnblockRequests = 1000
+
+// unblockStatus is the status of an unblock request.
+type unblockStatus string
+
+// Unblock request statuses.
+const (
+	unblockStatusPending  unblockStatus = "pending"
+	unblockStatusApproved unblockStatus = "approved"
+	unblockStatusRejected unblockStatus = "rejected"
+)
+
+// unblockRequest is a request of a client device to unblock a domain.
+type unblockRequest struct {
+	// Time is the time of the request.
+	Time time.Time `json:"time"`
+
+	// ID is the unique identifier of the request.
+	ID string `json:"id"`
+
+	// Client is the name of the persistent client, which made the request.
+	Client string `json:"client"`
+
+	// Domain is the domain requested to be unblocked.
+	Domain string `json:"domain"`
+
+	// Comment is the optional explanation of the request.
+	Comment string `json:"comment"`
+
+	// Status is the current status of the request.
+	Status unblockStatus `json:"status"`
+}
+
+// unblockRequests is the persistent queue of the unblock requests.
+type unblockRequests struct {
+	// mu protects reqs.
+	mu *sync.Mutex
+
+	// addRule adds the user rule allowing the domain for the client.
+	addRule func(rule string)
+
+	// path is the path to the file, which the requests are stored in.
+	path string
+
+	// reqs are the requests, the oldest first.
+	reqs []*unblockRequest
+}
+
+// newUnblockRequests returns a new queue of the unblock requests stored in the
+// file at path, loading the previous requests from it.
+func newUnblockRequests(path string, addRule func(rule string)) (q *unblockRequests, err error) {
+	q = &unblockRequests{
+		mu:      &sync.Mutex{},
+		addRule: addRule,
+		path:    path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	err = json.Unmarshal(data, &q.reqs)
+	if err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+
+	return q, nil
+}
+
+// errTooManyUnblockRequests is returned when a client has too many pending
+// unblock requests.
+const errTooManyUnblockRequests errors.Error = "too many pending unblock requests"
+
+// add queues the request of the client to unblock the domain.
+func (q *unblockRequests) add(client, domain, comment string) (r *unblockRequest, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := 0
+	for _, prev := range q.reqs {
+		if prev.Client != client || prev.Status != unblockStatusPending {
+			continue
+		} else if prev.Domain == domain {
+			return nil, fmt.Errorf("domain %q is already requested", domain)
+		}
+
+		pending++
+	}
+
+	if pending >= maxPendingUnblockRequests {
+		return nil, errTooManyUnblockRequests
+	}
+
+	r = &unblockRequest{
+		Time:    time.Now(),
+		ID:      uuid.NewString(),
+		Client:  client,
+		Domain:  domain,
+		Comment: comment,
+		Status:  unblockStatusPending,
+	}
+	q.reqs = append(q.reqs, r)
+	q.trimLocked()
+
+	log.Info("portal: client %q requested unblocking %q", client, domain)
+
+	return r, q.saveLocked()
+}
+
+// trimLocked removes the oldest decided requests while there are too many
+// requests.  q.mu is expected to be locked.
+func (q *unblockRequests) trimLocked() {
+	excess := len(q.reqs) - maxUnblockRequests
+	if excess <= 0 {
+		return
+	}
+
+	kept := q.reqs[:0]
+	for _, r := range q.reqs {
+		if excess > 0 && r.Status != unblockStatusPending {
+			excess--
+
+			continue
+		}
+
+		kept = append(kept, r)
+	}
+
+	q.reqs = kept
+}
+
+// list returns the requests of the client, the newest first.  If client is
+// empty, the requests of all clients are returned.
+func (q *unblockRequests) list(client string) (reqs []*unblockRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reqs = []*unblockRequest{}
+	for i := len(q.reqs) - 1; i >= 0; i-- {
+		if r := q.reqs[i]; client == "" || r.Client == client {
+			cloned := *r
+			reqs = append(reqs, &cloned)
+		}
+	}
+
+	return reqs
+}
+
+// decide sets the status of the pending request with the ID.  If the request
+// is approved, the allowlist rule for the domain and the client is added.
+func (q *unblockRequests) decide(id string, approve bool) (err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := slices.IndexFunc(q.reqs, func(r *unblockRequest) (ok bool) { return r.ID == id })
+	if i < 0 {
+		return fmt.Errorf("no request with id %q", id)
+	}
+
+	r := q.reqs[i]
+	if r.Status != unblockStatusPending {
+		return fmt.Errorf("request %q is already %s", id, r.Status)
+	}
+
+	r.Status = unblockStatusRejected
+	if approve {
+		r.Status = unblockStatusApproved
+		q.addRule(unblockRule(r.Domain, r.Client))
+	}
+
+	log.Info("portal: unblocking %q for client %q is %s", r.Domain, r.Client, r.Status)
+
+	return q.saveLocked()
+}
+
+// clientNameReplacer escapes the characters, which are special within the
+// quoted value of the $client modifier.
+var clientNameReplacer = strings.NewReplacer(`'`, `\'`, `,`, `\,`, `|`, `\|`)
+
+// unblockRule returns the user rule unblocking domain for the persistent client
+// with the name.
+func unblockRule(domain, name string) (rule string) {
+	return fmt.Sprintf("@@||%s^$client='%s'", domain, clientNameReplacer.Replace(name))
+}
+
+// saveLocked writes the requests into the file.  q.mu is expected to be
+// locked.
+func (q *unblockRequests) saveLocked() (err error) {
+	data, err := json.Marshal(q.reqs)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	err = maybe.WriteFile(q.path, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	return nil
+}
+
+// portalClientKey is the context key for the name of the persistent client
+// authenticated in the portal.
+type portalClientKey struct{}
+
+// portalClientFromContext returns the name of the persistent client
+// authenticated in the portal.
+func portalClientFromContext(ctx context.Context) (name string) {
+	name, _ = ctx.Value(portalClientKey{}).(string)
+
+	return name
+}
+
+// portalToken returns the portal token of the persistent client with name or
+// an empty string if there is no such client.
+func (clients *clientsContainer) portalToken(name string) (token string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	if c, ok := clients.list[name]; ok {
+		return c.PortalToken
+	}
+
+	return ""
+}
+
+// findByPortalToken returns the name of the persistent client with the portal
+// token.
+func (clients *clientsContainer) findByPortalToken(token string) (name string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, c := range clients.list {
+		if c.PortalToken == "" {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(c.PortalToken), []byte(token)) == 1 {
+			return c.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// portalAuthHandler returns a handler, which authenticates the client device
+// by the bearer portal token and restricts the query log to the queries of the
+// client.
+func portalAuthHandler(h http.Handler) (wrapped http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, ok := Context.clients.findByPortalToken(token)
+		if !ok {
+			log.Debug("portal: responded with forbidden to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("Forbidden"))
+
+			return
+		}
+
+		f := querylog.NewClientsFilter(Context.clients.delegatedIDs([]string{name}))
+		ctx := querylog.WithClientsFilter(r.Context(), f)
+		ctx = context.WithValue(ctx, portalClientKey{}, name)
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// unblockReq is the request for the POST /portal/unblock HTTP API.
+type unblockReq struct {
+	Domain  string `json:"domain"`
+	Comment string `json:"comment"`
+}
+
+// maxUnblockCommentLen is the maximum length of the comment of an unblock
+// request.
+const maxUnblockCommentLen = 256
+
+// handlePortalUnblock is the handler for the POST /portal/unblock HTTP API.
+// It queues the request of the authenticated client for the administrator's
+// approval.
+func (q *unblockRequests) handlePortalUnblock(w http.ResponseWriter, r *http.Request) {
+	req := &unblockReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+	err = netutil.ValidateDomainName(domain)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "domain: %s", err)
+
+		return
+	} else if len(req.Comment) > maxUnblockCommentLen {
+		aghhttp.Error(r, w, http.StatusBadRequest, "comment is longer than %d bytes", maxUnblockCommentLen)
+
+		return
+	}
+
+	ur, err := q.add(portalClientFromContext(r.Context()), domain, req.Comment)
+	if errors.Is(err, errTooManyUnblockRequests) {
+		aghhttp.Error(r, w, http.StatusTooManyRequests, "%s", err)
+
+		return
+	} else if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, ur)
+}
+
+// handlePortalUnblockList is the handler for the GET /portal/unblock_requests
+// HTTP API.
+// It responds with the unblock requests of the authenticated client.
+func (q *unblockRequests) handlePortalUnblockList(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, q.list(portalClientFromContext(r.Context())))
+}
+
+// handleUnblockRequests is the handler for the GET /control/unblock_requests
+// HTTP API.
+func (q *unblockRequests) handleUnblockRequests(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, q.list(""))
+}
+
+// unblockDecisionReq is the request for the POST
+// /control/unblock_requests/approve and /control/unblock_requests/reject HTTP
+// APIs.
+type unblockDecisionReq struct {
+	ID string `json:"id"`
+}
+
+// decisionHandler returns the handler, which approves or rejects the unblock
+// request.
+func (q *unblockRequests) decisionHandler(approve bool) (h http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &unblockDecisionReq{}
+		err := aghhttp.DecodeJSON(r, req)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+			return
+		}
+
+		err = q.decide(req.ID, approve)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+		}
+	}
+}
+
+// registerWebHandlers registers the HTTP handlers of the portal and the
+// administrator's handlers of the unblock requests.
+func (q *unblockRequests) registerWebHandlers() {
+	httpRegister(http.MethodGet, portalPathPrefix+"unblock_requests", q.handlePortalUnblockList)
+	httpRegister(http.MethodPost, portalPathPrefix+"unblock", q.handlePortalUnblock)
+	httpRegister(http.MethodGet, "/control/unblock_requests", q.handleUnblockRequests)
+	httpRegister(http.MethodPost, "/control/unblock_requests/approve", q.decisionHandler(true))
+	httpRegister(http.MethodPost, "/control/unblock_requests/reject", q.decisionHandler(false))
+}
@@ -0,0 +1,173 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnblockRequests(t *testing.T) {
+	var rules []string
+	addRule := func(rule string) { rules = append(rules, rule) }
+
+	path := filepath.Join(t.TempDir(), unblockRequestsFileName)
+	q, err := newUnblockRequests(path, addRule)
+	require.NoError(t, err)
+
+	first, err := q.add("kid", "games.example", "homework")
+	require.NoError(t, err)
+
+	_, err = q.add("kid", "games.example", "")
+	assert.EqualError(t, err, `domain "games.example" is already requested`)
+
+	second, err := q.add("parent", "news.example", "")
+	require.NoError(t, err)
+
+	kidReqs := q.list("kid")
+	require.Len(t, kidReqs, 1)
+
+	assert.Equal(t, first.ID, kidReqs[0].ID)
+	assert.Len(t, q.list(""), 2)
+
+	require.NoError(t, q.decide(first.ID, true))
+	require.NoError(t, q.decide(second.ID, false))
+	assert.Error(t, q.decide(first.ID, false))
+	assert.Error(t, q.decide("unknown", true))
+
+	assert.Equal(t, []string{"@@||games.example^$client='kid'"}, rules)
+
+	// The requests persist.
+	q, err = newUnblockRequests(path, addRule)
+	require.NoError(t, err)
+
+	reqs := q.list("")
+	require.Len(t, reqs, 2)
+
+	assert.Equal(t, unblockStatusRejected, reqs[0].Status)
+	assert.Equal(t, unblockStatusApproved, reqs[1].Status)
+
+	for i := 0; i < maxPendingUnblockRequests; i++ {
+		_, err = q.add("spammer", fmt.Sprintf("d%d.example", i), "")
+		require.NoError(t, err)
+	}
+
+	_, err = q.add("spammer", "more.example", "")
+	assert.ErrorIs(t, err, errTooManyUnblockRequests)
+}
+
+func TestUnblockRule(t *testing.T) {
+	testCases := []struct {
+		name   string
+		client string
+		want   string
+	}{{
+		name:   "simple",
+		client: "laptop",
+		want:   "@@||example.org^$client='laptop'",
+	}, {
+		name:   "special",
+		client: "Frank's phone, old|new",
+		want:   `@@||example.org^$client='Frank\'s phone\, old\|new'`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, unblockRule("example.org", tc.client))
+		})
+	}
+}
+
+func TestClientsContainer_findByPortalToken(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	const token = "0123456789abcdef"
+	ok, err := clients.Add(&Client{
+		Name:        "kid",
+		IDs:         []string{"1.2.3.4"},
+		PortalToken: token,
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	name, ok := clients.findByPortalToken(token)
+	require.True(t, ok)
+
+	assert.Equal(t, "kid", name)
+
+	_, ok = clients.findByPortalToken("")
+	assert.False(t, ok)
+
+	_, ok = clients.findByPortalToken("fedcba9876543210")
+	assert.False(t, ok)
+
+	_, err = clients.Add(&Client{
+		Name:        "short",
+		IDs:         []string{"1.2.3.5"},
+		PortalToken: "short",
+	})
+	assert.Error(t, err)
+}
+
+func TestClientJSON_portalToken(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	const token = "0123456789abcdef"
+	ok, err := clients.Add(&Client{
+		Name:        "kid",
+		IDs:         []string{"1.2.3.4"},
+		PortalToken: token,
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	c, ok := clients.Find("1.2.3.4")
+	require.True(t, ok)
+
+	data, err := json.Marshal(clientToJSON(c))
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(data), token)
+	assert.Contains(t, string(data), `"portal_token_set":true`)
+
+	testCases := []struct {
+		name string
+		data string
+		want string
+	}{{
+		name: "omitted",
+		data: `{"name":"kid","ids":["1.2.3.4"]}`,
+		want: token,
+	}, {
+		name: "empty",
+		data: `{"name":"kid","ids":["1.2.3.4"],"portal_token":""}`,
+		want: "",
+	}, {
+		name: "set",
+		data: `{"name":"kid","ids":["1.2.3.4"],"portal_token":"fedcba9876543210"}`,
+		want: "fedcba9876543210",
+	}, {
+		name: "set_flag_ignored",
+		data: `{"name":"kid","ids":["1.2.3.4"],"portal_token_set":false}`,
+		want: token,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dj := &updateJSON{}
+			err = json.Unmarshal([]byte(`{"name":"kid","data":`+tc.data+`}`), dj)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, clients.updatedClient(dj).PortalToken)
+		})
+	}
+}
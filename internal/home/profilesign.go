@@ -0,0 +1,236 @@
+package home
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Object identifiers used within the signed profiles.
+//
+// See RFC 5652, RFC 5754, and RFC 8017.
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// cmsContentInfo is the ContentInfo structure from RFC 5652.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// cmsSignedData is the SignedData structure from RFC 5652.
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo cmsContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue
+}
+
+// cmsIssuerAndSerialNumber is the IssuerAndSerialNumber structure from RFC
+// 5652.
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// cmsSignerInfo is the SignerInfo structure from RFC 5652.
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+// cmsAttribute is the Attribute structure from RFC 5652.
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// asn1Set returns the DER-encoded SET OF the DER-encoded elems, sorting them as
+// required by DER.
+func asn1Set(elems ...[]byte) (set asn1.RawValue) {
+	sorted := slices.Clone(elems)
+	slices.SortFunc(sorted, func(a, b []byte) (less bool) {
+		return bytes.Compare(a, b) < 0
+	})
+
+	return asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      bytes.Join(sorted, nil),
+	}
+}
+
+// asn1Context returns the context-specific tagged value with the DER-encoded
+// contents.
+func asn1Context(tag int, contents []byte) (v asn1.RawValue) {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      contents,
+	}
+}
+
+// newCMSAttribute returns the DER-encoded attribute with a single value.
+func newCMSAttribute(typ asn1.ObjectIdentifier, val any) (attr []byte, err error) {
+	valDER, err := asn1.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("encoding value of %s: %w", typ, err)
+	}
+
+	return asn1.Marshal(cmsAttribute{
+		Type:   typ,
+		Values: asn1Set(valDER),
+	})
+}
+
+// signatureAlgorithm returns the identifier of the algorithm used to sign with
+// key.
+func signatureAlgorithm(key crypto.Signer) (alg pkix.AlgorithmIdentifier, err error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{
+			Algorithm:  oidRSAEncryption,
+			Parameters: asn1.NullRawValue,
+		}, nil
+	case *ecdsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// signProfile returns the configuration profile wrapped into the CMS signed
+// data, signed with the leaf certificate of cert, as Apple devices expect it.
+// The whole certificate chain is included.  Only RSA and ECDSA keys are
+// supported.
+func signProfile(profile []byte, cert *tls.Certificate, now time.Time) (signed []byte, err error) {
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", cert.PrivateKey)
+	}
+
+	sigAlg, err := signatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	digest := sha256.Sum256(profile)
+
+	var attrs [][]byte
+	for _, a := range []struct {
+		val any
+		typ asn1.ObjectIdentifier
+	}{{
+		val: oidData,
+		typ: oidAttrContentType,
+	}, {
+		val: digest[:],
+		typ: oidAttrMessageDigest,
+	}, {
+		val: now.UTC(),
+		typ: oidAttrSigningTime,
+	}} {
+		var attr []byte
+		attr, err = newCMSAttribute(a.typ, a.val)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	// The signature is calculated over the DER encoding of the attributes
+	// with the SET OF tag, not the implicit one used within the SignerInfo.
+	attrsSet := asn1Set(attrs...)
+	attrsDER, err := asn1.Marshal(attrsSet)
+	if err != nil {
+		return nil, fmt.Errorf("encoding signed attributes: %w", err)
+	}
+
+	attrsDigest := sha256.Sum256(attrsDER)
+	sig, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	signerInfo, err := asn1.Marshal(cmsSignerInfo{
+		Version: 1,
+		SID: cmsIssuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: leaf.RawIssuer},
+			SerialNumber: leaf.SerialNumber,
+		},
+		DigestAlgorithm:    digestAlg,
+		SignedAttrs:        asn1Context(0, attrsSet.Bytes),
+		SignatureAlgorithm: sigAlg,
+		Signature:          sig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding signer info: %w", err)
+	}
+
+	digestAlgDER, err := asn1.Marshal(digestAlg)
+	if err != nil {
+		return nil, fmt.Errorf("encoding digest algorithm: %w", err)
+	}
+
+	content, err := asn1.Marshal(profile)
+	if err != nil {
+		return nil, fmt.Errorf("encoding content: %w", err)
+	}
+
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: asn1Set(digestAlgDER),
+		EncapContentInfo: cmsContentInfo{
+			ContentType: oidData,
+			Content:     asn1Context(0, content),
+		},
+		Certificates: asn1Context(0, bytes.Join(cert.Certificate, nil)),
+		SignerInfos:  asn1Set(signerInfo),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding signed data: %w", err)
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1Context(0, signedData),
+	})
+}
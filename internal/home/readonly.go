@@ -0,0 +1,97 @@
+package home
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// readOnlyConfig is the configuration of the read-only mode.  In this mode the
+// frequently written data files, such as the query log, the statistics, the
+// DHCP leases, and the web sessions, are kept in a volatile directory, usually
+// on a tmpfs, instead of the data directory.  It allows running AdGuard Home on
+// the devices with write-cycle-limited flash storage.
+//
+// The configuration file, the filter lists, and the anonymization key are still
+// kept in the working directory, since they are rarely written.  So are the
+// unblock requests, which must survive the reboots.
+type readOnlyConfig struct {
+	// VolatileDir is the directory for the frequently written data files.
+	// The relative paths are resolved against the working directory.  If
+	// empty, a subdirectory of the system temporary directory is used.
+	VolatileDir string `yaml:"volatile_dir"`
+
+	// Enabled defines if the read-only mode is enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
+// defaultVolatileDirName is the name of the subdirectory of the system
+// temporary directory used as the volatile directory by default.
+const defaultVolatileDirName = "AdGuardHome"
+
+// dataDir returns the directory for the frequently written data files.  It's
+// dataDir unless the read-only mode is enabled.
+func (c *readOnlyConfig) dataDir(workDir, dataDir string) (dir string) {
+	if !c.Enabled {
+		return dataDir
+	}
+
+	dir = c.VolatileDir
+	if dir == "" {
+		return filepath.Join(os.TempDir(), defaultVolatileDirName)
+	} else if !filepath.IsAbs(dir) {
+		return filepath.Join(workDir, dir)
+	}
+
+	return dir
+}
+
+// prepareVolatileDir creates the volatile directory at dir, which is only
+// accessible by the current user.  An existing directory must be owned by the
+// current user and mustn't be accessible by the others, since an unprivileged
+// user could have created it within the shared temporary directory beforehand
+// to read the sessions and the query log.
+func prepareVolatileDir(dir string) (err error) {
+	err = os.MkdirAll(filepath.Dir(dir), 0o755)
+	if err != nil {
+		return fmt.Errorf("creating parent directory: %w", err)
+	}
+
+	err = os.Mkdir(dir, 0o700)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	// Don't follow the symbolic links, since their targets may be anywhere.
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	owned, err := aghos.IsOwnedByCurrentUser(fi)
+	if err != nil {
+		if errors.As(err, new(*aghos.UnsupportedError)) {
+			// The temporary directory is per-user on Windows, and the file
+			// modes don't reflect the access rights there.
+			return nil
+		}
+
+		return fmt.Errorf("checking owner: %w", err)
+	} else if !owned {
+		return fmt.Errorf("%s is not owned by the current user", dir)
+	}
+
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("%s is accessible by other users: mode %#o, want 0700", dir, perm)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package home
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyConfig_dataDir(t *testing.T) {
+	workDir := filepath.Join(string(filepath.Separator), "opt", "AdGuardHome")
+	dataDir := filepath.Join(workDir, "data")
+	absDir := filepath.Join(string(filepath.Separator), "tmp", "agh")
+
+	testCases := []struct {
+		name string
+		conf readOnlyConfig
+		want string
+	}{{
+		name: "disabled",
+		conf: readOnlyConfig{
+			VolatileDir: absDir,
+			Enabled:     false,
+		},
+		want: dataDir,
+	}, {
+		name: "default",
+		conf: readOnlyConfig{
+			VolatileDir: "",
+			Enabled:     true,
+		},
+		want: filepath.Join(os.TempDir(), defaultVolatileDirName),
+	}, {
+		name: "absolute",
+		conf: readOnlyConfig{
+			VolatileDir: absDir,
+			Enabled:     true,
+		},
+		want: absDir,
+	}, {
+		name: "relative",
+		conf: readOnlyConfig{
+			VolatileDir: "volatile",
+			Enabled:     true,
+		},
+		want: filepath.Join(workDir, "volatile"),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.conf.dataDir(workDir, dataDir))
+		})
+	}
+}
+
+func TestPrepareVolatileDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes don't reflect the access rights on windows")
+	}
+
+	parent := t.TempDir()
+
+	t.Run("new", func(t *testing.T) {
+		dir := filepath.Join(parent, "new", defaultVolatileDirName)
+		require.NoError(t, prepareVolatileDir(dir))
+
+		fi, err := os.Stat(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+	})
+
+	t.Run("existing_private", func(t *testing.T) {
+		dir := filepath.Join(parent, "private")
+		require.NoError(t, os.Mkdir(dir, 0o700))
+
+		assert.NoError(t, prepareVolatileDir(dir))
+	})
+
+	t.Run("existing_shared", func(t *testing.T) {
+		dir := filepath.Join(parent, "shared")
+		require.NoError(t, os.Mkdir(dir, 0o700))
+		require.NoError(t, os.Chmod(dir, 0o755))
+
+		assert.Error(t, prepareVolatileDir(dir))
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		target := filepath.Join(parent, "target")
+		require.NoError(t, os.Mkdir(target, 0o700))
+
+		dir := filepath.Join(parent, "link")
+		require.NoError(t, os.Symlink(target, dir))
+
+		assert.Error(t, prepareVolatileDir(dir))
+	})
+}
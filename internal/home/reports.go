@@ -0,0 +1,455 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+// reportTopDomainsNum is the number of the top domains in a report.
+const reportTopDomainsNum = 10
+
+// reportSchedule is the schedule of the reports.
+type reportSchedule string
+
+// Report schedules.
+const (
+	reportScheduleDaily  reportSchedule = "daily"
+	reportScheduleWeekly reportSchedule = "weekly"
+)
+
+// hours returns the number of hours covered by a report sent on s.
+func (s reportSchedule) hours() (n uint32) {
+	if s == reportScheduleWeekly {
+		return 7 * 24
+	}
+
+	return 24
+}
+
+// smtpConfig is the configuration of the SMTP server sending the reports.
+type smtpConfig struct {
+	// Host is the hostname of the SMTP server.
+	Host string `yaml:"host" json:"host"`
+
+	// Username is the name of the user to authenticate with.  If empty, the
+	// authentication isn't performed.
+	Username string `yaml:"username" json:"username"`
+
+	// Password is the password of the user to authenticate with.  It's never
+	// returned by the HTTP API.
+	Password string `yaml:"password" json:"password,omitempty"`
+
+	// From is the email address of the sender.
+	From string `yaml:"from" json:"from"`
+
+	// Port is the port of the SMTP server.  The connection is upgraded with
+	// STARTTLS if the server supports it.
+	Port uint16 `yaml:"port" json:"port"`
+}
+
+// reportsConfig is the configuration of the scheduled reports.
+type reportsConfig struct {
+	// SMTP is the configuration of the SMTP server sending the reports.
+	SMTP smtpConfig `yaml:"smtp" json:"smtp"`
+
+	// Recipients are the email addresses of the recipients of the reports.
+	Recipients []string `yaml:"recipients" json:"recipients"`
+
+	// Schedule is the schedule of the reports.  The weekly reports are sent
+	// on Mondays.
+	Schedule reportSchedule `yaml:"schedule" json:"schedule"`
+
+	// Hour is the hour of the day in the local time, at which the reports are
+	// sent.
+	Hour uint8 `yaml:"hour" json:"hour"`
+
+	// Enabled defines if the reports are sent.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// clone returns a deep copy of c.
+func (c *reportsConfig) clone() (cloned *reportsConfig) {
+	cp := *c
+	cp.Recipients = slices.Clone(c.Recipients)
+
+	return &cp
+}
+
+// validateDelivery returns an error if the reports can't be delivered with c.
+func (c *reportsConfig) validateDelivery() (err error) {
+	if c.SMTP.Host == "" {
+		return errors.Error("no smtp host")
+	} else if c.SMTP.Port == 0 {
+		return errors.Error("no smtp port")
+	} else if _, err = mail.ParseAddress(c.SMTP.From); err != nil {
+		return fmt.Errorf("sender: %w", err)
+	} else if len(c.Recipients) == 0 {
+		return errors.Error("no recipients")
+	}
+
+	for _, rcpt := range c.Recipients {
+		if _, err = mail.ParseAddress(rcpt); err != nil {
+			return fmt.Errorf("recipient %q: %w", rcpt, err)
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if c is invalid.
+func (c *reportsConfig) validate() (err error) {
+	if c.Schedule != reportScheduleDaily && c.Schedule != reportScheduleWeekly {
+		return fmt.Errorf("bad schedule %q", c.Schedule)
+	} else if c.Hour > 23 {
+		return fmt.Errorf("bad hour %d", c.Hour)
+	} else if !c.Enabled {
+		return nil
+	}
+
+	return c.validateDelivery()
+}
+
+// nextReportTime returns the time of the first report sent on the schedule
+// after now.
+func nextReportTime(now time.Time, schedule reportSchedule, hour uint8) (next time.Time) {
+	next = time.Date(now.Year(), now.Month(), now.Day(), int(hour), 0, 0, 0, now.Location())
+
+	days := 1
+	if schedule == reportScheduleWeekly {
+		days = 7
+		next = next.AddDate(0, 0, (int(time.Monday)-int(next.Weekday())+7)%7)
+	}
+
+	if !next.After(now) {
+		next = next.AddDate(0, 0, days)
+	}
+
+	return next
+}
+
+// sendMailFunc sends the message msg to the recipients using the SMTP server
+// from conf.
+type sendMailFunc func(conf *smtpConfig, to []string, msg []byte) (err error)
+
+// sendMail is the sendMailFunc using [smtp.SendMail].
+func sendMail(conf *smtpConfig, to []string, msg []byte) (err error) {
+	from, err := mail.ParseAddress(conf.From)
+	if err != nil {
+		return fmt.Errorf("parsing sender: %w", err)
+	}
+
+	var auth smtp.Auth
+	if conf.Username != "" {
+		auth = smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)
+	}
+
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(int(conf.Port)))
+
+	return smtp.SendMail(addr, auth, from.Address, to, msg)
+}
+
+// reporter sends the scheduled reports summarizing the statistics.
+type reporter struct {
+	// mu protects conf.
+	mu *sync.Mutex
+
+	// conf is the current configuration of the reports.
+	conf *reportsConfig
+
+	// stats is the source of the summarized statistics.
+	stats stats.Interface
+
+	// devices is the source of the newly seen devices.
+	devices *deviceHistory
+
+	// send sends the rendered reports.
+	send sendMailFunc
+
+	// reschedule is used to signal the changes of the schedule.
+	reschedule chan struct{}
+
+	// done is closed when the reporter is closed.
+	done chan struct{}
+}
+
+// newReporter returns a new reporter with the configuration conf.
+func newReporter(conf *reportsConfig, st stats.Interface, devices *deviceHistory) (r *reporter) {
+	return &reporter{
+		mu:         &sync.Mutex{},
+		conf:       conf.clone(),
+		stats:      st,
+		devices:    devices,
+		send:       sendMail,
+		reschedule: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// config returns a copy of the current configuration.
+func (r *reporter) config() (conf *reportsConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.conf.clone()
+}
+
+// setConfig sets the new configuration and reschedules the reports.
+func (r *reporter) setConfig(conf *reportsConfig) {
+	r.mu.Lock()
+	r.conf = conf.clone()
+	r.mu.Unlock()
+
+	select {
+	case r.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// writeDiskConfig puts the current configuration into conf.
+func (r *reporter) writeDiskConfig(conf *reportsConfig) {
+	*conf = *r.config()
+}
+
+// start starts sending the reports on the schedule.
+func (r *reporter) start() {
+	go r.periodicSend()
+}
+
+// periodicSend sends the reports on the schedule until the reporter is closed.
+func (r *reporter) periodicSend() {
+	defer log.OnPanic("reports: sending")
+
+	for r.waitAndSend(r.config()) {
+	}
+}
+
+// waitAndSend waits until the time of the next report scheduled in conf and
+// sends it.  It returns early if the schedule is changed, and returns false if
+// the reporter is closed.
+func (r *reporter) waitAndSend(conf *reportsConfig) (cont bool) {
+	var timerCh <-chan time.Time
+	if conf.Enabled {
+		next := nextReportTime(time.Now(), conf.Schedule, conf.Hour)
+		log.Debug("reports: next report at %s", next)
+
+		t := time.NewTimer(time.Until(next))
+		defer t.Stop()
+
+		timerCh = t.C
+	}
+
+	select {
+	case <-timerCh:
+		if err := r.sendReport(conf, time.Now()); err != nil {
+			log.Error("reports: %s", err)
+		}
+	case <-r.reschedule:
+		// Go on.
+	case <-r.done:
+		return false
+	}
+
+	return true
+}
+
+// close stops sending the reports.
+func (r *reporter) close() {
+	close(r.done)
+}
+
+// reportData is the data the report is rendered from.
+type reportData struct {
+	// Start and End are the bounds of the period covered by the report.
+	Start time.Time
+	End   time.Time
+
+	// Summary is the statistics summed up over the period.
+	Summary *stats.Summary
+
+	// NewDevices are the devices first seen within the period.
+	NewDevices []*seenDevice
+
+	// Schedule is the schedule of the report.
+	Schedule reportSchedule
+}
+
+// reportTmpl is the template of the report's text.
+var reportTmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ms": func(secs float64) (ms string) {
+		return strconv.FormatFloat(secs*1000, 'f', 1, 64)
+	},
+	"pct": func(p float64) (s string) {
+		return strconv.FormatFloat(p, 'f', 1, 64)
+	},
+	"time": func(t time.Time) (s string) {
+		return t.Format("2006-01-02 15:04 MST")
+	},
+}).Parse(`AdGuard Home {{.Schedule}} report
+{{time .Start}} – {{time .End}}
+
+Total queries: {{.Summary.NumDNSQueries}}
+Blocked queries: {{.Summary.NumBlocked}} ({{pct .Summary.BlockedPercent}}%)
+
+New devices: {{len .NewDevices}}
+{{- range .NewDevices}}
+  {{.ID}}{{range .Names}} {{.}}{{end}}
+{{- end}}
+
+Top queried domains:
+{{- range .Summary.TopQueried}}{{range $name, $n := .}}
+  {{$name}}: {{$n}}
+{{- end}}{{else}}
+  none
+{{- end}}
+
+Top blocked domains:
+{{- range .Summary.TopBlocked}}{{range $name, $n := .}}
+  {{$name}}: {{$n}}
+{{- end}}{{else}}
+  none
+{{- end}}
+
+Upstream health:
+  Average processing time: {{ms .Summary.AvgProcessingTime}} ms
+  95th percentile of processing time: {{ms .Summary.P95ProcessingTime}} ms
+  Queries resolved by fallback upstreams: {{.Summary.NumFallbackQueries}}
+`))
+
+// renderReport returns the email message with the report for the period
+// ending at now.
+func (r *reporter) renderReport(conf *reportsConfig, now time.Time) (msg []byte, err error) {
+	hours := conf.Schedule.hours()
+	sum, ok := r.stats.Summary(hours, reportTopDomainsNum)
+	if !ok {
+		return nil, errors.Error("statistics are unavailable")
+	}
+
+	data := &reportData{
+		Start:    now.Add(-time.Duration(hours) * time.Hour),
+		End:      now,
+		Summary:  sum,
+		Schedule: conf.Schedule,
+	}
+
+	for _, d := range r.devices.list() {
+		if d.FirstSeen.After(data.Start) {
+			data.NewDevices = append(data.NewDevices, d)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	subj := fmt.Sprintf("AdGuard Home %s report for %s", conf.Schedule, now.Format("2006-01-02"))
+	hdrs := [][2]string{
+		{"From", conf.SMTP.From},
+		{"To", strings.Join(conf.Recipients, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subj)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	}
+
+	for _, h := range hdrs {
+		_, _ = fmt.Fprintf(buf, "%s: %s\r\n", h[0], h[1])
+	}
+
+	_, _ = buf.WriteString("\r\n")
+
+	err = reportTmpl.Execute(buf, data)
+	if err != nil {
+		return nil, fmt.Errorf("rendering: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sendReport renders the report for the period ending at now and sends it.
+func (r *reporter) sendReport(conf *reportsConfig, now time.Time) (err error) {
+	msg, err := r.renderReport(conf, now)
+	if err != nil {
+		return err
+	}
+
+	err = r.send(&conf.SMTP, conf.Recipients, msg)
+	if err != nil {
+		return fmt.Errorf("sending: %w", err)
+	}
+
+	log.Info("reports: sent %s report to %d recipients", conf.Schedule, len(conf.Recipients))
+
+	return nil
+}
+
+// handleReportsInfo is the handler for the GET /control/reports/info HTTP API.
+func (r *reporter) handleReportsInfo(w http.ResponseWriter, req *http.Request) {
+	conf := r.config()
+	conf.SMTP.Password = ""
+
+	_ = aghhttp.WriteJSONResponse(w, req, conf)
+}
+
+// handleReportsSetConfig is the handler for the POST /control/reports/config
+// HTTP API.  The empty password keeps the current one.
+func (r *reporter) handleReportsSetConfig(w http.ResponseWriter, req *http.Request) {
+	conf := &reportsConfig{}
+	err := json.NewDecoder(req.Body).Decode(conf)
+	if err != nil {
+		aghhttp.Error(req, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	if conf.SMTP.Password == "" {
+		conf.SMTP.Password = r.config().SMTP.Password
+	}
+
+	err = conf.validate()
+	if err != nil {
+		aghhttp.Error(req, w, http.StatusBadRequest, "validating: %s", err)
+
+		return
+	}
+
+	r.setConfig(conf)
+	onConfigModified()
+}
+
+// handleReportsSend is the handler for the POST /control/reports/send HTTP API.
+// It sends the report right away, regardless of the schedule.
+func (r *reporter) handleReportsSend(w http.ResponseWriter, req *http.Request) {
+	conf := r.config()
+	err := conf.validateDelivery()
+	if err != nil {
+		aghhttp.Error(req, w, http.StatusBadRequest, "validating: %s", err)
+
+		return
+	}
+
+	err = r.sendReport(conf, time.Now())
+	if err != nil {
+		aghhttp.Error(req, w, http.StatusInternalServerError, "%s", err)
+	}
+}
+
+// registerWebHandlers registers the HTTP handlers of the reports.
+func (r *reporter) registerWebHandlers() {
+	httpRegister(http.MethodGet, "/control/reports/info", r.handleReportsInfo)
+	httpRegister(http.MethodPost, "/control/reports/config", r.handleReportsSetConfig)
+	httpRegister(http.MethodPost, "/control/reports/send", r.handleReportsSend)
+}
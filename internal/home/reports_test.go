@@ -0,0 +1,149 @@
+package home
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextReportTime(t *testing.T) {
+	// 2022-01-05 is a Wednesday and 2022-01-10 is a Monday.
+	wednesday := time.Date(2022, 1, 5, 10, 30, 0, 0, time.UTC)
+	monday := time.Date(2022, 1, 10, 9, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		now      time.Time
+		want     time.Time
+		name     string
+		schedule reportSchedule
+		hour     uint8
+	}{{
+		now:      wednesday,
+		want:     time.Date(2022, 1, 5, 12, 0, 0, 0, time.UTC),
+		name:     "daily_today",
+		schedule: reportScheduleDaily,
+		hour:     12,
+	}, {
+		now:      wednesday,
+		want:     time.Date(2022, 1, 6, 8, 0, 0, 0, time.UTC),
+		name:     "daily_tomorrow",
+		schedule: reportScheduleDaily,
+		hour:     8,
+	}, {
+		now:      wednesday,
+		want:     time.Date(2022, 1, 10, 8, 0, 0, 0, time.UTC),
+		name:     "weekly",
+		schedule: reportScheduleWeekly,
+		hour:     8,
+	}, {
+		now:      monday,
+		want:     time.Date(2022, 1, 17, 8, 0, 0, 0, time.UTC),
+		name:     "weekly_monday_passed",
+		schedule: reportScheduleWeekly,
+		hour:     8,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, nextReportTime(tc.now, tc.schedule, tc.hour))
+		})
+	}
+}
+
+// fakeStats is a stats.Interface returning a constant summary.
+type fakeStats struct {
+	stats.Interface
+
+	sum *stats.Summary
+}
+
+// Summary implements the stats.Interface interface for *fakeStats.
+func (s *fakeStats) Summary(_ uint32, _ int) (sum *stats.Summary, ok bool) {
+	return s.sum, true
+}
+
+func TestReporter_sendReport(t *testing.T) {
+	noMAC := func(_ net.IP) (mac net.HardwareAddr) { return nil }
+	noNames := func(_ net.IP, _ string) (names []string) { return nil }
+
+	devices, err := newDeviceHistory(filepath.Join(t.TempDir(), deviceHistoryFileName), noMAC, noNames)
+	require.NoError(t, err)
+
+	now := time.Date(2022, 1, 10, 8, 0, 0, 0, time.UTC)
+	devices.seen(net.IP{192, 168, 0, 2}, "", now.Add(-48*time.Hour))
+	devices.seen(net.IP{192, 168, 0, 3}, "", now.Add(-time.Hour))
+
+	st := &fakeStats{
+		sum: &stats.Summary{
+			TopQueried:         []map[string]uint64{{"example.org": 30}, {"example.com": 10}},
+			TopBlocked:         []map[string]uint64{},
+			NumDNSQueries:      40,
+			NumBlocked:         10,
+			NumFallbackQueries: 2,
+			AvgProcessingTime:  0.0125,
+			P95ProcessingTime:  0.05,
+		},
+	}
+
+	conf := &reportsConfig{
+		SMTP: smtpConfig{
+			Host: "smtp.example.org",
+			From: "AdGuard Home <agh@example.org>",
+			Port: 587,
+		},
+		Recipients: []string{"admin@example.org"},
+		Schedule:   reportScheduleDaily,
+		Enabled:    true,
+	}
+	require.NoError(t, conf.validate())
+
+	r := newReporter(conf, st, devices)
+
+	var gotTo []string
+	var gotMsg string
+	r.send = func(_ *smtpConfig, to []string, msg []byte) (err error) {
+		gotTo, gotMsg = to, string(msg)
+
+		return nil
+	}
+
+	require.NoError(t, r.sendReport(r.config(), now))
+
+	assert.Equal(t, conf.Recipients, gotTo)
+
+	for _, want := range []string{
+		"To: admin@example.org\r\n",
+		"Total queries: 40\n",
+		"Blocked queries: 10 (25.0%)\n",
+		"New devices: 1\n  192.168.0.3\n",
+		"  example.org: 30\n  example.com: 10\n",
+		"Top blocked domains:\n  none\n",
+		"Average processing time: 12.5 ms\n",
+		"Queries resolved by fallback upstreams: 2\n",
+	} {
+		assert.True(t, strings.Contains(gotMsg, want), "want %q in %q", want, gotMsg)
+	}
+}
+
+func TestReportsConfig_validate(t *testing.T) {
+	conf := &reportsConfig{
+		Schedule: reportScheduleWeekly,
+		Hour:     8,
+	}
+	assert.NoError(t, conf.validate())
+
+	conf.Enabled = true
+	assert.EqualError(t, conf.validate(), "no smtp host")
+
+	conf.Hour = 24
+	assert.EqualError(t, conf.validate(), "bad hour 24")
+
+	conf.Hour, conf.Schedule = 8, "monthly"
+	assert.EqualError(t, conf.validate(), `bad schedule "monthly"`)
+}
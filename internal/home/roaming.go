@@ -0,0 +1,194 @@
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/ameshkov/dnsstamps"
+)
+
+// roamingBundleJSON is the response to the GET /control/roaming/bundle HTTP
+// API.  It contains the ready-to-use configuration artifacts for the devices
+// using the instance outside of the local network.  The fields for the
+// disabled protocols are empty.
+type roamingBundleJSON struct {
+	// ServerName is the hostname of the instance.
+	ServerName string `json:"server_name"`
+
+	// ClientID is the ClientID the artifacts are generated for, if any.
+	ClientID string `json:"client_id,omitempty"`
+
+	// DoHURL, DoTURL, and DoQURL are the addresses of the encrypted DNS
+	// servers.
+	DoHURL string `json:"doh_url,omitempty"`
+	DoTURL string `json:"dot_url,omitempty"`
+	DoQURL string `json:"doq_url,omitempty"`
+
+	// AndroidPrivateDNS is the hostname for the Private DNS setting of
+	// Android, which only supports DoT on the default port.
+	AndroidPrivateDNS string `json:"android_private_dns,omitempty"`
+
+	// DoHStamp, DoTStamp, and DoQStamp are the DNS stamps of the encrypted
+	// DNS servers.
+	DoHStamp string `json:"doh_stamp,omitempty"`
+	DoTStamp string `json:"dot_stamp,omitempty"`
+	DoQStamp string `json:"doq_stamp,omitempty"`
+
+	// DoHMobileConfig and DoTMobileConfig are the Apple configuration
+	// profiles.  Apple devices only support DoT on the default port.
+	DoHMobileConfig []byte `json:"doh_mobileconfig,omitempty"`
+	DoTMobileConfig []byte `json:"dot_mobileconfig,omitempty"`
+
+	// Signed is true if the configuration profiles are signed with the TLS
+	// certificate of the instance.
+	Signed bool `json:"signed"`
+}
+
+// newRoamingBundle returns the configuration artifacts for the client with
+// clientID, which may be empty, based on the TLS configuration.  The profiles
+// are signed with cert, if it's not nil.
+func newRoamingBundle(
+	conf *tlsConfigSettings,
+	clientID string,
+	cert *tls.Certificate,
+) (b *roamingBundleJSON, err error) {
+	host := conf.ServerName
+	if !conf.Enabled || host == "" {
+		return nil, fmt.Errorf("encryption is disabled or server_name is not set")
+	}
+
+	b = &roamingBundleJSON{
+		ServerName: host,
+		ClientID:   clientID,
+	}
+
+	// The DoT and DoQ servers recognize the ClientID by the first label of
+	// the server name.
+	clientHost := host
+	if clientID != "" {
+		clientHost = clientID + "." + host
+	}
+
+	var profiles []*[]byte
+	if port := conf.PortHTTPS; port != 0 {
+		addr := host
+		if port != defaultPortHTTPS {
+			addr = netutil.JoinHostPort(host, port)
+		}
+
+		dohPath := path.Join("/dns-query", clientID)
+		b.DoHURL = (&url.URL{Scheme: aghhttp.SchemeHTTPS, Host: addr, Path: dohPath}).String()
+		b.DoHStamp = (&dnsstamps.ServerStamp{
+			ProviderName: addr,
+			Path:         dohPath,
+			Proto:        dnsstamps.StampProtoTypeDoH,
+		}).String()
+
+		b.DoHMobileConfig, err = encodeMobileConfig(&dnsSettings{
+			DNSProtocol: dnsProtoHTTPS,
+			ServerName:  addr,
+		}, clientID)
+		if err != nil {
+			return nil, fmt.Errorf("encoding doh mobileconfig: %w", err)
+		}
+
+		profiles = append(profiles, &b.DoHMobileConfig)
+	}
+
+	if port := conf.PortDNSOverTLS; port != 0 {
+		addr := netutil.JoinHostPort(clientHost, port)
+		b.DoTURL = (&url.URL{Scheme: "tls", Host: addr}).String()
+		b.DoTStamp = (&dnsstamps.ServerStamp{
+			ProviderName: addr,
+			Proto:        dnsstamps.StampProtoTypeTLS,
+		}).String()
+
+		if port == defaultPortTLS {
+			b.AndroidPrivateDNS = clientHost
+
+			b.DoTMobileConfig, err = encodeMobileConfig(&dnsSettings{
+				DNSProtocol: dnsProtoTLS,
+				ServerName:  host,
+			}, clientID)
+			if err != nil {
+				return nil, fmt.Errorf("encoding dot mobileconfig: %w", err)
+			}
+
+			profiles = append(profiles, &b.DoTMobileConfig)
+		}
+	}
+
+	if port := conf.PortDNSOverQUIC; port != 0 {
+		addr := netutil.JoinHostPort(clientHost, port)
+		b.DoQURL = (&url.URL{Scheme: "quic", Host: addr}).String()
+		b.DoQStamp = (&dnsstamps.ServerStamp{
+			ProviderName: addr,
+			Proto:        dnsstamps.StampProtoTypeDoQ,
+		}).String()
+	}
+
+	if cert == nil || len(profiles) == 0 {
+		return b, nil
+	}
+
+	now := time.Now()
+	for _, p := range profiles {
+		var signed []byte
+		signed, err = signProfile(*p, cert, now)
+		if err != nil {
+			// Unsigned profiles are still usable, so just log the error.
+			log.Info("roaming: signing mobileconfig: %s", err)
+
+			return b, nil
+		}
+
+		*p = signed
+	}
+
+	b.Signed = true
+
+	return b, nil
+}
+
+// handleRoamingBundle is the handler for the GET /control/roaming/bundle HTTP
+// API.  The optional client_id query parameter sets the ClientID to generate
+// the artifacts for.
+func handleRoamingBundle(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	if clientID != "" {
+		err := dnsforward.ValidateClientID(clientID)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+			return
+		}
+	}
+
+	tlsConf := &tlsConfigSettings{}
+	Context.tls.WriteDiskConfig(tlsConf)
+
+	var cert *tls.Certificate
+	pair, err := tls.X509KeyPair(tlsConf.CertificateChainData, tlsConf.PrivateKeyData)
+	if err == nil {
+		cert = &pair
+	} else {
+		log.Debug("roaming: loading certificate: %s", err)
+	}
+
+	b, err := newRoamingBundle(tlsConf, clientID, cert)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, b)
+}
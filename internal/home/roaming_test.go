@@ -0,0 +1,141 @@
+package home
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func TestNewRoamingBundle(t *testing.T) {
+	conf := &tlsConfigSettings{
+		Enabled:         true,
+		ServerName:      "dns.example.org",
+		PortHTTPS:       8443,
+		PortDNSOverTLS:  defaultPortTLS,
+		PortDNSOverQUIC: 8853,
+	}
+
+	t.Run("client_id", func(t *testing.T) {
+		b, err := newRoamingBundle(conf, "cli", nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, "https://dns.example.org:8443/dns-query/cli", b.DoHURL)
+		assert.Equal(t, "tls://cli.dns.example.org:853", b.DoTURL)
+		assert.Equal(t, "quic://cli.dns.example.org:8853", b.DoQURL)
+		assert.Equal(t, "cli.dns.example.org", b.AndroidPrivateDNS)
+		assert.False(t, b.Signed)
+
+		stamp, err := dnsstamps.NewServerStampFromString(b.DoHStamp)
+		require.NoError(t, err)
+
+		assert.Equal(t, "dns.example.org:8443", stamp.ProviderName)
+		assert.Equal(t, "/dns-query/cli", stamp.Path)
+
+		var mc mobileConfig
+		_, err = plist.Unmarshal(b.DoTMobileConfig, &mc)
+		require.NoError(t, err)
+		require.Len(t, mc.PayloadContent, 1)
+
+		assert.Equal(t, "cli.dns.example.org", mc.PayloadContent[0].DNSSettings.ServerName)
+	})
+
+	t.Run("non_default_dot", func(t *testing.T) {
+		c := *conf
+		c.PortDNSOverTLS = 8853
+
+		b, err := newRoamingBundle(&c, "", nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, "tls://dns.example.org:8853", b.DoTURL)
+		assert.Empty(t, b.AndroidPrivateDNS)
+		assert.Empty(t, b.DoTMobileConfig)
+		assert.NotEmpty(t, b.DoHMobileConfig)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, err := newRoamingBundle(&tlsConfigSettings{ServerName: "dns.example.org"}, "", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		cert, err := tls.X509KeyPair(testCertChainData, testPrivateKeyData)
+		require.NoError(t, err)
+
+		b, err := newRoamingBundle(conf, "", &cert)
+		require.NoError(t, err)
+		require.True(t, b.Signed)
+
+		profile := verifySignedProfile(t, b.DoHMobileConfig, &cert)
+
+		var mc mobileConfig
+		_, err = plist.Unmarshal(profile, &mc)
+		require.NoError(t, err)
+		require.Len(t, mc.PayloadContent, 1)
+
+		assert.Equal(t, "https://dns.example.org:8443/dns-query", mc.PayloadContent[0].DNSSettings.ServerURL)
+	})
+}
+
+// verifySignedProfile checks the signature of the signed profile made with
+// cert and returns the profile itself.
+func verifySignedProfile(t *testing.T, signed []byte, cert *tls.Certificate) (profile []byte) {
+	t.Helper()
+
+	ci := cmsContentInfo{}
+	_, err := asn1.Unmarshal(signed, &ci)
+	require.NoError(t, err)
+	require.True(t, ci.ContentType.Equal(oidSignedData))
+
+	sd := cmsSignedData{}
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	require.NoError(t, err)
+
+	_, err = asn1.Unmarshal(sd.EncapContentInfo.Content.Bytes, &profile)
+	require.NoError(t, err)
+
+	assert.Equal(t, bytes.Join(cert.Certificate, nil), sd.Certificates.Bytes)
+
+	si := cmsSignerInfo{}
+	_, err = asn1.Unmarshal(sd.SignerInfos.Bytes, &si)
+	require.NoError(t, err)
+
+	// The signed attributes must be verified with the SET OF tag.
+	attrs := si.SignedAttrs
+	attrs.Class, attrs.Tag, attrs.FullBytes = asn1.ClassUniversal, asn1.TagSet, nil
+	attrsDER, err := asn1.Marshal(attrs)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(profile)
+	assert.True(t, bytes.Contains(attrsDER, digest[:]))
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	alg := x509.SHA256WithRSA
+	if leaf.PublicKeyAlgorithm == x509.ECDSA {
+		alg = x509.ECDSAWithSHA256
+	}
+
+	require.NoError(t, leaf.CheckSignature(alg, attrsDER, si.Signature))
+
+	return profile
+}
+
+func TestSignProfile_unsupportedKey(t *testing.T) {
+	cert, err := tls.X509KeyPair(testCertChainData, testPrivateKeyData)
+	require.NoError(t, err)
+
+	cert.PrivateKey = "not a key"
+
+	_, err = signProfile([]byte("profile"), &cert, time.Now())
+	assert.Error(t, err)
+}
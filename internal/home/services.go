@@ -0,0 +1,76 @@
+package home
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/aghsvc"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// newServices returns the lifecycle manager of the statistics, the query log,
+// the filtering, the DNS server, and, if dhcp isn't nil, the DHCP server.  The
+// DNS server must be initialized.  The modules the DNS server depends on are
+// started before it and stopped after it.
+func newServices(dhcp dhcpd.Interface) (m *aghsvc.Manager) {
+	svcs := []aghsvc.Service{&aghsvc.FuncService{
+		OnStart: func() (err error) {
+			Context.stats.Start()
+
+			return nil
+		},
+		OnShutdown: func() (err error) {
+			closeStats()
+
+			return nil
+		},
+		Name: "stats",
+	}, &aghsvc.FuncService{
+		OnStart: func() (err error) {
+			Context.queryLog.Start()
+
+			return nil
+		},
+		OnShutdown: func() (err error) {
+			closeQueryLog()
+
+			return nil
+		},
+		Name: "query log",
+	}, &aghsvc.FuncService{
+		// Closing the filtering stops its background refreshes of the filter
+		// health and the IP lists.
+		OnStart: func() (err error) {
+			Context.filters.Start()
+
+			return nil
+		},
+		OnShutdown: func() (err error) {
+			Context.filters.Close()
+
+			return nil
+		},
+		Name: "filtering",
+	}, &aghsvc.FuncService{
+		OnStart:    startDNSServer,
+		OnShutdown: stopDNSServer,
+		Name:       "dns server",
+	}}
+
+	if dhcp != nil {
+		svcs = append(svcs, &aghsvc.FuncService{
+			OnStart: func() (err error) {
+				// Don't stop the DNS server if the DHCP server fails to
+				// start, since the latter is often misconfigured.
+				err = dhcp.Start()
+				if err != nil {
+					log.Error("starting dhcp server: %s", err)
+				}
+
+				return nil
+			},
+			OnShutdown: dhcp.Stop,
+			Name:       "dhcp server",
+		})
+	}
+
+	return aghsvc.NewManager(svcs...)
+}
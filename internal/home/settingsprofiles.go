@@ -0,0 +1,397 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+// settingsProfile is a named set of the global filtering settings, which are
+// switched together, for example "Normal" or "Homework".
+type settingsProfile struct {
+	// Name is the unique name of the profile.
+	Name string `yaml:"name" json:"name"`
+
+	filtering.ProfileSettings `yaml:",inline"`
+}
+
+// profileSwitch is a scheduled activation of a settings profile.
+type profileSwitch struct {
+	// Profile is the name of the activated profile.
+	Profile string `yaml:"profile" json:"profile"`
+
+	// Time is the local time of the day, at which the profile is activated,
+	// in the "15:04" format.
+	Time string `yaml:"time" json:"time"`
+
+	// Days are the days of the week, at which the profile is activated, for
+	// example "mon".  If empty, the profile is activated every day.
+	Days []string `yaml:"days" json:"days"`
+}
+
+// weekdays are the days of the week by their names used in the schedule.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// validate returns an error if sw is invalid.
+func (sw *profileSwitch) validate() (err error) {
+	if _, err = time.Parse("15:04", sw.Time); err != nil {
+		return fmt.Errorf("time: %w", err)
+	}
+
+	for _, d := range sw.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("bad day %q", d)
+		}
+	}
+
+	return nil
+}
+
+// next returns the first time sw is scheduled at after now.  sw must be valid.
+func (sw *profileSwitch) next(now time.Time) (next time.Time) {
+	tod, _ := time.Parse("15:04", sw.Time)
+
+	for d := 0; d <= 7; d++ {
+		day := now.AddDate(0, 0, d)
+		t := time.Date(day.Year(), day.Month(), day.Day(), tod.Hour(), tod.Minute(), 0, 0, now.Location())
+		if t.After(now) && sw.isOn(t.Weekday()) {
+			return t
+		}
+	}
+
+	// Unreachable, since sw is valid.
+	return time.Time{}
+}
+
+// isOn returns true if sw is scheduled on the day of the week wd.
+func (sw *profileSwitch) isOn(wd time.Weekday) (ok bool) {
+	if len(sw.Days) == 0 {
+		return true
+	}
+
+	for _, d := range sw.Days {
+		if weekdays[strings.ToLower(d)] == wd {
+			return true
+		}
+	}
+
+	return false
+}
+
+// profilesConfig is the configuration of the settings profiles.
+type profilesConfig struct {
+	// Active is the name of the last activated profile, if any.
+	Active string `yaml:"active" json:"active"`
+
+	// Profiles are the available profiles.
+	Profiles []*settingsProfile `yaml:"profiles" json:"profiles"`
+
+	// Schedule are the scheduled activations of the profiles.
+	Schedule []*profileSwitch `yaml:"schedule" json:"schedule"`
+}
+
+// clone returns a deep copy of c.
+func (c *profilesConfig) clone() (cloned *profilesConfig) {
+	cloned = &profilesConfig{
+		Active:   c.Active,
+		Profiles: make([]*settingsProfile, 0, len(c.Profiles)),
+		Schedule: make([]*profileSwitch, 0, len(c.Schedule)),
+	}
+
+	for _, p := range c.Profiles {
+		cp := *p
+		cp.BlockedServices = slices.Clone(p.BlockedServices)
+		cloned.Profiles = append(cloned.Profiles, &cp)
+	}
+
+	for _, sw := range c.Schedule {
+		cp := *sw
+		cp.Days = slices.Clone(sw.Days)
+		cloned.Schedule = append(cloned.Schedule, &cp)
+	}
+
+	return cloned
+}
+
+// profile returns the profile with name, if any.
+func (c *profilesConfig) profile(name string) (p *settingsProfile) {
+	for _, p = range c.Profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if c is invalid.
+func (c *profilesConfig) validate() (err error) {
+	names := map[string]struct{}{}
+	for i, p := range c.Profiles {
+		if p == nil {
+			return fmt.Errorf("profile at index %d: %w", i, errors.Error("no value"))
+		} else if p.Name == "" {
+			return fmt.Errorf("profile at index %d: %w", i, errors.Error("empty name"))
+		} else if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("profile %q: duplicated name", p.Name)
+		}
+
+		names[p.Name] = struct{}{}
+
+		for _, s := range p.BlockedServices {
+			if !filtering.BlockedSvcKnown(s) {
+				return fmt.Errorf("profile %q: unknown blocked service %q", p.Name, s)
+			}
+		}
+	}
+
+	for i, sw := range c.Schedule {
+		if sw == nil {
+			return fmt.Errorf("schedule at index %d: %w", i, errors.Error("no value"))
+		} else if _, ok := names[sw.Profile]; !ok {
+			return fmt.Errorf("schedule at index %d: unknown profile %q", i, sw.Profile)
+		} else if err = sw.validate(); err != nil {
+			return fmt.Errorf("schedule at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// nextSwitch returns the first scheduled activation of a profile after now.
+// sw is nil if there are no scheduled activations.  c must be valid.
+func (c *profilesConfig) nextSwitch(now time.Time) (sw *profileSwitch, at time.Time) {
+	for _, s := range c.Schedule {
+		t := s.next(now)
+		if sw == nil || t.Before(at) {
+			sw, at = s, t
+		}
+	}
+
+	return sw, at
+}
+
+// profileSwitcher activates the settings profiles on request and on the
+// schedule.
+type profileSwitcher struct {
+	// mu protects conf.
+	mu *sync.Mutex
+
+	// conf is the current configuration of the profiles.
+	conf *profilesConfig
+
+	// apply sets the global filtering settings.
+	apply func(s *filtering.ProfileSettings)
+
+	// reschedule is used to signal the changes of the schedule.
+	reschedule chan struct{}
+
+	// done is closed when the switcher is closed.
+	done chan struct{}
+}
+
+// newProfileSwitcher returns a new profile switcher with the configuration
+// conf, which applies the settings using apply.
+func newProfileSwitcher(
+	conf *profilesConfig,
+	apply func(s *filtering.ProfileSettings),
+) (ps *profileSwitcher, err error) {
+	err = conf.validate()
+	if err != nil {
+		return nil, fmt.Errorf("validating settings profiles: %w", err)
+	}
+
+	return &profileSwitcher{
+		mu:         &sync.Mutex{},
+		conf:       conf.clone(),
+		apply:      apply,
+		reschedule: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// config returns a copy of the current configuration.
+func (ps *profileSwitcher) config() (conf *profilesConfig) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.conf.clone()
+}
+
+// active returns the name of the last activated profile, if any.
+func (ps *profileSwitcher) active() (name string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.conf.Active
+}
+
+// setConfig sets the profiles and the schedule from conf and reschedules the
+// activations.  The active profile is kept if it still exists.
+func (ps *profileSwitcher) setConfig(conf *profilesConfig) {
+	ps.mu.Lock()
+	active := ps.conf.Active
+	ps.conf = conf.clone()
+	if ps.conf.profile(active) == nil {
+		active = ""
+	}
+	ps.conf.Active = active
+	ps.mu.Unlock()
+
+	select {
+	case ps.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// activate applies the settings of the profile with name.
+func (ps *profileSwitcher) activate(name string) (err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p := ps.conf.profile(name)
+	if p == nil {
+		return fmt.Errorf("no profile %q", name)
+	}
+
+	ps.apply(&p.ProfileSettings)
+	ps.conf.Active = name
+
+	log.Info("profiles: activated profile %q", name)
+
+	return nil
+}
+
+// writeDiskConfig puts the current configuration into conf.
+func (ps *profileSwitcher) writeDiskConfig(conf *profilesConfig) {
+	*conf = *ps.config()
+}
+
+// start starts activating the profiles on the schedule.
+func (ps *profileSwitcher) start() {
+	go ps.periodicSwitch()
+}
+
+// periodicSwitch activates the profiles on the schedule until the switcher is
+// closed.
+func (ps *profileSwitcher) periodicSwitch() {
+	defer log.OnPanic("profiles: switching")
+
+	for ps.waitAndSwitch(ps.config()) {
+	}
+}
+
+// waitAndSwitch waits until the time of the next activation scheduled in conf
+// and activates the profile.  It returns early if the schedule is changed, and
+// returns false if the switcher is closed.
+func (ps *profileSwitcher) waitAndSwitch(conf *profilesConfig) (cont bool) {
+	var timerCh <-chan time.Time
+	sw, at := conf.nextSwitch(time.Now())
+	if sw != nil {
+		log.Debug("profiles: next switch to %q at %s", sw.Profile, at)
+
+		t := time.NewTimer(time.Until(at))
+		defer t.Stop()
+
+		timerCh = t.C
+	}
+
+	select {
+	case <-timerCh:
+		if err := ps.activate(sw.Profile); err != nil {
+			log.Error("profiles: %s", err)
+		} else {
+			onConfigModified()
+		}
+	case <-ps.reschedule:
+		// Go on.
+	case <-ps.done:
+		return false
+	}
+
+	return true
+}
+
+// close stops activating the profiles on the schedule.
+func (ps *profileSwitcher) close() {
+	close(ps.done)
+}
+
+// handleProfilesInfo is the handler for the GET /control/settings_profiles/info
+// HTTP API.
+func (ps *profileSwitcher) handleProfilesInfo(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, ps.config())
+}
+
+// handleProfilesSetConfig is the handler for the POST
+// /control/settings_profiles/config HTTP API.  The active field of the request
+// is ignored.
+func (ps *profileSwitcher) handleProfilesSetConfig(w http.ResponseWriter, r *http.Request) {
+	conf := &profilesConfig{}
+	err := aghhttp.DecodeJSON(r, conf)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	err = conf.validate()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "validating: %s", err)
+
+		return
+	}
+
+	ps.setConfig(conf)
+	onConfigModified()
+}
+
+// profileActivateReq is the request to the POST
+// /control/settings_profiles/activate HTTP API.
+type profileActivateReq struct {
+	Name string `json:"name"`
+}
+
+// handleProfilesActivate is the handler for the POST
+// /control/settings_profiles/activate HTTP API.
+func (ps *profileSwitcher) handleProfilesActivate(w http.ResponseWriter, r *http.Request) {
+	req := &profileActivateReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	err = ps.activate(req.Name)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// registerWebHandlers registers the HTTP handlers of the settings profiles.
+func (ps *profileSwitcher) registerWebHandlers() {
+	httpRegister(http.MethodGet, "/control/settings_profiles/info", ps.handleProfilesInfo)
+	httpRegister(http.MethodPost, "/control/settings_profiles/config", ps.handleProfilesSetConfig)
+	httpRegister(http.MethodPost, "/control/settings_profiles/activate", ps.handleProfilesActivate)
+}
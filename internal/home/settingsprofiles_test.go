@@ -0,0 +1,179 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfilesConfig_nextSwitch(t *testing.T) {
+	// 2022-01-05 is a Wednesday.
+	wednesday := time.Date(2022, 1, 5, 10, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		now      time.Time
+		want     time.Time
+		name     string
+		wantProf string
+		schedule []*profileSwitch
+	}{{
+		now:      wednesday,
+		want:     time.Date(2022, 1, 5, 16, 0, 0, 0, time.UTC),
+		name:     "today",
+		wantProf: "homework",
+		schedule: []*profileSwitch{{
+			Profile: "homework",
+			Time:    "16:00",
+		}},
+	}, {
+		now:      wednesday,
+		want:     time.Date(2022, 1, 6, 8, 0, 0, 0, time.UTC),
+		name:     "tomorrow",
+		wantProf: "normal",
+		schedule: []*profileSwitch{{
+			Profile: "normal",
+			Time:    "08:00",
+		}},
+	}, {
+		now:      wednesday,
+		want:     time.Date(2022, 1, 8, 9, 0, 0, 0, time.UTC),
+		name:     "weekend",
+		wantProf: "guests",
+		schedule: []*profileSwitch{{
+			Profile: "homework",
+			Time:    "16:00",
+			Days:    []string{"mon", "tue"},
+		}, {
+			Profile: "guests",
+			Time:    "09:00",
+			Days:    []string{"Sat", "sun"},
+		}},
+	}, {
+		now:      wednesday,
+		want:     time.Date(2022, 1, 12, 10, 0, 0, 0, time.UTC),
+		name:     "next_week",
+		wantProf: "normal",
+		schedule: []*profileSwitch{{
+			Profile: "normal",
+			Time:    "10:00",
+			Days:    []string{"wed"},
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &profilesConfig{Schedule: tc.schedule}
+			sw, at := c.nextSwitch(tc.now)
+			require.NotNil(t, sw)
+
+			assert.Equal(t, tc.wantProf, sw.Profile)
+			assert.Equal(t, tc.want, at)
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		sw, _ := (&profilesConfig{}).nextSwitch(wednesday)
+		assert.Nil(t, sw)
+	})
+}
+
+func TestProfilesConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *profilesConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &profilesConfig{
+			Profiles: []*settingsProfile{{Name: "normal"}},
+			Schedule: []*profileSwitch{{Profile: "normal", Time: "08:00", Days: []string{"mon"}}},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: &profilesConfig{
+			Profiles: []*settingsProfile{{Name: ""}},
+		},
+		name:       "empty_name",
+		wantErrMsg: "profile at index 0: empty name",
+	}, {
+		conf: &profilesConfig{
+			Profiles: []*settingsProfile{{Name: "normal"}, {Name: "normal"}},
+		},
+		name:       "duplicate",
+		wantErrMsg: `profile "normal": duplicated name`,
+	}, {
+		conf: &profilesConfig{
+			Profiles: []*settingsProfile{{Name: "normal"}},
+			Schedule: []*profileSwitch{{Profile: "strict", Time: "08:00"}},
+		},
+		name:       "unknown_profile",
+		wantErrMsg: `schedule at index 0: unknown profile "strict"`,
+	}, {
+		conf: &profilesConfig{
+			Profiles: []*settingsProfile{{Name: "normal"}},
+			Schedule: []*profileSwitch{{Profile: "normal", Time: "25:00"}},
+		},
+		name: "bad_time",
+		wantErrMsg: `schedule at index 0: time: parsing time "25:00": ` +
+			`hour out of range`,
+	}, {
+		conf: &profilesConfig{
+			Profiles: []*settingsProfile{{Name: "normal"}},
+			Schedule: []*profileSwitch{{Profile: "normal", Time: "08:00", Days: []string{"fun"}}},
+		},
+		name:       "bad_day",
+		wantErrMsg: `schedule at index 0: bad day "fun"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
+
+func TestProfileSwitcher_activate(t *testing.T) {
+	var applied *filtering.ProfileSettings
+	ps, err := newProfileSwitcher(&profilesConfig{
+		Profiles: []*settingsProfile{{
+			Name: "normal",
+			ProfileSettings: filtering.ProfileSettings{
+				FilteringEnabled: true,
+			},
+		}, {
+			Name: "homework",
+			ProfileSettings: filtering.ProfileSettings{
+				FilteringEnabled:  true,
+				ParentalEnabled:   true,
+				SafeSearchEnabled: true,
+			},
+		}},
+	}, func(s *filtering.ProfileSettings) { applied = s })
+	require.NoError(t, err)
+
+	err = ps.activate("homework")
+	require.NoError(t, err)
+	require.NotNil(t, applied)
+
+	assert.True(t, applied.ParentalEnabled)
+	assert.True(t, applied.SafeSearchEnabled)
+	assert.Equal(t, "homework", ps.active())
+
+	err = ps.activate("unknown")
+	testutil.AssertErrorMsg(t, `no profile "unknown"`, err)
+	assert.Equal(t, "homework", ps.active())
+
+	// The active profile is kept while it exists.
+	conf := ps.config()
+	conf.Profiles = conf.Profiles[1:]
+	ps.setConfig(conf)
+	assert.Equal(t, "homework", ps.active())
+
+	conf.Profiles = conf.Profiles[:0]
+	ps.setConfig(conf)
+	assert.Empty(t, ps.active())
+}
@@ -9,7 +9,6 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"net/http"
@@ -202,6 +201,13 @@ func loadTLSConf(tlsConf *tlsConfigSettings, status *tlsConfigStatus) (err error
 		return fmt.Errorf("validating certificate pair: %w", err)
 	}
 
+	for i, c := range tlsConf.AdditionalCertificates {
+		err = c.Load()
+		if err != nil {
+			return fmt.Errorf("loading additional certificate at index %d: %w", i, err)
+		}
+	}
+
 	return nil
 }
 
@@ -262,6 +268,20 @@ type tlsConfigSettingsExt struct {
 	PrivateKeySaved bool `yaml:"-" json:"private_key_saved,inline"`
 }
 
+// type check
+var _ aghhttp.Validator = (*tlsConfigSettingsExt)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for
+// *tlsConfigSettingsExt.
+func (s *tlsConfigSettingsExt) Validate() (err error) {
+	return aghhttp.ValidateAll(
+		aghhttp.ValidatePort("port_https", s.PortHTTPS),
+		aghhttp.ValidatePort("port_dns_over_tls", s.PortDNSOverTLS),
+		aghhttp.ValidatePort("port_dns_over_quic", s.PortDNSOverQUIC),
+		aghhttp.ValidatePort("port_dnscrypt", s.PortDNSCrypt),
+	)
+}
+
 func (m *tlsManager) handleTLSStatus(w http.ResponseWriter, r *http.Request) {
 	m.confLock.Lock()
 	data := tlsConfig{
@@ -405,6 +425,12 @@ func (m *tlsManager) handleTLSConfigure(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// The additional certificates are only set in the configuration file, so
+	// keep the current ones.
+	m.confLock.Lock()
+	req.AdditionalCertificates = m.conf.AdditionalCertificates
+	m.confLock.Unlock()
+
 	status := &tlsConfigStatus{}
 	err = loadTLSConf(&req.tlsConfigSettings, status)
 	if err != nil {
@@ -714,7 +740,7 @@ func parsePrivateKey(der []byte) (key crypto.PrivateKey, typ string, err error)
 // unmarshalTLS handles base64-encoded certificates transparently
 func unmarshalTLS(r *http.Request) (tlsConfigSettingsExt, error) {
 	data := tlsConfigSettingsExt{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := aghhttp.DecodeJSON(r, &data)
 	if err != nil {
 		return data, fmt.Errorf("failed to parse new TLS config json: %w", err)
 	}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -69,7 +70,7 @@ type httpsServer struct {
 	// TODO(a.garipov): Why is there a *sync.Cond here?  Remove.
 	cond       *sync.Cond
 	condLock   sync.Mutex
-	cert       tls.Certificate
+	certs      []tls.Certificate
 	inShutdown bool
 	enabled    bool
 }
@@ -152,13 +153,18 @@ func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings)
 		tlsConf.PortHTTPS != 0 &&
 		len(tlsConf.PrivateKeyData) != 0 &&
 		len(tlsConf.CertificateChainData) != 0
-	var cert tls.Certificate
-	var err error
+	var certs []tls.Certificate
 	if enabled {
-		cert, err = tls.X509KeyPair(tlsConf.CertificateChainData, tlsConf.PrivateKeyData)
+		cert, err := tls.X509KeyPair(tlsConf.CertificateChainData, tlsConf.PrivateKeyData)
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		certs = dnsforward.ListenerCertificates(
+			cert,
+			tlsConf.AdditionalCertificates,
+			dnsforward.TLSListenerHTTPS,
+		)
 	}
 
 	web.httpsServer.cond.L.Lock()
@@ -172,7 +178,7 @@ func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings)
 	}
 
 	web.httpsServer.enabled = enabled
-	web.httpsServer.cert = cert
+	web.httpsServer.certs = certs
 	web.httpsServer.cond.Broadcast()
 	web.httpsServer.cond.L.Unlock()
 }
@@ -295,7 +301,7 @@ func (web *Web) tlsServerLoop() {
 			ErrorLog: log.StdLog("web: https", log.DEBUG),
 			Addr:     addr,
 			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{web.httpsServer.cert},
+				Certificates: web.httpsServer.certs,
 				RootCAs:      Context.tlsRoots,
 				CipherSuites: Context.tlsCipherIDs,
 				MinVersion:   tls.VersionTLS12,
@@ -329,7 +335,7 @@ func (web *Web) mustStartHTTP3(address string) {
 		// well as timeouts here.
 		Addr: address,
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{web.httpsServer.cert},
+			Certificates: web.httpsServer.certs,
 			RootCAs:      Context.tlsRoots,
 			CipherSuites: Context.tlsCipherIDs,
 			MinVersion:   tls.VersionTLS12,
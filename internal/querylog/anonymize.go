@@ -0,0 +1,116 @@
+package querylog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// AnonymizationMode is the way the client IP addresses are anonymized.
+type AnonymizationMode string
+
+// Anonymization modes.
+const (
+	// AnonymizationModeMask zeroes the last two bytes of IPv4 addresses and the
+	// last 80 bits of IPv6 addresses.  See [AnonymizeIP].
+	AnonymizationModeMask AnonymizationMode = "mask"
+
+	// AnonymizationModeHash replaces the addresses with the ones derived from
+	// their HMAC-SHA256 with a per-installation key.  Unlike the masking, it
+	// keeps the clients distinguishable, but only to those knowing the key.
+	AnonymizationModeHash AnonymizationMode = "hash"
+)
+
+// validate returns an error if m is not a known anonymization mode.  The empty
+// mode is considered to be AnonymizationModeMask.
+func (m AnonymizationMode) validate() (err error) {
+	switch m {
+	case "", AnonymizationModeMask, AnonymizationModeHash:
+		return nil
+	default:
+		return fmt.Errorf("invalid anonymization mode %q", m)
+	}
+}
+
+// NewAnonymizer returns the function anonymizing the IP addresses according to
+// mode.  key is only used with AnonymizationModeHash and must not be empty
+// then.
+func NewAnonymizer(mode AnonymizationMode, key []byte) (f aghnet.IPMutFunc) {
+	if mode != AnonymizationModeHash {
+		return AnonymizeIP
+	}
+
+	return func(ip net.IP) {
+		hashIP(ip, key)
+	}
+}
+
+// hashedNet4 and hashedNet6 are the reserved networks, which the hashed IPv4
+// and IPv6 addresses belong to, so that they can't be confused with the real
+// ones.  These are the reserved 240.0.0.0/4 network and the IPv6 discard-only
+// prefix 100::/64 from RFC 6666.
+var (
+	hashedNet4 = &net.IPNet{IP: net.IP{240, 0, 0, 0}, Mask: net.CIDRMask(4, 32)}
+	hashedNet6 = &net.IPNet{IP: net.ParseIP("100::"), Mask: net.CIDRMask(64, 128)}
+)
+
+// hashIP replaces ip with the address of the same family derived from its
+// HMAC-SHA256 with key.  The already hashed addresses are left as is, so that
+// hashIP could be applied several times.
+func hashIP(ip net.IP, key []byte) {
+	n := hashedNet6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, n = ip4, hashedNet4
+	} else if len(ip) != net.IPv6len {
+		return
+	}
+
+	if n.Contains(ip) {
+		return
+	}
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(ip)
+	sum := mac.Sum(nil)
+
+	for i := range ip {
+		ip[i] = n.IP[i] | (sum[i] &^ n.Mask[i])
+	}
+}
+
+// anonymizationKeyLen is the length of the per-installation anonymization key.
+const anonymizationKeyLen = 32
+
+// ReadAnonymizationKey reads the per-installation anonymization key from the
+// file at path.  If there is no such file, it's created with a newly generated
+// key.
+func ReadAnonymizationKey(path string) (key []byte, err error) {
+	key, err = os.ReadFile(path)
+	if err == nil {
+		if len(key) != anonymizationKeyLen {
+			return nil, fmt.Errorf("bad key length %d in %q", len(key), path)
+		}
+
+		return key, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading key: %w", err)
+	}
+
+	key = make([]byte, anonymizationKeyLen)
+	if _, err = rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	err = os.WriteFile(path, key, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("writing key: %w", err)
+	}
+
+	return key, nil
+}
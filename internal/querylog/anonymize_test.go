@@ -0,0 +1,91 @@
+package querylog
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAnonymizer(t *testing.T) {
+	key := []byte("test key")
+
+	testCases := []struct {
+		ip      net.IP
+		wantNet *net.IPNet
+		want    net.IP
+		mode    AnonymizationMode
+		name    string
+	}{{
+		ip:      net.IP{1, 2, 3, 4},
+		wantNet: nil,
+		want:    net.IP{1, 2, 0, 0},
+		mode:    AnonymizationModeMask,
+		name:    "mask_ipv4",
+	}, {
+		ip:      net.ParseIP("2001:db8::1"),
+		wantNet: nil,
+		want:    net.ParseIP("2001:db8::"),
+		mode:    "",
+		name:    "default_ipv6",
+	}, {
+		ip:      net.IP{1, 2, 3, 4},
+		wantNet: hashedNet4,
+		want:    nil,
+		mode:    AnonymizationModeHash,
+		name:    "hash_ipv4",
+	}, {
+		ip:      net.ParseIP("2001:db8::1"),
+		wantNet: hashedNet6,
+		want:    nil,
+		mode:    AnonymizationModeHash,
+		name:    "hash_ipv6",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			anonymize := NewAnonymizer(tc.mode, key)
+
+			ip := netutil.CloneIP(tc.ip)
+			anonymize(ip)
+			if tc.wantNet == nil {
+				assert.True(t, tc.want.Equal(ip), "got %s", ip)
+
+				return
+			}
+
+			assert.True(t, tc.wantNet.Contains(ip), "got %s", ip)
+
+			// The hashing must be deterministic.
+			other := netutil.CloneIP(tc.ip)
+			anonymize(other)
+			assert.Equal(t, ip, other)
+
+			// The hashing must be idempotent.
+			hashed := netutil.CloneIP(ip)
+			anonymize(hashed)
+			assert.Equal(t, ip, hashed)
+
+			// The hashing must depend on the key.
+			other = netutil.CloneIP(tc.ip)
+			NewAnonymizer(tc.mode, []byte("other key"))(other)
+			assert.NotEqual(t, ip, other)
+		})
+	}
+}
+
+func TestReadAnonymizationKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anonymization.key")
+
+	key, err := ReadAnonymizationKey(path)
+	require.NoError(t, err)
+	require.Len(t, key, anonymizationKeyLen)
+
+	read, err := ReadAnonymizationKey(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, key, read)
+}
@@ -0,0 +1,525 @@
+package querylog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// defaultArchiveRegion is the region used to sign the requests if none is
+// configured.  Most of the S3-compatible storages accept it.
+const defaultArchiveRegion = "us-east-1"
+
+// archiveTimeout is the timeout of a single request to the object storage.
+// It's quite long, since the rotated files may be large.
+const archiveTimeout = 10 * time.Minute
+
+// ArchiveConfig is the configuration of uploading the rotated query log files
+// into an S3-compatible object storage for the long-term retention.
+type ArchiveConfig struct {
+	// Endpoint is the base URL of the object storage, for example
+	// "https://s3.eu-central-1.amazonaws.com" or "http://minio.lan:9000".
+	// The objects are addressed in the path style.
+	Endpoint string `yaml:"endpoint"`
+
+	// Region is the region the requests are signed for.  If empty,
+	// defaultArchiveRegion is used.
+	Region string `yaml:"region"`
+
+	// Bucket is the name of the bucket the files are uploaded into.
+	Bucket string `yaml:"bucket"`
+
+	// Prefix is prepended to the names of the uploaded objects, for example
+	// "adguardhome/querylog".
+	Prefix string `yaml:"prefix"`
+
+	// AccessKeyID and SecretAccessKey are the credentials of the object
+	// storage.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// DeleteLocal tells if the local files are removed once they're uploaded.
+	// The removed records are no longer shown in the query log.
+	DeleteLocal bool `yaml:"delete_local"`
+
+	// Enabled tells if the rotated files should be uploaded.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validate returns an error if the enabled configuration isn't valid.
+func (c *ArchiveConfig) validate() (err error) {
+	if !c.Enabled {
+		return nil
+	}
+
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("archive endpoint: %w", err)
+	} else if u.Scheme != aghhttp.SchemeHTTP && u.Scheme != aghhttp.SchemeHTTPS {
+		return fmt.Errorf("archive endpoint: unsupported scheme %q", u.Scheme)
+	}
+
+	switch {
+	case c.Bucket == "":
+		return errors.Error("archive bucket is empty")
+	case strings.Contains(c.Bucket, "/"):
+		return fmt.Errorf("archive bucket %q contains a slash", c.Bucket)
+	case c.AccessKeyID == "" || c.SecretAccessKey == "":
+		return errors.Error("archive credentials are empty")
+	default:
+		return nil
+	}
+}
+
+// archivedFile is a rotated file of a storage, which can be archived.
+type archivedFile struct {
+	// path is the path to the local file.
+	path string
+
+	// name is the stable name of the file, which, along with the hash of its
+	// contents, makes up the name of the object it's uploaded as.
+	name string
+}
+
+// archivingStorage is a [Storage] keeping the rotated records in the files,
+// which can be uploaded into the archive.
+type archivingStorage interface {
+	Storage
+
+	// rotatedFiles returns the files, which aren't written to anymore, from
+	// older to newer.
+	rotatedFiles() (files []*archivedFile, err error)
+
+	// removeRotated removes the rotated file at path along with its index,
+	// unless it has been changed since fi has been got.
+	removeRotated(path string, fi os.FileInfo) (err error)
+}
+
+// type check
+var (
+	_ archivingStorage = (*fileStorage)(nil)
+	_ archivingStorage = (*dailyStorage)(nil)
+	_ archivingStorage = (*encryptedStorage)(nil)
+)
+
+// removeIfSame removes the file at path along with its index, unless it has
+// been replaced or modified since fi has been got.
+func removeIfSame(path string, fi os.FileInfo) (err error) {
+	cur, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+
+	if !os.SameFile(fi, cur) || cur.Size() != fi.Size() || !cur.ModTime().Equal(fi.ModTime()) {
+		log.Debug("querylog: %q changed while archiving, keeping", path)
+
+		return nil
+	}
+
+	for _, p := range []string{path, qlogIndexPath(path)} {
+		err = removeIfExists(p)
+		if err != nil {
+			return fmt.Errorf("removing: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// archiver uploads the rotated files into an S3-compatible object storage.
+type archiver struct {
+	// client is used to send the requests.
+	client *http.Client
+
+	// signer signs the requests with the AWS Signature Version 4.
+	signer *v4.Signer
+
+	// baseURL is the URL of the bucket.
+	baseURL *url.URL
+
+	// conf is the configuration of the archiver.
+	conf ArchiveConfig
+}
+
+// newArchiver returns a new archiver.  conf must be valid and enabled.
+func newArchiver(conf *ArchiveConfig) (a *archiver) {
+	u, _ := url.Parse(conf.Endpoint)
+	u.Path = path.Join("/", u.Path, conf.Bucket)
+	u.RawPath = ""
+
+	a = &archiver{
+		client: &http.Client{Timeout: archiveTimeout},
+		// S3 expects the path to be escaped only once.
+		signer: v4.NewSigner(func(o *v4.SignerOptions) {
+			o.DisableURIPathEscaping = true
+		}),
+		baseURL: u,
+		conf:    *conf,
+	}
+
+	if a.conf.Region == "" {
+		a.conf.Region = defaultArchiveRegion
+	}
+
+	return a
+}
+
+// archive uploads the rotated files of s, which haven't been uploaded yet, and
+// removes the local copies, if configured.  If modifiedBefore isn't zero, the
+// files modified since then are skipped until the later calls.
+func (a *archiver) archive(s archivingStorage, modifiedBefore time.Time) (err error) {
+	files, err := s.rotatedFiles()
+	if err != nil {
+		return fmt.Errorf("listing rotated files: %w", err)
+	}
+
+	var errs []error
+	for _, af := range files {
+		err = a.archiveFile(s, af, modifiedBefore)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("archiving %q: %w", af.path, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("archiving files", errs...)
+	}
+
+	return nil
+}
+
+// archiveFile uploads af, unless the object with the same contents already
+// exists or af has been modified since modifiedBefore, if it isn't zero, and
+// removes it, if configured.
+func (a *archiver) archiveFile(
+	s archivingStorage,
+	af *archivedFile,
+	modifiedBefore time.Time,
+) (err error) {
+	f, err := os.Open(af.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The file has been rotated away in the meantime.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+
+	if !modifiedBefore.IsZero() && !fi.ModTime().Before(modifiedBefore) {
+		log.Debug("querylog: %q modified after %s, not archiving yet", af.path, modifiedBefore)
+
+		return nil
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, io.LimitReader(f, fi.Size()))
+	if err != nil {
+		return fmt.Errorf("hashing: %w", err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	key := path.Join(strings.Trim(a.conf.Prefix, "/"), hashedObjectName(af.name, sum))
+	exists, err := a.objectExists(key)
+	if err != nil {
+		return fmt.Errorf("checking object %q: %w", key, err)
+	}
+
+	if !exists {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("seeking: %w", err)
+		}
+
+		err = a.upload(key, io.LimitReader(f, fi.Size()), fi.Size(), sum)
+		if err != nil {
+			return fmt.Errorf("uploading object %q: %w", key, err)
+		}
+
+		log.Info("querylog: archived %q as %q", af.path, key)
+	}
+
+	if !a.conf.DeleteLocal {
+		return nil
+	}
+
+	return s.removeRotated(af.path, fi)
+}
+
+// hashedObjectName returns the name of the object for the file with name and
+// the hex-encoded SHA-256 hash of the contents sum.  The hash is inserted
+// before the first extension, so that the objects with different contents
+// never overwrite each other and the same contents are never uploaded twice.
+func hashedObjectName(name, sum string) (objName string) {
+	stem, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		stem, ext = name[:i], name[i:]
+	}
+
+	return stem + "-" + sum + ext
+}
+
+// emptyPayloadHash is the hex-encoded SHA-256 hash of the empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// objectExists returns true if the object with key exists.
+func (a *archiver) objectExists(key string) (ok bool, err error) {
+	req, err := a.newRequest(http.MethodHead, key, nil, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// upload puts size bytes from r into the object with key.  payloadHash is the
+// hex-encoded SHA-256 hash of the contents.
+func (a *archiver) upload(key string, r io.Reader, size int64, payloadHash string) (err error) {
+	req, err := a.newRequest(http.MethodPut, key, r, payloadHash)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+		return fmt.Errorf("unexpected status %s: %q", resp.Status, body)
+	}
+
+	return nil
+}
+
+// newRequest returns a new request to the object with key signed with the AWS
+// Signature Version 4.  payloadHash is the hex-encoded SHA-256 hash of body.
+func (a *archiver) newRequest(
+	method string,
+	key string,
+	body io.Reader,
+	payloadHash string,
+) (req *http.Request, err error) {
+	u := *a.baseURL
+	u.Path = path.Join(u.Path, key)
+	u.RawPath = escapeS3Path(u.Path)
+
+	req, err = http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	// S3 requires the hash of the payload to be sent along with the signed
+	// request.
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	creds := aws.Credentials{
+		AccessKeyID:     a.conf.AccessKeyID,
+		SecretAccessKey: a.conf.SecretAccessKey,
+	}
+
+	err = a.signer.SignHTTP(
+		context.Background(),
+		creds,
+		req,
+		payloadHash,
+		"s3",
+		a.conf.Region,
+		time.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("signing request: %w", err)
+	}
+
+	return req, nil
+}
+
+// escapeS3Path returns p with all the bytes except the unreserved characters
+// and the slashes percent-encoded, as S3 expects in the canonical request.
+func escapeS3Path(p string) (escaped string) {
+	const upperHex = "0123456789ABCDEF"
+
+	b := &strings.Builder{}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case
+			'a' <= c && c <= 'z',
+			'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(upperHex[c>>4])
+			b.WriteByte(upperHex[c&15])
+		}
+	}
+
+	return b.String()
+}
+
+// archive uploads the rotated files of the storage into the archive, if
+// configured.  If the storage strips the clients after clientRetention, only
+// the files not modified within it are uploaded, since all their records are
+// stripped already.  Otherwise, stripping would change the files, and so the
+// names of the objects, leaving the unstripped copies in the archive.
+// clientRetention must be taken from a snapshot of the configuration made under
+// l.lock.
+func (l *queryLog) archive(clientRetention time.Duration) {
+	if l.archiver == nil {
+		return
+	}
+
+	s, ok := l.storage.(archivingStorage)
+	if !ok {
+		return
+	}
+
+	var modifiedBefore time.Time
+	if _, ok = l.storage.(clientStrippingStorage); ok && clientRetention > 0 {
+		modifiedBefore = time.Now().Add(-clientRetention)
+	}
+
+	err := l.archiver.archive(s, modifiedBefore)
+	if err != nil {
+		log.Error("querylog: %s", err)
+	}
+}
+
+// rotatedFiles implements the [archivingStorage] interface for *fileStorage.
+// The previous file is only returned once it's compressed, if the compression
+// is enabled.
+func (s *fileStorage) rotatedFiles() (files []*archivedFile, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := []string{s.gzOldPath()}
+	if !s.compress {
+		paths = append(paths, s.oldPath())
+	}
+
+	base := filepath.Base(s.path)
+	for _, p := range paths {
+		_, err = os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("getting file info: %w", err)
+		}
+
+		name := base
+		if strings.HasSuffix(p, gzipExt) {
+			name += gzipExt
+		}
+
+		files = append(files, &archivedFile{
+			path: p,
+			name: name,
+		})
+	}
+
+	return files, nil
+}
+
+// removeRotated implements the [archivingStorage] interface for *fileStorage.
+func (s *fileStorage) removeRotated(path string, fi os.FileInfo) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return removeIfSame(path, fi)
+}
+
+// rotatedFiles implements the [archivingStorage] interface for *dailyStorage.
+// These are the files of the days before yesterday, which may still get the
+// late records, and only the compressed ones, if the compression is enabled.
+func (s *dailyStorage) rotatedFiles() (files []*archivedFile, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dfs, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	yesterday := startOfDay(time.Now()).AddDate(0, 0, -1)
+	for _, df := range dfs {
+		if !df.day.Before(yesterday) || (s.compress && !df.compressed) {
+			continue
+		}
+
+		files = append(files, &archivedFile{
+			path: df.path,
+			name: filepath.Base(df.path),
+		})
+	}
+
+	return files, nil
+}
+
+// removeRotated implements the [archivingStorage] interface for *dailyStorage.
+func (s *dailyStorage) removeRotated(path string, fi os.FileInfo) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return removeIfSame(path, fi)
+}
+
+// rotatedFiles implements the [archivingStorage] interface for
+// *encryptedStorage.  The files are archived encrypted.
+func (s *encryptedStorage) rotatedFiles() (files []*archivedFile, err error) {
+	if as, ok := s.Storage.(archivingStorage); ok {
+		return as.rotatedFiles()
+	}
+
+	return nil, nil
+}
+
+// removeRotated implements the [archivingStorage] interface for
+// *encryptedStorage.
+func (s *encryptedStorage) removeRotated(path string, fi os.FileInfo) (err error) {
+	if as, ok := s.Storage.(archivingStorage); ok {
+		return as.removeRotated(path, fi)
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package querylog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveConfig_validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       ArchiveConfig
+		wantErrMsg string
+	}{{
+		name:       "disabled",
+		conf:       ArchiveConfig{},
+		wantErrMsg: "",
+	}, {
+		name: "valid",
+		conf: ArchiveConfig{
+			Endpoint:        "https://s3.eu-central-1.amazonaws.com",
+			Bucket:          "logs",
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+			Enabled:         true,
+		},
+		wantErrMsg: "",
+	}, {
+		name: "bad_scheme",
+		conf: ArchiveConfig{
+			Endpoint:        "ftp://s3.lan",
+			Bucket:          "logs",
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+			Enabled:         true,
+		},
+		wantErrMsg: `archive endpoint: unsupported scheme "ftp"`,
+	}, {
+		name: "no_bucket",
+		conf: ArchiveConfig{
+			Endpoint:        "http://s3.lan",
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+			Enabled:         true,
+		},
+		wantErrMsg: "archive bucket is empty",
+	}, {
+		name: "bad_bucket",
+		conf: ArchiveConfig{
+			Endpoint:        "http://s3.lan",
+			Bucket:          "logs/querylog",
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+			Enabled:         true,
+		},
+		wantErrMsg: `archive bucket "logs/querylog" contains a slash`,
+	}, {
+		name: "no_credentials",
+		conf: ArchiveConfig{
+			Endpoint: "http://s3.lan",
+			Bucket:   "logs",
+			Enabled:  true,
+		},
+		wantErrMsg: "archive credentials are empty",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
+
+// testObjectStorage is a fake S3-compatible object storage.
+type testObjectStorage struct {
+	// mu protects objects and puts.
+	mu *sync.Mutex
+
+	// objects are the stored objects by their paths.
+	objects map[string][]byte
+
+	// puts is the number of the uploads.
+	puts int
+}
+
+// ServeHTTP implements the [http.Handler] interface for *testObjectStorage.
+func (s *testObjectStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodHead:
+		obj, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		s.objects[r.URL.Path] = body
+		s.puts++
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestArchiver_archive(t *testing.T) {
+	objs := &testObjectStorage{
+		mu:      &sync.Mutex{},
+		objects: map[string][]byte{},
+	}
+
+	srv := httptest.NewServer(objs)
+	t.Cleanup(srv.Close)
+
+	conf := &ArchiveConfig{
+		Endpoint:        srv.URL,
+		Bucket:          "logs",
+		Prefix:          "/adguardhome/",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Enabled:         true,
+	}
+
+	s := newFileStorage(filepath.Join(t.TempDir(), queryLogFileName))
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.Append(newIndexTestRecords(start, 10)))
+	require.NoError(t, s.rename())
+	require.NoError(t, s.Append(newIndexTestRecords(start.Add(10*time.Second), 10)))
+
+	want, err := os.ReadFile(s.oldPath())
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(want)
+	wantPath := "/logs/adguardhome/querylog-" + hex.EncodeToString(sum[:]) + ".json"
+
+	t.Run("upload", func(t *testing.T) {
+		require.NoError(t, newArchiver(conf).archive(s, time.Time{}))
+
+		objs.mu.Lock()
+		defer objs.mu.Unlock()
+
+		require.Len(t, objs.objects, 1)
+
+		assert.Equal(t, want, objs.objects[wantPath])
+		assert.Equal(t, 1, objs.puts)
+		assert.FileExists(t, s.oldPath())
+	})
+
+	t.Run("already_uploaded", func(t *testing.T) {
+		require.NoError(t, newArchiver(conf).archive(s, time.Time{}))
+
+		objs.mu.Lock()
+		defer objs.mu.Unlock()
+
+		assert.Equal(t, 1, objs.puts)
+	})
+
+	t.Run("touched", func(t *testing.T) {
+		now := time.Now()
+		require.NoError(t, os.Chtimes(s.oldPath(), now, now))
+		require.NoError(t, newArchiver(conf).archive(s, time.Time{}))
+
+		objs.mu.Lock()
+		defer objs.mu.Unlock()
+
+		assert.Len(t, objs.objects, 1)
+		assert.Equal(t, 1, objs.puts)
+	})
+
+	t.Run("delete_local", func(t *testing.T) {
+		delConf := *conf
+		delConf.DeleteLocal = true
+
+		require.NoError(t, newArchiver(&delConf).archive(s, time.Time{}))
+
+		objs.mu.Lock()
+		defer objs.mu.Unlock()
+
+		assert.Equal(t, 1, objs.puts)
+		assert.NoFileExists(t, s.oldPath())
+		assert.NoFileExists(t, qlogIndexPath(s.oldPath()))
+		assert.FileExists(t, s.path)
+	})
+
+	t.Run("bad_credentials", func(t *testing.T) {
+		require.NoError(t, s.rename())
+
+		badConf := *conf
+		badConf.AccessKeyID = "bad"
+
+		err = newArchiver(&badConf).archive(s, time.Time{})
+		assert.ErrorContains(t, err, "unexpected status 403 Forbidden")
+		assert.FileExists(t, s.oldPath())
+	})
+}
+
+func TestQueryLog_archive_clientRetention(t *testing.T) {
+	objs := &testObjectStorage{
+		mu:      &sync.Mutex{},
+		objects: map[string][]byte{},
+	}
+
+	srv := httptest.NewServer(objs)
+	t.Cleanup(srv.Close)
+
+	l := newQueryLog(Config{
+		Archive: ArchiveConfig{
+			Endpoint:        srv.URL,
+			Bucket:          "logs",
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+			Enabled:         true,
+		},
+		Enabled:         true,
+		FileEnabled:     true,
+		RotationIvl:     timeutil.Day,
+		ClientRetention: time.Hour,
+		MemSize:         100,
+		BaseDir:         t.TempDir(),
+	})
+
+	s, ok := l.storage.(*fileStorage)
+	require.True(t, ok)
+
+	// Make the records old enough to be rotated, but not pruned.
+	start := time.Now().Add(-timeutil.Day - time.Hour)
+	require.NoError(t, s.Append(newStripTestRecords(start, 10)))
+
+	// The rotated file is stripped, so it's modified within the client
+	// retention period and mustn't be archived yet.
+	l.rotate()
+
+	objs.mu.Lock()
+	assert.Empty(t, objs.objects)
+	objs.mu.Unlock()
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(s.oldPath(), old, old))
+
+	// Archiving the same file again mustn't upload another object.
+	l.rotate()
+	l.rotate()
+
+	objs.mu.Lock()
+	defer objs.mu.Unlock()
+
+	require.Len(t, objs.objects, 1)
+	assert.Equal(t, 1, objs.puts)
+
+	for _, obj := range objs.objects {
+		assert.NotContains(t, string(obj), `"CID"`)
+		assert.NotContains(t, string(obj), "1.2.3.")
+	}
+}
+
+func TestHashedObjectName(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{{
+		name: "no_ext",
+		in:   "querylog",
+		want: "querylog-abcd",
+	}, {
+		name: "ext",
+		in:   "querylog.json",
+		want: "querylog-abcd.json",
+	}, {
+		name: "several_exts",
+		in:   "querylog-2022-01-01.json.gz",
+		want: "querylog-2022-01-01-abcd.json.gz",
+	}, {
+		name: "hidden",
+		in:   ".querylog",
+		want: ".querylog-abcd",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, hashedObjectName(tc.in, "abcd"))
+		})
+	}
+}
+
+func TestDailyStorage_rotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDailyStorage(dir, filepath.Join(dir, queryLogFileName))
+	require.NoError(t, err)
+
+	today := startOfDay(time.Now())
+	for i := 0; i < 3; i++ {
+		day := today.AddDate(0, 0, -i)
+		require.NoError(t, s.Append(newIndexTestRecords(day.Add(time.Hour), 1)))
+	}
+
+	files, err := s.rotatedFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	assert.Equal(t, filepath.Base(s.dayPath(today.AddDate(0, 0, -2))), files[0].name)
+
+	s.compress = true
+
+	files, err = s.rotatedFiles()
+	require.NoError(t, err)
+
+	assert.Empty(t, files)
+}
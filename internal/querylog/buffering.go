@@ -0,0 +1,147 @@
+package querylog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The limits of the memory buffer parameters.
+const (
+	// maxMemSize is the maximum number of entries kept in the memory buffer.
+	maxMemSize = 100_000
+
+	// minFlushIvl and maxFlushIvl are the limits of the non-zero flush
+	// interval.
+	minFlushIvl = 1 * time.Second
+	maxFlushIvl = 1 * time.Hour
+)
+
+// validateBuffering returns an error if the parameters of the memory buffer of
+// c, MemSize and FlushInterval, aren't valid.
+func (c *Config) validateBuffering() (err error) {
+	switch {
+	case c.MemSize == 0:
+		return errors.Error("memory buffer size must be positive")
+	case c.MemSize > maxMemSize:
+		return fmt.Errorf("memory buffer size %d is greater than %d", c.MemSize, maxMemSize)
+	default:
+		return validateFlushInterval(c.FlushInterval)
+	}
+}
+
+// validateFlushInterval returns an error if ivl isn't a valid flush interval.
+func validateFlushInterval(ivl time.Duration) (err error) {
+	if ivl == 0 || (ivl >= minFlushIvl && ivl <= maxFlushIvl) {
+		return nil
+	}
+
+	return fmt.Errorf("flush interval %s must be zero or within [%s, %s]", ivl, minFlushIvl, maxFlushIvl)
+}
+
+// Configure validates the parameters of the memory buffer of c, MemSize and
+// FlushInterval, and applies them without restarting the query log.  The other
+// fields of c are ignored.
+func (l *queryLog) Configure(c *Config) (err error) {
+	err = c.validateBuffering()
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	conf := *l.conf
+	conf.MemSize, conf.FlushInterval = c.MemSize, c.FlushInterval
+	l.applyBufferingLocked(&conf)
+	l.conf = &conf
+
+	return nil
+}
+
+// applyBufferingLocked resizes the memory buffer according to conf and wakes
+// up the writer, so that it uses the new flush interval.  l.lock is expected to
+// be locked.
+func (l *queryLog) applyBufferingLocked(conf *Config) {
+	l.resizeBuffer(int(conf.MemSize), conf.FileEnabled)
+
+	// Waking the writer up also writes the entries, which have been queued
+	// while resizing, if any.
+	select {
+	case l.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// resizeBuffer replaces the memory buffer with the one of size, keeping the
+// entries.  If writing to the file is enabled, the entries not fitting into the
+// new buffer are queued to be written, otherwise the oldest ones are dropped.
+func (l *queryLog) resizeBuffer(size int, fileEnabled bool) {
+	l.bufferLock.Lock()
+	defer l.bufferLock.Unlock()
+
+	if size == l.buffer.Cap() {
+		return
+	}
+
+	log.Debug("querylog: resizing memory buffer from %d to %d", l.buffer.Cap(), size)
+
+	entries := l.buffer.Slice()
+	l.buffer = aghalg.NewRingBuffer[*logEntry](size)
+	if fileEnabled && len(entries) >= size {
+		l.flushQueue = append(l.flushQueue, entries)
+		l.trimQueueLocked()
+
+		return
+	}
+
+	for _, e := range entries {
+		l.buffer.Push(e)
+	}
+}
+
+// queueBuffer moves the entries of the memory buffer into the queue to be
+// written to the storage, if there are any.
+func (l *queryLog) queueBuffer() {
+	l.bufferLock.Lock()
+	defer l.bufferLock.Unlock()
+
+	l.queueBufferLocked()
+}
+
+// queueBufferLocked moves the entries of the memory buffer into the queue to be
+// written to the storage, if there are any.  l.bufferLock is expected to be
+// locked.
+func (l *queryLog) queueBufferLocked() {
+	if l.buffer.Len() == 0 {
+		return
+	}
+
+	l.flushQueue = append(l.flushQueue, l.buffer.Slice())
+	l.buffer.Clear()
+}
+
+// flushInterval returns the current flush interval.  It's zero if the entries
+// aren't written to the storage at all.
+func (l *queryLog) flushInterval() (ivl time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.conf.FileEnabled {
+		return 0
+	}
+
+	return l.conf.FlushInterval
+}
+
+// fileEnabled returns true if the entries are written to the storage.  It's
+// safe for concurrent use with the reconfiguration.
+func (l *queryLog) fileEnabled() (ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.conf.FileEnabled
+}
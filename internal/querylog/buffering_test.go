@@ -0,0 +1,99 @@
+package querylog
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_validateBuffering(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       Config
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		conf:       Config{MemSize: 1000, FlushInterval: time.Minute},
+	}, {
+		name:       "no_interval",
+		wantErrMsg: "",
+		conf:       Config{MemSize: 1000},
+	}, {
+		name:       "zero_size",
+		wantErrMsg: "memory buffer size must be positive",
+		conf:       Config{},
+	}, {
+		name:       "big_size",
+		wantErrMsg: "memory buffer size 100001 is greater than 100000",
+		conf:       Config{MemSize: maxMemSize + 1},
+	}, {
+		name:       "short_interval",
+		wantErrMsg: "flush interval 100ms must be zero or within [1s, 1h0m0s]",
+		conf:       Config{MemSize: 1000, FlushInterval: 100 * time.Millisecond},
+	}, {
+		name:       "negative_interval",
+		wantErrMsg: "flush interval -1s must be zero or within [1s, 1h0m0s]",
+		conf:       Config{MemSize: 1000, FlushInterval: -time.Second},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validateBuffering())
+		})
+	}
+}
+
+func TestQueryLog_Configure(t *testing.T) {
+	s := &testStorage{}
+	l := newQueryLog(Config{
+		Storage:     s,
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     10,
+		BaseDir:     t.TempDir(),
+	})
+
+	go l.runWriter()
+	t.Cleanup(l.Close)
+
+	for i := 0; i < 3; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	assert.Zero(t, l.WriteStats().Written)
+
+	err := l.Configure(&Config{MemSize: 0})
+	assert.Error(t, err)
+
+	// Shrinking the buffer writes the entries not fitting into it.
+	err = l.Configure(&Config{MemSize: 2})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() (ok bool) {
+		return l.WriteStats().Written == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// The entries of the incomplete buffer are written once the interval
+	// passes.
+	err = l.Configure(&Config{MemSize: 2, FlushInterval: minFlushIvl})
+	require.NoError(t, err)
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	require.Eventually(t, func() (ok bool) {
+		return l.WriteStats().Written == 4
+	}, 3*minFlushIvl, 10*time.Millisecond)
+
+	conf := &Config{}
+	l.WriteDiskConfig(conf)
+
+	assert.Equal(t, uint32(2), conf.MemSize)
+	assert.Equal(t, minFlushIvl, conf.FlushInterval)
+}
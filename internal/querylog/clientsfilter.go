@@ -0,0 +1,102 @@
+package querylog
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/exp/slices"
+)
+
+// ClientsFilter limits the query log to the requests from some clients.  It's
+// used to show the query log to the administrators of particular clients only.
+type ClientsFilter struct {
+	// ips are the IP addresses of the clients.
+	ips map[netip.Addr]struct{}
+
+	// clientIDs are the ClientIDs of the clients.
+	clientIDs *stringutil.Set
+
+	// nets are the networks of the clients.
+	nets []netip.Prefix
+
+	// ids are the sorted identifiers the filter has been created from.
+	ids []string
+}
+
+// NewClientsFilter returns a new filter which only passes the requests from the
+// clients with the given identifiers, which can be IP addresses, CIDRs, or
+// ClientIDs.  The identifiers of other kinds are ignored.
+func NewClientsFilter(ids []string) (f *ClientsFilter) {
+	f = &ClientsFilter{
+		ips:       map[netip.Addr]struct{}{},
+		clientIDs: stringutil.NewSet(),
+		ids:       slices.Clone(ids),
+	}
+
+	slices.Sort(f.ids)
+
+	for _, id := range ids {
+		if ip, err := netip.ParseAddr(id); err == nil {
+			f.ips[ip.Unmap()] = struct{}{}
+		} else if p, err := netip.ParsePrefix(id); err == nil {
+			f.nets = append(f.nets, p)
+		} else {
+			f.clientIDs.Add(id)
+		}
+	}
+
+	return f
+}
+
+// match returns true if the entry is from one of the clients of f.
+func (f *ClientsFilter) match(entry *logEntry) (ok bool) {
+	if entry.ClientID != "" && f.clientIDs.Has(entry.ClientID) {
+		return true
+	}
+
+	ip, ok := netip.AddrFromSlice(entry.IP)
+	if !ok {
+		return false
+	}
+
+	ip = ip.Unmap()
+	if _, ok = f.ips[ip]; ok {
+		return true
+	}
+
+	for _, p := range f.nets {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameClients returns true if f and other pass the requests from the same
+// clients.  A nil filter only matches the other nil one.
+func (f *ClientsFilter) sameClients(other *ClientsFilter) (ok bool) {
+	if f == nil || other == nil {
+		return f == other
+	}
+
+	return slices.Equal(f.ids, other.ids)
+}
+
+// clientsFilterKey is the context key for the clients filter.
+type clientsFilterKey struct{}
+
+// WithClientsFilter returns a copy of the parent context with the clients
+// filter, which is applied to all the query log HTTP API requests made within
+// the context.
+func WithClientsFilter(parent context.Context, f *ClientsFilter) (ctx context.Context) {
+	return context.WithValue(parent, clientsFilterKey{}, f)
+}
+
+// clientsFilterFromContext returns the clients filter from ctx, if any.
+func clientsFilterFromContext(ctx context.Context) (f *ClientsFilter) {
+	f, _ = ctx.Value(clientsFilterKey{}).(*ClientsFilter)
+
+	return f
+}
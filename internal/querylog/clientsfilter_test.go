@@ -0,0 +1,55 @@
+package querylog
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientsFilter_match(t *testing.T) {
+	f := NewClientsFilter([]string{"1.2.3.4", "5.6.7.0/24", "kid-laptop", "aa:aa:aa:aa:aa:aa"})
+
+	testCases := []struct {
+		entry *logEntry
+		want  assert.BoolAssertionFunc
+		name  string
+	}{{
+		entry: &logEntry{IP: net.IP{1, 2, 3, 4}},
+		want:  assert.True,
+		name:  "ip",
+	}, {
+		entry: &logEntry{IP: net.IPv4(1, 2, 3, 4)},
+		want:  assert.True,
+		name:  "ip_mapped",
+	}, {
+		entry: &logEntry{IP: net.IP{5, 6, 7, 8}},
+		want:  assert.True,
+		name:  "subnet",
+	}, {
+		entry: &logEntry{IP: net.IP{9, 9, 9, 9}, ClientID: "kid-laptop"},
+		want:  assert.True,
+		name:  "client_id",
+	}, {
+		entry: &logEntry{IP: net.IP{9, 9, 9, 9}, ClientID: "other"},
+		want:  assert.False,
+		name:  "other",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.want(t, f.match(tc.entry))
+		})
+	}
+
+	assert.True(t, f.sameClients(NewClientsFilter([]string{
+		"kid-laptop", "aa:aa:aa:aa:aa:aa", "5.6.7.0/24", "1.2.3.4",
+	})))
+	assert.False(t, f.sameClients(NewClientsFilter([]string{"1.2.3.4"})))
+	assert.False(t, f.sameClients(nil))
+
+	ctx := WithClientsFilter(context.Background(), f)
+	assert.Same(t, f, clientsFilterFromContext(ctx))
+	assert.Nil(t, clientsFilterFromContext(context.Background()))
+}
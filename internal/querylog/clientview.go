@@ -0,0 +1,77 @@
+package querylog
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ResolveClientFunc returns the identifiers of the client with id, which can be
+// an IP address, a MAC address, or a ClientID, as written to the query log,
+// that is IP addresses, CIDRs, and ClientIDs.  ids are empty if the client is
+// unknown.
+type ResolveClientFunc func(id string) (ids []string)
+
+// ClientAccessFunc returns true if the user making the request r may see the
+// query log of the client with the identifiers ids, as returned by the
+// [ResolveClientFunc].
+type ClientAccessFunc func(r *http.Request, ids []string) (ok bool)
+
+// clientViewPath is the path of the per-client query log HTTP API.
+const clientViewPath = "/control/querylog/client"
+
+// resolveClient returns the identifiers of the client with id to search the
+// log for.
+func (l *queryLog) resolveClient(id string) (ids []string) {
+	if l.conf.ResolveClient == nil {
+		return []string{id}
+	}
+
+	return l.conf.ResolveClient(id)
+}
+
+// handleQueryLogClient handles requests to the GET /control/querylog/client
+// endpoint.  It accepts the same parameters as the GET /control/querylog one,
+// except that the required "client" parameter is the IP address, the MAC
+// address, or the ClientID of the client, which queries are returned.
+func (l *queryLog) handleQueryLogClient(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("client")
+	if id == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client is required")
+
+		return
+	}
+
+	ids := l.resolveClient(id)
+	if len(ids) == 0 {
+		aghhttp.Error(r, w, http.StatusNotFound, "no client %q", id)
+
+		return
+	}
+
+	if check := l.conf.CheckClientAccess; check != nil && !check(r, ids) {
+		log.Debug("querylog: access to the log of client %q denied", id)
+		aghhttp.Error(r, w, http.StatusForbidden, "access to client %q is denied", id)
+
+		return
+	}
+
+	// Don't let the client parameter be parsed as the search criterion.
+	q.Del("client")
+	r.URL.RawQuery = q.Encode()
+
+	params, err := l.parseSearchParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to parse params: %s", err)
+
+		return
+	}
+
+	params.client = NewClientsFilter(ids)
+
+	entries, oldest := l.search(params)
+
+	_ = aghhttp.WriteJSONResponse(w, r, l.entriesToJSON(entries, oldest))
+}
@@ -0,0 +1,124 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+)
+
+func TestQueryLog_handleQueryLogClient(t *testing.T) {
+	const (
+		knownMAC   = "aa:aa:aa:aa:aa:aa"
+		unknownMAC = "bb:bb:bb:bb:bb:bb"
+		deniedIP   = "2.2.2.3"
+	)
+
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+		ResolveClient: func(id string) (ids []string) {
+			switch id {
+			case knownMAC:
+				return []string{"2.2.2.1", "2.2.2.2"}
+			case unknownMAC:
+				return nil
+			default:
+				return []string{id}
+			}
+		},
+		CheckClientAccess: func(_ *http.Request, ids []string) (ok bool) {
+			return !slices.Contains(ids, deniedIP)
+		},
+	})
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "third.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 3))
+
+	testCases := []struct {
+		filter     *ClientsFilter
+		name       string
+		client     string
+		wantHosts  []string
+		wantStatus int
+	}{{
+		filter:     nil,
+		name:       "mac",
+		client:     knownMAC,
+		wantHosts:  []string{"second.example", "first.example"},
+		wantStatus: http.StatusOK,
+	}, {
+		filter:     nil,
+		name:       "ip",
+		client:     "2.2.2.2",
+		wantHosts:  []string{"second.example"},
+		wantStatus: http.StatusOK,
+	}, {
+		filter:     NewClientsFilter([]string{"2.2.2.1"}),
+		name:       "restricted",
+		client:     knownMAC,
+		wantHosts:  []string{"first.example"},
+		wantStatus: http.StatusOK,
+	}, {
+		filter:     nil,
+		name:       "denied",
+		client:     deniedIP,
+		wantHosts:  nil,
+		wantStatus: http.StatusForbidden,
+	}, {
+		filter:     nil,
+		name:       "unknown",
+		client:     unknownMAC,
+		wantHosts:  nil,
+		wantStatus: http.StatusNotFound,
+	}, {
+		filter:     nil,
+		name:       "no_client",
+		client:     "",
+		wantHosts:  nil,
+		wantStatus: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, clientViewPath+"?client="+tc.client, nil)
+			if tc.filter != nil {
+				r = r.WithContext(WithClientsFilter(r.Context(), tc.filter))
+			}
+
+			w := httptest.NewRecorder()
+
+			l.handleQueryLogClient(w, r)
+			require.Equal(t, tc.wantStatus, w.Code)
+
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			resp := &struct {
+				Data []struct {
+					Question struct {
+						Name string `json:"name"`
+					} `json:"question"`
+				} `json:"data"`
+			}{}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+			hosts := make([]string, 0, len(resp.Data))
+			for _, d := range resp.Data {
+				hosts = append(hosts, d.Question.Name)
+			}
+
+			assert.Equal(t, tc.wantHosts, hosts)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package querylog
+
+import (
+	"time"
+)
+
+// coalesceKey identifies the identical queries of a client.
+type coalesceKey struct {
+	ip       string
+	clientID string
+	host     string
+	qtype    string
+	qclass   string
+}
+
+// newCoalesceKey returns the key of the query of e.
+func newCoalesceKey(e *logEntry) (k coalesceKey) {
+	return coalesceKey{
+		ip:       string(e.IP),
+		clientID: e.ClientID,
+		host:     e.QHost,
+		qtype:    e.QType,
+		qclass:   e.QClass,
+	}
+}
+
+// coalescer keeps the entries of the recent queries until their coalescing
+// windows end, so that the identical queries made within the window are
+// recorded once with the number of repeats.  It's protected by
+// queryLog.bufferLock.
+type coalescer struct {
+	// entries are the latest versions of the pending entries.  The entries
+	// are never modified, since they may be read without locking, so a repeat
+	// replaces the entry with the modified copy.
+	entries map[coalesceKey]*logEntry
+
+	// order are the keys of entries from older to newer.  Since the windows
+	// are all of the same length, it's also the order of their ends.
+	order []coalesceKey
+
+	// ivl is the length of the coalescing window.
+	ivl time.Duration
+}
+
+// newCoalescer returns a new coalescer with the window of ivl, which must be
+// positive.
+func newCoalescer(ivl time.Duration) (c *coalescer) {
+	return &coalescer{
+		entries: map[coalesceKey]*logEntry{},
+		ivl:     ivl,
+	}
+}
+
+// add counts e as a repeat of the pending identical entry, if there is one,
+// and otherwise makes e pending.  The windows ended by the time of e must be
+// expired beforehand.
+func (c *coalescer) add(e *logEntry) {
+	k := newCoalesceKey(e)
+	if prev, ok := c.entries[k]; ok {
+		repeated := *prev
+		repeated.Repeats++
+		c.entries[k] = &repeated
+
+		return
+	}
+
+	c.entries[k] = e
+	c.order = append(c.order, k)
+}
+
+// expire removes the pending entries, which windows have ended by now, and
+// returns them from older to newer.
+func (c *coalescer) expire(now time.Time) (expired []*logEntry) {
+	var n int
+	for _, k := range c.order {
+		e := c.entries[k]
+		if now.Sub(e.Time) < c.ivl {
+			break
+		}
+
+		expired = append(expired, e)
+		delete(c.entries, k)
+		n++
+	}
+
+	c.order = c.order[n:]
+
+	return expired
+}
+
+// flush removes all the pending entries and returns them from older to newer.
+func (c *coalescer) flush() (entries []*logEntry) {
+	entries = c.snapshot()
+	c.entries = map[coalesceKey]*logEntry{}
+	c.order = nil
+
+	return entries
+}
+
+// snapshot returns the pending entries from older to newer.
+func (c *coalescer) snapshot() (entries []*logEntry) {
+	entries = make([]*logEntry, 0, len(c.order))
+	for _, k := range c.order {
+		entries = append(entries, c.entries[k])
+	}
+
+	return entries
+}
@@ -0,0 +1,97 @@
+package querylog
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescer(t *testing.T) {
+	const ivl = time.Second
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	newEntry := func(host string, ip net.IP, after time.Duration) (e *logEntry) {
+		return &logEntry{
+			Time:   start.Add(after),
+			QHost:  host,
+			QType:  "A",
+			QClass: "IN",
+			IP:     ip,
+		}
+	}
+
+	ip1, ip2 := net.IP{1, 2, 3, 4}, net.IP{1, 2, 3, 5}
+
+	c := newCoalescer(ivl)
+	for _, e := range []*logEntry{
+		newEntry("example.org", ip1, 0),
+		newEntry("example.org", ip2, 100*time.Millisecond),
+		newEntry("example.org", ip1, 200*time.Millisecond),
+		newEntry("example.com", ip1, 300*time.Millisecond),
+		newEntry("example.org", ip1, 400*time.Millisecond),
+	} {
+		assert.Empty(t, c.expire(e.Time))
+		c.add(e)
+	}
+
+	pending := c.snapshot()
+	require.Len(t, pending, 3)
+
+	assert.Equal(t, uint32(2), pending[0].Repeats)
+	assert.Equal(t, uint32(0), pending[1].Repeats)
+	assert.Equal(t, uint32(0), pending[2].Repeats)
+
+	expired := c.expire(start.Add(ivl + 150*time.Millisecond))
+	require.Len(t, expired, 2)
+
+	assert.Equal(t, ip1, expired[0].IP)
+	assert.Equal(t, "example.org", expired[0].QHost)
+	assert.Equal(t, ip2, expired[1].IP)
+
+	// The window of the first entry has ended, so the same query starts a new
+	// one.
+	c.add(newEntry("example.org", ip1, ivl+200*time.Millisecond))
+
+	flushed := c.flush()
+	require.Len(t, flushed, 2)
+
+	assert.Equal(t, "example.com", flushed[0].QHost)
+	assert.Equal(t, "example.org", flushed[1].QHost)
+	assert.Zero(t, flushed[1].Repeats)
+
+	assert.Empty(t, c.snapshot())
+}
+
+func TestQueryLog_coalesce(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		CoalesceIvl: time.Hour,
+		BaseDir:     t.TempDir(),
+	})
+
+	for i := 0; i < 5; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+
+	params := newSearchParams()
+
+	// The pending entries are searchable.
+	entries, _ := l.search(params)
+	require.Len(t, entries, 2)
+
+	require.NoError(t, l.flushLogBuffer(true))
+
+	entries, _ = l.search(params)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, uint32(0), entries[0].Repeats)
+	assert.Equal(t, uint32(4), entries[1].Repeats)
+}
@@ -0,0 +1,185 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// gzipExt is the extension of the compressed query log files.
+const gzipExt = ".gz"
+
+// validateCompressionLevel returns an error if level isn't a valid gzip
+// compression level.  Zero means gzip.DefaultCompression.
+func validateCompressionLevel(level int) (err error) {
+	if level != 0 && (level < gzip.HuffmanOnly || level > gzip.BestCompression) {
+		return fmt.Errorf("invalid compression level %d", level)
+	}
+
+	return nil
+}
+
+// decompressToTemp decompresses the contents of gzf into a new temporary file
+// within the same directory.  The caller is responsible for removing it.
+func decompressToTemp(gzf *os.File) (f *os.File, err error) {
+	name := gzf.Name()
+	f, err = os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, f.Close())
+			err = errors.WithDeferred(err, os.Remove(f.Name()))
+			f = nil
+		}
+	}()
+
+	_, err = gzf.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("seeking: %w", err)
+	}
+
+	zr, err := gzip.NewReader(gzf)
+	if err != nil {
+		return nil, fmt.Errorf("opening gzip: %w", err)
+	}
+
+	_, err = io.Copy(f, zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+
+	return f, nil
+}
+
+// gzOldPath returns the path to the compressed previous file.
+func (s *fileStorage) gzOldPath() (p string) {
+	return s.oldPath() + gzipExt
+}
+
+// startCompression compresses the previous file in the background, if the
+// compression is enabled and the file isn't compressed yet.
+func (s *fileStorage) startCompression() {
+	if !s.compress {
+		return
+	}
+
+	if _, err := os.Stat(s.oldPath()); err != nil {
+		return
+	}
+
+	go func() {
+		defer log.OnPanic("querylog: compressing")
+
+		if err := s.compressOld(); err != nil {
+			log.Error("querylog: compressing %q: %s", s.oldPath(), err)
+		}
+	}()
+}
+
+// compressOld replaces the previous file with the compressed one along with its
+// index.  The previous file is only replaced if it hasn't been rotated while
+// compressing.
+func (s *fileStorage) compressOld() (err error) {
+	// Don't compress the same file concurrently.
+	if !s.compressMu.TryLock() {
+		return nil
+	}
+	defer s.compressMu.Unlock()
+
+	src, err := os.Open(s.oldPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, src.Close()) }()
+
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+
+	tmpPath := s.gzOldPath() + ".tmp"
+	err = writeGzip(tmpPath, src, s.compressLevel)
+	if err != nil {
+		return errors.WithDeferred(err, removeIfExists(tmpPath))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	curInfo, err := os.Stat(s.oldPath())
+	if err != nil || !os.SameFile(srcInfo, curInfo) {
+		log.Debug("querylog: %q rotated while compressing", s.oldPath())
+
+		return removeIfExists(tmpPath)
+	}
+
+	err = os.Rename(tmpPath, s.gzOldPath())
+	if err != nil {
+		return fmt.Errorf("renaming: %w", err)
+	}
+
+	err = rotateQLogIndex(s.oldPath(), s.gzOldPath())
+	if err != nil {
+		return fmt.Errorf("rotating index: %w", err)
+	}
+
+	err = os.Remove(s.oldPath())
+	if err != nil {
+		return fmt.Errorf("removing: %w", err)
+	}
+
+	log.Debug("querylog: compressed %q", s.oldPath())
+
+	return nil
+}
+
+// writeGzip writes the contents of src compressed with level into the file at
+// path.
+func writeGzip(path string, src io.Reader, level int) (err error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	zw, err := gzip.NewWriterLevel(f, level)
+	if err != nil {
+		return fmt.Errorf("creating gzip writer: %w", err)
+	}
+
+	_, err = io.Copy(zw, src)
+	if err != nil {
+		return fmt.Errorf("compressing: %w", err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("flushing gzip writer: %w", err)
+	}
+
+	return nil
+}
+
+// removeIfExists removes the file at path, if it exists.
+func removeIfExists(path string) (err error) {
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
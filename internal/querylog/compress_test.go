@@ -0,0 +1,81 @@
+package querylog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage_compress(t *testing.T) {
+	dir := t.TempDir()
+	s := newFileStorage(filepath.Join(dir, queryLogFileName))
+	s.compress = true
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.Append(newIndexTestRecords(start, 10)))
+	require.NoError(t, s.rename())
+	require.NoError(t, s.compressOld())
+	require.NoError(t, s.Append(newIndexTestRecords(start.Add(10*time.Second), 10)))
+
+	assert.FileExists(t, s.gzOldPath())
+	assert.FileExists(t, qlogIndexPath(s.gzOldPath()))
+	assert.NoFileExists(t, s.oldPath())
+	assert.NoFileExists(t, qlogIndexPath(s.oldPath()))
+
+	iterate := func(t *testing.T, olderThan time.Time) (times []time.Time) {
+		t.Helper()
+
+		err := s.Iterate(olderThan, func(rec string) (cont bool) {
+			times = append(times, time.Unix(0, readQLogTimestamp(rec)).UTC())
+
+			return true
+		})
+		require.NoError(t, err)
+
+		return times
+	}
+
+	t.Run("all", func(t *testing.T) {
+		times := iterate(t, time.Time{})
+		require.Len(t, times, 20)
+
+		assert.Equal(t, start.Add(19*time.Second), times[0])
+		assert.Equal(t, start, times[19])
+	})
+
+	t.Run("compressed_file", func(t *testing.T) {
+		times := iterate(t, start.Add(5*time.Second))
+		require.Len(t, times, 5)
+
+		assert.Equal(t, start.Add(4*time.Second), times[0])
+	})
+
+	t.Run("no_temporary_files", func(t *testing.T) {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+
+		assert.ElementsMatch(t, []string{
+			queryLogFileName,
+			qlogIndexPath(queryLogFileName),
+			filepath.Base(s.gzOldPath()),
+			qlogIndexPath(filepath.Base(s.gzOldPath())),
+		}, names)
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		require.NoError(t, s.rename())
+
+		assert.NoFileExists(t, s.gzOldPath())
+		assert.FileExists(t, s.oldPath())
+		assert.Len(t, iterate(t, time.Time{}), 10)
+	})
+}
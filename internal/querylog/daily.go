@@ -0,0 +1,462 @@
+package querylog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The parts of the names of the daily files, for example
+// "querylog-2024-05-01.json".
+const (
+	dailyFilePrefix = "querylog-"
+	dailyFileExt    = ".json"
+	dailyDateLayout = "2006-01-02"
+)
+
+// dailyStorage is the [Storage] keeping the records made during each day, in
+// the local time, in a separate file named after the day, for example
+// "querylog-2024-05-01.json".  The files of the days before yesterday may be
+// compressed.  The whole files are removed once they're outdated, so that they
+// could be archived separately.
+type dailyStorage struct {
+	// mu protects the files from concurrent modification.
+	mu *sync.Mutex
+
+	// dir is the directory of the files.
+	dir string
+
+	// maxSize is the maximum total size of the files in bytes.  Once it's
+	// exceeded, the oldest files are removed, except the current one.  If
+	// zero, the size is unlimited.
+	maxSize uint64
+
+	// compressLevel is the gzip compression level of the files.  If zero,
+	// gzip.DefaultCompression is used.
+	compressLevel int
+
+	// lastPath is the path of the file the records have been appended to
+	// last.  It's empty if there were no records appended since the previous
+	// syncing.
+	lastPath string
+
+	// compress tells if the files of the days before yesterday are
+	// compressed.
+	compress bool
+}
+
+// type check
+var _ clientStrippingStorage = (*dailyStorage)(nil)
+
+// newDailyStorage returns a new daily storage keeping the files in dir.  If
+// the files of the file storage with the current file at filePath exist, their
+// records are moved into the daily files.
+func newDailyStorage(dir, filePath string) (s *dailyStorage, err error) {
+	s = &dailyStorage{
+		mu:  &sync.Mutex{},
+		dir: dir,
+	}
+
+	err = s.migrate(newFileStorage(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("migrating: %w", err)
+	}
+
+	return s, nil
+}
+
+// migrate moves the records from the files of fs into the daily files and
+// removes the former.
+func (s *dailyStorage) migrate(fs *fileStorage) (err error) {
+	var num int
+	for _, p := range []string{fs.gzOldPath(), fs.oldPath(), fs.path} {
+		var n int
+		n, err = appendFileRecords(s, p)
+		if err != nil {
+			return fmt.Errorf("moving records from %q: %w", p, err)
+		}
+
+		num += n
+	}
+
+	if num == 0 {
+		return nil
+	}
+
+	log.Info("querylog: moved %d records from files into daily files", num)
+
+	return fs.Clear()
+}
+
+// dailyFile is a file of the daily storage.
+type dailyFile struct {
+	// day is the start of the day the records of the file are made during.
+	day time.Time
+
+	// path is the path to the file.
+	path string
+
+	// compressed is true if the file is gzipped.
+	compressed bool
+}
+
+// dayPath returns the path to the uncompressed file of the day.
+func (s *dailyStorage) dayPath(day time.Time) (p string) {
+	return filepath.Join(s.dir, dailyFilePrefix+day.Format(dailyDateLayout)+dailyFileExt)
+}
+
+// startOfDay returns the start of the day of t in the local time.
+func startOfDay(t time.Time) (day time.Time) {
+	t = t.Local()
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// files returns the files of the storage sorted from older to newer.  If both
+// the compressed and the uncompressed files of a day exist, the compression
+// has been interrupted right before removing the uncompressed one, so only the
+// compressed one is returned.  s.mu is expected to be locked.
+func (s *dailyStorage) files() (files []*dailyFile, err error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading dir: %w", err)
+	}
+
+	byDay := map[time.Time]*dailyFile{}
+	for _, ent := range entries {
+		name := ent.Name()
+		compressed := strings.HasSuffix(name, gzipExt)
+		date := strings.TrimSuffix(name, gzipExt)
+		if !strings.HasPrefix(date, dailyFilePrefix) || !strings.HasSuffix(date, dailyFileExt) {
+			continue
+		}
+
+		date = strings.TrimSuffix(strings.TrimPrefix(date, dailyFilePrefix), dailyFileExt)
+		day, perr := time.ParseInLocation(dailyDateLayout, date, time.Local)
+		if perr != nil {
+			log.Debug("querylog: skipping %q: %s", name, perr)
+
+			continue
+		}
+
+		if prev, ok := byDay[day]; ok && prev.compressed {
+			continue
+		}
+
+		byDay[day] = &dailyFile{
+			day:        day,
+			path:       filepath.Join(s.dir, name),
+			compressed: compressed,
+		}
+	}
+
+	files = make([]*dailyFile, 0, len(byDay))
+	for _, f := range byDay {
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) (less bool) { return files[i].day.Before(files[j].day) })
+
+	return files, nil
+}
+
+// Append implements the [Storage] interface for *dailyStorage.  The records
+// are appended to the files of the days they're made during.
+func (s *dailyStorage) Append(records [][]byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(records) > 0 {
+		day := recordDay(records[0])
+		n := 1
+		for n < len(records) && recordDay(records[n]).Equal(day) {
+			n++
+		}
+
+		path := s.dayPath(day)
+		_, err = appendToFile(path, records[:n])
+		if err != nil {
+			return err
+		}
+
+		if s.lastPath != "" && s.lastPath != path {
+			// Don't leave the records of the previous day uncommitted.
+			err = syncFile(s.lastPath)
+			if err != nil {
+				log.Debug("querylog: %s", err)
+			}
+		}
+
+		s.lastPath = path
+
+		records = records[n:]
+	}
+
+	return nil
+}
+
+// Sync implements the [syncingStorage] interface for *dailyStorage.
+func (s *dailyStorage) Sync() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastPath == "" {
+		return nil
+	}
+
+	err = syncFile(s.lastPath)
+	if err != nil {
+		return err
+	}
+
+	s.lastPath = ""
+
+	return nil
+}
+
+// recordDay returns the start of the day rec is made during.  If rec has no
+// valid time, the current day is returned.
+func recordDay(rec []byte) (day time.Time) {
+	t := time.Now()
+	if ts := readQLogTimestamp(string(rec)); ts != 0 {
+		t = time.Unix(0, ts)
+	}
+
+	return startOfDay(t)
+}
+
+// Iterate implements the [Storage] interface for *dailyStorage.  The files of
+// the days starting at or after olderThan aren't even opened.
+func (s *dailyStorage) Iterate(olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+	// Open the files under the lock, since they could be replaced by the
+	// compressed ones in the meantime.
+	s.mu.Lock()
+	files, err := s.files()
+	if err != nil {
+		s.mu.Unlock()
+
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, df := range files {
+		if olderThan.IsZero() || df.day.Before(olderThan) {
+			paths = append(paths, df.path)
+		}
+	}
+
+	r, err := NewQLogReader(paths)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("opening qlog reader: %w", err)
+	}
+
+	return iterateReader(r, olderThan, f)
+}
+
+// Rotate implements the [Storage] interface for *dailyStorage.  It removes the
+// files of the days, which have ended more than ivl ago, and the oldest files
+// exceeding the maximum total size.  It also compresses the files of the days
+// before yesterday, if the compression is enabled.
+func (s *dailyStorage) Rotate(ivl time.Duration) (err error) {
+	s.mu.Lock()
+	files, err := s.files()
+	if err == nil {
+		files, err = s.removeOutdated(files, time.Now().Add(-ivl))
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !s.compress {
+		return nil
+	}
+
+	yesterday := startOfDay(time.Now()).AddDate(0, 0, -1)
+
+	var errs []error
+	for _, df := range files {
+		if !df.compressed && df.day.Before(yesterday) {
+			err = s.compressFile(df.path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("compressing %q: %w", df.path, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("compressing files", errs...)
+	}
+
+	return nil
+}
+
+// removeOutdated removes the files of the days, which have ended before
+// olderThan, and the oldest files exceeding the maximum total size.  kept are
+// the rest of the files.  s.mu is expected to be locked.
+func (s *dailyStorage) removeOutdated(
+	files []*dailyFile,
+	olderThan time.Time,
+) (kept []*dailyFile, err error) {
+	var total uint64
+	sizes := make([]uint64, len(files))
+	for i, df := range files {
+		var fi os.FileInfo
+		fi, err = os.Stat(df.path)
+		if err != nil {
+			return nil, fmt.Errorf("getting file info: %w", err)
+		}
+
+		sizes[i] = uint64(fi.Size())
+		total += sizes[i]
+	}
+
+	// Keep the newest file regardless of the size.
+	for len(files) > 1 {
+		outdated := !files[0].day.AddDate(0, 0, 1).After(olderThan)
+		tooBig := s.maxSize > 0 && total > s.maxSize
+		if !outdated && !tooBig {
+			break
+		}
+
+		err = files[0].remove()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info("querylog: removed %q", files[0].path)
+
+		total -= sizes[0]
+		files, sizes = files[1:], sizes[1:]
+	}
+
+	return files, nil
+}
+
+// remove removes the file along with its index.  The uncompressed file of the
+// same day left by the interrupted compression, if any, is removed as well.
+func (df *dailyFile) remove() (err error) {
+	paths := []string{df.path, qlogIndexPath(df.path)}
+	if df.compressed {
+		plain := strings.TrimSuffix(df.path, gzipExt)
+		paths = append(paths, plain, qlogIndexPath(plain))
+	}
+
+	for _, p := range paths {
+		err = removeIfExists(p)
+		if err != nil {
+			return fmt.Errorf("removing: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// compressFile replaces the uncompressed file at path with the compressed one
+// along with its index.
+func (s *dailyStorage) compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, src.Close()) }()
+
+	gzPath := path + gzipExt
+	tmpPath := gzPath + ".tmp"
+	err = writeGzip(tmpPath, src, s.compressLevel)
+	if err != nil {
+		return errors.WithDeferred(err, removeIfExists(tmpPath))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.Rename(tmpPath, gzPath)
+	if err != nil {
+		return fmt.Errorf("renaming: %w", err)
+	}
+
+	err = rotateQLogIndex(path, gzPath)
+	if err != nil {
+		return fmt.Errorf("rotating index: %w", err)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("removing: %w", err)
+	}
+
+	log.Debug("querylog: compressed %q", path)
+
+	return nil
+}
+
+// Clear implements the [Storage] interface for *dailyStorage.
+func (s *dailyStorage) Clear() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, df := range files {
+		err = df.remove()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("removing files", errs...)
+	}
+
+	return nil
+}
+
+// StripClients implements the [clientStrippingStorage] interface for
+// *dailyStorage.
+func (s *dailyStorage) StripClients(olderThan time.Time) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, df := range files {
+		if !df.day.Before(olderThan) {
+			break
+		}
+
+		var fileN int
+		fileN, err = stripFile(df.path, olderThan.UnixNano(), s.compressLevel)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stripping %q: %w", df.path, err))
+		}
+
+		n += fileN
+	}
+
+	if len(errs) > 0 {
+		return n, errors.List("stripping files", errs...)
+	}
+
+	return n, nil
+}
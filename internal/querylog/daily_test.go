@@ -0,0 +1,119 @@
+package querylog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// iterateTimes returns the times of all the records of s from newer to older
+// starting with the ones made before olderThan.
+func iterateTimes(t *testing.T, s Storage, olderThan time.Time) (times []time.Time) {
+	t.Helper()
+
+	err := s.Iterate(olderThan, func(rec string) (cont bool) {
+		times = append(times, time.Unix(0, readQLogTimestamp(rec)))
+
+		return true
+	})
+	require.NoError(t, err)
+
+	return times
+}
+
+func TestDailyStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDailyStorage(dir, filepath.Join(dir, queryLogFileName))
+	require.NoError(t, err)
+
+	today := startOfDay(time.Now())
+	days := []time.Time{today.AddDate(0, 0, -3), today.AddDate(0, 0, -2), today}
+
+	// Write a batch spanning the end of the first day and the start of the
+	// second one, and a batch for today.
+	require.NoError(t, s.Append(newIndexTestRecords(days[1].Add(-5*time.Second), 10)))
+	require.NoError(t, s.Append(newIndexTestRecords(days[2], 10)))
+
+	for _, d := range days {
+		assert.FileExists(t, s.dayPath(d))
+	}
+
+	times := iterateTimes(t, s, time.Time{})
+	require.Len(t, times, 20)
+
+	assert.True(t, days[2].Add(9*time.Second).Equal(times[0]))
+	assert.True(t, days[1].Add(-5*time.Second).Equal(times[19]))
+
+	times = iterateTimes(t, s, days[1].Add(2*time.Second))
+	require.Len(t, times, 7)
+
+	assert.True(t, days[1].Add(time.Second).Equal(times[0]))
+
+	t.Run("compress", func(t *testing.T) {
+		s.compress = true
+		require.NoError(t, s.Rotate(30*24*time.Hour))
+
+		assert.FileExists(t, s.dayPath(days[0])+gzipExt)
+		assert.FileExists(t, s.dayPath(days[1])+gzipExt)
+		assert.NoFileExists(t, s.dayPath(days[0]))
+		assert.FileExists(t, s.dayPath(days[2]))
+
+		assert.Len(t, iterateTimes(t, s, time.Time{}), 20)
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		// Only the first day has ended at least two days ago.
+		require.NoError(t, s.Rotate(48*time.Hour))
+
+		assert.NoFileExists(t, s.dayPath(days[0])+gzipExt)
+		assert.FileExists(t, s.dayPath(days[1])+gzipExt)
+
+		assert.Len(t, iterateTimes(t, s, time.Time{}), 15)
+	})
+
+	t.Run("max_size", func(t *testing.T) {
+		s.maxSize = 1
+		require.NoError(t, s.Rotate(30*24*time.Hour))
+
+		// The current file is kept regardless of the size.
+		assert.NoFileExists(t, s.dayPath(days[1])+gzipExt)
+		assert.FileExists(t, s.dayPath(days[2]))
+
+		assert.Len(t, iterateTimes(t, s, time.Time{}), 10)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		require.NoError(t, s.Clear())
+
+		entries, rerr := os.ReadDir(dir)
+		require.NoError(t, rerr)
+
+		assert.Empty(t, entries)
+	})
+}
+
+func TestDailyStorage_migrate(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, queryLogFileName)
+
+	fs := newFileStorage(filePath)
+	start := startOfDay(time.Now()).AddDate(0, 0, -1)
+	require.NoError(t, fs.Append(newIndexTestRecords(start, 10)))
+	require.NoError(t, fs.rename())
+	require.NoError(t, fs.Append(newIndexTestRecords(start.Add(24*time.Hour), 10)))
+
+	s, err := newDailyStorage(dir, filePath)
+	require.NoError(t, err)
+
+	assert.NoFileExists(t, filePath)
+	assert.NoFileExists(t, fs.oldPath())
+
+	assert.FileExists(t, s.dayPath(start))
+	assert.FileExists(t, s.dayPath(start.AddDate(0, 0, 1)))
+
+	assert.Len(t, iterateTimes(t, s, time.Time{}), 20)
+}
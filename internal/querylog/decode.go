@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -66,6 +67,16 @@ var logEntryHandlers = map[string]logEntryHandler{
 		ent.QType = v
 		return nil
 	},
+	"RC": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.Rcode = v
+
+		return nil
+	},
 	"QC": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -129,6 +140,16 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return nil
 	},
+	"CacheBypassed": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(bool)
+		if !ok {
+			return nil
+		}
+
+		ent.CacheBypassed = v
+
+		return nil
+	},
 	"AD": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(bool)
 		if !ok {
@@ -139,6 +160,31 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return nil
 	},
+	"DS": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.DNSSEC = DNSSECStatus(v)
+
+		return nil
+	},
+	"RP": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(json.Number)
+		if !ok {
+			return nil
+		}
+
+		i, err := strconv.ParseUint(string(v), 10, 32)
+		if err != nil {
+			return err
+		}
+
+		ent.Repeats = uint32(i)
+
+		return nil
+	},
 	"Upstream": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -242,6 +288,21 @@ var resultHandlers = map[string]logEntryHandler{
 
 		ent.Result.CanonName = s
 
+		return nil
+	},
+	"SuppressedType": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(json.Number)
+		if !ok {
+			return nil
+		}
+
+		i, err := strconv.ParseUint(string(v), 10, 16)
+		if err != nil {
+			return err
+		}
+
+		ent.Result.SuppressedType = uint16(i)
+
 		return nil
 	},
 }
@@ -632,6 +693,23 @@ func decodeResult(dec *json.Decoder, ent *logEntry) {
 	}
 }
 
+// decodeAnswers decodes the structured answers with the key from dec into ent.
+func decodeAnswers(dec *json.Decoder, key string, ent *logEntry) (err error) {
+	var ans []*dnsAnswer
+	err = dec.Decode(&ans)
+	if err != nil {
+		return err
+	}
+
+	if key == "AN" {
+		ent.Answers = ans
+	} else {
+		ent.OrigAnswers = ans
+	}
+
+	return nil
+}
+
 func decodeLogEntry(ent *logEntry, str string) {
 	dec := json.NewDecoder(strings.NewReader(str))
 	dec.UseNumber()
@@ -656,9 +734,18 @@ func decodeLogEntry(ent *logEntry, str string) {
 			return
 		}
 
-		if key == "Result" {
+		switch key {
+		case "Result":
 			decodeResult(dec, ent)
 
+			continue
+		case "AN", "OAN":
+			if err = decodeAnswers(dec, key, ent); err != nil {
+				log.Debug("decodeLogEntry: decoding %q: %s", key, err)
+
+				return
+			}
+
 			continue
 		}
 
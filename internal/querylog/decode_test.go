@@ -34,7 +34,11 @@ func TestDecodeLogEntry(t *testing.T) {
 			`"CP":"",` +
 			`"ECS":"1.2.3.0/24",` +
 			`"Answer":"` + ansStr + `",` +
+			`"AN":[{"type":"A","value":"0.0.0.0","ttl":10}],` +
+			`"OAN":null,` +
+			`"RC":"NOERROR",` +
 			`"Cached":true,` +
+			`"CacheBypassed":true,` +
 			`"AD":true,` +
 			`"Result":{` +
 			`"IsFiltered":true,` +
@@ -44,6 +48,7 @@ func TestDecodeLogEntry(t *testing.T) {
 			`{"FilterListID":43,"Text":"||an2.yandex.ru","IP":"127.0.0.3"}],` +
 			`"CanonName":"example.com",` +
 			`"ServiceName":"example.org",` +
+			`"SuppressedType":16,` +
 			`"DNSRewriteResult":{"RCode":0,"Response":{"1":["127.0.0.2"]}}},` +
 			`"Upstream":"https://some.upstream",` +
 			`"Elapsed":837429}`
@@ -52,16 +57,19 @@ func TestDecodeLogEntry(t *testing.T) {
 		require.NoError(t, err)
 
 		want := &logEntry{
-			IP:          net.IPv4(127, 0, 0, 1),
-			Time:        time.Date(2020, 11, 25, 15, 55, 56, 519796000, time.UTC),
-			QHost:       "an.yandex.ru",
-			QType:       "A",
-			QClass:      "IN",
-			ClientID:    "cli42",
-			ClientProto: "",
-			ReqECS:      "1.2.3.0/24",
-			Answer:      ans,
-			Cached:      true,
+			IP:            net.IPv4(127, 0, 0, 1),
+			Time:          time.Date(2020, 11, 25, 15, 55, 56, 519796000, time.UTC),
+			QHost:         "an.yandex.ru",
+			QType:         "A",
+			QClass:        "IN",
+			ClientID:      "cli42",
+			ClientProto:   "",
+			ReqECS:        "1.2.3.0/24",
+			Answer:        ans,
+			Answers:       []*dnsAnswer{{Type: "A", Value: "0.0.0.0", TTL: 10}},
+			Rcode:         "NOERROR",
+			Cached:        true,
+			CacheBypassed: true,
 			Result: filtering.Result{
 				DNSRewriteResult: &filtering.DNSRewriteResult{
 					RCode: dns.RcodeSuccess,
@@ -81,8 +89,9 @@ func TestDecodeLogEntry(t *testing.T) {
 					Text:         "||an2.yandex.ru",
 					IP:           net.IPv4(127, 0, 0, 3),
 				}},
-				Reason:     filtering.FilteredBlockList,
-				IsFiltered: true,
+				Reason:         filtering.FilteredBlockList,
+				SuppressedType: dns.TypeTXT,
+				IsFiltered:     true,
 			},
 			Upstream:          "https://some.upstream",
 			Elapsed:           837429,
@@ -0,0 +1,289 @@
+package querylog
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// msgHeaderJSON is the JSON representation of a DNS message header.
+type msgHeaderJSON struct {
+	Opcode             string `json:"opcode"`
+	Rcode              string `json:"rcode"`
+	ID                 uint16 `json:"id"`
+	Response           bool   `json:"qr"`
+	Authoritative      bool   `json:"aa"`
+	Truncated          bool   `json:"tc"`
+	RecursionDesired   bool   `json:"rd"`
+	RecursionAvailable bool   `json:"ra"`
+	Zero               bool   `json:"z"`
+	AuthenticatedData  bool   `json:"ad"`
+	CheckingDisabled   bool   `json:"cd"`
+}
+
+// msgQuestionJSON is the JSON representation of a DNS question.
+type msgQuestionJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+// msgRRJSON is the JSON representation of a DNS resource record.
+type msgRRJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	Data  string `json:"data"`
+	TTL   uint32 `json:"ttl"`
+}
+
+// msgEDNSOptionJSON is the JSON representation of an EDNS option.
+type msgEDNSOptionJSON struct {
+	// Name is the human-readable name of the option, if known.
+	Name string `json:"name,omitempty"`
+
+	// Value is the human-readable value of the option.
+	Value string `json:"value"`
+
+	// Data is the hex-encoded raw option data.
+	Data string `json:"data"`
+
+	// Code is the option code.
+	Code uint16 `json:"code"`
+}
+
+// msgEDNSJSON is the JSON representation of the EDNS pseudo-section of a DNS
+// message.
+type msgEDNSJSON struct {
+	Options       []*msgEDNSOptionJSON `json:"options"`
+	ExtendedRcode int                  `json:"extended_rcode"`
+	UDPSize       uint16               `json:"udp_size"`
+	Version       uint8                `json:"version"`
+	DNSSECOK      bool                 `json:"do"`
+}
+
+// msgJSON is the JSON representation of a whole DNS message.
+type msgJSON struct {
+	EDNS       *msgEDNSJSON       `json:"edns,omitempty"`
+	Header     *msgHeaderJSON     `json:"header"`
+	Question   []*msgQuestionJSON `json:"question"`
+	Answer     []*msgRRJSON       `json:"answer"`
+	Authority  []*msgRRJSON       `json:"authority"`
+	Additional []*msgRRJSON       `json:"additional"`
+	Size       int                `json:"size"`
+}
+
+// msgToJSON converts a DNS message into its detailed JSON representation.  size
+// is the length of the packed message.  The OPT pseudo-record is presented in
+// the EDNS section instead of the additional one.  m must be unpacked, so that
+// its rcode includes the extended part.
+func msgToJSON(m *dns.Msg, size int) (mj *msgJSON) {
+	h := m.MsgHdr
+	mj = &msgJSON{
+		Header: &msgHeaderJSON{
+			Opcode:             dns.OpcodeToString[h.Opcode],
+			Rcode:              dns.RcodeToString[h.Rcode],
+			ID:                 h.Id,
+			Response:           h.Response,
+			Authoritative:      h.Authoritative,
+			Truncated:          h.Truncated,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: h.RecursionAvailable,
+			Zero:               h.Zero,
+			AuthenticatedData:  h.AuthenticatedData,
+			CheckingDisabled:   h.CheckingDisabled,
+		},
+		Question:   make([]*msgQuestionJSON, 0, len(m.Question)),
+		Answer:     rrsToJSON(m.Answer),
+		Authority:  rrsToJSON(m.Ns),
+		Additional: make([]*msgRRJSON, 0, len(m.Extra)),
+		Size:       size,
+	}
+
+	for _, q := range m.Question {
+		mj.Question = append(mj.Question, &msgQuestionJSON{
+			Name:  q.Name,
+			Type:  dns.Type(q.Qtype).String(),
+			Class: dns.Class(q.Qclass).String(),
+		})
+	}
+
+	for _, rr := range m.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			mj.EDNS = optToJSON(opt)
+
+			continue
+		}
+
+		mj.Additional = append(mj.Additional, rrToJSON(rr))
+	}
+
+	return mj
+}
+
+// rrsToJSON converts a section of a DNS message into its JSON representation.
+func rrsToJSON(rrs []dns.RR) (rjs []*msgRRJSON) {
+	rjs = make([]*msgRRJSON, 0, len(rrs))
+	for _, rr := range rrs {
+		rjs = append(rjs, rrToJSON(rr))
+	}
+
+	return rjs
+}
+
+// rrToJSON converts a DNS resource record into its JSON representation.
+func rrToJSON(rr dns.RR) (rj *msgRRJSON) {
+	hdr := rr.Header()
+	rj = &msgRRJSON{
+		Name:  hdr.Name,
+		Type:  dns.Type(hdr.Rrtype).String(),
+		Class: dns.Class(hdr.Class).String(),
+		TTL:   hdr.Ttl,
+	}
+
+	// Cut the header from the presentation format to only keep the data.
+	s, hs := rr.String(), hdr.String()
+	rj.Data = strings.TrimPrefix(s, hs)
+
+	return rj
+}
+
+// optToJSON converts an OPT pseudo-record into the JSON representation of the
+// EDNS section.
+func optToJSON(opt *dns.OPT) (ej *msgEDNSJSON) {
+	ej = &msgEDNSJSON{
+		Options:       make([]*msgEDNSOptionJSON, 0, len(opt.Option)),
+		ExtendedRcode: opt.ExtendedRcode(),
+		UDPSize:       opt.UDPSize(),
+		Version:       opt.Version(),
+		DNSSECOK:      opt.Do(),
+	}
+
+	for _, o := range opt.Option {
+		oj := &msgEDNSOptionJSON{
+			Name:  ednsOptionName(o.Option()),
+			Value: o.String(),
+			Code:  o.Option(),
+		}
+
+		oj.Data = hex.EncodeToString(ednsOptionData(o))
+
+		ej.Options = append(ej.Options, oj)
+	}
+
+	return ej
+}
+
+// ednsOptionData returns the raw data of the EDNS option o.
+func ednsOptionData(o dns.EDNS0) (data []byte) {
+	// The dns.EDNS0 interface doesn't export the packing method, so pack the
+	// option within an OPT record and cut the headers.
+	const (
+		optHdrLen    = 1 + 2 + 2 + 4 + 2
+		optionHdrLen = 2 + 2
+	)
+
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+		Option: []dns.EDNS0{o},
+	}
+
+	buf := make([]byte, dns.Len(opt))
+	n, err := dns.PackRR(opt, buf, 0, nil, false)
+	if err != nil || n < optHdrLen+optionHdrLen {
+		return nil
+	}
+
+	return buf[optHdrLen+optionHdrLen : n]
+}
+
+// ednsOptionName returns the human-readable name of the EDNS option with the
+// code, if it's known.
+func ednsOptionName(code uint16) (name string) {
+	switch code {
+	case dns.EDNS0LLQ:
+		return "LLQ"
+	case dns.EDNS0UL:
+		return "UL"
+	case dns.EDNS0NSID:
+		return "NSID"
+	case dns.EDNS0DAU:
+		return "DAU"
+	case dns.EDNS0DHU:
+		return "DHU"
+	case dns.EDNS0N3U:
+		return "N3U"
+	case dns.EDNS0SUBNET:
+		return "ECS"
+	case dns.EDNS0EXPIRE:
+		return "EXPIRE"
+	case dns.EDNS0COOKIE:
+		return "COOKIE"
+	case dns.EDNS0TCPKEEPALIVE:
+		return "TCP-KEEPALIVE"
+	case dns.EDNS0PADDING:
+		return "PADDING"
+	case dns.EDNS0EDE:
+		return "EDE"
+	default:
+		return ""
+	}
+}
+
+// questionMsg reconstructs the question message of the entry.  The original
+// request isn't stored in the query log, so only the question and the EDNS
+// Client Subnet option are restored.
+func questionMsg(entry *logEntry) (m *dns.Msg, err error) {
+	qtype, ok := dns.StringToType[entry.QType]
+	if !ok {
+		return nil, fmt.Errorf("unknown question type %q", entry.QType)
+	}
+
+	qclass, ok := dns.StringToClass[entry.QClass]
+	if !ok {
+		return nil, fmt.Errorf("unknown question class %q", entry.QClass)
+	}
+
+	m = &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   dns.Fqdn(entry.QHost),
+			Qtype:  qtype,
+			Qclass: qclass,
+		}},
+	}
+
+	if entry.ReqECS == "" {
+		return m, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(entry.ReqECS)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ecs: %w", err)
+	}
+
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+	if subnet.IP.To4() == nil {
+		ecs.Family = 2
+	}
+
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, ecs)
+
+	return m, nil
+}
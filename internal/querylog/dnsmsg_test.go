@@ -0,0 +1,129 @@
+package querylog
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgToJSON(t *testing.T) {
+	m := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	m.Response = true
+	m.Rcode = dns.RcodeBadKey
+	m.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    10,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+	m.SetEdns0(4096, true)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+		Code: dns.EDNS0NSID,
+		Nsid: "6162",
+	})
+
+	packed, err := m.Pack()
+	require.NoError(t, err)
+
+	unpacked := &dns.Msg{}
+	require.NoError(t, unpacked.Unpack(packed))
+
+	mj := msgToJSON(unpacked, len(packed))
+	require.NotNil(t, mj)
+
+	assert.Equal(t, len(packed), mj.Size)
+	assert.True(t, mj.Header.Response)
+	assert.Equal(t, "BADKEY", mj.Header.Rcode)
+
+	require.Len(t, mj.Question, 1)
+	assert.Equal(t, &msgQuestionJSON{
+		Name:  "example.org.",
+		Type:  "A",
+		Class: "IN",
+	}, mj.Question[0])
+
+	require.Len(t, mj.Answer, 1)
+	assert.Equal(t, &msgRRJSON{
+		Name:  "example.org.",
+		Type:  "A",
+		Class: "IN",
+		Data:  "1.2.3.4",
+		TTL:   10,
+	}, mj.Answer[0])
+
+	assert.Empty(t, mj.Authority)
+	assert.Empty(t, mj.Additional)
+
+	require.NotNil(t, mj.EDNS)
+	assert.True(t, mj.EDNS.DNSSECOK)
+	assert.Equal(t, uint16(4096), mj.EDNS.UDPSize)
+
+	require.Len(t, mj.EDNS.Options, 1)
+	assert.Equal(t, "NSID", mj.EDNS.Options[0].Name)
+	assert.Equal(t, "6162", mj.EDNS.Options[0].Data)
+}
+
+func TestQuestionMsg(t *testing.T) {
+	m, err := questionMsg(&logEntry{
+		QHost:  "example.org",
+		QType:  "AAAA",
+		QClass: "IN",
+		ReqECS: "1.2.3.0/24",
+	})
+	require.NoError(t, err)
+
+	require.Len(t, m.Question, 1)
+	assert.Equal(t, "example.org.", m.Question[0].Name)
+	assert.Equal(t, dns.TypeAAAA, m.Question[0].Qtype)
+
+	opt := m.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+
+	ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+	require.True(t, ok)
+
+	assert.Equal(t, uint8(24), ecs.SourceNetmask)
+	assert.Equal(t, net.IP{1, 2, 3, 0}, ecs.Address.To4())
+
+	_, err = questionMsg(&logEntry{QHost: "example.org", QType: "BAD", QClass: "IN"})
+	assert.Error(t, err)
+}
+
+func TestQueryLog_findEntry(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "file.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer(true))
+	addEntry(l, "memory.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 2)
+
+	for _, want := range entries {
+		e, err := l.findEntry(want.Time.UnixNano())
+		require.NoError(t, err)
+		require.NotNil(t, e)
+
+		assert.Equal(t, want.QHost, e.QHost)
+	}
+
+	e, err := l.findEntry(entries[0].Time.UnixNano() + 1)
+	require.NoError(t, err)
+
+	assert.Nil(t, e)
+}
@@ -0,0 +1,52 @@
+package querylog
+
+import "fmt"
+
+// DNSSECStatus is the status of the DNSSEC validation of the response by the
+// upstream.
+type DNSSECStatus string
+
+// DNSSECStatus values.
+const (
+	// DNSSECStatusNone means that the validation hasn't been requested, for
+	// example, since DNSSEC is disabled, or the response hasn't been received
+	// from the upstream.
+	DNSSECStatusNone DNSSECStatus = ""
+
+	// DNSSECStatusSecure means that the response has been validated, that is,
+	// it has the AD bit set.
+	DNSSECStatusSecure DNSSECStatus = "secure"
+
+	// DNSSECStatusInsecure means that the validation has been requested, but
+	// the response isn't authenticated, for example, since the zone isn't
+	// signed.
+	DNSSECStatusInsecure DNSSECStatus = "insecure"
+
+	// DNSSECStatusBogus means that the validation has failed, which the
+	// upstream has reported with an extended DNS error.
+	DNSSECStatusBogus DNSSECStatus = "bogus"
+)
+
+// newDNSSECStatus returns s as a DNSSECStatus or an error if it isn't a valid
+// status of a validated response.
+func newDNSSECStatus(s string) (st DNSSECStatus, err error) {
+	switch st = DNSSECStatus(s); st {
+	case DNSSECStatusSecure, DNSSECStatusInsecure, DNSSECStatusBogus:
+		return st, nil
+	default:
+		return "", fmt.Errorf("invalid dnssec status %q", s)
+	}
+}
+
+// dnssecStatus returns the status of the DNSSEC validation of the entry's
+// response.  The entries written by the previous versions only have the AD
+// bit.
+func (e *logEntry) dnssecStatus() (st DNSSECStatus) {
+	if e.DNSSEC != DNSSECStatusNone {
+		return e.DNSSEC
+	} else if e.AuthenticatedData {
+		return DNSSECStatusSecure
+	}
+
+	return DNSSECStatusNone
+}
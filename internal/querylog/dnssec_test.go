@@ -0,0 +1,44 @@
+package querylog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEntry_dnssecStatus(t *testing.T) {
+	testCases := []struct {
+		entry *logEntry
+		name  string
+		want  DNSSECStatus
+	}{{
+		entry: &logEntry{},
+		name:  "none",
+		want:  DNSSECStatusNone,
+	}, {
+		entry: &logEntry{DNSSEC: DNSSECStatusBogus},
+		name:  "bogus",
+		want:  DNSSECStatusBogus,
+	}, {
+		entry: &logEntry{DNSSEC: DNSSECStatusInsecure},
+		name:  "insecure",
+		want:  DNSSECStatusInsecure,
+	}, {
+		entry: &logEntry{AuthenticatedData: true},
+		name:  "previous_version_ad",
+		want:  DNSSECStatusSecure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.entry.dnssecStatus())
+
+			c := &searchCriterion{
+				criterionType: ctDNSSECStatus,
+				value:         string(tc.want),
+				strict:        true,
+			}
+			assert.True(t, c.match(tc.entry))
+		})
+	}
+}
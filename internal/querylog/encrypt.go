@@ -0,0 +1,303 @@
+package querylog
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// encryptionKeySize is the size of the AES-256 key encrypting the records.
+	encryptionKeySize = 32
+
+	// encryptionSaltSize is the size of the salt of the key derived from the
+	// passphrase.
+	encryptionSaltSize = 16
+
+	// encryptionSaltFileName is the name of the file with the salt of the key
+	// derived from the passphrase.
+	encryptionSaltFileName = "querylog.salt"
+)
+
+// The scrypt parameters recommended for the interactive logins as of 2017.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// encryptedStorage is a [Storage] encrypting the records with AES-GCM.  The
+// encrypted records keep the time in plain text, so that the rotation, the
+// indexes, and the repair work as usual:
+//
+//	{"T":"2022-11-01T12:00:00.123Z","E":"<base64 of the nonce and ciphertext>"}
+//
+// The time is also authenticated as the additional data.  The plain text
+// records written before the encryption has been enabled are read as is.
+type encryptedStorage struct {
+	Storage
+
+	// aead encrypts and decrypts the records.  It's nil if err is not nil.
+	aead cipher.AEAD
+
+	// err is the error of loading the key.  If it's not nil, appending fails
+	// with it, since the records must not be stored in plain text, and only
+	// the plain text records are read.
+	err error
+}
+
+// type check
+var _ repairingStorage = (*encryptedStorage)(nil)
+
+// newEncryptedStorage returns s encrypting the records with key.  If err is not
+// nil, the storage fails to append any records with it.
+func newEncryptedStorage(s Storage, key []byte, err error) (es *encryptedStorage) {
+	es = &encryptedStorage{
+		Storage: s,
+		err:     err,
+	}
+
+	if err != nil {
+		return es
+	}
+
+	switch s.(type) {
+	case *fileStorage, *dailyStorage:
+		// Go on.
+	default:
+		es.err = errors.Error("the storage backend doesn't support encryption")
+
+		return es
+	}
+
+	block, err := aes.NewCipher(key)
+	if err == nil {
+		es.aead, err = cipher.NewGCM(block)
+	}
+
+	if err != nil {
+		es.err = fmt.Errorf("initializing cipher: %w", err)
+	}
+
+	return es
+}
+
+// seal returns the encrypted record rec.
+func (s *encryptedStorage) seal(rec []byte) (enc []byte, err error) {
+	ts := readJSONValue(string(rec), `"T":"`)
+	if ts == "" {
+		return nil, errors.Error("no time in record")
+	}
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(rec)+s.aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, rec, []byte(ts))
+
+	buf := &bytes.Buffer{}
+	buf.Grow(len(`{"T":"","E":""}`) + len(ts) + base64.StdEncoding.EncodedLen(len(sealed)))
+	buf.WriteString(`{"T":"`)
+	buf.WriteString(ts)
+	buf.WriteString(`","E":"`)
+	buf.WriteString(base64.StdEncoding.EncodeToString(sealed))
+	buf.WriteString(`"}`)
+
+	return buf.Bytes(), nil
+}
+
+// open returns the decrypted record rec.  The plain text records are returned
+// as is.
+func (s *encryptedStorage) open(rec string) (plain string, err error) {
+	enc := readJSONValue(rec, `"E":"`)
+	if enc == "" {
+		return rec, nil
+	} else if s.aead == nil {
+		return "", errors.Error("no key")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", fmt.Errorf("decoding: %w", err)
+	}
+
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.Error("record is too short")
+	}
+
+	ts := readJSONValue(rec, `"T":"`)
+	b, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(ts))
+	if err != nil {
+		return "", fmt.Errorf("decrypting: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// Append implements the [Storage] interface for *encryptedStorage.
+func (s *encryptedStorage) Append(records [][]byte) (err error) {
+	if s.err != nil {
+		return fmt.Errorf("encrypting: %w", s.err)
+	}
+
+	encRecords := make([][]byte, 0, len(records))
+	for _, rec := range records {
+		var enc []byte
+		enc, err = s.seal(rec)
+		if err != nil {
+			return fmt.Errorf("encrypting: %w", err)
+		}
+
+		encRecords = append(encRecords, enc)
+	}
+
+	return s.Storage.Append(encRecords)
+}
+
+// Iterate implements the [Storage] interface for *encryptedStorage.  The
+// records, which can't be decrypted, for example since they've been encrypted
+// with another key, are skipped.
+func (s *encryptedStorage) Iterate(olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+	return s.Storage.Iterate(olderThan, func(rec string) (cont bool) {
+		plain, oerr := s.open(rec)
+		if oerr != nil {
+			log.Debug("querylog: skipping record: %s", oerr)
+
+			return true
+		}
+
+		return f(plain)
+	})
+}
+
+// Repair implements the [repairingStorage] interface for *encryptedStorage.
+// The encrypted records are checked and sorted by their plain text times.
+func (s *encryptedStorage) Repair(dryRun bool) (reports []*repairReport, err error) {
+	rs, ok := s.Storage.(repairingStorage)
+	if !ok {
+		return nil, errors.Error("repairing is not supported by the backend")
+	}
+
+	return rs.Repair(dryRun)
+}
+
+// Prune implements the [pruningStorage] interface for *encryptedStorage.  It
+// does nothing if the underlying storage doesn't need pruning.
+func (s *encryptedStorage) Prune(ivl time.Duration) (err error) {
+	if ps, ok := s.Storage.(pruningStorage); ok {
+		return ps.Prune(ivl)
+	}
+
+	return nil
+}
+
+// Sync implements the [syncingStorage] interface for *encryptedStorage.  It
+// does nothing if the underlying storage doesn't need syncing.
+func (s *encryptedStorage) Sync() (err error) {
+	if ss, ok := s.Storage.(syncingStorage); ok {
+		return ss.Sync()
+	}
+
+	return nil
+}
+
+// loadEncryptionKey returns the key encrypting the stored records read from the
+// key file or derived from the passphrase of conf.  key is nil if the
+// encryption isn't configured.
+func loadEncryptionKey(conf *Config) (key []byte, err error) {
+	switch {
+	case conf.EncryptionKeyFile != "":
+		return readEncryptionKeyFile(conf.EncryptionKeyFile)
+	case conf.EncryptionPassphrase != "":
+		var salt []byte
+		salt, err = loadEncryptionSalt(filepath.Join(conf.BaseDir, encryptionSaltFileName))
+		if err != nil {
+			return nil, fmt.Errorf("loading salt: %w", err)
+		}
+
+		return scrypt.Key([]byte(conf.EncryptionPassphrase), salt, scryptN, scryptR, scryptP, encryptionKeySize)
+	default:
+		return nil, nil
+	}
+}
+
+// readEncryptionKeyFile reads the hex-encoded key from the file at path.
+func readEncryptionKeyFile(path string) (key []byte, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	key, err = hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key file: %w", err)
+	} else if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("key file: bad key size %d, want %d", len(key), encryptionKeySize)
+	}
+
+	return key, nil
+}
+
+// loadEncryptionSalt reads the salt from the file at path, creating the file
+// with the new random salt if there is none.
+func loadEncryptionSalt(path string) (salt []byte, err error) {
+	salt, err = os.ReadFile(path)
+	if err == nil {
+		if len(salt) != encryptionSaltSize {
+			return nil, fmt.Errorf("bad salt size %d, want %d", len(salt), encryptionSaltSize)
+		}
+
+		return salt, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	salt = make([]byte, encryptionSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("generating: %w", err)
+	}
+
+	err = os.WriteFile(path, salt, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("writing: %w", err)
+	}
+
+	return salt, nil
+}
+
+// encryptStorage returns s wrapped into the encrypting storage, if the
+// encryption is configured.
+func (l *queryLog) encryptStorage(s Storage) (es Storage) {
+	key, err := loadEncryptionKey(l.conf)
+	if err != nil {
+		err = fmt.Errorf("loading encryption key: %w", err)
+	} else if key == nil {
+		return s
+	}
+
+	enc := newEncryptedStorage(s, key, err)
+	if enc.err != nil {
+		log.Error("querylog: encryption: %s, not writing to the storage", enc.err)
+	}
+
+	if l.conf.ClientRetention > 0 {
+		log.Info("querylog: warning: client retention isn't supported with encryption")
+	}
+
+	return enc
+}
@@ -0,0 +1,80 @@
+package querylog
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_encryption(t *testing.T) {
+	dir := t.TempDir()
+	newLog := func(passphrase string) (l *queryLog) {
+		return newQueryLog(Config{
+			Enabled:              true,
+			FileEnabled:          true,
+			RotationIvl:          timeutil.Day,
+			MemSize:              100,
+			BaseDir:              dir,
+			EncryptionPassphrase: passphrase,
+		})
+	}
+
+	// Write a plain text record before enabling the encryption.
+	l := newLog("")
+	addEntry(l, "plain.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	l = newLog("secret")
+	require.IsType(t, (*encryptedStorage)(nil), l.storage)
+
+	addEntry(l, "encrypted.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	data, err := os.ReadFile(filepath.Join(dir, queryLogFileName))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	assert.Contains(t, lines[0], "plain.example")
+	assert.NotContains(t, lines[1], "encrypted.example")
+	assert.NotZero(t, readQLogTimestamp(lines[1]))
+
+	hosts := func(l *queryLog) (hs []string) {
+		entries, _ := l.search(newSearchParams())
+		for _, e := range entries {
+			hs = append(hs, e.QHost)
+		}
+
+		return hs
+	}
+
+	assert.Equal(t, []string{"encrypted.example", "plain.example"}, hosts(newLog("secret")))
+
+	t.Run("wrong_passphrase", func(t *testing.T) {
+		assert.Equal(t, []string{"plain.example"}, hosts(newLog("wrong")))
+	})
+
+	t.Run("bad_key_file", func(t *testing.T) {
+		keyPath := filepath.Join(t.TempDir(), "key")
+		require.NoError(t, os.WriteFile(keyPath, []byte("abcd\n"), 0o600))
+
+		bad := newQueryLog(Config{
+			Enabled:           true,
+			FileEnabled:       true,
+			RotationIvl:       timeutil.Day,
+			MemSize:           100,
+			BaseDir:           dir,
+			EncryptionKeyFile: keyPath,
+		})
+
+		addEntry(bad, "lost.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+		assert.Error(t, bad.flushToStorage(bad.buffer.Slice()))
+	})
+}
@@ -0,0 +1,76 @@
+package querylog
+
+import (
+	"fmt"
+	"time"
+)
+
+// idCollisionWindow is the maximum difference between the time of a new entry
+// and the time of the previous one, within which the new entry is considered
+// to be made before or at the same time as the previous one only because of
+// the clock precision.  Larger differences are caused by the clock
+// adjustments, so the times of such entries are kept.
+const idCollisionWindow = 1 * time.Second
+
+// id returns the stable identifier of the entry, which is its time in Unix
+// nanoseconds.  The times of the entries are made unique when they're added to
+// the log, so the identifier is the same for the entry in memory and in the
+// storage.
+func (e *logEntry) id() (id int64) {
+	return e.Time.UnixNano()
+}
+
+// uniqueTime returns t or, if it's not after the time of the previous entry
+// added to the log, the nanosecond after the previous one, so that the
+// identifiers of the entries don't collide.
+func (l *queryLog) uniqueTime(t time.Time) (ut time.Time) {
+	l.idLock.Lock()
+	defer l.idLock.Unlock()
+
+	ut = nextUniqueTime(l.lastTime, t)
+	l.lastTime = ut
+
+	return ut
+}
+
+// nextUniqueTime returns t or the nanosecond after prev, if t isn't after prev
+// within idCollisionWindow.
+func nextUniqueTime(prev, t time.Time) (ut time.Time) {
+	if t.After(prev) || prev.Sub(t) >= idCollisionWindow {
+		return t
+	}
+
+	return prev.Add(time.Nanosecond)
+}
+
+// findEntry returns the log entry with the identifier id, if any.  It looks in
+// the in-memory buffer first.
+func (l *queryLog) findEntry(id int64) (e *logEntry, err error) {
+	for _, be := range l.memorySnapshot() {
+		if be.id() == id {
+			e = &logEntry{}
+			*e = *be
+
+			return e, nil
+		}
+	}
+
+	err = l.storage.Iterate(time.Unix(0, id+1), func(rec string) (cont bool) {
+		ts := readQLogTimestamp(rec)
+		if ts < id {
+			return false
+		} else if ts != id {
+			return true
+		}
+
+		e = &logEntry{}
+		decodeLogEntry(e, rec)
+
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("iterating storage: %w", err)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,153 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextUniqueTime(t *testing.T) {
+	prev := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		t    time.Time
+		want time.Time
+		name string
+	}{{
+		t:    prev.Add(time.Millisecond),
+		want: prev.Add(time.Millisecond),
+		name: "later",
+	}, {
+		t:    prev,
+		want: prev.Add(time.Nanosecond),
+		name: "same",
+	}, {
+		t:    prev.Add(-time.Millisecond),
+		want: prev.Add(time.Nanosecond),
+		name: "earlier",
+	}, {
+		t:    prev.Add(-time.Hour),
+		want: prev.Add(-time.Hour),
+		name: "clock_adjusted",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, nextUniqueTime(prev, tc.t))
+		})
+	}
+}
+
+func TestQueryLog_entryID(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	// Make the entries look like they're made at the same nanosecond as the
+	// previous one.
+	l.lastTime = time.Now().Add(time.Millisecond)
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 2)
+
+	memIDs := []int64{entries[1].id(), entries[0].id()}
+	require.Equal(t, memIDs[0]+1, memIDs[1])
+
+	// The identifiers are the same after the entries are written.
+	require.NoError(t, l.flushLogBuffer(true))
+
+	for i, host := range []string{"first.example", "second.example"} {
+		e, err := l.findEntry(memIDs[i])
+		require.NoError(t, err)
+		require.NotNil(t, e)
+
+		assert.Equal(t, host, e.QHost)
+		assert.Equal(t, memIDs[i], e.id())
+	}
+
+	e, err := l.findEntry(memIDs[1] + 1)
+	require.NoError(t, err)
+
+	assert.Nil(t, e)
+}
+
+func TestQueryLog_handleQueryLogEntryByID(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 1)
+
+	id := strconv.FormatInt(entries[0].id(), 10)
+
+	testCases := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{{
+		name:       "found",
+		path:       entryPathPrefix + id,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "not_found",
+		path:       entryPathPrefix + "1",
+		wantStatus: http.StatusNotFound,
+	}, {
+		name:       "bad_id",
+		path:       entryPathPrefix + "bad",
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "empty_id",
+		path:       entryPathPrefix,
+		wantStatus: http.StatusNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			l.handleQueryLogEntryByID(w, r)
+			require.Equal(t, tc.wantStatus, w.Code)
+
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			resp := &struct {
+				Entry    map[string]any `json:"entry"`
+				Question *msgJSON       `json:"question"`
+				Answer   *msgJSON       `json:"answer"`
+			}{}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+			assert.Equal(t, id, resp.Entry["id"])
+			assert.Equal(t, "upstream", resp.Entry["upstream"])
+
+			require.NotNil(t, resp.Question)
+			require.NotNil(t, resp.Answer)
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package querylog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// exportFormat is the format of the exported query log.
+type exportFormat string
+
+// Supported export formats.
+const (
+	exportFormatCSV     exportFormat = "csv"
+	exportFormatNDJSON  exportFormat = "ndjson"
+	exportFormatParquet exportFormat = "parquet"
+)
+
+// exportEntry is a log entry with the packed DNS messages decoded into readable
+// fields.
+type exportEntry struct {
+	// t is the parsed time of the entry.
+	t time.Time
+
+	Time        string       `json:"time"`
+	Client      string       `json:"client"`
+	ClientID    string       `json:"client_id,omitempty"`
+	ClientProto ClientProto  `json:"client_proto"`
+	QName       string       `json:"qname"`
+	QType       string       `json:"qtype"`
+	QClass      string       `json:"qclass"`
+	Status      string       `json:"status"`
+	Answer      []*dnsAnswer `json:"answer"`
+	Reason      string       `json:"reason"`
+	Rule        string       `json:"rule,omitempty"`
+	Upstream    string       `json:"upstream,omitempty"`
+	FilterID    int64        `json:"filter_id,omitempty"`
+	ElapsedMs   float64      `json:"elapsed_ms"`
+	Repeats     uint32       `json:"repeats,omitempty"`
+	Cached      bool         `json:"cached"`
+}
+
+// exportCSVHeader is the header row of the exported CSV.  The order of the
+// columns must be the same as in [exportEntry.csvRecord].
+var exportCSVHeader = []string{
+	"time",
+	"client",
+	"client_id",
+	"client_proto",
+	"qname",
+	"qtype",
+	"qclass",
+	"status",
+	"answer",
+	"reason",
+	"rule",
+	"filter_id",
+	"upstream",
+	"elapsed_ms",
+	"cached",
+}
+
+// answerString returns the answers of e joined with "; ".
+func (e *exportEntry) answerString() (s string) {
+	answers := make([]string, 0, len(e.Answer))
+	for _, a := range e.Answer {
+		answers = append(answers, fmt.Sprintf("%s %s %d", a.Type, a.Value, a.TTL))
+	}
+
+	return strings.Join(answers, "; ")
+}
+
+// csvRecord returns the CSV row of e.  The answers are joined with "; ".
+func (e *exportEntry) csvRecord() (rec []string) {
+	var filterID string
+	if e.FilterID != 0 {
+		filterID = strconv.FormatInt(e.FilterID, 10)
+	}
+
+	return []string{
+		e.Time,
+		e.Client,
+		e.ClientID,
+		string(e.ClientProto),
+		e.QName,
+		e.QType,
+		e.QClass,
+		e.Status,
+		e.answerString(),
+		e.Reason,
+		e.Rule,
+		filterID,
+		e.Upstream,
+		strconv.FormatFloat(e.ElapsedMs, 'f', -1, 64),
+		strconv.FormatBool(e.Cached),
+	}
+}
+
+// newExportEntry converts the log entry into the exported one.  The client's IP
+// address is processed with anonFunc.
+func newExportEntry(entry *logEntry, anonFunc aghnet.IPMutFunc) (e *exportEntry) {
+	ip := netutil.CloneIP(entry.IP)
+	anonFunc(ip)
+
+	e = &exportEntry{
+		t:           entry.Time,
+		Time:        entry.Time.Format(time.RFC3339Nano),
+		Client:      ip.String(),
+		ClientID:    entry.ClientID,
+		ClientProto: entry.ClientProto,
+		QName:       entry.QHost,
+		QType:       entry.QType,
+		QClass:      entry.QClass,
+		Reason:      entry.Result.Reason.String(),
+		Upstream:    entry.Upstream,
+		ElapsedMs:   entry.Elapsed.Seconds() * 1000,
+		Repeats:     entry.Repeats,
+		Cached:      entry.Cached,
+	}
+
+	if len(entry.Result.Rules) > 0 {
+		r := entry.Result.Rules[0]
+		e.Rule, e.FilterID = r.Text, r.FilterListID
+	}
+
+	e.Status = entry.responseCode()
+	e.Answer = entry.answers()
+
+	return e
+}
+
+// exportEntries calls f for each log entry made within [from, to), from newer
+// to older, including the ones not written to the storage yet.  Zero from or to
+// means no bound.  It stops at the first error returned by f.
+func (l *queryLog) exportEntries(from, to time.Time, f func(e *logEntry) (err error)) (err error) {
+	inWindow := func(t time.Time) (ok bool) {
+		return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+	}
+
+	// The in-memory entries are newer than the ones in the storage.
+	snapshot := l.memorySnapshot()
+	for i := len(snapshot) - 1; i >= 0; i-- {
+		if e := snapshot[i]; inWindow(e.Time) {
+			if err = f(e); err != nil {
+				return err
+			}
+		}
+	}
+
+	iterErr := l.storage.Iterate(to, func(rec string) (cont bool) {
+		e := &logEntry{}
+		decodeLogEntry(e, rec)
+		if !from.IsZero() && e.Time.Before(from) {
+			return false
+		}
+
+		err = f(e)
+
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return iterErr
+}
+
+// parseExportTime parses the optional time query parameter name.
+func parseExportTime(r *http.Request, name string) (t time.Time, err error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err = time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing %s: %w", name, err)
+	}
+
+	return t, nil
+}
+
+// handleQueryLogExport is the handler for the GET /control/querylog_export HTTP
+// API.  It streams the log entries within the requested time window in the
+// requested format.
+func (l *queryLog) handleQueryLogExport(w http.ResponseWriter, r *http.Request) {
+	format := exportFormat(r.URL.Query().Get("format"))
+	if format == "" {
+		format = exportFormatCSV
+	}
+
+	var contType string
+	switch format {
+	case exportFormatCSV:
+		contType = "text/csv"
+	case exportFormatNDJSON:
+		contType = "application/x-ndjson"
+	case exportFormatParquet:
+		contType = "application/vnd.apache.parquet"
+	default:
+		aghhttp.Error(r, w, http.StatusBadRequest, "unsupported format %q", format)
+
+		return
+	}
+
+	from, err := parseExportTime(r, "from")
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	to, err := parseExportTime(r, "to")
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	h := w.Header()
+	h.Set(aghhttp.HdrNameContentType, contType)
+	h.Set(aghhttp.HdrNameContentDisposition, fmt.Sprintf(`attachment; filename="querylog.%s"`, format))
+
+	anonFunc := l.anonymizer.Load()
+	clients := clientsFilterFromContext(r.Context())
+
+	var write func(e *exportEntry) (err error)
+	var flush func() (err error)
+	switch format {
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		write = func(e *exportEntry) (err error) { return cw.Write(e.csvRecord()) }
+		flush = func() (err error) {
+			cw.Flush()
+
+			return cw.Error()
+		}
+
+		err = cw.Write(exportCSVHeader)
+	case exportFormatParquet:
+		pw := newParquetWriter(w, l.conf.CompressionLevel)
+		write = pw.write
+		flush = pw.close
+	default:
+		enc := json.NewEncoder(w)
+		write = func(e *exportEntry) (err error) { return enc.Encode(e) }
+		flush = func() (err error) { return nil }
+	}
+
+	if err == nil {
+		err = l.exportEntries(from, to, func(e *logEntry) (err error) {
+			if clients != nil && !clients.match(e) {
+				return nil
+			}
+
+			return write(newExportEntry(e, anonFunc))
+		})
+	}
+
+	err = errors.WithDeferred(err, flush())
+	if err != nil {
+		// The response has probably been partially written already, so just
+		// log the error.
+		log.Error("querylog: exporting: %s", err)
+	}
+}
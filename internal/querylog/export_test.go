@@ -0,0 +1,117 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_handleQueryLogExport(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	// Keep the newest entry in memory.
+	addEntry(l, "third.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 3)
+
+	export := func(t *testing.T, q url.Values) (rw *httptest.ResponseRecorder) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog_export?"+q.Encode(), nil)
+		rw = httptest.NewRecorder()
+		l.handleQueryLogExport(rw, r)
+
+		return rw
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		rw := export(t, url.Values{"format": []string{"csv"}})
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		assert.Equal(t, "text/csv", rw.Header().Get("Content-Type"))
+
+		recs, err := csv.NewReader(rw.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, recs, 4)
+
+		assert.Equal(t, exportCSVHeader, recs[0])
+		assert.Equal(t, []string{"third.example", "A", "NOERROR", "A 1.1.1.3 0"}, []string{
+			recs[1][4],
+			recs[1][5],
+			recs[1][7],
+			recs[1][8],
+		})
+		assert.Equal(t, "2.2.2.3", recs[1][1])
+		assert.Equal(t, "second.example", recs[2][4])
+		assert.Equal(t, "first.example", recs[3][4])
+	})
+
+	t.Run("ndjson_window", func(t *testing.T) {
+		rw := export(t, url.Values{
+			"format": []string{"ndjson"},
+			"from":   []string{entries[1].Time.Format(time.RFC3339Nano)},
+			"to":     []string{entries[0].Time.Format(time.RFC3339Nano)},
+		})
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		var got []*exportEntry
+		sc := bufio.NewScanner(rw.Body)
+		for sc.Scan() {
+			e := &exportEntry{}
+			require.NoError(t, json.Unmarshal(sc.Bytes(), e))
+
+			got = append(got, e)
+		}
+		require.NoError(t, sc.Err())
+		require.Len(t, got, 1)
+
+		assert.Equal(t, "second.example", got[0].QName)
+		require.Len(t, got[0].Answer, 1)
+
+		assert.Equal(t, "1.1.1.2", got[0].Answer[0].Value)
+	})
+
+	t.Run("parquet", func(t *testing.T) {
+		rw := export(t, url.Values{"format": []string{"parquet"}})
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		assert.Equal(t, "application/vnd.apache.parquet", rw.Header().Get("Content-Type"))
+
+		data := rw.Body.Bytes()
+		require.Greater(t, len(data), 2*len(parquetMagic))
+
+		assert.Equal(t, parquetMagic, string(data[:len(parquetMagic)]))
+		assert.Equal(t, parquetMagic, string(data[len(data)-len(parquetMagic):]))
+	})
+
+	t.Run("bad_format", func(t *testing.T) {
+		rw := export(t, url.Values{"format": []string{"xml"}})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("bad_time", func(t *testing.T) {
+		rw := export(t, url.Values{"from": []string{"yesterday"}})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+}
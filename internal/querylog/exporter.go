@@ -0,0 +1,434 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// ExporterKind is the kind of the data store the entries are exported into.
+type ExporterKind string
+
+// Supported exporter kinds.
+const (
+	// ExporterKindClickHouse inserts the entries into a ClickHouse table using
+	// its HTTP interface and the JSONEachRow format.
+	ExporterKindClickHouse ExporterKind = "clickhouse"
+
+	// ExporterKindElasticsearch indexes the entries into an Elasticsearch
+	// index using its bulk API.
+	ExporterKindElasticsearch ExporterKind = "elasticsearch"
+)
+
+// Default exporter parameters.
+const (
+	defaultExporterBatchSize  = 1000
+	defaultExporterFlushIvl   = 10 * time.Second
+	defaultExporterMaxRetries = 5
+)
+
+// ExporterConfig is the configuration of exporting the query log entries into
+// an external data store in batches.
+type ExporterConfig struct {
+	// Kind is the kind of the data store.
+	Kind ExporterKind `yaml:"kind"`
+
+	// URL is the base URL of the HTTP API of the data store, for example
+	// "http://localhost:8123" for ClickHouse.
+	URL string `yaml:"url"`
+
+	// Username and Password are the credentials for the HTTP basic
+	// authentication.  If Username is empty, no authentication is used.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Table is the name of the ClickHouse table or of the Elasticsearch
+	// index.
+	Table string `yaml:"table"`
+
+	// BatchSize is the maximum number of entries sent at once.  If zero,
+	// defaultExporterBatchSize is used.
+	BatchSize int `yaml:"batch_size"`
+
+	// FlushInterval is the maximum time the entries wait in the incomplete
+	// batch.  If zero, defaultExporterFlushIvl is used.
+	FlushInterval timeutil.Duration `yaml:"flush_interval"`
+
+	// MaxRetries is the maximum number of attempts to resend a failed batch
+	// before it's dropped.  If zero, defaultExporterMaxRetries is used.
+	MaxRetries int `yaml:"max_retries"`
+
+	// Enabled tells if the entries should be exported.
+	Enabled bool `yaml:"enabled"`
+}
+
+// clickHouseTableRe matches the valid ClickHouse table names, optionally
+// qualified with the database name.  The name is put into the query as is, so
+// it must be strictly validated.
+var clickHouseTableRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// validate returns an error if the enabled configuration isn't valid.
+func (c *ExporterConfig) validate() (err error) {
+	if !c.Enabled {
+		return nil
+	}
+
+	switch c.Kind {
+	case ExporterKindClickHouse:
+		if !clickHouseTableRe.MatchString(c.Table) {
+			return fmt.Errorf("invalid exporter clickhouse table %q", c.Table)
+		}
+	case ExporterKindElasticsearch:
+		if c.Table == "" {
+			return errors.Error("exporter elasticsearch index is empty")
+		}
+	default:
+		return fmt.Errorf("invalid exporter kind %q", c.Kind)
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("exporter url: %w", err)
+	} else if u.Scheme != aghhttp.SchemeHTTP && u.Scheme != aghhttp.SchemeHTTPS {
+		return fmt.Errorf("exporter url: unsupported scheme %q", u.Scheme)
+	}
+
+	switch {
+	case c.BatchSize < 0:
+		return fmt.Errorf("exporter batch size %d is negative", c.BatchSize)
+	case c.FlushInterval.Duration < 0:
+		return fmt.Errorf("exporter flush interval %s is negative", c.FlushInterval)
+	case c.MaxRetries < 0:
+		return fmt.Errorf("exporter max retries %d is negative", c.MaxRetries)
+	default:
+		return nil
+	}
+}
+
+// Exporter sending parameters.
+const (
+	// exporterTimeout is the timeout of a single request to the data store.
+	exporterTimeout = 30 * time.Second
+
+	// exporterQueuedBatches is the number of batches, which may wait in the
+	// queue while the current one is being sent.
+	exporterQueuedBatches = 10
+
+	// exporterRetryMinIvl and exporterRetryMaxIvl are the backoff intervals
+	// of resending a failed batch.
+	exporterRetryMinIvl = 1 * time.Second
+	exporterRetryMaxIvl = 1 * time.Minute
+)
+
+// exporterSink sends the query log entries into an external data store in
+// batches.
+type exporterSink struct {
+	// client is used to send the requests.
+	client *http.Client
+
+	// anonymizer processes the IP addresses of the exported entries.
+	anonymizer *aghnet.IPMut
+
+	// queue contains the entries waiting to be batched.
+	queue chan *logEntry
+
+	// done is closed when the sink is closed.
+	done chan struct{}
+
+	// wg is used to wait for the sending goroutine to finish.
+	wg *sync.WaitGroup
+
+	// conf is the configuration of the exporter.
+	conf *ExporterConfig
+
+	// reqURL is the URL the batches are posted to.
+	reqURL string
+
+	// contType is the content type of the request bodies.
+	contType string
+
+	// flushIvl is the maximum time the entries wait in the incomplete batch.
+	flushIvl time.Duration
+
+	// batchSize is the maximum number of entries sent at once.
+	batchSize int
+
+	// maxRetries is the maximum number of resending attempts.
+	maxRetries int
+
+	// dropped is the number of entries dropped since the last report.  It
+	// must be accessed atomically.
+	dropped uint64
+}
+
+// newExporterSink returns a new exporter sink.  conf must be valid and
+// enabled.
+func newExporterSink(conf *ExporterConfig, anonymizer *aghnet.IPMut) (s *exporterSink) {
+	s = &exporterSink{
+		client:     &http.Client{Timeout: exporterTimeout},
+		anonymizer: anonymizer,
+		done:       make(chan struct{}),
+		wg:         &sync.WaitGroup{},
+		conf:       conf,
+		flushIvl:   conf.FlushInterval.Duration,
+		batchSize:  conf.BatchSize,
+		maxRetries: conf.MaxRetries,
+	}
+
+	if s.batchSize == 0 {
+		s.batchSize = defaultExporterBatchSize
+	}
+
+	if s.flushIvl == 0 {
+		s.flushIvl = defaultExporterFlushIvl
+	}
+
+	if s.maxRetries == 0 {
+		s.maxRetries = defaultExporterMaxRetries
+	}
+
+	s.queue = make(chan *logEntry, s.batchSize*exporterQueuedBatches)
+
+	u, _ := url.Parse(conf.URL)
+	if conf.Kind == ExporterKindClickHouse {
+		q := u.Query()
+		q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", conf.Table))
+
+		// Allow the tables with only some of the exported columns as well as
+		// parse the RFC 3339 times.
+		q.Set("input_format_skip_unknown_fields", "1")
+		q.Set("date_time_input_format", "best_effort")
+		u.RawQuery = q.Encode()
+
+		s.contType = "application/json"
+	} else {
+		u.Path = path.Join("/", u.Path, "_bulk")
+		s.contType = "application/x-ndjson"
+	}
+
+	s.reqURL = u.String()
+
+	return s
+}
+
+// start starts sending the queued entries.
+func (s *exporterSink) start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// close stops sending the entries.  The pending batch is sent once without
+// retrying, the entries still in the queue are discarded.
+func (s *exporterSink) close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// send queues e to be exported.  It never blocks, dropping e if the queue is
+// full.  e must not be modified after that.
+func (s *exporterSink) send(e *logEntry) {
+	select {
+	case s.queue <- e:
+		// Go on.
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// run batches the queued entries and sends them until the sink is closed.
+func (s *exporterSink) run() {
+	defer s.wg.Done()
+	defer log.OnPanic("querylog: exporter")
+
+	ticker := time.NewTicker(s.flushIvl)
+	defer ticker.Stop()
+
+	batch := make([]*logEntry, 0, s.batchSize)
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.done:
+			if len(batch) > 0 {
+				if err := s.export(batch); err != nil {
+					log.Error("querylog: exporter: sending %d entries on close: %s", len(batch), err)
+				}
+			}
+
+			return
+		}
+
+		s.exportWithRetry(batch)
+		batch = batch[:0]
+	}
+}
+
+// exportWithRetry sends batch, retrying with backoff on temporary errors.  The
+// batch is dropped once the retries are exhausted or the sink is closed.
+func (s *exporterSink) exportWithRetry(batch []*logEntry) {
+	ivl := exporterRetryMinIvl
+	for i := 0; ; i++ {
+		err := s.export(batch)
+		if err == nil {
+			break
+		}
+
+		var perr *permanentExportError
+		if i >= s.maxRetries || errors.As(err, &perr) {
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			log.Error("querylog: exporter: sending: %s", err)
+
+			break
+		}
+
+		log.Info("querylog: exporter: sending: %s; retrying in %s", err, ivl)
+
+		select {
+		case <-time.After(ivl):
+			// Go on.
+		case <-s.done:
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+
+			return
+		}
+
+		ivl *= 2
+		if ivl > exporterRetryMaxIvl {
+			ivl = exporterRetryMaxIvl
+		}
+	}
+
+	if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+		log.Info("querylog: exporter: dropped %d entries", dropped)
+	}
+}
+
+// permanentExportError is returned when the data store rejects the batch, so
+// resending it makes no sense.
+type permanentExportError struct {
+	err error
+}
+
+// type check
+var _ error = (*permanentExportError)(nil)
+
+// Error implements the error interface for *permanentExportError.
+func (err *permanentExportError) Error() (msg string) {
+	return err.err.Error()
+}
+
+// Unwrap implements the errors.Wrapper interface for *permanentExportError.
+func (err *permanentExportError) Unwrap() (unwrapped error) {
+	return err.err
+}
+
+// body returns the request body containing the batch.
+func (s *exporterSink) body(batch []*logEntry) (b []byte, err error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+
+	var action any
+	if s.conf.Kind == ExporterKindElasticsearch {
+		action = map[string]any{"index": map[string]string{"_index": s.conf.Table}}
+	}
+
+	anonFunc := s.anonymizer.Load()
+	for _, e := range batch {
+		if action != nil {
+			if err = enc.Encode(action); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = enc.Encode(newExportEntry(e, anonFunc)); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// export sends batch to the data store.
+func (s *exporterSink) export(batch []*logEntry) (err error) {
+	b, err := s.body(batch)
+	if err != nil {
+		return &permanentExportError{err: fmt.Errorf("encoding: %w", err)}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.reqURL, bytes.NewReader(b))
+	if err != nil {
+		return &permanentExportError{err: fmt.Errorf("creating request: %w", err)}
+	}
+
+	req.Header.Set(aghhttp.HdrNameContentType, s.contType)
+	req.Header.Set(aghhttp.HdrNameUserAgent, aghhttp.UserAgent())
+	if s.conf.Username != "" {
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if code := resp.StatusCode; code != http.StatusOK {
+		err = fmt.Errorf("status code %d: %s", code, bytes.TrimSpace(respBody))
+		if code >= http.StatusBadRequest && code < http.StatusInternalServerError &&
+			code != http.StatusTooManyRequests {
+			return &permanentExportError{err: err}
+		}
+
+		return err
+	}
+
+	if s.conf.Kind == ExporterKindElasticsearch {
+		return checkBulkResponse(respBody)
+	}
+
+	return nil
+}
+
+// checkBulkResponse returns an error if the response of the Elasticsearch bulk
+// API reports failures of some of the entries.  Those aren't resent, since the
+// rest of the batch has been indexed.
+func checkBulkResponse(b []byte) (err error) {
+	resp := struct {
+		Errors bool `json:"errors"`
+	}{}
+
+	err = json.Unmarshal(b, &resp)
+	if err != nil {
+		return &permanentExportError{err: fmt.Errorf("decoding response: %w", err)}
+	} else if resp.Errors {
+		return &permanentExportError{err: errors.Error("some entries were not indexed")}
+	}
+
+	return nil
+}
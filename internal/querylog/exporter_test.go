@@ -0,0 +1,215 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporterConfig_validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       ExporterConfig
+		wantErrMsg string
+	}{{
+		name: "disabled",
+		conf: ExporterConfig{
+			Kind: "bad",
+		},
+		wantErrMsg: "",
+	}, {
+		name: "clickhouse",
+		conf: ExporterConfig{
+			Kind:    ExporterKindClickHouse,
+			URL:     "http://localhost:8123",
+			Table:   "dns.querylog",
+			Enabled: true,
+		},
+		wantErrMsg: "",
+	}, {
+		name: "clickhouse_bad_table",
+		conf: ExporterConfig{
+			Kind:    ExporterKindClickHouse,
+			URL:     "http://localhost:8123",
+			Table:   "querylog; DROP TABLE users",
+			Enabled: true,
+		},
+		wantErrMsg: `invalid exporter clickhouse table "querylog; DROP TABLE users"`,
+	}, {
+		name: "elasticsearch_no_index",
+		conf: ExporterConfig{
+			Kind:    ExporterKindElasticsearch,
+			URL:     "https://localhost:9200",
+			Enabled: true,
+		},
+		wantErrMsg: "exporter elasticsearch index is empty",
+	}, {
+		name: "bad_scheme",
+		conf: ExporterConfig{
+			Kind:    ExporterKindElasticsearch,
+			URL:     "ftp://localhost:9200",
+			Table:   "querylog",
+			Enabled: true,
+		},
+		wantErrMsg: `exporter url: unsupported scheme "ftp"`,
+	}, {
+		name: "bad_kind",
+		conf: ExporterConfig{
+			Kind:    "bad",
+			Enabled: true,
+		},
+		wantErrMsg: `invalid exporter kind "bad"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.conf.validate()
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErrMsg)
+			}
+		})
+	}
+}
+
+func TestExporterSink(t *testing.T) {
+	type request struct {
+		path  string
+		query string
+		user  string
+		lines []string
+	}
+
+	reqCh := make(chan *request, 10)
+	var failures int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		req := &request{
+			path:  r.URL.Path,
+			query: r.URL.Query().Get("query"),
+		}
+		req.user, _, _ = r.BasicAuth()
+
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			req.lines = append(req.lines, sc.Text())
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/_bulk") {
+			_, _ = w.Write([]byte(`{"errors":false}`))
+		}
+
+		reqCh <- req
+	}))
+	t.Cleanup(srv.Close)
+
+	testCases := []struct {
+		name      string
+		kind      ExporterKind
+		wantPath  string
+		wantQuery string
+		wantLines int
+		failures  int32
+	}{{
+		name:      "clickhouse",
+		kind:      ExporterKindClickHouse,
+		wantPath:  "/",
+		wantQuery: "INSERT INTO querylog FORMAT JSONEachRow",
+		wantLines: 2,
+		failures:  0,
+	}, {
+		name:      "elasticsearch_retry",
+		kind:      ExporterKindElasticsearch,
+		wantPath:  "/es/_bulk",
+		wantQuery: "",
+		wantLines: 4,
+		failures:  1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&failures, tc.failures)
+
+			u := srv.URL
+			if tc.kind == ExporterKindElasticsearch {
+				u += "/es"
+			}
+
+			s := newExporterSink(&ExporterConfig{
+				Kind:          tc.kind,
+				URL:           u,
+				Username:      "user",
+				Password:      "pass",
+				Table:         "querylog",
+				BatchSize:     2,
+				FlushInterval: timeutil.Duration{Duration: time.Hour},
+				Enabled:       true,
+			}, aghnet.NewIPMut(nil))
+
+			s.start()
+			t.Cleanup(s.close)
+
+			s.send(newSyslogTestEntry())
+			s.send(newSyslogTestEntry())
+
+			var req *request
+			select {
+			case req = <-reqCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no request")
+			}
+
+			assert.Equal(t, tc.wantPath, req.path)
+			assert.Equal(t, tc.wantQuery, req.query)
+			assert.Equal(t, "user", req.user)
+			require.Len(t, req.lines, tc.wantLines)
+
+			e := &exportEntry{}
+			require.NoError(t, json.Unmarshal([]byte(req.lines[len(req.lines)-1]), e))
+
+			assert.Equal(t, "example.org", e.QName)
+			assert.Equal(t, "1.2.3.4", e.Client)
+
+			if tc.kind == ExporterKindElasticsearch {
+				assert.JSONEq(t, `{"index":{"_index":"querylog"}}`, req.lines[0])
+			}
+		})
+	}
+}
+
+func TestExporterSink_export_permanent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "bad table", http.StatusBadRequest)
+	}))
+	t.Cleanup(srv.Close)
+
+	s := newExporterSink(&ExporterConfig{
+		Kind:    ExporterKindClickHouse,
+		URL:     srv.URL,
+		Table:   "querylog",
+		Enabled: true,
+	}, aghnet.NewIPMut(nil))
+
+	err := s.export([]*logEntry{newSyslogTestEntry()})
+	require.Error(t, err)
+
+	var perr *permanentExportError
+	assert.ErrorAs(t, err, &perr)
+	assert.Contains(t, err.Error(), "bad table")
+}
@@ -0,0 +1,158 @@
+package querylog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/idna"
+)
+
+// hashedValueLen is the length of the hashed domain names and ClientIDs in
+// bytes before the hex encoding.
+const hashedValueLen = 16
+
+// newHashKey returns the key used to hash the entries in the hashed mode.  It's
+// the anonymization key, if set, or a newly generated one, so that the entries
+// can only be checked until the restart.
+func newHashKey(anonKey []byte) (key []byte) {
+	if len(anonKey) > 0 {
+		return anonKey
+	}
+
+	log.Info("querylog: warning: no anonymization key, using a temporary one for hashing")
+
+	key = make([]byte, anonymizationKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		// Don't store the entries hashed with the predictable key.
+		log.Error("querylog: generating hash key: %s", err)
+
+		return nil
+	}
+
+	return key
+}
+
+// hashValue returns the hex-encoded truncated HMAC-SHA256 of s with key.
+func hashValue(s string, key []byte) (hashed string) {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(s))
+
+	return hex.EncodeToString(mac.Sum(nil)[:hashedValueLen])
+}
+
+// hashEntry replaces the domain name, the client IP address, and the ClientID
+// of e with their hashes with key and removes the rest of the data revealing
+// the requested domain name or the client, such as the answers, the EDNS Client
+// Subnet, and the texts of the matched rules.  The rest of e is kept for the
+// counters.
+func hashEntry(e *logEntry, key []byte) {
+	e.QHost = hashValue(e.QHost, key)
+	hashIP(e.IP, key)
+	if e.ClientID != "" {
+		e.ClientID = hashValue(e.ClientID, key)
+	}
+
+	e.ReqECS = ""
+	e.Answer, e.OrigAnswer = nil, nil
+	e.Answers, e.OrigAnswers = []*dnsAnswer{}, nil
+
+	res := &e.Result
+	res.CanonName = ""
+	res.IPList = nil
+	res.DNSRewriteResult = nil
+
+	// Don't modify the rules of the caller.
+	rules := make([]*filtering.ResultRule, 0, len(res.Rules))
+	for _, r := range res.Rules {
+		rules = append(rules, &filtering.ResultRule{
+			FilterListID: r.FilterListID,
+		})
+	}
+
+	res.Rules = rules
+}
+
+// hashedDomainResp is the response to the GET /control/querylog/hashed_domain.
+type hashedDomainResp struct {
+	// LastSeen is the time of the latest request for the domain name, if any.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+
+	// Name is the checked domain name.
+	Name string `json:"name"`
+
+	// Hash is the hash of the domain name stored in the query log.
+	Hash string `json:"hash"`
+
+	// Count is the number of the requests for the domain name in the query
+	// log.
+	Count uint64 `json:"count"`
+
+	// Found is true if the domain name appears in the query log.
+	Found bool `json:"found"`
+}
+
+// handleQueryLogHashedDomain handles requests to the GET
+// /control/querylog/hashed_domain endpoint.  It checks if the known domain
+// name appears in the query log stored in the hashed mode.  Only the requests
+// from the clients of the delegated administrator, if any, are counted.
+func (l *queryLog) handleQueryLogHashedDomain(w http.ResponseWriter, r *http.Request) {
+	if !l.conf.Hashed || l.hashKey == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "hashed mode is disabled")
+
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("name"), "."))
+	if name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no name specified")
+
+		return
+	}
+
+	// The domain names are logged in the ASCII form.
+	if ascii, err := idna.ToASCII(name); err == nil {
+		name = ascii
+	}
+
+	resp := &hashedDomainResp{
+		Name: name,
+		Hash: hashValue(name, l.hashKey),
+	}
+
+	params := newSearchParams()
+	params.limit = 0
+	params.clients = clientsFilterFromContext(r.Context())
+	params.searchCriteria = []searchCriterion{{
+		criterionType: ctDomain,
+		value:         resp.Hash,
+		strict:        true,
+	}}
+
+	err := l.searchStream(params, func(e *logEntry) (err error) {
+		if resp.LastSeen == nil {
+			t := e.Time
+			resp.LastSeen = &t
+		}
+
+		resp.Count += 1 + uint64(e.Repeats)
+
+		return nil
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "searching: %s", err)
+
+		return
+	}
+
+	resp.Found = resp.Count > 0
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
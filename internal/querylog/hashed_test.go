@@ -0,0 +1,130 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_hashed(t *testing.T) {
+	key := []byte("test key")
+	l := newQueryLog(Config{
+		AnonymizationKey: key,
+		Enabled:          true,
+		FileEnabled:      true,
+		RotationIvl:      timeutil.Day,
+		MemSize:          100,
+		BaseDir:          t.TempDir(),
+		Hashed:           true,
+	})
+
+	clientIP := net.IP{2, 2, 2, 1}
+	addEntry(l, "example.org", net.IP{1, 1, 1, 1}, clientIP)
+	addEntry(l, "example.org", net.IP{1, 1, 1, 1}, clientIP)
+	addEntry(l, "example.net", net.IP{1, 1, 1, 2}, clientIP)
+
+	ll, _ := l.search(newSearchParams())
+	require.Len(t, ll, 3)
+
+	e := ll[0]
+	assert.Equal(t, hashValue("example.net", key), e.QHost)
+	assert.True(t, hashedNet4.Contains(e.IP))
+	assert.False(t, e.IP.Equal(clientIP))
+	assert.Empty(t, e.Answer)
+	assert.Empty(t, e.OrigAnswer)
+	assert.Empty(t, e.answers())
+	assert.Equal(t, "NOERROR", e.responseCode())
+
+	require.Len(t, e.Result.Rules, 1)
+
+	assert.Empty(t, e.Result.Rules[0].Text)
+	assert.Equal(t, int64(1), e.Result.Rules[0].FilterListID)
+	assert.True(t, e.Result.IsFiltered)
+
+	testCases := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantCount uint64
+		wantFound bool
+	}{{
+		name:      "found",
+		query:     "name=Example.ORG.",
+		wantCode:  http.StatusOK,
+		wantCount: 2,
+		wantFound: true,
+	}, {
+		name:      "not_found",
+		query:     "name=example.com",
+		wantCode:  http.StatusOK,
+		wantCount: 0,
+		wantFound: false,
+	}, {
+		name:      "no_name",
+		query:     "",
+		wantCode:  http.StatusBadRequest,
+		wantCount: 0,
+		wantFound: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/querylog/hashed_domain?"+tc.query, nil)
+			w := httptest.NewRecorder()
+
+			l.handleQueryLogHashedDomain(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			resp := &hashedDomainResp{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantCount, resp.Count)
+			assert.Equal(t, tc.wantFound, resp.Found)
+			assert.Equal(t, tc.wantFound, resp.LastSeen != nil)
+		})
+	}
+
+	t.Run("delegated", func(t *testing.T) {
+		f := NewClientsFilter([]string{"2.2.2.2"})
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog/hashed_domain?name=example.org", nil)
+		r = r.WithContext(WithClientsFilter(r.Context(), f))
+		w := httptest.NewRecorder()
+
+		l.handleQueryLogHashedDomain(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &hashedDomainResp{}
+		err := json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		assert.Zero(t, resp.Count)
+		assert.False(t, resp.Found)
+		assert.Nil(t, resp.LastSeen)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		dl := newQueryLog(Config{
+			Enabled:     true,
+			RotationIvl: timeutil.Day,
+			MemSize:     100,
+			BaseDir:     t.TempDir(),
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog/hashed_domain?name=example.org", nil)
+		w := httptest.NewRecorder()
+
+		dl.handleQueryLogHashedDomain(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
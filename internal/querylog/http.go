@@ -1,6 +1,7 @@
 package querylog
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,15 +15,36 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
 	"golang.org/x/net/idna"
 )
 
 type qlogConfig struct {
 	// Use float64 here to support fractional numbers and not mess the API
 	// users by changing the units.
-	Interval          float64 `json:"interval"`
-	Enabled           bool    `json:"enabled"`
-	AnonymizeClientIP bool    `json:"anonymize_client_ip"`
+	Interval float64 `json:"interval"`
+
+	// AnonymizationMode is the way the clients' IP addresses are anonymized
+	// if AnonymizeClientIP is true.
+	AnonymizationMode AnonymizationMode `json:"anonymization_mode"`
+
+	// IgnoredDomains and IgnoredClients are the domains and the clients,
+	// which queries aren't logged.  See [Config].
+	IgnoredDomains []string `json:"ignored_domains"`
+	IgnoredClients []string `json:"ignored_clients"`
+
+	// FlushInterval is the flush interval in milliseconds.  See [Config].
+	FlushInterval uint64 `json:"flush_interval_ms"`
+
+	// MemSize is the number of entries kept in memory.  See [Config].
+	MemSize uint32 `json:"size_memory"`
+
+	Enabled           bool `json:"enabled"`
+	AnonymizeClientIP bool `json:"anonymize_client_ip"`
+
+	// Hashed tells if the query log is stored in the hashed mode.  It's only
+	// set in the configuration file.  See [Config].
+	Hashed bool `json:"hashed"`
 }
 
 // Register web handlers
@@ -31,6 +53,21 @@ func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_info", l.handleQueryLogInfo)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/hashed_domain", l.handleQueryLogHashedDomain)
+	l.conf.HTTPRegister(http.MethodGet, clientViewPath, l.handleQueryLogClient)
+	l.conf.HTTPRegister(http.MethodGet, entryPathPrefix, l.handleQueryLogEntryByID)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_export", l.handleQueryLogExport)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_jobs", l.handleQueryLogJobs)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_jobs/status", l.handleQueryLogJobStatus)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_jobs/result", l.handleQueryLogJobResult)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_jobs/cancel", l.handleQueryLogJobCancel)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_replay", l.handleQueryLogReplay)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_repair", l.handleQueryLogRepair)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_import", l.handleQueryLogImport)
+
+	// The self-service portal of the client devices.  The clients filter in
+	// the request context restricts it to the queries of the device.
+	l.conf.HTTPRegister(http.MethodGet, "/portal/querylog", l.handleQueryLog)
 }
 
 func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +78,17 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("format") == string(exportFormatNDJSON) {
+		// The limit of the stream is optional.
+		if !r.URL.Query().Has("limit") {
+			params.limit = 0
+		}
+
+		l.streamQueryLog(w, r, params)
+
+		return
+	}
+
 	// search for the log entries
 	entries, oldest := l.search(params)
 
@@ -50,6 +98,106 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	_ = aghhttp.WriteJSONResponse(w, r, data)
 }
 
+// entryDetailJSON is the response to the GET /control/querylog/{id} HTTP API.
+type entryDetailJSON struct {
+	// Entry is the entry in the same format as in the GET /control/querylog
+	// response.
+	Entry jobject `json:"entry"`
+
+	// Question is the question message reconstructed from the entry.
+	Question *msgJSON `json:"question"`
+
+	// Answer is the response sent to the client, if any.
+	Answer *msgJSON `json:"answer,omitempty"`
+
+	// OrigAnswer is the response received from the upstream before it's been
+	// modified by filtering, if any.
+	OrigAnswer *msgJSON `json:"original_answer,omitempty"`
+}
+
+// entryPathPrefix is the prefix of the path of the GET /control/querylog/{id}
+// HTTP API.
+const entryPathPrefix = "/control/querylog/"
+
+// handleQueryLogEntryByID handles requests to the GET /control/querylog/{id}
+// endpoint.
+func (l *queryLog) handleQueryLogEntryByID(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, entryPathPrefix)
+	if id == "" || strings.Contains(id, "/") {
+		aghhttp.Error(r, w, http.StatusNotFound, "no entry with id %q", id)
+
+		return
+	}
+
+	l.serveEntry(w, r, id)
+}
+
+// serveEntry writes the entry with id along with its decoded messages.
+func (l *queryLog) serveEntry(w http.ResponseWriter, r *http.Request, id string) {
+	entryID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing id: %s", err)
+
+		return
+	}
+
+	entry, err := l.findEntry(entryID)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "looking up entry: %s", err)
+
+		return
+	} else if f := clientsFilterFromContext(r.Context()); entry == nil || (f != nil && !f.match(entry)) {
+		aghhttp.Error(r, w, http.StatusNotFound, "no entry with id %q", id)
+
+		return
+	}
+
+	entry.client, err = l.client(entry.ClientID, entry.IP.String(), clientCache{})
+	if err != nil {
+		log.Debug("querylog: enriching entry %q: %s", id, err)
+	}
+
+	resp := &entryDetailJSON{
+		Entry: l.entryToJSON(entry, l.anonymizer.Load()),
+	}
+
+	q, err := questionMsg(entry)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "restoring question: %s", err)
+
+		return
+	}
+
+	qsize := 0
+	if packed, perr := q.Pack(); perr == nil {
+		qsize = len(packed)
+	}
+
+	resp.Question = msgToJSON(q, qsize)
+	resp.Answer = unpackedMsgToJSON(entry.Answer)
+	resp.OrigAnswer = unpackedMsgToJSON(entry.OrigAnswer)
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// unpackedMsgToJSON unpacks the DNS message from data and returns its JSON
+// representation.  It returns nil if data is empty or isn't a valid message.
+func unpackedMsgToJSON(data []byte) (mj *msgJSON) {
+	if len(data) == 0 {
+		return nil
+	}
+
+	m := &dns.Msg{}
+	err := m.Unpack(data)
+	if err != nil {
+		log.Debug("querylog: unpacking message: %s", err)
+
+		return nil
+	}
+
+	return msgToJSON(m, len(data))
+}
+
 func (l *queryLog) handleQueryLogClear(_ http.ResponseWriter, _ *http.Request) {
 	l.clear()
 }
@@ -59,7 +207,17 @@ func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
 	resp := qlogConfig{
 		Enabled:           l.conf.Enabled,
 		Interval:          l.conf.RotationIvl.Hours() / 24,
+		AnonymizationMode: l.conf.AnonymizationMode,
 		AnonymizeClientIP: l.conf.AnonymizeClientIP,
+		IgnoredDomains:    stringutil.CloneSliceOrEmpty(l.conf.IgnoredDomains),
+		IgnoredClients:    stringutil.CloneSliceOrEmpty(l.conf.IgnoredClients),
+		FlushInterval:     uint64(l.conf.FlushInterval.Milliseconds()),
+		MemSize:           l.conf.MemSize,
+		Hashed:            l.conf.Hashed,
+	}
+
+	if resp.AnonymizationMode == "" {
+		resp.AnonymizationMode = AnonymizationModeMask
 	}
 
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
@@ -96,6 +254,51 @@ func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if req.Exists("anonymization_mode") {
+		err = d.AnonymizationMode.validate()
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+			return
+		}
+	}
+
+	hasIgnored := req.Exists("ignored_domains") || req.Exists("ignored_clients")
+	if !req.Exists("ignored_domains") {
+		d.IgnoredDomains = l.conf.IgnoredDomains
+	}
+	if !req.Exists("ignored_clients") {
+		d.IgnoredClients = l.conf.IgnoredClients
+	}
+
+	ignored, err := newIgnoreList(d.IgnoredDomains, d.IgnoredClients)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	hasBuffering := req.Exists("size_memory") || req.Exists("flush_interval_ms")
+	buffering := &Config{
+		MemSize:       l.conf.MemSize,
+		FlushInterval: l.conf.FlushInterval,
+	}
+	if req.Exists("size_memory") {
+		buffering.MemSize = d.MemSize
+	}
+	if req.Exists("flush_interval_ms") {
+		buffering.FlushInterval = time.Duration(d.FlushInterval) * time.Millisecond
+	}
+
+	if hasBuffering {
+		err = buffering.validateBuffering()
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+			return
+		}
+	}
+
 	defer l.conf.ConfigModified()
 
 	l.lock.Lock()
@@ -110,12 +313,25 @@ func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request)
 	if req.Exists("interval") {
 		conf.RotationIvl = ivl
 	}
+	if req.Exists("anonymization_mode") {
+		conf.AnonymizationMode = d.AnonymizationMode
+	}
 	if req.Exists("anonymize_client_ip") {
-		if conf.AnonymizeClientIP = d.AnonymizeClientIP; conf.AnonymizeClientIP {
-			l.anonymizer.Store(AnonymizeIP)
-		} else {
-			l.anonymizer.Store(nil)
-		}
+		conf.AnonymizeClientIP = d.AnonymizeClientIP
+	}
+	if hasIgnored {
+		conf.IgnoredDomains = stringutil.CloneSlice(d.IgnoredDomains)
+		conf.IgnoredClients = stringutil.CloneSlice(d.IgnoredClients)
+		l.ignored.Store(ignored)
+	}
+	if hasBuffering {
+		conf.MemSize, conf.FlushInterval = buffering.MemSize, buffering.FlushInterval
+		l.applyBufferingLocked(&conf)
+	}
+	if conf.AnonymizeClientIP {
+		l.anonymizer.Store(NewAnonymizer(conf.AnonymizationMode, conf.AnonymizationKey))
+	} else {
+		l.anonymizer.Store(nil)
 	}
 	l.conf = &conf
 }
@@ -145,7 +361,7 @@ func (l *queryLog) parseSearchCriterion(q url.Values, name string, ct criterionT
 
 	var asciiVal string
 	switch ct {
-	case ctTerm:
+	case ctTerm, ctDomain:
 		// Decode lowercased value from punycode to make EqualFold and
 		// friends work properly with IDNAs.
 		//
@@ -162,11 +378,42 @@ func (l *queryLog) parseSearchCriterion(q url.Values, name string, ct criterionT
 		if !stringutil.InSlice(filteringStatusValues, val) {
 			return false, sc, fmt.Errorf("invalid value %s", val)
 		}
+	case ctClient:
+		// Go on.
+	case ctQuestionType:
+		val = strings.ToUpper(val)
+		if _, ok = dns.StringToType[val]; !ok {
+			return false, sc, fmt.Errorf("invalid question type %q", val)
+		}
+
+		strict = true
+	case ctResponseCode:
+		val = strings.ToUpper(val)
+		if _, ok = dns.StringToRcode[val]; !ok {
+			return false, sc, fmt.Errorf("invalid response code %q", val)
+		}
+
+		strict = true
+	case ctDNSSECStatus:
+		val = strings.ToLower(val)
+		if _, err = newDNSSECStatus(val); err != nil {
+			return false, sc, err
+		}
+
+		strict = true
 	default:
 		return false, sc, fmt.Errorf(
 			"invalid criterion type %v: should be one of %v",
 			ct,
-			[]criterionType{ctTerm, ctFilteringStatus},
+			[]criterionType{
+				ctTerm,
+				ctFilteringStatus,
+				ctDomain,
+				ctClient,
+				ctQuestionType,
+				ctResponseCode,
+				ctDNSSECStatus,
+			},
 		)
 	}
 
@@ -195,6 +442,10 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 
 	var limit64 int64
 	if limit64, err = strconv.ParseInt(q.Get("limit"), 10, 64); err == nil {
+		if limit64 < 0 || limit64 > maxSearchLimit {
+			return nil, fmt.Errorf("limit: must be in range [0, %d], got %d", maxSearchLimit, limit64)
+		}
+
 		p.limit = int(limit64)
 	}
 
@@ -207,6 +458,18 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 		p.maxFileScanEntries = 0
 	}
 
+	p.searchCriteria, err = l.parseSearchCriteria(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p.clients = clientsFilterFromContext(r.Context())
+
+	return p, nil
+}
+
+// parseSearchCriteria parses the search criteria from the query parameters.
+func (l *queryLog) parseSearchCriteria(q url.Values) (criteria []searchCriterion, err error) {
 	for _, v := range []struct {
 		urlField string
 		ct       criterionType
@@ -216,6 +479,21 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 	}, {
 		urlField: "response_status",
 		ct:       ctFilteringStatus,
+	}, {
+		urlField: "domain",
+		ct:       ctDomain,
+	}, {
+		urlField: "client",
+		ct:       ctClient,
+	}, {
+		urlField: "question_type",
+		ct:       ctQuestionType,
+	}, {
+		urlField: "response_code",
+		ct:       ctResponseCode,
+	}, {
+		urlField: "dnssec_status",
+		ct:       ctDNSSECStatus,
 	}} {
 		var ok bool
 		var c searchCriterion
@@ -225,9 +503,55 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 		}
 
 		if ok {
-			p.searchCriteria = append(p.searchCriteria, c)
+			criteria = append(criteria, c)
 		}
 	}
 
-	return p, nil
+	return criteria, nil
+}
+
+// streamFlushBatch is the number of entries, after writing which the streamed
+// response is flushed to the client.
+const streamFlushBatch = 100
+
+// streamQueryLog writes the log entries matching params as newline-delimited
+// JSON objects, one entry per line, in the same format as the elements of the
+// "data" array of the GET /control/querylog response.  The entries are written
+// as they are read, so the memory use doesn't depend on the number of entries,
+// and the reading is paused while the client doesn't accept the data.
+func (l *queryLog) streamQueryLog(w http.ResponseWriter, r *http.Request, params *searchParams) {
+	w.Header().Set(aghhttp.HdrNameContentType, "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	ctx := r.Context()
+	anonFunc := l.anonymizer.Load()
+	enc := json.NewEncoder(w)
+
+	var n int
+	err := l.searchStream(params, func(e *logEntry) (err error) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		err = enc.Encode(l.entryToJSON(e, anonFunc))
+		if err != nil {
+			return err
+		}
+
+		n++
+		if flusher != nil && n%streamFlushBatch == 0 {
+			flusher.Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		// The status has already been written, so just log the error.
+		log.Debug("querylog: streaming entries: %s", err)
+
+		return
+	}
+
+	log.Debug("querylog: streamed %d entries", n)
 }
@@ -0,0 +1,108 @@
+package querylog
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// ignoreList is the list of the domains and the clients, which queries aren't
+// logged.  A nil *ignoreList ignores nothing.
+type ignoreList struct {
+	// domains are the lowercased patterns of the ignored domain names.
+	domains []string
+
+	// nets are the ignored client subnets.
+	nets []netip.Prefix
+
+	// clients are the patterns of the ignored client IP addresses and
+	// ClientIDs.
+	clients []string
+}
+
+// newIgnoreList returns a new ignore list for the domains and the clients.
+// Both domains and clients may contain the wildcards supported by
+// [path.Match], for example "*.example.org" or "192.168.1.*".  clients may
+// also contain CIDRs.
+func newIgnoreList(domains, clients []string) (il *ignoreList, err error) {
+	if len(domains) == 0 && len(clients) == 0 {
+		return nil, nil
+	}
+
+	il = &ignoreList{}
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if _, err = path.Match(d, ""); err != nil || d == "" {
+			return nil, fmt.Errorf("invalid ignored domain %q", d)
+		}
+
+		il.domains = append(il.domains, d)
+	}
+
+	for _, c := range clients {
+		if p, perr := netip.ParsePrefix(c); perr == nil {
+			il.nets = append(il.nets, p.Masked())
+
+			continue
+		}
+
+		c = strings.ToLower(c)
+		if _, err = path.Match(c, ""); err != nil || c == "" {
+			return nil, fmt.Errorf("invalid ignored client %q", c)
+		}
+
+		il.clients = append(il.clients, c)
+	}
+
+	return il, nil
+}
+
+// has returns true if the queries for host made by the client with ip and
+// clientID must not be logged.  host may have a trailing dot.
+func (il *ignoreList) has(host string, ip net.IP, clientID string) (ok bool) {
+	if il == nil {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range il.domains {
+		if ok, _ = path.Match(d, host); ok {
+			return true
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+	for _, n := range il.nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	var ipStr string
+	if addr.IsValid() {
+		ipStr = addr.String()
+	}
+
+	clientID = strings.ToLower(clientID)
+	for _, c := range il.clients {
+		if matchNonEmpty(c, ipStr) || matchNonEmpty(c, clientID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchNonEmpty returns true if s is not empty and matches the valid pattern.
+func matchNonEmpty(pattern, s string) (ok bool) {
+	if s == "" {
+		return false
+	}
+
+	ok, _ = path.Match(pattern, s)
+
+	return ok
+}
@@ -0,0 +1,108 @@
+package querylog
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreList_has(t *testing.T) {
+	il, err := newIgnoreList(
+		[]string{"ntp.example.org", "*.health.example"},
+		[]string{"192.168.1.0/24", "10.0.0.*", "monitor-*"},
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		host     string
+		ip       net.IP
+		clientID string
+		want     bool
+	}{{
+		name:     "domain",
+		host:     "NTP.example.org.",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "",
+		want:     true,
+	}, {
+		name:     "domain_wildcard",
+		host:     "probe.health.example",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "",
+		want:     true,
+	}, {
+		name:     "domain_wildcard_parent",
+		host:     "health.example",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "",
+		want:     false,
+	}, {
+		name:     "client_cidr",
+		host:     "example.com",
+		ip:       net.IPv4(192, 168, 1, 10),
+		clientID: "",
+		want:     true,
+	}, {
+		name:     "client_ip_wildcard",
+		host:     "example.com",
+		ip:       net.IP{10, 0, 0, 5},
+		clientID: "",
+		want:     true,
+	}, {
+		name:     "client_id_wildcard",
+		host:     "example.com",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "monitor-1",
+		want:     true,
+	}, {
+		name:     "not_ignored",
+		host:     "example.com",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "laptop",
+		want:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, il.has(tc.host, tc.ip, tc.clientID))
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		var nilList *ignoreList
+		assert.False(t, nilList.has("example.com", net.IP{1, 2, 3, 4}, ""))
+	})
+}
+
+func TestNewIgnoreList_bad(t *testing.T) {
+	_, err := newIgnoreList([]string{"[bad"}, nil)
+	assert.EqualError(t, err, `invalid ignored domain "[bad"`)
+
+	_, err = newIgnoreList(nil, []string{""})
+	assert.EqualError(t, err, `invalid ignored client ""`)
+}
+
+func TestQueryLog_Add_ignored(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:        true,
+		RotationIvl:    timeutil.Day,
+		MemSize:        100,
+		BaseDir:        t.TempDir(),
+		IgnoredDomains: []string{"ignored.example"},
+		IgnoredClients: []string{"2.2.2.2"},
+	})
+
+	addEntry(l, "ignored.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "logged.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "logged.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 1)
+
+	assert.Equal(t, "logged.example", entries[0].QHost)
+	assert.Equal(t, net.IPv4(2, 2, 2, 1).To4(), entries[0].IP.To4())
+}
@@ -0,0 +1,560 @@
+package querylog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/uuid"
+)
+
+// jobKind is the kind of a query log analysis job.
+type jobKind string
+
+// Kinds of analysis jobs.
+const (
+	// jobKindSearch looks up the entries matching the search criteria within
+	// the whole history.
+	jobKindSearch jobKind = "search"
+
+	// jobKindClientReport calculates the monthly report of a single client.
+	jobKindClientReport jobKind = "client_report"
+
+	// jobKindReplay re-runs the previously allowed queries through the
+	// current filtering rules to find the ones, which would now be blocked.
+	jobKindReplay jobKind = "replay"
+)
+
+// jobStatus is the status of a query log analysis job.
+type jobStatus string
+
+// Statuses of analysis jobs.
+const (
+	jobStatusRunning  jobStatus = "running"
+	jobStatusDone     jobStatus = "done"
+	jobStatusFailed   jobStatus = "failed"
+	jobStatusCanceled jobStatus = "canceled"
+)
+
+const (
+	// maxRunningJobs is the maximum number of jobs running at the same time.
+	maxRunningJobs = 2
+
+	// maxJobs is the maximum number of kept jobs, including the finished ones.
+	maxJobs = 16
+
+	// jobTTL is the time the finished jobs are kept for.
+	jobTTL = 1 * time.Hour
+
+	// jobProgressStep is the number of entries processed between the updates
+	// of the job's progress.
+	jobProgressStep = 1000
+
+	// maxJobSearchResults is the maximum number of entries found by a single
+	// search job.
+	maxJobSearchResults = 10_000
+
+	// maxReportDomains is the maximum number of domains in the top lists of a
+	// client report.
+	maxReportDomains = 100
+)
+
+// Errors of the analysis jobs.
+const (
+	// errTooManyJobs is returned when no more jobs may be started.
+	errTooManyJobs errors.Error = "too many jobs"
+
+	// errJobComplete is used to stop iterating over the entries once the
+	// analysis needs no more of them.
+	errJobComplete errors.Error = "job complete"
+)
+
+// jobAnalysis is the analysis performed by a job over the log entries, from
+// newer to older.
+type jobAnalysis interface {
+	// add processes e.  cont is false if no more entries are needed.
+	add(e *logEntry) (cont bool)
+
+	// result returns the result of the analysis, which is encoded into JSON.
+	result() (res any)
+}
+
+// jobJSON is the state of a job as returned by the HTTP API.
+type jobJSON struct {
+	// Created is the time the job has been started at.
+	Created time.Time `json:"created"`
+
+	// Finished is the time the job has finished at, if it has.
+	Finished *time.Time `json:"finished,omitempty"`
+
+	// ID is the unique identifier of the job.
+	ID string `json:"id"`
+
+	// Kind is the kind of the job.
+	Kind jobKind `json:"kind"`
+
+	// Status is the current status of the job.
+	Status jobStatus `json:"status"`
+
+	// Error is the error of the failed job.
+	Error string `json:"error,omitempty"`
+
+	// Progress is the estimated share of the job done, from 0 to 1.
+	Progress float64 `json:"progress"`
+
+	// Scanned is the number of the log entries processed so far.
+	Scanned int `json:"scanned"`
+}
+
+// job is a query log analysis job running in the background.
+type job struct {
+	// mu protects state and result.
+	mu *sync.Mutex
+
+	// cancel stops the job.
+	cancel context.CancelFunc
+
+	// result is the result of the analysis, once the job is done.
+	result any
+
+	// clients, if not nil, limits the analyzed entries to the ones from some
+	// clients.  Such job is only visible within the same filter.
+	clients *ClientsFilter
+
+	// state is the current state of the job.
+	state jobJSON
+}
+
+// visibleTo returns true if j may be accessed within the clients filter f.  The
+// jobs started without a filter are only visible without one as well, since
+// they may contain the entries of any client.
+func (j *job) visibleTo(f *ClientsFilter) (ok bool) {
+	return f == nil || f.sameClients(j.clients)
+}
+
+// snapshot returns a copy of the current state of j.
+func (j *job) snapshot() (state jobJSON) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.state
+}
+
+// setProgress updates the progress of the running job j.
+func (j *job) setProgress(progress float64, scanned int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.state.Progress, j.state.Scanned = progress, scanned
+}
+
+// finish sets the final state of j.  err is the error of the job, if any.
+func (j *job) finish(res any, scanned int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.state.Finished = &now
+	j.state.Scanned = scanned
+
+	switch {
+	case err == nil:
+		j.state.Status, j.state.Progress = jobStatusDone, 1
+		j.result = res
+	case errors.Is(err, context.Canceled):
+		j.state.Status = jobStatusCanceled
+	default:
+		j.state.Status, j.state.Error = jobStatusFailed, err.Error()
+	}
+}
+
+// jobRegistry keeps the analysis jobs.
+type jobRegistry struct {
+	// mu protects jobs.
+	mu *sync.Mutex
+
+	// jobs are the jobs by their IDs.
+	jobs map[string]*job
+}
+
+// newJobRegistry returns a new properly initialized job registry.
+func newJobRegistry() (r *jobRegistry) {
+	return &jobRegistry{
+		mu:   &sync.Mutex{},
+		jobs: map[string]*job{},
+	}
+}
+
+// add registers a new job of kind started at now within the clients filter,
+// which may be nil.  It returns errTooManyJobs if there are already too many
+// jobs.  ctx is the context of the job.
+func (r *jobRegistry) add(
+	kind jobKind,
+	now time.Time,
+	clients *ClientsFilter,
+) (j *job, ctx context.Context, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	running := 0
+	var finished []jobJSON
+	for id, rj := range r.jobs {
+		st := rj.snapshot()
+		switch {
+		case st.Finished == nil:
+			running++
+		case now.Sub(*st.Finished) > jobTTL:
+			delete(r.jobs, id)
+		default:
+			finished = append(finished, st)
+		}
+	}
+
+	if running >= maxRunningJobs {
+		return nil, nil, fmt.Errorf("%w: %d jobs are already running", errTooManyJobs, running)
+	}
+
+	// Drop the oldest finished jobs to make room for the new one.
+	sort.Slice(finished, func(i, k int) (less bool) {
+		return finished[i].Finished.Before(*finished[k].Finished)
+	})
+	for i := 0; len(r.jobs) >= maxJobs && i < len(finished); i++ {
+		delete(r.jobs, finished[i].ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j = &job{
+		mu:      &sync.Mutex{},
+		cancel:  cancel,
+		clients: clients,
+		state: jobJSON{
+			Created: now,
+			ID:      uuid.NewString(),
+			Kind:    kind,
+			Status:  jobStatusRunning,
+		},
+	}
+
+	r.jobs[j.state.ID] = j
+
+	return j, ctx, nil
+}
+
+// get returns the job with id, if any.
+func (r *jobRegistry) get(id string) (j *job, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok = r.jobs[id]
+
+	return j, ok
+}
+
+// close cancels all the running jobs.
+func (r *jobRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, j := range r.jobs {
+		j.cancel()
+	}
+}
+
+// startJob runs the analysis a over the log entries made within [from, to) in
+// the background.  Zero from means the beginning of the history.  If clients is
+// not nil, only the entries from these clients are analyzed.
+func (l *queryLog) startJob(
+	kind jobKind,
+	a jobAnalysis,
+	from time.Time,
+	to time.Time,
+	clients *ClientsFilter,
+) (j *job, err error) {
+	j, ctx, err := l.jobs.add(kind, time.Now(), clients)
+	if err != nil {
+		return nil, err
+	}
+
+	// The oldest entries are at most twice as old as the rotation interval,
+	// so estimate the progress using it when the beginning isn't known.
+	estFrom := from
+	if estFrom.IsZero() {
+		l.lock.Lock()
+		estFrom = to.Add(-2 * l.conf.RotationIvl)
+		l.lock.Unlock()
+	}
+
+	go l.runJob(ctx, j, a, from, to, estFrom)
+
+	return j, nil
+}
+
+// runJob runs the analysis a of job j.  estFrom is the estimated time of the
+// oldest entry, used to calculate the progress.
+func (l *queryLog) runJob(
+	ctx context.Context,
+	j *job,
+	a jobAnalysis,
+	from time.Time,
+	to time.Time,
+	estFrom time.Time,
+) {
+	defer log.OnPanic("querylog: running job")
+	defer j.cancel()
+
+	span := to.Sub(estFrom)
+	scanned := 0
+	err := l.exportEntries(from, to, func(e *logEntry) (err error) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		scanned++
+		if scanned%jobProgressStep == 0 && span > 0 {
+			// Don't report the job as done until it actually is.
+			progress := float64(to.Sub(e.Time)) / float64(span)
+			if progress > 0.99 {
+				progress = 0.99
+			}
+
+			j.setProgress(progress, scanned)
+		}
+
+		if j.clients != nil && !j.clients.match(e) {
+			return nil
+		}
+
+		if !a.add(e) {
+			return errJobComplete
+		}
+
+		return nil
+	})
+	if errors.Is(err, errJobComplete) {
+		err = nil
+	}
+
+	var res any
+	if err == nil {
+		res = a.result()
+	} else if !errors.Is(err, context.Canceled) {
+		log.Error("querylog: job %s: %s", j.state.ID, err)
+	}
+
+	j.finish(res, scanned, err)
+
+	log.Debug("querylog: job %s finished, %d entries scanned", j.state.ID, scanned)
+}
+
+// searchJobResult is the result of a search job.
+type searchJobResult struct {
+	// Data are the found entries in the same format as in the GET
+	// /control/querylog response, from newer to older.
+	Data []jobject `json:"data"`
+
+	// Truncated is true if there are more matching entries than
+	// maxJobSearchResults.
+	Truncated bool `json:"truncated"`
+}
+
+// searchAnalysis is the jobAnalysis looking up the entries matching the search
+// criteria.
+type searchAnalysis struct {
+	l      *queryLog
+	params *searchParams
+	cache  clientCache
+	res    *searchJobResult
+}
+
+// type check
+var _ jobAnalysis = (*searchAnalysis)(nil)
+
+// newSearchAnalysis returns a new search analysis with the criteria.
+func newSearchAnalysis(l *queryLog, criteria []searchCriterion) (a *searchAnalysis) {
+	return &searchAnalysis{
+		l: l,
+		params: &searchParams{
+			searchCriteria: criteria,
+		},
+		cache: clientCache{},
+		res: &searchJobResult{
+			Data: []jobject{},
+		},
+	}
+}
+
+// add implements the jobAnalysis interface for *searchAnalysis.
+func (a *searchAnalysis) add(e *logEntry) (cont bool) {
+	enrichEntry(a.l, e, a.cache)
+	if !a.params.match(e) {
+		return true
+	}
+
+	if len(a.res.Data) == maxJobSearchResults {
+		a.res.Truncated = true
+
+		return false
+	}
+
+	a.res.Data = append(a.res.Data, a.l.entryToJSON(e, a.l.anonymizer.Load()))
+
+	return true
+}
+
+// result implements the jobAnalysis interface for *searchAnalysis.
+func (a *searchAnalysis) result() (res any) {
+	return a.res
+}
+
+// enrichEntry sets the information about the client of e, using cache.
+func enrichEntry(l *queryLog, e *logEntry, cache clientCache) {
+	if e.client != nil {
+		return
+	}
+
+	var err error
+	e.client, err = l.client(e.ClientID, e.IP.String(), cache)
+	if err != nil {
+		log.Debug("querylog: enriching entry for client %q: %s", e.IP, err)
+	}
+}
+
+// reportDayJSON is the statistics of a single day within a client report.
+type reportDayJSON struct {
+	// Date is the date in the "2006-01-02" format.
+	Date string `json:"date"`
+
+	// NumQueries is the number of queries made during the day.
+	NumQueries int `json:"num_queries"`
+
+	// NumBlocked is the number of blocked queries made during the day.
+	NumBlocked int `json:"num_blocked"`
+}
+
+// clientReportJSON is the result of a client report job.
+type clientReportJSON struct {
+	// Client is the client the report is calculated for.
+	Client string `json:"client"`
+
+	// Month is the month of the report in the "2006-01" format.
+	Month string `json:"month"`
+
+	// Days are the statistics of each day of the month.
+	Days []*reportDayJSON `json:"days"`
+
+	// TopQueried are the most queried domains along with the numbers of
+	// queries.
+	TopQueried []map[string]int `json:"top_queried_domains"`
+
+	// TopBlocked are the most blocked domains along with the numbers of
+	// queries.
+	TopBlocked []map[string]int `json:"top_blocked_domains"`
+
+	// NumQueries is the total number of queries made during the month.
+	NumQueries int `json:"num_queries"`
+
+	// NumBlocked is the total number of blocked queries made during the
+	// month.
+	NumBlocked int `json:"num_blocked"`
+}
+
+// clientReportAnalysis is the jobAnalysis calculating the monthly report of a
+// single client.
+type clientReportAnalysis struct {
+	l         *queryLog
+	criterion *searchCriterion
+	cache     clientCache
+	queried   map[string]int
+	blocked   map[string]int
+	res       *clientReportJSON
+}
+
+// type check
+var _ jobAnalysis = (*clientReportAnalysis)(nil)
+
+// newClientReportAnalysis returns a new analysis of the client matched by c
+// during the month starting at start.
+func newClientReportAnalysis(
+	l *queryLog,
+	c *searchCriterion,
+	start time.Time,
+) (a *clientReportAnalysis) {
+	res := &clientReportJSON{
+		Client: c.value,
+		Month:  start.Format("2006-01"),
+	}
+
+	for d := start; d.Month() == start.Month(); d = d.AddDate(0, 0, 1) {
+		res.Days = append(res.Days, &reportDayJSON{Date: d.Format("2006-01-02")})
+	}
+
+	return &clientReportAnalysis{
+		l:         l,
+		criterion: c,
+		cache:     clientCache{},
+		queried:   map[string]int{},
+		blocked:   map[string]int{},
+		res:       res,
+	}
+}
+
+// add implements the jobAnalysis interface for *clientReportAnalysis.
+func (a *clientReportAnalysis) add(e *logEntry) (cont bool) {
+	enrichEntry(a.l, e, a.cache)
+	if !a.criterion.match(e) {
+		return true
+	}
+
+	day := a.res.Days[e.Time.Local().Day()-1]
+	day.NumQueries++
+	a.res.NumQueries++
+	a.queried[e.QHost]++
+
+	if e.Result.IsFiltered {
+		day.NumBlocked++
+		a.res.NumBlocked++
+		a.blocked[e.QHost]++
+	}
+
+	return true
+}
+
+// result implements the jobAnalysis interface for *clientReportAnalysis.
+func (a *clientReportAnalysis) result() (res any) {
+	a.res.TopQueried = topDomains(a.queried, maxReportDomains)
+	a.res.TopBlocked = topDomains(a.blocked, maxReportDomains)
+
+	return a.res
+}
+
+// topDomains returns at most limit domains from counts with the greatest
+// numbers in the descending order.
+func topDomains(counts map[string]int, limit int) (top []map[string]int) {
+	domains := make([]string, 0, len(counts))
+	for d := range counts {
+		domains = append(domains, d)
+	}
+
+	sort.Slice(domains, func(i, j int) (less bool) {
+		if ci, cj := counts[domains[i]], counts[domains[j]]; ci != cj {
+			return ci > cj
+		}
+
+		return domains[i] < domains[j]
+	})
+
+	if len(domains) > limit {
+		domains = domains[:limit]
+	}
+
+	top = make([]map[string]int, 0, len(domains))
+	for _, d := range domains {
+		top = append(top, map[string]int{d: counts[d]})
+	}
+
+	return top
+}
@@ -0,0 +1,326 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_jobs(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	t.Cleanup(l.Close)
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	// Keep the newest entry in memory.
+	addEntry(l, "third.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 2))
+
+	startJobWithin := func(
+		t *testing.T,
+		req *jobRequest,
+		f *ClientsFilter,
+	) (rw *httptest.ResponseRecorder) {
+		t.Helper()
+
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/control/querylog_jobs", bytes.NewReader(b))
+		if f != nil {
+			r = r.WithContext(WithClientsFilter(r.Context(), f))
+		}
+
+		rw = httptest.NewRecorder()
+		l.handleQueryLogJobs(rw, r)
+
+		return rw
+	}
+
+	startJob := func(t *testing.T, req *jobRequest) (rw *httptest.ResponseRecorder) {
+		t.Helper()
+
+		return startJobWithin(t, req, nil)
+	}
+
+	// waitResult waits for the job to finish and decodes its result into v.
+	waitResult := func(t *testing.T, rw *httptest.ResponseRecorder, v any) {
+		t.Helper()
+
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		st := &jobJSON{}
+		require.NoError(t, json.NewDecoder(rw.Body).Decode(st))
+
+		require.Eventually(t, func() (ok bool) {
+			r := httptest.NewRequest(http.MethodGet, "/control/querylog_jobs/status?id="+st.ID, nil)
+			srw := httptest.NewRecorder()
+			l.handleQueryLogJobStatus(srw, r)
+			require.Equal(t, http.StatusOK, srw.Code)
+
+			require.NoError(t, json.NewDecoder(srw.Body).Decode(st))
+
+			return st.Status != jobStatusRunning
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, jobStatusDone, st.Status)
+
+		assert.Equal(t, float64(1), st.Progress)
+		assert.Equal(t, 4, st.Scanned)
+
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog_jobs/result?id="+st.ID, nil)
+		rrw := httptest.NewRecorder()
+		l.handleQueryLogJobResult(rrw, r)
+		require.Equal(t, http.StatusOK, rrw.Code)
+
+		assert.Contains(t, rrw.Header().Get("Content-Disposition"), "attachment")
+		require.NoError(t, json.NewDecoder(rrw.Body).Decode(v))
+	}
+
+	t.Run("search", func(t *testing.T) {
+		rw := startJob(t, &jobRequest{
+			Kind:   jobKindSearch,
+			Domain: `"first.example"`,
+		})
+
+		res := &struct {
+			Data []struct {
+				Client string `json:"client"`
+			} `json:"data"`
+			Truncated bool `json:"truncated"`
+		}{}
+		waitResult(t, rw, res)
+
+		require.Len(t, res.Data, 2)
+
+		assert.Equal(t, "2.2.2.2", res.Data[0].Client)
+		assert.Equal(t, "2.2.2.1", res.Data[1].Client)
+		assert.False(t, res.Truncated)
+	})
+
+	t.Run("client_report", func(t *testing.T) {
+		now := time.Now()
+		rw := startJob(t, &jobRequest{
+			Kind:   jobKindClientReport,
+			Client: "2.2.2.2",
+			Month:  now.Format("2006-01"),
+		})
+
+		res := &clientReportJSON{}
+		waitResult(t, rw, res)
+
+		assert.Equal(t, 3, res.NumQueries)
+		assert.Equal(t, 3, res.NumBlocked)
+		assert.Equal(t, []map[string]int{{"first.example": 1}, {"second.example": 1}, {"third.example": 1}}, res.TopQueried)
+
+		require.Len(t, res.Days, startOfMonth(now).AddDate(0, 1, -1).Day())
+
+		day := res.Days[now.Day()-1]
+		assert.Equal(t, now.Format("2006-01-02"), day.Date)
+		assert.Equal(t, 3, day.NumQueries)
+	})
+
+	t.Run("clients_filter", func(t *testing.T) {
+		f := NewClientsFilter([]string{"2.2.2.1"})
+		rw := startJobWithin(t, &jobRequest{Kind: jobKindSearch}, f)
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		st := &jobJSON{}
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), st))
+
+		statusCode := func(f *ClientsFilter) (code int) {
+			r := httptest.NewRequest(http.MethodGet, "/control/querylog_jobs/status?id="+st.ID, nil)
+			if f != nil {
+				r = r.WithContext(WithClientsFilter(r.Context(), f))
+			}
+
+			srw := httptest.NewRecorder()
+			l.handleQueryLogJobStatus(srw, r)
+
+			return srw.Code
+		}
+
+		assert.Equal(t, http.StatusOK, statusCode(NewClientsFilter([]string{"2.2.2.1"})))
+		assert.Equal(t, http.StatusNotFound, statusCode(NewClientsFilter([]string{"2.2.2.2"})))
+
+		res := &struct {
+			Data []struct {
+				Client string `json:"client"`
+			} `json:"data"`
+		}{}
+		waitResult(t, rw, res)
+
+		require.Len(t, res.Data, 1)
+
+		assert.Equal(t, "2.2.2.1", res.Data[0].Client)
+	})
+
+	t.Run("bad_request", func(t *testing.T) {
+		rw := startJob(t, &jobRequest{Kind: "unknown"})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+		rw = startJob(t, &jobRequest{Kind: jobKindClientReport})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+		rw = startJob(t, &jobRequest{Kind: jobKindClientReport, Client: "2.2.2.2", Month: "bad"})
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog_jobs/status?id=unknown", nil)
+		rw := httptest.NewRecorder()
+		l.handleQueryLogJobStatus(rw, r)
+
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+	})
+}
+
+func TestJobRegistry_add(t *testing.T) {
+	r := newJobRegistry()
+	now := time.Now()
+
+	var running []*job
+	for i := 0; i < maxRunningJobs; i++ {
+		j, _, err := r.add(jobKindSearch, now, nil)
+		require.NoError(t, err)
+
+		running = append(running, j)
+	}
+
+	_, _, err := r.add(jobKindSearch, now, nil)
+	assert.ErrorIs(t, err, errTooManyJobs)
+
+	running[0].finish(nil, 0, nil)
+	_, _, err = r.add(jobKindSearch, now, nil)
+	require.NoError(t, err)
+
+	// The finished jobs are removed once expired.
+	running[1].finish(nil, 0, nil)
+	_, _, err = r.add(jobKindSearch, now.Add(2*jobTTL), nil)
+	require.NoError(t, err)
+
+	_, ok := r.get(running[0].state.ID)
+	assert.False(t, ok)
+
+	r.close()
+}
+
+func TestQueryLog_replay(t *testing.T) {
+	blockRule := &filtering.ResultRule{FilterListID: 1, Text: "||blocked.example^"}
+	checked := 0
+	l := newQueryLog(Config{
+		CheckHost: func(
+			host string,
+			_ uint16,
+			_ net.IP,
+			_ string,
+		) (res *filtering.Result, err error) {
+			checked++
+			switch host {
+			case "blocked.example":
+				return &filtering.Result{
+					Rules:      []*filtering.ResultRule{blockRule},
+					Reason:     filtering.FilteredBlockList,
+					IsFiltered: true,
+				}, nil
+			case "failing.example":
+				return nil, errors.Error("test error")
+			default:
+				return &filtering.Result{}, nil
+			}
+		},
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	t.Cleanup(l.Close)
+
+	add := func(host string, client net.IP) {
+		l.Add(&AddParams{
+			Question: &dns.Msg{Question: []dns.Question{{
+				Name:   host + ".",
+				Qtype:  dns.TypeA,
+				Qclass: dns.ClassINET,
+			}}},
+			ClientIP: client,
+		})
+	}
+
+	add("blocked.example", net.IPv4(2, 2, 2, 1))
+	add("allowed.example", net.IPv4(2, 2, 2, 1))
+	add("blocked.example", net.IPv4(2, 2, 2, 1))
+	add("failing.example", net.IPv4(2, 2, 2, 1))
+	add("blocked.example", net.IPv4(2, 2, 2, 2))
+
+	// Already blocked queries aren't replayed.
+	addEntry(l, "filtered.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	r := httptest.NewRequest(http.MethodPost, "/control/querylog_replay", nil)
+	rw := httptest.NewRecorder()
+	l.handleQueryLogReplay(rw, r)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	st := &jobJSON{}
+	require.NoError(t, json.NewDecoder(rw.Body).Decode(st))
+	assert.Equal(t, jobKindReplay, st.Kind)
+
+	j, ok := l.jobs.get(st.ID)
+	require.True(t, ok)
+
+	require.Eventually(t, func() (ok bool) {
+		return j.snapshot().Status != jobStatusRunning
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, jobStatusDone, j.snapshot().Status)
+
+	res, ok := j.result.(*replayJobResult)
+	require.True(t, ok)
+
+	assert.Equal(t, 4, checked)
+	assert.Equal(t, 3, res.Checked)
+	assert.Equal(t, 1, res.Failed)
+	assert.False(t, res.Truncated)
+
+	require.Len(t, res.Domains, 1)
+
+	d := res.Domains[0]
+	assert.Equal(t, "blocked.example", d.Domain)
+	assert.Equal(t, 3, d.Count)
+	assert.Equal(t, filtering.FilteredBlockList.String(), d.Reason)
+	assert.Equal(t, resultRulesToJSONRules([]*filtering.ResultRule{blockRule}), d.Rules)
+
+	t.Run("not_supported", func(t *testing.T) {
+		noCheck := newQueryLog(Config{
+			Enabled:     true,
+			RotationIvl: timeutil.Day,
+			MemSize:     100,
+			BaseDir:     t.TempDir(),
+		})
+		t.Cleanup(noCheck.Close)
+
+		r = httptest.NewRequest(http.MethodPost, "/control/querylog_replay", nil)
+		rw = httptest.NewRecorder()
+		noCheck.handleQueryLogReplay(rw, r)
+
+		assert.Equal(t, http.StatusNotImplemented, rw.Code)
+	})
+}
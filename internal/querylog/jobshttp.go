@@ -0,0 +1,227 @@
+package querylog
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// jobRequest is the request to the POST /control/querylog_jobs HTTP API.
+type jobRequest struct {
+	// Kind is the kind of the job to start.
+	Kind jobKind `json:"kind"`
+
+	// Search, ResponseStatus, Domain, Client, QuestionType, ResponseCode, and
+	// DNSSECStatus are the search criteria of jobKindSearch with the same
+	// meaning as the query parameters of the GET /control/querylog HTTP API.
+	// Client is also the required client of jobKindClientReport.
+	Search         string `json:"search"`
+	ResponseStatus string `json:"response_status"`
+	Domain         string `json:"domain"`
+	Client         string `json:"client"`
+	QuestionType   string `json:"question_type"`
+	ResponseCode   string `json:"response_code"`
+	DNSSECStatus   string `json:"dnssec_status"`
+
+	// Month is the month of jobKindClientReport in the "2006-01" format.  If
+	// empty, the current month is used.
+	Month string `json:"month"`
+}
+
+// jobIDRequest is the request to the POST /control/querylog_jobs/cancel HTTP
+// API.
+type jobIDRequest struct {
+	ID string `json:"id"`
+}
+
+// newAnalysis returns the analysis requested by req along with the time window
+// of the entries to analyze.
+func (l *queryLog) newAnalysis(req *jobRequest) (a jobAnalysis, from, to time.Time, err error) {
+	now := time.Now()
+
+	switch req.Kind {
+	case jobKindSearch:
+		var criteria []searchCriterion
+		criteria, err = l.parseSearchCriteria(url.Values{
+			"search":          {req.Search},
+			"response_status": {req.ResponseStatus},
+			"domain":          {req.Domain},
+			"client":          {req.Client},
+			"question_type":   {req.QuestionType},
+			"response_code":   {req.ResponseCode},
+			"dnssec_status":   {req.DNSSECStatus},
+		})
+		if err != nil {
+			return nil, from, to, err
+		}
+
+		return newSearchAnalysis(l, criteria), time.Time{}, now, nil
+	case jobKindClientReport:
+		if req.Client == "" {
+			return nil, from, to, errors.Error("client: empty value")
+		}
+
+		from = startOfMonth(now)
+		if req.Month != "" {
+			from, err = time.ParseInLocation("2006-01", req.Month, time.Local)
+			if err != nil {
+				return nil, from, to, fmt.Errorf("month: %w", err)
+			}
+		}
+
+		c := &searchCriterion{
+			criterionType: ctClient,
+			value:         req.Client,
+			strict:        true,
+		}
+
+		return newClientReportAnalysis(l, c, from), from, from.AddDate(0, 1, 0), nil
+	case jobKindReplay:
+		if l.conf.CheckHost == nil {
+			return nil, from, to, errors.Error("replaying queries is not supported")
+		}
+
+		return newReplayAnalysis(l.conf.CheckHost), time.Time{}, now, nil
+	default:
+		return nil, from, to, fmt.Errorf("kind: unsupported value %q", req.Kind)
+	}
+}
+
+// startOfMonth returns the local midnight starting the month containing t.
+func startOfMonth(t time.Time) (start time.Time) {
+	y, m, _ := t.Date()
+
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// handleQueryLogJobs is the handler for the POST /control/querylog_jobs HTTP
+// API.  It starts the requested analysis job in the background and responds
+// with its state.
+func (l *queryLog) handleQueryLogJobs(w http.ResponseWriter, r *http.Request) {
+	req := &jobRequest{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	a, from, to, err := l.newAnalysis(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	j, err := l.startJob(req.Kind, a, from, to, clientsFilterFromContext(r.Context()))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusTooManyRequests, "%s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, j.snapshot())
+}
+
+// handleQueryLogReplay is the handler for the POST /control/querylog_replay
+// HTTP API.  It starts the job replaying the previously allowed queries
+// through the current filtering rules and responds with its state.  The result
+// is retrieved using the GET /control/querylog_jobs/result HTTP API.
+func (l *queryLog) handleQueryLogReplay(w http.ResponseWriter, r *http.Request) {
+	a, from, to, err := l.newAnalysis(&jobRequest{Kind: jobKindReplay})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusNotImplemented, "%s", err)
+
+		return
+	}
+
+	j, err := l.startJob(jobKindReplay, a, from, to, clientsFilterFromContext(r.Context()))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusTooManyRequests, "%s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, j.snapshot())
+}
+
+// jobByID returns the job with id visible within the clients filter of r.  If
+// ok is false, the response has already been written.  The jobs of other
+// clients are reported as missing to not disclose their existence.
+func (l *queryLog) jobByID(w http.ResponseWriter, r *http.Request, id string) (j *job, ok bool) {
+	j, ok = l.jobs.get(id)
+	if !ok || !j.visibleTo(clientsFilterFromContext(r.Context())) {
+		aghhttp.Error(r, w, http.StatusNotFound, "no job with id %q", id)
+
+		return nil, false
+	}
+
+	return j, true
+}
+
+// jobFromRequest returns the job with the ID from the id query parameter.  If
+// ok is false, the response has already been written.
+func (l *queryLog) jobFromRequest(w http.ResponseWriter, r *http.Request) (j *job, ok bool) {
+	return l.jobByID(w, r, r.URL.Query().Get("id"))
+}
+
+// handleQueryLogJobStatus is the handler for the GET
+// /control/querylog_jobs/status HTTP API.
+func (l *queryLog) handleQueryLogJobStatus(w http.ResponseWriter, r *http.Request) {
+	j, ok := l.jobFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, j.snapshot())
+}
+
+// handleQueryLogJobResult is the handler for the GET
+// /control/querylog_jobs/result HTTP API.  It responds with the result of the
+// finished job as a downloadable JSON file.
+func (l *queryLog) handleQueryLogJobResult(w http.ResponseWriter, r *http.Request) {
+	j, ok := l.jobFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	j.mu.Lock()
+	st, res := j.state, j.result
+	j.mu.Unlock()
+
+	if st.Status != jobStatusDone {
+		aghhttp.Error(r, w, http.StatusConflict, "job %q is %s", st.ID, st.Status)
+
+		return
+	}
+
+	w.Header().Set(
+		aghhttp.HdrNameContentDisposition,
+		fmt.Sprintf(`attachment; filename="querylog_%s_%s.json"`, st.Kind, st.ID),
+	)
+
+	_ = aghhttp.WriteJSONResponse(w, r, res)
+}
+
+// handleQueryLogJobCancel is the handler for the POST
+// /control/querylog_jobs/cancel HTTP API.
+func (l *queryLog) handleQueryLogJobCancel(w http.ResponseWriter, r *http.Request) {
+	req := &jobIDRequest{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	j, ok := l.jobByID(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	j.cancel()
+}
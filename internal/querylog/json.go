@@ -59,6 +59,7 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 	anonFunc(eip)
 
 	jsonEntry = jobject{
+		"id":           strconv.FormatInt(entry.id(), 10),
 		"reason":       entry.Result.Reason.String(),
 		"elapsedMs":    strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
 		"time":         entry.Time.Format(time.RFC3339Nano),
@@ -66,6 +67,7 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 		"client_proto": entry.ClientProto,
 		"cached":       entry.Cached,
 		"upstream":     entry.Upstream,
+		"source":       entry.source(),
 		"question":     question,
 		"rules":        resultRulesToJSONRules(entry.Result.Rules),
 	}
@@ -78,10 +80,26 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 		jsonEntry["client_id"] = entry.ClientID
 	}
 
+	if entry.Upstream != "" {
+		jsonEntry["upstream_proto"] = upstreamProto(entry.Upstream)
+	}
+
+	if st := entry.dnssecStatus(); st != DNSSECStatusNone {
+		jsonEntry["dnssec_status"] = st
+	}
+
+	if entry.CacheBypassed {
+		jsonEntry["cache_bypassed"] = true
+	}
+
 	if entry.ReqECS != "" {
 		jsonEntry["ecs"] = entry.ReqECS
 	}
 
+	if entry.Repeats > 0 {
+		jsonEntry["repeats"] = entry.Repeats
+	}
+
 	if len(entry.Result.Rules) > 0 {
 		if r := entry.Result.Rules[0]; len(r.Text) > 0 {
 			jsonEntry["rule"] = r.Text
@@ -93,6 +111,10 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
 
+	if t := entry.Result.SuppressedType; t != 0 {
+		jsonEntry["suppressed_type"] = dns.Type(t).String()
+	}
+
 	l.setMsgData(entry, jsonEntry)
 	l.setOrigAns(entry, jsonEntry)
 
@@ -105,38 +127,25 @@ func (l *queryLog) setMsgData(entry *logEntry, jsonEntry jobject) {
 		return
 	}
 
-	msg := &dns.Msg{}
-	if err := msg.Unpack(entry.Answer); err != nil {
-		log.Debug("querylog: failed to unpack dns msg answer: %v: %s", entry.Answer, err)
-
-		return
-	}
-
-	jsonEntry["status"] = dns.RcodeToString[msg.Rcode]
+	jsonEntry["status"] = entry.responseCode()
 	// Old query logs may still keep AD flag value in the message.  Try to get
 	// it from there as well.
-	jsonEntry["answer_dnssec"] = entry.AuthenticatedData || msg.AuthenticatedData
+	jsonEntry["answer_dnssec"] = entry.AuthenticatedData || packedAD(entry.Answer)
 
-	if a := answerToMap(msg); a != nil {
+	if a := entry.answers(); len(a) > 0 {
 		jsonEntry["answer"] = a
 	}
 }
 
+// packedAD returns the AD flag of the packed message, which is the sixth bit
+// of its fourth octet.
+func packedAD(packed []byte) (ad bool) {
+	return len(packed) >= 4 && packed[3]&0x20 != 0
+}
+
 // setOrigAns sets the original answer data in jsonEntry.
 func (l *queryLog) setOrigAns(entry *logEntry, jsonEntry jobject) {
-	if len(entry.OrigAnswer) == 0 {
-		return
-	}
-
-	orig := &dns.Msg{}
-	err := orig.Unpack(entry.OrigAnswer)
-	if err != nil {
-		log.Debug("querylog: orig.Unpack(entry.OrigAnswer): %v: %s", entry.OrigAnswer, err)
-
-		return
-	}
-
-	if a := answerToMap(orig); a != nil {
+	if a := entry.origAnswers(); len(a) > 0 {
 		jsonEntry["original_answer"] = a
 	}
 }
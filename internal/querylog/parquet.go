@@ -0,0 +1,512 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// parquetMagic is the magic number at the start and at the end of a Parquet
+// file.
+const parquetMagic = "PAR1"
+
+// parquetRowGroupSize is the maximum number of rows in a single row group.  The
+// rows of a group are buffered in memory until the group is written.
+const parquetRowGroupSize = 1 << 16
+
+// parquetType is the physical type of a Parquet column.
+type parquetType int32
+
+// Parquet physical types used by the export.
+const (
+	parquetTypeBoolean   parquetType = 0
+	parquetTypeInt64     parquetType = 2
+	parquetTypeDouble    parquetType = 5
+	parquetTypeByteArray parquetType = 6
+)
+
+// Parquet converted types used by the export.  parquetConvNone isn't a Parquet
+// value and means that the converted type isn't set.
+const (
+	parquetConvNone            int32 = -1
+	parquetConvUTF8            int32 = 0
+	parquetConvTimestampMicros int32 = 10
+)
+
+// Other Parquet constants used by the export.
+const (
+	parquetRepetitionRequired int32 = 0
+	parquetEncodingPlain      int32 = 0
+	parquetEncodingRLE        int32 = 3
+	parquetCodecGzip          int32 = 2
+	parquetPageTypeData       int32 = 0
+)
+
+// parquetColumn is a column of the exported Parquet file.
+type parquetColumn struct {
+	// appendValue appends the PLAIN-encoded value of the column for e to b.
+	// It's nil for the boolean columns.
+	appendValue func(b []byte, e *exportEntry) (res []byte)
+
+	// boolValue returns the value of the boolean column for e.
+	boolValue func(e *exportEntry) (v bool)
+
+	// name is the name of the column.
+	name string
+
+	// typ is the physical type of the column.
+	typ parquetType
+
+	// conv is the converted type of the column.
+	conv int32
+}
+
+// parquetStrColumn returns a UTF-8 string column.
+func parquetStrColumn(name string, value func(e *exportEntry) (v string)) (c *parquetColumn) {
+	return &parquetColumn{
+		appendValue: func(b []byte, e *exportEntry) (res []byte) {
+			v := value(e)
+			b = appendUint32LE(b, uint32(len(v)))
+
+			return append(b, v...)
+		},
+		name: name,
+		typ:  parquetTypeByteArray,
+		conv: parquetConvUTF8,
+	}
+}
+
+// parquetColumns are the columns of the exported Parquet file.  Their names are
+// the same as in the CSV export.
+var parquetColumns = []*parquetColumn{{
+	appendValue: func(b []byte, e *exportEntry) (res []byte) {
+		return appendUint64LE(b, uint64(e.t.UnixMicro()))
+	},
+	name: "time",
+	typ:  parquetTypeInt64,
+	conv: parquetConvTimestampMicros,
+},
+	parquetStrColumn("client", func(e *exportEntry) (v string) { return e.Client }),
+	parquetStrColumn("client_id", func(e *exportEntry) (v string) { return e.ClientID }),
+	parquetStrColumn("client_proto", func(e *exportEntry) (v string) { return string(e.ClientProto) }),
+	parquetStrColumn("qname", func(e *exportEntry) (v string) { return e.QName }),
+	parquetStrColumn("qtype", func(e *exportEntry) (v string) { return e.QType }),
+	parquetStrColumn("qclass", func(e *exportEntry) (v string) { return e.QClass }),
+	parquetStrColumn("status", func(e *exportEntry) (v string) { return e.Status }),
+	parquetStrColumn("answer", (*exportEntry).answerString),
+	parquetStrColumn("reason", func(e *exportEntry) (v string) { return e.Reason }),
+	parquetStrColumn("rule", func(e *exportEntry) (v string) { return e.Rule }),
+	{
+		appendValue: func(b []byte, e *exportEntry) (res []byte) {
+			return appendUint64LE(b, uint64(e.FilterID))
+		},
+		name: "filter_id",
+		typ:  parquetTypeInt64,
+		conv: parquetConvNone,
+	},
+	parquetStrColumn("upstream", func(e *exportEntry) (v string) { return e.Upstream }),
+	{
+		appendValue: func(b []byte, e *exportEntry) (res []byte) {
+			return appendUint64LE(b, math.Float64bits(e.ElapsedMs))
+		},
+		name: "elapsed_ms",
+		typ:  parquetTypeDouble,
+		conv: parquetConvNone,
+	},
+	{
+		boolValue: func(e *exportEntry) (v bool) { return e.Cached },
+		name:      "cached",
+		typ:       parquetTypeBoolean,
+		conv:      parquetConvNone,
+	},
+}
+
+// parquetChunk is the metadata of a written column chunk.
+type parquetChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// parquetRowGroup is the metadata of a written row group.
+type parquetRowGroup struct {
+	chunks  []parquetChunk
+	numRows int64
+	size    int64
+}
+
+// parquetWriter writes the exported entries as an Apache Parquet file with a
+// single PLAIN-encoded and gzip-compressed data page per column chunk.  All
+// columns are required, the missing values are written as zero values.
+type parquetWriter struct {
+	// w is the destination of the file.
+	w io.Writer
+
+	// bufs are the encoded values of the current row group, one per column.
+	bufs [][]byte
+
+	// bools are the values of the boolean columns of the current row group.
+	bools [][]bool
+
+	// groups are the metadata of the written row groups.
+	groups []*parquetRowGroup
+
+	// offset is the number of bytes written to w.
+	offset int64
+
+	// rows is the number of rows in the current row group.
+	rows int
+
+	// level is the gzip compression level.
+	level int
+}
+
+// newParquetWriter returns a new Parquet writer writing into w and compressing
+// the pages with the gzip level.  Zero level means gzip.DefaultCompression.
+func newParquetWriter(w io.Writer, level int) (pw *parquetWriter) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	return &parquetWriter{
+		w:     w,
+		bufs:  make([][]byte, len(parquetColumns)),
+		bools: make([][]bool, len(parquetColumns)),
+		level: level,
+	}
+}
+
+// write adds e as a row, writing the row group once it's full.
+func (pw *parquetWriter) write(e *exportEntry) (err error) {
+	for i, c := range parquetColumns {
+		if c.typ == parquetTypeBoolean {
+			pw.bools[i] = append(pw.bools[i], c.boolValue(e))
+		} else {
+			pw.bufs[i] = c.appendValue(pw.bufs[i], e)
+		}
+	}
+
+	pw.rows++
+	if pw.rows < parquetRowGroupSize {
+		return nil
+	}
+
+	return pw.flushRowGroup()
+}
+
+// writeRaw writes b into the destination, preceding it with the magic number
+// if nothing has been written yet.
+func (pw *parquetWriter) writeRaw(b []byte) (err error) {
+	if pw.offset == 0 {
+		var n int
+		n, err = io.WriteString(pw.w, parquetMagic)
+		pw.offset += int64(n)
+		if err != nil {
+			return fmt.Errorf("writing magic: %w", err)
+		}
+	}
+
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+
+	return err
+}
+
+// flushRowGroup writes the buffered rows as a row group.
+func (pw *parquetWriter) flushRowGroup() (err error) {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	g := &parquetRowGroup{
+		numRows: int64(pw.rows),
+	}
+
+	for i, c := range parquetColumns {
+		data := pw.bufs[i]
+		if c.typ == parquetTypeBoolean {
+			data = appendPackedBools(data, pw.bools[i])
+		}
+
+		var ch parquetChunk
+		ch, err = pw.writePage(data)
+		if err != nil {
+			return fmt.Errorf("writing column %q: %w", c.name, err)
+		}
+
+		g.chunks = append(g.chunks, ch)
+		g.size += ch.uncompressedSize
+
+		pw.bufs[i], pw.bools[i] = pw.bufs[i][:0], pw.bools[i][:0]
+	}
+
+	pw.groups = append(pw.groups, g)
+	pw.rows = 0
+
+	return nil
+}
+
+// writePage writes the PLAIN-encoded values of the current row group as
+// a compressed data page.
+func (pw *parquetWriter) writePage(data []byte) (ch parquetChunk, err error) {
+	compressed := &bytes.Buffer{}
+	zw, err := gzip.NewWriterLevel(compressed, pw.level)
+	if err != nil {
+		return ch, fmt.Errorf("creating gzip writer: %w", err)
+	}
+
+	_, err = zw.Write(data)
+	if err != nil {
+		return ch, fmt.Errorf("compressing: %w", err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return ch, fmt.Errorf("flushing gzip writer: %w", err)
+	}
+
+	t := &thriftCompact{}
+	t.fieldI32(1, parquetPageTypeData)
+	t.fieldI32(2, int32(len(data)))
+	t.fieldI32(3, int32(compressed.Len()))
+	t.fieldStructBegin(5)
+	t.fieldI32(1, int32(pw.rows))
+	t.fieldI32(2, parquetEncodingPlain)
+	t.fieldI32(3, parquetEncodingRLE)
+	t.fieldI32(4, parquetEncodingRLE)
+	t.structEnd()
+	t.structEnd()
+
+	if pw.offset == 0 {
+		ch.offset = int64(len(parquetMagic))
+	} else {
+		ch.offset = pw.offset
+	}
+
+	ch.uncompressedSize = int64(len(t.buf) + len(data))
+	ch.compressedSize = int64(len(t.buf) + compressed.Len())
+
+	err = pw.writeRaw(append(t.buf, compressed.Bytes()...))
+
+	return ch, err
+}
+
+// close writes the remaining rows and the footer of the file.
+func (pw *parquetWriter) close() (err error) {
+	err = pw.flushRowGroup()
+	if err != nil {
+		return err
+	}
+
+	footer := pw.fileMetaData()
+	footer = appendUint32LE(footer, uint32(len(footer)))
+	footer = append(footer, parquetMagic...)
+
+	return pw.writeRaw(footer)
+}
+
+// fileMetaData returns the Thrift-encoded metadata of the file.
+func (pw *parquetWriter) fileMetaData() (b []byte) {
+	var numRows int64
+	for _, g := range pw.groups {
+		numRows += g.numRows
+	}
+
+	t := &thriftCompact{}
+	t.fieldI32(1, 1)
+
+	t.fieldListBegin(2, thriftTypeStruct, len(parquetColumns)+1)
+	t.structBegin()
+	t.fieldBinary(4, "schema")
+	t.fieldI32(5, int32(len(parquetColumns)))
+	t.structEnd()
+	for _, c := range parquetColumns {
+		t.structBegin()
+		t.fieldI32(1, int32(c.typ))
+		t.fieldI32(3, parquetRepetitionRequired)
+		t.fieldBinary(4, c.name)
+		if c.conv != parquetConvNone {
+			t.fieldI32(6, c.conv)
+		}
+		t.structEnd()
+	}
+
+	t.fieldI64(3, numRows)
+
+	t.fieldListBegin(4, thriftTypeStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		t.structBegin()
+		t.fieldListBegin(1, thriftTypeStruct, len(g.chunks))
+		for i, ch := range g.chunks {
+			c := parquetColumns[i]
+
+			t.structBegin()
+			t.fieldI64(2, ch.offset)
+			t.fieldStructBegin(3)
+			t.fieldI32(1, int32(c.typ))
+			t.fieldListBegin(2, thriftTypeI32, 2)
+			t.appendI32(parquetEncodingPlain)
+			t.appendI32(parquetEncodingRLE)
+			t.fieldListBegin(3, thriftTypeBinary, 1)
+			t.appendBinary(c.name)
+			t.fieldI32(4, parquetCodecGzip)
+			t.fieldI64(5, g.numRows)
+			t.fieldI64(6, ch.uncompressedSize)
+			t.fieldI64(7, ch.compressedSize)
+			t.fieldI64(9, ch.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.fieldI64(2, g.size)
+		t.fieldI64(3, g.numRows)
+		t.structEnd()
+	}
+
+	t.fieldBinary(6, "AdGuard Home")
+	t.structEnd()
+
+	return t.buf
+}
+
+// appendPackedBools appends the PLAIN-encoded booleans, that is the bits packed
+// from the least significant one, to b.
+func appendPackedBools(b []byte, vals []bool) (res []byte) {
+	for i := 0; i < len(vals); i += 8 {
+		var octet byte
+		for j := 0; j < 8 && i+j < len(vals); j++ {
+			if vals[i+j] {
+				octet |= 1 << j
+			}
+		}
+
+		b = append(b, octet)
+	}
+
+	return b
+}
+
+// appendUint32LE appends v to b in the little-endian byte order.
+func appendUint32LE(b []byte, v uint32) (res []byte) {
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], v)
+
+	return append(b, data[:]...)
+}
+
+// appendUint64LE appends v to b in the little-endian byte order.
+func appendUint64LE(b []byte, v uint64) (res []byte) {
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], v)
+
+	return append(b, data[:]...)
+}
+
+// Thrift compact protocol types used by the Parquet metadata.
+const (
+	thriftTypeI32    byte = 5
+	thriftTypeI64    byte = 6
+	thriftTypeBinary byte = 8
+	thriftTypeList   byte = 9
+	thriftTypeStruct byte = 12
+)
+
+// thriftCompact encodes the structures using the Thrift compact protocol.  The
+// top-level structure is implicitly begun.
+type thriftCompact struct {
+	// buf is the encoded data.
+	buf []byte
+
+	// lastIDs are the IDs of the last written fields of the enclosing
+	// structures.
+	lastIDs []int16
+
+	// lastID is the ID of the last written field of the current structure.
+	lastID int16
+}
+
+// fieldHeader writes the header of the field with id and typ.
+func (t *thriftCompact) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.appendVarint(uint64(int64(id)<<1 ^ int64(id)>>15))
+	}
+
+	t.lastID = id
+}
+
+// appendVarint writes v as a ULEB128 varint.
+func (t *thriftCompact) appendVarint(v uint64) {
+	for v >= 0x80 {
+		t.buf = append(t.buf, byte(v)|0x80)
+		v >>= 7
+	}
+
+	t.buf = append(t.buf, byte(v))
+}
+
+// appendI32 writes v as a list element.
+func (t *thriftCompact) appendI32(v int32) {
+	t.appendVarint(uint64(uint32(v<<1 ^ v>>31)))
+}
+
+// appendBinary writes s as a list element.
+func (t *thriftCompact) appendBinary(s string) {
+	t.appendVarint(uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// fieldI32 writes the 32-bit integer field.
+func (t *thriftCompact) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftTypeI32)
+	t.appendI32(v)
+}
+
+// fieldI64 writes the 64-bit integer field.
+func (t *thriftCompact) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftTypeI64)
+	t.appendVarint(uint64(v<<1 ^ v>>63))
+}
+
+// fieldBinary writes the string field.
+func (t *thriftCompact) fieldBinary(id int16, s string) {
+	t.fieldHeader(id, thriftTypeBinary)
+	t.appendBinary(s)
+}
+
+// fieldListBegin writes the header of the list field with n elements of
+// elemType.  The elements follow it.
+func (t *thriftCompact) fieldListBegin(id int16, elemType byte, n int) {
+	t.fieldHeader(id, thriftTypeList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elemType)
+		t.appendVarint(uint64(n))
+	}
+}
+
+// fieldStructBegin writes the header of the structure field and begins it.
+func (t *thriftCompact) fieldStructBegin(id int16) {
+	t.fieldHeader(id, thriftTypeStruct)
+	t.structBegin()
+}
+
+// structBegin begins a nested structure, for example a list element.
+func (t *thriftCompact) structBegin() {
+	t.lastIDs = append(t.lastIDs, t.lastID)
+	t.lastID = 0
+}
+
+// structEnd ends the current structure.
+func (t *thriftCompact) structEnd() {
+	t.buf = append(t.buf, 0)
+	if n := len(t.lastIDs); n > 0 {
+		t.lastID = t.lastIDs[n-1]
+		t.lastIDs = t.lastIDs[:n-1]
+	}
+}
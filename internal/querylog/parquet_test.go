@@ -0,0 +1,196 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParquetWriter(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	const n = 10
+
+	buf := &bytes.Buffer{}
+	pw := newParquetWriter(buf, 0)
+	for i := 0; i < n; i++ {
+		err := pw.write(&exportEntry{
+			t:      start.Add(time.Duration(i) * time.Second),
+			QName:  "example.org",
+			Cached: i%2 == 0,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, pw.close())
+
+	data := buf.Bytes()
+	require.Greater(t, len(data), 2*len(parquetMagic)+4)
+
+	assert.Equal(t, parquetMagic, string(data[:len(parquetMagic)]))
+	assert.Equal(t, parquetMagic, string(data[len(data)-len(parquetMagic):]))
+
+	footerEnd := len(data) - len(parquetMagic) - 4
+	footerLen := int(binary.LittleEndian.Uint32(data[footerEnd:]))
+	require.LessOrEqual(t, footerLen, footerEnd-len(parquetMagic))
+
+	footer := data[footerEnd-footerLen : footerEnd]
+	for _, c := range parquetColumns {
+		assert.True(t, bytes.Contains(footer, []byte(c.name)), c.name)
+	}
+
+	require.Len(t, pw.groups, 1)
+	require.Len(t, pw.groups[0].chunks, len(parquetColumns))
+
+	// The first column chunk is the time column.
+	ch := pw.groups[0].chunks[0]
+	page := data[ch.offset : ch.offset+ch.compressedSize]
+
+	hdr := &thriftCompact{}
+	hdr.fieldI32(1, parquetPageTypeData)
+	hdr.fieldI32(2, n*8)
+	require.True(t, bytes.HasPrefix(page, hdr.buf))
+
+	// The uncompressed size of the chunk is the size of the page header and
+	// the values.
+	hdrLen := int(ch.uncompressedSize) - n*8
+	zr, err := gzip.NewReader(bytes.NewReader(page[hdrLen:]))
+	require.NoError(t, err)
+
+	vals, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Len(t, vals, n*8)
+
+	for i := 0; i < n; i++ {
+		got := int64(binary.LittleEndian.Uint64(vals[i*8:]))
+		assert.Equal(t, start.Add(time.Duration(i)*time.Second).UnixMicro(), got)
+	}
+}
+
+// parquetTestRow is a row of the exported Parquet file as decoded by an
+// independent reader.
+type parquetTestRow struct {
+	Client      string  `parquet:"client"`
+	ClientID    string  `parquet:"client_id"`
+	ClientProto string  `parquet:"client_proto"`
+	QName       string  `parquet:"qname"`
+	QType       string  `parquet:"qtype"`
+	QClass      string  `parquet:"qclass"`
+	Status      string  `parquet:"status"`
+	Answer      string  `parquet:"answer"`
+	Reason      string  `parquet:"reason"`
+	Rule        string  `parquet:"rule"`
+	Upstream    string  `parquet:"upstream"`
+	Time        int64   `parquet:"time"`
+	FilterID    int64   `parquet:"filter_id"`
+	ElapsedMs   float64 `parquet:"elapsed_ms"`
+	Cached      bool    `parquet:"cached"`
+}
+
+// newParquetTestEntry returns a test entry with fields depending on i.
+func newParquetTestEntry(start time.Time, i int) (e *exportEntry) {
+	e = &exportEntry{
+		t:           start.Add(time.Duration(i) * time.Millisecond),
+		Client:      fmt.Sprintf("192.0.2.%d", i%256),
+		ClientProto: ClientProtoDoH,
+		QName:       fmt.Sprintf("host-%d.example.org", i),
+		QType:       "A",
+		QClass:      "IN",
+		Status:      "NOERROR",
+		Reason:      "NotFilteredNotFound",
+		ElapsedMs:   float64(i) / 4,
+		Cached:      i%3 == 0,
+	}
+
+	if i%2 == 0 {
+		e.ClientID = "cli"
+		e.Answer = []*dnsAnswer{{Type: "A", Value: "192.0.2.1", TTL: uint32(i)}}
+	} else {
+		e.Rule = "||example.org^"
+		e.FilterID = int64(i)
+		e.Upstream = "tls://dns.example:853"
+	}
+
+	return e
+}
+
+func TestParquetWriter_roundTrip(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+
+	// Write more than one row group.
+	const n = parquetRowGroupSize + 100
+
+	want := make([]*exportEntry, 0, n)
+	buf := &bytes.Buffer{}
+	pw := newParquetWriter(buf, gzip.BestSpeed)
+	for i := 0; i < n; i++ {
+		e := newParquetTestEntry(start, i)
+		want = append(want, e)
+
+		require.NoError(t, pw.write(e))
+	}
+	require.NoError(t, pw.close())
+
+	data := buf.Bytes()
+	f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(n), f.NumRows())
+	assert.Len(t, f.RowGroups(), 2)
+
+	fields := f.Schema().Fields()
+	require.Len(t, fields, len(parquetColumns))
+
+	for i, c := range parquetColumns {
+		assert.Equal(t, c.name, fields[i].Name())
+	}
+
+	r := parquet.NewGenericReader[parquetTestRow](f)
+	testutil.CleanupAndRequireSuccess(t, r.Close)
+
+	rows := make([]parquetTestRow, n)
+	read := 0
+	for read < n {
+		var nr int
+		nr, err = r.Read(rows[read:])
+		read += nr
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+
+			break
+		}
+	}
+	require.Equal(t, n, read)
+
+	for i, e := range want {
+		assert.Equal(t, parquetTestRow{
+			Client:      e.Client,
+			ClientID:    e.ClientID,
+			ClientProto: string(e.ClientProto),
+			QName:       e.QName,
+			QType:       e.QType,
+			QClass:      e.QClass,
+			Status:      e.Status,
+			Answer:      e.answerString(),
+			Reason:      e.Reason,
+			Rule:        e.Rule,
+			Upstream:    e.Upstream,
+			Time:        e.t.UnixMicro(),
+			FilterID:    e.FilterID,
+			ElapsedMs:   e.ElapsedMs,
+			Cached:      e.Cached,
+		}, rows[i], "row %d", i)
+	}
+}
+
+func TestAppendPackedBools(t *testing.T) {
+	vals := []bool{true, false, true, true, false, false, false, false, false, true}
+	assert.Equal(t, []byte{0b0000_1101, 0b0000_0010}, appendPackedBools(nil, vals))
+}
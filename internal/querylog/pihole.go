@@ -0,0 +1,269 @@
+package querylog
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// piholeImportBatch is the number of the imported entries appended to the
+// storage at once.
+const piholeImportBatch = 1000
+
+// piholeQTypes maps the query type codes of Pi-hole FTL to the DNS types.
+var piholeQTypes = map[int]uint16{
+	1:  dns.TypeA,
+	2:  dns.TypeAAAA,
+	3:  dns.TypeANY,
+	4:  dns.TypeSRV,
+	5:  dns.TypeSOA,
+	6:  dns.TypePTR,
+	7:  dns.TypeTXT,
+	8:  dns.TypeNAPTR,
+	9:  dns.TypeMX,
+	10: dns.TypeDS,
+	11: dns.TypeRRSIG,
+	12: dns.TypeDNSKEY,
+	13: dns.TypeNS,
+	15: dns.TypeSVCB,
+	16: dns.TypeHTTPS,
+}
+
+// Query status codes of Pi-hole FTL, which aren't blocking ones.
+const (
+	piholeStatusUnknown          = 0
+	piholeStatusForwarded        = 2
+	piholeStatusCached           = 3
+	piholeStatusRetried          = 12
+	piholeStatusRetriedDNSSEC    = 13
+	piholeStatusAlreadyForwarded = 14
+	piholeStatusCachedStale      = 17
+)
+
+// piholeImportStats are the numbers of the processed records of the Pi-hole
+// FTL database.
+type piholeImportStats struct {
+	// Imported is the number of the records imported into the query log.
+	Imported int `json:"imported"`
+
+	// Skipped is the number of the records, which couldn't be converted into
+	// the query log entries or are ignored by the query log settings.
+	Skipped int `json:"skipped"`
+}
+
+// newPiholeEntry converts the record of the Pi-hole FTL database into the log
+// entry.  ok is false if the record can't be converted.
+func newPiholeEntry(
+	ts int64,
+	qtype int,
+	status int,
+	domain string,
+	client string,
+	forward string,
+) (e *logEntry, ok bool) {
+	ip := net.ParseIP(client)
+	if ip == nil || domain == "" {
+		return nil, false
+	}
+
+	qt, ok := piholeQTypes[qtype]
+	if !ok {
+		return nil, false
+	}
+
+	e = &logEntry{
+		Time:   time.Unix(ts, 0),
+		QHost:  strings.ToLower(strings.TrimSuffix(domain, ".")),
+		QType:  dns.Type(qt).String(),
+		QClass: dns.Class(dns.ClassINET).String(),
+		IP:     ip,
+	}
+
+	switch status {
+	case piholeStatusUnknown, piholeStatusRetried, piholeStatusRetriedDNSSEC:
+		// Go on.
+	case piholeStatusForwarded, piholeStatusAlreadyForwarded:
+		// Pi-hole stores the upstream as "host#port".
+		e.Upstream = strings.Replace(forward, "#", ":", 1)
+	case piholeStatusCached, piholeStatusCachedStale:
+		e.Cached = true
+	default:
+		e.Result = filtering.Result{
+			IsFiltered: true,
+			Reason:     filtering.FilteredBlockList,
+		}
+	}
+
+	return e, true
+}
+
+// importPihole appends the query history from the Pi-hole FTL database at path
+// to the storage and passes it to the statistics.  The records older than the
+// rotation interval are skipped, since they would be removed by the next
+// rotation anyway.  The storage is repaired afterwards, if it's able to, since
+// the imported records are likely to be older than the ones already stored.
+func (l *queryLog) importPihole(path string) (st *piholeImportStats, err error) {
+	l.lock.Lock()
+	since := time.Now().Add(-l.conf.RotationIvl)
+	l.lock.Unlock()
+
+	st = &piholeImportStats{}
+	anonymize := l.anonymizer.Load()
+	batch := make([]*logEntry, 0, piholeImportBatch)
+
+	// The records are read from older to newer and have the second precision,
+	// so make their times, and thus the identifiers, unique.
+	var last time.Time
+	skipped, err := readPiholeDB(path, since, func(e *logEntry) (ferr error) {
+		if !l.ShouldLog(e.QHost, e.IP, "") {
+			st.Skipped++
+
+			return nil
+		}
+
+		e.Time = nextUniqueTime(last, e.Time)
+		last = e.Time
+
+		anonymize(e.IP)
+		batch = append(batch, e)
+		if len(batch) < piholeImportBatch {
+			return nil
+		}
+
+		ferr = l.importBatch(batch)
+		if ferr != nil {
+			return ferr
+		}
+
+		st.Imported += len(batch)
+		batch = batch[:0]
+
+		return nil
+	})
+	st.Skipped += skipped
+	if err == nil && len(batch) > 0 {
+		err = l.importBatch(batch)
+		if err == nil {
+			st.Imported += len(batch)
+		}
+	}
+
+	if st.Imported == 0 {
+		return st, err
+	}
+
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	if rs, ok := l.storage.(repairingStorage); ok {
+		_, rerr := rs.Repair(false)
+		err = errors.WithDeferred(err, rerr)
+	}
+
+	return st, err
+}
+
+// importBatch appends the imported entries to the storage and passes them to
+// the statistics.  l.fileFlushLock is only locked while appending, so that the
+// regular flushes aren't blocked until the whole database is imported.
+func (l *queryLog) importBatch(batch []*logEntry) (err error) {
+	// Convert the entries before hashing them, since the statistics get the
+	// plain domain names and the clients.
+	entries := make([]stats.Entry, 0, len(batch))
+	for _, e := range batch {
+		entries = append(entries, newPiholeStatsEntry(e))
+		if l.conf.Hashed {
+			hashEntry(e, l.hashKey)
+		}
+	}
+
+	l.fileFlushLock.Lock()
+	err = l.flushToStorage(batch)
+	l.fileFlushLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if l.conf.ImportStats != nil {
+		l.conf.ImportStats(entries)
+	}
+
+	return nil
+}
+
+// newPiholeStatsEntry converts the log entry imported from the Pi-hole FTL
+// database into the statistics entry.  The processing time isn't known, so
+// it's left zero.
+func newPiholeStatsEntry(e *logEntry) (se stats.Entry) {
+	se = stats.Entry{
+		Client:   e.IP.String(),
+		Domain:   e.QHost,
+		Result:   stats.RNotFiltered,
+		Cache:    stats.CacheMiss,
+		Upstream: e.Upstream,
+		At:       e.Time,
+	}
+
+	if e.Result.IsFiltered {
+		se.Result = stats.RFiltered
+		se.Cache = stats.CacheNone
+		se.BlockedService = filtering.ServiceIDByHost(e.QHost)
+	} else if e.Cached {
+		se.Cache = stats.CacheHit
+	}
+
+	return se
+}
+
+// piholeImportReq is the request body for the POST /control/querylog_import
+// HTTP API.
+type piholeImportReq struct {
+	// Path is the path to the Pi-hole FTL database on the machine running
+	// AdGuard Home, usually /etc/pihole/pihole-FTL.db.
+	Path string `json:"path"`
+}
+
+// handleQueryLogImport is the handler for the POST /control/querylog_import
+// HTTP API.  It imports the query history from the Pi-hole FTL database.
+func (l *queryLog) handleQueryLogImport(w http.ResponseWriter, r *http.Request) {
+	req := &piholeImportReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	} else if req.Path == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "path: empty value")
+
+		return
+	}
+
+	l.lock.Lock()
+	fileEnabled := l.conf.FileEnabled
+	l.lock.Unlock()
+
+	if !fileEnabled {
+		aghhttp.Error(r, w, http.StatusBadRequest, "writing the query log to the storage is disabled")
+
+		return
+	}
+
+	st, err := l.importPihole(req.Path)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "importing %q: %s", req.Path, err)
+
+		return
+	}
+
+	log.Info("querylog: imported %d records from %q, skipped %d", st.Imported, req.Path, st.Skipped)
+
+	_ = aghhttp.WriteJSONResponse(w, r, st)
+}
@@ -0,0 +1,129 @@
+package querylog
+
+import (
+	"database/sql"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPiholeDB creates the Pi-hole FTL database with the queries made since
+// start and returns its path.
+func newTestPiholeDB(t *testing.T, start time.Time) (path string) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), "pihole-FTL.db")
+	dsn, err := sqliteDSN(path, nil)
+	require.NoError(t, err)
+
+	db, err := sql.Open(sqliteDriverName, dsn)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, db.Close)
+
+	_, err = db.Exec(`CREATE TABLE queries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		type INTEGER NOT NULL,
+		status INTEGER NOT NULL,
+		domain TEXT NOT NULL,
+		client TEXT NOT NULL,
+		forward TEXT
+	)`)
+	require.NoError(t, err)
+
+	ts := start.Unix()
+	_, err = db.Exec(`INSERT INTO queries (timestamp, type, status, domain, client, forward)
+		VALUES
+			(?, 1, 2, 'Example.org', '192.168.1.2', '1.1.1.1#53'),
+			(?, 2, 3, 'example.net', '192.168.1.3', NULL),
+			(?, 1, 1, 'ads.example', 'fd00::4', NULL),
+			(?, 99, 2, 'unknown.example', '192.168.1.2', NULL),
+			(?, 1, 2, 'example.com', 'not-an-ip', NULL),
+			(?, 1, 2, 'stale.example', '192.168.1.2', NULL)`,
+		ts+2, ts+1, ts+3, ts+4, ts+5, ts-int64(2*timeutil.Day/time.Second),
+	)
+	require.NoError(t, err)
+
+	return path
+}
+
+func TestReadPiholeDB(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := newTestPiholeDB(t, start)
+
+	var entries []*logEntry
+	skipped, err := readPiholeDB(path, start, func(e *logEntry) (err error) {
+		entries = append(entries, e)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, skipped)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, "example.net", entries[0].QHost)
+	assert.Equal(t, "AAAA", entries[0].QType)
+	assert.True(t, entries[0].Cached)
+
+	assert.Equal(t, "example.org", entries[1].QHost)
+	assert.Equal(t, "A", entries[1].QType)
+	assert.Equal(t, "IN", entries[1].QClass)
+	assert.Equal(t, "1.1.1.1:53", entries[1].Upstream)
+	assert.Equal(t, net.IP{192, 168, 1, 2}, entries[1].IP.To4())
+	assert.Equal(t, start.Add(2*time.Second), entries[1].Time.UTC())
+	assert.False(t, entries[1].Result.IsFiltered)
+
+	assert.Equal(t, "ads.example", entries[2].QHost)
+	assert.True(t, entries[2].Result.IsFiltered)
+}
+
+func TestQueryLog_importPihole(t *testing.T) {
+	var imported []stats.Entry
+	l := newQueryLog(Config{
+		ImportStats: func(entries []stats.Entry) {
+			imported = append(imported, entries...)
+		},
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	now := time.Now()
+	addEntry(l, "current.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	st, err := l.importPihole(newTestPiholeDB(t, now.Add(-time.Hour)))
+	require.NoError(t, err)
+
+	// The record older than the rotation interval is skipped along with the
+	// invalid ones.
+	assert.Equal(t, &piholeImportStats{Imported: 3, Skipped: 2}, st)
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 4)
+
+	assert.Equal(t, "current.example", entries[0].QHost)
+	assert.Equal(t, "ads.example", entries[1].QHost)
+	assert.Equal(t, "example.org", entries[2].QHost)
+	assert.Equal(t, "example.net", entries[3].QHost)
+
+	require.Len(t, imported, 3)
+
+	assert.Equal(t, stats.CacheHit, imported[0].Cache)
+	assert.Equal(t, "example.org", imported[1].Domain)
+	assert.Equal(t, "192.168.1.2", imported[1].Client)
+	assert.Equal(t, "1.1.1.1:53", imported[1].Upstream)
+	assert.Equal(t, stats.RNotFiltered, imported[1].Result)
+	assert.Equal(t, stats.RFiltered, imported[2].Result)
+	assert.Equal(t, now.Add(-time.Hour+3*time.Second).Unix(), imported[2].At.Unix())
+}
@@ -0,0 +1,67 @@
+package querylog
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// piholeQuery selects the query history from the Pi-hole FTL database.  The
+// queries view is present in all the versions of the database since 2018,
+// and only its oldest columns are used.
+const piholeQuery = `
+SELECT timestamp, type, status, domain, client, IFNULL(forward, '')
+FROM queries
+WHERE timestamp >= ?
+ORDER BY timestamp, id`
+
+// readPiholeDB calls f for each record of the Pi-hole FTL database at path made
+// at since or later, from older to newer.  skipped is the number of the
+// records, which can't be converted into the log entries.
+func readPiholeDB(path string, since time.Time, f func(e *logEntry) (err error)) (skipped int, err error) {
+	// Open the database read-only, so that it isn't created, if there is none,
+	// and isn't changed.
+	dsn, err := sqliteDSN(path, url.Values{"mode": []string{"ro"}})
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open(sqliteDriverName, dsn)
+	if err != nil {
+		return 0, fmt.Errorf("opening database: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, db.Close()) }()
+
+	rows, err := db.Query(piholeQuery, since.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("querying: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, rows.Close()) }()
+
+	for rows.Next() {
+		var ts int64
+		var qtype, status int
+		var domain, client, forward string
+		err = rows.Scan(&ts, &qtype, &status, &domain, &client, &forward)
+		if err != nil {
+			return skipped, fmt.Errorf("scanning: %w", err)
+		}
+
+		e, ok := newPiholeEntry(ts, qtype, status, domain, client, forward)
+		if !ok {
+			skipped++
+
+			continue
+		}
+
+		err = f(e)
+		if err != nil {
+			return skipped, err
+		}
+	}
+
+	return skipped, rows.Err()
+}
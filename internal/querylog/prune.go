@@ -0,0 +1,267 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+)
+
+// pruneSlackDiv defines the slack of pruning as the fraction of the rotation
+// interval.  A file is only rewritten once its oldest record is older than the
+// interval plus the slack, so that the large files aren't rewritten on every
+// rotation check.
+const pruneSlackDiv = 10
+
+// pruningStorage is a [Storage] keeping the outdated records after the
+// rotation, which need to be removed separately.
+type pruningStorage interface {
+	Storage
+
+	// Prune removes the records older than ivl.
+	Prune(ivl time.Duration) (err error)
+}
+
+// type check
+var _ pruningStorage = (*fileStorage)(nil)
+
+// Prune implements the [pruningStorage] interface for *fileStorage.  Since the
+// current file only becomes the previous one once its oldest record is older
+// than ivl, the previous file keeps the records for up to twice as long unless
+// pruned.  A file is only rewritten once its oldest record is older than ivl
+// plus the slack defined by pruneSlackDiv.
+func (s *fileStorage) Prune(ivl time.Duration) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	olderThan := time.Now().Add(-ivl)
+	threshold := olderThan.Add(-ivl / pruneSlackDiv).UnixNano()
+
+	var errs []error
+	for _, p := range []string{s.gzOldPath(), s.oldPath()} {
+		var n int
+		n, err = pruneFile(p, olderThan.UnixNano(), threshold, s.compressLevel)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pruning %q: %w", p, err))
+		} else if n > 0 {
+			log.Info("querylog: pruned %d records older than %s from %q", n, olderThan, p)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("pruning files", errs...)
+	}
+
+	return nil
+}
+
+// pruneFile removes the records made before olderThan, in nanoseconds, from
+// the query log file at path, which is gzipped if it has the gzipExt extension,
+// and updates its index.  The file is only rewritten if its oldest record is
+// made before threshold.  level is the gzip compression level.  n is the
+// number of removed records.
+func pruneFile(path string, olderThan, threshold int64, level int) (n int, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	compressed := strings.HasSuffix(path, gzipExt)
+
+	var src io.Reader = f
+	if compressed {
+		src, err = gzip.NewReader(f)
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("opening gzip: %w", err)
+		}
+	}
+
+	r := bufio.NewReaderSize(src, maxRecordLen)
+	cut, firstTS, n, err := skipOlder(r, olderThan, threshold)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	if firstTS == 0 {
+		// All the records are outdated.
+		err = removeIfExists(qlogIndexPath(path))
+		if err != nil {
+			return 0, fmt.Errorf("removing index: %w", err)
+		}
+
+		return n, os.Remove(path)
+	}
+
+	err = rewriteFile(path, r, compressed, level)
+	if err != nil {
+		return 0, err
+	}
+
+	err = pruneQLogIndex(path, cut, firstTS)
+	if err != nil {
+		// The invalid index is never used, so only remove it.
+		log.Debug("querylog: pruning index of %q: %s", path, err)
+
+		err = removeIfExists(qlogIndexPath(path))
+		if err != nil {
+			return 0, fmt.Errorf("removing index: %w", err)
+		}
+	}
+
+	return n, nil
+}
+
+// skipOlder reads the records from r while they're made before olderThan.  If
+// the first record is made at or after threshold, it stops right away and
+// returns zero n.  cut is the number of bytes of the skipped records and
+// firstTS is the time of the first kept record, which is left unread in r.  If
+// there are no kept records, firstTS is zero.
+func skipOlder(r *bufio.Reader, olderThan, threshold int64) (cut, firstTS int64, n int, err error) {
+	for {
+		var line []byte
+		line, err = peekLine(r)
+		if err != nil {
+			return 0, 0, 0, err
+		} else if len(line) == 0 {
+			return cut, 0, n, nil
+		}
+
+		ts := readQLogTimestamp(string(line))
+		if n == 0 && ts >= threshold {
+			return 0, 0, 0, nil
+		} else if ts >= olderThan {
+			return cut, ts, n, nil
+		}
+
+		_, err = r.Discard(len(line))
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("skipping: %w", err)
+		}
+
+		cut += int64(len(line))
+		n++
+	}
+}
+
+// maxRecordLen is the maximum length of a query log record, which a pruned
+// file may contain.
+const maxRecordLen = 64 * 1024
+
+// peekLine returns the next line from r including the newline without
+// advancing r.  r must be able to buffer maxRecordLen bytes.  line is empty if
+// there are no more lines.
+func peekLine(r *bufio.Reader) (line []byte, err error) {
+	for size := 4096; ; size *= 2 {
+		line, err = r.Peek(size)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			return line[:i+1], nil
+		} else if errors.Is(err, io.EOF) {
+			return line, nil
+		} else if errors.Is(err, bufio.ErrBufferFull) && size < maxRecordLen {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading record: %w", err)
+		}
+	}
+}
+
+// rewriteFile atomically replaces the file at path with the rest of r,
+// compressing it with level if compressed is true.
+func rewriteFile(path string, r io.Reader, compressed bool, level int) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, removeIfExists(tmpPath))
+		}
+	}()
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("closing temporary file: %w", err)
+	}
+
+	if compressed {
+		err = writeGzip(tmpPath, r, level)
+	} else {
+		err = writePlain(tmpPath, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("renaming: %w", err)
+	}
+
+	return nil
+}
+
+// writePlain writes the contents of src into the file at path.
+func writePlain(path string, src io.Reader) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	_, err = io.Copy(f, src)
+	if err != nil {
+		return fmt.Errorf("copying: %w", err)
+	}
+
+	return nil
+}
+
+// pruneQLogIndex updates the index of the query log file at path, which first
+// cut bytes have been removed, and which now starts with the record made at
+// firstTS.
+func pruneQLogIndex(path string, cut, firstTS int64) (err error) {
+	idxPath := qlogIndexPath(path)
+	data, err := os.ReadFile(idxPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading: %w", err)
+	} else if len(data)%qlogIndexEntrySize != 0 {
+		return fmt.Errorf("bad index size %d", len(data))
+	}
+
+	pruned := make([]byte, qlogIndexEntrySize, len(data)+qlogIndexEntrySize)
+	binary.BigEndian.PutUint64(pruned[:8], uint64(firstTS))
+
+	for i := 0; i < len(data); i += qlogIndexEntrySize {
+		ent := data[i : i+qlogIndexEntrySize]
+		ts, offset := binary.BigEndian.Uint64(ent[:8]), int64(binary.BigEndian.Uint64(ent[8:]))
+		if offset <= cut {
+			continue
+		}
+
+		var upd [qlogIndexEntrySize]byte
+		binary.BigEndian.PutUint64(upd[:8], ts)
+		binary.BigEndian.PutUint64(upd[8:], uint64(offset-cut))
+		pruned = append(pruned, upd[:]...)
+	}
+
+	return maybe.WriteFile(idxPath, pruned, 0o644)
+}
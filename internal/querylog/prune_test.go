@@ -0,0 +1,99 @@
+package querylog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage_Prune(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ivl      time.Duration
+		wantNum  int
+		wantOld  bool
+		compress bool
+	}{{
+		name:     "plain",
+		ivl:      84500 * time.Millisecond,
+		wantNum:  14,
+		wantOld:  true,
+		compress: false,
+	}, {
+		name:     "compressed",
+		ivl:      84500 * time.Millisecond,
+		wantNum:  14,
+		wantOld:  true,
+		compress: true,
+	}, {
+		name:     "within_slack",
+		ivl:      95 * time.Second,
+		wantNum:  30,
+		wantOld:  true,
+		compress: false,
+	}, {
+		name:     "all_outdated",
+		ivl:      10 * time.Second,
+		wantNum:  10,
+		wantOld:  false,
+		compress: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFileStorage(filepath.Join(t.TempDir(), queryLogFileName))
+			s.compress = tc.compress
+			start := time.Now().Add(-100 * time.Second)
+
+			// Write two batches into the previous file and one into the
+			// current one.
+			require.NoError(t, s.Append(newIndexTestRecords(start, 10)))
+			require.NoError(t, s.Append(newIndexTestRecords(start.Add(10*time.Second), 10)))
+			require.NoError(t, s.rename())
+			require.NoError(t, s.Append(newIndexTestRecords(start.Add(20*time.Second), 10)))
+
+			oldPath := s.oldPath()
+			if tc.compress {
+				require.NoError(t, s.compressOld())
+				oldPath = s.gzOldPath()
+			}
+
+			require.NoError(t, s.Prune(tc.ivl))
+
+			if !tc.wantOld {
+				assert.NoFileExists(t, oldPath)
+				assert.NoFileExists(t, qlogIndexPath(oldPath))
+			}
+
+			var times []time.Time
+			err := s.Iterate(time.Time{}, func(rec string) (cont bool) {
+				times = append(times, time.Unix(0, readQLogTimestamp(rec)))
+
+				return true
+			})
+			require.NoError(t, err)
+			require.Len(t, times, tc.wantNum)
+
+			assert.True(t, start.Add(29*time.Second).Equal(times[0]))
+			assert.True(t, start.Add(time.Duration(30-tc.wantNum)*time.Second).Equal(times[len(times)-1]))
+
+			// The pruned index still points at the right records.
+			times = times[:0]
+			err = s.Iterate(start.Add(18*time.Second), func(rec string) (cont bool) {
+				times = append(times, time.Unix(0, readQLogTimestamp(rec)))
+
+				return false
+			})
+			require.NoError(t, err)
+
+			if tc.wantOld {
+				require.Len(t, times, 1)
+
+				assert.True(t, start.Add(17*time.Second).Equal(times[0]))
+			}
+		})
+	}
+}
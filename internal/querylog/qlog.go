@@ -1,18 +1,25 @@
 // Package querylog provides query log functions and interfaces.
+//
+// The query log doesn't depend on the rest of AdGuard Home and is only
+// configured with [Config], so it can be embedded into other programs.  All
+// the callbacks of [Config] are optional, and the HTTP API is only registered
+// if [Config.HTTPRegister] is set.
 package querylog
 
 import (
 	"fmt"
+	"io"
 	"net"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
-	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
 )
@@ -25,20 +32,78 @@ const (
 type queryLog struct {
 	findClient func(ids []string) (c *Client, err error)
 
-	conf    *Config
-	lock    sync.Mutex
-	logFile string // path to the log file
+	conf *Config
+	lock sync.Mutex
 
-	// bufferLock protects buffer.
+	// storage is the persistent storage of the entries.
+	storage Storage
+
+	// bufferLock protects buffer and flushQueue.
 	bufferLock sync.RWMutex
 	// buffer contains recent log entries.
-	buffer []*logEntry
+	buffer *aghalg.RingBuffer[*logEntry]
+	// flushQueue contains the full buffers' contents waiting to be written to
+	// the file, from older to newer.  It's bounded by maxQueuedBuffers, see
+	// trimQueueLocked.
+	flushQueue [][]*logEntry
+
+	// coalescer keeps the recent entries to record the identical queries
+	// once.  It's nil if the coalescing is disabled.  It's protected by
+	// bufferLock.
+	coalescer *coalescer
 
 	fileFlushLock sync.Mutex // synchronize a file-flushing goroutine and main thread
-	flushPending  bool       // don't start another goroutine while the previous one is still running
-	fileWriteLock sync.Mutex
+
+	// flushCh wakes up the writer goroutine once a full buffer is queued.  Its
+	// buffer is of a single element, so that adding entries never blocks.
+	flushCh chan struct{}
+
+	// done is closed when the query log is closed to stop the writer and the
+	// rotation goroutines.
+	done chan struct{}
+
+	// workers is used to wait for the writer and the rotation goroutines to
+	// stop when the query log is closed.
+	workers sync.WaitGroup
+
+	// writtenTotal and droppedTotal are the numbers of entries written to the
+	// storage and dropped since the queue has been full.  They must be
+	// accessed atomically.
+	writtenTotal uint64
+	droppedTotal uint64
+
+	// writeFailing is true if the latest writing to the storage has failed.
+	// It's protected by fileFlushLock.
+	writeFailing bool
+
+	// idLock protects lastTime.
+	idLock sync.Mutex
+
+	// lastTime is the time of the latest entry added to the log.  See
+	// [queryLog.uniqueTime].
+	lastTime time.Time
 
 	anonymizer *aghnet.IPMut
+
+	// syslog forwards the entries to a remote syslog server, if enabled.
+	syslog *syslogSink
+
+	// exporter exports the entries into an external data store, if enabled.
+	exporter *exporterSink
+
+	// archiver uploads the rotated files into an object storage, if enabled.
+	archiver *archiver
+
+	// jobs are the analysis jobs started via the HTTP API.
+	jobs *jobRegistry
+
+	// ignored is the *ignoreList of the domains and the clients, which
+	// queries aren't logged.
+	ignored atomic.Value
+
+	// hashKey is the key used to hash the entries in the hashed mode.  It's
+	// nil if the hashed mode is disabled or the key couldn't be generated.
+	hashKey []byte
 }
 
 // ClientProto values are names of the client protocols.
@@ -86,9 +151,24 @@ type logEntry struct {
 	ClientID    string      `json:"CID,omitempty"`
 	ClientProto ClientProto `json:"CP"`
 
+	// Answer and OrigAnswer are the packed response sent to the client and
+	// the one received from the upstream.  They're only used to show the
+	// whole messages, the readers of the answers use Answers and OrigAnswers.
 	Answer     []byte `json:",omitempty"` // sometimes empty answers happen like binerdunt.top or rev2.globalrootservers.net
 	OrigAnswer []byte `json:",omitempty"`
 
+	// Answers and OrigAnswers are the resource records from the answer
+	// sections of Answer and OrigAnswer.  They're nil if there is no such
+	// response and in the entries written by the previous versions.  They're
+	// written even if empty to distinguish these cases.
+	Answers     []*dnsAnswer `json:"AN"`
+	OrigAnswers []*dnsAnswer `json:"OAN"`
+
+	// Rcode is the response code of Answer, for example "NXDOMAIN".  It's
+	// empty if there is no answer and in the entries written by the previous
+	// versions.
+	Rcode string `json:"RC,omitempty"`
+
 	Result   filtering.Result
 	Upstream string `json:",omitempty"`
 
@@ -97,18 +177,158 @@ type logEntry struct {
 	Elapsed time.Duration
 
 	Cached            bool `json:",omitempty"`
+	CacheBypassed     bool `json:",omitempty"`
 	AuthenticatedData bool `json:"AD,omitempty"`
+
+	// DNSSEC is the status of the DNSSEC validation of the response.
+	DNSSEC DNSSECStatus `json:"DS,omitempty"`
+
+	// Repeats is the number of the identical queries made by the same client
+	// within the coalescing window after this one.
+	Repeats uint32 `json:"RP,omitempty"`
+}
+
+// pushLocked puts entries into the buffer.  Each time the buffer becomes full,
+// its entries are moved into the queue to be written, if writing to the file is
+// enabled, and needFlush is set to true.  Otherwise, the oldest entries are
+// just overwritten.  dropped and pending are the numbers of the entries dropped
+// from the queue and left in it.  l.bufferLock is expected to be locked.
+func (l *queryLog) pushLocked(entries []*logEntry) (needFlush bool, dropped, pending int) {
+	for _, e := range entries {
+		l.buffer.Push(e)
+		if !l.conf.FileEnabled || l.buffer.Len() != l.buffer.Cap() {
+			continue
+		}
+
+		// Move the entries into the queue to be written, so that they aren't
+		// overwritten while the file is being written.
+		l.flushQueue = append(l.flushQueue, l.buffer.Slice())
+		l.buffer.Clear()
+
+		// The queue only grows while the storage is failing or too slow.
+		var d int
+		d, pending = l.trimQueueLocked()
+		dropped += d
+		needFlush = true
+	}
+
+	return needFlush, dropped, pending
+}
+
+// responseCode returns the response code of the entry's answer.  For the
+// entries written by the previous versions, it's taken from the header of the
+// packed answer, where the lower four bits of the fourth octet are the response
+// code.
+func (e *logEntry) responseCode() (rc string) {
+	if e.Rcode != "" {
+		return e.Rcode
+	} else if len(e.Answer) < 4 {
+		return ""
+	}
+
+	return dns.RcodeToString[int(e.Answer[3]&0xf)]
+}
+
+// answers returns the structured records of the answer section of the entry's
+// response.
+func (e *logEntry) answers() (ans []*dnsAnswer) {
+	return structuredAnswers(e.Answers, e.Answer)
+}
+
+// origAnswers returns the structured records of the answer section of the
+// entry's original response.
+func (e *logEntry) origAnswers() (ans []*dnsAnswer) {
+	return structuredAnswers(e.OrigAnswers, e.OrigAnswer)
+}
+
+// structuredAnswers returns ans, unless it's nil and packed isn't empty, which
+// is the case for the entries written by the previous versions.  Then the
+// answers are unpacked from packed.
+func structuredAnswers(ans []*dnsAnswer, packed []byte) (res []*dnsAnswer) {
+	if ans != nil || len(packed) == 0 {
+		return ans
+	}
+
+	msg := &dns.Msg{}
+	if err := msg.Unpack(packed); err != nil {
+		log.Debug("querylog: unpacking answer: %s", err)
+
+		return nil
+	}
+
+	return answerToMap(msg)
+}
+
+// newAnswers returns the structured records of the answer section of m.  The
+// result is never nil.
+func newAnswers(m *dns.Msg) (ans []*dnsAnswer) {
+	ans = answerToMap(m)
+	if ans == nil {
+		ans = []*dnsAnswer{}
+	}
+
+	return ans
 }
 
 func (l *queryLog) Start() {
 	if l.conf.HTTPRegister != nil {
 		l.initWeb()
 	}
-	go l.periodicRotate()
+
+	l.workers.Add(2)
+	go func() {
+		defer l.workers.Done()
+
+		l.periodicRotate()
+	}()
+	go func() {
+		defer l.workers.Done()
+
+		l.runWriter()
+	}()
+
+	if l.syslog != nil {
+		l.syslog.start()
+	}
+
+	if l.exporter != nil {
+		l.exporter.start()
+	}
 }
 
+// Close stops the query log.  Once the writer and the rotation goroutines have
+// stopped, all the pending entries, including the ones of the incomplete memory
+// buffer and the coalesced ones, are written to the storage, which is then
+// synced and closed.
 func (l *queryLog) Close() {
-	_ = l.flushLogBuffer(true)
+	l.jobs.close()
+	close(l.done)
+	l.workers.Wait()
+
+	err := l.flushLogBuffer(true)
+	if err != nil {
+		log.Error("querylog: writing pending entries on closing: %s", err)
+	} else if ss, ok := l.storage.(syncingStorage); ok && l.fileEnabled() {
+		err = ss.Sync()
+		if err != nil {
+			log.Error("querylog: syncing storage on closing: %s", err)
+		}
+	}
+
+	if l.syslog != nil {
+		l.syslog.close()
+	}
+
+	if l.exporter != nil {
+		l.exporter.close()
+	}
+
+	if c, ok := l.storage.(io.Closer); ok {
+		err := c.Close()
+		if err != nil {
+			log.Error("querylog: closing storage: %s", err)
+		}
+	}
 }
 
 func checkInterval(ivl time.Duration) (ok bool) {
@@ -128,25 +348,29 @@ func (l *queryLog) WriteDiskConfig(c *Config) {
 	*c = *l.conf
 }
 
+// ShouldLog implements the QueryLog interface for *queryLog.
+func (l *queryLog) ShouldLog(host string, ip net.IP, clientID string) (ok bool) {
+	ignored, _ := l.ignored.Load().(*ignoreList)
+
+	return !ignored.has(host, ip, clientID)
+}
+
 // Clear memory buffer and remove log files
 func (l *queryLog) clear() {
 	l.fileFlushLock.Lock()
 	defer l.fileFlushLock.Unlock()
 
 	l.bufferLock.Lock()
-	l.buffer = nil
-	l.flushPending = false
-	l.bufferLock.Unlock()
-
-	oldLogFile := l.logFile + ".1"
-	err := os.Remove(oldLogFile)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing old log file %q: %s", oldLogFile, err)
+	l.buffer.Clear()
+	l.flushQueue = nil
+	if l.coalescer != nil {
+		l.coalescer.flush()
 	}
+	l.bufferLock.Unlock()
 
-	err = os.Remove(l.logFile)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing log file %q: %s", l.logFile, err)
+	err := l.storage.Clear()
+	if err != nil {
+		log.Error("querylog: clearing storage: %s", err)
 	}
 
 	log.Debug("querylog: cleared")
@@ -164,12 +388,16 @@ func (l *queryLog) Add(params *AddParams) {
 		return
 	}
 
+	q := params.Question.Question[0]
+	if !l.ShouldLog(q.Name, params.ClientIP, params.ClientID) {
+		return
+	}
+
 	if params.Result == nil {
 		params.Result = &filtering.Result{}
 	}
 
 	now := time.Now()
-	q := params.Question.Question[0]
 	entry := logEntry{
 		Time: now,
 
@@ -183,12 +411,26 @@ func (l *queryLog) Add(params *AddParams) {
 		Result:   *params.Result,
 		Upstream: params.Upstream,
 
-		IP: params.ClientIP,
+		IP: netutil.CloneIP(params.ClientIP),
 
 		Elapsed: params.Elapsed,
 
 		Cached:            params.Cached,
+		CacheBypassed:     params.CacheBypassed,
 		AuthenticatedData: params.AuthenticatedData,
+		DNSSEC:            params.DNSSEC,
+	}
+
+	if l.conf.Hashed {
+		if l.hashKey == nil {
+			// The entry mustn't be stored as is.
+			return
+		}
+	} else {
+		// Anonymize the address before the entry is buffered, so that the
+		// real one is never stored.  The anonymization is idempotent, so it's
+		// fine if the caller has already done it.
+		l.anonymizer.Load()(entry.IP)
 	}
 
 	if params.ReqECS != nil {
@@ -205,6 +447,8 @@ func (l *queryLog) Add(params *AddParams) {
 		}
 
 		entry.Answer = a
+		entry.Answers = newAnswers(params.Answer)
+		entry.Rcode = dns.RcodeToString[params.Answer.Rcode]
 	}
 
 	if params.OrigAnswer != nil {
@@ -217,33 +461,47 @@ func (l *queryLog) Add(params *AddParams) {
 		}
 
 		entry.OrigAnswer = a
+		entry.OrigAnswers = newAnswers(params.OrigAnswer)
+	}
+
+	if l.conf.Hashed {
+		hashEntry(&entry, l.hashKey)
+	}
+
+	entry.Time = l.uniqueTime(entry.Time)
+
+	if l.syslog != nil {
+		l.syslog.send(&entry)
+	}
+
+	if l.exporter != nil {
+		l.exporter.send(&entry)
 	}
 
 	l.bufferLock.Lock()
-	l.buffer = append(l.buffer, &entry)
-	needFlush := false
-
-	if !l.conf.FileEnabled {
-		if len(l.buffer) > int(l.conf.MemSize) {
-			// writing to file is disabled - just remove the oldest entry from array
-			//
-			// TODO(a.garipov): This should be replaced by a proper ring buffer,
-			// but it's currently difficult to do that.
-			l.buffer[0] = nil
-			l.buffer = l.buffer[1:]
-		}
-	} else if !l.flushPending {
-		needFlush = len(l.buffer) >= int(l.conf.MemSize)
-		if needFlush {
-			l.flushPending = true
-		}
+	entries := []*logEntry{&entry}
+	if l.coalescer != nil {
+		// The entry is only buffered once its coalescing window ends.
+		entries = l.coalescer.expire(now)
+		l.coalescer.add(&entry)
 	}
+
+	needFlush, dropped, pending := l.pushLocked(entries)
 	l.bufferLock.Unlock()
 
-	// if buffer needs to be flushed to disk, do it now
+	if dropped > 0 {
+		l.emitWriteEvent(&WriteEvent{
+			Err:     errQueueFull,
+			Pending: pending,
+			Dropped: dropped,
+		})
+	}
+
 	if needFlush {
-		go func() {
-			_ = l.flushLogBuffer(false)
-		}()
+		// Don't block if the writer has already been woken up.
+		select {
+		case l.flushCh <- struct{}{}:
+		default:
+		}
 	}
 }
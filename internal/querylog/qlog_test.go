@@ -4,13 +4,19 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -37,7 +43,7 @@ func TestQueryLog(t *testing.T) {
 	// Write to disk (first file).
 	require.NoError(t, l.flushLogBuffer(true))
 	// Start writing to the second file.
-	require.NoError(t, l.rotate())
+	require.NoError(t, l.storage.Rotate(0))
 	// Add disk entries.
 	addEntry(l, "example.org", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
 	// Write to disk.
@@ -110,6 +116,90 @@ func TestQueryLog(t *testing.T) {
 			{num: 2, host: "example.org", answer: net.IPv4(1, 1, 1, 2), client: net.IPv4(2, 2, 2, 2)},
 			{num: 3, host: "example.org", answer: net.IPv4(1, 1, 1, 1), client: net.IPv4(2, 2, 2, 1)},
 		},
+	}, {
+		name: "by_domain_non-strict",
+		sCr: []searchCriterion{{
+			criterionType: ctDomain,
+			strict:        false,
+			value:         "test.example",
+		}},
+		want: []tcAssertion{
+			{num: 0, host: "test.example.org", answer: net.IPv4(1, 1, 1, 3), client: net.IPv4(2, 2, 2, 3)},
+		},
+	}, {
+		name: "by_domain_strict",
+		sCr: []searchCriterion{{
+			criterionType: ctDomain,
+			strict:        true,
+			value:         "EXAMPLE.org",
+		}},
+		want: []tcAssertion{
+			{num: 0, host: "example.org", answer: net.IPv4(1, 1, 1, 2), client: net.IPv4(2, 2, 2, 2)},
+			{num: 1, host: "example.org", answer: net.IPv4(1, 1, 1, 1), client: net.IPv4(2, 2, 2, 1)},
+		},
+	}, {
+		name: "by_client_strict",
+		sCr: []searchCriterion{{
+			criterionType: ctClient,
+			strict:        true,
+			value:         "2.2.2.4",
+		}},
+		want: []tcAssertion{
+			{num: 0, host: "example.com", answer: net.IPv4(1, 1, 1, 4), client: net.IPv4(2, 2, 2, 4)},
+		},
+	}, {
+		name: "by_client_no_domain",
+		sCr: []searchCriterion{{
+			criterionType: ctClient,
+			strict:        false,
+			value:         "example",
+		}},
+		want: []tcAssertion{},
+	}, {
+		name: "by_question_type",
+		sCr: []searchCriterion{{
+			criterionType: ctQuestionType,
+			strict:        true,
+			value:         "AAAA",
+		}},
+		want: []tcAssertion{},
+	}, {
+		name: "by_question_type_and_domain",
+		sCr: []searchCriterion{{
+			criterionType: ctQuestionType,
+			strict:        true,
+			value:         "A",
+		}, {
+			criterionType: ctDomain,
+			strict:        false,
+			value:         ".com",
+		}},
+		want: []tcAssertion{
+			{num: 0, host: "example.com", answer: net.IPv4(1, 1, 1, 4), client: net.IPv4(2, 2, 2, 4)},
+		},
+	}, {
+		name: "by_response_code",
+		sCr: []searchCriterion{{
+			criterionType: ctResponseCode,
+			strict:        true,
+			value:         "NOERROR",
+		}, {
+			criterionType: ctDomain,
+			strict:        true,
+			value:         "example.org",
+		}},
+		want: []tcAssertion{
+			{num: 0, host: "example.org", answer: net.IPv4(1, 1, 1, 2), client: net.IPv4(2, 2, 2, 2)},
+			{num: 1, host: "example.org", answer: net.IPv4(1, 1, 1, 1), client: net.IPv4(2, 2, 2, 1)},
+		},
+	}, {
+		name: "by_response_code_nxdomain",
+		sCr: []searchCriterion{{
+			criterionType: ctResponseCode,
+			strict:        true,
+			value:         "NXDOMAIN",
+		}},
+		want: []tcAssertion{},
 	}}
 
 	for _, tc := range testCases {
@@ -228,6 +318,32 @@ func TestQueryLogMaxFileScanEntries(t *testing.T) {
 	}
 }
 
+func TestQueryLog_noCallbacks(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	l.Start()
+	t.Cleanup(l.Close)
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	ll, _ := l.search(newSearchParams())
+	require.Len(t, ll, 1)
+
+	assert.Equal(t, "example.org", ll[0].QHost)
+
+	body := strings.NewReader(`{"enabled":true,"interval":1}`)
+	r := httptest.NewRequest(http.MethodPut, "/control/querylog_config", body)
+	w := httptest.NewRecorder()
+
+	require.NotPanics(t, func() { l.handleQueryLogConfig(w, r) })
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
 func TestQueryLogFileDisabled(t *testing.T) {
 	l := newQueryLog(Config{
 		Enabled:     true,
@@ -249,6 +365,47 @@ func TestQueryLogFileDisabled(t *testing.T) {
 	assert.Equal(t, "example2.org", ll[1].QHost)
 }
 
+func TestQueryLog_maxSize(t *testing.T) {
+	const maxSize = 2048
+
+	dir := t.TempDir()
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MaxSize:     maxSize,
+		MemSize:     100,
+		BaseDir:     dir,
+	})
+
+	const entNum = 50
+	for i := 0; i < entNum; i++ {
+		addEntry(l, fmt.Sprintf("example%d.org", i), net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+		require.NoError(t, l.flushLogBuffer(true))
+	}
+
+	// The current file doesn't exist right after the rotation.
+	var total int64
+	for _, name := range []string{queryLogFileName, queryLogFileName + ".1"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if name == queryLogFileName && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		require.NoError(t, err)
+
+		total += fi.Size()
+	}
+
+	// Each file may exceed the half of the limit by a single record.
+	assert.Less(t, total, int64(maxSize+maxSize/2))
+
+	entries, _ := l.search(newSearchParams())
+	require.NotEmpty(t, entries)
+	require.Less(t, len(entries), entNum)
+
+	assert.Equal(t, fmt.Sprintf("example%d.org", entNum-1), entries[0].QHost)
+}
+
 func addEntry(l *queryLog, host string, answerStr, client net.IP) {
 	q := dns.Msg{
 		Question: []dns.Question{{
@@ -308,6 +465,10 @@ func assertLogEntry(t *testing.T, entry *logEntry, host string, answer, client n
 
 	ip := proxyutil.IPFromRR(msg.Answer[0]).To16()
 	assert.Equal(t, answer, ip)
+
+	require.Len(t, entry.Answers, 1)
+
+	assert.Equal(t, answer.String(), entry.Answers[0].Value)
 }
 
 func testEntries() (entries []*logEntry) {
@@ -378,3 +539,134 @@ func TestLogEntriesByTime_sort(t *testing.T) {
 			"%s %s", entries[i+1].Time, entries[i].Time)
 	}
 }
+
+func TestQueryLog_search_memoryFirst(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "file.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	addEntry(l, "memory.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "memory.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+
+	params := newSearchParams()
+	params.limit = 2
+
+	entries, oldest := l.search(params)
+	require.Len(t, entries, 2)
+
+	assertLogEntry(t, entries[0], "memory.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+	assertLogEntry(t, entries[1], "memory.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	// Request the next page using the cursor.
+	params.olderThan = oldest
+
+	entries, _ = l.search(params)
+	require.Len(t, entries, 1)
+
+	assertLogEntry(t, entries[0], "file.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+}
+
+func TestQueryLog_searchMemory_nonPositiveLimit(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "memory.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "memory.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	for _, limit := range []int{0, -1} {
+		params := newSearchParams()
+		params.limit = limit
+
+		entries, total := l.searchMemory(params, clientCache{})
+		assert.Empty(t, entries, limit)
+		assert.Equal(t, 2, total, limit)
+
+		entries, _ = l.search(params)
+		assert.Empty(t, entries, limit)
+	}
+}
+
+func TestLogEntry_responseCode(t *testing.T) {
+	nxdomain, err := (&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}).Pack()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		entry *logEntry
+		name  string
+		want  string
+	}{{
+		entry: &logEntry{Rcode: "SERVFAIL", Answer: nxdomain},
+		name:  "field",
+		want:  "SERVFAIL",
+	}, {
+		entry: &logEntry{Answer: nxdomain},
+		name:  "previous_version",
+		want:  "NXDOMAIN",
+	}, {
+		entry: &logEntry{},
+		name:  "no_answer",
+		want:  "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.entry.responseCode())
+		})
+	}
+}
+
+func TestLogEntry_answers(t *testing.T) {
+	withA, err := (&dns.Msg{
+		Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "example.org.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    10,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}},
+	}).Pack()
+	require.NoError(t, err)
+
+	structured := []*dnsAnswer{{Type: "A", Value: "5.6.7.8", TTL: 20}}
+
+	testCases := []struct {
+		entry *logEntry
+		name  string
+		want  []*dnsAnswer
+	}{{
+		entry: &logEntry{Answer: withA, Answers: structured},
+		name:  "structured",
+		want:  structured,
+	}, {
+		entry: &logEntry{Answer: withA, Answers: []*dnsAnswer{}},
+		name:  "structured_empty",
+		want:  []*dnsAnswer{},
+	}, {
+		entry: &logEntry{Answer: withA},
+		name:  "previous_version",
+		want:  []*dnsAnswer{{Type: "A", Value: "1.2.3.4", TTL: 10}},
+	}, {
+		entry: &logEntry{},
+		name:  "no_answer",
+		want:  nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.entry.answers())
+		})
+	}
+}
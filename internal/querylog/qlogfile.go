@@ -35,6 +35,13 @@ type QLogFile struct {
 	file     *os.File // the query log file
 	position int64    // current position in the file
 
+	// gzFile is the compressed query log file, which is decompressed into
+	// file on the first read.  It's nil if the file isn't compressed.
+	gzFile *os.File
+
+	// path is the path to the query log file.
+	path string
+
 	buffer      []byte // buffer that we've read from the file
 	bufferStart int64  // start of the buffer (in the file)
 	bufferLen   int    // buffer len
@@ -49,11 +56,36 @@ func NewQLogFile(path string) (*QLogFile, error) {
 		return nil, err
 	}
 
+	if strings.HasSuffix(path, gzipExt) {
+		// Don't decompress the file until it's actually read, since the newer
+		// files are usually enough.
+		return &QLogFile{
+			gzFile: f,
+			path:   path,
+		}, nil
+	}
+
 	return &QLogFile{
 		file: f,
+		path: path,
 	}, nil
 }
 
+// ensureFile decompresses the compressed query log file into a temporary one,
+// if it hasn't been done yet.  q.lock is expected to be locked.
+func (q *QLogFile) ensureFile() (err error) {
+	if q.file != nil {
+		return nil
+	}
+
+	q.file, err = decompressToTemp(q.gzFile)
+	if err != nil {
+		return fmt.Errorf("decompressing %q: %w", q.path, err)
+	}
+
+	return nil
+}
+
 // seekTS performs binary search in the query log file looking for a record
 // with the specified timestamp. Once the record is found, it sets
 // "position" so that the next ReadNext call returned that record.
@@ -78,6 +110,11 @@ func (q *QLogFile) seekTS(timestamp int64) (int64, int, error) {
 	// Empty the buffer
 	q.buffer = nil
 
+	err := q.ensureFile()
+	if err != nil {
+		return 0, 0, err
+	}
+
 	// First of all, check the file size
 	fileInfo, err := q.file.Stat()
 	if err != nil {
@@ -113,7 +150,7 @@ func (q *QLogFile) seekTS(timestamp int64) (int64, int, error) {
 			// If we're testing the same line twice then most likely
 			// the scope is too narrow and we won't find anything
 			// anymore in any other file.
-			return 0, depth, fmt.Errorf("looking up timestamp %d in %q: %w", timestamp, q.file.Name(), ErrTSNotFound)
+			return 0, depth, fmt.Errorf("looking up timestamp %d in %q: %w", timestamp, q.path, ErrTSNotFound)
 		} else if lineIdx == fileInfo.Size() {
 			return 0, depth, ErrTSTooLate
 		}
@@ -124,7 +161,7 @@ func (q *QLogFile) seekTS(timestamp int64) (int64, int, error) {
 		// Get the timestamp from the query log record
 		ts := readQLogTimestamp(line)
 		if ts == 0 {
-			return 0, depth, fmt.Errorf("looking up timestamp %d in %q: record %q has empty timestamp", timestamp, q.file.Name(), line)
+			return 0, depth, fmt.Errorf("looking up timestamp %d in %q: record %q has empty timestamp", timestamp, q.path, line)
 		}
 
 		if ts == timestamp {
@@ -146,7 +183,7 @@ func (q *QLogFile) seekTS(timestamp int64) (int64, int, error) {
 
 		depth++
 		if depth >= 100 {
-			return 0, depth, fmt.Errorf("looking up timestamp %d in %q: depth %d too high: %w", timestamp, q.file.Name(), depth, ErrTSNotFound)
+			return 0, depth, fmt.Errorf("looking up timestamp %d in %q: depth %d too high: %w", timestamp, q.path, depth, ErrTSNotFound)
 		}
 	}
 
@@ -167,6 +204,11 @@ func (q *QLogFile) SeekStart() (int64, error) {
 	// Empty the buffer
 	q.buffer = nil
 
+	err := q.ensureFile()
+	if err != nil {
+		return 0, err
+	}
+
 	// First of all, check the file size
 	fileInfo, err := q.file.Stat()
 	if err != nil {
@@ -192,6 +234,11 @@ func (q *QLogFile) ReadNext() (string, error) {
 		return "", io.EOF
 	}
 
+	err := q.ensureFile()
+	if err != nil {
+		return "", err
+	}
+
 	line, lineIdx, err := q.readNextLine(q.position)
 	if err != nil {
 		return "", err
@@ -210,8 +257,18 @@ func (q *QLogFile) ReadNext() (string, error) {
 }
 
 // Close frees the underlying resources
-func (q *QLogFile) Close() error {
-	return q.file.Close()
+func (q *QLogFile) Close() (err error) {
+	if q.gzFile == nil {
+		return q.file.Close()
+	}
+
+	err = q.gzFile.Close()
+	if q.file != nil {
+		err = errors.WithDeferred(err, q.file.Close())
+		err = errors.WithDeferred(err, os.Remove(q.file.Name()))
+	}
+
+	return err
 }
 
 // readNextLine reads the next line from the specified position
@@ -0,0 +1,179 @@
+package querylog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// qlogIndexSuffix is the suffix of the sidecar index file of a query log file.
+//
+// The index consists of the entries written for each batch of records appended
+// to the query log file.  Each entry is the timestamp of the first record of
+// the batch in nanoseconds followed by the offset of the batch within the file,
+// both are big-endian 64-bit integers.  Since the records are appended in the
+// chronological order, the entries are sorted by both fields.
+const qlogIndexSuffix = ".idx"
+
+// qlogIndexEntrySize is the size of a single index entry in bytes.
+const qlogIndexEntrySize = 16
+
+// qlogIndexPath returns the path to the index of the query log file at path.
+func qlogIndexPath(path string) (idxPath string) {
+	return path + qlogIndexSuffix
+}
+
+// appendQLogIndex appends the entry for the batch of records starting at offset
+// with the record made at ts to the index of the query log file at path.  If
+// offset is zero, the file has just been created, so the stale index, if any,
+// is replaced.
+func appendQLogIndex(path string, ts, offset int64) (err error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(qlogIndexPath(path), flag, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening index: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	var ent [qlogIndexEntrySize]byte
+	binary.BigEndian.PutUint64(ent[:8], uint64(ts))
+	binary.BigEndian.PutUint64(ent[8:], uint64(offset))
+
+	_, err = f.Write(ent[:])
+	if err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+
+	return nil
+}
+
+// rotateQLogIndex moves the index of the query log file at path to the one of
+// the file at newPath.  If there is no index of the former, the index of the
+// latter is removed, so that it's never used with the wrong file.
+func rotateQLogIndex(path, newPath string) (err error) {
+	err = os.Rename(qlogIndexPath(path), qlogIndexPath(newPath))
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(qlogIndexPath(newPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// indexedOffset returns the offset of the first batch of records within q,
+// which starts with a record made at or after ts, or the size of q if there is
+// no such batch.  ok is false if q has no valid index.
+func (q *QLogFile) indexedOffset(ts int64) (offset int64, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	path := q.path
+	data, err := os.ReadFile(qlogIndexPath(path))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Debug("querylog: reading index of %q: %s", path, err)
+		}
+
+		return 0, false
+	}
+
+	// The offsets of the compressed file are the ones within the
+	// decompressed data.
+	if err = q.ensureFile(); err != nil {
+		log.Debug("querylog: %s", err)
+
+		return 0, false
+	}
+
+	fi, err := q.file.Stat()
+	if err != nil {
+		log.Debug("querylog: getting info of %q: %s", path, err)
+
+		return 0, false
+	}
+
+	n := len(data) / qlogIndexEntrySize
+	if n == 0 || len(data)%qlogIndexEntrySize != 0 {
+		return 0, false
+	}
+
+	entry := func(i int) (entTS, entOffset int64) {
+		ent := data[i*qlogIndexEntrySize : (i+1)*qlogIndexEntrySize]
+
+		return int64(binary.BigEndian.Uint64(ent[:8])), int64(binary.BigEndian.Uint64(ent[8:]))
+	}
+
+	// Don't trust the index, which doesn't fit the file, since the file could
+	// have been replaced.
+	if _, lastOffset := entry(n - 1); lastOffset >= fi.Size() {
+		return 0, false
+	}
+
+	i := sort.Search(n, func(i int) (found bool) {
+		entTS, _ := entry(i)
+
+		return entTS >= ts
+	})
+	if i == n {
+		return fi.Size(), true
+	}
+
+	_, offset = entry(i)
+
+	return offset, true
+}
+
+// seekOffset sets the position so that the next ReadNext call returns the line
+// right before offset, which must be the start of a line or the size of the
+// file.
+func (q *QLogFile) seekOffset(offset int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.buffer = nil
+
+	// There is a line break before each line, see ReadNext.
+	q.position = offset - 1
+	if q.position < 0 {
+		q.position = 0
+	}
+}
+
+// seekIndexed sets the position of r to the newest record made before ts using
+// the indexes of the files, so that the next ReadNext call returns either this
+// record or one of the few newer records of the same batch.  ok is false if
+// any of the files, which needs to be looked at, has no valid index.  The older
+// files are only looked at if all the records of the newer ones are made at or
+// after ts, so that the compressed files are decompressed only when needed.
+func (r *QLogReader) seekIndexed(ts int64) (ok bool) {
+	for i := len(r.qFiles) - 1; i >= 0; i-- {
+		q := r.qFiles[i]
+
+		var offset int64
+		offset, ok = q.indexedOffset(ts)
+		if !ok {
+			return false
+		} else if offset == 0 && i > 0 {
+			continue
+		}
+
+		q.seekOffset(offset)
+		r.currentFile = i
+
+		break
+	}
+
+	return true
+}
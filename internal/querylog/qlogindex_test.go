@@ -0,0 +1,122 @@
+package querylog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newIndexTestRecords returns n records made each second starting at start.
+func newIndexTestRecords(start time.Time, n int) (recs [][]byte) {
+	for i := 0; i < n; i++ {
+		t := start.Add(time.Duration(i) * time.Second).Format(time.RFC3339Nano)
+		recs = append(recs, []byte(`{"T":"`+t+`","QH":"example.org"}`))
+	}
+
+	return recs
+}
+
+func TestFileStorage_index(t *testing.T) {
+	s := newFileStorage(filepath.Join(t.TempDir(), queryLogFileName))
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Write three batches of ten records each, rotating after the first one.
+	require.NoError(t, s.Append(newIndexTestRecords(start, 10)))
+	require.NoError(t, s.rename())
+	require.NoError(t, s.Append(newIndexTestRecords(start.Add(10*time.Second), 10)))
+	require.NoError(t, s.Append(newIndexTestRecords(start.Add(20*time.Second), 10)))
+
+	require.FileExists(t, qlogIndexPath(s.oldPath()))
+	require.FileExists(t, qlogIndexPath(s.path))
+
+	iterate := func(t *testing.T, olderThan time.Time) (times []time.Time) {
+		t.Helper()
+
+		err := s.Iterate(olderThan, func(rec string) (cont bool) {
+			times = append(times, time.Unix(0, readQLogTimestamp(rec)).UTC())
+
+			return true
+		})
+		require.NoError(t, err)
+
+		return times
+	}
+
+	testCases := []struct {
+		olderThan time.Time
+		wantFirst time.Time
+		name      string
+		wantLen   int
+	}{{
+		olderThan: start.Add(25 * time.Second),
+		wantFirst: start.Add(24 * time.Second),
+		name:      "middle_of_batch",
+		wantLen:   25,
+	}, {
+		olderThan: start.Add(20 * time.Second),
+		wantFirst: start.Add(19 * time.Second),
+		name:      "batch_start",
+		wantLen:   20,
+	}, {
+		olderThan: start.Add(5 * time.Second),
+		wantFirst: start.Add(4 * time.Second),
+		name:      "previous_file",
+		wantLen:   5,
+	}, {
+		olderThan: start.Add(time.Hour),
+		wantFirst: start.Add(29 * time.Second),
+		name:      "after_all",
+		wantLen:   30,
+	}, {
+		olderThan: start,
+		name:      "before_all",
+		wantLen:   0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			times := iterate(t, tc.olderThan)
+			require.Len(t, times, tc.wantLen)
+
+			if tc.wantLen > 0 {
+				assert.Equal(t, tc.wantFirst, times[0])
+			}
+		})
+	}
+
+	t.Run("seek", func(t *testing.T) {
+		r, err := NewQLogReader([]string{s.oldPath(), s.path})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+
+		require.True(t, r.seekIndexed(start.Add(20*time.Second).UnixNano()))
+
+		line, err := r.ReadNext()
+		require.NoError(t, err)
+
+		assert.Equal(t, start.Add(19*time.Second).UnixNano(), readQLogTimestamp(line))
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		// Replace the current file with a smaller one, which the index
+		// doesn't fit.
+		require.NoError(t, os.WriteFile(s.path, newIndexTestRecords(start.Add(20*time.Second), 1)[0], 0o644))
+
+		r, err := NewQLogReader([]string{s.path})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+
+		assert.False(t, r.seekIndexed(start.Add(20*time.Second).UnixNano()))
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		require.NoError(t, s.Clear())
+
+		assert.NoFileExists(t, qlogIndexPath(s.oldPath()))
+		assert.NoFileExists(t, qlogIndexPath(s.path))
+	})
+}
@@ -2,12 +2,13 @@ package querylog
 
 import (
 	"net"
-	"path/filepath"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/timeutil"
@@ -26,26 +27,104 @@ type QueryLog interface {
 
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(c *Config)
+
+	// Configure validates and applies the parameters of the memory buffer of
+	// c, MemSize and FlushInterval, without restarting the query log.
+	Configure(c *Config) (err error)
+
+	// ShouldLog returns false if the queries for host made by the client with
+	// ip and clientID are ignored and must neither be logged nor counted in
+	// the statistics.  ip must not be anonymized.
+	ShouldLog(host string, ip net.IP, clientID string) (ok bool)
+
+	// WriteStats returns the numbers of the entries written to the storage and
+	// dropped since the start.
+	WriteStats() (s *WriteStats)
 }
 
 // Config is the query log configuration structure.
 type Config struct {
-	// Anonymizer processes the IP addresses to anonymize those if needed.
+	// Anonymizer processes the IP addresses to anonymize those if needed.  It
+	// is updated according to AnonymizationMode when AnonymizeClientIP is
+	// changed via the HTTP API.
 	Anonymizer *aghnet.IPMut
 
-	// ConfigModified is called when the configuration is changed, for
-	// example by HTTP requests.
+	// AnonymizationMode is the way the clients' IP addresses are anonymized.
+	// If empty, AnonymizationModeMask is used.
+	AnonymizationMode AnonymizationMode
+
+	// AnonymizationKey is the per-installation key used by
+	// AnonymizationModeHash.  See [ReadAnonymizationKey].
+	AnonymizationKey []byte
+
+	// ConfigModified, if not nil, is called when the configuration is
+	// changed, for example by HTTP requests.
 	ConfigModified func()
 
-	// HTTPRegister registers an HTTP handler.
+	// HTTPRegister, if not nil, registers the handlers of the HTTP API.
 	HTTPRegister aghhttp.RegisterFunc
 
-	// FindClient returns client information by their IDs.
+	// FindClient, if not nil, returns client information by their IDs.
 	FindClient func(ids []string) (c *Client, err error)
 
+	// CheckHost, if not nil, checks the hosts against the current filtering
+	// rules.  It's used to replay the logged queries.
+	CheckHost CheckHostFunc
+
+	// ResolveClient, if not nil, returns the identifiers of the client with
+	// the id, such as the IP addresses leased to the MAC address, to show the
+	// query log of the client.  See [ResolveClientFunc].
+	ResolveClient ResolveClientFunc
+
+	// CheckClientAccess, if not nil, checks if the user making the request may
+	// see the query log of the client.  See [ClientAccessFunc].
+	CheckClientAccess ClientAccessFunc
+
+	// ImportStats, if not nil, passes the statistics data of the entries
+	// imported from another software to the statistics.  See
+	// [stats.Interface.Import].
+	ImportStats func(entries []stats.Entry)
+
+	// OnWriteEvent, if not nil, is called when writing the entries to the
+	// storage starts failing, when the pending entries are dropped since the
+	// write queue is full, and when the writing recovers.
+	OnWriteEvent func(e *WriteEvent)
+
+	// Syslog is the configuration of forwarding the entries to a remote
+	// syslog server in addition to the storage.
+	Syslog SyslogConfig
+
+	// Exporter is the configuration of exporting the entries into an external
+	// data store, such as ClickHouse or Elasticsearch, in addition to the
+	// storage.
+	Exporter ExporterConfig
+
+	// Archive is the configuration of uploading the rotated log files into an
+	// S3-compatible object storage.  It's only used by BackendFile and
+	// BackendDaily.
+	Archive ArchiveConfig
+
+	// Storage is the persistent storage of the query log.  If nil, the
+	// built-in storage chosen by Backend is used.
+	Storage Storage
+
+	// Backend is the built-in storage implementation keeping the entries
+	// within BaseDir.  If empty, BackendFile is used.  It's ignored if Storage
+	// is not nil.
+	Backend Backend
+
 	// BaseDir is the base directory for log files.
 	BaseDir string
 
+	// IgnoredDomains are the domain names, which queries aren't logged.  The
+	// wildcards, such as "*.example.org", are supported.
+	IgnoredDomains []string
+
+	// IgnoredClients are the IP addresses, CIDRs, and ClientIDs of the
+	// clients, which queries aren't logged.  The wildcards, such as
+	// "192.168.1.*", are supported.
+	IgnoredClients []string
+
 	// RotationIvl is the interval for log rotation.  After that period, the
 	// old log file will be renamed, NOT deleted, so the actual log
 	// retention time is twice the interval.  The value must be one of:
@@ -58,6 +137,50 @@ type Config struct {
 	//
 	RotationIvl time.Duration
 
+	// MaxSize is the maximum total size of the log files in bytes.  Once it's
+	// exceeded, the oldest file is deleted even if the rotation interval hasn't
+	// passed yet.  If zero, the size is unlimited.  It's only used by
+	// BackendFile and BackendDaily.
+	MaxSize uint64
+
+	// ClientRetention is the period, after which the client IP addresses are
+	// replaced with the unspecified ones and the ClientIDs and the EDNS Client
+	// Subnets are removed from the stored records, while the rest of the
+	// records is kept until the rotation.  It's checked once an hour.  If
+	// zero, the client identifiers are kept.  It's only used by the built-in
+	// storages.
+	ClientRetention time.Duration
+
+	// CoalesceIvl is the coalescing window.  The identical queries made by
+	// the same client within it after the first one are only counted in the
+	// entry of the first one.  The entries are written to the storage once
+	// their windows end.  If zero, every query is recorded.
+	CoalesceIvl time.Duration
+
+	// EncryptionPassphrase is the passphrase, from which the key encrypting
+	// the stored records is derived.  The salt is kept in the file in
+	// BaseDir.  It's ignored if EncryptionKeyFile is set.
+	EncryptionPassphrase string
+
+	// EncryptionKeyFile is the path to the file with the hex-encoded 256-bit
+	// key encrypting the stored records.
+	//
+	// If either EncryptionKeyFile or EncryptionPassphrase is set, the records
+	// are encrypted with AES-GCM, which is only supported by BackendFile and
+	// BackendDaily.  If the key can't be loaded, the records aren't stored.
+	EncryptionKeyFile string
+
+	// CompressionLevel is the gzip compression level of the rotated log
+	// files, from gzip.HuffmanOnly to gzip.BestCompression.  If zero,
+	// gzip.DefaultCompression is used.  It's only used by BackendFile and
+	// BackendDaily.
+	CompressionLevel int
+
+	// FlushInterval is the interval, after which the entries of the memory
+	// buffer are written to the storage even if the buffer isn't full yet.  If
+	// zero, the entries are only written once the buffer is full.
+	FlushInterval time.Duration
+
 	// MemSize is the number of entries kept in a memory buffer before they
 	// are flushed to disk.
 	MemSize uint32
@@ -68,9 +191,21 @@ type Config struct {
 	// FileEnabled tells if the query log writes logs to files.
 	FileEnabled bool
 
+	// Compress tells if the rotated log files are compressed with gzip in the
+	// background.  It's only used by BackendFile and BackendDaily, which
+	// only compresses the files of the days before yesterday.
+	Compress bool
+
 	// AnonymizeClientIP tells if the query log should anonymize clients' IP
 	// addresses.
 	AnonymizeClientIP bool
+
+	// Hashed tells if the domain names, the client IP addresses, and the
+	// ClientIDs are only stored as their hashes salted with AnonymizationKey.
+	// The answers and the other data revealing them aren't stored at all.
+	// Whether a known domain name appears in such a log can be checked with
+	// the GET /control/querylog/hashed_domain HTTP API.
+	Hashed bool
 }
 
 // AddParams is the parameters for adding an entry.
@@ -106,8 +241,15 @@ type AddParams struct {
 	// Cached indicates if the response is served from cache.
 	Cached bool
 
+	// CacheBypassed indicates if the DNS cache has been bypassed for the
+	// client.
+	CacheBypassed bool
+
 	// AuthenticatedData shows if the response had the AD bit set.
 	AuthenticatedData bool
+
+	// DNSSEC is the status of the DNSSEC validation of the response.
+	DNSSEC DNSSECStatus
 }
 
 // validate returns an error if the parameters aren't valid.
@@ -140,15 +282,36 @@ func newQueryLog(conf Config) (l *queryLog) {
 		}
 	}
 
+	// The buffer must be able to hold at least one entry.
+	memSize := int(conf.MemSize)
+	if memSize <= 0 {
+		memSize = 1
+	}
+
 	l = &queryLog{
 		findClient: findClient,
 
-		logFile:    filepath.Join(conf.BaseDir, queryLogFileName),
+		buffer: aghalg.NewRingBuffer[*logEntry](memSize),
+
+		storage:    conf.Storage,
 		anonymizer: conf.Anonymizer,
+
+		flushCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+
+		jobs: newJobRegistry(),
+	}
+
+	if l.anonymizer == nil {
+		l.anonymizer = aghnet.NewIPMut(nil)
 	}
 
 	l.conf = &Config{}
 	*l.conf = conf
+	l.conf.MemSize = uint32(memSize)
+	if l.conf.ConfigModified == nil {
+		l.conf.ConfigModified = func() {}
+	}
 
 	if !checkInterval(conf.RotationIvl) {
 		log.Info(
@@ -158,5 +321,92 @@ func newQueryLog(conf Config) (l *queryLog) {
 		l.conf.RotationIvl = timeutil.Day
 	}
 
+	if err := validateFlushInterval(conf.FlushInterval); err != nil {
+		log.Info("querylog: warning: %s, writing full buffers only", err)
+		l.conf.FlushInterval = 0
+	}
+
+	if conf.ClientRetention < 0 {
+		log.Info("querylog: warning: negative client retention %s, keeping clients", conf.ClientRetention)
+		l.conf.ClientRetention = 0
+	}
+
+	if conf.CoalesceIvl > 0 {
+		l.coalescer = newCoalescer(conf.CoalesceIvl)
+	} else if conf.CoalesceIvl < 0 {
+		log.Info("querylog: warning: negative coalescing window %s, disabling", conf.CoalesceIvl)
+		l.conf.CoalesceIvl = 0
+	}
+
+	if err := conf.AnonymizationMode.validate(); err != nil {
+		log.Info("querylog: warning: %s, setting to %q", err, AnonymizationModeMask)
+		l.conf.AnonymizationMode = AnonymizationModeMask
+	}
+
+	if err := conf.Syslog.validate(); err != nil {
+		log.Info("querylog: warning: %s, disabling syslog forwarding", err)
+		l.conf.Syslog.Enabled = false
+	}
+
+	if err := validateCompressionLevel(conf.CompressionLevel); err != nil {
+		log.Info("querylog: warning: %s, using default", err)
+		l.conf.CompressionLevel = 0
+	}
+
+	ignored, err := newIgnoreList(conf.IgnoredDomains, conf.IgnoredClients)
+	if err != nil {
+		log.Info("querylog: warning: %s, not ignoring anything", err)
+		l.conf.IgnoredDomains, l.conf.IgnoredClients = nil, nil
+	}
+
+	l.ignored.Store(ignored)
+
+	if l.conf.Hashed {
+		l.hashKey = newHashKey(conf.AnonymizationKey)
+	}
+
+	if l.storage == nil {
+		l.storage = newStorage(l.conf)
+		l.storage = l.encryptStorage(l.storage)
+	}
+
+	if l.conf.Syslog.Enabled {
+		l.syslog = newSyslogSink(&l.conf.Syslog, l.anonymizer)
+	}
+
+	if err := conf.Exporter.validate(); err != nil {
+		log.Info("querylog: warning: %s, disabling export", err)
+		l.conf.Exporter.Enabled = false
+	}
+
+	if l.conf.Exporter.Enabled {
+		l.exporter = newExporterSink(&l.conf.Exporter, l.anonymizer)
+	}
+
+	if err := conf.Archive.validate(); err != nil {
+		log.Info("querylog: warning: %s, disabling archiving", err)
+		l.conf.Archive.Enabled = false
+	}
+
+	if l.conf.Archive.Enabled {
+		if _, ok := l.storage.(archivingStorage); ok {
+			l.archiver = newArchiver(&l.conf.Archive)
+		} else {
+			log.Info("querylog: warning: the storage doesn't support archiving")
+		}
+	}
+
+	// The rotated files are removed before all their records are stripped,
+	// so they're never archived.
+	_, isStripping := l.storage.(clientStrippingStorage)
+	if l.archiver != nil && isStripping && l.conf.ClientRetention >= l.conf.RotationIvl {
+		log.Info(
+			"querylog: warning: client retention %s isn't shorter than rotation interval %s, "+
+				"not archiving rotated files",
+			l.conf.ClientRetention,
+			l.conf.RotationIvl,
+		)
+	}
+
 	return l
 }
@@ -1,95 +1,259 @@
 package querylog
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 )
 
-// flushLogBuffer flushes the current buffer to file and resets the current buffer
-func (l *queryLog) flushLogBuffer(fullFlush bool) error {
-	if !l.conf.FileEnabled {
-		return nil
+// fileStorage is the [Storage] keeping the records in two files: the current
+// one and the previous one, which has the ".1" suffix.
+type fileStorage struct {
+	// mu protects the files from concurrent modification.
+	mu *sync.Mutex
+
+	// path is the path to the current file.
+	path string
+
+	// maxSize is the maximum total size of the files in bytes.  Once the
+	// current file exceeds the half of it, the file becomes the previous one,
+	// and the previous one is deleted, regardless of the rotation interval.  If
+	// zero, the size is unlimited.
+	maxSize uint64
+
+	// compressMu prevents compressing the previous file concurrently.
+	compressMu *sync.Mutex
+
+	// compressLevel is the gzip compression level of the previous file.  If
+	// zero, gzip.DefaultCompression is used.
+	compressLevel int
+
+	// compress tells if the previous file is compressed in the background
+	// once it's rotated.
+	compress bool
+}
+
+// newFileStorage returns a new file storage with the current file at path.
+func newFileStorage(path string) (s *fileStorage) {
+	return &fileStorage{
+		mu:         &sync.Mutex{},
+		path:       path,
+		compressMu: &sync.Mutex{},
 	}
+}
+
+// type check
+var _ Storage = (*fileStorage)(nil)
 
-	l.fileFlushLock.Lock()
-	defer l.fileFlushLock.Unlock()
+// oldPath returns the path to the previous file.
+func (s *fileStorage) oldPath() (p string) {
+	return s.path + ".1"
+}
 
-	// flush remainder to file
-	l.bufferLock.Lock()
-	needFlush := len(l.buffer) >= int(l.conf.MemSize)
-	if !needFlush && !fullFlush {
-		l.bufferLock.Unlock()
+// Append implements the [Storage] interface for *fileStorage.
+func (s *fileStorage) Append(records [][]byte) (err error) {
+	if len(records) == 0 {
 		return nil
 	}
-	flushBuffer := l.buffer
-	l.buffer = nil
-	l.flushPending = false
-	l.bufferLock.Unlock()
-	err := l.flushToFile(flushBuffer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size, err := appendToFile(s.path, records)
 	if err != nil {
-		log.Error("Saving querylog to file failed: %s", err)
 		return err
 	}
-	return nil
+
+	return s.rotateBySize(size)
 }
 
-// flushToFile saves the specified log entries to the query log file
-func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
-	if len(buffer) == 0 {
-		log.Debug("querylog: there's nothing to write to a file")
-		return nil
+// Sync implements the [syncingStorage] interface for *fileStorage.
+func (s *fileStorage) Sync() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return syncFile(s.path)
+}
+
+// appendToFile appends the records to the query log file at path, creating it
+// if necessary, and indexes them.  size is the size of the file after
+// appending.
+func appendToFile(path string, records [][]byte) (size int64, err error) {
+	n := 0
+	for _, rec := range records {
+		n += len(rec) + 1
 	}
-	start := time.Now()
 
-	var b bytes.Buffer
-	e := json.NewEncoder(&b)
-	for _, entry := range buffer {
-		err = e.Encode(entry)
-		if err != nil {
-			log.Error("Failed to marshal entry: %s", err)
+	b := make([]byte, 0, n)
+	for _, rec := range records {
+		b = append(b, rec...)
+		b = append(b, '\n')
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("getting file info: %w", err)
+	}
 
-			return err
+	n, err = f.Write(b)
+	if err != nil {
+		return 0, fmt.Errorf("writing: %w", err)
+	}
+
+	log.Debug("querylog: ok %q: %v bytes written", path, n)
+
+	// The missing index entries only make the seeking less precise, so don't
+	// fail the writing.
+	if ts := readQLogTimestamp(string(records[0])); ts != 0 {
+		err = appendQLogIndex(path, ts, fi.Size())
+		if err != nil {
+			log.Error("querylog: indexing %q: %s", path, err)
 		}
 	}
 
-	elapsed := time.Since(start)
-	log.Debug("%d elements serialized via json in %v: %d kB, %v/entry, %v/entry", len(buffer), elapsed, b.Len()/1024, float64(b.Len())/float64(len(buffer)), elapsed/time.Duration(len(buffer)))
+	return fi.Size() + int64(n), nil
+}
 
-	var zb bytes.Buffer
-	filename := l.logFile
-	zb = b
+// rotateBySize makes the current file of size bytes the previous one, deleting
+// the latter, if it exceeds the half of the maximum size.  s.mu is expected to
+// be locked.
+func (s *fileStorage) rotateBySize(size int64) (err error) {
+	if s.maxSize == 0 || uint64(size) <= s.maxSize/2 {
+		return nil
+	}
 
-	l.fileWriteLock.Lock()
-	defer l.fileWriteLock.Unlock()
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	err = s.rename()
 	if err != nil {
-		log.Error("failed to create file \"%s\": %s", filename, err)
-		return err
+		return fmt.Errorf("rotating by size: %w", err)
 	}
-	defer func() { err = errors.WithDeferred(err, f.Close()) }()
 
-	n, err := f.Write(zb.Bytes())
+	log.Info("querylog: %s exceeded %d bytes, rotated", s.path, s.maxSize/2)
+
+	s.startCompression()
+
+	return nil
+}
+
+// rename makes the current file the previous one along with its index,
+// removing the compressed previous file, if any.  s.mu is expected to be
+// locked.
+func (s *fileStorage) rename() (err error) {
+	for _, p := range []string{s.gzOldPath(), qlogIndexPath(s.gzOldPath())} {
+		err = removeIfExists(p)
+		if err != nil {
+			return fmt.Errorf("removing compressed file: %w", err)
+		}
+	}
+
+	err = os.Rename(s.path, s.oldPath())
 	if err != nil {
-		log.Error("Couldn't write to file: %s", err)
 		return err
 	}
 
-	log.Debug("querylog: ok \"%s\": %v bytes written", filename, n)
+	err = rotateQLogIndex(s.path, s.oldPath())
+	if err != nil {
+		return fmt.Errorf("rotating index: %w", err)
+	}
 
 	return nil
 }
 
-func (l *queryLog) rotate() error {
-	from := l.logFile
-	to := l.logFile + ".1"
+// Iterate implements the [Storage] interface for *fileStorage.
+func (s *fileStorage) Iterate(olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+	// Open the files under the lock, since the previous one could be replaced
+	// by the compressed one in the meantime.
+	s.mu.Lock()
+	r, err := NewQLogReader([]string{s.gzOldPath(), s.oldPath(), s.path})
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("opening qlog reader: %w", err)
+	}
+
+	return iterateReader(r, olderThan, f)
+}
+
+// iterateReader calls f for each record read by r, from newer to older,
+// starting with the newest one older than olderThan, if it's not zero.  It
+// stops once f returns false.  r is closed afterwards.
+func iterateReader(r *QLogReader, olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	var olderThanNano int64
+	if olderThan.IsZero() {
+		err = r.SeekStart()
+	} else {
+		olderThanNano = olderThan.UnixNano()
+		if !r.seekIndexed(olderThanNano) {
+			err = r.seekTS(olderThanNano)
+			if errors.Is(err, ErrTSNotFound) {
+				// olderThan isn't the time of any record, so read the files
+				// from the newest record and skip the newer ones.
+				err = r.SeekStart()
+			}
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("seeking to %s: %w", olderThan, err)
+	}
+
+	for {
+		var line string
+		line, err = r.ReadNext()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading: %w", err)
+		}
+
+		if olderThanNano != 0 && readQLogTimestamp(line) >= olderThanNano {
+			continue
+		}
+
+		if !f(line) {
+			return nil
+		}
+	}
+}
+
+// Rotate implements the [Storage] interface for *fileStorage.  The current
+// file becomes the previous one once its oldest record is older than ivl, so
+// the records are kept for at least ivl and at most twice as long.
+func (s *fileStorage) Rotate(ivl time.Duration) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Also compress the previous file left uncompressed, for example, when
+	// the compression has just been enabled.
+	defer s.startCompression()
+
+	oldest, err := s.readFileFirstTimeValue()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("reading oldest record: %w", err)
+	}
+
+	if rot, now := oldest.Add(ivl), time.Now(); rot.After(now) {
+		log.Debug(
+			"querylog: %s <= %s, not rotating",
+			now.Format(time.RFC3339),
+			rot.Format(time.RFC3339),
+		)
+
+		return nil
+	}
 
-	err := os.Rename(from, to)
+	err = s.rename()
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			log.Debug("querylog: no log to rotate")
@@ -100,14 +264,16 @@ func (l *queryLog) rotate() error {
 		return fmt.Errorf("failed to rename old file: %w", err)
 	}
 
-	log.Debug("querylog: renamed %s into %s", from, to)
+	log.Debug("querylog: renamed %s into %s", s.path, s.oldPath())
 
 	return nil
 }
 
-func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
+// readFileFirstTimeValue returns the time of the oldest record in the current
+// file.
+func (s *fileStorage) readFileFirstTimeValue() (first time.Time, err error) {
 	var f *os.File
-	f, err = os.Open(l.logFile)
+	f, err = os.Open(s.path)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -132,52 +298,29 @@ func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
 	return t, nil
 }
 
-func (l *queryLog) periodicRotate() {
-	defer log.OnPanic("querylog: rotating")
-
-	l.checkAndRotate()
-
-	// rotationCheckIvl is the period of time between checking the need for
-	// rotating log files.  It's smaller of any available rotation interval to
-	// increase time accuracy.
-	//
-	// See https://github.com/AdguardTeam/AdGuardHome/issues/3823.
-	const rotationCheckIvl = 1 * time.Hour
-
-	rotations := time.NewTicker(rotationCheckIvl)
-	defer rotations.Stop()
-
-	for range rotations.C {
-		l.checkAndRotate()
-	}
-}
-
-// checkAndRotate rotates log files if those are older than the specified
-// rotation interval.
-func (l *queryLog) checkAndRotate() {
-	oldest, err := l.readFileFirstTimeValue()
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("querylog: reading oldest record for rotation: %s", err)
-
-		return
-	}
-
-	if rot, now := oldest.Add(l.conf.RotationIvl), time.Now(); rot.After(now) {
-		log.Debug(
-			"querylog: %s <= %s, not rotating",
-			now.Format(time.RFC3339),
-			rot.Format(time.RFC3339),
-		)
-
-		return
+// Clear implements the [Storage] interface for *fileStorage.
+func (s *fileStorage) Clear() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, p := range []string{
+		s.gzOldPath(),
+		qlogIndexPath(s.gzOldPath()),
+		s.oldPath(),
+		qlogIndexPath(s.oldPath()),
+		s.path,
+		qlogIndexPath(s.path),
+	} {
+		err = os.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
 	}
 
-	err = l.rotate()
-	if err != nil {
-		log.Error("querylog: rotating: %s", err)
-
-		return
+	if len(errs) > 0 {
+		return errors.List("removing files", errs...)
 	}
 
-	log.Debug("querylog: rotated successfully")
+	return nil
 }
@@ -0,0 +1,321 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+)
+
+// repairIndexBatch is the number of records per entry of the index rebuilt by
+// the repair.
+const repairIndexBatch = 1000
+
+// repairingStorage is a [Storage] able to check the integrity of its records
+// and to repair them.
+type repairingStorage interface {
+	Storage
+
+	// Repair checks the records of each file and, unless dryRun is true,
+	// removes the corrupt ones, restores the chronological order of the rest,
+	// and rebuilds the index of each file, which needs that.
+	Repair(dryRun bool) (reports []*repairReport, err error)
+}
+
+// type check
+var (
+	_ repairingStorage = (*fileStorage)(nil)
+	_ repairingStorage = (*dailyStorage)(nil)
+)
+
+// repairReport is the result of checking and repairing a single query log
+// file.
+type repairReport struct {
+	// File is the name of the file.
+	File string `json:"file"`
+
+	// Records is the number of the valid records in the file.
+	Records int `json:"records"`
+
+	// Corrupt is the number of the lines, which aren't valid records, for
+	// example the ones truncated by a power loss.
+	Corrupt int `json:"corrupt"`
+
+	// OutOfOrder is the number of the records made before some of the
+	// preceding ones, for example because of the clock adjustment.
+	OutOfOrder int `json:"out_of_order"`
+
+	// IndexValid is false if the index of the file is missing or doesn't
+	// match the records.
+	IndexValid bool `json:"index_valid"`
+
+	// Repaired is true if the file or its index has been rewritten.
+	Repaired bool `json:"repaired"`
+}
+
+// needsRepair returns true if the file or its index should be rewritten.
+func (rep *repairReport) needsRepair() (ok bool) {
+	return rep.Corrupt > 0 || rep.OutOfOrder > 0 || !rep.IndexValid
+}
+
+// repairRecord is a valid record of a query log file.
+type repairRecord struct {
+	// line is the record including the trailing newline.
+	line string
+
+	// ts is the time the record is made at in nanoseconds.
+	ts int64
+}
+
+// repairFile checks the query log file at path, which is gzipped if it has the
+// gzipExt extension, and, unless dryRun is true, rewrites it and its index if
+// needed.  level is the gzip compression level.  rep is nil if there is no
+// such file.  The whole file is read into memory.
+func repairFile(path string, dryRun bool, level int) (rep *repairReport, err error) {
+	records, rep, err := readRepairRecords(path)
+	if err != nil || rep == nil {
+		return nil, err
+	}
+
+	idx, err := os.ReadFile(qlogIndexPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+
+	rep.IndexValid = len(records) == 0 || validQLogIndex(idx, records)
+	if dryRun || !rep.needsRepair() {
+		return rep, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) (less bool) { return records[i].ts < records[j].ts })
+
+	buf := &bytes.Buffer{}
+	idx = idx[:0]
+	for i, rec := range records {
+		if i%repairIndexBatch == 0 {
+			var ent [qlogIndexEntrySize]byte
+			binary.BigEndian.PutUint64(ent[:8], uint64(rec.ts))
+			binary.BigEndian.PutUint64(ent[8:], uint64(buf.Len()))
+			idx = append(idx, ent[:]...)
+		}
+
+		buf.WriteString(rec.line)
+	}
+
+	err = rewriteFile(path, buf, strings.HasSuffix(path, gzipExt), level)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(idx) == 0 {
+		err = removeIfExists(qlogIndexPath(path))
+	} else {
+		err = maybe.WriteFile(qlogIndexPath(path), idx, 0o644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("writing index: %w", err)
+	}
+
+	rep.Repaired = true
+
+	return rep, nil
+}
+
+// readRepairRecords reads the valid records of the query log file at path and
+// counts the invalid ones.  rep is nil if there is no such file.
+func readRepairRecords(path string) (records []*repairRecord, rep *repairReport, err error) {
+	r, closer, err := openQLogFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	} else if errors.Is(err, io.EOF) {
+		// An empty gzipped file.
+		return nil, &repairReport{File: filepath.Base(path)}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, closer.Close()) }()
+
+	rep = &repairReport{File: filepath.Base(path)}
+
+	var last int64
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("reading: %w", err)
+		}
+
+		rec := strings.TrimSuffix(line, "\n")
+		if strings.TrimSpace(rec) == "" {
+			continue
+		}
+
+		var ts int64
+		if json.Valid([]byte(rec)) {
+			ts = readQLogTimestamp(rec)
+		}
+
+		if ts == 0 {
+			rep.Corrupt++
+
+			continue
+		}
+
+		if ts < last {
+			rep.OutOfOrder++
+		} else {
+			last = ts
+		}
+
+		records = append(records, &repairRecord{line: rec + "\n", ts: ts})
+	}
+
+	rep.Records = len(records)
+
+	return records, rep, nil
+}
+
+// validQLogIndex returns true if each entry of the index idx points at the
+// start of the record made at the time of the entry, and the entries are
+// sorted.  records must be in the order of the file with no invalid lines.
+func validQLogIndex(idx []byte, records []*repairRecord) (ok bool) {
+	if len(idx) == 0 || len(idx)%qlogIndexEntrySize != 0 {
+		return false
+	}
+
+	starts := make(map[int64]int64, len(records))
+	var off int64
+	for _, rec := range records {
+		starts[off] = rec.ts
+		off += int64(len(rec.line))
+	}
+
+	var prevTS, prevOff int64 = 0, -1
+	for ; len(idx) > 0; idx = idx[qlogIndexEntrySize:] {
+		ts := int64(binary.BigEndian.Uint64(idx[:8]))
+		entOff := int64(binary.BigEndian.Uint64(idx[8:qlogIndexEntrySize]))
+		if recTS, has := starts[entOff]; !has || recTS != ts || ts < prevTS || entOff <= prevOff {
+			return false
+		}
+
+		prevTS, prevOff = ts, entOff
+	}
+
+	return true
+}
+
+// repairFiles runs repairFile for each of paths and collects the reports.
+func repairFiles(paths []string, dryRun bool, level int) (reports []*repairReport, err error) {
+	var errs []error
+	reports = []*repairReport{}
+	for _, p := range paths {
+		var rep *repairReport
+		rep, err = repairFile(p, dryRun, level)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("repairing %q: %w", p, err))
+		} else if rep != nil {
+			reports = append(reports, rep)
+		}
+	}
+
+	if len(errs) > 0 {
+		return reports, errors.List("repairing files", errs...)
+	}
+
+	return reports, nil
+}
+
+// Repair implements the [repairingStorage] interface for *fileStorage.
+func (s *fileStorage) Repair(dryRun bool) (reports []*repairReport, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return repairFiles([]string{s.gzOldPath(), s.oldPath(), s.path}, dryRun, s.compressLevel)
+}
+
+// Repair implements the [repairingStorage] interface for *dailyStorage.
+func (s *dailyStorage) Repair(dryRun bool) (reports []*repairReport, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, df := range files {
+		paths = append(paths, df.path)
+	}
+
+	return repairFiles(paths, dryRun, s.compressLevel)
+}
+
+// repairReq is the request body for the POST /control/querylog_repair HTTP
+// API.
+type repairReq struct {
+	// DryRun defines if the files should only be checked.
+	DryRun bool `json:"dry_run"`
+}
+
+// repairResp is the response body for the POST /control/querylog_repair HTTP
+// API.
+type repairResp struct {
+	Files []*repairReport `json:"files"`
+}
+
+// handleQueryLogRepair is the handler for the POST /control/querylog_repair
+// HTTP API.  It checks the query log files for the corrupt and out-of-order
+// records and, unless it's a dry run, repairs them and rebuilds the indexes.
+func (l *queryLog) handleQueryLogRepair(w http.ResponseWriter, r *http.Request) {
+	req := &repairReq{}
+	err := aghhttp.DecodeJSON(r, req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	rs, ok := l.storage.(repairingStorage)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusNotImplemented, "repairing is not supported by the backend")
+
+		return
+	}
+
+	reports, err := rs.Repair(req.DryRun)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	var corrupt, outOfOrder int
+	for _, rep := range reports {
+		corrupt += rep.Corrupt
+		outOfOrder += rep.OutOfOrder
+	}
+
+	log.Info(
+		"querylog: checked %d files, %d corrupt and %d out-of-order records, dry run: %t",
+		len(reports),
+		corrupt,
+		outOfOrder,
+		req.DryRun,
+	)
+
+	_ = aghhttp.WriteJSONResponse(w, r, &repairResp{Files: reports})
+}
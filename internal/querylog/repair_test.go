@@ -0,0 +1,98 @@
+package querylog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage_Repair(t *testing.T) {
+	s := newFileStorage(filepath.Join(t.TempDir(), queryLogFileName))
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	recs := newStripTestRecords(start, 5)
+	require.NoError(t, s.Append(recs[2:]))
+
+	// Append a record with the time adjusted back and a record truncated by
+	// a power loss.
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+
+	_, err = f.WriteString(string(recs[0]) + "\n" + string(recs[1])[:20])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	t.Run("dry_run", func(t *testing.T) {
+		reports, rerr := s.Repair(true)
+		require.NoError(t, rerr)
+		require.Len(t, reports, 1)
+
+		assert.Equal(t, &repairReport{
+			File:       queryLogFileName,
+			Records:    4,
+			Corrupt:    1,
+			OutOfOrder: 1,
+			IndexValid: true,
+			Repaired:   false,
+		}, reports[0])
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		reports, rerr := s.Repair(false)
+		require.NoError(t, rerr)
+		require.Len(t, reports, 1)
+
+		assert.True(t, reports[0].Repaired)
+
+		data, rerr := os.ReadFile(s.path)
+		require.NoError(t, rerr)
+
+		want := []string{string(recs[0]), string(recs[2]), string(recs[3]), string(recs[4])}
+		assert.Equal(t, strings.Join(want, "\n")+"\n", string(data))
+	})
+
+	t.Run("repaired", func(t *testing.T) {
+		reports, rerr := s.Repair(false)
+		require.NoError(t, rerr)
+		require.Len(t, reports, 1)
+
+		assert.Equal(t, &repairReport{
+			File:       queryLogFileName,
+			Records:    4,
+			IndexValid: true,
+		}, reports[0])
+	})
+}
+
+func TestFileStorage_Repair_index(t *testing.T) {
+	s := newFileStorage(filepath.Join(t.TempDir(), queryLogFileName))
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.Append(newStripTestRecords(start, 5)))
+	require.NoError(t, os.WriteFile(qlogIndexPath(s.path), []byte("bad"), 0o644))
+
+	reports, err := s.Repair(false)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+
+	assert.False(t, reports[0].IndexValid)
+	assert.True(t, reports[0].Repaired)
+
+	q, err := NewQLogFile(s.path)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, q.Close)
+
+	off, ok := q.indexedOffset(start.Add(time.Hour).UnixNano())
+	require.True(t, ok)
+
+	fi, err := os.Stat(s.path)
+	require.NoError(t, err)
+
+	assert.Equal(t, fi.Size(), off)
+}
@@ -0,0 +1,188 @@
+package querylog
+
+import (
+	"net"
+	"sort"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// CheckHostFunc checks the host against the current filtering rules using the
+// settings of the client with ip and clientID.
+type CheckHostFunc func(
+	host string,
+	qtype uint16,
+	ip net.IP,
+	clientID string,
+) (res *filtering.Result, err error)
+
+const (
+	// maxReplayChecks is the maximum number of distinct queries checked by a
+	// single replay job.
+	maxReplayChecks = 100_000
+
+	// maxReplayDomains is the maximum number of domains in the result of a
+	// replay job.
+	maxReplayDomains = 1_000
+)
+
+// replayKey is the key of a distinct query checked by a replay job.
+type replayKey struct {
+	host     string
+	clientID string
+	ip       string
+	qtype    uint16
+}
+
+// replayDomainJSON is a previously allowed domain, which would now be blocked.
+type replayDomainJSON struct {
+	// Domain is the queried domain name.
+	Domain string `json:"domain"`
+
+	// Reason is the reason the queries for the domain would now be blocked.
+	Reason string `json:"reason"`
+
+	// Rules are the rules, which would now block the domain, in the same
+	// format as in the GET /control/querylog response.
+	Rules []jobject `json:"rules"`
+
+	// Count is the number of the previously allowed queries for the domain,
+	// which would now be blocked.
+	Count int `json:"count"`
+}
+
+// replayJobResult is the result of a replay job.
+type replayJobResult struct {
+	// Domains are the previously allowed domains, which would now be blocked,
+	// with the greatest numbers of queries first.
+	Domains []*replayDomainJSON `json:"domains"`
+
+	// Checked is the number of distinct previously allowed queries checked.
+	Checked int `json:"checked"`
+
+	// Failed is the number of distinct queries, which couldn't be checked.
+	Failed int `json:"failed"`
+
+	// Truncated is true if not all the previously allowed queries have been
+	// checked or not all the found domains are returned.
+	Truncated bool `json:"truncated"`
+}
+
+// replayAnalysis is the jobAnalysis re-running the previously allowed queries
+// through the current filtering rules.
+type replayAnalysis struct {
+	check CheckHostFunc
+
+	// results are the results of the distinct queries checked so far.  The
+	// nil values mean that the query would still be allowed.
+	results map[replayKey]*filtering.Result
+
+	// domains are the found domains by their names.
+	domains map[string]*replayDomainJSON
+
+	res *replayJobResult
+}
+
+// type check
+var _ jobAnalysis = (*replayAnalysis)(nil)
+
+// newReplayAnalysis returns a new replay analysis using check.
+func newReplayAnalysis(check CheckHostFunc) (a *replayAnalysis) {
+	return &replayAnalysis{
+		check:   check,
+		results: map[replayKey]*filtering.Result{},
+		domains: map[string]*replayDomainJSON{},
+		res:     &replayJobResult{},
+	}
+}
+
+// add implements the jobAnalysis interface for *replayAnalysis.
+func (a *replayAnalysis) add(e *logEntry) (cont bool) {
+	qtype, ok := dns.StringToType[e.QType]
+	if e.Result.IsFiltered || !ok {
+		return true
+	}
+
+	k := replayKey{
+		host:     e.QHost,
+		clientID: e.ClientID,
+		ip:       e.IP.String(),
+		qtype:    qtype,
+	}
+
+	res, ok := a.results[k]
+	if !ok {
+		if len(a.results) == maxReplayChecks {
+			a.res.Truncated = true
+
+			return false
+		}
+
+		res = a.checkEntry(e, qtype)
+		a.results[k] = res
+	}
+
+	if res == nil {
+		return true
+	}
+
+	d, ok := a.domains[e.QHost]
+	if !ok {
+		d = &replayDomainJSON{
+			Domain: e.QHost,
+			Reason: res.Reason.String(),
+			Rules:  resultRulesToJSONRules(res.Rules),
+		}
+		a.domains[e.QHost] = d
+	}
+
+	d.Count++
+
+	return true
+}
+
+// checkEntry checks the query of e against the current filtering rules.  res
+// is nil if the query would still be allowed or couldn't be checked.
+func (a *replayAnalysis) checkEntry(e *logEntry, qtype uint16) (res *filtering.Result) {
+	res, err := a.check(e.QHost, qtype, e.IP, e.ClientID)
+	if err != nil {
+		a.res.Failed++
+		log.Debug("querylog: replaying query for %q: %s", e.QHost, err)
+
+		return nil
+	}
+
+	a.res.Checked++
+	if res == nil || !res.IsFiltered {
+		return nil
+	}
+
+	return res
+}
+
+// result implements the jobAnalysis interface for *replayAnalysis.
+func (a *replayAnalysis) result() (res any) {
+	domains := make([]*replayDomainJSON, 0, len(a.domains))
+	for _, d := range a.domains {
+		domains = append(domains, d)
+	}
+
+	sort.Slice(domains, func(i, j int) (less bool) {
+		if ci, cj := domains[i].Count, domains[j].Count; ci != cj {
+			return ci > cj
+		}
+
+		return domains[i].Domain < domains[j].Domain
+	})
+
+	if len(domains) > maxReplayDomains {
+		domains = domains[:maxReplayDomains]
+		a.res.Truncated = true
+	}
+
+	a.res.Domains = domains
+
+	return a.res
+}
@@ -1,7 +1,6 @@
 package querylog
 
 import (
-	"io"
 	"sort"
 	"time"
 
@@ -42,17 +41,45 @@ func (l *queryLog) client(clientID, ip string, cache clientCache) (c *Client, er
 	return c, nil
 }
 
+// memorySnapshot returns the copy of the in-memory entries which haven't been
+// written to the storage yet, from older to newer.  The entries themselves must
+// not be modified.
+func (l *queryLog) memorySnapshot() (entries []*logEntry) {
+	l.bufferLock.RLock()
+	defer l.bufferLock.RUnlock()
+
+	for _, q := range l.flushQueue {
+		entries = append(entries, q...)
+	}
+
+	entries = append(entries, l.buffer.Slice()...)
+	if l.coalescer != nil {
+		entries = append(entries, l.coalescer.snapshot()...)
+	}
+
+	return entries
+}
+
 // searchMemory looks up log records which are currently in the in-memory
-// buffer.  It optionally uses the client cache, if provided.  It also returns
-// the total amount of records in the buffer at the moment of searching.
+// buffer.  It optionally uses the client cache, if provided.  It stops once
+// enough records for the requested page are found.  It also returns the total
+// amount of records in the buffer at the moment of searching.  If params.limit
+// isn't positive, no records are returned, since the page is empty.
 func (l *queryLog) searchMemory(params *searchParams, cache clientCache) (entries []*logEntry, total int) {
-	l.bufferLock.Lock()
-	defer l.bufferLock.Unlock()
+	// Don't hold the lock while enriching and matching the entries, since
+	// that may take a while.
+	snapshot := l.memorySnapshot()
+	if params.limit <= 0 {
+		return nil, len(snapshot)
+	}
 
 	// Go through the buffer in the reverse order, from newer to older.
 	var err error
-	for i := len(l.buffer) - 1; i >= 0; i-- {
-		e := l.buffer[i]
+	for i := len(snapshot) - 1; i >= 0; i-- {
+		// Copy the entry to set the client information without affecting
+		// the concurrent searches.
+		e := &logEntry{}
+		*e = *snapshot[i]
 
 		e.client, err = l.client(e.ClientID, e.IP.String(), cache)
 		if err != nil {
@@ -63,12 +90,17 @@ func (l *queryLog) searchMemory(params *searchParams, cache clientCache) (entrie
 			// Go on and try to match anyway.
 		}
 
-		if params.match(e) {
-			entries = append(entries, e)
+		if !params.match(e) {
+			continue
+		}
+
+		entries = append(entries, e)
+		if len(entries) == params.offset+params.limit {
+			break
 		}
 	}
 
-	return entries, len(l.buffer)
+	return entries, len(snapshot)
 }
 
 // search - searches log entries in the query log using specified parameters
@@ -76,19 +108,26 @@ func (l *queryLog) searchMemory(params *searchParams, cache clientCache) (entrie
 func (l *queryLog) search(params *searchParams) (entries []*logEntry, oldest time.Time) {
 	now := time.Now()
 
-	if params.limit == 0 {
+	if params.limit <= 0 {
 		return []*logEntry{}, time.Time{}
 	}
 
 	cache := clientCache{}
-	fileEntries, oldest, total := l.searchFiles(params, cache)
-	memoryEntries, bufLen := l.searchMemory(params, cache)
-	total += bufLen
-
 	totalLimit := params.offset + params.limit
 
-	// now let's get a unified collection
-	entries = append(memoryEntries, fileEntries...)
+	// The in-memory entries are newer than the ones in the storage, so don't
+	// read the storage at all if the page is already filled.
+	var total int
+	entries, total = l.searchMemory(params, cache)
+	if len(entries) < totalLimit {
+		var storageEntries []*logEntry
+		var storageTotal int
+		storageEntries, oldest, storageTotal = l.searchStorage(params, cache)
+		total += storageTotal
+
+		entries = append(entries, storageEntries...)
+	}
+
 	if len(entries) > totalLimit {
 		// remove extra records
 		entries = entries[:totalLimit]
@@ -127,88 +166,132 @@ func (l *queryLog) search(params *searchParams) (entries []*logEntry, oldest tim
 	return entries, oldest
 }
 
-// searchFiles looks up log records from all log files.  It optionally uses the
-// client cache, if provided.  searchFiles does not scan more than
+// searchStorage looks up log records in the storage.  It optionally uses the
+// client cache, if provided.  searchStorage does not scan more than
 // maxFileScanEntries so callers may need to call it several times to get all
-// results.  oldset and total are the time of the oldest processed entry and the
+// results.  oldest and total are the time of the oldest processed entry and the
 // total number of processed entries, including discarded ones, correspondingly.
-func (l *queryLog) searchFiles(
+// oldest is zero if there are no more records in the storage.  If params.limit
+// isn't positive, the storage isn't searched at all.
+func (l *queryLog) searchStorage(
 	params *searchParams,
 	cache clientCache,
 ) (entries []*logEntry, oldest time.Time, total int) {
-	files := []string{
-		l.logFile + ".1",
-		l.logFile,
+	if params.limit <= 0 {
+		return nil, time.Time{}, 0
 	}
 
-	r, err := NewQLogReader(files)
-	if err != nil {
-		log.Error("querylog: failed to open qlog reader: %s", err)
+	totalLimit := params.offset + params.limit
+	oldestNano := int64(0)
+	finished := true
 
-		return entries, oldest, 0
-	}
-	defer func() {
-		derr := r.Close()
-		if derr != nil {
-			log.Error("querylog: closing file: %s", err)
+	err := l.storageIterate(params)(params.olderThan, func(rec string) (cont bool) {
+		// By default, we do not scan more than maxFileScanEntries at once.
+		// The idea is to make search calls faster so that the UI could handle
+		// it and show something quicker.  This behavior can be overridden if
+		// maxFileScanEntries is set to 0.
+		if params.maxFileScanEntries > 0 && total >= params.maxFileScanEntries {
+			finished = false
+
+			return false
+		}
+
+		e, ts := l.matchRecord(rec, params, cache)
+		oldestNano = ts
+		total++
+
+		if e == nil {
+			return true
 		}
-	}()
-
-	if params.olderThan.IsZero() {
-		err = r.SeekStart()
-	} else {
-		err = r.seekTS(params.olderThan.UnixNano())
-		if err == nil {
-			// Read to the next record, because we only need the one
-			// that goes after it.
-			_, err = r.ReadNext()
+
+		entries = append(entries, e)
+		if len(entries) == totalLimit {
+			finished = false
+
+			return false
 		}
-	}
 
+		return true
+	})
 	if err != nil {
-		log.Debug("querylog: cannot seek to %s: %s", params.olderThan, err)
+		log.Error("querylog: searching storage: %s", err)
+	}
 
-		return entries, oldest, 0
+	if !finished && oldestNano != 0 {
+		oldest = time.Unix(0, oldestNano)
 	}
 
-	totalLimit := params.offset + params.limit
-	oldestNano := int64(0)
+	return entries, oldest, total
+}
 
-	// By default, we do not scan more than maxFileScanEntries at once.
-	// The idea is to make search calls faster so that the UI could handle
-	// it and show something quicker.  This behavior can be overridden if
-	// maxFileScanEntries is set to 0.
-	for total < params.maxFileScanEntries || params.maxFileScanEntries <= 0 {
-		var e *logEntry
-		var ts int64
+// storageIterate returns the function iterating over the records of the
+// storage, which preselects them using params if the storage supports that.
+func (l *queryLog) storageIterate(
+	params *searchParams,
+) (iterate func(olderThan time.Time, f func(rec string) (cont bool)) (err error)) {
+	fs, ok := l.storage.(filteringStorage)
+	if !ok {
+		return l.storage.Iterate
+	}
 
-		e, ts, err = l.readNextEntry(r, params, cache)
-		if err != nil {
-			if err == io.EOF {
-				oldestNano = 0
+	flt := params.storageFilter()
 
-				break
-			}
+	return func(olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+		return fs.IterateFiltered(olderThan, flt, f)
+	}
+}
 
-			log.Error("querylog: reading next entry: %s", err)
+// searchStream calls f for each log entry matching params, from newer to
+// older, skipping the first params.offset ones and stopping after params.limit
+// ones, if it's positive.  Unlike search, it neither keeps the entries in
+// memory nor limits the number of the scanned records.  It stops at the first
+// error returned by f.
+func (l *queryLog) searchStream(params *searchParams, f func(e *logEntry) (err error)) (err error) {
+	var skipped, sent int
+	emit := func(e *logEntry) (cont bool) {
+		if skipped < params.offset {
+			skipped++
+
+			return true
 		}
 
-		oldestNano = ts
-		total++
+		err = f(e)
+		sent++
+
+		return err == nil && (params.limit <= 0 || sent < params.limit)
+	}
 
-		if e != nil {
-			entries = append(entries, e)
-			if len(entries) == totalLimit {
-				break
-			}
+	cache := clientCache{}
+
+	// The in-memory entries are newer than the ones in the storage.
+	snapshot := l.memorySnapshot()
+	for i := len(snapshot) - 1; i >= 0; i-- {
+		// Copy the entry to set the client information without affecting
+		// the concurrent searches.
+		e := &logEntry{}
+		*e = *snapshot[i]
+
+		var cerr error
+		e.client, cerr = l.client(e.ClientID, e.IP.String(), cache)
+		if cerr != nil {
+			log.Error("querylog: enriching memory record at time %s: %s", e.Time, cerr)
+		}
+
+		if params.match(e) && !emit(e) {
+			return err
 		}
 	}
 
-	if oldestNano != 0 {
-		oldest = time.Unix(0, oldestNano)
+	iterErr := l.storageIterate(params)(params.olderThan, func(rec string) (cont bool) {
+		e, _ := l.matchRecord(rec, params, cache)
+
+		return e == nil || emit(e)
+	})
+	if err != nil {
+		return err
 	}
 
-	return entries, oldest, total
+	return iterErr
 }
 
 // quickMatchClientFinder is a wrapper around the usual client finding function
@@ -224,7 +307,7 @@ func (f quickMatchClientFinder) findClient(clientID, ip string) (c *Client) {
 	c, err = f.client(clientID, ip, f.cache)
 	if err != nil {
 		log.Error(
-			"querylog: enriching file record for quick search: for client %q (clientid %q): %s",
+			"querylog: enriching stored record for quick search: for client %q (clientid %q): %s",
 			ip,
 			clientID,
 			err,
@@ -234,39 +317,34 @@ func (f quickMatchClientFinder) findClient(clientID, ip string) (c *Client) {
 	return c
 }
 
-// readNextEntry reads the next log entry and checks if it matches the search
-// criteria.  It optionally uses the client cache, if provided.  e is nil if the
-// entry doesn't match the search criteria.  ts is the timestamp of the
+// matchRecord decodes the log entry from rec and checks if it matches the
+// search criteria.  It optionally uses the client cache, if provided.  e is nil
+// if the entry doesn't match the search criteria.  ts is the timestamp of the
 // processed entry.
-func (l *queryLog) readNextEntry(
-	r *QLogReader,
+func (l *queryLog) matchRecord(
+	rec string,
 	params *searchParams,
 	cache clientCache,
-) (e *logEntry, ts int64, err error) {
-	var line string
-	line, err = r.ReadNext()
-	if err != nil {
-		return nil, 0, err
-	}
-
+) (e *logEntry, ts int64) {
 	clientFinder := quickMatchClientFinder{
 		client: l.client,
 		cache:  cache,
 	}
 
-	if !params.quickMatch(line, clientFinder.findClient) {
-		ts = readQLogTimestamp(line)
+	if !params.quickMatch(rec, clientFinder.findClient) {
+		ts = readQLogTimestamp(rec)
 
-		return nil, ts, nil
+		return nil, ts
 	}
 
 	e = &logEntry{}
-	decodeLogEntry(e, line)
+	decodeLogEntry(e, rec)
 
+	var err error
 	e.client, err = l.client(e.ClientID, e.IP.String(), cache)
 	if err != nil {
 		log.Error(
-			"querylog: enriching file record at time %s for client %q (clientid %q): %s",
+			"querylog: enriching stored record at time %s for client %q (clientid %q): %s",
 			e.Time,
 			e.IP,
 			e.ClientID,
@@ -278,8 +356,8 @@ func (l *queryLog) readNextEntry(
 
 	ts = e.Time.UnixNano()
 	if !params.match(e) {
-		return nil, ts, nil
+		return nil, ts
 	}
 
-	return e, ts, nil
+	return e, ts
 }
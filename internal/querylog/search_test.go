@@ -1,10 +1,15 @@
 package querylog
 
 import (
+	"encoding/json"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -92,3 +97,107 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 
 	assert.Equal(t, knownClientName, gotClient.Name)
 }
+
+func TestQueryLog_searchStream(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	const (
+		entNum        = 10
+		memDomain     = "memory.example.org"
+		storageDomain = "storage.example.org"
+	)
+
+	for i := 0; i < entNum; i++ {
+		addEntry(l, storageDomain, net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+	require.NoError(t, l.flushLogBuffer(true))
+
+	for i := 0; i < entNum; i++ {
+		addEntry(l, memDomain, net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	testCases := []struct {
+		name      string
+		wantFirst string
+		wantLast  string
+		wantLen   int
+		offset    int
+		limit     int
+	}{{
+		name:      "all",
+		wantFirst: memDomain,
+		wantLast:  storageDomain,
+		wantLen:   2 * entNum,
+		offset:    0,
+		limit:     0,
+	}, {
+		name:      "limit",
+		wantFirst: memDomain,
+		wantLast:  storageDomain,
+		wantLen:   15,
+		offset:    0,
+		limit:     15,
+	}, {
+		name:      "offset",
+		wantFirst: storageDomain,
+		wantLast:  storageDomain,
+		wantLen:   5,
+		offset:    15,
+		limit:     0,
+	}, {
+		name:      "past_end",
+		wantFirst: "",
+		wantLast:  "",
+		wantLen:   0,
+		offset:    2 * entNum,
+		limit:     10,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := newSearchParams()
+			params.offset, params.limit = tc.offset, tc.limit
+
+			var hosts []string
+			err := l.searchStream(params, func(e *logEntry) (err error) {
+				hosts = append(hosts, e.QHost)
+
+				return nil
+			})
+			require.NoError(t, err)
+			require.Len(t, hosts, tc.wantLen)
+
+			if tc.wantLen > 0 {
+				assert.Equal(t, tc.wantFirst, hosts[0])
+				assert.Equal(t, tc.wantLast, hosts[tc.wantLen-1])
+			}
+		})
+	}
+
+	t.Run("http", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog?format=ndjson&offset=5", nil)
+		w := httptest.NewRecorder()
+
+		l.handleQueryLog(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "application/x-ndjson", w.Header().Get(aghhttp.HdrNameContentType))
+
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		require.Len(t, lines, 2*entNum-5)
+
+		ent := map[string]any{}
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &ent))
+
+		q, ok := ent["question"].(map[string]any)
+		require.True(t, ok)
+
+		assert.Equal(t, memDomain, q["name"])
+	})
+}
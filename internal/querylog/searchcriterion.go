@@ -18,6 +18,20 @@ const (
 	//
 	// See (*searchCriterion).ctFilteringStatusCase for details.
 	ctFilteringStatus
+	// ctDomain is for searching by the domain name only.  It supports IDNAs.
+	ctDomain
+	// ctClient is for searching by the client's IP address, the client's ID,
+	// or the client's name only.
+	ctClient
+	// ctQuestionType is for searching by the type of the question, for
+	// example "AAAA".  It's always strict.
+	ctQuestionType
+	// ctResponseCode is for searching by the response code, for example
+	// "NXDOMAIN".  It's always strict.
+	ctResponseCode
+	// ctDNSSECStatus is for searching by the status of the DNSSEC validation,
+	// for example "bogus".  It's always strict.
+	ctDNSSECStatus
 )
 
 const (
@@ -103,6 +117,34 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 		}
 
 		return ctDomainOrClientCaseNonStrict(c.value, c.asciiVal, clientID, name, host, ip)
+	case ctDomain:
+		host := readJSONValue(line, `"QH":"`)
+
+		return c.matchDomain(host)
+	case ctClient:
+		ip := readJSONValue(line, `"IP":"`)
+		clientID := readJSONValue(line, `"CID":"`)
+
+		var name string
+		if cli := findClient(clientID, ip); cli != nil {
+			name = cli.Name
+		}
+
+		return c.matchClient(clientID, name, ip)
+	case ctQuestionType:
+		return strings.EqualFold(readJSONValue(line, `"QT":"`), c.value)
+	case ctResponseCode:
+		// The entries written by the previous versions have no response code
+		// field, so leave those to the full match.
+		rc := readJSONValue(line, `"RC":"`)
+
+		return rc == "" || rc == c.value
+	case ctDNSSECStatus:
+		// The entries written by the previous versions have no DNSSEC status
+		// field, so leave those to the full match.
+		ds := readJSONValue(line, `"DS":"`)
+
+		return ds == "" || ds == c.value
 	case ctFilteringStatus:
 		// Go on, as we currently don't do quick matches against
 		// filtering statuses.
@@ -119,11 +161,51 @@ func (c *searchCriterion) match(entry *logEntry) bool {
 		return c.ctDomainOrClientCase(entry)
 	case ctFilteringStatus:
 		return c.ctFilteringStatusCase(entry.Result)
+	case ctDomain:
+		return c.matchDomain(entry.QHost)
+	case ctClient:
+		var name string
+		if entry.client != nil {
+			name = entry.client.Name
+		}
+
+		return c.matchClient(entry.ClientID, name, entry.IP.String())
+	case ctQuestionType:
+		return strings.EqualFold(entry.QType, c.value)
+	case ctResponseCode:
+		return entry.responseCode() == c.value
+	case ctDNSSECStatus:
+		return string(entry.dnssecStatus()) == c.value
 	}
 
 	return false
 }
 
+// matchDomain returns true if host matches the domain criterion.
+func (c *searchCriterion) matchDomain(host string) (ok bool) {
+	if c.strict {
+		return strings.EqualFold(host, c.value) ||
+			(c.asciiVal != "" && strings.EqualFold(host, c.asciiVal))
+	}
+
+	return stringutil.ContainsFold(host, c.value) ||
+		(c.asciiVal != "" && stringutil.ContainsFold(host, c.asciiVal))
+}
+
+// matchClient returns true if the client with the given properties matches the
+// client criterion.
+func (c *searchCriterion) matchClient(clientID, name, ip string) (ok bool) {
+	if c.strict {
+		return strings.EqualFold(clientID, c.value) ||
+			strings.EqualFold(ip, c.value) ||
+			strings.EqualFold(name, c.value)
+	}
+
+	return stringutil.ContainsFold(clientID, c.value) ||
+		stringutil.ContainsFold(ip, c.value) ||
+		stringutil.ContainsFold(name, c.value)
+}
+
 func (c *searchCriterion) ctDomainOrClientCase(e *logEntry) bool {
 	clientID := e.ClientID
 	host := e.QHost
@@ -157,7 +239,11 @@ func (c *searchCriterion) ctFilteringStatusCase(res filtering.Result) bool {
 
 	case filteringStatusBlocked:
 		return res.IsFiltered &&
-			res.Reason.In(filtering.FilteredBlockList, filtering.FilteredBlockedService)
+			res.Reason.In(
+				filtering.FilteredBlockList,
+				filtering.FilteredBlockedService,
+				filtering.FilteredDoHCanary,
+			)
 
 	case filteringStatusBlockedService:
 		return res.IsFiltered && res.Reason == filtering.FilteredBlockedService
@@ -185,6 +271,7 @@ func (c *searchCriterion) ctFilteringStatusCase(res filtering.Result) bool {
 		return !res.Reason.In(
 			filtering.FilteredBlockList,
 			filtering.FilteredBlockedService,
+			filtering.FilteredDoHCanary,
 			filtering.NotFilteredAllowList,
 		)
 
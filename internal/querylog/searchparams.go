@@ -1,6 +1,12 @@
 package querylog
 
-import "time"
+import (
+	"net"
+	"time"
+)
+
+// maxSearchLimit is the maximum number of entries returned by a single search.
+const maxSearchLimit = 1000
 
 // searchParams represent the search query sent by the client
 type searchParams struct {
@@ -11,6 +17,14 @@ type searchParams struct {
 	// if not set - disregard it and return any value
 	olderThan time.Time
 
+	// clients, if not nil, limits the entries to the ones from the specified
+	// clients.
+	clients *ClientsFilter
+
+	// client, if not nil, limits the entries to the ones from the single
+	// client requested in addition to clients.
+	client *ClientsFilter
+
 	offset             int // offset for the search
 	limit              int // limit the number of records returned
 	maxFileScanEntries int // maximum log entries to scan in query log files. if 0 - no limit
@@ -50,6 +64,14 @@ func (s *searchParams) match(entry *logEntry) bool {
 		return false
 	}
 
+	if s.clients != nil && !s.clients.match(entry) {
+		return false
+	}
+
+	if s.client != nil && !s.client.match(entry) {
+		return false
+	}
+
 	for _, c := range s.searchCriteria {
 		if !c.match(entry) {
 			return false
@@ -58,3 +80,34 @@ func (s *searchParams) match(entry *logEntry) bool {
 
 	return true
 }
+
+// storageFilter returns the preselection of the records matching the strict
+// domain and client criteria, if any.  The preselected records are then matched
+// against all criteria as usual.
+//
+// Note that the strict client criterion is only used when it's an IP address,
+// so a client named like an IP address of another one might be missed.
+func (s *searchParams) storageFilter() (flt *storageFilter) {
+	flt = &storageFilter{}
+	for _, c := range s.searchCriteria {
+		if !c.strict {
+			continue
+		}
+
+		switch c.criterionType {
+		case ctDomain:
+			flt.hosts = append(flt.hosts, c.value)
+			if c.asciiVal != "" {
+				flt.hosts = append(flt.hosts, c.asciiVal)
+			}
+		case ctClient:
+			if ip := net.ParseIP(c.value); ip != nil {
+				flt.clientIP = ip.String()
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	return flt
+}
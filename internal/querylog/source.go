@@ -0,0 +1,47 @@
+package querylog
+
+import "strings"
+
+// Sources of the responses written by the JSON API.
+const (
+	// sourceUpstream means that the response has been received from the
+	// upstream.
+	sourceUpstream = "upstream"
+
+	// sourceCache means that the response has been served from the cache.
+	sourceCache = "cache"
+
+	// sourceBlocked means that the response has been replaced by the
+	// filtering.
+	sourceBlocked = "blocked"
+
+	// sourceLocal means that the response has been made by AdGuard Home
+	// itself, for example, from a rewrite or a DHCP lease.
+	sourceLocal = "local"
+)
+
+// source returns the source of the response to the request of e.
+func (e *logEntry) source() (src string) {
+	switch {
+	case e.Result.IsFiltered:
+		return sourceBlocked
+	case e.Cached:
+		return sourceCache
+	case e.Upstream != "":
+		return sourceUpstream
+	default:
+		return sourceLocal
+	}
+}
+
+// upstreamProto returns the protocol of the upstream with the address addr,
+// for example "tls" or "https".  The addresses of the plain DNS upstreams have
+// no scheme, since they use UDP with the fallback to TCP.
+func upstreamProto(addr string) (proto string) {
+	scheme, _, ok := strings.Cut(addr, "://")
+	if !ok {
+		return "udp"
+	}
+
+	return scheme
+}
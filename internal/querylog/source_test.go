@@ -0,0 +1,72 @@
+package querylog
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEntry_source(t *testing.T) {
+	const ups = "tls://dns.example"
+
+	testCases := []struct {
+		entry *logEntry
+		name  string
+		want  string
+	}{{
+		entry: &logEntry{Upstream: ups},
+		name:  "upstream",
+		want:  sourceUpstream,
+	}, {
+		entry: &logEntry{Upstream: ups, Cached: true},
+		name:  "cache",
+		want:  sourceCache,
+	}, {
+		entry: &logEntry{Result: filtering.Result{IsFiltered: true}},
+		name:  "blocked",
+		want:  sourceBlocked,
+	}, {
+		entry: &logEntry{Upstream: ups, Result: filtering.Result{IsFiltered: true}},
+		name:  "blocked_response",
+		want:  sourceBlocked,
+	}, {
+		entry: &logEntry{Result: filtering.Result{Reason: filtering.Rewritten}},
+		name:  "local",
+		want:  sourceLocal,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.entry.source())
+		})
+	}
+}
+
+func TestUpstreamProto(t *testing.T) {
+	testCases := []struct {
+		addr string
+		want string
+	}{{
+		addr: "8.8.8.8:53",
+		want: "udp",
+	}, {
+		addr: "tcp://8.8.8.8:53",
+		want: "tcp",
+	}, {
+		addr: "tls://dns.example:853",
+		want: "tls",
+	}, {
+		addr: "https://dns.example:443/dns-query",
+		want: "https",
+	}, {
+		addr: "quic://dns.example:853",
+		want: "quic",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			assert.Equal(t, tc.want, upstreamProto(tc.addr))
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package querylog
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+
+	// Register the SQLite driver.
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the table of the records along with the indexes on the
+// time, the client IP address, and the question name.  The indexes include the
+// time, so that the records could be iterated over from newer to older without
+// sorting.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	ts     INTEGER NOT NULL,
+	client TEXT    NOT NULL,
+	qname  TEXT    NOT NULL COLLATE NOCASE,
+	rec    TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_ts ON records (ts);
+CREATE INDEX IF NOT EXISTS records_client ON records (client, ts);
+CREATE INDEX IF NOT EXISTS records_qname ON records (qname, ts);
+`
+
+// sqliteDriverName is the name of the pure-Go SQLite driver.
+const sqliteDriverName = "sqlite"
+
+// sqliteDSN returns the URI of the SQLite database at path with the query
+// parameters of the driver set to params.  The path is escaped, so that it may
+// contain characters like "?" and "#".
+func sqliteDSN(path string, params url.Values) (dsn string, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("getting absolute path: %w", err)
+	}
+
+	// Make sure the path is absolute in terms of URIs on Windows as well, for
+	// example "/C:/AdGuardHome/data/querylog.db".
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	u := &url.URL{
+		Scheme:   "file",
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+
+	return u.String(), nil
+}
+
+// sqliteStorage is the [Storage] keeping the records in an SQLite database.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// type check
+var _ filteringStorage = (*sqliteStorage)(nil)
+
+// newSQLiteStorage opens the SQLite database at path, creating it if
+// necessary.  If the files of the file storage with the current file at
+// filePath exist, their records are moved into the database.
+func newSQLiteStorage(path, filePath string) (s *sqliteStorage, err error) {
+	// Use the write-ahead log so that the searches don't block the appends.
+	dsn, err := sqliteDSN(path, url.Values{
+		"_pragma": []string{"journal_mode(WAL)", "busy_timeout(5000)"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(sqliteDriverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	s = &sqliteStorage{
+		db: db,
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, db.Close())
+		}
+	}()
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+
+	err = s.migrate(newFileStorage(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("migrating: %w", err)
+	}
+
+	return s, nil
+}
+
+// migrate moves the records from the files of fs into the database and removes
+// the files.
+func (s *sqliteStorage) migrate(fs *fileStorage) (err error) {
+	var num int
+	for _, p := range []string{fs.gzOldPath(), fs.oldPath(), fs.path} {
+		var n int
+		n, err = appendFileRecords(s, p)
+		if err != nil {
+			return fmt.Errorf("moving records from %q: %w", p, err)
+		}
+
+		num += n
+	}
+
+	if num == 0 {
+		return nil
+	}
+
+	log.Info("querylog: moved %d records from files into the database", num)
+
+	return fs.Clear()
+}
+
+// Append implements the [Storage] interface for *sqliteStorage.
+func (s *sqliteStorage) Append(records [][]byte) (err error) {
+	if len(records) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, tx.Rollback())
+		}
+	}()
+
+	stmt, err := tx.Prepare(`INSERT INTO records (ts, client, qname, rec) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("preparing statement: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stmt.Close()) }()
+
+	for _, rec := range records {
+		line := string(rec)
+		_, err = stmt.Exec(
+			readQLogTimestamp(line),
+			readJSONValue(line, `"IP":"`),
+			readJSONValue(line, `"QH":"`),
+			line,
+		)
+		if err != nil {
+			return fmt.Errorf("inserting record: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Iterate implements the [Storage] interface for *sqliteStorage.
+func (s *sqliteStorage) Iterate(olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+	return s.IterateFiltered(olderThan, &storageFilter{}, f)
+}
+
+// IterateFiltered implements the [filteringStorage] interface for
+// *sqliteStorage.
+func (s *sqliteStorage) IterateFiltered(
+	olderThan time.Time,
+	flt *storageFilter,
+	f func(rec string) (cont bool),
+) (err error) {
+	var conds []string
+	var args []any
+	if !olderThan.IsZero() {
+		conds = append(conds, "ts < ?")
+		args = append(args, olderThan.UnixNano())
+	}
+
+	if flt.clientIP != "" {
+		conds = append(conds, "client = ?")
+		args = append(args, flt.clientIP)
+	}
+
+	if len(flt.hosts) > 0 {
+		conds = append(conds, "qname IN (?"+strings.Repeat(", ?", len(flt.hosts)-1)+")")
+		for _, h := range flt.hosts {
+			args = append(args, h)
+		}
+	}
+
+	query := "SELECT rec FROM records"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	query += " ORDER BY ts DESC, rowid DESC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("querying: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, rows.Close()) }()
+
+	for rows.Next() {
+		var rec string
+		err = rows.Scan(&rec)
+		if err != nil {
+			return fmt.Errorf("scanning: %w", err)
+		}
+
+		if !f(rec) {
+			return nil
+		}
+	}
+
+	return rows.Err()
+}
+
+// Rotate implements the [Storage] interface for *sqliteStorage.  Unlike the
+// file storage, it removes the records older than ivl exactly.
+func (s *sqliteStorage) Rotate(ivl time.Duration) (err error) {
+	res, err := s.db.Exec(`DELETE FROM records WHERE ts < ?`, time.Now().Add(-ivl).UnixNano())
+	if err != nil {
+		return fmt.Errorf("deleting records: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("getting number of deleted records: %w", err)
+	}
+
+	log.Debug("querylog: deleted %d outdated records", n)
+
+	return nil
+}
+
+// type check
+var _ clientStrippingStorage = (*sqliteStorage)(nil)
+
+// sqliteStripBatchSize is the maximum number of records stripped within a
+// single transaction.
+const sqliteStripBatchSize = 1000
+
+// StripClients implements the [clientStrippingStorage] interface for
+// *sqliteStorage.
+func (s *sqliteStorage) StripClients(olderThan time.Time) (n int, err error) {
+	for {
+		var batchN int
+		batchN, err = s.stripBatch(olderThan.UnixNano())
+		n += batchN
+		if err != nil || batchN < sqliteStripBatchSize {
+			return n, err
+		}
+	}
+}
+
+// sqliteStripRow is a record to strip.
+type sqliteStripRow struct {
+	client string
+	rec    string
+	id     int64
+}
+
+// stripBatch strips up to sqliteStripBatchSize records made before olderThan,
+// in nanoseconds, which aren't stripped yet.
+func (s *sqliteStorage) stripBatch(olderThan int64) (n int, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, tx.Rollback())
+		}
+	}()
+
+	rows, err := tx.Query(
+		`SELECT rowid, client, rec FROM records WHERE ts < ? AND client NOT IN ('', ?, ?) LIMIT ?`,
+		olderThan,
+		strippedIPv4,
+		strippedIPv6,
+		sqliteStripBatchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("querying: %w", err)
+	}
+
+	var batch []sqliteStripRow
+	for rows.Next() {
+		var r sqliteStripRow
+		err = rows.Scan(&r.id, &r.client, &r.rec)
+		if err != nil {
+			return 0, errors.WithDeferred(fmt.Errorf("scanning: %w", err), rows.Close())
+		}
+
+		batch = append(batch, r)
+	}
+
+	err = errors.WithDeferred(rows.Err(), rows.Close())
+	if err != nil {
+		return 0, fmt.Errorf("querying: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`UPDATE records SET client = ?, rec = ? WHERE rowid = ?`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing statement: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stmt.Close()) }()
+
+	for _, r := range batch {
+		client := strippedIPv4
+		if strings.Contains(r.client, ":") {
+			client = strippedIPv6
+		}
+
+		rec, _ := stripRecord(r.rec)
+		_, err = stmt.Exec(client, rec, r.id)
+		if err != nil {
+			return 0, fmt.Errorf("updating record: %w", err)
+		}
+	}
+
+	return len(batch), tx.Commit()
+}
+
+// Clear implements the [Storage] interface for *sqliteStorage.
+func (s *sqliteStorage) Clear() (err error) {
+	_, err = s.db.Exec(`DELETE FROM records`)
+	if err != nil {
+		return fmt.Errorf("deleting records: %w", err)
+	}
+
+	return nil
+}
+
+// Close implements the [io.Closer] interface for *sqliteStorage.
+func (s *sqliteStorage) Close() (err error) {
+	return s.db.Close()
+}
@@ -0,0 +1,181 @@
+package querylog
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_sqlite(t *testing.T) {
+	dir := t.TempDir()
+	newLog := func(b Backend) (l *queryLog) {
+		return newQueryLog(Config{
+			Backend:     b,
+			Enabled:     true,
+			FileEnabled: true,
+			RotationIvl: timeutil.Day,
+			MemSize:     100,
+			BaseDir:     dir,
+		})
+	}
+
+	fl := newLog(BackendFile)
+	addEntry(fl, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(fl, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	fl.Close()
+
+	l := newLog(BackendSQLite)
+	t.Cleanup(l.Close)
+
+	require.IsType(t, (*sqliteStorage)(nil), l.storage)
+
+	t.Run("migrate", func(t *testing.T) {
+		assert.NoFileExists(t, filepath.Join(dir, queryLogFileName))
+
+		entries, _ := l.search(newSearchParams())
+		require.Len(t, entries, 2)
+
+		assertLogEntry(t, entries[0], "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+		assertLogEntry(t, entries[1], "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	})
+
+	addEntry(l, "third.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	testCases := []struct {
+		name     string
+		criteria []searchCriterion
+		wantHost string
+	}{{
+		name: "domain",
+		criteria: []searchCriterion{{
+			criterionType: ctDomain,
+			value:         "SECOND.example",
+			strict:        true,
+		}},
+		wantHost: "second.example",
+	}, {
+		name: "client",
+		criteria: []searchCriterion{{
+			criterionType: ctClient,
+			value:         "2.2.2.3",
+			strict:        true,
+		}},
+		wantHost: "third.example",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := newSearchParams()
+			params.searchCriteria = tc.criteria
+
+			entries, _ := l.search(params)
+			require.Len(t, entries, 1)
+
+			assert.Equal(t, tc.wantHost, entries[0].QHost)
+		})
+	}
+
+	t.Run("rotate", func(t *testing.T) {
+		require.NoError(t, l.storage.Rotate(0))
+
+		entries, _ := l.search(newSearchParams())
+		assert.Empty(t, entries)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		addEntry(l, "fourth.example", net.IPv4(1, 1, 1, 4), net.IPv4(2, 2, 2, 4))
+		require.NoError(t, l.flushLogBuffer(true))
+
+		l.clear()
+
+		entries, _ := l.search(newSearchParams())
+		assert.Empty(t, entries)
+
+		_, err := os.Stat(filepath.Join(dir, sqliteFileName))
+		assert.NoError(t, err)
+	})
+}
+
+func TestSQLiteStorage_StripClients(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSQLiteStorage(filepath.Join(dir, sqliteFileName), filepath.Join(dir, queryLogFileName))
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, s.Append(newStripTestRecords(start, 10)))
+
+	olderThan := start.Add(5 * time.Second)
+	n, err := s.StripClients(olderThan)
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, n)
+
+	flt := &storageFilter{clientIP: strippedIPv4}
+	var stripped []string
+	err = s.IterateFiltered(time.Time{}, flt, func(rec string) (cont bool) {
+		stripped = append(stripped, rec)
+
+		return true
+	})
+	require.NoError(t, err)
+	require.Len(t, stripped, 5)
+
+	for _, rec := range stripped {
+		assert.NotContains(t, rec, "CID")
+	}
+
+	n, err = s.StripClients(olderThan)
+	require.NoError(t, err)
+
+	assert.Zero(t, n)
+}
+
+func TestSQLiteStorage_migrateCompressed(t *testing.T) {
+	dir := t.TempDir()
+	fs := newFileStorage(filepath.Join(dir, queryLogFileName))
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, fs.Append(newIndexTestRecords(start, 10)))
+	require.NoError(t, fs.rename())
+	require.NoError(t, fs.compressOld())
+	require.NoError(t, fs.Append(newIndexTestRecords(start.Add(10*time.Second), 10)))
+
+	s, err := newSQLiteStorage(filepath.Join(dir, sqliteFileName), fs.path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, s.Close()) })
+
+	var n int
+	err = s.Iterate(time.Time{}, func(_ string) (cont bool) {
+		n++
+
+		return true
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 20, n)
+	assert.NoFileExists(t, fs.gzOldPath())
+}
+
+func TestNewSQLiteStorage_specialPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data?mode=ro#1 %20")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+
+	dbPath := filepath.Join(dir, sqliteFileName)
+	s, err := newSQLiteStorage(dbPath, filepath.Join(dir, queryLogFileName))
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, s.Append(newIndexTestRecords(start, 1)))
+
+	assert.FileExists(t, dbPath)
+}
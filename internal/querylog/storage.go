@@ -0,0 +1,550 @@
+package querylog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+// Storage is the persistent storage of the query log.  The records are the log
+// entries encoded into JSON objects, so that the searches could quickly skip
+// the non-matching records without decoding them.
+type Storage interface {
+	// Append stores the records, from older to newer.
+	Append(records [][]byte) (err error)
+
+	// Iterate calls f for each stored record, from newer to older, starting
+	// with the newest one older than olderThan, if it's not zero.  It stops
+	// once f returns false.
+	Iterate(olderThan time.Time, f func(rec string) (cont bool)) (err error)
+
+	// Rotate removes the records older than ivl, if it's time to.  The records
+	// newer than ivl must be kept.
+	Rotate(ivl time.Duration) (err error)
+
+	// Clear removes all the records.
+	Clear() (err error)
+}
+
+// storageFilter is the preselection of the records, which a [filteringStorage]
+// can perform faster than the search, for example using indexes.  The empty
+// fields match any record.
+type storageFilter struct {
+	// clientIP is the IP address of the client.
+	clientIP string
+
+	// hosts are the question names, one of which must match the record's one
+	// case-insensitively.
+	hosts []string
+}
+
+// filteringStorage is a [Storage] able to preselect the records itself.
+type filteringStorage interface {
+	Storage
+
+	// IterateFiltered is like Iterate, but only calls f for the records
+	// matching flt.
+	IterateFiltered(olderThan time.Time, flt *storageFilter, f func(rec string) (cont bool)) (err error)
+}
+
+// syncingStorage is a [Storage] able to commit the appended records to the
+// stable storage, so that they aren't lost on power failure.
+type syncingStorage interface {
+	Storage
+
+	// Sync commits the records appended since the previous call.
+	Sync() (err error)
+}
+
+// type check
+var (
+	_ syncingStorage = (*fileStorage)(nil)
+	_ syncingStorage = (*dailyStorage)(nil)
+	_ syncingStorage = (*encryptedStorage)(nil)
+)
+
+// syncFile commits the contents of the file at path to the stable storage.  It
+// does nothing if the file doesn't exist.
+func syncFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("syncing %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// Backend is the name of the built-in storage implementation.
+type Backend string
+
+// Built-in storage implementations.
+const (
+	// BackendFile keeps the records in the JSON-lines files.
+	BackendFile Backend = "file"
+
+	// BackendSQLite keeps the records in an SQLite database with the indexes
+	// on the time, the client, and the question name.
+	BackendSQLite Backend = "sqlite"
+
+	// BackendDaily keeps the records in the JSON-lines files, one for each
+	// day, for example "querylog-2024-05-01.json".
+	BackendDaily Backend = "daily"
+)
+
+// sqliteFileName is the name of the SQLite database file within the base
+// directory.
+const sqliteFileName = "querylog.db"
+
+// newStorage returns the built-in storage for conf.  It falls back to the file
+// storage if the backend isn't supported or can't be initialized.
+func newStorage(conf *Config) (s Storage) {
+	filePath := filepath.Join(conf.BaseDir, queryLogFileName)
+
+	switch conf.Backend {
+	case "", BackendFile:
+		// Go on.
+	case BackendSQLite:
+		dbPath := filepath.Join(conf.BaseDir, sqliteFileName)
+		sqlite, err := newSQLiteStorage(dbPath, filePath)
+		if err == nil {
+			return sqlite
+		}
+
+		log.Error("querylog: initializing sqlite storage, using files: %s", err)
+	case BackendDaily:
+		daily, err := newDailyStorage(conf.BaseDir, filePath)
+		if err == nil {
+			daily.maxSize = conf.MaxSize
+			daily.compress = conf.Compress
+			daily.compressLevel = conf.CompressionLevel
+
+			return daily
+		}
+
+		log.Error("querylog: initializing daily storage, using files: %s", err)
+	default:
+		log.Info("querylog: warning: unsupported backend %q, using files", conf.Backend)
+	}
+
+	fs := newFileStorage(filePath)
+	fs.maxSize = conf.MaxSize
+	fs.compress = conf.Compress
+	fs.compressLevel = conf.CompressionLevel
+
+	return fs
+}
+
+// appendFileRecords appends the records from the query log file at path, if it
+// exists, to dst.  num is the number of the appended records.
+func appendFileRecords(dst Storage, path string) (num int, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, gzipExt) {
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(f)
+		if err != nil {
+			return 0, fmt.Errorf("opening gzip: %w", err)
+		}
+
+		r = zr
+	}
+
+	// Store the records in batches to keep the memory usage low.
+	const batchSize = 1000
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, maxEntrySize), bufferSize)
+
+	batch := make([][]byte, 0, batchSize)
+	for sc.Scan() {
+		batch = append(batch, []byte(sc.Text()))
+		if len(batch) < batchSize {
+			continue
+		}
+
+		if err = dst.Append(batch); err != nil {
+			return num, err
+		}
+
+		num += len(batch)
+		batch = batch[:0]
+	}
+
+	if err = sc.Err(); err != nil {
+		return num, fmt.Errorf("reading: %w", err)
+	}
+
+	if err = dst.Append(batch); err != nil {
+		return num, err
+	}
+
+	return num + len(batch), nil
+}
+
+// WriteEvent is an event of writing the entries to the storage.
+type WriteEvent struct {
+	// Err is the error of the failed writing.  It's nil if the writing has
+	// recovered.
+	Err error
+
+	// Pending is the number of entries waiting to be written.
+	Pending int
+
+	// Dropped is the number of the oldest pending entries dropped, since the
+	// memory cap has been exceeded.
+	Dropped int
+}
+
+// WriteStats are the counters of writing the entries to the storage.
+type WriteStats struct {
+	// Written is the number of the entries written to the storage.
+	Written uint64
+
+	// Dropped is the number of the entries dropped, since the write queue has
+	// been full.
+	Dropped uint64
+
+	// Buffered is the number of the entries in memory waiting to be written to
+	// the storage.
+	Buffered uint64
+}
+
+// WriteStats implements the [QueryLog] interface for *queryLog.
+func (l *queryLog) WriteStats() (s *WriteStats) {
+	l.bufferLock.RLock()
+	defer l.bufferLock.RUnlock()
+
+	buffered := l.buffer.Len()
+	for _, q := range l.flushQueue {
+		buffered += len(q)
+	}
+
+	return &WriteStats{
+		Written:  atomic.LoadUint64(&l.writtenTotal),
+		Dropped:  atomic.LoadUint64(&l.droppedTotal),
+		Buffered: uint64(buffered),
+	}
+}
+
+// errQueueFull is the error of the write event reporting the entries dropped,
+// since the storage is failing or too slow to keep up.
+const errQueueFull errors.Error = "write queue is full"
+
+// maxQueuedBuffers is the maximum number of full memory buffers waiting to be
+// written by the writer goroutine.  Once it's exceeded, for example, because
+// the storage is failing or too slow, the oldest entries are dropped, so that
+// the DNS processing is never blocked by the writing.
+const maxQueuedBuffers = 10
+
+// Backoff intervals of retrying writing to the failing storage.
+const (
+	flushRetryMinIvl = 1 * time.Second
+	flushRetryMaxIvl = 5 * time.Minute
+)
+
+// trimQueueLocked drops the oldest queued entries exceeding the memory cap.
+// l.bufferLock is expected to be locked.
+func (l *queryLog) trimQueueLocked() (dropped, pending int) {
+	for _, entries := range l.flushQueue {
+		pending += len(entries)
+	}
+
+	limit := maxQueuedBuffers * l.buffer.Cap()
+	for pending > limit && len(l.flushQueue) > 0 {
+		n := len(l.flushQueue[0])
+		l.flushQueue = l.flushQueue[1:]
+		dropped += n
+		pending -= n
+	}
+
+	if dropped > 0 {
+		atomic.AddUint64(&l.droppedTotal, uint64(dropped))
+	}
+
+	return dropped, pending
+}
+
+// emitWriteEvent calls the write event callback, if any.  l.bufferLock is
+// expected to be unlocked.
+func (l *queryLog) emitWriteEvent(e *WriteEvent) {
+	if e.Dropped > 0 {
+		log.Error("querylog: dropped %d entries, since the write queue is full", e.Dropped)
+	}
+
+	if l.conf.OnWriteEvent != nil {
+		l.conf.OnWriteEvent(e)
+	}
+}
+
+// flushLogBuffer writes the queued entries to the storage.  If fullFlush is
+// true, the entries from the current buffer are written as well.  If the
+// writing fails, the entries that haven't been written are kept in the queue
+// until the next attempt.
+func (l *queryLog) flushLogBuffer(fullFlush bool) (err error) {
+	if !l.fileEnabled() {
+		return nil
+	}
+
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	l.bufferLock.Lock()
+	if fullFlush && l.coalescer != nil {
+		_, dropped, pending := l.pushLocked(l.coalescer.flush())
+		if dropped > 0 {
+			defer l.emitWriteEvent(&WriteEvent{
+				Err:     errQueueFull,
+				Pending: pending,
+				Dropped: dropped,
+			})
+		}
+	}
+
+	if fullFlush {
+		l.queueBufferLocked()
+	}
+
+	queue := l.flushQueue
+	l.flushQueue = nil
+	l.bufferLock.Unlock()
+
+	for i, entries := range queue {
+		err = l.flushToStorage(entries)
+		if err != nil {
+			log.Error("querylog: saving to storage: %s", err)
+			l.requeue(queue[i:], err)
+
+			return err
+		}
+	}
+
+	if l.writeFailing {
+		l.writeFailing = false
+		log.Info("querylog: saving to storage recovered")
+		l.emitWriteEvent(&WriteEvent{})
+	}
+
+	return nil
+}
+
+// requeue puts the entries that failed to be written because of err back in
+// front of the queue.  l.fileFlushLock is expected to be locked.
+func (l *queryLog) requeue(failed [][]*logEntry, err error) {
+	l.bufferLock.Lock()
+	l.flushQueue = append(slices.Clip(failed), l.flushQueue...)
+	dropped, pending := l.trimQueueLocked()
+	l.bufferLock.Unlock()
+
+	if !l.writeFailing || dropped > 0 {
+		l.writeFailing = true
+		l.emitWriteEvent(&WriteEvent{
+			Err:     err,
+			Pending: pending,
+			Dropped: dropped,
+		})
+	}
+}
+
+// runWriter writes the queued entries to the storage each time it's woken up
+// through l.flushCh until the query log is closed.  If the flush interval is
+// set, the entries of the incomplete memory buffer are also written once it
+// passes.
+func (l *queryLog) runWriter() {
+	defer log.OnPanic("querylog: writing")
+
+	for {
+		var tick <-chan time.Time
+		var t *time.Timer
+		if ivl := l.flushInterval(); ivl > 0 {
+			t = time.NewTimer(ivl)
+			tick = t.C
+		}
+
+		select {
+		case <-l.flushCh:
+			// Go on.
+		case <-tick:
+			l.queueBuffer()
+		case <-l.done:
+			stopTimer(t)
+
+			return
+		}
+
+		stopTimer(t)
+		if !l.flushWithRetry() {
+			return
+		}
+	}
+}
+
+// stopTimer stops t, if it's not nil.
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// flushWithRetry writes the queued entries to the storage, retrying with
+// backoff while the storage is failing.  It returns false if the query log has
+// been closed while waiting for the next attempt.
+func (l *queryLog) flushWithRetry() (cont bool) {
+	ivl := flushRetryMinIvl
+	for {
+		err := l.flushLogBuffer(false)
+		if err == nil {
+			// The entries queued while writing have woken up the writer
+			// again, so there is no need to check the queue.
+			return true
+		}
+
+		log.Info("querylog: retrying saving to storage in %s", ivl)
+
+		t := time.NewTimer(ivl)
+		select {
+		case <-t.C:
+			// Go on.
+		case <-l.done:
+			t.Stop()
+
+			return false
+		}
+
+		ivl *= 2
+		if ivl > flushRetryMaxIvl {
+			ivl = flushRetryMaxIvl
+		}
+	}
+}
+
+// flushToStorage encodes and saves the log entries to the storage.
+// l.fileFlushLock is expected to be locked.
+func (l *queryLog) flushToStorage(entries []*logEntry) (err error) {
+	if len(entries) == 0 {
+		log.Debug("querylog: there's nothing to write to the storage")
+
+		return nil
+	}
+
+	start := time.Now()
+
+	size := 0
+	records := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		var rec []byte
+		rec, err = json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encoding entry: %w", err)
+		}
+
+		size += len(rec)
+		records = append(records, rec)
+	}
+
+	elapsed := time.Since(start)
+	log.Debug(
+		"querylog: %d elements serialized via json in %v: %d kB, %v/entry, %v/entry",
+		len(entries),
+		elapsed,
+		size/1024,
+		float64(size)/float64(len(entries)),
+		elapsed/time.Duration(len(entries)),
+	)
+
+	err = l.storage.Append(records)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&l.writtenTotal, uint64(len(entries)))
+
+	return nil
+}
+
+// periodicRotate removes the outdated records from the storage once in a
+// while.
+func (l *queryLog) periodicRotate() {
+	defer log.OnPanic("querylog: rotating")
+
+	l.rotate()
+
+	// rotationCheckIvl is the period of time between checking the need for
+	// rotating log files.  It's smaller of any available rotation interval to
+	// increase time accuracy.
+	//
+	// See https://github.com/AdguardTeam/AdGuardHome/issues/3823.
+	const rotationCheckIvl = 1 * time.Hour
+
+	rotations := time.NewTicker(rotationCheckIvl)
+	defer rotations.Stop()
+
+	for {
+		select {
+		case <-rotations.C:
+			l.rotate()
+		case <-l.done:
+			log.Debug("querylog: periodic rotation finished")
+
+			return
+		}
+	}
+}
+
+// rotate removes the records older than the rotation interval from the
+// storage, pruning them if the storage keeps them after the rotation, strips
+// the clients from the records older than the client retention period, and
+// archives the rotated files.
+func (l *queryLog) rotate() {
+	// Take a snapshot, since the configuration may be replaced by the HTTP API
+	// concurrently.
+	l.lock.Lock()
+	conf := *l.conf
+	l.lock.Unlock()
+
+	err := l.storage.Rotate(conf.RotationIvl)
+	if err != nil {
+		log.Error("querylog: rotating: %s", err)
+
+		return
+	}
+
+	log.Debug("querylog: rotated successfully")
+
+	if ps, ok := l.storage.(pruningStorage); ok {
+		err = ps.Prune(conf.RotationIvl)
+		if err != nil {
+			log.Error("querylog: pruning: %s", err)
+		}
+	}
+
+	// Strip the clients first, so that the archived files are stripped.
+	l.stripClients(conf.ClientRetention)
+
+	l.archive(conf.ClientRetention)
+}
@@ -0,0 +1,228 @@
+package querylog
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStorage is a [Storage] keeping the records in memory.
+type testStorage struct {
+	// appendErr, if not nil, is returned from Append.
+	appendErr error
+
+	records []string
+}
+
+// type check
+var _ Storage = (*testStorage)(nil)
+
+// Append implements the [Storage] interface for *testStorage.
+func (s *testStorage) Append(records [][]byte) (err error) {
+	if s.appendErr != nil {
+		return s.appendErr
+	}
+
+	for _, rec := range records {
+		s.records = append(s.records, string(rec))
+	}
+
+	return nil
+}
+
+// Iterate implements the [Storage] interface for *testStorage.
+func (s *testStorage) Iterate(olderThan time.Time, f func(rec string) (cont bool)) (err error) {
+	for i := len(s.records) - 1; i >= 0; i-- {
+		rec := s.records[i]
+		if !olderThan.IsZero() && readQLogTimestamp(rec) >= olderThan.UnixNano() {
+			continue
+		}
+
+		if !f(rec) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Rotate implements the [Storage] interface for *testStorage.
+func (s *testStorage) Rotate(_ time.Duration) (err error) {
+	return nil
+}
+
+// Clear implements the [Storage] interface for *testStorage.
+func (s *testStorage) Clear() (err error) {
+	s.records = nil
+
+	return nil
+}
+
+func TestQueryLog_storage(t *testing.T) {
+	s := &testStorage{}
+	l := newQueryLog(Config{
+		Storage:     s,
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+	require.Len(t, s.records, 2)
+
+	params := newSearchParams()
+	entries, _ := l.search(params)
+	require.Len(t, entries, 2)
+
+	assertLogEntry(t, entries[0], "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	assertLogEntry(t, entries[1], "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	e, err := l.findEntry(entries[1].Time.UnixNano())
+	require.NoError(t, err)
+	require.NotNil(t, e)
+
+	assert.Equal(t, "first.example", e.QHost)
+
+	l.clear()
+	assert.Empty(t, s.records)
+}
+
+func TestQueryLog_flushLogBuffer_failing(t *testing.T) {
+	const memSize = 2
+
+	var events []*WriteEvent
+	s := &testStorage{}
+	l := newQueryLog(Config{
+		Storage: s,
+		OnWriteEvent: func(e *WriteEvent) {
+			events = append(events, e)
+		},
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     memSize,
+		BaseDir:     t.TempDir(),
+	})
+
+	// The writer goroutine isn't started, so flush the buffer manually.
+	const testErr errors.Error = "disk is gone"
+	s.appendErr = testErr
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.ErrorIs(t, l.flushLogBuffer(true), testErr)
+	require.Len(t, events, 1)
+
+	assert.Equal(t, &WriteEvent{Err: testErr, Pending: 1}, events[0])
+
+	// The entry is kept until the next attempt.
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 1)
+
+	// Exceed the memory cap.
+	const entNum = maxQueuedBuffers * memSize
+	for i := 0; i < entNum; i++ {
+		addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	}
+
+	require.Len(t, events, 2)
+
+	assert.Equal(t, &WriteEvent{
+		Err:     errQueueFull,
+		Pending: entNum,
+		Dropped: 1,
+	}, events[1])
+
+	s.appendErr = nil
+	require.NoError(t, l.flushLogBuffer(true))
+	require.Len(t, events, 3)
+
+	assert.Equal(t, &WriteEvent{}, events[2])
+	assert.Len(t, s.records, entNum)
+
+	assert.Equal(t, &WriteStats{Written: entNum, Dropped: 1}, l.WriteStats())
+}
+
+func TestQueryLog_runWriter(t *testing.T) {
+	const memSize = 2
+
+	s := &testStorage{}
+	l := newQueryLog(Config{
+		Storage:     s,
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     memSize,
+		BaseDir:     t.TempDir(),
+	})
+
+	go l.runWriter()
+	t.Cleanup(l.Close)
+
+	for i := 0; i < 2*memSize; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	require.Eventually(t, func() (ok bool) {
+		return l.WriteStats().Written == 2*memSize
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Len(t, s.records, 2*memSize)
+	assert.Zero(t, l.WriteStats().Dropped)
+}
+
+func TestQueryLog_Close(t *testing.T) {
+	const entNum = 3
+
+	dir := t.TempDir()
+	conf := Config{
+		Enabled:       true,
+		FileEnabled:   true,
+		RotationIvl:   timeutil.Day,
+		MemSize:       100,
+		FlushInterval: time.Hour,
+		BaseDir:       dir,
+	}
+
+	l := newQueryLog(conf)
+	l.Start()
+
+	for i := 0; i < entNum; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	// None of the entries are written until the query log is closed, since
+	// the memory buffer isn't full and the flush interval hasn't passed.
+	assert.Zero(t, l.WriteStats().Written)
+
+	l.Close()
+	assert.Equal(t, uint64(entNum), l.WriteStats().Written)
+
+	reopened := newQueryLog(conf)
+	entries, _ := reopened.search(newSearchParams())
+	assert.Len(t, entries, entNum)
+}
+
+func TestSyncFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), queryLogFileName)
+
+	t.Run("no_file", func(t *testing.T) {
+		assert.NoError(t, syncFile(path))
+	})
+
+	t.Run("file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("{}\n"), 0o644))
+
+		assert.NoError(t, syncFile(path))
+	})
+}
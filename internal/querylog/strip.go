@@ -0,0 +1,324 @@
+package querylog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+)
+
+// The unspecified addresses replacing the client IP addresses in the stripped
+// records.
+const (
+	strippedIPv4 = "0.0.0.0"
+	strippedIPv6 = "::"
+)
+
+// clientStrippingStorage is a [Storage] able to remove the client identifiers
+// from the old records, keeping the rest of them.
+type clientStrippingStorage interface {
+	Storage
+
+	// StripClients replaces the client IP addresses with the unspecified ones
+	// and removes the ClientIDs and the EDNS Client Subnets from the records
+	// made before olderThan.  n is the number of the stripped records.
+	StripClients(olderThan time.Time) (n int, err error)
+}
+
+// type check
+var _ clientStrippingStorage = (*fileStorage)(nil)
+
+// stripClients removes the client identifiers from the records older than the
+// client retention period ivl, if it's set and the storage supports it.  ivl
+// must be taken from a snapshot of the configuration made under l.lock.
+func (l *queryLog) stripClients(ivl time.Duration) {
+	ss, ok := l.storage.(clientStrippingStorage)
+	if ivl <= 0 || !ok {
+		return
+	}
+
+	olderThan := time.Now().Add(-ivl)
+	n, err := ss.StripClients(olderThan)
+	if err != nil {
+		log.Error("querylog: stripping clients: %s", err)
+	}
+
+	if n > 0 {
+		log.Info("querylog: stripped clients from %d records older than %s", n, olderThan)
+	}
+}
+
+// stripRecord returns rec with the client IP address replaced with the
+// unspecified one and without the ClientID and the EDNS Client Subnet.  ok is
+// false if rec is already stripped, so it's returned as is.
+func stripRecord(rec string) (stripped string, ok bool) {
+	stripped = removeJSONStringField(rec, `"ECS":"`)
+	stripped = removeJSONStringField(stripped, `"CID":"`)
+	stripped = replaceRecordIP(stripped)
+
+	return stripped, stripped != rec
+}
+
+// removeJSONStringField removes the first string field, which key with the
+// opening quote of the value is prefix, from the JSON object in s along with
+// the separating comma.  The value mustn't contain escaped quotes.
+func removeJSONStringField(s, prefix string) (res string) {
+	start := strings.Index(s, prefix)
+	if start == -1 {
+		return s
+	}
+
+	i := strings.IndexByte(s[start+len(prefix):], '"')
+	if i == -1 {
+		return s
+	}
+
+	end := start + len(prefix) + i + 1
+	if end < len(s) && s[end] == ',' {
+		end++
+	} else if start > 0 && s[start-1] == ',' {
+		start--
+	}
+
+	return s[:start] + s[end:]
+}
+
+// replaceRecordIP replaces the client IP address in the record rec with the
+// unspecified address of the same family.  The client IP address is the last
+// field named "IP" in the record, since the ones of the rules come before it.
+func replaceRecordIP(rec string) (res string) {
+	const prefix = `"IP":"`
+
+	i := strings.LastIndex(rec, prefix)
+	if i == -1 {
+		return rec
+	}
+
+	start := i + len(prefix)
+	n := strings.IndexByte(rec[start:], '"')
+	if n == -1 {
+		return rec
+	}
+
+	ip := rec[start : start+n]
+	if ip == "" || ip == strippedIPv4 || ip == strippedIPv6 {
+		return rec
+	}
+
+	repl := strippedIPv4
+	if strings.Contains(ip, ":") {
+		repl = strippedIPv6
+	}
+
+	return rec[:start] + repl + rec[start+n:]
+}
+
+// StripClients implements the [clientStrippingStorage] interface for
+// *fileStorage.
+func (s *fileStorage) StripClients(olderThan time.Time) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, p := range []string{s.gzOldPath(), s.oldPath(), s.path} {
+		var fileN int
+		fileN, err = stripFile(p, olderThan.UnixNano(), s.compressLevel)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stripping %q: %w", p, err))
+		}
+
+		n += fileN
+	}
+
+	if len(errs) > 0 {
+		return n, errors.List("stripping files", errs...)
+	}
+
+	return n, nil
+}
+
+// stripFile removes the client identifiers from the records made before
+// olderThan, in nanoseconds, in the query log file at path, which is gzipped if
+// it has the gzipExt extension, and updates its index.  The file is only
+// rewritten if some of these records aren't stripped yet.  level is the gzip
+// compression level.  n is the number of stripped records.
+func stripFile(path string, olderThan int64, level int) (n int, err error) {
+	need, err := needsStripping(path, olderThan)
+	if err != nil || !need {
+		return 0, err
+	}
+
+	r, closer, err := openQLogFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, closer.Close()) }()
+
+	// The index is only read to be updated, so an invalid one is removed.
+	idx, err := os.ReadFile(qlogIndexPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("reading index: %w", err)
+	} else if len(idx)%qlogIndexEntrySize != 0 {
+		idx = nil
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer log.OnPanic("querylog: stripping")
+
+		var serr error
+		n, serr = stripRecords(pw, r, olderThan, idx)
+		_ = pw.CloseWithError(serr)
+	}()
+
+	err = rewriteFile(path, pr, strings.HasSuffix(path, gzipExt), level)
+
+	// Unblock the stripping goroutine, if the rewriting has failed.
+	_ = pr.CloseWithError(err)
+	<-done
+
+	if err != nil {
+		return 0, err
+	}
+
+	if idx == nil {
+		err = removeIfExists(qlogIndexPath(path))
+	} else {
+		err = maybe.WriteFile(qlogIndexPath(path), idx, 0o644)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("updating index: %w", err)
+	}
+
+	return n, nil
+}
+
+// openQLogFile opens the query log file at path for reading, decompressing it
+// if it has the gzipExt extension.  closer closes the file.
+func openQLogFile(path string) (r *bufio.Reader, closer io.Closer, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening: %w", err)
+	}
+
+	var src io.Reader = f
+	if strings.HasSuffix(path, gzipExt) {
+		src, err = gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, errors.WithDeferred(fmt.Errorf("opening gzip: %w", err), f.Close())
+		}
+	}
+
+	return bufio.NewReaderSize(src, maxRecordLen), f, nil
+}
+
+// needsStripping returns true if the query log file at path has any records
+// made before olderThan, in nanoseconds, which aren't stripped yet.
+func needsStripping(path string, olderThan int64) (ok bool, err error) {
+	r, closer, err := openQLogFile(path)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, io.EOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer func() { err = errors.WithDeferred(err, closer.Close()) }()
+
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if line != "" && readQLogTimestamp(line) < olderThan {
+			if _, ok = stripRecord(line); ok {
+				return true, nil
+			}
+		} else if line != "" {
+			return false, nil
+		}
+
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("reading: %w", err)
+		}
+	}
+}
+
+// stripRecords writes the records from r into w removing the client
+// identifiers from the ones made before olderThan, in nanoseconds.  The offsets
+// of the index entries in idx are updated accordingly.  n is the number of
+// stripped records.
+func stripRecords(w io.Writer, r *bufio.Reader, olderThan int64, idx []byte) (n int, err error) {
+	bw := bufio.NewWriter(w)
+
+	// shift is the total number of bytes removed from the records read so
+	// far.
+	var off, shift int64
+	for {
+		idx = shiftQLogIndex(idx, off, shift)
+
+		var line string
+		line, err = r.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("reading: %w", err)
+		}
+
+		off += int64(len(line))
+		if readQLogTimestamp(line) >= olderThan {
+			_, err = bw.WriteString(line)
+			if err != nil {
+				return 0, fmt.Errorf("writing: %w", err)
+			}
+
+			break
+		}
+
+		stripped, ok := stripRecord(line)
+		if ok {
+			n++
+			shift += int64(len(line) - len(stripped))
+		}
+
+		_, err = bw.WriteString(stripped)
+		if err != nil {
+			return 0, fmt.Errorf("writing: %w", err)
+		}
+	}
+
+	// The rest of the records are kept as is.
+	shiftQLogIndex(idx, -1, shift)
+
+	_, err = io.Copy(bw, r)
+	if err != nil {
+		return 0, fmt.Errorf("copying: %w", err)
+	}
+
+	return n, bw.Flush()
+}
+
+// shiftQLogIndex subtracts shift from the offsets of the leading entries of the
+// index idx, which are less than or equal to off, or of all the entries, if
+// off is negative.  It returns the rest of idx.
+func shiftQLogIndex(idx []byte, off, shift int64) (rest []byte) {
+	for ; len(idx) > 0; idx = idx[qlogIndexEntrySize:] {
+		ent := idx[8:qlogIndexEntrySize]
+		entOff := int64(binary.BigEndian.Uint64(ent))
+		if off >= 0 && entOff > off {
+			break
+		}
+
+		binary.BigEndian.PutUint64(ent, uint64(entOff-shift))
+	}
+
+	return idx
+}
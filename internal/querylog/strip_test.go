@@ -0,0 +1,168 @@
+package querylog
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripRecord(t *testing.T) {
+	testCases := []struct {
+		name   string
+		rec    string
+		want   string
+		wantOK bool
+	}{{
+		name:   "ipv4",
+		rec:    `{"T":"t","QH":"example.org","ECS":"1.2.3.0/24","CID":"cid","CP":"","IP":"1.2.3.4","Elapsed":1}`,
+		want:   `{"T":"t","QH":"example.org","CP":"","IP":"0.0.0.0","Elapsed":1}`,
+		wantOK: true,
+	}, {
+		name:   "ipv6",
+		rec:    `{"T":"t","QH":"example.org","CP":"","IP":"2001:db8::1"}`,
+		want:   `{"T":"t","QH":"example.org","CP":"","IP":"::"}`,
+		wantOK: true,
+	}, {
+		name: "rules",
+		rec: `{"T":"t","Result":{"Rules":[{"IP":"1.1.1.1"}]},` +
+			`"IP":"1.2.3.4"}`,
+		want: `{"T":"t","Result":{"Rules":[{"IP":"1.1.1.1"}]},` +
+			`"IP":"0.0.0.0"}`,
+		wantOK: true,
+	}, {
+		name:   "last_field",
+		rec:    `{"T":"t","CID":"cid"}`,
+		want:   `{"T":"t"}`,
+		wantOK: true,
+	}, {
+		name:   "stripped",
+		rec:    `{"T":"t","CP":"","IP":"0.0.0.0"}`,
+		want:   `{"T":"t","CP":"","IP":"0.0.0.0"}`,
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := stripRecord(tc.rec)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+// newStripTestRecords returns n records made a second apart starting at start
+// with the client identifiers.
+func newStripTestRecords(start time.Time, n int) (recs [][]byte) {
+	for i := 0; i < n; i++ {
+		t := start.Add(time.Duration(i) * time.Second).Format(time.RFC3339Nano)
+		rec := fmt.Sprintf(`{"T":"%s","QH":"example.org","CID":"client%d","CP":"","IP":"1.2.3.%d"}`, t, i, i)
+		recs = append(recs, []byte(rec))
+	}
+
+	return recs
+}
+
+func TestFileStorage_StripClients(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress_%t", compress), func(t *testing.T) {
+			s := newFileStorage(filepath.Join(t.TempDir(), queryLogFileName))
+			start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			// Write one batch into the previous file and two into the
+			// current one.
+			require.NoError(t, s.Append(newStripTestRecords(start, 10)))
+			require.NoError(t, s.rename())
+			require.NoError(t, s.Append(newStripTestRecords(start.Add(10*time.Second), 10)))
+			require.NoError(t, s.Append(newStripTestRecords(start.Add(20*time.Second), 10)))
+
+			if compress {
+				require.NoError(t, s.compressOld())
+			}
+
+			olderThan := start.Add(15 * time.Second)
+			n, err := s.StripClients(olderThan)
+			require.NoError(t, err)
+
+			assert.Equal(t, 15, n)
+
+			var recs []string
+			err = s.Iterate(time.Time{}, func(rec string) (cont bool) {
+				recs = append(recs, rec)
+
+				return true
+			})
+			require.NoError(t, err)
+			require.Len(t, recs, 30)
+
+			for _, rec := range recs {
+				ts := time.Unix(0, readQLogTimestamp(rec))
+				if ts.Before(olderThan) {
+					assert.Contains(t, rec, `"IP":"0.0.0.0"`)
+					assert.NotContains(t, rec, "CID")
+				} else {
+					assert.Contains(t, rec, `"CID":"client`)
+				}
+			}
+
+			// The updated index still points at the right records.
+			var got time.Time
+			err = s.Iterate(start.Add(18*time.Second), func(rec string) (cont bool) {
+				got = time.Unix(0, readQLogTimestamp(rec))
+
+				return false
+			})
+			require.NoError(t, err)
+
+			assert.True(t, start.Add(17*time.Second).Equal(got))
+
+			// The stripped records aren't stripped again.
+			n, err = s.StripClients(olderThan)
+			require.NoError(t, err)
+
+			assert.Zero(t, n)
+		})
+	}
+}
+
+func TestQueryLog_rotate_concurrentConfig(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:         true,
+		FileEnabled:     true,
+		RotationIvl:     timeutil.Day,
+		ClientRetention: time.Hour,
+		MemSize:         100,
+		BaseDir:         t.TempDir(),
+	})
+	l.Start()
+	t.Cleanup(l.Close)
+
+	const n = 10
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < n; i++ {
+			l.rotate()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		body := strings.NewReader(`{"enabled":true,"interval":1}`)
+		r := httptest.NewRequest(http.MethodPut, "/control/querylog_config", body)
+		w := httptest.NewRecorder()
+
+		l.handleQueryLogConfig(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	<-done
+}
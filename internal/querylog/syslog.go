@@ -0,0 +1,436 @@
+package querylog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// SyslogProto is the transport protocol used to send the entries to a syslog
+// server.
+type SyslogProto string
+
+// Supported syslog transport protocols.
+const (
+	SyslogProtoUDP SyslogProto = "udp"
+	SyslogProtoTCP SyslogProto = "tcp"
+	SyslogProtoTLS SyslogProto = "tls"
+)
+
+// SyslogFormat is the format of the entries sent to a syslog server.
+type SyslogFormat string
+
+// Supported syslog message formats.
+const (
+	// SyslogFormatRFC5424 is the format described in RFC 5424 with the
+	// details of the entry in the structured data.
+	SyslogFormatRFC5424 SyslogFormat = "rfc5424"
+
+	// SyslogFormatCEF is the ArcSight Common Event Format wrapped into an RFC
+	// 5424 message without structured data.
+	SyslogFormatCEF SyslogFormat = "cef"
+)
+
+// defaultSyslogQueueSize is the default number of entries waiting to be sent
+// to the syslog server.
+const defaultSyslogQueueSize = 1000
+
+// SyslogConfig is the configuration of forwarding the query log entries to a
+// remote syslog server.
+type SyslogConfig struct {
+	// Address is the address of the syslog server in the host:port form.
+	Address string `yaml:"address"`
+
+	// Protocol is the transport protocol.  If empty, SyslogProtoUDP is used.
+	Protocol SyslogProto `yaml:"protocol"`
+
+	// Format is the format of the messages.  If empty, SyslogFormatRFC5424 is
+	// used.
+	Format SyslogFormat `yaml:"format"`
+
+	// QueueSize is the maximum number of entries waiting to be sent.  The new
+	// entries are dropped when the queue is full, so that processing of the
+	// DNS requests is never blocked by the syslog server.  If zero,
+	// defaultSyslogQueueSize is used.
+	QueueSize int `yaml:"queue_size"`
+
+	// Enabled tells if the entries should be forwarded.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validate returns an error if the enabled configuration isn't valid.
+func (c *SyslogConfig) validate() (err error) {
+	if !c.Enabled {
+		return nil
+	}
+
+	if _, _, err = net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("syslog address: %w", err)
+	}
+
+	switch c.Protocol {
+	case "", SyslogProtoUDP, SyslogProtoTCP, SyslogProtoTLS:
+		// Go on.
+	default:
+		return fmt.Errorf("invalid syslog protocol %q", c.Protocol)
+	}
+
+	switch c.Format {
+	case "", SyslogFormatRFC5424, SyslogFormatCEF:
+		// Go on.
+	default:
+		return fmt.Errorf("invalid syslog format %q", c.Format)
+	}
+
+	if c.QueueSize < 0 {
+		return fmt.Errorf("syslog queue size %d is negative", c.QueueSize)
+	}
+
+	return nil
+}
+
+// Syslog sending timeouts.
+const (
+	// syslogDialTimeout is the timeout for connecting to the syslog server.
+	syslogDialTimeout = 10 * time.Second
+
+	// syslogWriteTimeout is the timeout for sending a single message.
+	syslogWriteTimeout = 5 * time.Second
+
+	// syslogRedialIvl is the minimum interval between the attempts to connect
+	// to the syslog server.  The entries are dropped in between.
+	syslogRedialIvl = 5 * time.Second
+)
+
+// syslogSink sends the query log entries to a remote syslog server.
+type syslogSink struct {
+	// dial connects to the syslog server.
+	dial func() (conn net.Conn, err error)
+
+	// conn is the current connection to the syslog server.  It's only used
+	// within the sending goroutine.
+	conn net.Conn
+
+	// lastDial is the time of the latest connection attempt.  It's only used
+	// within the sending goroutine.
+	lastDial time.Time
+
+	// anonymizer processes the IP addresses of the sent entries.
+	anonymizer *aghnet.IPMut
+
+	// queue contains the entries waiting to be sent.
+	queue chan *logEntry
+
+	// done is closed when the sink is closed.
+	done chan struct{}
+
+	// wg is used to wait for the sending goroutine to finish.
+	wg *sync.WaitGroup
+
+	// hostname is the HOSTNAME field of the messages.
+	hostname string
+
+	// format is the format of the messages.
+	format SyslogFormat
+
+	// framed is true if the messages should be framed with octet counting, as
+	// described in RFC 6587, which is the case for the stream protocols.
+	framed bool
+
+	// dropped is the number of entries dropped since the last report.  It
+	// must be accessed atomically.
+	dropped uint64
+}
+
+// newSyslogSink returns a new syslog sink.  conf must be valid and enabled.
+func newSyslogSink(conf *SyslogConfig, anonymizer *aghnet.IPMut) (s *syslogSink) {
+	queueSize := conf.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultSyslogQueueSize
+	}
+
+	format := conf.Format
+	if format == "" {
+		format = SyslogFormatRFC5424
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	s = &syslogSink{
+		anonymizer: anonymizer,
+		queue:      make(chan *logEntry, queueSize),
+		done:       make(chan struct{}),
+		wg:         &sync.WaitGroup{},
+		hostname:   hostname,
+		format:     format,
+		framed:     conf.Protocol == SyslogProtoTCP || conf.Protocol == SyslogProtoTLS,
+	}
+
+	addr := conf.Address
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	switch conf.Protocol {
+	case SyslogProtoTCP:
+		s.dial = func() (conn net.Conn, err error) { return dialer.Dial("tcp", addr) }
+	case SyslogProtoTLS:
+		s.dial = func() (conn net.Conn, err error) {
+			return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			})
+		}
+	default:
+		s.dial = func() (conn net.Conn, err error) { return dialer.Dial("udp", addr) }
+	}
+
+	return s
+}
+
+// start starts sending the queued entries.
+func (s *syslogSink) start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// close stops sending the entries and closes the connection.  The entries
+// still in the queue are discarded.
+func (s *syslogSink) close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// send queues e to be sent.  It never blocks, dropping e if the queue is full.
+// e must not be modified after that.
+func (s *syslogSink) send(e *logEntry) {
+	select {
+	case s.queue <- e:
+		// Go on.
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// run sends the queued entries until the sink is closed.
+func (s *syslogSink) run() {
+	defer s.wg.Done()
+	defer log.OnPanic("querylog: syslog")
+
+	for {
+		select {
+		case e := <-s.queue:
+			s.write(e)
+		case <-s.done:
+			if s.conn != nil {
+				if err := s.conn.Close(); err != nil {
+					log.Debug("querylog: syslog: closing connection: %s", err)
+				}
+			}
+
+			return
+		}
+	}
+}
+
+// write sends e to the syslog server, connecting to it if needed.  e is
+// dropped on errors.
+func (s *syslogSink) write(e *logEntry) {
+	if s.conn == nil {
+		if time.Since(s.lastDial) < syslogRedialIvl {
+			atomic.AddUint64(&s.dropped, 1)
+
+			return
+		}
+
+		s.lastDial = time.Now()
+
+		var err error
+		s.conn, err = s.dial()
+		if err != nil {
+			// Make sure the typed nil isn't kept.
+			s.conn = nil
+			atomic.AddUint64(&s.dropped, 1)
+			log.Error("querylog: syslog: connecting: %s", err)
+
+			return
+		}
+	}
+
+	msg := s.message(e)
+	if s.framed {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	err := s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if err == nil {
+		_, err = s.conn.Write(msg)
+	}
+
+	if err != nil {
+		atomic.AddUint64(&s.dropped, 1)
+		log.Error("querylog: syslog: sending: %s", err)
+
+		// Reconnect on the next entry, since the stream may be broken.
+		_ = s.conn.Close()
+		s.conn = nil
+
+		return
+	}
+
+	if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+		log.Info("querylog: syslog: dropped %d entries", dropped)
+	}
+}
+
+// Syslog message fields.
+const (
+	// syslogPriority is the priority of the messages, which is the facility
+	// "daemon" and the severity "informational".
+	syslogPriority = 3*8 + 6
+
+	// syslogAppName is the APP-NAME field of the messages.
+	syslogAppName = "AdGuardHome"
+
+	// syslogMsgID is the MSGID field of the messages.
+	syslogMsgID = "query"
+
+	// syslogSDID is the SD-ID of the structured data element containing the
+	// details of the entry.  32473 is the private enterprise number reserved
+	// for the documentation by RFC 5612.
+	syslogSDID = "query@32473"
+
+	// syslogTimeFormat is the TIMESTAMP format, which allows at most six
+	// digits of the fraction of a second.
+	syslogTimeFormat = "2006-01-02T15:04:05.999999Z07:00"
+)
+
+// message returns the syslog message for e in the sink's format.
+func (s *syslogSink) message(e *logEntry) (msg []byte) {
+	ee := newExportEntry(e, s.anonymizer.Load())
+
+	b := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(
+		b,
+		"<%d>1 %s %s %s %d %s ",
+		syslogPriority,
+		e.Time.UTC().Format(syslogTimeFormat),
+		s.hostname,
+		syslogAppName,
+		os.Getpid(),
+		syslogMsgID,
+	)
+
+	if s.format == SyslogFormatCEF {
+		b.WriteString("- ")
+		writeCEF(b, e, ee)
+
+		return b.Bytes()
+	}
+
+	writeSD(b, ee)
+	_, _ = fmt.Fprintf(b, " %s %s %s %s", ee.Client, ee.QName, ee.QType, ee.Reason)
+
+	return b.Bytes()
+}
+
+// sdValueReplacer escapes the characters, which must be escaped within the
+// PARAM-VALUE of the RFC 5424 structured data.
+var sdValueReplacer = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// writeSD writes the structured data element describing e to b.
+func writeSD(b *bytes.Buffer, e *exportEntry) {
+	b.WriteString("[" + syslogSDID)
+
+	writeParam := func(name, val string) {
+		if val != "" {
+			_, _ = fmt.Fprintf(b, ` %s="%s"`, name, sdValueReplacer.Replace(val))
+		}
+	}
+
+	writeParam("client", e.Client)
+	writeParam("client_id", e.ClientID)
+	writeParam("client_proto", string(e.ClientProto))
+	writeParam("qname", e.QName)
+	writeParam("qtype", e.QType)
+	writeParam("qclass", e.QClass)
+	writeParam("status", e.Status)
+	writeParam("reason", e.Reason)
+	writeParam("rule", e.Rule)
+	writeParam("upstream", e.Upstream)
+	writeParam("elapsed_ms", strconv.FormatFloat(e.ElapsedMs, 'f', -1, 64))
+	writeParam("cached", strconv.FormatBool(e.Cached))
+
+	b.WriteString("]")
+}
+
+// CEF escaping.
+var (
+	// cefHeaderReplacer escapes the characters, which must be escaped within
+	// the CEF header fields.
+	cefHeaderReplacer = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+
+	// cefExtReplacer escapes the characters, which must be escaped within the
+	// CEF extension values.
+	cefExtReplacer = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// CEF severities of the entries.
+const (
+	cefSeverityAllowed  = 1
+	cefSeverityFiltered = 5
+)
+
+// writeCEF writes the CEF representation of e to b.  ee is the decoded e.
+func writeCEF(b *bytes.Buffer, e *logEntry, ee *exportEntry) {
+	sev := cefSeverityAllowed
+	if e.Result.IsFiltered {
+		sev = cefSeverityFiltered
+	}
+
+	_, _ = fmt.Fprintf(
+		b,
+		"CEF:0|AdGuard|AdGuard Home|%s|%s|DNS query|%d|",
+		cefHeaderReplacer.Replace(version.Version()),
+		cefHeaderReplacer.Replace(ee.Reason),
+		sev,
+	)
+
+	ext := []string{}
+	writeExt := func(key, val string) {
+		if val != "" {
+			ext = append(ext, key+"="+cefExtReplacer.Replace(val))
+		}
+	}
+
+	// writeCustom writes the custom extension field along with its label.
+	writeCustom := func(key, label, val string) {
+		if val != "" {
+			writeExt(key+"Label", label)
+			writeExt(key, val)
+		}
+	}
+
+	writeExt("rt", strconv.FormatInt(e.Time.UnixMilli(), 10))
+	writeExt("src", ee.Client)
+	writeExt("dhost", ee.QName)
+	writeExt("act", ee.Reason)
+	writeCustom("cs1", "qtype", ee.QType)
+	writeCustom("cs2", "status", ee.Status)
+	writeCustom("cs3", "upstream", ee.Upstream)
+	writeCustom("cs4", "rule", ee.Rule)
+	writeCustom("cs5", "clientId", ee.ClientID)
+	writeCustom("cn1", "elapsedMs", strconv.FormatInt(e.Elapsed.Milliseconds(), 10))
+
+	b.WriteString(strings.Join(ext, " "))
+}
@@ -0,0 +1,155 @@
+package querylog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSyslogTestEntry returns a new log entry for the syslog tests.
+func newSyslogTestEntry() (e *logEntry) {
+	return &logEntry{
+		Time:     time.Date(2022, 1, 2, 3, 4, 5, 123456789, time.UTC),
+		QHost:    "example.org",
+		QType:    "A",
+		QClass:   "IN",
+		ClientID: "cli|ent",
+		Result: filtering.Result{
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+			Rules: []*filtering.ResultRule{{
+				Text: `||example.org^$ctag="x"`,
+			}},
+		},
+		IP:      net.IP{1, 2, 3, 4},
+		Elapsed: 12 * time.Millisecond,
+	}
+}
+
+func TestSyslogSink_message(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format SyslogFormat
+		want   []string
+	}{{
+		name:   "rfc5424",
+		format: SyslogFormatRFC5424,
+		want: []string{
+			"<30>1 2022-01-02T03:04:05.123456Z ",
+			" AdGuardHome ",
+			` query [query@32473 client="1.2.3.4" client_id="cli|ent" qname="example.org"`,
+			`rule="||example.org^$ctag=\"x\""`,
+			`elapsed_ms="12"`,
+			"] 1.2.3.4 example.org A FilteredBlackList",
+		},
+	}, {
+		name:   "cef",
+		format: SyslogFormatCEF,
+		want: []string{
+			"<30>1 2022-01-02T03:04:05.123456Z ",
+			" query - CEF:0|AdGuard|AdGuard Home|",
+			"|FilteredBlackList|DNS query|5|rt=1641092645123 src=1.2.3.4",
+			`cs4Label=rule cs4=||example.org^$ctag\="x"`,
+			"cs5Label=clientId cs5=cli|ent cn1Label=elapsedMs cn1=12",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSyslogSink(&SyslogConfig{
+				Address: "127.0.0.1:514",
+				Format:  tc.format,
+				Enabled: true,
+			}, aghnet.NewIPMut(nil))
+
+			msg := string(s.message(newSyslogTestEntry()))
+			for _, w := range tc.want {
+				assert.Contains(t, msg, w)
+			}
+		})
+	}
+}
+
+func TestSyslogSink_send(t *testing.T) {
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		s := newSyslogSink(&SyslogConfig{
+			Address:  conn.LocalAddr().String(),
+			Protocol: SyslogProtoUDP,
+			Enabled:  true,
+		}, aghnet.NewIPMut(nil))
+		s.start()
+		t.Cleanup(s.close)
+
+		s.send(newSyslogTestEntry())
+
+		buf := make([]byte, 2048)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasPrefix(string(buf[:n]), "<30>1 "))
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+
+		s := newSyslogSink(&SyslogConfig{
+			Address:  l.Addr().String(),
+			Protocol: SyslogProtoTCP,
+			Enabled:  true,
+		}, aghnet.NewIPMut(nil))
+		s.start()
+		t.Cleanup(s.close)
+
+		s.send(newSyslogTestEntry())
+
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		r := bufio.NewReader(conn)
+		lenStr, err := r.ReadString(' ')
+		require.NoError(t, err)
+
+		msgLen, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+		require.NoError(t, err)
+
+		msg := make([]byte, msgLen)
+		_, err = io.ReadFull(r, msg)
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasPrefix(string(msg), "<30>1 "))
+	})
+
+	t.Run("full", func(t *testing.T) {
+		s := newSyslogSink(&SyslogConfig{
+			Address:   "127.0.0.1:514",
+			QueueSize: 1,
+			Enabled:   true,
+		}, aghnet.NewIPMut(nil))
+
+		// Don't start the sink, so that the queue is never drained.
+		s.send(newSyslogTestEntry())
+		s.send(newSyslogTestEntry())
+
+		assert.Equal(t, uint64(1), s.dropped)
+	})
+}
@@ -0,0 +1,51 @@
+package stats
+
+// CacheResult is the result of looking up the DNS cache for the request.
+//
+// TODO(a.garipov): Count the evictions as well once dnsproxy allows setting the
+// OnDelete callback of its cache, which is currently created internally.
+type CacheResult int
+
+// Supported CacheResult values.
+const (
+	// CacheNone means that the cache hasn't been used for the request, for
+	// example, because it's disabled or the request has been filtered.
+	CacheNone CacheResult = iota
+	// CacheMiss means that the response has been received from an upstream.
+	CacheMiss
+	// CacheHit means that a positive response has been served from the
+	// cache.
+	CacheHit
+	// CacheNegativeHit means that an NXDOMAIN or a NODATA response has been
+	// served from the cache.
+	CacheNegativeHit
+	// CacheStaleHit means that an expired response has been served from the
+	// optimistic cache.
+	CacheStaleHit
+
+	cacheResultLast = CacheStaleHit + 1
+)
+
+// cacheResultNames are the names of the cache results used in metrics.
+var cacheResultNames = [cacheResultLast]string{
+	CacheNone:        "none",
+	CacheMiss:        "miss",
+	CacheHit:         "hit",
+	CacheNegativeHit: "negative_hit",
+	CacheStaleHit:    "stale_hit",
+}
+
+// cacheNum returns the number of requests with the cache result cr in udb.  The
+// units written by the previous versions don't have the cache data.
+func (udb *unitDB) cacheNum(cr CacheResult) (n uint64) {
+	if int(cr) >= len(udb.NCache) {
+		return 0
+	}
+
+	return udb.NCache[cr]
+}
+
+// cacheNumsGetter returns a numsGetter for the cache result cr.
+func cacheNumsGetter(cr CacheResult) (ng numsGetter) {
+	return func(u *unitDB) (num uint64) { return u.cacheNum(cr) }
+}
@@ -0,0 +1,193 @@
+package stats
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
+
+// maxClientDomains is the max number of top domains stored for a single client
+// within a unit.
+const maxClientDomains = 20
+
+// clientPairs is the number of requests for each domain name made by a single
+// client for serializing statistics data into the database.
+type clientPairs struct {
+	Client  string
+	Domains []countPair
+}
+
+// addClientDomain adds the domain requested within e by the client with
+// clientID to the per-client tops of u.
+func (u *unit) addClientDomain(e Entry, clientID string) {
+	m := &u.clientDomains
+	if e.Result != RNotFiltered {
+		m = &u.clientBlocked
+	}
+
+	if *m == nil {
+		*m = map[string]map[string]uint64{}
+	}
+
+	domains, ok := (*m)[clientID]
+	if !ok {
+		domains = map[string]uint64{}
+		(*m)[clientID] = domains
+	}
+
+	domains[e.Domain]++
+}
+
+// convertClientMapToSlice converts the per-client tops from m into the slice
+// containing at most maxClients most active clients according to clients.
+func convertClientMapToSlice(
+	m map[string]map[string]uint64,
+	clients map[string]uint64,
+) (s []clientPairs) {
+	if len(m) == 0 {
+		return nil
+	}
+
+	for _, cp := range convertMapToSlice(clients, maxClients) {
+		domains, ok := m[cp.Name]
+		if !ok {
+			continue
+		}
+
+		s = append(s, clientPairs{
+			Client:  cp.Name,
+			Domains: convertMapToSlice(domains, maxClientDomains),
+		})
+	}
+
+	return s
+}
+
+// convertClientSliceToMap converts the per-client tops from s into the map.
+// m is nil if s is empty.
+func convertClientSliceToMap(s []clientPairs) (m map[string]map[string]uint64) {
+	if len(s) == 0 {
+		return nil
+	}
+
+	m = make(map[string]map[string]uint64, len(s))
+	for _, cp := range s {
+		m[cp.Client] = convertSliceToMap(cp.Domains)
+	}
+
+	return m
+}
+
+// clientDomainPairs returns the top domains of client from s or nil, if there
+// is no such client.
+func clientDomainPairs(s []clientPairs, client string) (pairs []countPair) {
+	for _, cp := range s {
+		if cp.Client == client {
+			return cp.Domains
+		}
+	}
+
+	return nil
+}
+
+// ClientTopResp is a response to the GET /control/stats/client/{ip}/top.
+type ClientTopResp struct {
+	// Client is the requested client.
+	Client string `json:"client"`
+
+	// TopQueried are the domain names most requested by the client, which
+	// haven't been blocked.
+	TopQueried []topAddrs `json:"top_queried_domains"`
+
+	// TopBlocked are the domain names most requested by the client, which have
+	// been blocked.
+	TopBlocked []topAddrs `json:"top_blocked_domains"`
+
+	// NumQueries is the total number of requests made by the client.
+	NumQueries uint64 `json:"num_dns_queries"`
+}
+
+// getClientData returns the top domains requested by client over the last
+// limit hours.  Note that the units only store the tops of the most active
+// clients, so the numbers for the less active ones may be incomplete.
+func (s *StatsCtx) getClientData(client string, limit uint32) (resp *ClientTopResp, ok bool) {
+	resp = &ClientTopResp{
+		Client:     client,
+		TopQueried: []topAddrs{},
+		TopBlocked: []topAddrs{},
+	}
+
+	if limit == 0 {
+		return resp, true
+	}
+
+	units, _ := s.loadUnits(limit)
+	if units == nil {
+		return nil, false
+	}
+
+	resp.TopQueried = topsCollector(units, maxDomains, func(u *unitDB) (pairs []countPair) {
+		return clientDomainPairs(u.ClientDomains, client)
+	})
+	resp.TopBlocked = topsCollector(units, maxDomains, func(u *unitDB) (pairs []countPair) {
+		return clientDomainPairs(u.ClientBlocked, client)
+	})
+
+	for _, u := range units {
+		resp.NumQueries += pairsCount(u.Clients, client)
+	}
+
+	topsToUnicode(resp.TopQueried)
+	topsToUnicode(resp.TopBlocked)
+
+	return resp, true
+}
+
+// clientTopPathPrefix is the prefix of the path of the per-client tops HTTP
+// API.
+const clientTopPathPrefix = "/control/stats/client/"
+
+// clientTopPathSuffix is the suffix of the path of the per-client tops HTTP
+// API.
+const clientTopPathSuffix = "/top"
+
+// handleStatsClientTop handles requests to the GET
+// /control/stats/client/{ip}/top endpoint.  The client is either an IP address
+// or a ClientID.
+func (s *StatsCtx) handleStatsClientTop(w http.ResponseWriter, r *http.Request) {
+	if !s.perClientTops {
+		aghhttp.Error(r, w, http.StatusNotFound, "per-client statistics are disabled")
+
+		return
+	}
+
+	client := strings.TrimPrefix(r.URL.Path, clientTopPathPrefix)
+	if !strings.HasSuffix(client, clientTopPathSuffix) {
+		aghhttp.Error(r, w, http.StatusNotFound, "unknown path %q", r.URL.Path)
+
+		return
+	}
+
+	client = strings.TrimSuffix(client, clientTopPathSuffix)
+	if client == "" || strings.Contains(client, "/") {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad client %q", client)
+
+		return
+	}
+
+	if ip := net.ParseIP(client); ip != nil {
+		client = ip.String()
+	}
+
+	resp, ok := s.getClientData(client, atomic.LoadUint32(&s.limitHours))
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
@@ -0,0 +1,87 @@
+package stats
+
+import (
+	"strings"
+)
+
+// DomainStatsResp is a response to the GET /control/stats/domain.
+type DomainStatsResp struct {
+	// Name is the requested domain name.
+	Name string `json:"name"`
+
+	// TimeUnits is either "hours" or "days" depending on the statistics
+	// interval.
+	TimeUnits string `json:"time_units"`
+
+	// Queries is the number of allowed requests for the domain per time unit.
+	Queries []uint64 `json:"queries"`
+
+	// Blocked is the number of blocked requests for the domain per time unit.
+	Blocked []uint64 `json:"blocked"`
+
+	// NumQueries is the total number of allowed requests for the domain.
+	NumQueries uint64 `json:"num_queries"`
+
+	// NumBlocked is the total number of blocked requests for the domain.
+	NumBlocked uint64 `json:"num_blocked"`
+}
+
+// pairsCount returns the count of the pair with name from pairs or 0, if there
+// is no such pair.
+func pairsCount(pairs []countPair, name string) (n uint64) {
+	for _, p := range pairs {
+		if p.Name == name {
+			return p.Count
+		}
+	}
+
+	return 0
+}
+
+// getDomainData returns the statistics of requests for a single domain over
+// time.  Note that the units only store the most requested domains, so the
+// numbers for the rarely requested ones may be incomplete.
+func (s *StatsCtx) getDomainData(domain string, limit uint32) (resp *DomainStatsResp, ok bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if limit == 0 {
+		return &DomainStatsResp{
+			Name:      domain,
+			TimeUnits: "days",
+			Queries:   []uint64{},
+			Blocked:   []uint64{},
+		}, true
+	}
+
+	timeUnit := Hours
+	if limit/24 > 7 {
+		timeUnit = Days
+	}
+
+	units, firstID := s.loadUnits(limit)
+	if units == nil {
+		return nil, false
+	}
+
+	resp = &DomainStatsResp{
+		Name:      domain,
+		TimeUnits: "hours",
+		Queries: statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) {
+			return pairsCount(u.Domains, domain)
+		}),
+		Blocked: statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) {
+			return pairsCount(u.BlockedDomains, domain)
+		}),
+	}
+
+	for _, u := range units {
+		resp.NumQueries += pairsCount(u.Domains, domain)
+		resp.NumBlocked += pairsCount(u.BlockedDomains, domain)
+	}
+
+	if timeUnit == Days {
+		resp.TimeUnits = "days"
+	}
+
+	return resp, true
+}
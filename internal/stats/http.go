@@ -3,8 +3,9 @@
 package stats
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -24,6 +25,12 @@ type StatsResp struct {
 	TopClients []topAddrs `json:"top_clients"`
 	TopBlocked []topAddrs `json:"top_blocked_domains"`
 
+	// TopBlockedServices are the known services, the domains of which have
+	// been blocked most often.
+	TopBlockedServices []topAddrs `json:"top_blocked_services"`
+
+	TopSlowest []SlowDomain `json:"top_slowest_domains"`
+
 	DNSQueries []uint64 `json:"dns_queries"`
 
 	BlockedFiltering     []uint64 `json:"blocked_filtering"`
@@ -36,12 +43,77 @@ type StatsResp struct {
 	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
 	NumReplacedParental     uint64 `json:"num_replaced_parental"`
 
+	CacheHits         []uint64 `json:"cache_hits"`
+	CacheMisses       []uint64 `json:"cache_misses"`
+	CacheNegativeHits []uint64 `json:"cache_negative_hits"`
+	CacheStaleHits    []uint64 `json:"cache_stale_hits"`
+
+	NumCacheHits         uint64 `json:"num_cache_hits"`
+	NumCacheMisses       uint64 `json:"num_cache_misses"`
+	NumCacheNegativeHits uint64 `json:"num_cache_negative_hits"`
+	NumCacheStaleHits    uint64 `json:"num_cache_stale_hits"`
+
+	// FallbackQueries is the number of requests resolved by the fallback
+	// upstreams per time unit.
+	FallbackQueries    []uint64 `json:"fallback_queries"`
+	NumFallbackQueries uint64   `json:"num_fallback_queries"`
+
+	// NoErrorResponses, NXDomainResponses, ServFailResponses, and
+	// RefusedResponses are the numbers of responses with the corresponding
+	// response codes per time unit.
+	NoErrorResponses  []uint64 `json:"noerror_responses"`
+	NXDomainResponses []uint64 `json:"nxdomain_responses"`
+	ServFailResponses []uint64 `json:"servfail_responses"`
+	RefusedResponses  []uint64 `json:"refused_responses"`
+
+	NumNoErrorResponses  uint64 `json:"num_noerror_responses"`
+	NumNXDomainResponses uint64 `json:"num_nxdomain_responses"`
+	NumServFailResponses uint64 `json:"num_servfail_responses"`
+	NumRefusedResponses  uint64 `json:"num_refused_responses"`
+
 	AvgProcessingTime float64 `json:"avg_processing_time"`
+
+	// AvgProcessingTimes and P95ProcessingTimes are the average and the 95th
+	// percentile of processing time in seconds per time unit.
+	AvgProcessingTimes []float64 `json:"avg_processing_times"`
+	P95ProcessingTimes []float64 `json:"p95_processing_times"`
+}
+
+// statsLimit returns the number of hours to show the statistics for in the
+// response to r.  It's the value of the interval query parameter in days, if
+// any, which must be a valid retention interval not exceeding the configured
+// one, or limitHours otherwise.
+func statsLimit(r *http.Request, limitHours uint32) (limit uint32, err error) {
+	ivlStr := r.URL.Query().Get("interval")
+	if ivlStr == "" {
+		return limitHours, nil
+	}
+
+	days, err := strconv.ParseUint(ivlStr, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parsing interval: %w", err)
+	}
+
+	limit = uint32(days) * 24
+	if days == 0 || !checkInterval(uint32(days)) {
+		return 0, fmt.Errorf("unsupported interval %d", days)
+	} else if limit > limitHours {
+		return 0, fmt.Errorf("interval %d exceeds retention of %d days", days, limitHours/24)
+	}
+
+	return limit, nil
 }
 
-// handleStats handles requests to the GET /control/stats endpoint.
+// handleStats handles requests to the GET /control/stats endpoint.  The
+// optional interval query parameter narrows the time range of the top charts
+// and the counters down to the given number of days.
 func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
-	limit := atomic.LoadUint32(&s.limitHours)
+	limit, err := statsLimit(r, atomic.LoadUint32(&s.limitHours))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
 
 	start := time.Now()
 	resp, ok := s.getData(limit)
@@ -58,11 +130,48 @@ func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
 }
 
+// handleStatsDomain handles requests to the GET /control/stats/domain
+// endpoint.
+func (s *StatsCtx) handleStatsDomain(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "name is required")
+
+		return
+	}
+
+	limit := atomic.LoadUint32(&s.limitHours)
+
+	resp, ok := s.getDomainData(name, limit)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
 // configResp is the response to the GET /control/stats_info.
 type configResp struct {
 	IntervalDays uint32 `json:"interval"`
 }
 
+// type check
+var _ aghhttp.Validator = (*configResp)(nil)
+
+// Validate implements the [aghhttp.Validator] interface for *configResp.
+func (c *configResp) Validate() (err error) {
+	if checkInterval(c.IntervalDays) {
+		return nil
+	}
+
+	return &aghhttp.FieldError{
+		Err:   fmt.Errorf("interval: unsupported value %d", c.IntervalDays),
+		Field: "interval",
+	}
+}
+
 // handleStatsInfo handles requests to the GET /control/stats_info endpoint.
 func (s *StatsCtx) handleStatsInfo(w http.ResponseWriter, r *http.Request) {
 	resp := configResp{IntervalDays: atomic.LoadUint32(&s.limitHours) / 24}
@@ -73,19 +182,13 @@ func (s *StatsCtx) handleStatsInfo(w http.ResponseWriter, r *http.Request) {
 // endpoint.
 func (s *StatsCtx) handleStatsConfig(w http.ResponseWriter, r *http.Request) {
 	reqData := configResp{}
-	err := json.NewDecoder(r.Body).Decode(&reqData)
+	err := aghhttp.DecodeJSON(r, &reqData)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
 
 		return
 	}
 
-	if !checkInterval(reqData.IntervalDays) {
-		aghhttp.Error(r, w, http.StatusBadRequest, "Unsupported interval")
-
-		return
-	}
-
 	s.setLimit(int(reqData.IntervalDays))
 	s.configModified()
 }
@@ -105,7 +208,14 @@ func (s *StatsCtx) initWeb() {
 	}
 
 	s.httpRegister(http.MethodGet, "/control/stats", s.handleStats)
+	s.httpRegister(http.MethodGet, "/control/stats/domain", s.handleStatsDomain)
+	s.httpRegister(http.MethodGet, clientTopPathPrefix, s.handleStatsClientTop)
+	s.httpRegister(http.MethodGet, "/control/stats/latency", s.handleStatsLatency)
+	s.httpRegister(http.MethodGet, "/control/stats/listeners", s.handleStatsListeners)
+	s.httpRegister(http.MethodGet, "/control/stats/insights", s.handleStatsInsights)
 	s.httpRegister(http.MethodPost, "/control/stats_reset", s.handleStatsReset)
 	s.httpRegister(http.MethodPost, "/control/stats_config", s.handleStatsConfig)
 	s.httpRegister(http.MethodGet, "/control/stats_info", s.handleStatsInfo)
+	s.httpRegister(http.MethodGet, "/control/stats_series", s.handleStatsSeries)
+	s.httpRegister(http.MethodGet, "/control/metrics", s.handleMetrics)
 }
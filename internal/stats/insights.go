@@ -0,0 +1,266 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/exp/slices"
+)
+
+// defaultInsightsWindow is the default duration of each of the compared
+// windows in hours.
+const defaultInsightsWindow = 24
+
+// maxInsights is the maximum number of the new top domains and of the clients
+// in the response.
+const maxInsights = 10
+
+// minClientChange is the minimum relative change of the number of requests from
+// a client, which is considered notable.
+const minClientChange = 0.5
+
+// WindowSummary is the summary of the requests within a single window.
+type WindowSummary struct {
+	// NumDNSQueries is the number of requests within the window.
+	NumDNSQueries uint64 `json:"num_dns_queries"`
+
+	// NumBlocked is the number of requests within the window, which have been
+	// blocked or replaced.
+	NumBlocked uint64 `json:"num_blocked"`
+
+	// BlockRate is the ratio of NumBlocked to NumDNSQueries.
+	BlockRate float64 `json:"block_rate"`
+}
+
+// ClientChange is a notable change of the number of requests from a client.
+type ClientChange struct {
+	// Client is the ClientID or the IP address of the client.
+	Client string `json:"client"`
+
+	// Previous is the number of requests within the previous window.
+	Previous uint64 `json:"previous"`
+
+	// Current is the number of requests within the current window.
+	Current uint64 `json:"current"`
+
+	// Change is the relative change of the number of requests.  It's zero if
+	// the client hasn't made any requests within the previous window.
+	Change float64 `json:"change"`
+}
+
+// InsightsResp is the response to the GET /control/stats/insights.
+type InsightsResp struct {
+	// Current is the summary of the current window.
+	Current *WindowSummary `json:"current"`
+
+	// Previous is the summary of the previous window.
+	Previous *WindowSummary `json:"previous"`
+
+	// NewTopDomains are the most requested domains within the current window,
+	// which haven't been among the requested ones within the previous window.
+	NewTopDomains []topAddrs `json:"new_top_domains"`
+
+	// ClientChanges are the clients with the largest notable changes of the
+	// number of requests.
+	ClientChanges []*ClientChange `json:"client_changes"`
+
+	// BlockRateShift is the difference between the block rates of the current
+	// and the previous windows.
+	BlockRateShift float64 `json:"block_rate_shift"`
+
+	// Window is the duration of each of the windows in hours.
+	Window uint32 `json:"window"`
+}
+
+// rollup is the sum of the statistics within a window.
+type rollup struct {
+	domains map[string]uint64
+	clients map[string]uint64
+	total   uint64
+	blocked uint64
+}
+
+// newRollup sums up the statistics of units.
+func newRollup(units []*unitDB) (r *rollup) {
+	r = &rollup{
+		domains: map[string]uint64{},
+		clients: map[string]uint64{},
+	}
+
+	for _, u := range units {
+		r.total += u.NTotal
+		r.blocked += u.NTotal - u.NResult[RNotFiltered]
+
+		for _, cp := range u.Domains {
+			r.domains[cp.Name] += cp.Count
+		}
+
+		for _, cp := range u.Clients {
+			r.clients[cp.Name] += cp.Count
+		}
+	}
+
+	return r
+}
+
+// summary returns the summary of r.
+func (r *rollup) summary() (ws *WindowSummary) {
+	ws = &WindowSummary{
+		NumDNSQueries: r.total,
+		NumBlocked:    r.blocked,
+	}
+
+	if r.total > 0 {
+		ws.BlockRate = float64(r.blocked) / float64(r.total)
+	}
+
+	return ws
+}
+
+// newTopDomains returns the most requested domains of curr, which aren't
+// present in prev.  Since only the top domains are stored for each unit, the
+// domains requested rarely within prev may be reported as well.
+func newTopDomains(prev, curr *rollup) (tops []topAddrs) {
+	m := map[string]uint64{}
+	for d, n := range curr.domains {
+		if prev.domains[d] == 0 {
+			m[d] = n
+		}
+	}
+
+	tops = convertTopSlice(convertMapToSlice(m, maxInsights))
+	topsToUnicode(tops)
+
+	return tops
+}
+
+// clientChanges returns the clients, the number of requests from which has
+// changed by at least minClientChange between prev and curr, the largest
+// absolute changes first.
+func clientChanges(prev, curr *rollup) (changes []*ClientChange) {
+	changes = []*ClientChange{}
+	add := func(c string) {
+		p, n := prev.clients[c], curr.clients[c]
+		cc := &ClientChange{
+			Client:   c,
+			Previous: p,
+			Current:  n,
+		}
+
+		if p != 0 {
+			cc.Change = (float64(n) - float64(p)) / float64(p)
+			if cc.Change < minClientChange && cc.Change > -minClientChange {
+				return
+			}
+		}
+
+		changes = append(changes, cc)
+	}
+
+	for c := range curr.clients {
+		add(c)
+	}
+
+	for c := range prev.clients {
+		if _, ok := curr.clients[c]; !ok {
+			add(c)
+		}
+	}
+
+	absDelta := func(cc *ClientChange) (d uint64) {
+		if cc.Current > cc.Previous {
+			return cc.Current - cc.Previous
+		}
+
+		return cc.Previous - cc.Current
+	}
+
+	slices.SortFunc(changes, func(a, b *ClientChange) (less bool) {
+		da, db := absDelta(a), absDelta(b)
+		if da != db {
+			return da > db
+		}
+
+		return a.Client < b.Client
+	})
+
+	if len(changes) > maxInsights {
+		changes = changes[:maxInsights]
+	}
+
+	return changes
+}
+
+// getInsights returns the notable differences between the latest window of
+// the given duration in hours and the one before it.
+func (s *StatsCtx) getInsights(window uint32) (resp *InsightsResp, ok bool) {
+	units, _ := s.loadUnits(2 * window)
+	if units == nil {
+		return nil, false
+	}
+
+	prev, curr := newRollup(units[:window]), newRollup(units[window:])
+	resp = &InsightsResp{
+		Current:       curr.summary(),
+		Previous:      prev.summary(),
+		NewTopDomains: newTopDomains(prev, curr),
+		ClientChanges: clientChanges(prev, curr),
+		Window:        window,
+	}
+
+	resp.BlockRateShift = resp.Current.BlockRate - resp.Previous.BlockRate
+
+	return resp, true
+}
+
+// insightsWindow returns the duration of each of the compared windows in hours
+// from the window query parameter of r.  Both windows must fit into the
+// retention interval of limitHours.
+func insightsWindow(r *http.Request, limitHours uint32) (window uint32, err error) {
+	window = defaultInsightsWindow
+	if winStr := r.URL.Query().Get("window"); winStr != "" {
+		var w uint64
+		w, err = strconv.ParseUint(winStr, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("parsing window: %w", err)
+		} else if w == 0 {
+			return 0, errors.Error("window must be positive")
+		}
+
+		window = uint32(w)
+	}
+
+	if uint64(window)*2 > uint64(limitHours) {
+		return 0, fmt.Errorf(
+			"two windows of %d hours exceed retention of %d hours",
+			window,
+			limitHours,
+		)
+	}
+
+	return window, nil
+}
+
+// handleStatsInsights handles requests to the GET /control/stats/insights
+// endpoint.
+func (s *StatsCtx) handleStatsInsights(w http.ResponseWriter, r *http.Request) {
+	window, err := insightsWindow(r, atomic.LoadUint32(&s.limitHours))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	resp, ok := s.getInsights(window)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
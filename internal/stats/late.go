@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"go.etcd.io/bbolt"
+)
+
+// maxLateEntries is the maximum number of the late entries kept until the
+// next flush.  The late entries beyond it are dropped.
+const maxLateEntries = 10_000
+
+// lateFlushNum is the number of the late entries, after which the flushing
+// goroutine merges them into the database without waiting for the next
+// snapshot or the next unit.
+const lateFlushNum = maxLateEntries / 10
+
+// lateEntry is an entry made within the period of a unit other than the current
+// one.  It's either the unit, which has already been flushed to the database,
+// or the one the flushing goroutine hasn't switched to yet.
+type lateEntry struct {
+	// clientID is the normalized client's primary ID.
+	clientID string
+
+	// e is the entry itself.
+	e Entry
+
+	// unitID is the identifier of the unit the entry belongs to.
+	unitID uint32
+}
+
+// unitIDAt returns the identifier of the unit containing t, in the same way
+// newUnitID does for the current time.
+func unitIDAt(t time.Time) (id uint32) {
+	const secsInHour = int64(time.Hour / time.Second)
+
+	return uint32(t.Unix() / secsInHour)
+}
+
+// isBeyondLimit returns true if the unit with id is older than the current one
+// by limit units or more.  s.currMu is expected to be locked.
+func (s *StatsCtx) isBeyondLimit(id, limit uint32) (ok bool) {
+	return id < s.curr.id && s.curr.id-id >= limit
+}
+
+// addLateLocked queues e made by the client with clientID within the unit with
+// id, which isn't the current one, until the flushing goroutine merges it.  The
+// entries beyond the statistics interval are dropped.  It doesn't access the
+// database, since it's called for each request.  s.currMu is expected to be
+// locked.
+func (s *StatsCtx) addLateLocked(id uint32, e Entry, clientID string) {
+	limit := atomic.LoadUint32(&s.limitHours)
+	if s.isBeyondLimit(id, limit) {
+		log.Debug("stats: dropping entry of unit %d beyond the interval", id)
+
+		return
+	} else if len(s.late) >= maxLateEntries {
+		log.Debug("stats: dropping entry of unit %d: too many late entries", id)
+
+		return
+	}
+
+	s.late = append(s.late, &lateEntry{
+		clientID: clientID,
+		e:        e,
+		unitID:   id,
+	})
+
+	if len(s.late) >= lateFlushNum {
+		// Wake the flushing goroutine up, unless it's already been.
+		select {
+		case s.lateReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flushLateLocked merges the late entries into their units in the database
+// and removes them.  The entries made within the current unit are added to it.
+// The entries made within the units newer than the current one are kept until
+// the flushing goroutine switches to them, unless all is true.  s.currMu is
+// expected to be locked.
+func (s *StatsCtx) flushLateLocked(tx *bbolt.Tx, all bool) (err error) {
+	limit := atomic.LoadUint32(&s.limitHours)
+	units := map[uint32]*unit{}
+	var kept []*lateEntry
+	for _, le := range s.late {
+		id := le.unitID
+		if id == s.curr.id {
+			s.addEntry(s.curr, le.e, le.clientID)
+
+			continue
+		} else if id > s.curr.id && !all {
+			kept = append(kept, le)
+
+			continue
+		} else if s.isBeyondLimit(id, limit) {
+			// The unit has already been removed from the database.
+			continue
+		}
+
+		u, ok := units[id]
+		if !ok {
+			u = newUnit(id)
+			u.deserialize(loadUnitFromDB(tx, id))
+			units[id] = u
+		}
+
+		s.addEntry(u, le.e, le.clientID)
+	}
+
+	s.late = kept
+
+	for id, u := range units {
+		err = u.serialize().flushUnitToDB(tx, id)
+		if err != nil {
+			return fmt.Errorf("flushing late entries of unit %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package stats
+
+import (
+	"sort"
+)
+
+// maxSlowDomains is the max number of the slowest domains to return.
+const maxSlowDomains = 100
+
+// usecsInSec is the number of microseconds in a second.
+const usecsInSec = 1_000_000
+
+// latencyBounds are the upper bounds of the processing time histogram buckets
+// in microseconds.  The last bucket of a histogram, which isn't described here,
+// contains all the greater values.
+var latencyBounds = []uint64{
+	1_000,
+	2_000,
+	5_000,
+	10_000,
+	20_000,
+	50_000,
+	100_000,
+	200_000,
+	500_000,
+	1_000_000,
+	2_000_000,
+	5_000_000,
+}
+
+// timeHist is a histogram of request processing times for a single domain.
+type timeHist struct {
+	// Name is the domain name.
+	Name string
+
+	// Counts are the numbers of requests within each of the latencyBounds
+	// buckets.  The last value is the number of requests which took longer
+	// than the greatest bound.
+	Counts []uint64
+
+	// Sum is the sum of the processing times of the requests in microseconds.
+	Sum uint64
+
+	// bounds are the upper bounds of the buckets in microseconds used instead
+	// of latencyBounds, if not nil.  The histograms stored in the database
+	// always use latencyBounds.
+	bounds []uint64
+}
+
+// newTimeHist returns a new properly initialized *timeHist.
+func newTimeHist(name string) (h *timeHist) {
+	return &timeHist{
+		Name:   name,
+		Counts: make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+// newBoundedTimeHist returns a new properly initialized *timeHist with the
+// buckets upper bounds.  bounds must be sorted and not empty.
+func newBoundedTimeHist(name string, bounds []uint64) (h *timeHist) {
+	return &timeHist{
+		Name:   name,
+		Counts: make([]uint64, len(bounds)+1),
+		bounds: bounds,
+	}
+}
+
+// bucketBounds returns the upper bounds of the buckets of h.
+func (h *timeHist) bucketBounds() (bounds []uint64) {
+	if h.bounds != nil {
+		return h.bounds
+	}
+
+	return latencyBounds
+}
+
+// add adds a request, which took dur microseconds to process, to h.
+func (h *timeHist) add(dur uint64) {
+	bounds := h.bucketBounds()
+	i := sort.Search(len(bounds), func(i int) bool {
+		return dur <= bounds[i]
+	})
+
+	h.Counts[i]++
+	h.Sum += dur
+}
+
+// merge adds the values of other to h.
+func (h *timeHist) merge(other *timeHist) {
+	for i := 0; i < len(h.Counts) && i < len(other.Counts); i++ {
+		h.Counts[i] += other.Counts[i]
+	}
+
+	h.Sum += other.Sum
+}
+
+// count returns the total number of requests in h.
+func (h *timeHist) count() (n uint64) {
+	for _, c := range h.Counts {
+		n += c
+	}
+
+	return n
+}
+
+// avg returns the average processing time in microseconds.
+func (h *timeHist) avg() (avg uint64) {
+	n := h.count()
+	if n == 0 {
+		return 0
+	}
+
+	return h.Sum / n
+}
+
+// percentile returns the upper bound of the bucket containing the p-th
+// percentile of the processing time in microseconds.  If it's within the last
+// bucket, the greatest bound is returned.  p must be within (0, 100].
+func (h *timeHist) percentile(p uint64) (dur uint64) {
+	n := h.count()
+	if n == 0 {
+		return 0
+	}
+
+	// Round up to get the rank of the request.
+	rank := (n*p + 99) / 100
+
+	bounds := h.bucketBounds()
+
+	var cum uint64
+	for i, c := range h.Counts {
+		cum += c
+		if cum >= rank && i < len(bounds) {
+			return bounds[i]
+		}
+	}
+
+	return bounds[len(bounds)-1]
+}
+
+// clone returns a deep copy of h.
+func (h *timeHist) clone() (c *timeHist) {
+	return &timeHist{
+		Name:   h.Name,
+		Counts: append([]uint64{}, h.Counts...),
+		Sum:    h.Sum,
+		bounds: h.bounds,
+	}
+}
+
+// convertHistsToSlice returns the copies of at most max histograms from m with
+// the greatest average processing time.
+func convertHistsToSlice(m map[string]*timeHist, max int) (s []*timeHist) {
+	s = make([]*timeHist, 0, len(m))
+	for _, h := range m {
+		s = append(s, h.clone())
+	}
+
+	sort.Slice(s, func(i, j int) bool {
+		ai, aj := s[i].avg(), s[j].avg()
+		if ai != aj {
+			return ai > aj
+		}
+
+		return s[i].Name < s[j].Name
+	})
+
+	if max > len(s) {
+		max = len(s)
+	}
+
+	return s[:max]
+}
+
+// SlowDomain is the processing time statistics of a single domain.
+type SlowDomain struct {
+	// Name is the domain name.
+	Name string `json:"name"`
+
+	// AvgTime is the average processing time in seconds.
+	AvgTime float64 `json:"avg_time"`
+
+	// P95Time is the 95th percentile of processing time in seconds.
+	P95Time float64 `json:"p95_time"`
+
+	// Count is the number of the processed requests.
+	Count uint64 `json:"count"`
+}
+
+// slowestCollector returns at most max domains with the greatest average
+// processing time within units.
+func slowestCollector(units []*unitDB, max int) (domains []SlowDomain) {
+	m := map[string]*timeHist{}
+	for _, u := range units {
+		for _, h := range u.DomainsTime {
+			sum, ok := m[h.Name]
+			if !ok {
+				sum = newTimeHist(h.Name)
+				m[h.Name] = sum
+			}
+
+			sum.merge(h)
+		}
+	}
+
+	domains = make([]SlowDomain, 0, max)
+	for _, h := range convertHistsToSlice(m, max) {
+		domains = append(domains, SlowDomain{
+			Name:    h.Name,
+			AvgTime: float64(h.avg()) / usecsInSec,
+			P95Time: float64(h.percentile(95)) / usecsInSec,
+			Count:   h.count(),
+		})
+	}
+
+	return domains
+}
+
+// processingTimeCollector returns the average and the 95th percentile of
+// processing time in seconds of all the requests per time unit within units.
+// The units are grouped in the same way as in [statsCollector].
+func processingTimeCollector(
+	units []*unitDB,
+	firstID uint32,
+	timeUnit TimeUnit,
+) (avgs, p95s []float64) {
+	histGetter := func(get func(h *timeHist) (n uint64)) (ng numsGetter) {
+		return func(u *unitDB) (n uint64) {
+			if u.TimeHist == nil {
+				return 0
+			}
+
+			return get(u.TimeHist)
+		}
+	}
+
+	sums := statsCollector(units, firstID, timeUnit, histGetter(func(h *timeHist) (n uint64) {
+		return h.Sum
+	}))
+
+	hists := make([]*timeHist, len(sums))
+	for i, sum := range sums {
+		hists[i] = newTimeHist("")
+		hists[i].Sum = sum
+	}
+
+	// Collect the last bucket as well, which isn't described by latencyBounds.
+	for b := 0; b <= len(latencyBounds); b++ {
+		counts := statsCollector(units, firstID, timeUnit, histGetter(func(h *timeHist) (n uint64) {
+			if b < len(h.Counts) {
+				return h.Counts[b]
+			}
+
+			return 0
+		}))
+		for i, c := range counts {
+			hists[i].Counts[b] = c
+		}
+	}
+
+	avgs = make([]float64, 0, len(hists))
+	p95s = make([]float64, 0, len(hists))
+	for _, h := range hists {
+		avgs = append(avgs, float64(h.avg())/usecsInSec)
+		p95s = append(p95s, float64(h.percentile(95))/usecsInSec)
+	}
+
+	return avgs, p95s
+}
@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// maxListeners is the maximum number of listeners, for which the statistics
+// are collected.  The requests received by the listeners beyond it are only
+// counted in the overall statistics.
+const maxListeners = 100
+
+// listenerStats are the statistics of the requests received by a single
+// listener since the start.
+type listenerStats struct {
+	// hist is the histogram of processing time of the requests received by
+	// the listener.
+	hist *timeHist
+
+	// blocked is the number of the requests received by the listener, which
+	// have been blocked or replaced.
+	blocked uint64
+}
+
+// addListenerLocked adds e to the statistics of the listener, which received
+// it, if any.  s.currMu is expected to be locked.
+func (s *StatsCtx) addListenerLocked(e Entry) {
+	if e.Listener == "" {
+		return
+	}
+
+	ls, ok := s.listeners[e.Listener]
+	if !ok {
+		if len(s.listeners) >= maxListeners {
+			log.Debug("stats: too many listeners, not adding %q", e.Listener)
+
+			return
+		}
+
+		ls = &listenerStats{
+			hist: newBoundedTimeHist("", s.latency.bounds),
+		}
+		s.listeners[e.Listener] = ls
+	}
+
+	ls.hist.add(uint64(e.Time))
+	if e.Result != RNotFiltered {
+		ls.blocked++
+	}
+}
+
+// ListenerStats is the statistics of the requests received by a single
+// listener.
+type ListenerStats struct {
+	// Latency is the processing time statistics of the requests received by
+	// the listener.
+	Latency *LatencyStats `json:"latency"`
+
+	// Listener is the protocol and the local address of the listener, for
+	// example "udp://192.168.1.1:53".
+	Listener string `json:"listener"`
+
+	// NumDNSQueries is the number of the requests received by the listener.
+	NumDNSQueries uint64 `json:"num_dns_queries"`
+
+	// NumBlocked is the number of the requests received by the listener,
+	// which have been blocked or replaced.
+	NumBlocked uint64 `json:"num_blocked"`
+}
+
+// ListenersResp is the response to the GET /control/stats/listeners.
+type ListenersResp struct {
+	// Listeners are the statistics of the requests received by each listener
+	// sorted by the address of the listener.
+	Listeners []*ListenerStats `json:"listeners"`
+}
+
+// listenersResp returns the per-listener statistics since the start.
+func (s *StatsCtx) listenersResp() (resp *ListenersResp) {
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	resp = &ListenersResp{
+		Listeners: make([]*ListenerStats, 0, len(s.listeners)),
+	}
+
+	addrs := maps.Keys(s.listeners)
+	slices.Sort(addrs)
+	for _, addr := range addrs {
+		ls := s.listeners[addr]
+		lat := newLatencyStats(ls.hist)
+		resp.Listeners = append(resp.Listeners, &ListenerStats{
+			Latency:       lat,
+			Listener:      addr,
+			NumDNSQueries: lat.Count,
+			NumBlocked:    ls.blocked,
+		})
+	}
+
+	return resp
+}
+
+// handleStatsListeners handles requests to the GET /control/stats/listeners
+// endpoint.
+func (s *StatsCtx) handleStatsListeners(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, s.listenersResp())
+}
@@ -0,0 +1,296 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// maxMetricsTops is the number of the top domains and clients written by the
+// metrics HTTP API.
+const maxMetricsTops = 10
+
+// resultNames are the names of the results of processing the requests used in
+// metrics.
+var resultNames = [resultLast]string{
+	RNotFiltered:  "not_filtered",
+	RFiltered:     "filtered",
+	RSafeBrowsing: "safe_browsing",
+	RSafeSearch:   "safe_search",
+	RParental:     "parental",
+}
+
+// Counter is a counter or a gauge of another module written by the GET
+// /control/metrics HTTP API.
+type Counter struct {
+	// Name is the name of the metric, for example
+	// "adguard_home_querylog_entries_dropped_total".
+	Name string
+
+	// Help is the description of the metric.
+	Help string
+
+	// Value is the current value of the metric.
+	Value uint64
+
+	// Gauge is true if the value of the metric may decrease, such as the
+	// number of the buffered entries.
+	Gauge bool
+}
+
+// writeCounter writes the counter with the name, the help text, and the value n
+// in the Prometheus text exposition format into b.
+func writeCounter(b *strings.Builder, name, help string, n uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	fmt.Fprintf(b, "%s %d\n", name, n)
+}
+
+// writeGauge writes the gauge with the name, the help text, and the value v in
+// the Prometheus text exposition format into b.
+func writeGauge(b *strings.Builder, name, help string, v float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(b, "%s %g\n", name, v)
+}
+
+// writeResultCounters writes the numbers of requests by the result of
+// processing in the Prometheus text exposition format into b.
+func (s *StatsCtx) writeResultCounters(b *strings.Builder) {
+	const name = "adguard_home_dns_requests_total"
+
+	fmt.Fprintf(b, "# HELP %s The number of DNS requests by the result of filtering.\n", name)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	for res := RNotFiltered; res < resultLast; res++ {
+		n := atomic.LoadUint64(&s.resultTotal[res])
+		fmt.Fprintf(b, "%s{result=%q} %d\n", name, resultNames[res], n)
+	}
+}
+
+// writeRespCodeCounters writes the numbers of responses by the response code
+// in the Prometheus text exposition format into b.
+func (s *StatsCtx) writeRespCodeCounters(b *strings.Builder) {
+	const name = "adguard_home_dns_responses_total"
+
+	fmt.Fprintf(b, "# HELP %s The number of DNS responses by the response code.\n", name)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	for rc := RespOther; rc < respCodeLast; rc++ {
+		n := atomic.LoadUint64(&s.respCodeTotal[rc])
+		fmt.Fprintf(b, "%s{rcode=%q} %d\n", name, respCodeNames[rc], n)
+	}
+}
+
+// writeCacheMetrics writes the numbers of requests by the result of the cache
+// lookup and the ratio of the cache hits in the Prometheus text exposition
+// format into b.
+func (s *StatsCtx) writeCacheMetrics(b *strings.Builder) {
+	const name = "adguard_home_dns_cache_requests_total"
+
+	fmt.Fprintf(b, "# HELP %s The number of DNS requests by the result of the cache lookup.\n", name)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+
+	var hits, total uint64
+	for cr := CacheMiss; cr < cacheResultLast; cr++ {
+		n := atomic.LoadUint64(&s.cacheTotal[cr])
+		fmt.Fprintf(b, "%s{result=%q} %d\n", name, cacheResultNames[cr], n)
+
+		total += n
+		if cr != CacheMiss {
+			hits += n
+		}
+	}
+
+	var ratio float64
+	if total > 0 {
+		ratio = float64(hits) / float64(total)
+	}
+
+	writeGauge(
+		b,
+		"adguard_home_dns_cache_hit_ratio",
+		"The ratio of the DNS requests served from the cache to the ones looked up in it.",
+		ratio,
+	)
+}
+
+// writeUpstreamMetrics writes the numbers of requests resolved by each
+// upstream and the histograms of their processing time in the Prometheus text
+// exposition format into b.
+func (s *StatsCtx) writeUpstreamMetrics(b *strings.Builder) {
+	const (
+		reqName  = "adguard_home_dns_upstream_requests_total"
+		timeName = "adguard_home_dns_upstream_processing_seconds"
+	)
+
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	hists := s.latency.upstreams
+	addrs := maps.Keys(hists)
+	slices.Sort(addrs)
+
+	fmt.Fprintf(b, "# HELP %s The number of DNS requests resolved by the upstream.\n", reqName)
+	fmt.Fprintf(b, "# TYPE %s counter\n", reqName)
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "%s{upstream=%q} %d\n", reqName, addr, hists[addr].count())
+	}
+
+	fmt.Fprintf(b, "# HELP %s The processing time of DNS requests resolved by the upstream.\n", timeName)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", timeName)
+	for _, addr := range addrs {
+		writeHistogram(b, timeName, "upstream", addr, hists[addr])
+	}
+}
+
+// writeListenerMetrics writes the numbers of all and of the blocked requests
+// received by each listener and the histograms of their processing time in
+// the Prometheus text exposition format into b.
+func (s *StatsCtx) writeListenerMetrics(b *strings.Builder) {
+	const (
+		reqName     = "adguard_home_dns_listener_requests_total"
+		blockedName = "adguard_home_dns_listener_blocked_requests_total"
+		timeName    = "adguard_home_dns_listener_processing_seconds"
+	)
+
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	addrs := maps.Keys(s.listeners)
+	slices.Sort(addrs)
+
+	fmt.Fprintf(b, "# HELP %s The number of DNS requests received by the listener.\n", reqName)
+	fmt.Fprintf(b, "# TYPE %s counter\n", reqName)
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "%s{listener=%q} %d\n", reqName, addr, s.listeners[addr].hist.count())
+	}
+
+	fmt.Fprintf(b, "# HELP %s The number of blocked DNS requests received by the listener.\n", blockedName)
+	fmt.Fprintf(b, "# TYPE %s counter\n", blockedName)
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "%s{listener=%q} %d\n", blockedName, addr, s.listeners[addr].blocked)
+	}
+
+	fmt.Fprintf(b, "# HELP %s The processing time of DNS requests received by the listener.\n", timeName)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", timeName)
+	for _, addr := range addrs {
+		writeHistogram(b, timeName, "listener", addr, s.listeners[addr].hist)
+	}
+}
+
+// writeHistogram writes the buckets, the sum, and the count of h labeled with
+// the label having the value in the Prometheus text exposition format into b.
+func writeHistogram(b *strings.Builder, name, label, value string, h *timeHist) {
+	bounds := h.bucketBounds()
+
+	var cum uint64
+	for i, c := range h.Counts {
+		cum += c
+
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(float64(bounds[i])/usecsInSec, 'g', -1, 64)
+		}
+
+		fmt.Fprintf(b, "%s_bucket{%s=%q,le=%q} %d\n", name, label, value, le, cum)
+	}
+
+	fmt.Fprintf(b, "%s_sum{%s=%q} %g\n", name, label, value, float64(h.Sum)/usecsInSec)
+	fmt.Fprintf(b, "%s_count{%s=%q} %d\n", name, label, value, cum)
+}
+
+// writeTopGauges writes the numbers of requests for the top domains and from
+// the top clients over the statistics interval in the Prometheus text
+// exposition format into b.  The top clients are omitted if they're hidden.
+func (s *StatsCtx) writeTopGauges(b *strings.Builder) {
+	limit := atomic.LoadUint32(&s.limitHours)
+	if limit == 0 {
+		return
+	}
+
+	units, _ := s.loadUnits(limit)
+	if units == nil {
+		return
+	}
+
+	tops := []struct {
+		pg    pairsGetter
+		name  string
+		help  string
+		label string
+	}{{
+		pg:    func(u *unitDB) (pairs []countPair) { return u.Domains },
+		name:  "adguard_home_top_queried_domain_requests",
+		help:  "The number of DNS requests for the most requested domains, which haven't been blocked.",
+		label: "domain",
+	}, {
+		pg:    func(u *unitDB) (pairs []countPair) { return u.BlockedDomains },
+		name:  "adguard_home_top_blocked_domain_requests",
+		help:  "The number of DNS requests for the most blocked domains.",
+		label: "domain",
+	}, {
+		pg:    func(u *unitDB) (pairs []countPair) { return u.Clients },
+		name:  "adguard_home_top_client_requests",
+		help:  "The number of DNS requests made by the most active clients.",
+		label: "client",
+	}}
+
+	if s.clientsHidden != nil && s.clientsHidden() {
+		tops = tops[:len(tops)-1]
+	}
+
+	for _, top := range tops {
+		fmt.Fprintf(b, "# HELP %s %s\n", top.name, top.help)
+		fmt.Fprintf(b, "# TYPE %s gauge\n", top.name)
+		for _, m := range topsCollector(units, maxMetricsTops, top.pg) {
+			for k, n := range m {
+				fmt.Fprintf(b, "%s{%s=%q} %d\n", top.name, top.label, k, n)
+			}
+		}
+	}
+}
+
+// handleMetrics handles requests to the GET /control/metrics endpoint.  It
+// writes the request, the response code, the cache, the fallback upstreams,
+// the per-upstream, the per-listener, and the extra counters as well as the top
+// domains and clients in the Prometheus text exposition format.  The counters
+// are reset on restart.
+func (s *StatsCtx) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	b := &strings.Builder{}
+
+	s.writeResultCounters(b)
+	s.writeRespCodeCounters(b)
+	s.writeCacheMetrics(b)
+	writeCounter(
+		b,
+		"adguard_home_dns_fallback_requests_total",
+		"The number of DNS requests resolved by the fallback upstreams.",
+		atomic.LoadUint64(&s.fallbackTotal),
+	)
+	writeCounter(
+		b,
+		"adguard_home_dns_fallback_switches_total",
+		"The number of transitions between the primary and the fallback upstreams.",
+		atomic.LoadUint64(&s.fallbackSwitchesTotal),
+	)
+	s.writeUpstreamMetrics(b)
+	s.writeListenerMetrics(b)
+	s.writeTopGauges(b)
+
+	if s.extraCounters != nil {
+		for _, c := range s.extraCounters() {
+			if c.Gauge {
+				writeGauge(b, c.Name, c.Help, float64(c.Value))
+			} else {
+				writeCounter(b, c.Name, c.Help, c.Value)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
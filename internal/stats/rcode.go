@@ -0,0 +1,48 @@
+package stats
+
+// ResponseCode is the class of the response code of the response to the
+// request.
+type ResponseCode int
+
+// Supported ResponseCode values.
+const (
+	// RespOther means that the response has any other response code or there
+	// is no response at all, for example, because the request has been
+	// dropped.
+	RespOther ResponseCode = iota
+	// RespNoError means that the response has the NOERROR response code.
+	RespNoError
+	// RespNXDomain means that the response has the NXDOMAIN response code.
+	RespNXDomain
+	// RespServFail means that the response has the SERVFAIL response code.
+	RespServFail
+	// RespRefused means that the response has the REFUSED response code.
+	RespRefused
+
+	respCodeLast = RespRefused + 1
+)
+
+// respCodeNames are the names of the response codes used in metrics.
+var respCodeNames = [respCodeLast]string{
+	RespOther:    "other",
+	RespNoError:  "noerror",
+	RespNXDomain: "nxdomain",
+	RespServFail: "servfail",
+	RespRefused:  "refused",
+}
+
+// respCodeNum returns the number of responses with the response code rc in
+// udb.  The units written by the previous versions don't have the response
+// code data.
+func (udb *unitDB) respCodeNum(rc ResponseCode) (n uint64) {
+	if int(rc) >= len(udb.NRespCode) {
+		return 0
+	}
+
+	return udb.NRespCode[rc]
+}
+
+// respCodeNumsGetter returns a numsGetter for the response code rc.
+func respCodeNumsGetter(rc ResponseCode) (ng numsGetter) {
+	return func(u *unitDB) (num uint64) { return u.respCodeNum(rc) }
+}
@@ -0,0 +1,236 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// slotDuration is the duration of a slot, the finest granularity of the time
+// series stored within each unit.
+const slotDuration = 5 * time.Minute
+
+// slotsPerUnit is the number of slots within each hourly unit.
+const slotsPerUnit = int(time.Hour / slotDuration)
+
+// maxSeriesPoints is the maximum number of points in a single response of the
+// time series HTTP API.
+const maxSeriesPoints = 10_000
+
+// seriesIntervals are the supported granularities of the time series by their
+// names.
+var seriesIntervals = map[string]time.Duration{
+	"5m": slotDuration,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// slotIndex returns the index of the slot containing t within its unit.
+func slotIndex(t time.Time) (i int) {
+	const secsInHour = int64(time.Hour / time.Second)
+
+	return int(t.Unix()%secsInHour) / int(slotDuration/time.Second)
+}
+
+// unitStart returns the time the unit with id starts at, in the same way
+// unitIDAt calculates the identifier.
+func unitStart(id uint32) (t time.Time) {
+	return time.Unix(int64(id)*int64(time.Hour/time.Second), 0)
+}
+
+// addSlot adds the request with res made at to the slots of u.  If at is zero,
+// the request is considered to be made now.
+func (u *unit) addSlot(at time.Time, res Result) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	i := slotIndex(at)
+	u.nSlotTotal[i]++
+	if res != RNotFiltered {
+		u.nSlotBlocked[i]++
+	}
+}
+
+// SeriesPoint is the numbers of requests within a single interval of the time
+// series.
+type SeriesPoint struct {
+	// Time is the start of the interval.
+	Time time.Time `json:"time"`
+
+	// NumDNSQueries is the number of requests within the interval.
+	NumDNSQueries uint64 `json:"num_dns_queries"`
+
+	// NumBlocked is the number of requests within the interval, which have
+	// been blocked or replaced.
+	NumBlocked uint64 `json:"num_blocked"`
+}
+
+// SeriesResp is the response to the GET /control/stats_series.
+type SeriesResp struct {
+	// Start is the start of the first interval.
+	Start time.Time `json:"start"`
+
+	// End is the end of the last interval.
+	End time.Time `json:"end"`
+
+	// Interval is the granularity of the series, for example "1h".
+	Interval string `json:"interval"`
+
+	// Points are the numbers of requests within each interval starting from
+	// Start.
+	Points []*SeriesPoint `json:"points"`
+}
+
+// seriesParams are the parameters of the time series request.
+type seriesParams struct {
+	// start and end are the bounds of the requested period aligned to ivl.
+	start time.Time
+	end   time.Time
+
+	// ivlName is the name of the granularity of the series.
+	ivlName string
+
+	// ivl is the granularity of the series.
+	ivl time.Duration
+}
+
+// parseSeriesParams parses the parameters of the time series request r.  The
+// default period ends at now and lasts for limitHours or for a day, if the
+// statistics are disabled.  The bounds of the period are aligned to the
+// interval in UTC.
+func parseSeriesParams(
+	r *http.Request,
+	now time.Time,
+	limitHours uint32,
+) (p *seriesParams, err error) {
+	q := r.URL.Query()
+
+	p = &seriesParams{
+		ivlName: q.Get("interval"),
+	}
+
+	if p.ivlName == "" {
+		p.ivlName = "1h"
+	}
+
+	var ok bool
+	if p.ivl, ok = seriesIntervals[p.ivlName]; !ok {
+		return nil, fmt.Errorf("unsupported interval %q", p.ivlName)
+	}
+
+	end := now
+	if endStr := q.Get("end"); endStr != "" {
+		end, err = time.Parse(time.RFC3339, endStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing end: %w", err)
+		}
+	}
+
+	if limitHours == 0 {
+		limitHours = 24
+	}
+
+	start := end.Add(-time.Duration(limitHours) * time.Hour)
+	if startStr := q.Get("start"); startStr != "" {
+		start, err = time.Parse(time.RFC3339, startStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing start: %w", err)
+		}
+	}
+
+	if !start.Before(end) {
+		return nil, errors.Error("start must be before end")
+	}
+
+	p.start = start.Truncate(p.ivl).UTC()
+	p.end = end.Truncate(p.ivl).UTC()
+	if p.end.Before(end) {
+		p.end = p.end.Add(p.ivl)
+	}
+
+	if n := p.end.Sub(p.start) / p.ivl; n > maxSeriesPoints {
+		return nil, fmt.Errorf("too many points: %d, max %d", n, maxSeriesPoints)
+	}
+
+	return p, nil
+}
+
+// getSeries returns the time series of the numbers of requests within the
+// period and with the granularity from p.  The units stored by the previous
+// versions don't have the slots, so their requests are counted at the start of
+// the unit.
+func (s *StatsCtx) getSeries(p *seriesParams) (resp *SeriesResp, ok bool) {
+	n := int(p.end.Sub(p.start) / p.ivl)
+	resp = &SeriesResp{
+		Start:    p.start,
+		End:      p.end,
+		Interval: p.ivlName,
+		Points:   make([]*SeriesPoint, 0, n),
+	}
+
+	for i := 0; i < n; i++ {
+		resp.Points = append(resp.Points, &SeriesPoint{
+			Time: p.start.Add(time.Duration(i) * p.ivl),
+		})
+	}
+
+	limit := atomic.LoadUint32(&s.limitHours)
+	if limit == 0 {
+		return resp, true
+	}
+
+	units, firstID := s.loadUnits(limit)
+	if units == nil {
+		return nil, false
+	}
+
+	add := func(t time.Time, total, blocked uint64) {
+		if t.Before(p.start) || !t.Before(p.end) {
+			return
+		}
+
+		pt := resp.Points[t.Sub(p.start)/p.ivl]
+		pt.NumDNSQueries += total
+		pt.NumBlocked += blocked
+	}
+
+	for i, u := range units {
+		start := unitStart(firstID + uint32(i))
+		if len(u.NSlotTotal) != slotsPerUnit || len(u.NSlotBlocked) != slotsPerUnit {
+			add(start, u.NTotal, u.NTotal-u.NResult[RNotFiltered])
+
+			continue
+		}
+
+		for j := 0; j < slotsPerUnit; j++ {
+			add(start.Add(time.Duration(j)*slotDuration), u.NSlotTotal[j], u.NSlotBlocked[j])
+		}
+	}
+
+	return resp, true
+}
+
+// handleStatsSeries handles requests to the GET /control/stats_series
+// endpoint.
+func (s *StatsCtx) handleStatsSeries(w http.ResponseWriter, r *http.Request) {
+	p, err := parseSeriesParams(r, time.Now(), atomic.LoadUint32(&s.limitHours))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	resp, ok := s.getSeries(p)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
@@ -1,5 +1,10 @@
 // Package stats provides units for managing statistics of the filtering DNS
 // server.
+//
+// The statistics don't depend on the rest of AdGuard Home and are only
+// configured with [Config], so they can be embedded into other programs.  All
+// the callbacks of [Config] are optional, and the HTTP API is only registered
+// if [Config.HTTPRegister] is set.
 package stats
 
 import (
@@ -36,20 +41,38 @@ type Config struct {
 	// nil, the default function is used, see newUnitID.
 	UnitID UnitIDGenFunc
 
-	// ConfigModified will be called each time the configuration changed via web
-	// interface.
+	// ConfigModified, if not nil, will be called each time the configuration
+	// changed via web interface.
 	ConfigModified func()
 
-	// HTTPRegister is the function that registers handlers for the stats
-	// endpoints.
+	// HTTPRegister, if not nil, is the function that registers handlers for
+	// the stats endpoints.
 	HTTPRegister aghhttp.RegisterFunc
 
+	// ExtraCounters, if not nil, returns the counters of the other modules
+	// written by the GET /control/metrics HTTP API along with the statistics
+	// ones.
+	ExtraCounters func() (cs []*Counter)
+
+	// ClientsHidden, if not nil, returns true if the clients mustn't be
+	// exposed by the metrics, since the query log anonymizes or hashes them.
+	ClientsHidden func() (ok bool)
+
 	// Filename is the name of the database file.
 	Filename string
 
 	// LimitDays is the maximum number of days to collect statistics into the
 	// current unit.
 	LimitDays uint32
+
+	// LatencyBuckets are the ascending upper bounds of the processing time
+	// histogram buckets used for the per-upstream latency statistics.  If
+	// empty or invalid, the default ones are used.
+	LatencyBuckets []time.Duration
+
+	// PerClientTops defines if the top domains of each client are collected
+	// along with the global ones.
+	PerClientTops bool
 }
 
 // Interface is the statistics interface to be used by other packages.
@@ -62,12 +85,31 @@ type Interface interface {
 	// Update collects the incoming statistics data.
 	Update(e Entry)
 
+	// Import collects the statistics data of the requests made in the past,
+	// for example, the ones imported from another software.  Unlike Update, it
+	// doesn't change the numbers collected since the start.  It may block
+	// until the previously collected data is flushed.
+	Import(entries []Entry)
+
 	// GetTopClientIP returns at most limit IP addresses corresponding to the
 	// clients with the most number of requests.
 	TopClientsIP(limit uint) []net.IP
 
+	// TopDomains returns at most limit domain names with the most number of
+	// requests which haven't been blocked.
+	TopDomains(limit uint) (domains []string)
+
+	// Summary returns the statistics summed up over the last hours with at
+	// most topLimit top domain names.  ok is false if the statistics couldn't
+	// be loaded.
+	Summary(hours uint32, topLimit int) (sum *Summary, ok bool)
+
 	// WriteDiskConfig puts the Interface's configuration to the dc.
 	WriteDiskConfig(dc *DiskConfig)
+
+	// Latency returns the processing time statistics of all the requests and
+	// of the requests resolved by each upstream since the start.
+	Latency() (resp *LatencyResp)
 }
 
 // StatsCtx collects the statistics and flushes it to the database.  Its default
@@ -99,12 +141,67 @@ type StatsCtx struct {
 	// httpRegister is used to set HTTP handlers.
 	httpRegister aghhttp.RegisterFunc
 
+	// extraCounters returns the counters of the other modules, if not nil.
+	extraCounters func() (cs []*Counter)
+
+	// clientsHidden returns true if the clients mustn't be exposed by the
+	// metrics, if not nil.
+	clientsHidden func() (ok bool)
+
 	// configModified is called whenever the configuration is modified via web
 	// interface.
 	configModified func()
 
 	// filename is the name of database file.
 	filename string
+
+	// perClientTops defines if the top domains of each client are collected.
+	perClientTops bool
+
+	// done is closed when the statistics are closed to stop the flushing
+	// goroutine.
+	done chan struct{}
+
+	// cacheTotal are the numbers of requests by the result of the cache lookup
+	// since the start.  They must be accessed atomically.
+	cacheTotal [cacheResultLast]uint64
+
+	// respCodeTotal are the numbers of responses by the response code since
+	// the start.  They must be accessed atomically.
+	respCodeTotal [respCodeLast]uint64
+
+	// fallbackTotal is the number of requests resolved by the fallback
+	// upstreams and fallbackSwitchesTotal is the number of transitions between
+	// the primary and the fallback upstreams since the start.  They must be
+	// accessed atomically.
+	fallbackTotal         uint64
+	fallbackSwitchesTotal uint64
+
+	// latency are the histograms of processing time of all the requests and of
+	// the requests resolved by each upstream since the start.  It's protected
+	// by currMu.
+	latency *latencyHists
+
+	// listeners are the statistics of the requests received by each listener
+	// since the start.  It's protected by currMu.
+	listeners map[string]*listenerStats
+
+	// resultTotal are the numbers of requests by the result of processing
+	// since the start.  They must be accessed atomically.
+	resultTotal [resultLast]uint64
+
+	// late are the entries made within the periods of the units other than the
+	// current one, waiting for the flushing goroutine to merge them.  It's
+	// protected by currMu.
+	late []*lateEntry
+
+	// lateReady wakes the flushing goroutine up when there are enough late
+	// entries to merge them without waiting.
+	lateReady chan struct{}
+
+	// lastSnapshot is the time the current unit has last been written to the
+	// database.  It's protected by currMu.
+	lastSnapshot time.Time
 }
 
 var _ Interface = &StatsCtx{}
@@ -118,8 +215,16 @@ func New(conf Config) (s *StatsCtx, err error) {
 		currMu:         &sync.RWMutex{},
 		dbMu:           &sync.Mutex{},
 		filename:       conf.Filename,
+		done:           make(chan struct{}),
+		lateReady:      make(chan struct{}, 1),
 		configModified: conf.ConfigModified,
 		httpRegister:   conf.HTTPRegister,
+		extraCounters:  conf.ExtraCounters,
+		clientsHidden:  conf.ClientsHidden,
+		latency:        newLatencyHists(conf.LatencyBuckets),
+		listeners:      map[string]*listenerStats{},
+		perClientTops:  conf.PerClientTops,
+		lastSnapshot:   time.Now(),
 	}
 	if s.limitHours = conf.LimitDays * 24; !checkInterval(conf.LimitDays) {
 		s.limitHours = 24
@@ -127,6 +232,9 @@ func New(conf Config) (s *StatsCtx, err error) {
 	if s.unitIDGen = newUnitID; conf.UnitID != nil {
 		s.unitIDGen = conf.UnitID
 	}
+	if s.configModified == nil {
+		s.configModified = func() {}
+	}
 
 	// TODO(e.burkov):  Move the code below to the Start method.
 
@@ -193,6 +301,9 @@ func (s *StatsCtx) Close() (err error) {
 	if db == nil {
 		return nil
 	}
+
+	close(s.done)
+
 	defer func() {
 		cerr := db.Close()
 		if cerr == nil {
@@ -208,8 +319,13 @@ func (s *StatsCtx) Close() (err error) {
 	}
 	defer func() { err = errors.WithDeferred(err, finishTxn(tx, err == nil)) }()
 
-	s.currMu.RLock()
-	defer s.currMu.RUnlock()
+	s.currMu.Lock()
+	defer s.currMu.Unlock()
+
+	err = s.flushLateLocked(tx, true)
+	if err != nil {
+		return err
+	}
 
 	udb := s.curr.serialize()
 
@@ -222,7 +338,8 @@ func (s *StatsCtx) Update(e Entry) {
 		return
 	}
 
-	if e.Result == 0 || e.Result >= resultLast || e.Domain == "" || e.Client == "" {
+	clientID, ok := normalizeEntry(&e)
+	if !ok {
 		log.Debug("stats: malformed entry")
 
 		return
@@ -237,12 +354,129 @@ func (s *StatsCtx) Update(e Entry) {
 		return
 	}
 
-	clientID := e.Client
+	atomic.AddUint64(&s.cacheTotal[e.Cache], 1)
+	atomic.AddUint64(&s.respCodeTotal[e.RespCode], 1)
+	atomic.AddUint64(&s.resultTotal[e.Result], 1)
+	if e.FallbackSwitched {
+		atomic.AddUint64(&s.fallbackSwitchesTotal, 1)
+	}
+
+	s.latency.add(e.Upstream, uint64(e.Time))
+	s.addListenerLocked(e)
+	if e.Fallback {
+		atomic.AddUint64(&s.fallbackTotal, 1)
+	}
+
+	s.addUnitEntryLocked(e, clientID)
+}
+
+// normalizeEntry replaces the unknown cache result and response code of e with
+// the default ones and returns the normalized client's primary ID.  ok is false
+// if e is malformed.
+func normalizeEntry(e *Entry) (clientID string, ok bool) {
+	if e.Result == 0 || e.Result >= resultLast || e.Domain == "" || e.Client == "" {
+		return "", false
+	}
+
+	clientID = e.Client
 	if ip := net.ParseIP(clientID); ip != nil {
 		clientID = ip.String()
 	}
 
-	s.curr.add(e.Result, e.Domain, clientID, uint64(e.Time))
+	if e.Cache < 0 || e.Cache >= cacheResultLast {
+		e.Cache = CacheNone
+	}
+
+	if e.RespCode < 0 || e.RespCode >= respCodeLast {
+		e.RespCode = RespOther
+	}
+
+	return clientID, true
+}
+
+// addUnitEntryLocked adds e made by the client with clientID to the unit it
+// belongs to.  s.currMu is expected to be locked.
+func (s *StatsCtx) addUnitEntryLocked(e Entry, clientID string) {
+	if e.At.IsZero() {
+		s.addEntry(s.curr, e, clientID)
+
+		return
+	}
+
+	// Leave the entries made within the flushed units and within the units the
+	// periodic flushing hasn't switched to yet to the flushing goroutine.  The
+	// entries made within the units beyond the current time are likely caused
+	// by the clock adjustments, so keep them in the current unit.
+	id := unitIDAt(e.At)
+	if id != s.curr.id && id <= s.unitIDGen() {
+		s.addLateLocked(id, e, clientID)
+
+		return
+	}
+
+	s.addEntry(s.curr, e, clientID)
+}
+
+// importWaitIvl is the interval between the attempts to queue the imported
+// entries, while the late entries queue is full.
+const importWaitIvl = 100 * time.Millisecond
+
+// Import implements the Interface interface for *StatsCtx.  It queues the
+// entries as the late ones, waiting for the flushing goroutine to merge the
+// previous ones when the queue is full, so that none of them is dropped.
+func (s *StatsCtx) Import(entries []Entry) {
+	for {
+		entries = entries[s.queueImported(entries):]
+		if len(entries) == 0 {
+			return
+		}
+
+		t := time.NewTimer(importWaitIvl)
+		select {
+		case <-t.C:
+			// Go on.
+		case <-s.done:
+			t.Stop()
+			log.Info("stats: warning: dropping %d imported entries: closed", len(entries))
+
+			return
+		}
+	}
+}
+
+// queueImported queues the entries as long as there is room for them in the
+// late entries queue.  n is the number of the processed entries, including the
+// malformed ones.
+func (s *StatsCtx) queueImported(entries []Entry) (n int) {
+	if atomic.LoadUint32(&s.limitHours) == 0 {
+		return len(entries)
+	}
+
+	s.currMu.Lock()
+	defer s.currMu.Unlock()
+
+	if s.curr == nil {
+		return len(entries)
+	}
+
+	for ; n < len(entries) && len(s.late) < maxLateEntries; n++ {
+		e := entries[n]
+		clientID, ok := normalizeEntry(&e)
+		if ok {
+			s.addUnitEntryLocked(e, clientID)
+		}
+	}
+
+	return n
+}
+
+// addEntry adds the data of e made by the client with clientID to u, including
+// the per-client tops, if enabled.
+func (s *StatsCtx) addEntry(u *unit, e Entry, clientID string) {
+	u.addEntry(e, clientID)
+	if s.perClientTops {
+		u.addClientDomain(e, clientID)
+	}
 }
 
 // WriteDiskConfig implements the Interface interface for *StatsCtx.
@@ -282,6 +516,34 @@ func (s *StatsCtx) TopClientsIP(maxCount uint) (ips []net.IP) {
 	return ips
 }
 
+// TopDomains implements the Interface interface for *StatsCtx.
+func (s *StatsCtx) TopDomains(limit uint) (domains []string) {
+	limitHours := atomic.LoadUint32(&s.limitHours)
+	if limitHours == 0 {
+		return nil
+	}
+
+	units, _ := s.loadUnits(limitHours)
+	if units == nil {
+		return nil
+	}
+
+	m := map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.Domains {
+			m[it.Name] += it.Count
+		}
+	}
+
+	a := convertMapToSlice(m, int(limit))
+	domains = make([]string, 0, len(a))
+	for _, it := range a {
+		domains = append(domains, it.Name)
+	}
+
+	return domains
+}
+
 // database returns the database if it's opened.  It's safe for concurrent use.
 func (s *StatsCtx) database() (db *bbolt.DB) {
 	s.dbMu.Lock()
@@ -370,13 +632,67 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 	s.currMu.Lock()
 	defer s.currMu.Unlock()
 
+	cont, sleepFor = s.flushLocked(id)
+	if cont {
+		s.snapshotLocked(time.Now())
+	}
+
+	return cont, sleepFor
+}
+
+// snapshotIvl is the interval, after which the current unit is written to the
+// database even though its period hasn't ended yet, so that an unclean
+// shutdown loses the data of that interval at most.  The unit is loaded back on
+// start.
+const snapshotIvl = 5 * time.Minute
+
+// snapshotLocked writes the current unit to the database if the last snapshot
+// has been made more than snapshotIvl before now.  s.currMu is expected to be
+// locked.
+func (s *StatsCtx) snapshotLocked(now time.Time) {
+	if s.curr == nil || now.Sub(s.lastSnapshot) < snapshotIvl {
+		return
+	}
+
+	db := s.database()
+	if db == nil || atomic.LoadUint32(&s.limitHours) == 0 {
+		return
+	}
+
+	s.lastSnapshot = now
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		log.Error("stats: opening transaction: %s", err)
+
+		return
+	}
+
+	err = s.curr.serialize().flushUnitToDB(tx, s.curr.id)
+	if err != nil {
+		log.Error("stats: writing snapshot: %s", err)
+	} else if err = s.flushLateLocked(tx, false); err != nil {
+		log.Error("stats: %s", err)
+	}
+
+	err = finishTxn(tx, err == nil)
+	if err != nil {
+		log.Error("stats: %s", err)
+	}
+}
+
+// flushLocked is the implementation of flush for the unit with id being the
+// current one.  It also merges the late entries into their units, when
+// switching the unit or when there are at least lateFlushNum of them, so that
+// the database isn't written each second.  s.currMu is expected to be locked.
+func (s *StatsCtx) flushLocked(id uint32) (cont bool, sleepFor time.Duration) {
 	ptr := s.curr
 	if ptr == nil {
 		return false, 0
 	}
 
 	limit := atomic.LoadUint32(&s.limitHours)
-	if limit == 0 || ptr.id == id {
+	if limit == 0 || (ptr.id == id && len(s.late) < lateFlushNum) {
 		return true, time.Second
 	}
 
@@ -398,14 +714,26 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 		}
 	}()
 
-	s.curr = newUnit(id)
+	if ptr.id != id {
+		s.curr = newUnit(id)
+
+		flushErr := ptr.serialize().flushUnitToDB(tx, ptr.id)
+		if flushErr != nil {
+			log.Error("stats: flushing unit: %s", flushErr)
+			isCommitable = false
+		}
+	}
 
-	flushErr := ptr.serialize().flushUnitToDB(tx, ptr.id)
-	if flushErr != nil {
-		log.Error("stats: flushing unit: %s", flushErr)
+	lateErr := s.flushLateLocked(tx, false)
+	if lateErr != nil {
+		log.Error("stats: %s", lateErr)
 		isCommitable = false
 	}
 
+	if ptr.id == id {
+		return true, 0
+	}
+
 	delErr := tx.DeleteBucket(idToUnitName(id - limit))
 	if delErr != nil {
 		// TODO(e.burkov):  Improve the algorithm of deleting the oldest bucket
@@ -425,13 +753,35 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 // generated unit ID differs from the current's ID.  Flushing process includes:
 //   - swapping the current unit with the new empty one;
 //   - writing the current unit to the database;
-//   - removing the stale unit from the database.
+//   - removing the stale unit from the database;
+//   - merging the late entries into their units in the database.
+//
+// It returns when the statistics are closed.
 func (s *StatsCtx) periodicFlush() {
-	for cont, sleepFor := true, time.Duration(0); cont; time.Sleep(sleepFor) {
-		cont, sleepFor = s.flush()
+	defer log.Debug("stats: periodic flushing finished")
+
+	for {
+		cont, sleepFor := s.flush()
+		if !cont || !s.waitFlush(sleepFor) {
+			return
+		}
 	}
+}
 
-	log.Debug("periodic flushing finished")
+// waitFlush waits for d to pass or for enough late entries to be queued.  It
+// returns false if the statistics are closed earlier.
+func (s *StatsCtx) waitFlush(d time.Duration) (ok bool) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-s.lateReady:
+		return true
+	case <-s.done:
+		return false
+	}
 }
 
 func (s *StatsCtx) setLimit(limitDays int) {
@@ -488,6 +838,7 @@ func (s *StatsCtx) clear() (err error) {
 	defer s.currMu.Unlock()
 
 	s.curr = newUnit(s.unitIDGen())
+	s.late = nil
 
 	return nil
 }
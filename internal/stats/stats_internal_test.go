@@ -1,7 +1,10 @@
 package stats
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
@@ -103,3 +106,636 @@ func TestStats_races(t *testing.T) {
 		finWG.Wait()
 	}
 }
+
+func TestStats_lateEntries(t *testing.T) {
+	const limitHours = 24
+
+	now := time.Now()
+	curID := unitIDAt(now)
+
+	r := curID
+	conf := Config{
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&r) },
+		Filename:  filepath.Join(t.TempDir(), "./stats.db"),
+		LimitDays: limitHours / 24,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	newEntry := func(at time.Time) (e Entry) {
+		return Entry{
+			Domain: "example.org",
+			Client: "1.2.3.4",
+			Result: RNotFiltered,
+			At:     at,
+			Time:   1,
+		}
+	}
+
+	s.Update(newEntry(now))
+
+	atomic.StoreUint32(&r, curID+1)
+	cont, _ := s.flush()
+	require.True(t, cont)
+
+	// Made within the flushed unit.
+	s.Update(newEntry(now))
+	// Made beyond the interval.
+	s.Update(newEntry(now.Add(-2 * limitHours * time.Hour)))
+	// Made within the current unit.
+	s.Update(newEntry(now.Add(time.Hour)))
+
+	require.Len(t, s.late, 1)
+
+	// The late entries aren't merged each second.
+	cont, _ = s.flush()
+	require.True(t, cont)
+
+	require.Len(t, s.late, 1)
+
+	// Made within the unit the periodic flushing hasn't switched to yet.
+	atomic.StoreUint32(&r, curID+2)
+	s.Update(newEntry(now.Add(2 * time.Hour)))
+
+	require.Len(t, s.late, 2)
+
+	cont, _ = s.flush()
+	require.True(t, cont)
+
+	assert.Empty(t, s.late)
+
+	units, _ := s.loadUnits(limitHours)
+	require.Len(t, units, limitHours)
+
+	assert.Equal(t, uint64(2), units[limitHours-3].NTotal)
+	assert.Equal(t, uint64(1), units[limitHours-2].NTotal)
+	assert.Equal(t, uint64(1), units[limitHours-1].NTotal)
+}
+
+func TestStats_Import(t *testing.T) {
+	const limitHours = 24
+
+	now := time.Now()
+	curID := unitIDAt(now)
+	conf := Config{
+		UnitID:    func() (id uint32) { return curID },
+		Filename:  filepath.Join(t.TempDir(), "./stats.db"),
+		LimitDays: limitHours / 24,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	newEntry := func(at time.Time) (e Entry) {
+		return Entry{
+			Domain: "example.org",
+			Client: "1.2.3.4",
+			Result: RFiltered,
+			At:     at,
+		}
+	}
+
+	s.Import([]Entry{
+		newEntry(now.Add(-time.Hour)),
+		newEntry(now.Add(-time.Hour)),
+		newEntry(now),
+		{},
+	})
+
+	require.Len(t, s.late, 2)
+
+	// The numbers since the start aren't changed.
+	assert.Zero(t, atomic.LoadUint64(&s.resultTotal[RFiltered]))
+
+	// Merge the late entries along with the snapshot.
+	s.lastSnapshot = now.Add(-snapshotIvl)
+	cont, _ := s.flush()
+	require.True(t, cont)
+
+	units, _ := s.loadUnits(limitHours)
+	require.Len(t, units, limitHours)
+
+	assert.Equal(t, uint64(2), units[limitHours-2].NTotal)
+	assert.Equal(t, uint64(1), units[limitHours-1].NTotal)
+}
+
+func TestTimeHist(t *testing.T) {
+	h := newTimeHist("example.org")
+
+	// 94 fast requests and 6 slow ones.
+	for i := 0; i < 94; i++ {
+		h.add(800)
+	}
+
+	for i := 0; i < 6; i++ {
+		h.add(150_000)
+	}
+
+	assert.Equal(t, uint64(100), h.count())
+	assert.Equal(t, uint64((94*800+6*150_000)/100), h.avg())
+	assert.Equal(t, uint64(200_000), h.percentile(95))
+	assert.Equal(t, uint64(1_000), h.percentile(50))
+
+	t.Run("overflow", func(t *testing.T) {
+		oh := newTimeHist("example.net")
+		oh.add(10_000_000)
+
+		assert.Equal(t, latencyBounds[len(latencyBounds)-1], oh.percentile(95))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		mh := newTimeHist("example.org")
+		mh.merge(h)
+		mh.merge(h)
+
+		assert.Equal(t, 2*h.count(), mh.count())
+		assert.Equal(t, h.avg(), mh.avg())
+	})
+}
+
+func TestLatencyHists(t *testing.T) {
+	testCases := []struct {
+		name       string
+		buckets    []time.Duration
+		wantBounds []uint64
+	}{{
+		name:       "default",
+		buckets:    nil,
+		wantBounds: latencyBounds,
+	}, {
+		name:       "custom",
+		buckets:    []time.Duration{10 * time.Millisecond, 100 * time.Millisecond},
+		wantBounds: []uint64{10_000, 100_000},
+	}, {
+		name:       "not_ascending",
+		buckets:    []time.Duration{100 * time.Millisecond, 10 * time.Millisecond},
+		wantBounds: latencyBounds,
+	}, {
+		name:       "not_positive",
+		buckets:    []time.Duration{0, 10 * time.Millisecond},
+		wantBounds: latencyBounds,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lh := newLatencyHists(tc.buckets)
+			assert.Equal(t, tc.wantBounds, lh.bounds)
+			assert.Len(t, lh.total.Counts, len(tc.wantBounds)+1)
+		})
+	}
+
+	t.Run("add", func(t *testing.T) {
+		lh := newLatencyHists([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+		lh.add("", 5_000)
+		lh.add("tls://fast.example", 5_000)
+		lh.add("tls://slow.example", 50_000)
+		lh.add("tls://slow.example", 500_000)
+
+		assert.Equal(t, []uint64{2, 1, 1}, lh.total.Counts)
+		require.Len(t, lh.upstreams, 2)
+
+		slow := lh.upstreams["tls://slow.example"]
+		require.NotNil(t, slow)
+
+		assert.Equal(t, []uint64{0, 1, 1}, slow.Counts)
+		assert.Equal(t, uint64(100_000), slow.percentile(50))
+		assert.Equal(t, uint64(100_000), slow.percentile(99))
+		assert.Equal(t, uint64(10_000), lh.upstreams["tls://fast.example"].percentile(99))
+	})
+}
+
+func TestSlowestCollector(t *testing.T) {
+	u1, u2 := newUnit(0), newUnit(1)
+	u1.add(RNotFiltered, CacheMiss, "fast.example", "client", 1_000)
+	u1.add(RNotFiltered, CacheMiss, "slow.example", "client", 300_000)
+	u2.add(RNotFiltered, CacheHit, "slow.example", "client", 100_000)
+	u2.add(RFiltered, CacheNone, "blocked.example", "client", 900_000)
+
+	got := slowestCollector([]*unitDB{u1.serialize(), u2.serialize()}, 10)
+	require.Len(t, got, 2)
+
+	assert.Equal(t, SlowDomain{
+		Name:    "slow.example",
+		AvgTime: 0.2,
+		P95Time: 0.5,
+		Count:   2,
+	}, got[0])
+	assert.Equal(t, "fast.example", got[1].Name)
+}
+
+func TestProcessingTimeCollector(t *testing.T) {
+	u1, u2, u3 := newUnit(0), newUnit(1), newUnit(2)
+	u1.add(RNotFiltered, CacheMiss, "example.org", "client", 1_000)
+	u1.add(RFiltered, CacheNone, "example.net", "client", 3_000)
+	u3.add(RNotFiltered, CacheMiss, "example.org", "client", 300_000)
+
+	udb2 := u2.serialize()
+	udb2.TimeHist = nil
+
+	avgs, p95s := processingTimeCollector([]*unitDB{u1.serialize(), udb2, u3.serialize()}, 0, Hours)
+
+	assert.Equal(t, []float64{0.002, 0, 0.3}, avgs)
+	assert.Equal(t, []float64{0.005, 0, 0.5}, p95s)
+}
+
+func TestUnit_clientDomains(t *testing.T) {
+	u := newUnit(0)
+	for _, e := range []Entry{{
+		Domain: "example.org",
+		Result: RNotFiltered,
+	}, {
+		Domain: "example.org",
+		Result: RNotFiltered,
+	}, {
+		Domain: "ads.example",
+		Result: RFiltered,
+	}} {
+		u.addEntry(e, "client")
+		u.addClientDomain(e, "client")
+	}
+
+	udb := u.serialize()
+	require.Len(t, udb.ClientDomains, 1)
+	require.Len(t, udb.ClientBlocked, 1)
+
+	assert.Equal(t, []countPair{{Name: "example.org", Count: 2}}, udb.ClientDomains[0].Domains)
+	assert.Equal(t, []countPair{{Name: "ads.example", Count: 1}}, udb.ClientBlocked[0].Domains)
+
+	restored := newUnit(0)
+	restored.deserialize(udb)
+
+	assert.Equal(t, u.clientDomains, restored.clientDomains)
+	assert.Equal(t, u.clientBlocked, restored.clientBlocked)
+
+	t.Run("disabled", func(t *testing.T) {
+		du := newUnit(1)
+		du.addEntry(Entry{Domain: "example.org", Result: RNotFiltered}, "client")
+
+		dudb := du.serialize()
+		assert.Empty(t, dudb.ClientDomains)
+		assert.Empty(t, dudb.ClientBlocked)
+	})
+}
+
+func TestStatsCtx_snapshotLocked(t *testing.T) {
+	conf := Config{
+		UnitID:    func() (id uint32) { return 1 },
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	s.Update(Entry{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RNotFiltered,
+	})
+
+	loadCurrent := func() (udb *unitDB) {
+		tx, txErr := s.database().Begin(false)
+		require.NoError(t, txErr)
+		t.Cleanup(func() { _ = tx.Rollback() })
+
+		return loadUnitFromDB(tx, 1)
+	}
+
+	start := s.lastSnapshot
+
+	s.currMu.Lock()
+	s.snapshotLocked(start.Add(snapshotIvl / 2))
+	s.currMu.Unlock()
+
+	assert.Nil(t, loadCurrent())
+
+	s.currMu.Lock()
+	s.snapshotLocked(start.Add(snapshotIvl))
+	s.currMu.Unlock()
+
+	udb := loadCurrent()
+	require.NotNil(t, udb)
+
+	assert.Equal(t, uint64(1), udb.NTotal)
+}
+
+func TestStatsCtx_handleStats_interval(t *testing.T) {
+	var r uint32 = 1
+	conf := Config{
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&r) },
+		Filename:  filepath.Join(t.TempDir(), "./stats.db"),
+		LimitDays: 30,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	newEntry := func(domain string) (e Entry) {
+		return Entry{
+			Domain: domain,
+			Client: "1.2.3.4",
+			Result: RNotFiltered,
+			Time:   1,
+		}
+	}
+
+	s.Update(newEntry("old.example"))
+
+	// Ten days later.
+	atomic.StoreUint32(&r, 1+10*24)
+	cont, _ := s.flush()
+	require.True(t, cont)
+
+	s.Update(newEntry("new.example"))
+
+	bothTop := []map[string]uint64{{"new.example": 1}, {"old.example": 1}}
+	newTop := []map[string]uint64{{"new.example": 1}}
+
+	testCases := []struct {
+		name          string
+		query         string
+		wantTimeUnits string
+		wantTop       []map[string]uint64
+		wantLen       int
+		wantNum       uint64
+	}{{
+		name:          "default",
+		query:         "",
+		wantTimeUnits: "days",
+		wantTop:       bothTop,
+		wantLen:       30,
+		wantNum:       2,
+	}, {
+		name:          "day",
+		query:         "?interval=1",
+		wantTimeUnits: "hours",
+		wantTop:       newTop,
+		wantLen:       24,
+		wantNum:       1,
+	}, {
+		name:          "week",
+		query:         "?interval=7",
+		wantTimeUnits: "hours",
+		wantTop:       newTop,
+		wantLen:       7 * 24,
+		wantNum:       1,
+	}, {
+		name:          "month",
+		query:         "?interval=30",
+		wantTimeUnits: "days",
+		wantTop:       bothTop,
+		wantLen:       30,
+		wantNum:       2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleStats(w, httptest.NewRequest(http.MethodGet, "/control/stats"+tc.query, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			data := &StatsResp{}
+			err = json.NewDecoder(w.Body).Decode(data)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantTimeUnits, data.TimeUnits)
+			assert.ElementsMatch(t, tc.wantTop, data.TopQueried)
+			assert.Len(t, data.DNSQueries, tc.wantLen)
+			assert.Equal(t, tc.wantNum, data.NumDNSQueries)
+		})
+	}
+
+	badTestCases := []struct {
+		name  string
+		query string
+	}{{
+		name:  "beyond_retention",
+		query: "?interval=90",
+	}, {
+		name:  "unsupported",
+		query: "?interval=3",
+	}, {
+		name:  "zero",
+		query: "?interval=0",
+	}, {
+		name:  "not_a_number",
+		query: "?interval=week",
+	}}
+
+	for _, tc := range badTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleStats(w, httptest.NewRequest(http.MethodGet, "/control/stats"+tc.query, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestStatsCtx_handleStatsSeries(t *testing.T) {
+	base := time.Date(2022, time.October, 3, 12, 0, 0, 0, time.UTC)
+
+	r := unitIDAt(base)
+	conf := Config{
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&r) },
+		Filename:  filepath.Join(t.TempDir(), "./stats.db"),
+		LimitDays: 1,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	newEntry := func(res Result, at time.Time) (e Entry) {
+		return Entry{
+			Domain: "example.org",
+			Client: "1.2.3.4",
+			Result: res,
+			At:     at,
+			Time:   1,
+		}
+	}
+
+	s.Update(newEntry(RNotFiltered, base))
+	s.Update(newEntry(RFiltered, base.Add(7*time.Minute)))
+	s.Update(newEntry(RNotFiltered, base.Add(59*time.Minute)))
+
+	const path = "/control/stats_series"
+
+	t.Run("5m", func(t *testing.T) {
+		q := "?interval=5m&start=2022-10-03T12:00:00Z&end=2022-10-03T13:00:00Z"
+		w := httptest.NewRecorder()
+		s.handleStatsSeries(w, httptest.NewRequest(http.MethodGet, path+q, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &SeriesResp{}
+		err = json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		require.Len(t, resp.Points, slotsPerUnit)
+
+		assert.Equal(t, base.Add(5*time.Minute), resp.Points[1].Time)
+
+		assert.Equal(t, uint64(1), resp.Points[0].NumDNSQueries)
+		assert.Equal(t, uint64(0), resp.Points[0].NumBlocked)
+		assert.Equal(t, uint64(1), resp.Points[1].NumDNSQueries)
+		assert.Equal(t, uint64(1), resp.Points[1].NumBlocked)
+		assert.Equal(t, uint64(0), resp.Points[2].NumDNSQueries)
+		assert.Equal(t, uint64(1), resp.Points[11].NumDNSQueries)
+	})
+
+	t.Run("1h", func(t *testing.T) {
+		q := "?interval=1h&start=2022-10-03T11:30:00Z&end=2022-10-03T12:30:00Z"
+		w := httptest.NewRecorder()
+		s.handleStatsSeries(w, httptest.NewRequest(http.MethodGet, path+q, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &SeriesResp{}
+		err = json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, base.Add(-time.Hour), resp.Start)
+		assert.Equal(t, base.Add(time.Hour), resp.End)
+
+		require.Len(t, resp.Points, 2)
+
+		assert.Equal(t, uint64(0), resp.Points[0].NumDNSQueries)
+		assert.Equal(t, uint64(3), resp.Points[1].NumDNSQueries)
+		assert.Equal(t, uint64(1), resp.Points[1].NumBlocked)
+	})
+
+	t.Run("1d", func(t *testing.T) {
+		q := "?interval=1d&start=2022-10-03T00:00:00Z&end=2022-10-04T00:00:00Z"
+		w := httptest.NewRecorder()
+		s.handleStatsSeries(w, httptest.NewRequest(http.MethodGet, path+q, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &SeriesResp{}
+		err = json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		require.Len(t, resp.Points, 1)
+
+		assert.Equal(t, uint64(3), resp.Points[0].NumDNSQueries)
+	})
+
+	badTestCases := []struct {
+		name  string
+		query string
+	}{{
+		name:  "bad_interval",
+		query: "?interval=2h",
+	}, {
+		name:  "bad_start",
+		query: "?start=yesterday",
+	}, {
+		name:  "start_after_end",
+		query: "?start=2022-10-03T13:00:00Z&end=2022-10-03T12:00:00Z",
+	}, {
+		name:  "too_many_points",
+		query: "?interval=5m&start=2022-07-03T12:00:00Z&end=2022-10-03T12:00:00Z",
+	}}
+
+	for _, tc := range badTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleStatsSeries(w, httptest.NewRequest(http.MethodGet, path+tc.query, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestStatsCtx_handleStatsInsights(t *testing.T) {
+	var r uint32 = 1
+	conf := Config{
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&r) },
+		Filename:  filepath.Join(t.TempDir(), "./stats.db"),
+		LimitDays: 7,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	update := func(domain, client string, res Result, n int) {
+		for i := 0; i < n; i++ {
+			s.Update(Entry{
+				Domain: domain,
+				Client: client,
+				Result: res,
+				Time:   1,
+			})
+		}
+	}
+
+	// The previous window.
+	update("old.example", "1.1.1.1", RNotFiltered, 10)
+	update("ads.example", "2.2.2.2", RFiltered, 10)
+
+	// The current window, a day later.
+	atomic.StoreUint32(&r, 1+24)
+	cont, _ := s.flush()
+	require.True(t, cont)
+
+	update("old.example", "1.1.1.1", RNotFiltered, 12)
+	update("new.example", "3.3.3.3", RNotFiltered, 5)
+	update("ads.example", "2.2.2.2", RFiltered, 3)
+
+	const path = "/control/stats/insights"
+
+	t.Run("day", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleStatsInsights(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &InsightsResp{}
+		err = json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, uint32(24), resp.Window)
+		assert.Equal(t, &WindowSummary{
+			NumDNSQueries: 20,
+			NumBlocked:    10,
+			BlockRate:     0.5,
+		}, resp.Previous)
+		assert.Equal(t, &WindowSummary{
+			NumDNSQueries: 20,
+			NumBlocked:    3,
+			BlockRate:     0.15,
+		}, resp.Current)
+		assert.InDelta(t, -0.35, resp.BlockRateShift, 1e-9)
+
+		assert.Equal(t, []map[string]uint64{{"new.example": 5}}, resp.NewTopDomains)
+
+		// The change of 1.1.1.1 by 20% isn't notable.
+		assert.Equal(t, []*ClientChange{{
+			Client:   "2.2.2.2",
+			Previous: 10,
+			Current:  3,
+			Change:   -0.7,
+		}, {
+			Client:   "3.3.3.3",
+			Previous: 0,
+			Current:  5,
+			Change:   0,
+		}}, resp.ClientChanges)
+	})
+
+	t.Run("too_long", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleStatsInsights(w, httptest.NewRequest(http.MethodGet, path+"?window=85", nil))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleStatsInsights(w, httptest.NewRequest(http.MethodGet, path+"?window=0", nil))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
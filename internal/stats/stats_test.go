@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
 
@@ -49,11 +50,14 @@ func TestStats(t *testing.T) {
 	cliIP := net.IP{127, 0, 0, 1}
 	cliIPStr := cliIP.String()
 
+	clientsHidden := false
+
 	handlers := map[string]http.Handler{}
 	conf := stats.Config{
-		Filename:  filepath.Join(t.TempDir(), "stats.db"),
-		LimitDays: 1,
-		UnitID:    constUnitID,
+		ClientsHidden: func() (ok bool) { return clientsHidden },
+		Filename:      filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays:     1,
+		UnitID:        constUnitID,
 		HTTPRegister: func(_, url string, handler http.HandlerFunc) {
 			handlers[url] = handler
 		},
@@ -69,22 +73,38 @@ func TestStats(t *testing.T) {
 		const reqDomain = "domain"
 
 		entries := []stats.Entry{{
-			Domain: reqDomain,
-			Client: cliIPStr,
-			Result: stats.RFiltered,
-			Time:   123456,
+			Domain:         reqDomain,
+			Client:         cliIPStr,
+			Result:         stats.RFiltered,
+			RespCode:       stats.RespNXDomain,
+			BlockedService: "facebook",
+			Listener:       "udp://0.0.0.0:53",
+			Time:           123456,
 		}, {
-			Domain: reqDomain,
-			Client: cliIPStr,
-			Result: stats.RNotFiltered,
-			Time:   123456,
+			Domain:           reqDomain,
+			Client:           cliIPStr,
+			Result:           stats.RNotFiltered,
+			Cache:            stats.CacheHit,
+			RespCode:         stats.RespNoError,
+			Fallback:         true,
+			FallbackSwitched: true,
+			Upstream:         "tls://dns.example",
+			Listener:         "tcp://0.0.0.0:53",
+			Time:             123456,
 		}}
 
 		wantData := &stats.StatsResp{
-			TimeUnits:  "hours",
-			TopQueried: []map[string]uint64{0: {reqDomain: 1}},
-			TopClients: []map[string]uint64{0: {cliIPStr: 2}},
-			TopBlocked: []map[string]uint64{0: {reqDomain: 1}},
+			TimeUnits:          "hours",
+			TopQueried:         []map[string]uint64{0: {reqDomain: 1}},
+			TopClients:         []map[string]uint64{0: {cliIPStr: 2}},
+			TopBlocked:         []map[string]uint64{0: {reqDomain: 1}},
+			TopBlockedServices: []map[string]uint64{0: {"facebook": 1}},
+			TopSlowest: []stats.SlowDomain{{
+				Name:    reqDomain,
+				AvgTime: 0.123456,
+				P95Time: 0.2,
+				Count:   1,
+			}},
 			DNSQueries: []uint64{
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
@@ -101,12 +121,60 @@ func TestStats(t *testing.T) {
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 			},
+			CacheHits: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			CacheMisses: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			CacheNegativeHits: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			CacheStaleHits: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			FallbackQueries: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			NoErrorResponses: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			NXDomainResponses: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			ServFailResponses: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			RefusedResponses: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			NumFallbackQueries:      1,
+			NumNoErrorResponses:     1,
+			NumNXDomainResponses:    1,
 			NumDNSQueries:           2,
 			NumBlockedFiltering:     1,
 			NumReplacedSafebrowsing: 0,
 			NumReplacedSafesearch:   0,
 			NumReplacedParental:     0,
+			NumCacheHits:            1,
 			AvgProcessingTime:       0.123456,
+			AvgProcessingTimes: []float64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0.123456,
+			},
+			P95ProcessingTimes: []float64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0.2,
+			},
 		}
 
 		for _, e := range entries {
@@ -120,11 +188,142 @@ func TestStats(t *testing.T) {
 		assert.Equal(t, wantData, data)
 	})
 
+	t.Run("domain", func(t *testing.T) {
+		zeroes := make([]uint64, 23)
+		wantData := &stats.DomainStatsResp{
+			Name:       "domain",
+			TimeUnits:  "hours",
+			Queries:    append(zeroes, 1),
+			Blocked:    append(zeroes, 1),
+			NumQueries: 1,
+			NumBlocked: 1,
+		}
+
+		data := &stats.DomainStatsResp{}
+		req := httptest.NewRequest(http.MethodGet, "/control/stats/domain?name=Domain.", nil)
+		assertSuccessAndUnmarshal(t, data, handlers["/control/stats/domain"], req)
+
+		assert.Equal(t, wantData, data)
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/control/metrics", nil)
+		handlers["/control/metrics"].ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		body := w.Body.String()
+		assert.Contains(t, body, `adguard_home_dns_cache_requests_total{result="hit"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_cache_requests_total{result="miss"} 0`)
+		assert.Contains(t, body, "adguard_home_dns_fallback_requests_total 1")
+		assert.Contains(t, body, "adguard_home_dns_fallback_switches_total 1")
+		assert.Contains(t, body, `adguard_home_dns_upstream_requests_total{upstream="tls://dns.example"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_upstream_processing_seconds_sum{upstream="tls://dns.example"} 0.123456`)
+		assert.Contains(t, body, `adguard_home_dns_upstream_processing_seconds_bucket{upstream="tls://dns.example",le="0.1"} 0`)
+		assert.Contains(t, body, `adguard_home_dns_upstream_processing_seconds_bucket{upstream="tls://dns.example",le="0.2"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_upstream_processing_seconds_bucket{upstream="tls://dns.example",le="+Inf"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_listener_requests_total{listener="udp://0.0.0.0:53"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_listener_blocked_requests_total{listener="udp://0.0.0.0:53"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_listener_blocked_requests_total{listener="tcp://0.0.0.0:53"} 0`)
+		assert.Contains(t, body, `adguard_home_dns_listener_processing_seconds_count{listener="tcp://0.0.0.0:53"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_requests_total{result="filtered"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_responses_total{rcode="nxdomain"} 1`)
+		assert.Contains(t, body, `adguard_home_dns_responses_total{rcode="servfail"} 0`)
+		assert.Contains(t, body, `adguard_home_dns_requests_total{result="not_filtered"} 1`)
+		assert.Contains(t, body, "adguard_home_dns_cache_hit_ratio 1")
+		assert.Contains(t, body, `adguard_home_top_queried_domain_requests{domain="domain"} 1`)
+		assert.Contains(t, body, `adguard_home_top_client_requests{client="127.0.0.1"} 2`)
+
+		// The metrics are only served under /control, which is restricted for
+		// the delegated administrators.
+		require.NotContains(t, handlers, "/metrics")
+	})
+
+	t.Run("metrics_clients_hidden", func(t *testing.T) {
+		clientsHidden = true
+		t.Cleanup(func() { clientsHidden = false })
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/control/metrics", nil)
+		handlers["/control/metrics"].ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		body := w.Body.String()
+		assert.Contains(t, body, `adguard_home_top_queried_domain_requests{domain="domain"} 1`)
+		assert.NotContains(t, body, "adguard_home_top_client_requests")
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		buckets := func(n uint64) (b []uint64) {
+			b = make([]uint64, 13)
+			b[7] = n
+
+			return b
+		}
+
+		wantData := &stats.LatencyResp{
+			Overall: &stats.LatencyStats{
+				Buckets: buckets(2),
+				Count:   2,
+				AvgTime: 0.123456,
+				P50Time: 0.2,
+				P90Time: 0.2,
+				P99Time: 0.2,
+			},
+			BucketBounds: []float64{
+				0.001, 0.002, 0.005, 0.01, 0.02, 0.05,
+				0.1, 0.2, 0.5, 1, 2, 5,
+			},
+			Upstreams: []*stats.LatencyStats{{
+				Upstream: "tls://dns.example",
+				Buckets:  buckets(1),
+				Count:    1,
+				AvgTime:  0.123456,
+				P50Time:  0.2,
+				P90Time:  0.2,
+				P99Time:  0.2,
+			}},
+		}
+
+		data := &stats.LatencyResp{}
+		req := httptest.NewRequest(http.MethodGet, "/control/stats/latency", nil)
+		assertSuccessAndUnmarshal(t, data, handlers["/control/stats/latency"], req)
+
+		assert.Equal(t, wantData, data)
+	})
+
+	t.Run("listeners", func(t *testing.T) {
+		data := &stats.ListenersResp{}
+		req := httptest.NewRequest(http.MethodGet, "/control/stats/listeners", nil)
+		assertSuccessAndUnmarshal(t, data, handlers["/control/stats/listeners"], req)
+
+		require.Len(t, data.Listeners, 2)
+
+		tcp, udp := data.Listeners[0], data.Listeners[1]
+		assert.Equal(t, "tcp://0.0.0.0:53", tcp.Listener)
+		assert.Equal(t, uint64(1), tcp.NumDNSQueries)
+		assert.Equal(t, uint64(0), tcp.NumBlocked)
+
+		assert.Equal(t, "udp://0.0.0.0:53", udp.Listener)
+		assert.Equal(t, uint64(1), udp.NumDNSQueries)
+		assert.Equal(t, uint64(1), udp.NumBlocked)
+
+		require.NotNil(t, udp.Latency)
+
+		assert.Equal(t, 0.2, udp.Latency.P50Time)
+		assert.Empty(t, udp.Latency.Upstream)
+	})
+
 	t.Run("tops", func(t *testing.T) {
 		topClients := s.TopClientsIP(2)
 		require.NotEmpty(t, topClients)
 
 		assert.True(t, cliIP.Equal(topClients[0]))
+
+		topDomains := s.TopDomains(2)
+		require.Len(t, topDomains, 1)
+
+		assert.Equal(t, "domain", topDomains[0])
 	})
 
 	t.Run("reset", func(t *testing.T) {
@@ -132,15 +331,29 @@ func TestStats(t *testing.T) {
 		assertSuccessAndUnmarshal(t, nil, handlers["/control/stats_reset"], req)
 
 		_24zeroes := [24]uint64{}
+		_24floatZeroes := [24]float64{}
 		emptyData := &stats.StatsResp{
 			TimeUnits:            "hours",
 			TopQueried:           []map[string]uint64{},
 			TopClients:           []map[string]uint64{},
 			TopBlocked:           []map[string]uint64{},
+			TopBlockedServices:   []map[string]uint64{},
+			TopSlowest:           []stats.SlowDomain{},
 			DNSQueries:           _24zeroes[:],
 			BlockedFiltering:     _24zeroes[:],
 			ReplacedSafebrowsing: _24zeroes[:],
 			ReplacedParental:     _24zeroes[:],
+			CacheHits:            _24zeroes[:],
+			CacheMisses:          _24zeroes[:],
+			CacheNegativeHits:    _24zeroes[:],
+			CacheStaleHits:       _24zeroes[:],
+			FallbackQueries:      _24zeroes[:],
+			NoErrorResponses:     _24zeroes[:],
+			NXDomainResponses:    _24zeroes[:],
+			ServFailResponses:    _24zeroes[:],
+			RefusedResponses:     _24zeroes[:],
+			AvgProcessingTimes:   _24floatZeroes[:],
+			P95ProcessingTimes:   _24floatZeroes[:],
 		}
 
 		req = httptest.NewRequest(http.MethodGet, "/control/stats", nil)
@@ -194,3 +407,116 @@ func TestLargeNumbers(t *testing.T) {
 	assertSuccessAndUnmarshal(t, data, handlers["/control/stats"], req)
 	assert.Equal(t, hoursNum*cliNumPerHour, int(data.NumDNSQueries))
 }
+
+func TestStats_clientTop(t *testing.T) {
+	const (
+		cliIPStr  = "127.0.0.1"
+		cliPath   = "/control/stats/client/"
+		topPath   = cliPath + cliIPStr + "/top"
+		reqDomain = "example.org"
+	)
+
+	newStats := func(t *testing.T, perClient bool) (handlers map[string]http.Handler) {
+		t.Helper()
+
+		handlers = map[string]http.Handler{}
+		s, err := stats.New(stats.Config{
+			Filename:      filepath.Join(t.TempDir(), "stats.db"),
+			LimitDays:     1,
+			UnitID:        constUnitID,
+			PerClientTops: perClient,
+			HTTPRegister: func(_, url string, handler http.HandlerFunc) {
+				handlers[url] = handler
+			},
+		})
+		require.NoError(t, err)
+
+		s.Start()
+		testutil.CleanupAndRequireSuccess(t, s.Close)
+
+		for _, e := range []stats.Entry{{
+			Domain: reqDomain,
+			Client: cliIPStr,
+			Result: stats.RNotFiltered,
+		}, {
+			Domain: reqDomain,
+			Client: cliIPStr,
+			Result: stats.RNotFiltered,
+		}, {
+			Domain: "ads.example",
+			Client: cliIPStr,
+			Result: stats.RFiltered,
+		}, {
+			Domain: reqDomain,
+			Client: "127.0.0.2",
+			Result: stats.RNotFiltered,
+		}} {
+			s.Update(e)
+		}
+
+		return handlers
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		handlers := newStats(t, true)
+
+		data := &stats.ClientTopResp{}
+		req := httptest.NewRequest(http.MethodGet, topPath, nil)
+		assertSuccessAndUnmarshal(t, data, handlers[cliPath], req)
+
+		assert.Equal(t, &stats.ClientTopResp{
+			Client:     cliIPStr,
+			TopQueried: []map[string]uint64{{reqDomain: 2}},
+			TopBlocked: []map[string]uint64{{"ads.example": 1}},
+			NumQueries: 3,
+		}, data)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		handlers := newStats(t, false)
+
+		w := httptest.NewRecorder()
+		handlers[cliPath].ServeHTTP(w, httptest.NewRequest(http.MethodGet, topPath, nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("bad_path", func(t *testing.T) {
+		handlers := newStats(t, true)
+
+		w := httptest.NewRecorder()
+		handlers[cliPath].ServeHTTP(w, httptest.NewRequest(http.MethodGet, cliPath+cliIPStr, nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestStats_noCallbacks(t *testing.T) {
+	handlers := map[string]http.Handler{}
+	s, err := stats.New(stats.Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		HTTPRegister: func(_, url string, handler http.HandlerFunc) {
+			handlers[url] = handler
+		},
+	})
+	require.NoError(t, err)
+
+	s.Start()
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	s.Update(stats.Entry{
+		Domain: "example.org",
+		Client: "127.0.0.1",
+		Result: stats.RNotFiltered,
+	})
+	assert.Equal(t, []string{"example.org"}, s.TopDomains(10))
+
+	body := strings.NewReader(`{"interval":7}`)
+	req := httptest.NewRequest(http.MethodPost, "/control/stats_config", body)
+	assertSuccessAndUnmarshal(t, nil, handlers["/control/stats_config"], req)
+
+	dc := &stats.DiskConfig{}
+	s.WriteDiskConfig(dc)
+	assert.Equal(t, uint32(7), dc.Interval)
+}
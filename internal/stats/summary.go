@@ -0,0 +1,76 @@
+package stats
+
+// Summary is the statistics summed up over a period of time.
+type Summary struct {
+	// TopQueried are the most requested domain names with the numbers of
+	// requests.
+	TopQueried []topAddrs
+
+	// TopBlocked are the most blocked domain names with the numbers of
+	// requests.
+	TopBlocked []topAddrs
+
+	// NumDNSQueries is the total number of requests.
+	NumDNSQueries uint64
+
+	// NumBlocked is the number of requests blocked by the filtering rules, the
+	// safe browsing, and the parental control.
+	NumBlocked uint64
+
+	// NumFallbackQueries is the number of requests resolved by the fallback
+	// upstreams.
+	NumFallbackQueries uint64
+
+	// AvgProcessingTime and P95ProcessingTime are the average and the 95th
+	// percentile of processing time in seconds.
+	AvgProcessingTime float64
+	P95ProcessingTime float64
+}
+
+// BlockedPercent returns the percentage of blocked requests.
+func (sum *Summary) BlockedPercent() (p float64) {
+	if sum.NumDNSQueries == 0 {
+		return 0
+	}
+
+	return float64(sum.NumBlocked) * 100 / float64(sum.NumDNSQueries)
+}
+
+// Summary implements the Interface interface for *StatsCtx.
+func (s *StatsCtx) Summary(hours uint32, topLimit int) (sum *Summary, ok bool) {
+	if hours == 0 {
+		return &Summary{
+			TopQueried: []topAddrs{},
+			TopBlocked: []topAddrs{},
+		}, true
+	}
+
+	units, _ := s.loadUnits(hours)
+	if units == nil {
+		return nil, false
+	}
+
+	sum = &Summary{
+		TopQueried: topsCollector(units, topLimit, func(u *unitDB) (pairs []countPair) { return u.Domains }),
+		TopBlocked: topsCollector(units, topLimit, func(u *unitDB) (pairs []countPair) { return u.BlockedDomains }),
+	}
+
+	hist := newTimeHist("")
+	for _, u := range units {
+		sum.NumDNSQueries += u.NTotal
+		sum.NumBlocked += u.NResult[RFiltered] + u.NResult[RSafeBrowsing] + u.NResult[RParental]
+		sum.NumFallbackQueries += u.NFallback
+
+		if u.TimeHist != nil {
+			hist.merge(u.TimeHist)
+		}
+	}
+
+	sum.AvgProcessingTime = float64(hist.avg()) / usecsInSec
+	sum.P95ProcessingTime = float64(hist.percentile(95)) / usecsInSec
+
+	topsToUnicode(sum.TopQueried)
+	topsToUnicode(sum.TopBlocked)
+
+	return sum, true
+}
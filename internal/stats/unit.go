@@ -11,6 +11,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"go.etcd.io/bbolt"
+	"golang.org/x/net/idna"
 )
 
 // TODO(a.garipov): Rewrite all of this.  Add proper error handling and
@@ -21,6 +22,8 @@ const (
 	maxDomains = 100
 	// maxClients is the max number of top clients to return.
 	maxClients = 100
+	// maxServices is the max number of top blocked services to return.
+	maxServices = 100
 )
 
 // UnitIDGenFunc is the signature of a function that generates a unique ID for
@@ -65,6 +68,42 @@ type Entry struct {
 	// Result is the result of processing the request.
 	Result Result
 
+	// Cache is the result of looking up the DNS cache for the request.
+	Cache CacheResult
+
+	// RespCode is the class of the response code of the response sent to the
+	// client.
+	RespCode ResponseCode
+
+	// Fallback is true if the response has been received from the fallback
+	// upstreams.
+	Fallback bool
+
+	// FallbackSwitched is true if the request has caused the transition
+	// between the primary and the fallback upstreams.
+	FallbackSwitched bool
+
+	// Upstream is the address of the upstream, which has resolved the
+	// request.  It's empty if the response hasn't been received from an
+	// upstream, for example, if it's been served from the cache.
+	Upstream string
+
+	// BlockedService is the ID of the known service, to which the requested
+	// domain belongs, if the request has been blocked, for example "youtube".
+	// It's empty if the request hasn't been blocked or the domain doesn't
+	// belong to any known service.
+	BlockedService string
+
+	// Listener is the protocol and the local address of the listener, which
+	// has received the request, for example "udp://192.168.1.1:53".  It's
+	// empty if unknown.
+	Listener string
+
+	// At is the time the request has been received at.  It defines the unit
+	// the entry belongs to, even if the entry is made after the unit has been
+	// flushed.  If it's zero, the entry belongs to the current unit.
+	At time.Time
+
 	// Time is the duration of the request processing in milliseconds.
 	Time uint32
 }
@@ -82,27 +121,64 @@ type unit struct {
 	nTotal uint64
 	// nResult stores the number of requests grouped by it's result.
 	nResult []uint64
+	// nCache stores the number of requests grouped by the result of the
+	// cache lookup.
+	nCache []uint64
+	// nRespCode stores the number of responses grouped by the response code.
+	nRespCode []uint64
+	// nFallback stores the number of requests resolved by the fallback
+	// upstreams.
+	nFallback uint64
 	// timeSum stores the sum of processing time in milliseconds of each request
 	// written by the unit.
 	timeSum uint64
+	// nSlotTotal stores the number of requests within each slot of the unit.
+	nSlotTotal []uint64
+	// nSlotBlocked stores the number of requests, which have been blocked or
+	// replaced, within each slot of the unit.
+	nSlotBlocked []uint64
 
 	// domains stores the number of requests for each domain.
 	domains map[string]uint64
 	// blockedDomains stores the number of requests for each domain that has
 	// been blocked.
 	blockedDomains map[string]uint64
+	// blockedServices stores the number of blocked requests for the domains
+	// of each known service.
+	blockedServices map[string]uint64
 	// clients stores the number of requests from each client.
 	clients map[string]uint64
+	// domainsTime stores the histogram of processing time for each domain
+	// that hasn't been blocked.
+	domainsTime map[string]*timeHist
+	// timeHist stores the histogram of processing time of all the requests.
+	timeHist *timeHist
+
+	// clientDomains stores the number of requests for each domain that hasn't
+	// been blocked made by each client.  It's nil unless the per-client tops
+	// are enabled.
+	clientDomains map[string]map[string]uint64
+	// clientBlocked stores the number of requests for each domain that has
+	// been blocked made by each client.  It's nil unless the per-client tops
+	// are enabled.
+	clientBlocked map[string]map[string]uint64
 }
 
 // newUnit allocates the new *unit.
 func newUnit(id uint32) (u *unit) {
 	return &unit{
-		id:             id,
-		nResult:        make([]uint64, resultLast),
-		domains:        make(map[string]uint64),
-		blockedDomains: make(map[string]uint64),
-		clients:        make(map[string]uint64),
+		id:              id,
+		nResult:         make([]uint64, resultLast),
+		nCache:          make([]uint64, cacheResultLast),
+		nRespCode:       make([]uint64, respCodeLast),
+		nSlotTotal:      make([]uint64, slotsPerUnit),
+		nSlotBlocked:    make([]uint64, slotsPerUnit),
+		domains:         make(map[string]uint64),
+		blockedDomains:  make(map[string]uint64),
+		blockedServices: make(map[string]uint64),
+		clients:         make(map[string]uint64),
+		domainsTime:     make(map[string]*timeHist),
+		timeHist:        newTimeHist(""),
 	}
 }
 
@@ -119,24 +195,55 @@ type unitDB struct {
 	NTotal uint64
 	// NResult is the number of requests by the result's kind.
 	NResult []uint64
+	// NCache is the number of requests by the result of the cache lookup.
+	NCache []uint64
+	// NRespCode is the number of responses by the response code.  It's empty
+	// for the units stored by the older versions.
+	NRespCode []uint64
+	// NFallback is the number of requests resolved by the fallback upstreams.
+	NFallback uint64
+	// NSlotTotal is the number of requests within each slot of the unit.  It's
+	// empty for the units stored by the older versions.
+	NSlotTotal []uint64
+	// NSlotBlocked is the number of requests, which have been blocked or
+	// replaced, within each slot of the unit.  It's empty for the units stored
+	// by the older versions.
+	NSlotBlocked []uint64
 
 	// Domains is the number of requests for each domain name.
 	Domains []countPair
 	// BlockedDomains is the number of requests blocked for each domain name.
 	BlockedDomains []countPair
+	// BlockedServices is the number of requests blocked for the domain names
+	// of each known service.  It's empty for the units stored by the older
+	// versions.
+	BlockedServices []countPair
 	// Clients is the number of requests from each client.
 	Clients []countPair
+	// DomainsTime are the histograms of processing time for the slowest
+	// domain names.
+	DomainsTime []*timeHist
 
 	// TimeAvg is the average of processing times in milliseconds of all the
 	// requests in the unit.
 	TimeAvg uint32
+	// TimeHist is the histogram of processing time of all the requests in the
+	// unit.  It's nil for the units stored by the older versions.
+	TimeHist *timeHist
+
+	// ClientDomains are the most requested domain names, which haven't been
+	// blocked, of the most active clients.  It's empty if the per-client tops
+	// are disabled.
+	ClientDomains []clientPairs
+	// ClientBlocked are the most requested domain names, which have been
+	// blocked, of the most active clients.  It's empty if the per-client tops
+	// are disabled.
+	ClientBlocked []clientPairs
 }
 
 // newUnitID is the default UnitIDGenFunc that generates the unique id hourly.
 func newUnitID() (id uint32) {
-	const secsInHour = int64(time.Hour / time.Second)
-
-	return uint32(time.Now().Unix() / secsInHour)
+	return unitIDAt(time.Now())
 }
 
 func finishTxn(tx *bbolt.Tx, commit bool) (err error) {
@@ -207,12 +314,22 @@ func (u *unit) serialize() (udb *unitDB) {
 	}
 
 	return &unitDB{
-		NTotal:         u.nTotal,
-		NResult:        append([]uint64{}, u.nResult...),
-		Domains:        convertMapToSlice(u.domains, maxDomains),
-		BlockedDomains: convertMapToSlice(u.blockedDomains, maxDomains),
-		Clients:        convertMapToSlice(u.clients, maxClients),
-		TimeAvg:        timeAvg,
+		NTotal:          u.nTotal,
+		NResult:         append([]uint64{}, u.nResult...),
+		NCache:          append([]uint64{}, u.nCache...),
+		NRespCode:       append([]uint64{}, u.nRespCode...),
+		NFallback:       u.nFallback,
+		NSlotTotal:      append([]uint64{}, u.nSlotTotal...),
+		NSlotBlocked:    append([]uint64{}, u.nSlotBlocked...),
+		Domains:         convertMapToSlice(u.domains, maxDomains),
+		BlockedDomains:  convertMapToSlice(u.blockedDomains, maxDomains),
+		BlockedServices: convertMapToSlice(u.blockedServices, maxServices),
+		Clients:         convertMapToSlice(u.clients, maxClients),
+		DomainsTime:     convertHistsToSlice(u.domainsTime, maxSlowDomains),
+		TimeAvg:         timeAvg,
+		TimeHist:        u.timeHist.clone(),
+		ClientDomains:   convertClientMapToSlice(u.clientDomains, u.clients),
+		ClientBlocked:   convertClientMapToSlice(u.clientBlocked, u.clients),
 	}
 }
 
@@ -248,23 +365,66 @@ func (u *unit) deserialize(udb *unitDB) {
 	u.nTotal = udb.NTotal
 	u.nResult = make([]uint64, resultLast)
 	copy(u.nResult, udb.NResult)
+	u.nCache = make([]uint64, cacheResultLast)
+	copy(u.nCache, udb.NCache)
+	u.nRespCode = make([]uint64, respCodeLast)
+	copy(u.nRespCode, udb.NRespCode)
+	u.nFallback = udb.NFallback
+	u.nSlotTotal = make([]uint64, slotsPerUnit)
+	copy(u.nSlotTotal, udb.NSlotTotal)
+	u.nSlotBlocked = make([]uint64, slotsPerUnit)
+	copy(u.nSlotBlocked, udb.NSlotBlocked)
 	u.domains = convertSliceToMap(udb.Domains)
 	u.blockedDomains = convertSliceToMap(udb.BlockedDomains)
+	u.blockedServices = convertSliceToMap(udb.BlockedServices)
 	u.clients = convertSliceToMap(udb.Clients)
+	u.domainsTime = make(map[string]*timeHist, len(udb.DomainsTime))
+	for _, h := range udb.DomainsTime {
+		u.domainsTime[h.Name] = h
+	}
 	u.timeSum = uint64(udb.TimeAvg) * udb.NTotal
+	u.timeHist = newTimeHist("")
+	if udb.TimeHist != nil {
+		u.timeHist.merge(udb.TimeHist)
+	}
+	u.clientDomains = convertClientSliceToMap(udb.ClientDomains)
+	u.clientBlocked = convertClientSliceToMap(udb.ClientBlocked)
 }
 
 // add adds new data to u.  It's safe for concurrent use.
-func (u *unit) add(res Result, domain, cli string, dur uint64) {
+// addEntry adds the data of e made by the client with clientID to u.
+func (u *unit) addEntry(e Entry, clientID string) {
+	u.add(e.Result, e.Cache, e.Domain, clientID, uint64(e.Time))
+	u.nRespCode[e.RespCode]++
+	u.addSlot(e.At, e.Result)
+	if e.BlockedService != "" && e.Result != RNotFiltered {
+		u.blockedServices[e.BlockedService]++
+	}
+	if e.Fallback {
+		u.nFallback++
+	}
+}
+
+func (u *unit) add(res Result, cr CacheResult, domain, cli string, dur uint64) {
 	u.nResult[res]++
+	u.nCache[cr]++
 	if res == RNotFiltered {
 		u.domains[domain]++
+
+		h, ok := u.domainsTime[domain]
+		if !ok {
+			h = newTimeHist(domain)
+			u.domainsTime[domain] = h
+		}
+
+		h.add(dur)
 	} else {
 		u.blockedDomains[domain]++
 	}
 
 	u.clients[cli]++
 	u.timeSum += dur
+	u.timeHist.add(dur)
 	u.nTotal++
 }
 
@@ -300,6 +460,31 @@ func convertTopSlice(a []countPair) (m []map[string]uint64) {
 	return m
 }
 
+// topsToUnicode converts the internationalized domain names in tops into the
+// Unicode form.
+func topsToUnicode(tops []topAddrs) {
+	for i, top := range tops {
+		for name, n := range top {
+			if uni := domainToUnicode(name); uni != name {
+				tops[i] = topAddrs{uni: n}
+			}
+		}
+	}
+}
+
+// domainToUnicode returns the Unicode form of the internationalized domain
+// name.  name is returned as is if it can't be converted.
+func domainToUnicode(name string) (uni string) {
+	uni, err := idna.ToUnicode(name)
+	if err != nil {
+		log.Debug("stats: converting %q to unicode: %s", name, err)
+
+		return name
+	}
+
+	return uni
+}
+
 // numsGetter is a signature for statsCollector argument.
 type numsGetter func(u *unitDB) (num uint64)
 
@@ -377,14 +562,27 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		return StatsResp{
 			TimeUnits: "days",
 
-			TopBlocked: []topAddrs{},
-			TopClients: []topAddrs{},
-			TopQueried: []topAddrs{},
+			TopBlocked:         []topAddrs{},
+			TopBlockedServices: []topAddrs{},
+			TopClients:         []topAddrs{},
+			TopQueried:         []topAddrs{},
+			TopSlowest:         []SlowDomain{},
 
 			BlockedFiltering:     []uint64{},
 			DNSQueries:           []uint64{},
 			ReplacedParental:     []uint64{},
 			ReplacedSafebrowsing: []uint64{},
+			CacheHits:            []uint64{},
+			CacheMisses:          []uint64{},
+			CacheNegativeHits:    []uint64{},
+			CacheStaleHits:       []uint64{},
+			FallbackQueries:      []uint64{},
+			NoErrorResponses:     []uint64{},
+			NXDomainResponses:    []uint64{},
+			ServFailResponses:    []uint64{},
+			RefusedResponses:     []uint64{},
+			AvgProcessingTimes:   []float64{},
+			P95ProcessingTimes:   []float64{},
 		}, true
 	}
 
@@ -410,9 +608,22 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		ReplacedParental:     statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RParental] }),
 		TopQueried:           topsCollector(units, maxDomains, func(u *unitDB) (pairs []countPair) { return u.Domains }),
 		TopBlocked:           topsCollector(units, maxDomains, func(u *unitDB) (pairs []countPair) { return u.BlockedDomains }),
+		TopBlockedServices:   topsCollector(units, maxServices, func(u *unitDB) (pairs []countPair) { return u.BlockedServices }),
 		TopClients:           topsCollector(units, maxClients, func(u *unitDB) (pairs []countPair) { return u.Clients }),
+		TopSlowest:           slowestCollector(units, maxSlowDomains),
+		CacheHits:            statsCollector(units, firstID, timeUnit, cacheNumsGetter(CacheHit)),
+		CacheMisses:          statsCollector(units, firstID, timeUnit, cacheNumsGetter(CacheMiss)),
+		CacheNegativeHits:    statsCollector(units, firstID, timeUnit, cacheNumsGetter(CacheNegativeHit)),
+		CacheStaleHits:       statsCollector(units, firstID, timeUnit, cacheNumsGetter(CacheStaleHit)),
+		FallbackQueries:      statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NFallback }),
+		NoErrorResponses:     statsCollector(units, firstID, timeUnit, respCodeNumsGetter(RespNoError)),
+		NXDomainResponses:    statsCollector(units, firstID, timeUnit, respCodeNumsGetter(RespNXDomain)),
+		ServFailResponses:    statsCollector(units, firstID, timeUnit, respCodeNumsGetter(RespServFail)),
+		RefusedResponses:     statsCollector(units, firstID, timeUnit, respCodeNumsGetter(RespRefused)),
 	}
 
+	data.AvgProcessingTimes, data.P95ProcessingTimes = processingTimeCollector(units, firstID, timeUnit)
+
 	// Total counters:
 	sum := unitDB{
 		NResult: make([]uint64, resultLast),
@@ -428,6 +639,16 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		sum.NResult[RSafeBrowsing] += u.NResult[RSafeBrowsing]
 		sum.NResult[RSafeSearch] += u.NResult[RSafeSearch]
 		sum.NResult[RParental] += u.NResult[RParental]
+
+		data.NumCacheHits += u.cacheNum(CacheHit)
+		data.NumCacheMisses += u.cacheNum(CacheMiss)
+		data.NumCacheNegativeHits += u.cacheNum(CacheNegativeHit)
+		data.NumCacheStaleHits += u.cacheNum(CacheStaleHit)
+		data.NumFallbackQueries += u.NFallback
+		data.NumNoErrorResponses += u.respCodeNum(RespNoError)
+		data.NumNXDomainResponses += u.respCodeNum(RespNXDomain)
+		data.NumServFailResponses += u.respCodeNum(RespServFail)
+		data.NumRefusedResponses += u.respCodeNum(RespRefused)
 	}
 
 	data.NumDNSQueries = sum.NTotal
@@ -440,6 +661,14 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		data.AvgProcessingTime = float64(sum.TimeAvg/uint32(timeN)) / 1000000
 	}
 
+	// The internationalized domain names are stored in the ASCII form, but are
+	// shown in the Unicode one.
+	topsToUnicode(data.TopQueried)
+	topsToUnicode(data.TopBlocked)
+	for i := range data.TopSlowest {
+		data.TopSlowest[i].Name = domainToUnicode(data.TopSlowest[i].Name)
+	}
+
 	data.TimeUnits = "hours"
 	if timeUnit == Days {
 		data.TimeUnits = "days"
@@ -0,0 +1,172 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// latencyHists are the histograms of processing time of all the requests and
+// of the requests resolved by each upstream since the start.
+type latencyHists struct {
+	// total is the histogram of processing time of all the requests.
+	total *timeHist
+
+	// upstreams are the histograms of processing time of the requests
+	// resolved by each upstream.
+	upstreams map[string]*timeHist
+
+	// bounds are the upper bounds of the histogram buckets in microseconds.
+	bounds []uint64
+}
+
+// newLatencyHists returns the properly initialized *latencyHists using the
+// buckets upper bounds.  If buckets are empty or invalid, latencyBounds are
+// used.
+func newLatencyHists(buckets []time.Duration) (lh *latencyHists) {
+	bounds, err := latencyBucketsToBounds(buckets)
+	if err != nil {
+		log.Info("stats: warning: bad latency buckets: %s; using defaults", err)
+	}
+
+	if bounds == nil {
+		bounds = latencyBounds
+	}
+
+	return &latencyHists{
+		total:     newBoundedTimeHist("", bounds),
+		upstreams: map[string]*timeHist{},
+		bounds:    bounds,
+	}
+}
+
+// latencyBucketsToBounds converts buckets into the upper bounds of histogram
+// buckets in microseconds.  bounds are nil if buckets are empty.
+func latencyBucketsToBounds(buckets []time.Duration) (bounds []uint64, err error) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+
+	bounds = make([]uint64, 0, len(buckets))
+	for i, b := range buckets {
+		usecs := b.Microseconds()
+		if usecs <= 0 {
+			return nil, fmt.Errorf("bucket at index %d: %s is less than 1µs", i, b)
+		}
+
+		if i > 0 && uint64(usecs) <= bounds[i-1] {
+			return nil, fmt.Errorf("bucket at index %d: %s is not greater than previous", i, b)
+		}
+
+		bounds = append(bounds, uint64(usecs))
+	}
+
+	return bounds, nil
+}
+
+// add adds a request resolved by upstream, which took dur microseconds to
+// process, to lh.  upstream is empty if the request hasn't been resolved by
+// any upstream.
+func (lh *latencyHists) add(upstream string, dur uint64) {
+	lh.total.add(dur)
+	if upstream == "" {
+		return
+	}
+
+	h, ok := lh.upstreams[upstream]
+	if !ok {
+		h = newBoundedTimeHist(upstream, lh.bounds)
+		lh.upstreams[upstream] = h
+	}
+
+	h.add(dur)
+}
+
+// LatencyStats is the processing time statistics of a set of requests.
+type LatencyStats struct {
+	// Upstream is the address of the upstream, which resolved the requests.
+	// It's empty for the overall statistics.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Buckets are the numbers of requests within each of the buckets described
+	// by [LatencyResp.BucketBounds].  The last one contains the number of
+	// requests exceeding all the bounds.
+	Buckets []uint64 `json:"buckets"`
+
+	// Count is the number of the processed requests.
+	Count uint64 `json:"count"`
+
+	// AvgTime is the average processing time in seconds.
+	AvgTime float64 `json:"avg_time"`
+
+	// P50Time is the median processing time in seconds.
+	P50Time float64 `json:"p50_time"`
+
+	// P90Time is the 90th percentile of processing time in seconds.
+	P90Time float64 `json:"p90_time"`
+
+	// P99Time is the 99th percentile of processing time in seconds.
+	P99Time float64 `json:"p99_time"`
+}
+
+// newLatencyStats returns the statistics of the requests from h.
+func newLatencyStats(h *timeHist) (ls *LatencyStats) {
+	return &LatencyStats{
+		Upstream: h.Name,
+		Buckets:  append([]uint64{}, h.Counts...),
+		Count:    h.count(),
+		AvgTime:  float64(h.avg()) / usecsInSec,
+		P50Time:  float64(h.percentile(50)) / usecsInSec,
+		P90Time:  float64(h.percentile(90)) / usecsInSec,
+		P99Time:  float64(h.percentile(99)) / usecsInSec,
+	}
+}
+
+// LatencyResp is the response to the GET /control/stats/latency.
+type LatencyResp struct {
+	// Overall is the processing time statistics of all the requests.
+	Overall *LatencyStats `json:"overall"`
+
+	// BucketBounds are the upper bounds of the histogram buckets in seconds.
+	BucketBounds []float64 `json:"bucket_bounds"`
+
+	// Upstreams are the processing time statistics of the requests resolved
+	// by each upstream sorted by the address of the upstream.
+	Upstreams []*LatencyStats `json:"upstreams"`
+}
+
+// Latency implements the [Interface] interface for *StatsCtx.
+func (s *StatsCtx) Latency() (resp *LatencyResp) {
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	lh := s.latency
+	resp = &LatencyResp{
+		Overall:      newLatencyStats(lh.total),
+		BucketBounds: make([]float64, 0, len(lh.bounds)),
+		Upstreams:    make([]*LatencyStats, 0, len(lh.upstreams)),
+	}
+
+	for _, b := range lh.bounds {
+		resp.BucketBounds = append(resp.BucketBounds, float64(b)/usecsInSec)
+	}
+
+	addrs := maps.Keys(lh.upstreams)
+	slices.Sort(addrs)
+	for _, addr := range addrs {
+		resp.Upstreams = append(resp.Upstreams, newLatencyStats(lh.upstreams[addr]))
+	}
+
+	return resp
+}
+
+// handleStatsLatency handles requests to the GET /control/stats/latency
+// endpoint.
+func (s *StatsCtx) handleStatsLatency(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, s.Latency())
+}